@@ -0,0 +1,260 @@
+package userguide
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// secretFieldPattern matches the names of configuration fields holding
+// credentials, which are reported only as set or unset
+var secretFieldPattern = regexp.MustCompile(`(?i)(tokens?|secret|passwords?|keys)$`)
+
+// AdminHandler serves the /admin operator endpoints, guarded by admin.token
+// and the Basic auth credentials of admin.passwords and admin.password.file
+type AdminHandler struct {
+	fileService FileServiceInterface
+	tokens      []string
+	credentials *AdminCredentials
+	signer      *URLSigner
+	authorizer  Authorizer
+	schedule    *GuideSchedule
+	utils       *Utils
+	// usage and keys answer API key usage reports; usage is nil when off
+	usage *KeyUsageLedger
+	keys  *FileKeyStore
+	// analytics answers download interruption reports; nil when off
+	analytics *DownloadAnalytics
+	// purger serves POST /admin/cache/purge; nil leaves it unregistered
+	purger *CachePurger
+	// quotas answers storage usage reports; nil outside multi-product mode
+	quotas *QuotaManager
+	// audit answers audit log queries; nil when the log is off
+	audit *AuditLog
+	// quarantine and uploads manage quarantined guides; nil when virus
+	// scanning is off
+	quarantine *VirusScan
+	uploads    *UploadService
+	// router resolves the paths POST /sign is asked to sign
+	router *mux.Router
+
+	mu     sync.RWMutex
+	config *Config
+}
+
+// NewAdminHandler creates the admin handler; its routes are registered only
+// when admin.token is set or credentials is not nil
+func NewAdminHandler(fileService FileServiceInterface, authorizer Authorizer, schedule *GuideSchedule, credentials *AdminCredentials, config *Config) *AdminHandler {
+	ah := &AdminHandler{fileService: fileService, authorizer: authorizer, schedule: schedule, credentials: credentials, signer: NewURLSigner(config), utils: &Utils{}, config: config}
+	if config.AdminToken != "" {
+		ah.tokens = []string{config.AdminToken}
+	}
+	return ah
+}
+
+// ReportKeyUsage serves usage reports per API key from ledger; keys, when
+// not nil, names the owner of each key. Call before RegisterRoutes.
+func (ah *AdminHandler) ReportKeyUsage(ledger *KeyUsageLedger, keys *FileKeyStore) {
+	ah.usage, ah.keys = ledger, keys
+}
+
+// ReportInterruptions serves the interruption rates of analytics. Call
+// before RegisterRoutes.
+func (ah *AdminHandler) ReportInterruptions(analytics *DownloadAnalytics) {
+	ah.analytics = analytics
+}
+
+// ReportStorageUsage serves the usage of each product against its quota.
+// Call before RegisterRoutes.
+func (ah *AdminHandler) ReportStorageUsage(quotas *QuotaManager) {
+	ah.quotas = quotas
+}
+
+// ServeAuditLog serves queries of audit. Call before RegisterRoutes.
+func (ah *AdminHandler) ServeAuditLog(audit *AuditLog) {
+	ah.audit = audit
+}
+
+// PurgeCaches serves POST /admin/cache/purge with purger. Call before
+// RegisterRoutes.
+func (ah *AdminHandler) PurgeCaches(purger *CachePurger) {
+	ah.purger = purger
+}
+
+// ManageQuarantine serves the quarantine of scan, publishing released
+// guides through uploads. Call before RegisterRoutes.
+func (ah *AdminHandler) ManageQuarantine(scan *VirusScan, uploads *UploadService) {
+	ah.quarantine, ah.uploads = scan, uploads
+}
+
+// Enabled reports whether the admin routes are served
+func (ah *AdminHandler) Enabled() bool {
+	return len(ah.tokens) > 0 || ah.credentials != nil
+}
+
+// Reload replaces the configuration reported after a runtime change
+func (ah *AdminHandler) Reload(config *Config) {
+	ah.mu.Lock()
+	defer ah.mu.Unlock()
+	ah.config = config
+}
+
+// RegisterRoutes registers the admin routes with the router. They form one
+// /admin group behind AdminAuthMiddleware, so every endpoint added to it is
+// guarded the same way.
+func (ah *AdminHandler) RegisterRoutes(r *mux.Router) {
+	if !ah.Enabled() {
+		return
+	}
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(AdminAuthMiddleware(ah.tokens, ah.credentials))
+	admin.HandleFunc("/config", ah.ConfigHandler).Methods("GET")
+	admin.HandleFunc("/diagnostics", ah.DiagnosticsHandler).Methods("GET")
+	admin.HandleFunc("/schedule", ah.ScheduleHandler).Methods("GET")
+	admin.HandleFunc("/schedule/{name}", ah.UpdateScheduleHandler).Methods("PUT")
+	admin.HandleFunc("/schedule/{product}/{name}", ah.UpdateScheduleHandler).Methods("PUT")
+	if ah.audit != nil {
+		admin.HandleFunc("/audit", ah.AuditHandler).Methods("GET")
+		admin.HandleFunc("/audit/verify", ah.AuditVerifyHandler).Methods("GET")
+	}
+	if ah.analytics != nil {
+		admin.HandleFunc("/downloads/interruptions", ah.InterruptionsHandler).Methods("GET")
+	}
+	if ah.purger != nil {
+		admin.HandleFunc("/cache/purge", ah.PurgeHandler).Methods("POST")
+	}
+	if ah.quotas != nil {
+		admin.HandleFunc("/usage", ah.UsageHandler).Methods("GET")
+	}
+	if ah.quarantine != nil {
+		ah.registerQuarantineRoutes(admin)
+	}
+	if ah.usage != nil {
+		admin.Handle("/apikeys/{id}/report", Validate(ah.KeyReportHandler,
+			ParamRule{Source: PathParam, Name: "id", Required: true, Pattern: keyIDPattern},
+		)).Methods("GET")
+	}
+
+	if ah.signer != nil {
+		ah.router = r
+		r.Handle("/sign", AdminAuthMiddleware(ah.tokens, ah.credentials)(http.HandlerFunc(ah.SignHandler))).Methods("POST")
+	}
+}
+
+// permitted asks the authorizer about an admin action and writes the error
+// response when it is refused
+func (ah *AdminHandler) permitted(w http.ResponseWriter, r *http.Request, action, resource string) bool {
+	identity := identityFromRequest(r, ah.utils)
+	err := authorizeAdmin(r.Context(), ah.authorizer, identity, action, resource)
+	if err == nil {
+		return true
+	}
+	log.Printf("Denied %s on %s to %s: %s", action, resource, identity.Subject, err.Error())
+	if errors.Is(err, ErrUnauthenticated) || errors.Is(err, ErrForbidden) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	} else {
+		http.Error(w, "Authorization unavailable", http.StatusServiceUnavailable)
+	}
+	return false
+}
+
+// ConfigHandler returns the effective configuration, defaults included,
+// with credentials redacted
+func (ah *AdminHandler) ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.permitted(w, r, "config.read", "config") {
+		return
+	}
+	ah.mu.RLock()
+	config := ah.config
+	ah.mu.RUnlock()
+
+	sources := []string{"application.properties"}
+	if config.ConfigSource != "" {
+		sources = append(sources, config.ConfigSource+" "+redactURL(config.ConfigAddress))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sources": sources,
+		"config":  redactValue(reflect.ValueOf(config).Elem(), false),
+	})
+}
+
+// durationType is rendered as a duration string rather than nanoseconds
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// redactValue renders a configuration value as JSON-friendly data. Fields
+// named like credentials are replaced by a marker when set, and API keys in
+// ACL entries and passwords embedded in URLs are removed.
+func redactValue(v reflect.Value, secret bool) interface{} {
+	if v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		if re, ok := v.Interface().(*regexp.Regexp); ok {
+			return re.String()
+		}
+		return redactValue(v.Elem(), secret)
+	}
+	if secret {
+		if v.IsZero() {
+			return ""
+		}
+		return redacted
+	}
+
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Kind() == reflect.String:
+		return redactString(v.String())
+	case v.Kind() == reflect.Struct:
+		fields := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fields[field.Name] = redactValue(v.Field(i), secretFieldPattern.MatchString(field.Name))
+		}
+		return fields
+	case v.Kind() == reflect.Map:
+		entries := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			entries[key.String()] = redactValue(v.MapIndex(key), false)
+		}
+		return entries
+	case v.Kind() == reflect.Slice:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = redactValue(v.Index(i), false)
+		}
+		return items
+	}
+	return v.Interface()
+}
+
+// redactString hides the API key of an ACL entry and the password of a URL
+func redactString(value string) string {
+	if strings.HasPrefix(value, "key:") {
+		return "key:" + redacted
+	}
+	return redactURL(value)
+}
+
+// redactURL removes the password from a URL with credentials; other strings
+// are returned unchanged
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,32 @@
+package userguide
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAdminUsageRequiresAdminAuth(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.ProductsEnabled = true
+		config.UploadEnabled = true
+		config.UploadToken = "upload-token"
+		config.AdminToken = "admin-token"
+	})
+
+	tests := []struct {
+		name string
+		auth string
+		want int
+	}{
+		{"no credentials", "", http.StatusUnauthorized},
+		{"upload token", "Bearer upload-token", http.StatusUnauthorized},
+		{"admin token", "Bearer admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := h.Get(t, "/admin/usage", tt.auth); resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package userguide
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AdminCredentials holds the operators allowed to sign in to the /admin
+// routes with HTTP Basic auth: those listed in admin.passwords, with a plain
+// or bcrypt-hashed password, and those in the htpasswd-style
+// admin.password.file, which must be bcrypt-hashed. The file is re-read when
+// its modification time changes.
+type AdminCredentials struct {
+	static map[string]string
+	path   string
+	// dummy is compared against for unknown users so response timing does
+	// not reveal which user names exist
+	dummy []byte
+
+	mu      sync.Mutex
+	modTime time.Time
+	hashes  map[string][]byte
+}
+
+// NewAdminCredentials loads admin.passwords and admin.password.file; it
+// returns nil when neither is set
+func NewAdminCredentials(config *Config) (*AdminCredentials, error) {
+	if len(config.AdminPasswords) == 0 && config.AdminPasswordFile == "" {
+		return nil, nil
+	}
+	ac := &AdminCredentials{static: make(map[string]string), path: config.AdminPasswordFile}
+	for _, entry := range config.AdminPasswords {
+		user, password, ok := strings.Cut(entry, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("admin.passwords entries must be user:password")
+		}
+		ac.static[user] = password
+	}
+	if ac.path != "" {
+		if err := ac.reload(); err != nil {
+			return nil, err
+		}
+	}
+	random := make([]byte, 16)
+	rand.Read(random)
+	dummy, err := bcrypt.GenerateFromPassword(random, bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	ac.dummy = dummy
+	return ac, nil
+}
+
+// Check reports whether password is valid for user
+func (ac *AdminCredentials) Check(user, password string) bool {
+	if ac.path != "" {
+		if err := ac.reload(); err != nil {
+			// Keep answering from the last good copy of the file
+			log.Printf("Unable to reload admin passwords from %s: %s", ac.path, err.Error())
+		}
+	}
+	if stored, ok := ac.static[user]; ok {
+		if isBcryptHash(stored) {
+			return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+		}
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+	ac.mu.Lock()
+	hash, ok := ac.hashes[user]
+	ac.mu.Unlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(ac.dummy, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// reload re-reads the password file if it changed since it was last read
+func (ac *AdminCredentials) reload() error {
+	stat, err := os.Stat(ac.path)
+	if err != nil {
+		return err
+	}
+	ac.mu.Lock()
+	unchanged := ac.hashes != nil && stat.ModTime().Equal(ac.modTime)
+	ac.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(ac.path)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" || !isBcryptHash(hash) {
+			return fmt.Errorf("line %d of %s: entries must be user:<bcrypt hash>", line, ac.path)
+		}
+		hashes[user] = []byte(hash)
+	}
+
+	ac.mu.Lock()
+	ac.hashes = hashes
+	ac.modTime = stat.ModTime()
+	ac.mu.Unlock()
+	metrics.Set("userguide_admin_users_loaded", float64(len(hashes)+len(ac.static)))
+	return nil
+}
+
+// isBcryptHash reports whether s is a well-formed bcrypt hash
+func isBcryptHash(s string) bool {
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
+
+type adminUserContextKey struct{}
+
+// AdminUserFromContext returns the operator who signed in with Basic auth,
+// or "" when the request used the admin token
+func AdminUserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(adminUserContextKey{}).(string)
+	return user
+}
+
+// AdminAuthMiddleware guards the /admin route group. Requests need one of
+// the admin tokens as a bearer token or, when credentials is not nil, valid
+// Basic auth; others get a 401 inviting either.
+func AdminAuthMiddleware(tokens []string, credentials *AdminCredentials) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(tokens) > 0 && validBearerToken(r, tokens) {
+				next.ServeHTTP(w, withBearerToken(r))
+				return
+			}
+			if user, password, ok := r.BasicAuth(); ok && credentials != nil {
+				if credentials.Check(user, password) {
+					next.ServeHTTP(w, withIdentity(r.WithContext(context.WithValue(r.Context(), adminUserContextKey{}, user))))
+					return
+				}
+				log.Printf("Rejected admin sign-in for %q from %s", user, r.RemoteAddr)
+			} else {
+				log.Printf("Rejected unauthenticated request for %s from %s", r.URL.Path, r.RemoteAddr)
+			}
+			metrics.Inc("userguide_auth_failures_total")
+			if credentials != nil {
+				w.Header().Add("WWW-Authenticate", `Basic realm="userguide-admin", charset="UTF-8"`)
+			}
+			if len(tokens) > 0 {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="userguide"`)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package userguide
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrUnknownAPIKey is returned by a KeyStore for keys it does not hold
+var ErrUnknownAPIKey = errors.New("unknown API key")
+
+// APIKeyInfo is the metadata stored with an API key
+type APIKeyInfo struct {
+	Owner  string   `json:"owner"`
+	Scopes []string `json:"scopes,omitempty"`
+	// Tier is the QoS tier of the key; empty for the standard tier
+	Tier string `json:"tier,omitempty"`
+	// ExpiresAt is zero for keys that never expire
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Expired reports whether the key is past its expiry at now
+func (k *APIKeyInfo) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// HasScope reports whether the key grants scope; "*" grants every scope
+func (k *APIKeyInfo) HasScope(scope string) bool {
+	return scope == "" || slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, "*")
+}
+
+// KeyStore looks up the metadata of API keys presented in X-API-Key
+type KeyStore interface {
+	// Lookup returns ErrUnknownAPIKey when key is not held by the store
+	Lookup(ctx context.Context, key string) (*APIKeyInfo, error)
+}
+
+// apiKeyEntry is one key in the key file; only the key's SHA-256 is stored
+type apiKeyEntry struct {
+	SHA256 string `json:"sha256"`
+	APIKeyInfo
+}
+
+// apiKeyFile is the layout of apikeys.file
+type apiKeyFile struct {
+	Keys []apiKeyEntry `json:"keys"`
+}
+
+// FileKeyStore reads API keys from a JSON file holding their SHA-256 hashes.
+// The file is re-read when its modification time changes, so keys can be
+// added or revoked without a restart.
+type FileKeyStore struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	keys    map[string]*APIKeyInfo
+}
+
+// NewFileKeyStore loads the key file at path
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	ks := &FileKeyStore{path: path}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Lookup returns the metadata of key, picking up changes to the key file
+func (ks *FileKeyStore) Lookup(_ context.Context, key string) (*APIKeyInfo, error) {
+	if err := ks.reload(); err != nil {
+		// Keep answering from the last good copy of the file
+		log.Printf("Unable to reload API keys from %s: %s", ks.path, err.Error())
+	}
+	sum := sha256.Sum256([]byte(key))
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	info, ok := ks.keys[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, ErrUnknownAPIKey
+	}
+	return info, nil
+}
+
+// reload re-reads the key file if it changed since it was last read
+func (ks *FileKeyStore) reload() error {
+	stat, err := os.Stat(ks.path)
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	unchanged := ks.keys != nil && stat.ModTime().Equal(ks.modTime)
+	ks.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+	var file apiKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing %s: %w", ks.path, err)
+	}
+	keys := make(map[string]*APIKeyInfo, len(file.Keys))
+	for i, entry := range file.Keys {
+		sum := strings.ToLower(entry.SHA256)
+		if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+			return fmt.Errorf("key %d in %s: sha256 must be 64 hex characters", i+1, ks.path)
+		}
+		info := entry.APIKeyInfo
+		keys[sum] = &info
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.modTime = stat.ModTime()
+	ks.mu.Unlock()
+	metrics.Set("userguide_apikeys_loaded", float64(len(keys)))
+	return nil
+}
+
+type apiKeyContextKey struct{}
+
+// APIKeyFromContext returns the metadata of the key that authenticated the
+// request, or nil when the route does not require one
+func APIKeyFromContext(ctx context.Context) *APIKeyInfo {
+	info, _ := ctx.Value(apiKeyContextKey{}).(*APIKeyInfo)
+	return info
+}
+
+// APIKeyMiddleware rejects requests without a valid, unexpired X-API-Key
+// with 401, and keys lacking scope with 403
+func APIKeyMiddleware(store KeyStore, scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(APIKeyHeader)
+			if key == "" {
+				rejectAPIKey(w, r, "missing", http.StatusUnauthorized, "API key required")
+				return
+			}
+			info, err := store.Lookup(r.Context(), key)
+			switch {
+			case errors.Is(err, ErrUnknownAPIKey):
+				rejectAPIKey(w, r, "unknown", http.StatusUnauthorized, "Invalid API key")
+				return
+			case err != nil:
+				log.Printf("API key lookup failed: %s", err.Error())
+				http.Error(w, "Unable to verify API key", http.StatusServiceUnavailable)
+				return
+			case info.Expired(time.Now()):
+				rejectAPIKey(w, r, "expired", http.StatusUnauthorized, "API key expired")
+				return
+			case !info.HasScope(scope):
+				rejectAPIKey(w, r, "scope", http.StatusForbidden, "API key lacks the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, withIdentity(r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, info))))
+		})
+	}
+}
+
+func rejectAPIKey(w http.ResponseWriter, r *http.Request, reason string, status int, message string) {
+	presented := "none"
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		presented = keyFingerprint(key)
+	}
+	log.Printf("Rejected API key %s for %s from %s: %s", presented, r.URL.Path, r.RemoteAddr, reason)
+	metrics.Inc("userguide_apikey_rejections_total", "reason", reason)
+	http.Error(w, message, status)
+}
+
+// parseAPIKeyRoutes parses apikeys.routes entries of the form
+// <path template>[:<scope>]
+func parseAPIKeyRoutes(value string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, entry := range splitList(value) {
+		path, scope, _ := strings.Cut(entry, ":")
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("route %q must start with /", path)
+		}
+		routes[path] = strings.TrimSpace(scope)
+	}
+	return routes, nil
+}
+
+// runAPIKeyCommand generates a new API key and prints the entry to add to
+// apikeys.file; the key itself is shown only once
+func runAPIKeyCommand(args []string) error {
+	fs := flag.NewFlagSet("apikey", flag.ContinueOnError)
+	owner := fs.String("owner", "", "Owner recorded with the key")
+	scopes := fs.String("scopes", "", "Comma separated scopes the key grants")
+	ttl := fs.Duration("ttl", 0, "Lifetime of the key; 0 never expires")
+	tier := fs.String("tier", "", "QoS tier of the key; empty for standard")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *owner == "" {
+		return fmt.Errorf("usage: apikey -owner <name> [-scopes a,b] [-ttl 720h] [-tier gold]")
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	key := hex.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(key))
+	entry := apiKeyEntry{SHA256: hex.EncodeToString(sum[:]), APIKeyInfo: APIKeyInfo{Owner: *owner, Scopes: splitList(*scopes), Tier: *tier}}
+	if *ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(*ttl).UTC().Truncate(time.Second)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("API key: %s\n", key)
+	fmt.Printf("Add to the \"keys\" list of apikeys.file:\n%s\n", data)
+	return nil
+}
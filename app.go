@@ -0,0 +1,403 @@
+package userguide
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// App is the wired service: every route with its middlewares, and the
+// background work started around serving. main runs one over the configured
+// storage; tests run one over a fake.
+type App struct {
+	// Handler answers every request, Router holds the routes behind it
+	Handler http.Handler
+	Router  *mux.Router
+
+	config      *Config
+	scheduler   *Scheduler
+	leader      LeaderElector
+	fileHandler *FileHandler
+	guides      Storage
+	swap        *StorageSwap
+}
+
+// NewApp wires the service for config, serving guides, and reports what it
+// set up to boot. Watchers and replication run until ctx ends; scheduled
+// jobs wait for Start.
+func NewApp(ctx context.Context, config *Config, guides Storage, boot *BootReport) (*App, error) {
+	var err error
+
+	// Encrypted guides are decrypted chunk by chunk as they are read, which
+	// memory mapping and precompressed siblings would bypass
+	atRest, err = NewAtRestEncryption(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure encryption at rest: %v", err)
+	}
+	if atRest != nil {
+		boot.Backend("encryption keys", config.EncryptionProvider, "")
+		boot.Feature("guides encrypted at rest; memory-mapped and precompressed serving disabled")
+	}
+
+	if config.MmapEnabled && atRest == nil {
+		fileServer.hotFiles = newMmapCache(config.MmapThreshold, config.MmapMaxBytes)
+		boot.Feature("memory-mapped serving of files requested %d+ times per minute", config.MmapThreshold)
+	}
+
+	if config.PrecompressedEnabled && atRest == nil {
+		fileServer.siblings = newPrecompressedSiblings()
+	}
+	fileServer.digestMode = config.DigestMode
+	if config.DigestMode != DigestOff {
+		boot.Feature("download digests (%s)", config.DigestMode)
+	}
+
+	locker := NewLocker(config)
+	boot.Backend("locks", config.LockStore, "")
+	boot.Backend("rate limits", config.RateLimitStore, "")
+	checksums, err := NewChecksumStore(config.UserGuidePath, locker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checksums: %v", err)
+	}
+	schedule, err := NewGuideSchedule(config.UserGuidePath, checksums, locker)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load guide schedule: %v", err)
+	}
+
+	// Background jobs; singleton jobs run on the elected leader only
+	var leader LeaderElector
+	if config.LeaderElection != LeaderNone {
+		leader, err = NewLeaderElector(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure leader election: %v", err)
+		}
+		boot.Backend("leader election", config.LeaderElection, "lease "+config.LeaderLeaseName)
+	}
+	scheduler := NewScheduler(leader)
+	disk := NewDiskMonitor(config)
+	health.RegisterCheck("disk", disk.Check)
+	if config.DiskCheckInterval > 0 {
+		scheduler.Every("disk", config.DiskCheckInterval, disk.Check)
+	}
+	staging := NewStaging(config)
+	if scanner := NewOfficeScanner(config); scanner != nil {
+		staging.AddCheck(scanner.Check)
+	}
+	virusScan, err := NewVirusScan(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure virus scanning: %v", err)
+	}
+	if virusScan != nil {
+		staging.AddCheck(virusScan.Check)
+		boot.Backend("virus scanner", config.ScanEngine, "")
+		boot.Feature("virus scanning of uploads, quarantine in %s", virusScan.quarantine)
+	}
+	if config.ScheduleInterval > 0 {
+		scheduler.Singleton("guide-schedule", config.ScheduleInterval, schedule.Run)
+	}
+	// currentGuides follows storage swaps; swap is set further down
+	var swap *StorageSwap
+	currentGuides := func() Storage {
+		if swap != nil {
+			return swap.Current()
+		}
+		return guides
+	}
+	if config.IntegrityInterval > 0 {
+		scheduler.Singleton("integrity", config.IntegrityInterval, NewIntegrityVerifier(config, currentGuides, checksums, locker, staging).Run)
+		boot.Feature("integrity verification every %s", config.IntegrityInterval)
+	}
+	if config.ReplicationRole != ReplicationNone && config.ReplicationToken == "" {
+		return nil, fmt.Errorf("replication.token is required when replication.role is %s", config.ReplicationRole)
+	}
+	if config.ReplicationRole == ReplicationPrimary {
+		replicator := NewReplicator(config, checksums)
+		if config.ReplicationResync > 0 {
+			scheduler.Singleton("replication-resync", config.ReplicationResync, replicator.Resync)
+		}
+		go replicator.Run(ctx)
+		boot.Feature("replicating published guides to %s", strings.Join(config.ReplicationTargets, ", "))
+	}
+	authorizer, err := NewAuthorizer(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure authorizer: %v", err)
+	}
+	if bundles, ok := authorizer.(interface{ LoadBundle(context.Context) error }); ok && config.OPABundleURL != "" {
+		// Every replica has its own policy sidecar to keep current
+		scheduler.Every("opa-bundle", config.OPABundleRefresh, bundles.LoadBundle)
+	}
+
+	// Initialize service with interface
+	var fileService FileServiceInterface = NewFileService(config, chaosGuides(config, guides))
+	adminCredentials, err := NewAdminCredentials(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin credentials: %v", err)
+	}
+	admin := NewAdminHandler(fileService, authorizer, schedule, adminCredentials, config)
+
+	// Watch the remote configuration source for runtime changes
+	if config.ConfigSource != "" {
+		source, err := NewConfigSource(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create config source: %v", err)
+		}
+		watcher := NewConfigWatcher("application.properties", source, config.ConfigWatchInterval)
+		if reloadable, ok := fileService.(interface{ Reload(*Config) }); ok {
+			watcher.OnChange(reloadable.Reload)
+		}
+		watcher.OnChange(admin.Reload)
+		if files, ok := fileService.(*FileService); ok {
+			swap = NewStorageSwap(ctx, config, guides, files)
+			watcher.OnChange(swap.Reload)
+			boot.Feature("guide storage swapped on reload, draining old downloads for up to %s", config.StorageDrainTimeout)
+		}
+		go watcher.Run(ctx)
+		boot.Backend("config source", config.ConfigSource, fmt.Sprintf("%s, prefix %q", redactURL(config.ConfigAddress), config.ConfigPrefix))
+	}
+	if chaosEnabled() {
+		boot.Warn("chaos mode enabled (%+v)", config.Chaos)
+	}
+	storage := NewStorageMonitor(config, guides)
+	fileService = storage.Instrument(config.StorageType, fileService)
+	health.RegisterCheck("storage", storage.Check)
+	boot.Backend("storage", config.StorageType, describeStorage(config, guides))
+	protectedEnabled := config.ProtectedPath != "" && (len(config.ProtectedTokens) > 0 || config.JWTJWKSURL != "")
+	if config.ProtectedPath != "" && !protectedEnabled {
+		boot.Warn("protected.path is set but neither protected.tokens nor jwt.jwks.url is; protected guides disabled")
+	}
+	if protectedEnabled {
+		boot.Backend("protected storage", StorageBackendLocal, config.ProtectedPath)
+	}
+	fileHandler := NewFileHandler(fileService, authorizer, config)
+	if swap != nil {
+		fileHandler.UseStorageSwap(swap)
+	}
+	if shadow := NewTrafficShadow(config); shadow != nil {
+		fileHandler.MirrorDownloads(shadow)
+		go shadow.Run(ctx)
+		boot.Feature("%s", shadow)
+	}
+	var keys *FileKeyStore
+	if config.APIKeysFile != "" {
+		keys, err = NewFileKeyStore(config.APIKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load API keys: %v", err)
+		}
+		fileHandler.RequireAPIKey(keys, config.APIKeyRoutes)
+		boot.Backend("api keys", "file", config.APIKeysFile)
+		boot.Feature("API key required on %d routes", len(config.APIKeyRoutes))
+	} else if len(config.APIKeyRoutes) > 0 {
+		return nil, fmt.Errorf("apikeys.routes is set but apikeys.file is not")
+	}
+	if introspector := NewTokenIntrospector(config); introspector != nil {
+		fileHandler.RequireIntrospection(introspector, config.OAuthRoutes, config.OAuthRequiredScope)
+		boot.Feature("OAuth2 token with scope %q required on %s", config.OAuthRequiredScope, strings.Join(config.OAuthRoutes, ", "))
+	}
+	oidc := NewOIDCClient(config)
+	if oidc != nil {
+		if config.OIDCClientID == "" || config.OIDCRedirectURL == "" {
+			return nil, fmt.Errorf("oidc.issuer is set but oidc.client.id or oidc.redirect.url is not")
+		}
+		fileHandler.RequireOIDC(oidc, config.OIDCRoutes)
+		boot.Feature("OpenID Connect sign-in with %s required on %s", config.OIDCIssuer, strings.Join(config.OIDCRoutes, ", "))
+	}
+	auditLog, err := NewAuditLog(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	if auditLog != nil {
+		admin.ServeAuditLog(auditLog)
+		boot.Backend("audit log", "file", config.AuditLogFile)
+	}
+	admin.PurgeCaches(NewCachePurger(config, fileHandler))
+	if config.CDNPurgeURL != "" {
+		boot.Backend("cdn purge", "http", redactURL(config.CDNPurgeURL))
+	}
+	if usage := NewKeyUsageLedger(config); usage != nil {
+		fileHandler.TrackKeyUsage(usage)
+		admin.ReportKeyUsage(usage, keys)
+		boot.Feature("API key downloads recorded in %s", config.APIKeyUsageFile)
+	}
+	if analytics := NewDownloadAnalytics(config); analytics != nil {
+		fileHandler.TrackInterruptions(analytics)
+		admin.ReportInterruptions(analytics)
+		boot.Feature("download interruptions tracked over %s", config.DownloadAnalyticsWindow)
+	}
+	rbac, err := NewRBACPolicy(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load RBAC policy: %v", err)
+	}
+	if rbac != nil {
+		fileHandler.RequireRoles(rbac)
+		boot.Feature("guide roles enforced from %s (roles claim %q)", config.RBACPolicyFile, config.RBACRolesClaim)
+	}
+	sessions := NewSessions(config)
+	if sessions != nil && !fileHandler.UseSessions(sessions) {
+		boot.Warn("session.enabled is set but protected routes are off; sessions disabled")
+		sessions = nil
+	}
+	if sessions != nil {
+		boot.Backend("sessions", config.SessionStore, fmt.Sprintf("ttl %s, idle timeout %s", config.SessionTTL, config.SessionIdleTimeout))
+	}
+	// Create router
+	r := mux.NewRouter()
+	r.Use(identityMiddleware)
+	r.Use(NewRouteMetrics(config).Middleware)
+	r.Use(NewIPFilter(config).Middleware)
+	if auditLog != nil {
+		r.Use(auditLog.Middleware)
+	}
+	if len(config.IPAllow) > 0 || len(config.IPDeny) > 0 {
+		boot.Feature("client addresses filtered: %d allow and %d deny ranges", len(config.IPAllow), len(config.IPDeny))
+	}
+	r.Use(NewHeaderPolicy(config).Middleware)
+	r.Use(securityMiddleware(config))
+	if config.TLSClientCAFile != "" {
+		r.Use(clientCertMiddleware)
+		boot.Feature("client certificates signed by %s: %s", config.TLSClientCAFile, config.TLSClientAuth)
+	}
+	if config.RecordingMode != RecordingOff {
+		recorder, err := NewRecorder(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up recording: %v", err)
+		}
+		boot.Warn("%s mode enabled, fixtures in %s", config.RecordingMode, config.RecordingPath)
+		r.Use(recorder.Middleware)
+	}
+	if !config.ZeroCopy {
+		boot.Feature("buffered file serving, zero-copy disabled")
+		r.Use(bufferedOnlyMiddleware)
+	}
+	var keyStore KeyStore
+	if keys != nil {
+		keyStore = keys
+	}
+	r.Use(NewQoS(config, keyStore).Middleware)
+	r.Use(AuditMiddleware(config))
+	csrf := NewCSRFGuard(config)
+	if csrf != nil {
+		r.Use(csrf.Middleware)
+		csrf.RegisterRoutes(r)
+		boot.Feature("CSRF tokens required on %s routes", strings.Join(config.CSRFGroups, ", "))
+	}
+	if len(config.HotlinkAllowedOrigins) > 0 {
+		r.Use(NewHotlinkGuard(config).Middleware())
+		boot.Feature("guide links allowed from %s", strings.Join(config.HotlinkAllowedOrigins, ", "))
+	}
+	if chaosEnabled() {
+		r.Use(chaosMiddleware(config.Chaos))
+	}
+	if netsim := NewNetworkSimulator(config); netsim != nil {
+		if _, ok := config.NetworkProfiles[config.NetsimDefault]; config.NetsimDefault != "" && !ok {
+			return nil, fmt.Errorf("netsim.default names unknown profile %q", config.NetsimDefault)
+		}
+		r.Use(netsim.Middleware)
+		fallback := "full speed"
+		if config.NetsimDefault != "" {
+			fallback = config.NetsimDefault
+		}
+		boot.Warn("network simulation enabled: responses at %s unless ?%s= picks one of %s",
+			fallback, NetsimParam, netsim.Profiles())
+	}
+
+	// Register routes using handler method
+	fileHandler.RegisterRoutes(r)
+	NewBlobHandler(fileHandler, checksums).RegisterRoutes(r)
+	NewCatalogHandler(fileHandler, checksums).RegisterRoutes(r)
+	quotas := NewQuotaManager(config, currentGuides)
+	uploadService := NewUploadService(config, checksums, disk, quotas, locker, staging, schedule)
+	uploadService.PublishTo(guides)
+	if swap != nil {
+		swap.Retarget(uploadService, storage, checksums)
+	}
+	if virusScan != nil {
+		admin.ManageQuarantine(virusScan, uploadService)
+	}
+	if config.ProductsEnabled {
+		admin.ReportStorageUsage(quotas)
+	}
+	admin.RegisterRoutes(r)
+	if oidc != nil {
+		oidc.RegisterRoutes(r)
+	}
+	if sessions != nil {
+		sessions.RegisterRoutes(r)
+	}
+
+	uploadEnabled := config.UploadEnabled && config.UploadToken != ""
+	if uploadEnabled && config.ReplicationRole == ReplicationSecondary {
+		// Passive regions only accept guides pushed by the primary
+		boot.Warn("upload.enabled is ignored on a replication secondary")
+		uploadEnabled = false
+	}
+	if uploadEnabled {
+		NewUploadHandler(uploadService, authorizer, config.ProductsEnabled, config.UploadToken).RegisterRoutes(r)
+	} else if config.UploadEnabled && config.UploadToken == "" {
+		boot.Warn("upload.enabled is set but upload.token is empty; uploads disabled")
+	}
+	if uploadEnabled || config.ReplicationRole == ReplicationSecondary || config.IntegrityMirrorURL != "" {
+		// Fail at startup rather than on the first publish
+		if err := staging.Prepare(); err != nil {
+			return nil, fmt.Errorf("failed to prepare staging directory: %v", err)
+		}
+	}
+	if config.ReplicationRole == ReplicationSecondary {
+		NewReplicationHandler(uploadService, checksums, config).RegisterRoutes(r)
+	}
+
+	previewEnabled := config.PreviewPath != "" && config.PreviewSecret != ""
+	if previewEnabled {
+		NewPreviewHandler(NewPreviewService(config)).RegisterRoutes(r)
+	}
+
+	var handler http.Handler = r
+	if cors := NewCORS(config); cors != nil {
+		handler = cors.Middleware(r)
+		boot.Feature("cross-origin requests allowed from %s", strings.Join(config.CORSAllowedOrigins, ", "))
+	}
+
+	boot.AddRoutes(r)
+	return &App{
+		Handler:     handler,
+		Router:      r,
+		config:      config,
+		scheduler:   scheduler,
+		leader:      leader,
+		fileHandler: fileHandler,
+		guides:      guides,
+		swap:        swap,
+	}, nil
+}
+
+// Start runs the scheduled jobs and the warm-up, then reports the service
+// ready
+func (app *App) Start(ctx context.Context) {
+	app.scheduler.Start(ctx)
+	if app.config.WarmupEnabled {
+		warmupCtx, cancel := context.WithTimeout(ctx, app.config.WarmupTimeout)
+		runWarmUp(warmupCtx, app.config, app.currentGuides(), app.fileHandler)
+		cancel()
+	}
+	ready.Store(true)
+}
+
+// Close reports the service no longer ready, gives up leadership and
+// releases the guide storage once requests have stopped
+func (app *App) Close(ctx context.Context) {
+	ready.Store(false)
+	if app.leader != nil {
+		app.leader.Resign(ctx)
+	}
+	closeStorage(app.currentGuides())
+}
+
+// currentGuides returns the storage guides are served from
+func (app *App) currentGuides() Storage {
+	if app.swap != nil {
+		return app.swap.Current()
+	}
+	return app.guides
+}
@@ -0,0 +1,113 @@
+package userguide
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+)
+
+// Support case headers clients may send with a download
+const (
+	TicketIDHeader   = "X-Ticket-ID"
+	CustomerIDHeader = "X-Customer-ID"
+	// DownloadIDHeader carries the receipt identifying a download's audit record
+	DownloadIDHeader = "X-Download-ID"
+)
+
+// EventGuideDownloaded is the audit record published for every guide served
+const EventGuideDownloaded = "guide.downloaded"
+
+// defaultAuditIDPattern matches ticket and customer identifiers unless configured
+var defaultAuditIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,63}$`)
+
+// AuditContext ties a download to a support case
+type AuditContext struct {
+	TicketID   string
+	CustomerID string
+}
+
+type auditContextKey struct{}
+
+// auditContextFrom returns the support case attached to a request, if any
+func auditContextFrom(ctx context.Context) AuditContext {
+	audit, _ := ctx.Value(auditContextKey{}).(AuditContext)
+	return audit
+}
+
+// AuditMiddleware validates the X-Ticket-ID and X-Customer-ID headers,
+// rejecting malformed values with 400, and echoes accepted values so the
+// client's receipt names the case the download was recorded against
+func AuditMiddleware(config *Config) mux.MiddlewareFunc {
+	rules := []ParamRule{
+		{Source: HeaderParam, Name: TicketIDHeader, Pattern: config.AuditTicketPattern},
+		{Source: HeaderParam, Name: CustomerIDHeader, Pattern: config.AuditCustomerPattern},
+	}
+	return func(next http.Handler) http.Handler {
+		return Validate(func(w http.ResponseWriter, r *http.Request) {
+			audit := AuditContext{
+				TicketID:   r.Header.Get(TicketIDHeader),
+				CustomerID: r.Header.Get(CustomerIDHeader),
+			}
+			if audit == (AuditContext{}) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if audit.TicketID != "" {
+				w.Header().Set(TicketIDHeader, audit.TicketID)
+			}
+			if audit.CustomerID != "" {
+				w.Header().Set(CustomerIDHeader, audit.CustomerID)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, audit)))
+		}, rules...)
+	}
+}
+
+// recordDownload publishes the audit record of a guide about to be served
+// and returns its identifier to the client in X-Download-ID
+func (fh *FileHandler) recordDownload(w http.ResponseWriter, r *http.Request, guide string) {
+	w.Header().Set(DownloadIDHeader, fh.publishDownload(r, guide))
+}
+
+// publishDownload publishes the audit record of a guide about to be served
+// and returns its identifier
+func (fh *FileHandler) publishDownload(r *http.Request, guide string) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	downloadID := hex.EncodeToString(id)
+
+	identity := identityFromRequest(r, fh.utils)
+	data := map[string]string{
+		"download_id": downloadID,
+		"client":      identity.Subject,
+		"auth":        identity.Method,
+		"ip":          fh.utils.ClientIP(r),
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		data["range"] = rangeHeader
+	}
+	audit := auditContextFrom(r.Context())
+	if audit.TicketID != "" {
+		data["ticket_id"] = audit.TicketID
+	}
+	if audit.CustomerID != "" {
+		data["customer_id"] = audit.CustomerID
+	}
+	events.Publish(Event{Type: EventGuideDownloaded, Subject: guide, Data: data})
+	if usage := keyDownloadFromContext(r.Context()); usage != nil {
+		usage.Guides = append(usage.Guides, guide)
+		if usage.DownloadID == "" {
+			usage.DownloadID = downloadID
+		}
+	}
+	if attempt := downloadAttemptFromContext(r.Context()); attempt != nil {
+		attempt.Guides = append(attempt.Guides, guide)
+	}
+	// Guides that exist bound the label values, unlike requested names
+	metrics.Inc("userguide_guide_downloads_total", "guide", guide)
+	return downloadID
+}
@@ -0,0 +1,382 @@
+package userguide
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events published for the audit log by AuditLog.Middleware
+const (
+	EventAuthFailed  = "auth.failed"
+	EventAdminAction = "admin.action"
+)
+
+// Audit record categories
+const (
+	AuditCategoryDownload = "download"
+	AuditCategoryAuth     = "auth"
+	AuditCategoryConfig   = "config"
+	AuditCategoryAdmin    = "admin"
+)
+
+// auditCategories picks the events kept in the audit log
+var auditCategories = map[string]string{
+	EventGuideDownloaded: AuditCategoryDownload,
+	EventAuthFailed:      AuditCategoryAuth,
+	EventConfigReloaded:  AuditCategoryConfig,
+	EventAdminAction:     AuditCategoryAdmin,
+}
+
+// maxAuditQueryLimit caps the records one query returns
+const maxAuditQueryLimit = 1000
+
+// AuditRecord is one entry of the audit log. Each record carries the hash
+// of the one before it, so editing or removing a record breaks the chain
+// from that point on.
+type AuditRecord struct {
+	Seq      int64             `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Category string            `json:"category"`
+	Action   string            `json:"action"`
+	Actor    string            `json:"actor,omitempty"`
+	ClientIP string            `json:"clientIp,omitempty"`
+	Resource string            `json:"resource,omitempty"`
+	Result   string            `json:"result"`
+	Detail   map[string]string `json:"detail,omitempty"`
+	PrevHash string            `json:"prevHash"`
+	Hash     string            `json:"hash"`
+}
+
+// digest is the hash of the record without its own hash field
+func (ar AuditRecord) digest() string {
+	ar.Hash = ""
+	data, _ := json.Marshal(ar)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog writes downloads, authentication failures, configuration
+// reloads and admin actions to an append-only JSON lines file, taking them
+// from the event bus
+type AuditLog struct {
+	path  string
+	utils *Utils
+
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	last string
+}
+
+// NewAuditLog opens audit.log.file, continuing the hash chain of the
+// records already in it; it returns nil when no file is configured
+func NewAuditLog(config *Config) (*AuditLog, error) {
+	if config.AuditLogFile == "" {
+		return nil, nil
+	}
+	al := &AuditLog{path: config.AuditLogFile, utils: &Utils{}}
+	err := al.scan(func(record AuditRecord) bool {
+		al.seq, al.last = record.Seq, record.Hash
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	al.file, err = os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	events.Subscribe(al.record)
+	return al, nil
+}
+
+// record appends the audit record of an event the log keeps
+func (al *AuditLog) record(e Event) {
+	category, ok := auditCategories[e.Type]
+	if !ok {
+		return
+	}
+	record := AuditRecord{Time: e.Time, Category: category, Action: e.Type, Resource: e.Subject, Result: "success"}
+	for key, value := range e.Data {
+		switch key {
+		case "client", "actor":
+			record.Actor = value
+		case "ip":
+			record.ClientIP = value
+		case "result":
+			record.Result = value
+		default:
+			if record.Detail == nil {
+				record.Detail = make(map[string]string)
+			}
+			record.Detail[key] = value
+		}
+	}
+	if record.Actor == "" && category == AuditCategoryConfig {
+		record.Actor = "system"
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	record.Seq = al.seq + 1
+	record.PrevHash = al.last
+	record.Hash = record.digest()
+	line, _ := json.Marshal(record)
+	if _, err := al.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Unable to write audit record to %s: %s", al.path, err.Error())
+		metrics.Inc("userguide_audit_log_errors_total")
+		return
+	}
+	al.seq, al.last = record.Seq, record.Hash
+	metrics.Inc("userguide_audit_records_total", "category", category)
+}
+
+// Middleware publishes authentication and authorization failures, and the
+// admin actions of operators, once the response status is known
+func (al *AuditLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uw := &usageWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(uw, r)
+
+		admin := isAdminAction(r)
+		if uw.status != http.StatusUnauthorized && uw.status != http.StatusForbidden && !admin {
+			return
+		}
+		data := map[string]string{
+			"actor":  requestActor(r, al.utils),
+			"ip":     al.utils.ClientIP(r),
+			"method": r.Method,
+			"status": strconv.Itoa(uw.status),
+		}
+		if identity, ok := IdentityFromContext(r.Context()); ok {
+			data["auth"] = identity.Method
+		}
+		switch {
+		case uw.status == http.StatusUnauthorized:
+			data["result"] = "unauthenticated"
+			events.Publish(Event{Type: EventAuthFailed, Subject: r.URL.Path, Data: data})
+		case uw.status == http.StatusForbidden:
+			data["result"] = "denied"
+			events.Publish(Event{Type: EventAuthFailed, Subject: r.URL.Path, Data: data})
+		default:
+			if uw.status >= 400 {
+				data["result"] = "failure"
+			}
+			events.Publish(Event{Type: EventAdminAction, Subject: r.URL.Path, Data: data})
+		}
+	})
+}
+
+// isAdminAction reports whether a request is an operator action: any admin
+// route, signing a link or publishing a guide
+func isAdminAction(r *http.Request) bool {
+	return headerGroup(r.URL.Path) == HeaderGroupAdmin || r.URL.Path == "/sign" ||
+		(strings.HasPrefix(r.URL.Path, "/upload/") && r.Method != http.MethodGet)
+}
+
+// requestActor names who made a request from the credentials it
+// presented, whether or not they were accepted
+func requestActor(r *http.Request, utils *Utils) string {
+	subject := identityFromRequest(r, utils).Subject
+	if !strings.HasPrefix(subject, "ip:") {
+		return subject
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return "admin:" + user
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		return "bearer:" + keyFingerprint(token)
+	}
+	return subject
+}
+
+// AuditQuery selects audit records; empty fields match everything and a
+// zero Limit returns every match
+type AuditQuery struct {
+	Category string
+	Action   string
+	Actor    string
+	Resource string
+	Result   string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+func (q AuditQuery) matches(record AuditRecord) bool {
+	return (q.Category == "" || record.Category == q.Category) &&
+		(q.Action == "" || record.Action == q.Action) &&
+		(q.Actor == "" || record.Actor == q.Actor) &&
+		(q.Resource == "" || strings.Contains(record.Resource, q.Resource)) &&
+		(q.Result == "" || record.Result == q.Result) &&
+		(q.From.IsZero() || !record.Time.Before(q.From)) &&
+		(q.To.IsZero() || record.Time.Before(q.To))
+}
+
+// Query returns the newest records matching q, newest first
+func (al *AuditLog) Query(q AuditQuery) ([]AuditRecord, error) {
+	var matched []AuditRecord
+	err := al.scan(func(record AuditRecord) bool {
+		if q.matches(record) {
+			matched = append(matched, record)
+			if q.Limit > 0 && len(matched) > q.Limit {
+				matched = matched[1:]
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]AuditRecord, 0, len(matched))
+	for i := len(matched) - 1; i >= 0; i-- {
+		records = append(records, matched[i])
+	}
+	return records, nil
+}
+
+// AuditVerification is the result of checking the hash chain
+type AuditVerification struct {
+	Records int  `json:"records"`
+	Valid   bool `json:"valid"`
+	// BrokenAt is the sequence number of the first record that does not
+	// follow from the one before it
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Verify checks that every record hashes to its stored hash and links to
+// the record before it
+func (al *AuditLog) Verify() (AuditVerification, error) {
+	result := AuditVerification{Valid: true}
+	previous := ""
+	var expectedSeq int64 = 1
+	err := al.scan(func(record AuditRecord) bool {
+		result.Records++
+		switch {
+		case record.Seq != expectedSeq:
+			result.Reason = fmt.Sprintf("expected sequence %d", expectedSeq)
+		case record.PrevHash != previous:
+			result.Reason = "previous hash does not match"
+		case record.digest() != record.Hash:
+			result.Reason = "record does not match its hash"
+		default:
+			previous = record.Hash
+			expectedSeq++
+			return true
+		}
+		result.Valid, result.BrokenAt = false, record.Seq
+		return false
+	})
+	return result, err
+}
+
+// scan calls fn for each record in the file until it returns false. Lines
+// are written whole under al.mu, so reading up to the size seen under the
+// lock never meets a record still being written.
+func (al *AuditLog) scan(fn func(AuditRecord) bool) error {
+	f, err := os.Open(al.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if al.file != nil {
+		al.mu.Lock()
+		info, err := al.file.Stat()
+		al.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		src = io.LimitReader(f, info.Size())
+	}
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("%s line %d: %w", al.path, line, err)
+		}
+		if !fn(record) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// AuditHandler serves GET /admin/audit?category=&action=&actor=&resource=&result=&from=&to=&limit=,
+// the newest matching audit records first
+func (ah *AdminHandler) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.permitted(w, r, "audit.read", "audit") {
+		return
+	}
+	values := r.URL.Query()
+	q := AuditQuery{
+		Category: values.Get("category"),
+		Action:   values.Get("action"),
+		Actor:    values.Get("actor"),
+		Resource: values.Get("resource"),
+		Result:   values.Get("result"),
+		Limit:    100,
+	}
+	for name, target := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if value := values.Get(name); value != "" {
+			t, err := parseReportTime(value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*target = t
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditQueryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditQueryLimit), http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+
+	records, err := ah.audit.Query(q)
+	if err != nil {
+		log.Printf("Unable to query audit log: %s", err.Error())
+		http.Error(w, "Audit log unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"records": records})
+}
+
+// AuditVerifyHandler serves GET /admin/audit/verify, checking the hash chain
+// of the whole log
+func (ah *AdminHandler) AuditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.permitted(w, r, "audit.read", "audit") {
+		return
+	}
+	result, err := ah.audit.Verify()
+	if err != nil {
+		log.Printf("Unable to verify audit log: %s", err.Error())
+		http.Error(w, "Audit log unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, result)
+}
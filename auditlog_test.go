@@ -0,0 +1,239 @@
+package userguide
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditStart is the time of the first record written by writeAuditRecords
+var auditStart = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// auditEvents are the events writeAuditRecords records, an hour apart
+var auditEvents = []Event{
+	{Type: EventGuideDownloaded, Subject: "user-guide.pdf", Data: map[string]string{"client": "key:alice", "ip": "10.0.0.1"}},
+	{Type: EventAuthFailed, Subject: "/protected/guides/manual.pdf", Data: map[string]string{"actor": "ip:10.0.0.2", "result": "unauthenticated"}},
+	{Type: EventConfigReloaded, Subject: "application.properties"},
+	{Type: EventGuideDownloaded, Subject: "acme/setup.pdf", Data: map[string]string{"client": "key:bob"}},
+	{Type: EventAdminAction, Subject: "/admin/cache/purge", Data: map[string]string{"actor": "admin:ops", "result": "failure", "status": "500"}},
+	{Type: EventGuidePublished, Subject: "acme/setup.pdf"},
+}
+
+// writeAuditRecords opens an audit log at path and records auditEvents in
+// it directly, with fixed times, rather than through the event bus
+func writeAuditRecords(t *testing.T, path string) *AuditLog {
+	t.Helper()
+	config := DefaultConfig()
+	config.AuditLogFile = path
+	al, err := NewAuditLog(config)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	for i, e := range auditEvents {
+		e.Time = auditStart.Add(time.Duration(i) * time.Hour)
+		al.record(e)
+	}
+	return al
+}
+
+// editAuditRecords rewrites the audit log at path, passing edit every
+// record in order; records edit returns false for are dropped
+func editAuditRecords(t *testing.T, path string, edit func(record *AuditRecord) bool) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	var out bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("decode audit record: %v", err)
+		}
+		if !edit(&record) {
+			continue
+		}
+		line, _ := json.Marshal(record)
+		out.Write(append(line, '\n'))
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0o640); err != nil {
+		t.Fatalf("write audit log: %v", err)
+	}
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func(record *AuditRecord) bool
+		valid    bool
+		brokenAt int64
+		reason   string
+	}{
+		{"untouched", func(record *AuditRecord) bool { return true }, true, 0, ""},
+		{"edited record", func(record *AuditRecord) bool {
+			if record.Seq == 2 {
+				record.Result = "success"
+			}
+			return true
+		}, false, 2, "record does not match its hash"},
+		{"edited and rehashed record", func(record *AuditRecord) bool {
+			if record.Seq == 2 {
+				record.Actor = "key:mallory"
+				record.Hash = record.digest()
+			}
+			return true
+		}, false, 3, "previous hash does not match"},
+		{"removed record", func(record *AuditRecord) bool { return record.Seq != 3 }, false, 4, "expected sequence 3"},
+		{"renumbered after removal", func(record *AuditRecord) bool {
+			if record.Seq == 3 {
+				return false
+			}
+			if record.Seq > 3 {
+				record.Seq--
+				record.Hash = record.digest()
+			}
+			return true
+		}, false, 3, "previous hash does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			writeAuditRecords(t, path)
+			editAuditRecords(t, path, tt.edit)
+
+			result, err := (&AuditLog{path: path}).Verify()
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if result.Valid != tt.valid || result.BrokenAt != tt.brokenAt || result.Reason != tt.reason {
+				t.Errorf("verify = %+v, want valid %v broken at %d (%q)", result, tt.valid, tt.brokenAt, tt.reason)
+			}
+		})
+	}
+}
+
+func TestAuditLogContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeAuditRecords(t, path)
+	reopened := writeAuditRecords(t, path)
+
+	result, err := reopened.Verify()
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if want := 2 * (len(auditEvents) - 1); !result.Valid || result.Records != want {
+		t.Errorf("verify = %+v, want %d valid records", result, want)
+	}
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	al := writeAuditRecords(t, filepath.Join(t.TempDir(), "audit.log"))
+
+	tests := []struct {
+		name  string
+		query AuditQuery
+		want  []int64
+	}{
+		{"everything", AuditQuery{}, []int64{5, 4, 3, 2, 1}},
+		{"category", AuditQuery{Category: AuditCategoryDownload}, []int64{4, 1}},
+		{"action", AuditQuery{Action: EventAuthFailed}, []int64{2}},
+		{"actor", AuditQuery{Actor: "key:alice"}, []int64{1}},
+		{"system actor of reloads", AuditQuery{Actor: "system"}, []int64{3}},
+		{"resource substring", AuditQuery{Resource: "acme/"}, []int64{4}},
+		{"result", AuditQuery{Result: "success"}, []int64{4, 3, 1}},
+		{"from is inclusive", AuditQuery{From: auditStart.Add(3 * time.Hour)}, []int64{5, 4}},
+		{"to is exclusive", AuditQuery{To: auditStart.Add(2 * time.Hour)}, []int64{2, 1}},
+		{"limit keeps the newest", AuditQuery{Limit: 2}, []int64{5, 4}},
+		{"combined", AuditQuery{Category: AuditCategoryDownload, From: auditStart.Add(time.Hour)}, []int64{4}},
+		{"no match", AuditQuery{Actor: "key:carol"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := al.Query(tt.query)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			var got []int64
+			for _, record := range records {
+				got = append(got, record.Seq)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditHandlers(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.AdminToken = "admin-token"
+		config.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	})
+	for i, e := range auditEvents {
+		e.Time = auditStart.Add(time.Duration(i) * time.Hour)
+		events.Publish(e)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []int64
+	}{
+		{"filters", "?category=download&from=2026-03-01T13:00:00Z", http.StatusOK, []int64{4}},
+		{"date range", "?from=2026-03-01&to=2026-03-01T15:00:00Z&result=success", http.StatusOK, []int64{3, 1}},
+		{"limit", "?category=download&limit=1", http.StatusOK, []int64{4}},
+		{"invalid time", "?from=yesterday", http.StatusBadRequest, nil},
+		{"limit too large", "?limit=1001", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.Get(t, "/admin/audit"+tt.query, "Bearer admin-token")
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var body struct {
+				Records []AuditRecord `json:"records"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			var got []int64
+			for _, record := range body.Records {
+				got = append(got, record.Seq)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if resp := h.Get(t, "/admin/audit", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("query without credentials: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	editAuditRecords(t, h.Config.AuditLogFile, func(record *AuditRecord) bool {
+		if record.Seq == 4 {
+			record.Resource = "acme/other.pdf"
+		}
+		return true
+	})
+	resp := h.Get(t, "/admin/audit/verify", "Bearer admin-token")
+	var result AuditVerification
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("verify: status = %d, decode: %v", resp.StatusCode, err)
+	}
+	if result.Valid || result.BrokenAt != 4 {
+		t.Errorf("verify = %+v, want the chain broken at 4", result)
+	}
+}
@@ -0,0 +1,288 @@
+package userguide
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Authorization errors; implementations wrap these so the handler can pick
+// the status code
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("access denied")
+)
+
+// Identity describes the client asking for a guide
+type Identity struct {
+	// Subject names the strongest identity presented for logs and policy:
+	// key:<api key fingerprint>, admin:<user>, user:<token or sign-in
+	// subject>, token:<static token fingerprint>, cert:<name> or ip:<address>
+	Subject string
+	// Method is the Auth* method that established Subject
+	Method string
+	// Name and Email describe a person when the credential says, such as
+	// the certificate name or the token's email claim
+	Name       string
+	Email      string
+	APIKey     string
+	LicenseKey string
+	IP         net.IP
+	// Roles are granted by the API key's scopes and the JWT role claim
+	Roles []string
+}
+
+// Authorizer decides whether an identity may download a guide. guide is the
+// file name, or product/name in multi-product mode. A nil error allows the
+// download.
+type Authorizer interface {
+	AuthorizeDownload(ctx context.Context, identity Identity, guide string) error
+}
+
+// AuthorizerFactory builds an authorizer from configuration
+type AuthorizerFactory func(config *Config) (Authorizer, error)
+
+// Built-in authorizer names
+const (
+	AuthorizerAllowAll    = "allow-all"
+	AuthorizerACL         = "acl"
+	AuthorizerEntitlement = "entitlement"
+)
+
+var (
+	authorizersMu sync.RWMutex
+	authorizers   = map[string]AuthorizerFactory{
+		AuthorizerAllowAll:    func(*Config) (Authorizer, error) { return allowAll{}, nil },
+		AuthorizerACL:         newACLAuthorizer,
+		AuthorizerEntitlement: newEntitlementAuthorizer,
+	}
+)
+
+// RegisterAuthorizer makes a custom authorizer selectable with authz.authorizer.
+// Call it from an init function in the file that implements it.
+func RegisterAuthorizer(name string, factory AuthorizerFactory) {
+	authorizersMu.Lock()
+	defer authorizersMu.Unlock()
+	authorizers[name] = factory
+}
+
+// NewAuthorizer creates the authorizer selected by authz.authorizer. When
+// unset, guides are checked with the license service if one is configured
+// and otherwise allowed.
+func NewAuthorizer(config *Config) (Authorizer, error) {
+	name := config.Authorizer
+	if name == "" {
+		name = AuthorizerAllowAll
+		if config.LicenseURL != "" {
+			name = AuthorizerEntitlement
+		}
+	}
+
+	authorizersMu.RLock()
+	factory, ok := authorizers[name]
+	authorizersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown authorizer %q", name)
+	}
+	return factory(config)
+}
+
+// identityFromRequest returns the identity the auth middleware that
+// admitted r resolved, or else the credentials r carries
+func identityFromRequest(r *http.Request, utils *Utils) Identity {
+	if identity, ok := IdentityFromContext(r.Context()); ok {
+		return identity
+	}
+	return resolveIdentity(r, utils)
+}
+
+// resolveIdentity collects the credentials a request carries, the
+// strongest naming it
+func resolveIdentity(r *http.Request, utils *Utils) Identity {
+	ctx := r.Context()
+	id := Identity{
+		APIKey:     r.Header.Get(APIKeyHeader),
+		LicenseKey: r.Header.Get(LicenseKeyHeader),
+		Roles:      rolesFromContext(ctx),
+	}
+	ip := utils.ClientIP(r)
+	id.IP = net.ParseIP(ip)
+	id.Subject, id.Method = "ip:"+ip, AuthAnonymous
+	if cert := ClientCertFromContext(ctx); cert != nil {
+		id.Subject, id.Method, id.Name = "cert:"+cert.Name(), AuthClientCert, cert.CommonName
+		if len(cert.Emails) > 0 {
+			id.Email = cert.Emails[0]
+		}
+	}
+	if token, ok := ctx.Value(bearerTokenContextKey{}).(string); ok {
+		id.Subject, id.Method = "token:"+token, AuthToken
+	}
+	if session := OIDCSessionFromContext(ctx); session != nil {
+		id.Subject, id.Method, id.Name, id.Email = "user:"+session.Subject, AuthOIDC, session.Email, session.Email
+	}
+	if claims := JWTClaimsFromContext(ctx); claims != nil {
+		id.Subject, id.Method, id.Name, id.Email = "user:"+claims.Subject, AuthJWT, claims.Email, claims.Email
+	}
+	if SessionFromContext(ctx) != nil {
+		id.Method = AuthSession
+	}
+	if user := AdminUserFromContext(ctx); user != "" {
+		id.Subject, id.Method, id.Name = "admin:"+user, AuthAdmin, user
+	}
+	if id.APIKey != "" {
+		id.Subject, id.Method = "key:"+keyFingerprint(id.APIKey), AuthAPIKey
+		if key := APIKeyFromContext(ctx); key != nil && key.Owner != "" {
+			id.Name = key.Owner
+		}
+	}
+	return id
+}
+
+// keyFingerprint identifies a secret in logs without revealing it
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// allowAll lets every client download every guide
+type allowAll struct{}
+
+func (allowAll) AuthorizeDownload(context.Context, Identity, string) error {
+	return nil
+}
+
+// entitlementAuthorizer checks the client's license key with the license service
+type entitlementAuthorizer struct {
+	checker EntitlementChecker
+}
+
+func newEntitlementAuthorizer(config *Config) (Authorizer, error) {
+	checker := NewEntitlementChecker(config)
+	if checker == nil {
+		return nil, fmt.Errorf("the entitlement authorizer requires license.url")
+	}
+	return &entitlementAuthorizer{checker: checker}, nil
+}
+
+func (ea *entitlementAuthorizer) AuthorizeDownload(ctx context.Context, identity Identity, guide string) error {
+	return ea.checker.CheckEntitlement(ctx, identity.LicenseKey, guide)
+}
+
+// aclAuthorizer restricts guides matching a pattern to listed principals.
+// The most specific matching pattern decides; guides matching no pattern
+// are open.
+type aclAuthorizer struct {
+	patterns []string
+	rules    map[string][]aclPrincipal
+}
+
+// aclPrincipal is key:<api key>, ip:<address or CIDR> or * for anyone
+type aclPrincipal struct {
+	any     bool
+	apiKey  string
+	network *net.IPNet
+	// subject matches Identity.Subject, such as user:alice
+	subject string
+}
+
+func newACLAuthorizer(config *Config) (Authorizer, error) {
+	acl := &aclAuthorizer{rules: make(map[string][]aclPrincipal)}
+	for pattern, entries := range config.ACL {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid ACL pattern %q", pattern)
+		}
+		for _, entry := range entries {
+			principal, err := parseACLPrincipal(entry)
+			if err != nil {
+				return nil, fmt.Errorf("ACL %s: %v", pattern, err)
+			}
+			acl.rules[pattern] = append(acl.rules[pattern], principal)
+		}
+		acl.patterns = append(acl.patterns, pattern)
+	}
+	sortBySpecificity(acl.patterns)
+	return acl, nil
+}
+
+// sortBySpecificity orders guide patterns so the first match is the most
+// specific: exact names first, then patterns with more literal characters;
+// ties are broken alphabetically so the choice is stable
+func sortBySpecificity(patterns []string) {
+	sort.Slice(patterns, func(i, j int) bool {
+		a, b := patterns[i], patterns[j]
+		if wa, wb := isGlob(a), isGlob(b); wa != wb {
+			return !wa
+		}
+		if la, lb := literalLength(a), literalLength(b); la != lb {
+			return la > lb
+		}
+		return a < b
+	})
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+func literalLength(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+func parseACLPrincipal(entry string) (aclPrincipal, error) {
+	if entry == "*" {
+		return aclPrincipal{any: true}, nil
+	}
+	kind, value, _ := strings.Cut(entry, ":")
+	switch kind {
+	case "key":
+		if value != "" {
+			return aclPrincipal{apiKey: value}, nil
+		}
+	case "user", "cert", "token", "admin":
+		if value != "" {
+			return aclPrincipal{subject: entry}, nil
+		}
+	case "ip":
+		if !strings.Contains(value, "/") {
+			if strings.Contains(value, ":") {
+				value += "/128"
+			} else {
+				value += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err == nil {
+			return aclPrincipal{network: network}, nil
+		}
+	}
+	return aclPrincipal{}, fmt.Errorf("invalid principal %q", entry)
+}
+
+func (acl *aclAuthorizer) AuthorizeDownload(_ context.Context, identity Identity, guide string) error {
+	for _, pattern := range acl.patterns {
+		if matched, _ := path.Match(pattern, guide); !matched {
+			continue
+		}
+		for _, principal := range acl.rules[pattern] {
+			if principal.any ||
+				(principal.apiKey != "" && principal.apiKey == identity.APIKey) ||
+				(principal.subject != "" && principal.subject == identity.Subject) ||
+				(principal.network != nil && identity.IP != nil && principal.network.Contains(identity.IP)) {
+				return nil
+			}
+		}
+		if identity.APIKey == "" && identity.Method == AuthAnonymous {
+			return fmt.Errorf("%w: API key required for %s", ErrUnauthenticated, guide)
+		}
+		return fmt.Errorf("%w: %s is not allowed to download %s", ErrForbidden, identity.Subject, guide)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialRefresh is how long before expiry temporary credentials and
+// access tokens are replaced
+const credentialRefresh = 5 * time.Minute
+
+// awsCredentials sign AWS requests; temporary ones carry a session token
+// and an expiry
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// awsCredentialSource finds credentials the way AWS SDKs do: the
+// configured keys, else the AWS_* environment variables, a web identity
+// token (EKS service accounts), the ECS task role or the EC2 instance
+// profile. Temporary credentials are fetched again shortly before they
+// expire.
+type awsCredentialSource struct {
+	static   *awsCredentials
+	region   string
+	sts      *http.Client
+	metadata *http.Client
+
+	mu      sync.Mutex
+	current awsCredentials
+}
+
+func newAWSCredentialSource(config *Config) *awsCredentialSource {
+	source := &awsCredentialSource{
+		region: config.S3Region,
+		sts:    NewHTTPClient(config, 0),
+		// Instance and task metadata are link-local; never proxy them
+		metadata: &http.Client{Timeout: 5 * time.Second},
+	}
+	switch {
+	case config.S3AccessKeyID != "":
+		source.static = &awsCredentials{AccessKeyID: config.S3AccessKeyID, SecretAccessKey: config.S3AccessKeySecret, SessionToken: config.S3SessionToken}
+	case os.Getenv("AWS_ACCESS_KEY_ID") != "":
+		source.static = &awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	return source
+}
+
+// Get returns valid credentials
+func (cs *awsCredentialSource) Get(ctx context.Context) (awsCredentials, error) {
+	if cs.static != nil {
+		return *cs.static, nil
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.current.AccessKeyID != "" && time.Until(cs.current.Expires) > credentialRefresh {
+		return cs.current, nil
+	}
+	var creds awsCredentials
+	var err error
+	switch {
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		creds, err = cs.webIdentity(ctx)
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		creds, err = cs.container(ctx)
+	default:
+		creds, err = cs.instanceProfile(ctx)
+	}
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	cs.current = creds
+	return creds, nil
+}
+
+// webIdentity exchanges the projected service account token for role
+// credentials with STS AssumeRoleWithWebIdentity
+func (cs *awsCredentialSource) webIdentity(ctx context.Context) (awsCredentials, error) {
+	token, err := os.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "userguide-api"
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://sts."+cs.region+".amazonaws.com/",
+		strings.NewReader(query.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := readCredentialResponse(cs.sts, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("sts: %v", err)
+	}
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.Credentials.AccessKeyID == "" {
+		return awsCredentials{}, errors.New("sts: invalid AssumeRoleWithWebIdentity response")
+	}
+	c := result.Credentials
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// container reads the ECS task role credentials from the container
+// credentials endpoint
+func (cs *awsCredentialSource) container(ctx context.Context) (awsCredentials, error) {
+	address := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		address = "http://169.254.170.2" + relative
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	body, err := readCredentialResponse(cs.metadata, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("container credentials: %v", err)
+	}
+	return parseMetadataCredentials(body)
+}
+
+// instanceProfile reads the EC2 instance profile credentials from the
+// instance metadata service, version 2
+func (cs *awsCredentialSource) instanceProfile(ctx context.Context) (awsCredentials, error) {
+	const imds = "http://169.254.169.254/latest"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imds+"/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := readCredentialResponse(cs.metadata, req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata: %v", err)
+	}
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, imds+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return readCredentialResponse(cs.metadata, req)
+	}
+	roles, err := get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata: %v", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return awsCredentials{}, errors.New("instance metadata: no instance profile")
+	}
+	body, err := get("/meta-data/iam/security-credentials/" + url.PathEscape(role))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("instance metadata: %v", err)
+	}
+	return parseMetadataCredentials(body)
+}
+
+// parseMetadataCredentials reads the JSON credentials served by the ECS
+// and EC2 metadata endpoints
+func parseMetadataCredentials(body []byte) (awsCredentials, error) {
+	var c struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(body, &c); err != nil || c.AccessKeyID == "" {
+		return awsCredentials{}, errors.New("invalid credentials response")
+	}
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.Token, Expires: c.Expiration}, nil
+}
+
+// readCredentialResponse sends req and returns the body of a successful response
+func readCredentialResponse(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s from %s", resp.Status, req.URL.Host)
+	}
+	return body, nil
+}
@@ -0,0 +1,168 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureStorageResource is the token audience of Azure Storage
+const azureStorageResource = "https://storage.azure.com/"
+
+// azureToken is a Microsoft Entra access token and its expiry
+type azureToken struct {
+	AccessToken string
+	Expires     time.Time
+}
+
+// azureIdentity gets tokens for the managed identity of the host: AKS
+// workload identity when AZURE_FEDERATED_TOKEN_FILE is set, the App Service
+// and Functions identity endpoint when IDENTITY_ENDPOINT is, else the VM's
+// instance metadata service. clientID selects a user-assigned identity.
+// Tokens are fetched again shortly before they expire.
+type azureIdentity struct {
+	clientID string
+	login    *http.Client
+	metadata *http.Client
+
+	mu      sync.Mutex
+	current azureToken
+}
+
+func newAzureIdentity(config *Config) *azureIdentity {
+	clientID := config.AzureClientID
+	if clientID == "" {
+		clientID = os.Getenv("AZURE_CLIENT_ID")
+	}
+	return &azureIdentity{
+		clientID: clientID,
+		login:    NewHTTPClient(config, 0),
+		// The identity endpoints are local to the host; never proxy them
+		metadata: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Get returns a valid access token for Azure Storage
+func (ai *azureIdentity) Get(ctx context.Context) (azureToken, error) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	if ai.current.AccessToken != "" && time.Until(ai.current.Expires) > credentialRefresh {
+		return ai.current, nil
+	}
+	var token azureToken
+	var err error
+	switch {
+	case os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+		token, err = ai.workloadIdentity(ctx)
+	case os.Getenv("IDENTITY_ENDPOINT") != "":
+		token, err = ai.appService(ctx)
+	default:
+		token, err = ai.instance(ctx)
+	}
+	if err != nil {
+		return azureToken{}, err
+	}
+	ai.current = token
+	return token, nil
+}
+
+// workloadIdentity exchanges the projected service account token for an
+// access token of the federated application
+func (ai *azureIdentity) workloadIdentity(ctx context.Context) (azureToken, error) {
+	assertion, err := os.ReadFile(os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+	if err != nil {
+		return azureToken{}, err
+	}
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com/"
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {ai.clientID},
+		"scope":                 {azureStorageResource + ".default"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	}
+	address := strings.TrimSuffix(authority, "/") + "/" + url.PathEscape(os.Getenv("AZURE_TENANT_ID")) + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, strings.NewReader(form.Encode()))
+	if err != nil {
+		return azureToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := readCredentialResponse(ai.login, req)
+	if err != nil {
+		return azureToken{}, fmt.Errorf("workload identity: %v", err)
+	}
+	return parseAzureToken(body)
+}
+
+// appService reads the token from the App Service and Functions identity
+// endpoint
+func (ai *azureIdentity) appService(ctx context.Context) (azureToken, error) {
+	query := url.Values{"api-version": {"2019-08-01"}, "resource": {azureStorageResource}}
+	if ai.clientID != "" {
+		query.Set("client_id", ai.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("IDENTITY_ENDPOINT")+"?"+query.Encode(), nil)
+	if err != nil {
+		return azureToken{}, err
+	}
+	req.Header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	body, err := readCredentialResponse(ai.metadata, req)
+	if err != nil {
+		return azureToken{}, fmt.Errorf("identity endpoint: %v", err)
+	}
+	return parseAzureToken(body)
+}
+
+// instance reads the token from the instance metadata service of the VM
+func (ai *azureIdentity) instance(ctx context.Context) (azureToken, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureStorageResource}}
+	if ai.clientID != "" {
+		query.Set("client_id", ai.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return azureToken{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	body, err := readCredentialResponse(ai.metadata, req)
+	if err != nil {
+		return azureToken{}, fmt.Errorf("instance metadata: %v", err)
+	}
+	return parseAzureToken(body)
+}
+
+// parseAzureToken reads the token responses of Entra ID and the identity
+// endpoints, which give the expiry as a duration or as a Unix time, either
+// as a number or a string
+func parseAzureToken(body []byte) (azureToken, error) {
+	var token struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   json.RawMessage `json:"expires_in"`
+		ExpiresOn   json.RawMessage `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return azureToken{}, errors.New("invalid token response")
+	}
+	seconds := func(raw json.RawMessage) int64 {
+		n, _ := strconv.ParseInt(strings.Trim(string(raw), `"`), 10, 64)
+		return n
+	}
+	expires := time.Now().Add(time.Hour)
+	if on := seconds(token.ExpiresOn); on > 0 {
+		expires = time.Unix(on, 0)
+	} else if in := seconds(token.ExpiresIn); in > 0 {
+		expires = time.Now().Add(time.Duration(in) * time.Second)
+	}
+	return azureToken{AccessToken: token.AccessToken, Expires: expires}, nil
+}
@@ -0,0 +1,345 @@
+package userguide
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageBackendAzure names the Azure Blob Storage guide store
+const StorageBackendAzure = "azure"
+
+func init() {
+	RegisterStorage(StorageBackendAzure, func(config *Config) (Storage, error) { return NewAzureStorage(config) })
+}
+
+// azureAPIVersion is the Blob service version requests ask for; bearer
+// tokens need 2017-11-09 or later
+const azureAPIVersion = "2021-08-06"
+
+// AzureStorage keeps guides as block blobs in an Azure Storage container,
+// below an optional name prefix. Requests carry the azure.sas.token shared
+// access signature when one is set, else a token of the host's managed
+// identity. Like S3Storage it serves guides from local copies; a copy is
+// downloaded with If-Match on the ETag its metadata reported, so a blob
+// replaced mid-way is fetched again rather than cached half old.
+type AzureStorage struct {
+	client    *http.Client
+	transfers *http.Client
+	// container is the container URL, without a query
+	container string
+	prefix    string
+	sas       url.Values
+	identity  *azureIdentity
+	cache     *objectCache
+}
+
+// NewAzureStorage creates a storage of the azure.container blobs below
+// azure.prefix
+func NewAzureStorage(config *Config) (*AzureStorage, error) {
+	if config.AzureContainer == "" {
+		return nil, fmt.Errorf("storage.type=%s needs azure.container", StorageBackendAzure)
+	}
+	address := config.AzureEndpoint
+	if address == "" {
+		if config.AzureAccount == "" {
+			return nil, fmt.Errorf("storage.type=%s needs azure.account or azure.endpoint", StorageBackendAzure)
+		}
+		address = "https://" + config.AzureAccount + ".blob.core.windows.net"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(address, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid azure.endpoint %q", address)
+	}
+	sas, err := url.ParseQuery(strings.TrimPrefix(config.AzureSASToken, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure.sas.token: %v", err)
+	}
+	cacheDir := config.AzureCachePath
+	if cacheDir == "" {
+		cacheDir = filepath.Join(config.UserGuidePath, ".azure-cache")
+	}
+	prefix := strings.Trim(config.AzurePrefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &AzureStorage{
+		client:    NewHTTPClient(config, 0),
+		transfers: &http.Client{Transport: outboundTransport(config)},
+		// Emulators such as Azurite put the account in the path
+		container: endpoint.Scheme + "://" + endpoint.Host + endpoint.EscapedPath() + "/" + url.PathEscape(config.AzureContainer),
+		prefix:    prefix,
+		sas:       sas,
+	}
+	if len(sas) == 0 {
+		s.identity = newAzureIdentity(config)
+	}
+	if s.cache, err = newObjectCache(StorageBackendAzure, s.String(), cacheDir, config.AzureCacheTTL); err != nil {
+		return nil, err
+	}
+	s.cache.head = s.head
+	s.cache.download = func(ctx context.Context, info ObjectInfo) (io.ReadCloser, error) {
+		return s.read(ctx, info.Key, info.Version)
+	}
+	return s, nil
+}
+
+// String describes the container for logs
+func (s *AzureStorage) String() string {
+	return s.container + "/" + s.prefix
+}
+
+// blobURL returns the address of key's blob with query, escaping each
+// segment of the blob name
+func (s *AzureStorage) blobURL(key string, query url.Values) string {
+	segments := strings.Split(s.prefix+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return s.withQuery(s.container+"/"+strings.Join(segments, "/"), query)
+}
+
+// withQuery adds query and the shared access signature to address
+func (s *AzureStorage) withQuery(address string, query url.Values) string {
+	merged := url.Values{}
+	for name, values := range s.sas {
+		merged[name] = values
+	}
+	for name, values := range query {
+		merged[name] = values
+	}
+	if len(merged) == 0 {
+		return address
+	}
+	return address + "?" + merged.Encode()
+}
+
+func (s *AzureStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkObjectKey(key); err != nil {
+		return nil, err
+	}
+	return s.read(ctx, key, "")
+}
+
+// read downloads key, failing with errObjectChanged when etag is set and
+// the blob no longer has it
+func (s *AzureStorage) read(ctx context.Context, key, etag string) (io.ReadCloser, error) {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, err := s.do(ctx, s.transfers, http.MethodGet, s.blobURL(key, nil), header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errObjectChanged, key)
+	}
+	if err := azureError(resp, key); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *AzureStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.cache.Stat(ctx, key)
+}
+
+// head reads the properties of key's blob
+func (s *AzureStorage) head(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, s.client, http.MethodHead, s.blobURL(key, nil), nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := azureError(resp, key); err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: modTime, Version: resp.Header.Get("ETag")}, nil
+}
+
+// LocalPath returns the cached copy of key, downloading it when needed
+func (s *AzureStorage) LocalPath(ctx context.Context, key string) (string, error) {
+	return s.cache.LocalPath(ctx, key)
+}
+
+func (s *AzureStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	marker := ""
+	for {
+		page, err := s.listPage(ctx, prefix, marker, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Blobs {
+			key := strings.TrimPrefix(blob.Name, s.prefix)
+			if checkObjectKey(key) != nil || hiddenKey(key) {
+				continue
+			}
+			modTime, _ := http.ParseTime(blob.Properties.LastModified)
+			objects = append(objects, ObjectInfo{Key: key, Size: blob.Properties.ContentLength, ModTime: modTime, Version: blob.Properties.ETag})
+		}
+		if page.NextMarker == "" {
+			break
+		}
+		marker = page.NextMarker
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// azureListResult is a List Blobs response
+type azureListResult struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			ContentLength int64  `xml:"Content-Length"`
+			LastModified  string `xml:"Last-Modified"`
+			ETag          string `xml:"Etag"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// listPage lists one page of the blobs below prefix; maxResults 0 leaves
+// the page size to Azure
+func (s *AzureStorage) listPage(ctx context.Context, prefix, marker string, maxResults int) (*azureListResult, error) {
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {s.prefix + prefix}}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	if maxResults > 0 {
+		query.Set("maxresults", strconv.Itoa(maxResults))
+	}
+	resp, err := s.do(ctx, s.client, http.MethodGet, s.withQuery(s.container, query), nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := azureError(resp, ""); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var page azureListResult
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&page); err != nil {
+		return nil, fmt.Errorf("invalid list response: %v", err)
+	}
+	return &page, nil
+}
+
+// Put uploads body as key's block blob in a single request. Azure needs
+// the length up front, so bodies other than files and in-memory readers
+// are spooled to the cache directory first.
+func (s *AzureStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	spooled, size, cleanup, err := spoolBody(s.cache.dir, body)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	header := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}, "Content-Type": {"application/octet-stream"}}
+	resp, err := s.do(ctx, s.transfers, http.MethodPut, s.blobURL(key, nil), header, io.NopCloser(spooled), size)
+	s.cache.Forget(key)
+	if err != nil {
+		return err
+	}
+	if err := azureError(resp, key); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *AzureStorage) Delete(ctx context.Context, key string) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, s.client, http.MethodDelete, s.blobURL(key, nil), nil, nil, 0)
+	s.cache.Forget(key)
+	if err != nil {
+		return err
+	}
+	if err := azureError(resp, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	resp.Body.Close()
+	s.cache.Remove(key)
+	return nil
+}
+
+// Probe checks that the container can be listed, for the storage health check
+func (s *AzureStorage) Probe(ctx context.Context) error {
+	_, err := s.listPage(ctx, "", "", 1)
+	return err
+}
+
+// do sends a request to the Blob service, authorized by the shared access
+// signature already in address or by a managed identity token
+func (s *AzureStorage) do(ctx context.Context, client *http.Client, method, address string, header http.Header, body io.ReadCloser, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Body = body
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Ms-Version", azureAPIVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	if s.identity != nil {
+		token, err := s.identity.Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("no managed identity token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	}
+	return client.Do(req)
+}
+
+// azureError closes the body of a failed response and describes the
+// failure; a missing blob is ErrObjectNotFound, a missing container is not
+func azureError(resp *http.Response, key string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	var failure struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+	// HEAD responses carry the error code in a header only
+	code := resp.Header.Get("X-Ms-Error-Code")
+	if code == "" {
+		code = failure.Code
+	}
+	what := key
+	if key == "" {
+		what = "container"
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" && code != "ContainerNotFound" {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if code == "" {
+		return fmt.Errorf("azure %s: %s", what, resp.Status)
+	}
+	if message, _, _ := strings.Cut(failure.Message, "\n"); message != "" {
+		return fmt.Errorf("azure %s: %s: %s: %s", what, resp.Status, code, message)
+	}
+	return fmt.Errorf("azure %s: %s: %s", what, resp.Status, code)
+}
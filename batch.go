@@ -0,0 +1,122 @@
+package userguide
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// batchRequest is the body of POST /download/batch
+type batchRequest struct {
+	Guides []string `json:"guides"`
+}
+
+// batchGuide is a guide checked for inclusion in a batch download
+type batchGuide struct {
+	name string
+	path string
+}
+
+// BatchDownloadHandler streams a zip of the listed guides. Every guide is
+// resolved and authorized as if downloaded on its own before anything is
+// sent, so the archive holds exactly the guides asked for or is refused.
+func (fh *FileHandler) BatchDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Guides) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "request body must be {\"guides\": [names]}"})
+		return
+	}
+	if len(req.Guides) > fh.batchMaxGuides {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("at most %d guides per batch", fh.batchMaxGuides)})
+		return
+	}
+
+	files := fh.guides(r)
+	guides := make([]batchGuide, 0, len(req.Guides))
+	seen := make(map[string]bool, len(req.Guides))
+	for _, name := range req.Guides {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		filePath, err := resolveGuide(files, name)
+		if err != nil {
+			log.Printf("Batch download of %s refused to %s: %s", name, r.RemoteAddr, err.Error())
+			var windowErr *WindowError
+			if errors.As(err, &windowErr) || errors.Is(err, ErrUnauthenticated) || errors.Is(err, ErrForbidden) {
+				writeGuideError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "User guide not available", "guide": name})
+			return
+		}
+		if !fh.authorized(w, r, name) {
+			return
+		}
+		guides = append(guides, batchGuide{name: name, path: filePath})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	downloadIDs := make([]string, 0, len(guides))
+	for _, guide := range guides {
+		downloadIDs = append(downloadIDs, fh.publishDownload(r, guide.name))
+	}
+	w.Header().Set(DownloadIDHeader, strings.Join(downloadIDs, ", "))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"userguides.zip\"")
+
+	log.Printf("Serving batch of %d guides to %s", len(guides), r.RemoteAddr)
+	metrics.Inc("userguide_batch_downloads_total")
+	metrics.Add("userguide_batch_guides_total", float64(len(guides)))
+
+	// Headers are sent with the first entry, so a failure from here on can
+	// only cut the archive short; clients detect that from the missing
+	// central directory
+	zw := zip.NewWriter(w)
+	for _, guide := range guides {
+		if err := writeZipEntry(zw, guide); err != nil {
+			log.Printf("Batch download to %s aborted at %s: %s", r.RemoteAddr, guide.name, err.Error())
+			metrics.Inc("userguide_batch_download_errors_total")
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Batch download to %s aborted: %s", r.RemoteAddr, err.Error())
+		metrics.Inc("userguide_batch_download_errors_total")
+	}
+}
+
+// writeZipEntry copies a guide into the archive under its guide name
+func writeZipEntry(zw *zip.Writer, guide batchGuide) error {
+	file, err := openGuide(guide.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = guide.name
+	header.Method = zip.Deflate
+
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
@@ -0,0 +1,132 @@
+package userguide
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// blobCacheControl lets CDNs and clients keep content-addressed responses forever
+const blobCacheControl = "max-age=31536000, immutable"
+
+// sha256Pattern matches a lowercase hex SHA-256 digest
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BlobHandler serves published guides by content hash, so their URLs never
+// need invalidating: a republished guide gets a new URL
+type BlobHandler struct {
+	files     *FileHandler
+	checksums *ChecksumStore
+}
+
+// NewBlobHandler creates a handler serving the guides recorded in checksums
+func NewBlobHandler(files *FileHandler, checksums *ChecksumStore) *BlobHandler {
+	return &BlobHandler{files: files, checksums: checksums}
+}
+
+// RegisterRoutes registers the blob and manifest routes with the router
+func (bh *BlobHandler) RegisterRoutes(r *mux.Router) {
+	bh.files.handle(r, "/blobs/{sha256}", Validate(bh.BlobHandler,
+		ParamRule{Source: PathParam, Name: "sha256", Required: true, Pattern: sha256Pattern},
+	).ServeHTTP).Methods("GET")
+	bh.files.handle(r, "/manifest", bh.ManifestHandler).Methods("GET")
+}
+
+// manifestEntry describes one published guide and its immutable URL
+type manifestEntry struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+// ManifestHandler lists the published guides the client may download with
+// their content-addressed URLs
+func (bh *BlobHandler) ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromRequest(r, bh.files.utils)
+	entries := []manifestEntry{}
+	for name, sum := range bh.checksums.All() {
+		if !bh.files.listable(r, identity, name) {
+			continue
+		}
+		entries = append(entries, manifestEntry{Name: name, SHA256: sum, URL: "/blobs/" + sum})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	setListingCacheControl(w, identity)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"guides": entries})
+}
+
+// listable reports whether a published guide may be shown to the client:
+// it is not excluded and the client may download it
+func (fh *FileHandler) listable(r *http.Request, identity Identity, name string) bool {
+	return !fh.utils.IsExcluded(name) && fh.authorizer.AuthorizeDownload(r.Context(), identity, name) == nil &&
+		(fh.rbac == nil || fh.rbac.Allows(name, identity.Roles))
+}
+
+// setListingCacheControl lets caches keep guide listings only while they
+// revalidate them, and only privately when they depend on credentials
+func setListingCacheControl(w http.ResponseWriter, identity Identity) {
+	w.Header().Set("Cache-Control", "no-cache")
+	if identity.APIKey != "" || identity.LicenseKey != "" || len(identity.Roles) > 0 {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+}
+
+// BlobHandler serves the guide whose content has the requested SHA-256
+func (bh *BlobHandler) BlobHandler(w http.ResponseWriter, r *http.Request) {
+	sum := mux.Vars(r)["sha256"]
+	name, filePath, ok := bh.lookup(bh.files.guides(r), sum)
+	if !ok {
+		http.Error(w, "User guide not available", http.StatusNotFound)
+		return
+	}
+
+	safeFilename := filepath.Base(filePath)
+	w.Header().Set("Content-Type", bh.files.utils.GetContentType(safeFilename))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+bh.files.utils.EscapeForHeader(safeFilename)+"\"")
+	w.Header().Set("ETag", `"`+sum+`"`)
+	if !bh.files.authorized(w, r, name) {
+		return
+	}
+	// Copies handed out on the strength of credentials stay out of shared caches
+	if strings.HasPrefix(w.Header().Get("Cache-Control"), "private") {
+		w.Header().Set("Cache-Control", "private, "+blobCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "public, "+blobCacheControl)
+	}
+
+	log.Printf("Serving blob %s (%s) to %s", sum[:12], name, r.RemoteAddr)
+	metrics.Inc("userguide_blob_downloads_total")
+	bh.files.recordDownload(w, r, name)
+	fileServer.ServeFile(w, r, filePath)
+}
+
+// lookup finds a guide currently holding the content sum. The file is
+// re-hashed (cached by size and modification time) so a guide replaced
+// outside the upload path is never served under its old hash. Guides files
+// refuses are skipped.
+func (bh *BlobHandler) lookup(files FileServiceInterface, sum string) (string, string, bool) {
+	var names []string
+	for name, recorded := range bh.checksums.All() {
+		if recorded == sum {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		filePath, err := resolveGuide(files, name)
+		if err != nil {
+			continue
+		}
+		if version, err := bh.files.versions.Version(filePath); err == nil && version == sum {
+			return name, filePath, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,258 @@
+package userguide
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// BootReport describes what the server started with: a summary of its
+// configuration, the backends it resolved, the features and routes it
+// enabled and where it listens. main logs it once everything is set up;
+// --print-config writes it as JSON instead, with the full effective
+// configuration, credentials redacted.
+type BootReport struct {
+	Config    BootConfig    `json:"config"`
+	Backends  []BootBackend `json:"backends"`
+	Features  []string      `json:"features"`
+	Warnings  []string      `json:"warnings"`
+	Routes    []BootRoute   `json:"routes"`
+	Listeners []string      `json:"listeners"`
+	// Effective is the whole configuration, only written as JSON
+	Effective interface{} `json:"effective,omitempty"`
+}
+
+// BootConfig summarizes the settings every deployment cares about
+type BootConfig struct {
+	Sources       []string `json:"sources"`
+	Port          string   `json:"port"`
+	TLS           bool     `json:"tls"`
+	GuidePath     string   `json:"guidePath"`
+	UserGuideFile string   `json:"userGuideFile"`
+	CanaryFile    string   `json:"canaryFile,omitempty"`
+	CanaryPercent int      `json:"canaryPercent,omitempty"`
+	// Limits holds the request, connection and download limits in effect
+	Limits []string `json:"limits"`
+}
+
+// BootBackend is an external or pluggable component a feature resolved to
+type BootBackend struct {
+	Role   string `json:"role"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// BootRoute is a registered route
+type BootRoute struct {
+	Methods     []string `json:"methods"`
+	Path        string   `json:"path"`
+	Description string   `json:"description,omitempty"`
+}
+
+// NewBootReport starts the report of config
+func NewBootReport(config *Config) *BootReport {
+	sources := []string{"application.properties"}
+	if config.ConfigSource != "" {
+		sources = append(sources, config.ConfigSource+" "+redactURL(config.ConfigAddress))
+	}
+	report := &BootReport{
+		Config: BootConfig{
+			Sources:       sources,
+			Port:          config.ServerPort,
+			TLS:           config.TLSCertFile != "",
+			GuidePath:     config.UserGuidePath,
+			UserGuideFile: config.UserGuideFile,
+			Limits: []string{fmt.Sprintf("requests: header timeout %s, body timeout %s, max body %d bytes",
+				config.ReadHeaderTimeout, config.BodyReadTimeout, config.MaxBodyBytes),
+				fmt.Sprintf("uploads: body timeout %s, max body %d bytes", config.UploadBodyTimeout, config.UploadMaxBytes)},
+		},
+		Backends:  []BootBackend{},
+		Features:  []string{},
+		Warnings:  []string{},
+		Effective: redactValue(reflect.ValueOf(config).Elem(), false),
+	}
+	if config.CanaryFile != "" {
+		report.Config.CanaryFile, report.Config.CanaryPercent = config.CanaryFile, config.CanaryPercent
+	}
+	if config.MaxConnections > 0 || config.MaxConnectionsPerIP > 0 {
+		report.Limit("connections: %d total, %d per client IP", config.MaxConnections, config.MaxConnectionsPerIP)
+	}
+	if config.MaxInFlight > 0 {
+		report.Limit("in flight: %d requests, %d queued for up to %s", config.MaxInFlight, config.MaxInFlightQueue, config.MaxInFlightWait)
+	}
+	if config.DownloadMaxConcurrent > 0 {
+		report.Limit("downloads per client: %d at once, extras wait up to %s", config.DownloadMaxConcurrent, config.DownloadConcurrentWait)
+	}
+	report.Limit("keep-alive: %t, idle timeout %s", config.KeepAlivesEnabled, config.IdleTimeout)
+	return report
+}
+
+// Limit records a limit in effect
+func (br *BootReport) Limit(format string, args ...interface{}) {
+	br.Config.Limits = append(br.Config.Limits, fmt.Sprintf(format, args...))
+}
+
+// Backend records what role resolved to
+func (br *BootReport) Backend(role, kind, detail string) {
+	br.Backends = append(br.Backends, BootBackend{Role: role, Kind: kind, Detail: detail})
+}
+
+// Feature records an enabled feature and how it is set up
+func (br *BootReport) Feature(format string, args ...interface{}) {
+	br.Features = append(br.Features, fmt.Sprintf(format, args...))
+}
+
+// Warn records a setting that did not take effect as configured
+func (br *BootReport) Warn(format string, args ...interface{}) {
+	br.Warnings = append(br.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Listen records an address the server accepts connections on
+func (br *BootReport) Listen(address string) {
+	br.Listeners = append(br.Listeners, address)
+}
+
+// AddRoutes records the routes registered with r, sorted by path
+func (br *BootReport) AddRoutes(r *mux.Router) {
+	r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			// Subrouter prefixes only group the routes below them
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"*"}
+		}
+		for _, method := range methods {
+			if method == "HEAD" || method == "OPTIONS" {
+				continue
+			}
+			br.Routes = append(br.Routes, BootRoute{Methods: []string{method}, Path: path, Description: routeDescriptions[method+" "+path]})
+		}
+		return nil
+	})
+	sort.SliceStable(br.Routes, func(i, j int) bool { return br.Routes[i].Path < br.Routes[j].Path })
+
+	// One entry per path, with its methods
+	merged := br.Routes[:0]
+	for _, route := range br.Routes {
+		if n := len(merged); n > 0 && merged[n-1].Path == route.Path && merged[n-1].Description == route.Description {
+			merged[n-1].Methods = append(merged[n-1].Methods, route.Methods...)
+			continue
+		}
+		merged = append(merged, route)
+	}
+	br.Routes = merged
+}
+
+// Log writes the report to the log, one line per item
+func (br *BootReport) Log() {
+	scheme := "HTTP"
+	if br.Config.TLS {
+		scheme = "HTTPS"
+	}
+	log.Printf("Server starting on port %s (%s), configuration from %s", br.Config.Port, scheme, strings.Join(br.Config.Sources, ", "))
+	log.Printf("User guides directory: %s", br.Config.GuidePath)
+	log.Printf("Configured user guide file: %s", br.Config.UserGuideFile)
+	if br.Config.CanaryFile != "" {
+		log.Printf("Canary user guide file: %s (%d%% of clients)", br.Config.CanaryFile, br.Config.CanaryPercent)
+	}
+	for _, limit := range br.Config.Limits {
+		log.Printf("Limit %s", limit)
+	}
+	for _, backend := range br.Backends {
+		if backend.Detail != "" {
+			log.Printf("Backend %s: %s (%s)", backend.Role, backend.Kind, backend.Detail)
+		} else {
+			log.Printf("Backend %s: %s", backend.Role, backend.Kind)
+		}
+	}
+	for _, feature := range br.Features {
+		log.Printf("Enabled: %s", feature)
+	}
+	for _, warning := range br.Warnings {
+		log.Printf("Warning: %s", warning)
+	}
+	log.Println("Available endpoints:")
+	for _, route := range br.Routes {
+		if route.Description != "" {
+			log.Printf("  %s %s - %s", strings.Join(route.Methods, ", "), route.Path, route.Description)
+		} else {
+			log.Printf("  %s %s", strings.Join(route.Methods, ", "), route.Path)
+		}
+	}
+	log.Printf("Listening on %s", strings.Join(br.Listeners, ", "))
+}
+
+// WriteJSON writes the report as indented JSON
+func (br *BootReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(br)
+}
+
+// routeDescriptions explains the routes in the boot report, by method and
+// path template
+var routeDescriptions = map[string]string{
+	"GET /download/userguide":               "Download configured user guide",
+	"GET /view/userguide":                   "View configured user guide in the browser",
+	"GET /public/download":                  "Download configured user guide (no credentials)",
+	"POST /download/batch":                  "Download a zip of the listed guides",
+	"GET /guides/{name}/pages":              "Extract a page range of a PDF guide (?from=&to=)",
+	"GET /guides":                           "Catalog of published guides (JSON, or HTML for browsers)",
+	"GET /guides/{name}":                    "Details of a published guide",
+	"GET /guides/{product}/{name}":          "Details of a published product guide",
+	"GET /search":                           "Search published guides by name (?q=)",
+	"GET /manifest":                         "Published guides with their immutable blob URLs",
+	"GET /blobs/{sha256}":                   "Download published guide by content hash",
+	"GET /health":                           "Health check",
+	"GET /health/deep":                      "Health check with live component checks",
+	"GET /ready":                            "Readiness, true once warm-up has finished and outside storage swaps",
+	"GET /metrics":                          "Prometheus metrics",
+	"GET /csrf":                             "CSRF token to echo in X-CSRF-Token",
+	"GET /auth/login":                       "Sign in with the OpenID provider (?return_to=)",
+	"GET /auth/callback":                    "OpenID Connect redirect target",
+	"POST /auth/logout":                     "Sign out",
+	"GET /auth/session":                     "The caller's login session",
+	"DELETE /auth/session":                  "End the login session",
+	"GET /rbac/permissions":                 "Roles of the caller and the guides they grant (?guide=)",
+	"GET /protected/guides/{name}":          "Download restricted guide (bearer token or JWT)",
+	"GET /protected/download":               "Download restricted edition of the user guide (bearer token or JWT)",
+	"POST /token/download":                  "Exchange bearer token for a download link (bearer token or JWT)",
+	"GET /download/token/{token}":           "Download restricted guide through a link",
+	"POST /token/resume":                    "Exchange a resume token and offset for a link to the rest (bearer token or JWT)",
+	"GET /download/resume/{token}":          "Continue an interrupted restricted download",
+	"GET /preview/{token}":                  "Preview draft guide",
+	"GET /products/{product}/guides/{name}": "Download product guide",
+	"GET /products/{product}/releases/{release}/userguide": "Download guide for a product release",
+	"PUT /upload/{name}":                   "Upload guide (bearer token)",
+	"PUT /upload/{product}/{name}":         "Upload product guide (bearer token)",
+	"GET /admin/config":                    "Effective configuration, credentials redacted (admin token or Basic auth)",
+	"GET /admin/diagnostics":               "Run self-diagnostic checks (admin token or Basic auth)",
+	"GET /admin/schedule":                  "Upcoming guide launches and expiries (admin token or Basic auth)",
+	"PUT /admin/schedule/{name}":           "Set a guide's publishAt/expireAt (admin token or Basic auth)",
+	"PUT /admin/schedule/{product}/{name}": "Set a product guide's publishAt/expireAt (admin token or Basic auth)",
+	"GET /admin/audit":                     "Query the audit log (admin token or Basic auth)",
+	"GET /admin/audit/verify":              "Check the audit log hash chain (admin token or Basic auth)",
+	"POST /admin/cache/purge":              "Invalidate cached guide data and the CDN (admin token or Basic auth)",
+	"GET /admin/usage":                     "Storage usage per product (admin token or Basic auth)",
+	"GET /admin/quarantine":                "Quarantined guides and their scan reports (admin token or Basic auth)",
+	"GET /admin/quarantine/{id}":           "Scan report of a quarantined guide (admin token or Basic auth)",
+	"POST /admin/quarantine/{id}/release":  "Publish a quarantined guide anyway (admin token or Basic auth)",
+	"POST /admin/quarantine/{id}/approve":  "Approve another operator's quarantine release (admin token or Basic auth)",
+	"DELETE /admin/quarantine/{id}":        "Delete a quarantined guide (admin token or Basic auth)",
+	"GET /admin/apikeys/{id}/report":       "Downloads made with an API key (?from=&to=&format=, admin token or Basic auth)",
+	"POST /sign":                           "Signed, expiring link to a guide route (admin token or Basic auth)",
+	"PUT /replication/guides/{name}":       "Receive guide from primary region (bearer token)",
+	"GET /replication/manifest":            "Guide checksums held by this region (bearer token)",
+}
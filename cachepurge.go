@@ -0,0 +1,253 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// EventCachePurged is published after an operator purges the caches
+const EventCachePurged = "cache.purged"
+
+// CachePurger drops what the service remembers about guide files, for when
+// a guide is replaced in a way the size and modification time checks miss
+// (a copy that preserves both, or a restore from backup), and asks the CDN
+// to forget its copies too. Downloads in progress keep the data they hold.
+type CachePurger struct {
+	versions *guideVersions
+	cdn      *CDNPurger
+}
+
+// NewCachePurger creates the purger for fh's caches and the process-wide
+// file server caches
+func NewCachePurger(config *Config, fh *FileHandler) *CachePurger {
+	return &CachePurger{versions: fh.versions, cdn: NewCDNPurger(config)}
+}
+
+// PurgeResult reports what a purge invalidated
+type PurgeResult struct {
+	// Guides is empty when every guide was purged
+	Guides []string `json:"guides"`
+	// Mapped counts memory mappings retired
+	Mapped int `json:"mapped"`
+	// Versions counts guide versions recomputed
+	Versions int `json:"versions"`
+	// Siblings counts precompressed sibling checks dropped
+	Siblings int `json:"siblings"`
+	// CDN is purged, skipped or failed
+	CDN      string `json:"cdn"`
+	CDNError string `json:"cdnError,omitempty"`
+}
+
+// Purge invalidates the caches for guides, each a name or product/name, or
+// for every guide when guides is empty. Versions are recomputed straight
+// away so the next response carries the new X-Guide-Version. The CDN is
+// purged when configured and cdn is true.
+func (cp *CachePurger) Purge(ctx context.Context, guides []string, cdn bool) PurgeResult {
+	result := PurgeResult{Guides: guides, CDN: "skipped"}
+	if result.Guides == nil {
+		result.Guides = []string{}
+	}
+	match := func(p string) bool {
+		if len(guides) == 0 {
+			return true
+		}
+		p = filepath.ToSlash(p)
+		for _, guide := range guides {
+			if strings.HasSuffix(p, "/"+guide) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if fileServer.hotFiles != nil {
+		result.Mapped = fileServer.hotFiles.Invalidate(match)
+	}
+	if fileServer.siblings != nil {
+		result.Siblings = fileServer.siblings.Invalidate(match)
+	}
+	for _, p := range cp.versions.Invalidate(match) {
+		if _, err := cp.versions.Version(p); err == nil {
+			result.Versions++
+		}
+	}
+
+	if cdn && cp.cdn != nil {
+		if err := cp.cdn.Purge(ctx, guides); err != nil {
+			log.Printf("CDN purge failed: %s", err.Error())
+			metrics.Inc("userguide_cache_purges_total", "cdn", "failed")
+			result.CDN, result.CDNError = "failed", err.Error()
+		} else {
+			metrics.Inc("userguide_cache_purges_total", "cdn", "purged")
+			result.CDN = "purged"
+		}
+	} else {
+		metrics.Inc("userguide_cache_purges_total", "cdn", "skipped")
+	}
+
+	subject := strings.Join(guides, ",")
+	if subject == "" {
+		subject = "*"
+	}
+	events.Publish(Event{Type: EventCachePurged, Subject: subject, Data: actorData(ctx, map[string]string{"cdn": result.CDN})})
+	return result
+}
+
+// purgeRequest is the optional body of POST /admin/cache/purge
+type purgeRequest struct {
+	Guides []string `json:"guides"`
+	// CDN defaults to true
+	CDN *bool `json:"cdn"`
+}
+
+// PurgeHandler serves POST /admin/cache/purge. The body lists the guides to
+// purge ({"guides": ["user-guide.pdf", "acme/setup.pdf"]}); an empty body or
+// list purges every guide. {"cdn": false} leaves the CDN alone. A failed CDN
+// purge answers 502 after the local caches were purged.
+func (ah *AdminHandler) PurgeHandler(w http.ResponseWriter, r *http.Request) {
+	var req purgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid purge request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, guide := range req.Guides {
+		product, name := path.Split(guide)
+		product = strings.TrimSuffix(product, "/")
+		clean, err := ah.utils.ValidateFilename(name)
+		if err == nil && product != "" {
+			err = ah.utils.ValidateProductName(product)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Guides[i] = path.Join(product, clean)
+	}
+	resource := strings.Join(req.Guides, ",")
+	if resource == "" {
+		resource = "*"
+	}
+	if !ah.permitted(w, r, "cache.purge", resource) {
+		return
+	}
+
+	result := ah.purger.Purge(r.Context(), req.Guides, req.CDN == nil || *req.CDN)
+	log.Printf("Caches purged for %s by %s: %d mappings, %d versions, %d sibling checks, CDN %s",
+		resource, identityFromRequest(r, ah.utils).Subject, result.Mapped, result.Versions, result.Siblings, result.CDN)
+	status := http.StatusOK
+	if result.CDN == "failed" {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, result)
+}
+
+// CDNPurger asks a CDN to drop its copies of guide URLs. With {path} in
+// cdn.purge.url one request per URL path is sent with cdn.purge.method
+// (PURGE by default, as Varnish and Fastly expect); otherwise a single POST
+// carries {"paths": [...], "all": bool} for an API or a small adapter.
+type CDNPurger struct {
+	url       string
+	method    string
+	token     string
+	templates []string
+	client    *http.Client
+}
+
+// NewCDNPurger creates the purger for cdn.purge.*; it returns nil when
+// cdn.purge.url is empty
+func NewCDNPurger(config *Config) *CDNPurger {
+	if config.CDNPurgeURL == "" {
+		return nil
+	}
+	method := config.CDNPurgeMethod
+	if method == "" {
+		method = http.MethodPost
+		if strings.Contains(config.CDNPurgeURL, "{path}") {
+			method = "PURGE"
+		}
+	}
+	return &CDNPurger{
+		url:       config.CDNPurgeURL,
+		method:    method,
+		token:     config.CDNPurgeToken,
+		templates: config.CDNPurgePaths,
+		client:    NewHTTPClient(config, 0),
+	}
+}
+
+// Purge purges the URL paths serving guides, or everything when guides is empty
+func (cp *CDNPurger) Purge(ctx context.Context, guides []string) error {
+	all := len(guides) == 0
+	paths := []string{"/*"}
+	if !all {
+		paths = cp.paths(guides)
+	}
+
+	if !strings.Contains(cp.url, "{path}") {
+		body, err := json.Marshal(map[string]interface{}{"paths": paths, "all": all})
+		if err != nil {
+			return err
+		}
+		return cp.send(ctx, cp.url, body)
+	}
+	for _, p := range paths {
+		if err := cp.send(ctx, strings.ReplaceAll(cp.url, "{path}", strings.TrimPrefix(p, "/")), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paths fills the cdn.purge.paths templates in for guides. Templates
+// without placeholders, such as /download/userguide, may serve any guide
+// and are always included.
+func (cp *CDNPurger) paths(guides []string) []string {
+	var paths []string
+	for _, template := range cp.templates {
+		for _, guide := range guides {
+			product, name := path.Split(guide)
+			product = strings.TrimSuffix(product, "/")
+			if strings.Contains(template, "{product}") && product == "" {
+				continue
+			}
+			p := strings.NewReplacer("{product}", product, "{name}", name).Replace(template)
+			if !slices.Contains(paths, p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+func (cp *CDNPurger) send(ctx context.Context, target string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, cp.method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cp.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cp.token)
+	}
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", cp.method, redactURL(target), resp.Status)
+	}
+	return nil
+}
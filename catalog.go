@@ -0,0 +1,265 @@
+package userguide
+
+import (
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// catalogMaxQuery caps the length of a search query
+const catalogMaxQuery = 200
+
+// CatalogHandler serves the catalog of published guides. Every route has
+// one handler whose data is written as JSON for API clients or rendered
+// with the catalog templates for browsers, chosen by the Accept header.
+type CatalogHandler struct {
+	files     *FileHandler
+	checksums *ChecksumStore
+}
+
+// NewCatalogHandler creates a catalog of the guides recorded in checksums
+func NewCatalogHandler(files *FileHandler, checksums *ChecksumStore) *CatalogHandler {
+	return &CatalogHandler{files: files, checksums: checksums}
+}
+
+// RegisterRoutes registers the catalog routes with the router
+func (ch *CatalogHandler) RegisterRoutes(r *mux.Router) {
+	ch.files.handle(r, "/guides", ch.ListHandler).Methods("GET")
+	ch.files.handle(r, "/guides/{name}", ch.GuideHandler).Methods("GET")
+	ch.files.handle(r, "/guides/{product}/{name}", ch.GuideHandler).Methods("GET")
+	ch.files.handle(r, "/search", Validate(ch.SearchHandler,
+		ParamRule{Source: QueryParam, Name: "q", MaxLength: catalogMaxQuery},
+	).ServeHTTP).Methods("GET")
+}
+
+// catalogEntry describes one published guide
+type catalogEntry struct {
+	Name        string    `json:"name"`
+	Product     string    `json:"product,omitempty"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	Modified    time.Time `json:"modified"`
+	SHA256      string    `json:"sha256"`
+	// URL downloads the guide by content hash
+	URL string `json:"url"`
+	// Details is the catalog page of the guide
+	Details string `json:"details"`
+}
+
+// catalogPage is a list of guides, all of them or those matching Query
+type catalogPage struct {
+	Query  string         `json:"query,omitempty"`
+	Guides []catalogEntry `json:"guides"`
+	Search bool           `json:"-"`
+}
+
+// ListHandler serves GET /guides, the published guides the client may
+// download
+func (ch *CatalogHandler) ListHandler(w http.ResponseWriter, r *http.Request) {
+	page := catalogPage{Guides: ch.entries(r, func(string) bool { return true })}
+	setListingCacheControl(w, identityFromRequest(r, ch.files.utils))
+	renderCatalog(w, r, http.StatusOK, "guides", page)
+}
+
+// GuideHandler serves GET /guides/{name} and /guides/{product}/{name}, the
+// details of one published guide
+func (ch *CatalogHandler) GuideHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	if vars["product"] != "" {
+		name = vars["product"] + "/" + name
+	}
+	entries := ch.entries(r, func(guide string) bool { return guide == name })
+	if len(entries) == 0 {
+		renderCatalogError(w, r, http.StatusNotFound, "User guide not found")
+		return
+	}
+	setListingCacheControl(w, identityFromRequest(r, ch.files.utils))
+	renderCatalog(w, r, http.StatusOK, "guide", entries[0])
+}
+
+// SearchHandler serves GET /search?q=, the guides whose name or product
+// contains every word of the query, ignoring case. Searches scan the
+// checksum manifest, which is in memory from startup, so warm-up has no
+// index to build and uploads none to keep current.
+func (ch *CatalogHandler) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	words := strings.Fields(strings.ToLower(query))
+	page := catalogPage{Query: query, Search: true, Guides: []catalogEntry{}}
+	if len(words) > 0 {
+		page.Guides = ch.entries(r, func(guide string) bool {
+			guide = strings.ToLower(guide)
+			for _, word := range words {
+				if !strings.Contains(guide, word) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	metrics.Inc("userguide_catalog_searches_total")
+	setListingCacheControl(w, identityFromRequest(r, ch.files.utils))
+	renderCatalog(w, r, http.StatusOK, "guides", page)
+}
+
+// entries returns the published guides selected by match that the client
+// may download and that are currently being served, sorted by name
+func (ch *CatalogHandler) entries(r *http.Request, match func(name string) bool) []catalogEntry {
+	identity := identityFromRequest(r, ch.files.utils)
+	files := ch.files.guides(r)
+	entries := []catalogEntry{}
+	for name, sum := range ch.checksums.All() {
+		if !match(name) || !ch.files.listable(r, identity, name) {
+			continue
+		}
+		filePath, err := resolveGuide(files, name)
+		if err != nil {
+			continue
+		}
+		info, err := statGuide(filePath)
+		if err != nil {
+			continue
+		}
+		product, _ := path.Split(name)
+		entries = append(entries, catalogEntry{
+			Name:        name,
+			Product:     strings.TrimSuffix(product, "/"),
+			ContentType: ch.files.utils.GetContentType(path.Base(name)),
+			Size:        info.Size(),
+			Modified:    info.ModTime().UTC(),
+			SHA256:      sum,
+			URL:         "/blobs/" + sum,
+			Details:     "/guides/" + name,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// catalogTemplates render catalog data for browsers: guides for a
+// catalogPage, guide for a catalogEntry and error for a catalogError
+var catalogTemplates = template.Must(template.New("catalog").Funcs(template.FuncMap{
+	"size": formatSize,
+	"date": func(t time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 60em; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: .4em; text-align: left; }
+dt { font-weight: bold; }
+</style>
+</head>
+<body>
+<nav><a href="/guides">All guides</a>
+<form action="/search" method="get" style="display: inline; margin-left: 1em">
+<input type="search" name="q" aria-label="Search guides"> <button>Search</button>
+</form></nav>
+<h1>{{.}}</h1>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "guides"}}{{if .Search}}{{template "header" (printf "Guides matching “%s”" .Query)}}{{else}}{{template "header" "User guides"}}{{end}}
+{{if .Guides}}<table>
+<thead><tr><th>Guide</th><th>Product</th><th>Size</th><th>Updated</th><th></th></tr></thead>
+<tbody>
+{{range .Guides}}<tr><td><a href="{{.Details}}">{{.Name}}</a></td><td>{{.Product}}</td><td>{{size .Size}}</td><td>{{date .Modified}}</td><td><a href="{{.URL}}">Download</a></td></tr>
+{{end}}</tbody>
+</table>
+{{else}}<p>No guides found.</p>
+{{end}}{{template "footer"}}{{end}}
+
+{{define "guide"}}{{template "header" .Name}}
+<dl>
+{{if .Product}}<dt>Product</dt><dd>{{.Product}}</dd>
+{{end}}<dt>Type</dt><dd>{{.ContentType}}</dd>
+<dt>Size</dt><dd>{{size .Size}}</dd>
+<dt>Updated</dt><dd>{{date .Modified}}</dd>
+<dt>SHA-256</dt><dd><code>{{.SHA256}}</code></dd>
+</dl>
+<p><a href="{{.URL}}">Download</a></p>
+{{template "footer"}}{{end}}
+
+{{define "error"}}{{template "header" .Error}}{{template "footer"}}{{end}}
+`))
+
+// renderCatalog writes data as the page template for clients preferring
+// HTML and as JSON otherwise
+func renderCatalog(w http.ResponseWriter, r *http.Request, status int, page string, data interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if !prefersHTML(r) {
+		writeJSON(w, status, data)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := catalogTemplates.ExecuteTemplate(w, page, data); err != nil {
+		log.Printf("Unable to render catalog page %s: %s", page, err.Error())
+	}
+}
+
+// renderCatalogError answers a failed catalog request in the format the
+// client prefers
+func renderCatalogError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	renderCatalog(w, r, status, "error", catalogError{Error: message})
+}
+
+type catalogError struct {
+	Error string `json:"error"`
+}
+
+// prefersHTML reports whether the Accept header ranks HTML above JSON. A
+// bare */* counts for JSON, so API clients and clients accepting neither
+// get JSON; browsers ask for text/html explicitly.
+func prefersHTML(r *http.Request) bool {
+	var html, json float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml", "text/*":
+			html = max(html, q)
+		case "application/json", "application/*", "*/*":
+			json = max(json, q)
+		}
+	}
+	return html > json
+}
+
+// formatSize writes a byte count for people, e.g. 2.4 MB
+func formatSize(bytes int64) string {
+	const unit = 1000
+	if bytes < unit {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+	value, prefix := float64(bytes)/unit, 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + string("kMGTP"[prefix]) + "B"
+}
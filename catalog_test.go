@@ -0,0 +1,95 @@
+package userguide
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"userguide_api_poc/samples"
+)
+
+// writeChecksumManifest records guides as published with placeholder sums
+func writeChecksumManifest(t testing.TB, dir string, guides []string) {
+	t.Helper()
+	hashes := make(map[string]string, len(guides))
+	for _, name := range guides {
+		hashes[name] = strings.Repeat("ab", 32)
+	}
+	data, _ := json.Marshal(hashes)
+	if err := os.WriteFile(filepath.Join(dir, checksumFile), data, 0644); err != nil {
+		t.Fatalf("write checksum manifest: %v", err)
+	}
+}
+
+func TestCatalogSearch(t *testing.T) {
+	guides := []string{"user-guide.pdf", "acme/setup-guide.pdf", "acme/release-notes.md", "globex/setup.pdf"}
+	h := newTestHarness(t, func(config *Config) {
+		config.ProductsEnabled = true
+		writeChecksumManifest(t, config.UserGuidePath, guides)
+	})
+	for _, name := range guides[1:] {
+		h.Storage.Add(name, samples.PDF(name))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"setup", []string{"acme/setup-guide.pdf", "globex/setup.pdf"}},
+		{"ACME Guide", []string{"acme/setup-guide.pdf"}},
+		{"guide", []string{"acme/setup-guide.pdf", "user-guide.pdf"}},
+		{"nothing", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp := h.Get(t, "/search?q="+strings.ReplaceAll(tt.query, " ", "+"), "")
+			var page catalogPage
+			if err := json.NewDecoder(resp.Body).Decode(&page); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, decode: %v", resp.StatusCode, err)
+			}
+			var got []string
+			for _, entry := range page.Guides {
+				got = append(got, entry.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("guides = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkSearch searches a catalog of ten thousand guides, a hundred
+// products of a hundred guides each
+func BenchmarkSearch(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	var guides []string
+	for product := 0; product < 100; product++ {
+		for guide := 0; guide < 100; guide++ {
+			guides = append(guides, fmt.Sprintf("product-%d/guide-%d.pdf", product, guide))
+		}
+	}
+	h := newTestHarness(b, func(config *Config) {
+		config.ProductsEnabled = true
+		writeChecksumManifest(b, config.UserGuidePath, guides)
+	})
+	for _, name := range guides {
+		h.Storage.Add(name, samples.PDF(name))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp := h.Get(b, "/search?q=product-42+guide-7.pdf", "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b.Fatalf("status = %d", resp.StatusCode)
+		}
+	}
+}
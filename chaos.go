@@ -0,0 +1,161 @@
+package userguide
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ChaosEnvVar must be set to "1" for chaos settings to take effect
+const ChaosEnvVar = "USERGUIDE_CHAOS_MODE"
+
+// ChaosConfig configures fault injection for resilience testing
+type ChaosConfig struct {
+	Latency          time.Duration
+	LatencyJitter    time.Duration
+	StorageErrorRate float64
+	TruncateRate     float64
+}
+
+// chaosEnabled reports whether fault injection is allowed in this process
+func chaosEnabled() bool {
+	return os.Getenv(ChaosEnvVar) == "1"
+}
+
+// chaosStorage injects failures into the guide reads of a real storage, so
+// every route reading guides sees them as it would see an outage
+type chaosStorage struct {
+	Storage
+	errorRate float64
+}
+
+// chaosGuides wraps the storage guides are served from with injected
+// errors when chaos mode is on, and returns it unchanged otherwise
+func chaosGuides(config *Config, guides Storage) Storage {
+	if !chaosEnabled() || config.Chaos.StorageErrorRate <= 0 {
+		return guides
+	}
+	return &chaosStorage{Storage: guides, errorRate: config.Chaos.StorageErrorRate}
+}
+
+func (cs *chaosStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := cs.inject("Open", key); err != nil {
+		return nil, err
+	}
+	return cs.Storage.Open(ctx, key)
+}
+
+func (cs *chaosStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := cs.inject("Stat", key); err != nil {
+		return ObjectInfo{}, err
+	}
+	return cs.Storage.Stat(ctx, key)
+}
+
+// LocalPath fails like the reads that fetch remote guides into their cache
+func (cs *chaosStorage) LocalPath(ctx context.Context, key string) (string, error) {
+	if err := cs.inject("LocalPath", key); err != nil {
+		return "", err
+	}
+	return storagePath(ctx, cs.Storage, key)
+}
+
+func (cs *chaosStorage) inject(op, key string) error {
+	if rand.Float64() < cs.errorRate {
+		metrics.Inc("userguide_chaos_injected_total", "fault", "storage_error")
+		return fmt.Errorf("chaos: injected storage error in %s %s", op, key)
+	}
+	return nil
+}
+
+// chaosMiddleware adds latency and randomly truncates response bodies
+func chaosMiddleware(chaos ChaosConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if delay := chaos.Latency + jitter(chaos.LatencyJitter); delay > 0 {
+				metrics.Inc("userguide_chaos_injected_total", "fault", "latency")
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					// The client gave up while waiting
+					timer.Stop()
+					return
+				}
+			}
+
+			if rand.Float64() < chaos.TruncateRate {
+				metrics.Inc("userguide_chaos_injected_total", "fault", "truncate")
+				w = &truncatingWriter{ResponseWriter: w}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(max)))
+}
+
+// truncatingWriter aborts the connection after half of the body: half of
+// the declared Content-Length or, for chunked and compressed responses
+// whose length is unknown, half of the first write
+type truncatingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	limit       int64
+	written     int64
+}
+
+func (tw *truncatingWriter) WriteHeader(status int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.limit = -1
+	if length, err := strconv.ParseInt(tw.Header().Get("Content-Length"), 10, 64); err == nil {
+		tw.limit = length / 2
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *truncatingWriter) Write(p []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.limit < 0 && len(p) > 0 {
+		tw.limit = int64(len(p)) / 2
+	}
+	if tw.limit >= 0 && tw.written+int64(len(p)) > tw.limit {
+		n, _ := tw.ResponseWriter.Write(p[:tw.limit-tw.written])
+		tw.written += int64(n)
+		// Unsent buffered bytes would otherwise be dropped with the
+		// connection, leaving the client less than the truncated body
+		http.NewResponseController(tw.ResponseWriter).Flush()
+		log.Printf("Chaos: truncated response after %d bytes", tw.written)
+		panic(http.ErrAbortHandler)
+	}
+	n, err := tw.ResponseWriter.Write(p)
+	tw.written += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (tw *truncatingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
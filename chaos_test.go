@@ -0,0 +1,156 @@
+package userguide
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"userguide_api_poc/testutil"
+)
+
+func TestChaosStorage(t *testing.T) {
+	t.Setenv(ChaosEnvVar, "1")
+	config := DefaultConfig()
+	config.Chaos.StorageErrorRate = 1
+	store := testutil.NewFakeStorage(t)
+	store.Add("user-guide.pdf", []byte("%PDF-1.4"))
+	chaos := chaosGuides(config, store)
+	ctx := context.Background()
+
+	if _, err := chaos.Open(ctx, "user-guide.pdf"); err == nil {
+		t.Error("Open succeeded")
+	}
+	if _, err := chaos.Stat(ctx, "user-guide.pdf"); err == nil {
+		t.Error("Stat succeeded")
+	}
+	if _, err := storagePath(ctx, chaos, "user-guide.pdf"); err == nil {
+		t.Error("LocalPath succeeded")
+	}
+	if objects, err := chaos.List(ctx, ""); err != nil || len(objects) != 1 {
+		t.Errorf("List = %v, %v; listing is not a guide read", objects, err)
+	}
+	if calls := store.Calls(); len(calls) != 1 || calls[0] != "List()" {
+		t.Errorf("storage calls = %v, want the failed reads never to reach it", calls)
+	}
+
+	config.Chaos.StorageErrorRate = 0
+	if chaosGuides(config, store) != Storage(store) {
+		t.Error("storage wrapped without a storage error rate")
+	}
+	config.Chaos.StorageErrorRate = 1
+	t.Setenv(ChaosEnvVar, "")
+	if chaosGuides(config, store) != Storage(store) {
+		t.Errorf("storage wrapped without %s=1", ChaosEnvVar)
+	}
+}
+
+func TestChaosStorageErrorsReachEveryRoute(t *testing.T) {
+	t.Setenv(ChaosEnvVar, "1")
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, rate := range []float64{0, 1} {
+		h := newTestHarness(t, func(config *Config) {
+			config.ProductsEnabled = true
+			config.Chaos.StorageErrorRate = rate
+		})
+		h.Storage.Add("acme/setup.pdf", []byte("%PDF-1.4"))
+		for _, path := range []string{"/download/userguide", "/products/acme/guides/setup.pdf"} {
+			resp := h.Get(t, path, "")
+			if ok := resp.StatusCode == http.StatusOK; ok != (rate == 0) {
+				t.Errorf("GET %s with error rate %v: status = %d", path, rate, resp.StatusCode)
+			}
+		}
+	}
+}
+
+// truncatedBody serves body through the chaos middleware, always
+// truncating, and returns what the client received
+func truncatedBody(t *testing.T, handler http.HandlerFunc) ([]byte, error) {
+	t.Helper()
+	server := httptest.NewServer(chaosMiddleware(ChaosConfig{TruncateRate: 1})(handler))
+	defer server.Close()
+	// Compressed bodies are counted as sent, not as decompressed
+	server.Client().Transport.(*http.Transport).DisableCompression = true
+	resp, err := server.Client().Get(server.URL + "/download/userguide")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func TestChaosTruncatesResponses(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	body := bytes.Repeat([]byte("user guide "), 2000)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(body)
+	zw.Close()
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		full    int
+	}{
+		{"content length", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Write(body)
+		}, len(body)},
+		{"chunked", func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < len(body); i += 1000 {
+				w.Write(body[i : i+1000])
+				http.NewResponseController(w).Flush()
+			}
+		}, len(body)},
+		{"compressed", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusOK)
+			w.Write(compressed.Bytes())
+		}, compressed.Len()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := truncatedBody(t, tt.handler)
+			if err == nil {
+				t.Errorf("response ended cleanly after %d of %d bytes", len(got), tt.full)
+			}
+			if len(got) >= tt.full {
+				t.Errorf("received %d of %d bytes, want a truncated body", len(got), tt.full)
+			}
+		})
+	}
+}
+
+func TestChaosLatencyEndsWithTheRequest(t *testing.T) {
+	served := false
+	handler := chaosMiddleware(ChaosConfig{Latency: time.Hour})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "/download/userguide", nil).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("injected latency outlived the request")
+	}
+	if served {
+		t.Error("request served after the client gave up")
+	}
+}
@@ -0,0 +1,148 @@
+package userguide
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// checksumFile is the name of the checksum manifest inside the guide directory
+const checksumFile = ".checksums.json"
+
+// ChecksumStore persists the expected SHA-256 of every published guide.
+// The manifest may be shared by several replicas, so updates hold the
+// manifest lock and re-read the file before writing it back.
+type ChecksumStore struct {
+	mu     sync.Mutex
+	path   string
+	locker Locker
+	hashes map[string]string
+}
+
+// NewChecksumStore loads the checksum manifest from the guide directory
+func NewChecksumStore(basePath string, locker Locker) (*ChecksumStore, error) {
+	cs := &ChecksumStore{
+		path:   filepath.Join(basePath, checksumFile),
+		locker: locker,
+		hashes: make(map[string]string),
+	}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Get returns the stored checksum for a guide
+func (cs *ChecksumStore) Get(name string) (string, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sum, ok := cs.hashes[name]
+	return sum, ok
+}
+
+// Set records a guide's checksum and persists the manifest
+func (cs *ChecksumStore) Set(ctx context.Context, name, sum string) error {
+	unlock, err := cs.locker.Lock(ctx, checksumFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if err := cs.load(); err != nil {
+		return err
+	}
+	cs.hashes[name] = sum
+	return cs.save()
+}
+
+// Delete forgets the checksum of a guide that is no longer published
+func (cs *ChecksumStore) Delete(ctx context.Context, name string) error {
+	unlock, err := cs.locker.Lock(ctx, checksumFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if err := cs.load(); err != nil {
+		return err
+	}
+	if _, ok := cs.hashes[name]; !ok {
+		return nil
+	}
+	delete(cs.hashes, name)
+	return cs.save()
+}
+
+// Reload picks up checksums recorded by other replicas
+func (cs *ChecksumStore) Reload() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.load()
+}
+
+// All returns a copy of every stored checksum
+func (cs *ChecksumStore) All() map[string]string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	all := make(map[string]string, len(cs.hashes))
+	for name, sum := range cs.hashes {
+		all[name] = sum
+	}
+	return all
+}
+
+// load replaces the in-memory checksums with the manifest on disk; callers
+// must hold the lock
+func (cs *ChecksumStore) load() error {
+	data, err := os.ReadFile(cs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		return fmt.Errorf("invalid checksum manifest %s: %v", cs.path, err)
+	}
+	cs.hashes = hashes
+	return nil
+}
+
+// save writes the manifest atomically; callers must hold the lock
+func (cs *ChecksumStore) save() error {
+	data, err := json.MarshalIndent(cs.hashes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := cs.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.path)
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := openGuide(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,154 @@
+// Package userguide is the user guide API: configuration, guide storage,
+// the HTTP routes wired by NewApp and the command line run by Main. The
+// userguide command in cmd/userguide only calls Main; tests of code built
+// on the API can start the full router with the userguidetest package.
+package userguide
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Main runs the userguide command with arguments, the command line without
+// the program name: the server, or the subcommand named first
+func Main(arguments []string) {
+	flags := flag.NewFlagSet("userguide", flag.ExitOnError)
+	printConfig := flags.Bool("print-config", false, "print the boot report and effective configuration as JSON and exit")
+	flags.Parse(arguments)
+	args := flags.Args()
+
+	// The demo never reads application.properties, so local settings
+	// cannot break it or make it reach out to other services
+	var config *Config
+	if len(args) > 0 && args[0] == "demo" {
+		demoConfig, cleanup, err := prepareDemo(args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cleanup()
+		config = demoConfig
+	} else {
+		// Load configuration
+		var err error
+		config, err = LoadConfig("application.properties")
+		if err != nil {
+			log.Fatal("Failed to load configuration:", err)
+		}
+	}
+
+	if config.UserGuidePath == "" {
+		log.Fatal("User guide path cannot be empty")
+	}
+
+	// Subcommands run instead of the server
+	if len(args) > 0 {
+		switch args[0] {
+		case "demo":
+			// Runs the server below over generated sample guides
+		case "preview":
+			if err := runPreviewCommand(config, args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "apikey":
+			if err := runAPIKeyCommand(args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "encrypt":
+			if err := runEncryptCommand(config, args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "loadtest":
+			if err := runLoadTestCommand(args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		default:
+			log.Fatalf("Unknown command: %s", args[0])
+		}
+	}
+
+	boot := NewBootReport(config)
+
+	// Stop background work and drain connections on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Create directory if needed
+	if _, err := os.Stat(config.UserGuidePath); os.IsNotExist(err) {
+		err := os.MkdirAll(config.UserGuidePath, 0755)
+		if err != nil {
+			log.Fatal("Failed to create userguides directory:", err)
+		}
+	}
+
+	guides, err := NewGuideStorage(config)
+	if err != nil {
+		log.Fatal("Failed to open guide storage:", err)
+	}
+	app, err := NewApp(ctx, config, guides, boot)
+	if err != nil {
+		closeStorage(guides)
+		log.Fatal(err)
+	}
+	server := NewHTTPServer(config, app.Handler)
+
+	if *printConfig {
+		boot.Listen(":" + config.ServerPort)
+		if err := boot.WriteJSON(os.Stdout); err != nil {
+			log.Fatal("Failed to print configuration:", err)
+		}
+		return
+	}
+	app.Start(ctx)
+
+	listener, err := newListener(config)
+	if err != nil {
+		log.Fatal("Server failed to start:", err)
+	}
+
+	var registrar *ServiceRegistrar
+	if config.DiscoveryEnabled {
+		registrar, err = NewServiceRegistrar(config)
+		if err != nil {
+			log.Fatal("Failed to configure service discovery:", err)
+		}
+		if err := registrar.Register(ctx); err != nil {
+			log.Fatal("Failed to register with Consul:", err)
+		}
+		boot.Backend("service discovery", "consul", registrar.ServiceID())
+	}
+	boot.Listen(listener.Addr().String())
+	boot.Log()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Server failed to start:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+	ready.Store(false)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// Leave the catalog first so the gateway stops routing new requests here
+	if registrar != nil {
+		if err := registrar.Deregister(shutdownCtx); err != nil {
+			log.Printf("Failed to deregister from Consul: %s", err.Error())
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Graceful shutdown incomplete: %s", err.Error())
+	}
+	app.Close(shutdownCtx)
+}
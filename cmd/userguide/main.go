@@ -0,0 +1,13 @@
+// Command userguide serves the user guide API; see the userguide package
+// for its configuration and subcommands.
+package main
+
+import (
+	"os"
+
+	userguide "userguide_api_poc"
+)
+
+func main() {
+	userguide.Main(os.Args[1:])
+}
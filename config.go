@@ -0,0 +1,1711 @@
+package userguide
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds application configuration
+type Config struct {
+	UserGuidePath string
+	UserGuideFile string
+	// FollowSymlinks allows guides reached through symlinks that resolve
+	// inside UserGuidePath; links escaping it are always refused
+	FollowSymlinks bool
+	// Where guides are stored: local (UserGuidePath), s3, gcs, azure, sftp, db
+	// or memory
+	StorageType string
+	// S3 bucket holding guides; S3Endpoint and S3PathStyle point at
+	// S3-compatible stores such as MinIO. Without keys, credentials come
+	// from the environment or the instance's IAM role.
+	S3Bucket          string
+	S3Region          string
+	S3Prefix          string
+	S3Endpoint        string
+	S3PathStyle       bool
+	S3AccessKeyID     string
+	S3AccessKeySecret string
+	S3SessionToken    string
+	// Local copies of guides served from the bucket, and how long object
+	// metadata is trusted before it is checked again
+	S3CachePath string
+	S3CacheTTL  time.Duration
+	// GCS bucket holding guides, read with application-default
+	// credentials unless GCSCredentialsFile names a key file. GCSEndpoint
+	// points at emulators.
+	GCSBucket          string
+	GCSPrefix          string
+	GCSEndpoint        string
+	GCSCredentialsFile string
+	GCSCachePath       string
+	GCSCacheTTL        time.Duration
+	// Attempts after a failed GCS request, the first waiting up to
+	// GCSRetryBackoff and each later one up to twice as long
+	GCSRetries      int
+	GCSRetryBackoff time.Duration
+	// Azure Storage container holding guides, accessed with a shared
+	// access signature or else the host's managed identity (AzureClientID
+	// picks a user-assigned one). AzureEndpoint points at emulators.
+	AzureAccount   string
+	AzureContainer string
+	AzurePrefix    string
+	AzureEndpoint  string
+	AzureSASToken  string
+	AzureClientID  string
+	AzureCachePath string
+	AzureCacheTTL  time.Duration
+	// SFTP server directory holding guides. The server's host key must be
+	// in SFTPKnownHosts or match one of SFTPHostKeyFingerprints (SHA256:...);
+	// logins use the private key, the password, or both.
+	SFTPAddress             string
+	SFTPUser                string
+	SFTPPassword            string
+	SFTPPrivateKeyFile      string
+	SFTPPrivateKeyPassword  string
+	SFTPKnownHosts          string
+	SFTPHostKeyFingerprints []string
+	SFTPPath                string
+	SFTPCachePath           string
+	SFTPCacheTTL            time.Duration
+	// Connections kept to the SFTP server at most, how long an unused one
+	// stays open, and how long connecting and logging in may take
+	SFTPPoolSize    int
+	SFTPIdleTimeout time.Duration
+	SFTPTimeout     time.Duration
+	// PostgreSQL or MySQL database holding guides, addressed by a
+	// postgres:// or mysql:// URL. DBPassword overrides one in the URL.
+	DBURL          string
+	DBPassword     string
+	DBTLS          string
+	DBCAFile       string
+	DBTable        string
+	DBCreateTables bool
+	DBChunkSize    int
+	DBPoolSize     int
+	DBTimeout      time.Duration
+	DBCachePath    string
+	DBCacheTTL     time.Duration
+	// Guides held in memory for tests and demos: the built-in samples, or
+	// none. Served copies go to MemoryCachePath, else a temporary directory.
+	MemorySeed      string
+	MemoryCachePath string
+	// How long a storage swap waits for downloads from the old storage
+	StorageDrainTimeout time.Duration
+
+	// Restricted guides served to bearer token holders only
+	ProtectedPath   string
+	ProtectedTokens []string
+	// Links to restricted guides issued by POST /token/download
+	DownloadTokenSecret string
+	DownloadTokenTTL    time.Duration
+	// How long after a protected download starts it may be resumed
+	DownloadResumeTTL time.Duration
+	// Expiring links to guide routes issued by POST /sign
+	SignedURLSecret string
+	SignedURLTTL    time.Duration
+	SignedURLMaxTTL time.Duration
+	// JWTs accepted on the protected routes, verified against a JWKS endpoint
+	JWTJWKSURL        string
+	JWTIssuer         string
+	JWTAudience       string
+	JWTLeeway         time.Duration
+	JWTJWKSRefresh    time.Duration
+	JWTJWKSMinRefresh time.Duration
+	JWTJWKSTimeout    time.Duration
+	// API keys accepted in X-API-Key, and the routes that require one along
+	// with the scope each needs
+	APIKeysFile  string
+	APIKeyRoutes map[string]string
+	// Downloads made with API keys are appended here for usage reports
+	APIKeyUsageFile string
+	// Opaque OAuth2 tokens checked with an RFC 7662 introspection endpoint
+	// on OAuthRoutes, which require OAuthRequiredScope
+	OAuthIntrospectionURL string
+	OAuthClientID         string
+	OAuthClientSecret     string
+	OAuthRequiredScope    string
+	OAuthRoutes           []string
+	OAuthCacheTTL         time.Duration
+	OAuthNegativeCacheTTL time.Duration
+	OAuthTimeout          time.Duration
+
+	// OpenID Connect sign-in for browsers on OIDCRoutes; bearer JWTs from the
+	// same provider are accepted there too
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCAudience     string
+	OIDCScopes       []string
+	OIDCRoutes       []string
+	OIDCSessionTTL   time.Duration
+	OIDCCookieSecret string
+	OIDCTimeout      time.Duration
+
+	// Server-side sessions remembering callers admitted to the /protected
+	// routes, in memory or in Redis
+	SessionEnabled      bool
+	SessionStore        string
+	SessionTTL          time.Duration
+	SessionIdleTimeout  time.Duration
+	SessionCookieSecure bool
+	SessionMemoryMax    int
+
+	// Roles required per guide, from API key scopes and a JWT claim
+	RBACPolicyFile string
+	RBACRolesClaim string
+
+	// Outbound HTTP client shared by integrations (identity providers,
+	// entitlement and policy services, mirrors, replication)
+	HTTPProxy               string
+	HTTPNoProxy             []string
+	HTTPCAFile              string
+	HTTPTimeout             time.Duration
+	HTTPDialTimeout         time.Duration
+	HTTPMaxIdleConnsPerHost int
+
+	// Remote configuration source layered over this file
+	ConfigSource        string
+	ConfigAddress       string
+	ConfigPrefix        string
+	ConfigToken         string
+	ConfigWatchInterval time.Duration
+	ConfigWatchWait     time.Duration
+
+	// HashiCorp Vault, resolving @vault:<path>#<field> property values: the
+	// server, an Enterprise namespace, the auth method (token or approle)
+	// with its credentials and the AppRole mount
+	VaultAddress       string
+	VaultNamespace     string
+	VaultAuth          string
+	VaultToken         string
+	VaultRoleID        string
+	VaultAppRoleSecret string
+	VaultAppRoleMount  string
+
+	// Consul service registration
+	DiscoveryEnabled          bool
+	DiscoveryConsulAddress    string
+	DiscoveryConsulToken      string
+	DiscoveryServiceName      string
+	DiscoveryServiceID        string
+	DiscoveryTags             []string
+	DiscoveryAdvertiseAddress string
+	DiscoveryCheckURL         string
+	DiscoveryCheckInterval    time.Duration
+
+	// Redis connection shared by distributed features
+	RedisAddress  string
+	RedisPassword string
+	RedisDB       int
+	RedisTimeout  time.Duration
+
+	// Active/passive replication between regions
+	ReplicationRole          string
+	ReplicationTargets       []string
+	ReplicationToken         string
+	ReplicationTimeout       time.Duration
+	ReplicationRetryInterval time.Duration
+	ReplicationResync        time.Duration
+	ReplicationMaxLag        time.Duration
+
+	// Locks serialising guide publishes across replicas
+	LockStore string
+	LockTTL   time.Duration
+	LockWait  time.Duration
+
+	// Leader election for singleton background jobs
+	LeaderElection      string
+	LeaderLeaseName     string
+	LeaderIdentity      string
+	LeaderLeaseDuration time.Duration
+	LeaderRenewInterval time.Duration
+
+	// Canary rollout of a new guide version
+	CanaryFile    string
+	CanaryPercent int
+
+	// Download requests mirrored to a staging instance, ShadowPercent of
+	// them, as HEAD requests or in full per ShadowMode
+	ShadowURL          string
+	ShadowPercent      float64
+	ShadowMode         string
+	ShadowStripHeaders []string
+	ShadowWorkers      int
+	ShadowQueue        int
+	ShadowTimeout      time.Duration
+
+	// Tokenized preview links for draft guides
+	PreviewPath    string
+	PreviewSecret  string
+	PreviewTTL     time.Duration
+	PreviewBaseURL string
+
+	// HTTP server limits
+	ServerPort        string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	BodyReadTimeout   time.Duration
+	WriteTimeout      time.Duration
+	MaxHeaderBytes    int
+	MaxBodyBytes      int64
+	MaxConnections    int
+	ShutdownTimeout   time.Duration
+	// Requests handled at once across all routes and tiers; excess requests
+	// wait in a queue of MaxInFlightQueue for up to MaxInFlightWait, then 503
+	MaxInFlight      int
+	MaxInFlightQueue int
+	MaxInFlightWait  time.Duration
+	// HTTPS serving; with TLSClientCAFile clients authenticate with
+	// certificates it signed (TLSClientAuth require or optional)
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	TLSClientAuth   string
+
+	// Service level objectives tracked per route; burn rates are exposed
+	// for each window. Routes in SLOExcludeRoutes are not tracked.
+	SLOAvailabilityTarget float64
+	SLOLatencyTarget      float64
+	SLOLatencyThreshold   time.Duration
+	SLOWindows            []time.Duration
+	SLOExcludeRoutes      []string
+
+	// Client address rules applied before any handler. X-Forwarded-For is
+	// believed only from IPTrustedProxies.
+	IPAllow               []*net.IPNet
+	IPDeny                []*net.IPNet
+	IPTrustedProxies      []*net.IPNet
+	IPFilterExcludeRoutes []string
+
+	// Route groups (first path segment) whose unsafe requests need a
+	// double-submit CSRF token
+	CSRFGroups []string
+
+	// Cache warm-up before the listener accepts traffic
+	WarmupEnabled bool
+	WarmupTimeout time.Duration
+
+	// Connection reuse and file serving tuning
+	IdleTimeout         time.Duration
+	KeepAlivesEnabled   bool
+	MaxConnectionsPerIP int
+	ZeroCopy            bool
+
+	// Memory-mapped serving of hot files
+	MmapEnabled   bool
+	MmapThreshold int
+	MmapMaxBytes  int64
+
+	// SHA-256 of bytes sent: off, log or trailer
+	DigestMode string
+
+	// Serve verified .br/.gz siblings to clients that accept them
+	PrecompressedEnabled bool
+
+	// Guide uploads
+	UploadEnabled  bool
+	UploadToken    string
+	UploadMaxBytes int64
+	// Time allowed to read an upload or replication body, instead of the
+	// server read timeouts; 0 for no limit
+	UploadBodyTimeout time.Duration
+	// Answer uploads of content already published in the same product with
+	// the existing guide instead of storing a copy
+	UploadDedupe bool
+	// Macro and embedded object handling for Word guides: off, reject or strip
+	OfficeScan string
+	// Where uploads and mirror repairs are written until verified; empty
+	// means .staging inside UserGuidePath
+	StagingPath string
+	// Virus scanning of staged guides: the engine (empty disables it), the
+	// clamd address for clamav, the service and method for icap, where
+	// infected files are moved, how long a scan may take and whether guides
+	// are published when the scanner cannot be reached
+	ScanEngine     string
+	ClamdAddress   string
+	ICAPURL        string
+	ICAPMethod     string
+	QuarantinePath string
+	ScanTimeout    time.Duration
+	ScanFailOpen   bool
+	// Releasing a quarantined guide needs the approval of a second operator
+	QuarantineApproval bool
+
+	// Encryption at rest of published guides: where the key encryption keys
+	// come from (config, env or a registered KMS provider; empty disables
+	// encryption), the id:base64 keys of the config provider with the one
+	// wrapping new guides first, and the variable the env provider reads
+	// them from
+	EncryptionProvider string
+	EncryptionKeys     []string
+	EncryptionKeyEnv   string
+
+	// Bearer token for the /admin operator endpoints
+	AdminToken string
+	// Operators signing in to /admin with Basic auth: user:password entries
+	// (plain or bcrypt) and an htpasswd-style file of bcrypt hashes
+	AdminPasswords    []string
+	AdminPasswordFile string
+
+	// Periodic integrity verification
+	IntegrityInterval     time.Duration
+	IntegrityMirrorURL    string
+	IntegrityFetchTimeout time.Duration
+
+	// How often embargoed guides are launched and expired ones archived
+	ScheduleInterval time.Duration
+
+	// Disk space monitoring
+	DiskCheckInterval      time.Duration
+	DiskWarningPercent     float64
+	DiskCriticalPercent    float64
+	DiskUploadMinFreeBytes uint64
+
+	// Multi-product mode and per-product quotas
+	ProductsEnabled bool
+	Quotas          map[string]Quota
+
+	// Filename validation rules
+	FilenamePolicy FilenamePolicy
+
+	// Release to guide mapping per product
+	Releases map[string]ReleaseMatrix
+
+	// Time windows during which guides matching a pattern may be downloaded
+	AccessWindows map[string]AccessWindow
+
+	// Download authorization: authorizer name and acl rules by guide pattern
+	Authorizer string
+	ACL        map[string][]string
+
+	// Open Policy Agent sidecar for the opa authorizer
+	OPAURL           string
+	OPADownloadRule  string
+	OPAAdminRule     string
+	OPAFailurePolicy string
+	OPATimeout       time.Duration
+	OPABundleURL     string
+	OPABundleRefresh time.Duration
+
+	// License entitlement service for restricted guides
+	LicenseURL              string
+	LicenseRestricted       []string
+	LicenseFailurePolicy    string
+	LicenseTimeout          time.Duration
+	LicenseCacheTTL         time.Duration
+	LicenseNegativeCacheTTL time.Duration
+
+	// API key tiers and admission control
+	Tiers                 map[string]*TierLimits
+	AdmissionMaxInFlight  int
+	AdmissionQueueSize    int
+	AdmissionQueueTimeout time.Duration
+	RateLimitStore        string
+	RateLimitHeaders      bool
+
+	// Fault injection, only honoured when USERGUIDE_CHAOS_MODE=1
+	Chaos ChaosConfig
+
+	// Simulated network conditions for client testing: NetsimDefault
+	// applies to every response, ?netsim= picks a profile per request
+	NetsimEnabled   bool
+	NetsimDefault   string
+	NetworkProfiles map[string]*NetworkProfile
+
+	// Mobile and low-bandwidth editions of guides
+	DeviceVariants DeviceVariants
+
+	// Origins whose pages may link to guides; empty disables the check
+	HotlinkAllowedOrigins    []string
+	HotlinkAllowEmptyReferer bool
+
+	// Origins whose scripts may call the API; empty disables CORS
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSExposedHeaders   []string
+	CORSMaxAge           time.Duration
+	CORSAllowCredentials bool
+
+	// Response headers removed everywhere, and per route group allow-lists
+	HeadersStrip []string
+	HeadersAllow map[string][]string
+
+	// Simultaneous downloads per client identity, 0 for no limit, and how
+	// long an extra download waits for a slot before a 429
+	DownloadMaxConcurrent  int
+	DownloadConcurrentWait time.Duration
+
+	// Download analytics: whether interrupted downloads are tracked, the
+	// period GET /admin/downloads/interruptions summarizes, and the most
+	// downloads kept for it
+	DownloadAnalytics           bool
+	DownloadAnalyticsWindow     time.Duration
+	DownloadAnalyticsMaxRecords int
+
+	// CDN purged by POST /admin/cache/purge: the purge endpoint, with
+	// {path} for one request per URL path, and the guide URL templates
+	CDNPurgeURL    string
+	CDNPurgeMethod string
+	CDNPurgeToken  string
+	CDNPurgePaths  []string
+
+	// Security headers set on every response, with per route group overrides
+	SecurityHeaders SecurityHeaders
+
+	// Formats accepted in the X-Ticket-ID and X-Customer-ID headers
+	AuditTicketPattern   *regexp.Regexp
+	AuditCustomerPattern *regexp.Regexp
+	// Append-only audit log of downloads, auth failures, config reloads and
+	// admin actions; empty disables it
+	AuditLogFile string
+
+	// Largest guide GET /guides/{name}/pages extracts pages from, and the
+	// most its compressed streams may inflate to
+	PagesMaxSourceBytes   int64
+	PagesMaxInflatedBytes int64
+
+	// Most guides one POST /download/batch request may ask for
+	BatchMaxGuides int
+
+	// Request/response fixtures for contract tests: off, record or replay
+	RecordingMode         string
+	RecordingPath         string
+	RecordingMaxBodyBytes int64
+}
+
+// DefaultConfig returns a configuration populated with safe defaults
+func DefaultConfig() *Config {
+	return &Config{
+		FollowSymlinks:    true,
+		StorageType:       StorageBackendLocal,
+		S3Region:          "us-east-1",
+		S3CacheTTL:        30 * time.Second,
+		DownloadTokenTTL:  time.Minute,
+		DownloadResumeTTL: 24 * time.Hour,
+		SignedURLTTL:      time.Hour,
+		SignedURLMaxTTL:   7 * 24 * time.Hour,
+		JWTLeeway:         30 * time.Second,
+		JWTJWKSRefresh:    time.Hour,
+		JWTJWKSMinRefresh: time.Minute,
+		JWTJWKSTimeout:    5 * time.Second,
+
+		DownloadAnalyticsWindow:     24 * time.Hour,
+		DownloadAnalyticsMaxRecords: 10000,
+
+		StorageDrainTimeout: 30 * time.Second,
+		GCSEndpoint:         "https://storage.googleapis.com",
+		GCSCacheTTL:         30 * time.Second,
+		GCSRetries:          3,
+		GCSRetryBackoff:     250 * time.Millisecond,
+		AzureCacheTTL:       30 * time.Second,
+		SFTPCacheTTL:        30 * time.Second,
+		SFTPPoolSize:        4,
+		SFTPIdleTimeout:     5 * time.Minute,
+		SFTPTimeout:         10 * time.Second,
+
+		DBTLS:          DBTLSPrefer,
+		DBTable:        "userguide_blobs",
+		DBCreateTables: true,
+		DBChunkSize:    1 << 20,
+		DBPoolSize:     4,
+		DBTimeout:      10 * time.Second,
+		DBCacheTTL:     30 * time.Second,
+
+		MemorySeed: MemorySeedSamples,
+
+		ShadowMode:         ShadowHeaders,
+		ShadowStripHeaders: []string{"Authorization", "Cookie", "Proxy-Authorization", APIKeyHeader, LicenseKeyHeader},
+		ShadowWorkers:      4,
+		ShadowQueue:        100,
+		ShadowTimeout:      30 * time.Second,
+
+		OAuthRequiredScope:    "userguide:read",
+		OAuthRoutes:           []string{"/download/userguide"},
+		OAuthCacheTTL:         5 * time.Minute,
+		OAuthNegativeCacheTTL: 30 * time.Second,
+		OAuthTimeout:          5 * time.Second,
+		OIDCScopes:            []string{"openid", "profile", "email"},
+		OIDCRoutes:            []string{"/download/userguide"},
+		OIDCSessionTTL:        8 * time.Hour,
+		OIDCTimeout:           5 * time.Second,
+		SessionStore:          SessionStoreMemory,
+		SessionTTL:            8 * time.Hour,
+		SessionIdleTimeout:    30 * time.Minute,
+		SessionCookieSecure:   true,
+		SessionMemoryMax:      10000,
+		RBACRolesClaim:        "roles",
+
+		HTTPTimeout:             10 * time.Second,
+		HTTPDialTimeout:         5 * time.Second,
+		HTTPMaxIdleConnsPerHost: 8,
+
+		ConfigPrefix:        "userguide/",
+		ConfigWatchInterval: 30 * time.Second,
+		ConfigWatchWait:     5 * time.Minute,
+
+		VaultAuth:         VaultAuthToken,
+		VaultAppRoleMount: "approle",
+
+		DiscoveryConsulAddress: "http://localhost:8500",
+		DiscoveryServiceName:   "userguide-api",
+		DiscoveryCheckInterval: 10 * time.Second,
+
+		RedisAddress: "localhost:6379",
+		RedisTimeout: 2 * time.Second,
+
+		ReplicationRole:          ReplicationNone,
+		ReplicationTimeout:       5 * time.Minute,
+		ReplicationRetryInterval: 30 * time.Second,
+		ReplicationResync:        time.Hour,
+		ReplicationMaxLag:        5 * time.Minute,
+
+		LockStore: LockStoreMemory,
+		LockTTL:   time.Minute,
+		LockWait:  30 * time.Second,
+
+		LeaderElection:      LeaderNone,
+		LeaderLeaseName:     "userguide-api-leader",
+		LeaderLeaseDuration: 15 * time.Second,
+		LeaderRenewInterval: 5 * time.Second,
+
+		PreviewTTL: 15 * time.Minute,
+
+		ServerPort:        "8080",
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       time.Minute,
+		BodyReadTimeout:   30 * time.Second,
+		MaxHeaderBytes:    32 << 10,
+		MaxBodyBytes:      1 << 20,
+		ShutdownTimeout:   30 * time.Second,
+		MaxInFlightWait:   time.Second,
+
+		WarmupEnabled: true,
+		WarmupTimeout: 2 * time.Minute,
+
+		IdleTimeout:       2 * time.Minute,
+		KeepAlivesEnabled: true,
+		TLSClientAuth:     ClientAuthRequire,
+
+		SLOAvailabilityTarget: 0.999,
+		SLOLatencyTarget:      0.99,
+		SLOLatencyThreshold:   500 * time.Millisecond,
+		SLOWindows:            []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour},
+		SLOExcludeRoutes:      []string{"/health", "/health/deep", "/ready", "/metrics"},
+		IPFilterExcludeRoutes: []string{"/health", "/health/deep", "/ready"},
+
+		ZeroCopy: true,
+
+		MmapThreshold: 10,
+		MmapMaxBytes:  1 << 30,
+
+		DigestMode: DigestOff,
+
+		PrecompressedEnabled: true,
+
+		UploadMaxBytes: 500 << 20,
+		UploadDedupe:   true,
+		OfficeScan:     OfficeScanReject,
+		ScanTimeout:    time.Minute,
+		ICAPMethod:     "RESPMOD",
+
+		UploadBodyTimeout: 30 * time.Minute,
+
+		QuarantineApproval: true,
+
+		EncryptionKeyEnv: "USERGUIDE_ENCRYPTION_KEYS",
+
+		IntegrityFetchTimeout: 5 * time.Minute,
+		ScheduleInterval:      time.Minute,
+
+		DiskCheckInterval:      time.Minute,
+		DiskWarningPercent:     15,
+		DiskCriticalPercent:    5,
+		DiskUploadMinFreeBytes: 100 << 20,
+
+		Quotas: make(map[string]Quota),
+
+		FilenamePolicy: defaultFilenamePolicy(),
+
+		Releases: make(map[string]ReleaseMatrix),
+
+		AccessWindows: make(map[string]AccessWindow),
+
+		ACL: make(map[string][]string),
+
+		OPAURL:           "http://localhost:8181",
+		OPADownloadRule:  "userguide/download/allow",
+		OPAAdminRule:     "userguide/admin/allow",
+		OPAFailurePolicy: FailClosed,
+		OPATimeout:       2 * time.Second,
+		OPABundleRefresh: 5 * time.Minute,
+
+		LicenseFailurePolicy:    FailClosed,
+		LicenseTimeout:          3 * time.Second,
+		LicenseCacheTTL:         5 * time.Minute,
+		LicenseNegativeCacheTTL: 30 * time.Second,
+
+		Tiers:                 defaultTiers(),
+		AdmissionQueueSize:    100,
+		AdmissionQueueTimeout: 5 * time.Second,
+		RateLimitStore:        RateLimitStoreMemory,
+		RateLimitHeaders:      true,
+
+		NetworkProfiles: defaultNetworkProfiles(),
+
+		DeviceVariants: make(DeviceVariants),
+
+		HotlinkAllowEmptyReferer: true,
+
+		CORSAllowedMethods: []string{"GET", "HEAD", "POST"},
+		CORSAllowedHeaders: []string{"Authorization", "Content-Type", "Range", "If-Range", APIKeyHeader, csrfHeader},
+		CORSExposedHeaders: []string{"Content-Disposition", "Content-Length", "Content-Range", "Accept-Ranges", "Retry-After", "X-Guide-Version", "X-Download-ID"},
+		CORSMaxAge:         10 * time.Minute,
+
+		HeadersStrip: []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version", "X-Runtime"},
+		HeadersAllow: make(map[string][]string),
+
+		SecurityHeaders: defaultSecurityHeaders(),
+
+		CDNPurgePaths: []string{"/download/userguide", "/view/userguide", "/public/download", "/products/{product}/guides/{name}"},
+
+		AuditTicketPattern:   defaultAuditIDPattern,
+		AuditCustomerPattern: defaultAuditIDPattern,
+
+		PagesMaxSourceBytes:   32 << 20,
+		PagesMaxInflatedBytes: 64 << 20,
+		BatchMaxGuides:        50,
+
+		RecordingMode:         RecordingOff,
+		RecordingPath:         "./recordings",
+		RecordingMaxBodyBytes: 1 << 20,
+	}
+}
+
+// LoadConfig loads configuration from properties file, layering properties
+// from a remote configuration source on top when one is configured
+func LoadConfig(filename string) (*Config, error) {
+	props, err := readProperties(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := buildConfig(props)
+	if err != nil || config.ConfigSource == "" {
+		return config, err
+	}
+
+	source, err := NewConfigSource(config)
+	if err != nil {
+		return nil, err
+	}
+	remote, _, err := source.Fetch(context.Background(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load remote configuration: %v", err)
+	}
+	return buildConfig(mergeProperties(props, remote))
+}
+
+// readProperties parses a properties file into key/value pairs
+func readProperties(filename string) (map[string]string, error) {
+	props := make(map[string]string)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Printf("Warning: Could not open config file %s, using defaults", filename)
+		return props, nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		props[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return props, scanner.Err()
+}
+
+// mergeProperties returns base overridden by overrides
+func mergeProperties(base, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overrides))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	return merged
+}
+
+// buildConfig applies properties on top of the defaults
+func buildConfig(props map[string]string) (*Config, error) {
+	props, err := interpolateProperties(props)
+	if err != nil {
+		return nil, err
+	}
+	config := DefaultConfig()
+	// Vault secrets are read once the vault.* settings are known
+	var vaultKeys []string
+	for _, key := range sortedKeys(props) {
+		if strings.HasPrefix(props[key], vaultReferencePrefix) {
+			vaultKeys = append(vaultKeys, key)
+			continue
+		}
+		value, err := resolveFileReference(props[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+		if err := applyProperty(config, key, value); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	if len(vaultKeys) > 0 {
+		if err := applyVaultReferences(config, props, vaultKeys); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// checkConfig rejects settings that are valid alone but unsafe together
+func checkConfig(config *Config) error {
+	// Echoing every origin with credentials would let any site read
+	// responses with the visitor's cookies and tokens
+	if config.CORSAllowCredentials && slices.Contains(config.CORSAllowedOrigins, "*") {
+		return fmt.Errorf("cors.allow.credentials requires cors.allowed.origins to list origins, not *")
+	}
+	// A JWKS may hold the keys of several issuers or tenants, whose tokens
+	// must not be accepted here
+	if config.JWTJWKSURL != "" && config.JWTIssuer == "" {
+		return fmt.Errorf("jwt.jwks.url requires jwt.issuer")
+	}
+	return nil
+}
+
+// interpolateProperties expands ${name} references in property values to
+// the value of the property name or, when there is none, the environment
+// variable name. $${ stands for a literal ${.
+func interpolateProperties(props map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(props))
+	var resolve func(key string, path []string) (string, error)
+	resolve = func(key string, path []string) (string, error) {
+		if value, ok := resolved[key]; ok {
+			return value, nil
+		}
+		if slices.Contains(path, key) {
+			return "", fmt.Errorf("reference cycle %s", strings.Join(append(path, key), " -> "))
+		}
+		value, err := expandReferences(props[key], func(name string) (string, error) {
+			if _, ok := props[name]; ok {
+				return resolve(name, append(path, key))
+			}
+			if env, ok := os.LookupEnv(name); ok {
+				return env, nil
+			}
+			return "", fmt.Errorf("${%s} is neither a property nor an environment variable", name)
+		})
+		if err != nil {
+			return "", err
+		}
+		resolved[key] = value
+		return value, nil
+	}
+	for _, key := range sortedKeys(props) {
+		if _, err := resolve(key, nil); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	return resolved, nil
+}
+
+// expandReferences replaces each ${name} in value with lookup(name)
+func expandReferences(value string, lookup func(name string) (string, error)) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(value, "${")
+		if i < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		if i > 0 && value[i-1] == '$' {
+			b.WriteString(value[:i-1] + "${")
+			value = value[i+2:]
+			continue
+		}
+		end := strings.IndexByte(value[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", value)
+		}
+		name := value[i+2 : i+2+end]
+		if name == "" {
+			return "", fmt.Errorf("empty ${} in %q", value)
+		}
+		replacement, err := lookup(name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value[:i])
+		b.WriteString(replacement)
+		value = value[i+3+end:]
+	}
+}
+
+// fileReferencePrefix marks a property whose value is read from a file,
+// such as a Docker or Kubernetes secret mounted at /run/secrets
+const fileReferencePrefix = "@file:"
+
+// resolveFileReference returns the contents of the file named by an
+// @file:<path> value, without the trailing newline secret files usually
+// end with; other values are returned unchanged
+func resolveFileReference(value string) (string, error) {
+	path, ok := strings.CutPrefix(value, fileReferencePrefix)
+	if !ok {
+		return value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// applyProperty sets the configuration field named by key
+func applyProperty(config *Config, key, value string) error {
+	var err error
+	switch key {
+	case "http.proxy":
+		config.HTTPProxy = value
+		if value != "" {
+			var proxyURL *url.URL
+			if proxyURL, err = url.Parse(value); err == nil && (proxyURL.Scheme == "" || proxyURL.Host == "") {
+				err = fmt.Errorf("proxy must be an absolute URL such as http://proxy.example.com:3128")
+			}
+		}
+	case "http.no.proxy":
+		config.HTTPNoProxy = splitList(value)
+	case "http.ca.file":
+		config.HTTPCAFile = value
+		if value != "" {
+			_, err = loadCAPool(value)
+		}
+	case "http.timeout":
+		config.HTTPTimeout, err = time.ParseDuration(value)
+	case "http.dial.timeout":
+		config.HTTPDialTimeout, err = time.ParseDuration(value)
+	case "http.max.idle.conns.per.host":
+		config.HTTPMaxIdleConnsPerHost, err = strconv.Atoi(value)
+	case "config.source":
+		config.ConfigSource = value
+	case "config.address":
+		config.ConfigAddress = value
+	case "config.prefix":
+		config.ConfigPrefix = value
+	case "config.token":
+		config.ConfigToken = value
+	case "config.watch.interval":
+		config.ConfigWatchInterval, err = time.ParseDuration(value)
+	case "config.watch.wait":
+		config.ConfigWatchWait, err = time.ParseDuration(value)
+	case "vault.address":
+		config.VaultAddress = value
+	case "vault.namespace":
+		config.VaultNamespace = value
+	case "vault.auth":
+		switch value {
+		case VaultAuthToken, VaultAuthAppRole:
+			config.VaultAuth = value
+		default:
+			err = fmt.Errorf("must be %s or %s", VaultAuthToken, VaultAuthAppRole)
+		}
+	case "vault.token":
+		config.VaultToken = value
+	case "vault.approle.role.id":
+		config.VaultRoleID = value
+	case "vault.approle.secret.id":
+		config.VaultAppRoleSecret = value
+	case "vault.approle.mount":
+		config.VaultAppRoleMount = value
+	case "discovery.enabled":
+		config.DiscoveryEnabled, err = strconv.ParseBool(value)
+	case "discovery.consul.address":
+		config.DiscoveryConsulAddress = value
+	case "discovery.consul.token":
+		config.DiscoveryConsulToken = value
+	case "discovery.service.name":
+		config.DiscoveryServiceName = value
+	case "discovery.service.id":
+		config.DiscoveryServiceID = value
+	case "discovery.tags":
+		config.DiscoveryTags = splitList(value)
+	case "discovery.advertise.address":
+		config.DiscoveryAdvertiseAddress = value
+	case "discovery.check.url":
+		config.DiscoveryCheckURL = value
+	case "discovery.check.interval":
+		config.DiscoveryCheckInterval, err = time.ParseDuration(value)
+	case "redis.address":
+		config.RedisAddress = value
+	case "redis.password":
+		config.RedisPassword = value
+	case "redis.db":
+		config.RedisDB, err = strconv.Atoi(value)
+	case "redis.timeout":
+		config.RedisTimeout, err = time.ParseDuration(value)
+	case "replication.role":
+		switch value {
+		case ReplicationNone, ReplicationPrimary, ReplicationSecondary:
+			config.ReplicationRole = value
+		default:
+			err = fmt.Errorf("must be %s, %s or %s", ReplicationNone, ReplicationPrimary, ReplicationSecondary)
+		}
+	case "replication.targets":
+		config.ReplicationTargets = splitList(value)
+	case "replication.token":
+		config.ReplicationToken = value
+	case "replication.timeout":
+		config.ReplicationTimeout, err = time.ParseDuration(value)
+	case "replication.retry.interval":
+		config.ReplicationRetryInterval, err = time.ParseDuration(value)
+	case "replication.resync.interval":
+		config.ReplicationResync, err = time.ParseDuration(value)
+	case "replication.max.lag":
+		config.ReplicationMaxLag, err = time.ParseDuration(value)
+	case "lock.store":
+		switch value {
+		case LockStoreMemory, LockStoreRedis:
+			config.LockStore = value
+		default:
+			err = fmt.Errorf("must be %s or %s", LockStoreMemory, LockStoreRedis)
+		}
+	case "lock.ttl":
+		config.LockTTL, err = time.ParseDuration(value)
+	case "lock.wait":
+		config.LockWait, err = time.ParseDuration(value)
+	case "leader.election":
+		switch value {
+		case LeaderNone, LeaderRedis, LeaderKubernetes:
+			config.LeaderElection = value
+		default:
+			err = fmt.Errorf("must be %s, %s or %s", LeaderNone, LeaderRedis, LeaderKubernetes)
+		}
+	case "leader.lease.name":
+		config.LeaderLeaseName = value
+	case "leader.identity":
+		config.LeaderIdentity = value
+	case "leader.lease.duration":
+		config.LeaderLeaseDuration, err = time.ParseDuration(value)
+	case "leader.renew.interval":
+		config.LeaderRenewInterval, err = time.ParseDuration(value)
+	case "userguide.path":
+		config.UserGuidePath = value
+	case "userguide.follow.symlinks":
+		config.FollowSymlinks, err = strconv.ParseBool(value)
+	case "storage.type":
+		config.StorageType = value
+	case "storage.drain.timeout":
+		config.StorageDrainTimeout, err = time.ParseDuration(value)
+	case "s3.bucket":
+		config.S3Bucket = value
+	case "s3.region":
+		config.S3Region = value
+	case "s3.prefix":
+		config.S3Prefix = value
+	case "s3.endpoint":
+		config.S3Endpoint = value
+	case "s3.path.style":
+		config.S3PathStyle, err = strconv.ParseBool(value)
+	case "s3.access.key.id":
+		config.S3AccessKeyID = value
+	case "s3.secret.access.key":
+		config.S3AccessKeySecret = value
+	case "s3.session.token":
+		config.S3SessionToken = value
+	case "s3.cache.path":
+		config.S3CachePath = value
+	case "s3.cache.ttl":
+		config.S3CacheTTL, err = time.ParseDuration(value)
+	case "gcs.bucket":
+		config.GCSBucket = value
+	case "gcs.prefix":
+		config.GCSPrefix = value
+	case "gcs.endpoint":
+		config.GCSEndpoint = value
+	case "gcs.credentials.file":
+		config.GCSCredentialsFile = value
+	case "gcs.cache.path":
+		config.GCSCachePath = value
+	case "gcs.cache.ttl":
+		config.GCSCacheTTL, err = time.ParseDuration(value)
+	case "azure.account":
+		config.AzureAccount = value
+	case "azure.container":
+		config.AzureContainer = value
+	case "azure.prefix":
+		config.AzurePrefix = value
+	case "azure.endpoint":
+		config.AzureEndpoint = value
+	case "azure.sas.token":
+		config.AzureSASToken = value
+	case "azure.client.id":
+		config.AzureClientID = value
+	case "azure.cache.path":
+		config.AzureCachePath = value
+	case "azure.cache.ttl":
+		config.AzureCacheTTL, err = time.ParseDuration(value)
+	case "sftp.address":
+		config.SFTPAddress = value
+	case "sftp.user":
+		config.SFTPUser = value
+	case "sftp.password":
+		config.SFTPPassword = value
+	case "sftp.private.key.file":
+		config.SFTPPrivateKeyFile = value
+	case "sftp.private.key.password":
+		config.SFTPPrivateKeyPassword = value
+	case "sftp.known.hosts":
+		config.SFTPKnownHosts = value
+	case "sftp.host.key.fingerprints":
+		config.SFTPHostKeyFingerprints = splitList(value)
+	case "sftp.path":
+		config.SFTPPath = value
+	case "sftp.cache.path":
+		config.SFTPCachePath = value
+	case "sftp.cache.ttl":
+		config.SFTPCacheTTL, err = time.ParseDuration(value)
+	case "sftp.pool.size":
+		config.SFTPPoolSize, err = strconv.Atoi(value)
+		if err == nil && config.SFTPPoolSize < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "sftp.pool.idle.timeout":
+		config.SFTPIdleTimeout, err = time.ParseDuration(value)
+	case "sftp.timeout":
+		config.SFTPTimeout, err = time.ParseDuration(value)
+		if err == nil && config.SFTPTimeout <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "db.url":
+		config.DBURL = value
+	case "db.password":
+		config.DBPassword = value
+	case "db.tls":
+		switch value {
+		case DBTLSOff, DBTLSPrefer, DBTLSRequire, DBTLSVerify:
+			config.DBTLS = value
+		default:
+			err = fmt.Errorf("must be off, prefer, require or verify")
+		}
+	case "db.ca.file":
+		config.DBCAFile = value
+	case "db.table":
+		if !dbTableName.MatchString(value) {
+			err = fmt.Errorf("must be letters, digits and underscores")
+		}
+		config.DBTable = value
+	case "db.create.tables":
+		config.DBCreateTables, err = strconv.ParseBool(value)
+	case "db.chunk.size":
+		config.DBChunkSize, err = strconv.Atoi(value)
+		if err == nil && config.DBChunkSize < 1024 {
+			err = fmt.Errorf("must be at least 1024")
+		}
+	case "db.pool.size":
+		config.DBPoolSize, err = strconv.Atoi(value)
+		if err == nil && config.DBPoolSize < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "db.timeout":
+		config.DBTimeout, err = time.ParseDuration(value)
+		if err == nil && config.DBTimeout <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "db.cache.path":
+		config.DBCachePath = value
+	case "db.cache.ttl":
+		config.DBCacheTTL, err = time.ParseDuration(value)
+	case "memory.seed":
+		if value != MemorySeedSamples && value != MemorySeedNone {
+			err = fmt.Errorf("must be samples or none")
+		}
+		config.MemorySeed = value
+	case "memory.cache.path":
+		config.MemoryCachePath = value
+	case "gcs.retries":
+		config.GCSRetries, err = strconv.Atoi(value)
+		if err == nil && config.GCSRetries < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "gcs.retry.backoff":
+		config.GCSRetryBackoff, err = time.ParseDuration(value)
+		if err == nil && config.GCSRetryBackoff <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "protected.path":
+		config.ProtectedPath = value
+	case "protected.tokens":
+		config.ProtectedTokens = splitList(value)
+	case "download.token.secret":
+		config.DownloadTokenSecret = value
+	case "signed.url.secret":
+		config.SignedURLSecret = value
+	case "signed.url.ttl":
+		config.SignedURLTTL, err = time.ParseDuration(value)
+	case "signed.url.max.ttl":
+		config.SignedURLMaxTTL, err = time.ParseDuration(value)
+	case "download.token.ttl":
+		config.DownloadTokenTTL, err = time.ParseDuration(value)
+	case "download.resume.ttl":
+		config.DownloadResumeTTL, err = time.ParseDuration(value)
+	case "jwt.jwks.url":
+		config.JWTJWKSURL = value
+	case "jwt.issuer":
+		config.JWTIssuer = value
+	case "jwt.audience":
+		config.JWTAudience = value
+	case "jwt.leeway":
+		config.JWTLeeway, err = time.ParseDuration(value)
+	case "jwt.jwks.refresh":
+		config.JWTJWKSRefresh, err = time.ParseDuration(value)
+	case "jwt.jwks.min.refresh":
+		config.JWTJWKSMinRefresh, err = time.ParseDuration(value)
+	case "jwt.jwks.timeout":
+		config.JWTJWKSTimeout, err = time.ParseDuration(value)
+	case "apikeys.file":
+		config.APIKeysFile = value
+	case "apikeys.usage.file":
+		config.APIKeyUsageFile = value
+	case "apikeys.routes":
+		config.APIKeyRoutes, err = parseAPIKeyRoutes(value)
+	case "oauth.introspection.url":
+		config.OAuthIntrospectionURL = value
+	case "oauth.client.id":
+		config.OAuthClientID = value
+	case "oauth.client.secret":
+		config.OAuthClientSecret = value
+	case "oauth.required.scope":
+		config.OAuthRequiredScope = value
+	case "oauth.routes":
+		config.OAuthRoutes = splitList(value)
+	case "oauth.cache.ttl":
+		config.OAuthCacheTTL, err = time.ParseDuration(value)
+	case "oauth.cache.negative.ttl":
+		config.OAuthNegativeCacheTTL, err = time.ParseDuration(value)
+	case "oauth.timeout":
+		config.OAuthTimeout, err = time.ParseDuration(value)
+	case "oidc.issuer":
+		config.OIDCIssuer = value
+	case "oidc.client.id":
+		config.OIDCClientID = value
+	case "oidc.client.secret":
+		config.OIDCClientSecret = value
+	case "oidc.redirect.url":
+		config.OIDCRedirectURL = value
+	case "oidc.audience":
+		config.OIDCAudience = value
+	case "oidc.scopes":
+		config.OIDCScopes = splitList(value)
+	case "oidc.routes":
+		config.OIDCRoutes = splitList(value)
+	case "oidc.session.ttl":
+		config.OIDCSessionTTL, err = time.ParseDuration(value)
+	case "oidc.cookie.secret":
+		config.OIDCCookieSecret = value
+	case "oidc.timeout":
+		config.OIDCTimeout, err = time.ParseDuration(value)
+	case "session.enabled":
+		config.SessionEnabled, err = strconv.ParseBool(value)
+	case "session.store":
+		switch value {
+		case SessionStoreMemory, SessionStoreRedis:
+			config.SessionStore = value
+		default:
+			err = fmt.Errorf("must be %s or %s", SessionStoreMemory, SessionStoreRedis)
+		}
+	case "session.ttl":
+		config.SessionTTL, err = time.ParseDuration(value)
+	case "session.idle.timeout":
+		config.SessionIdleTimeout, err = time.ParseDuration(value)
+	case "session.cookie.secure":
+		config.SessionCookieSecure, err = strconv.ParseBool(value)
+	case "session.memory.max":
+		config.SessionMemoryMax, err = strconv.Atoi(value)
+		if err == nil && config.SessionMemoryMax < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "rbac.policy.file":
+		config.RBACPolicyFile = value
+	case "rbac.roles.claim":
+		config.RBACRolesClaim = value
+	case "userguide.filename":
+		config.UserGuideFile = value
+	case "shadow.url":
+		config.ShadowURL = value
+		if value != "" {
+			var target *url.URL
+			if target, err = url.Parse(value); err == nil && (target.Scheme == "" || target.Host == "") {
+				err = fmt.Errorf("must be an absolute URL such as https://staging.example.com")
+			}
+		}
+	case "shadow.percent":
+		config.ShadowPercent, err = strconv.ParseFloat(value, 64)
+		if err == nil && (config.ShadowPercent < 0 || config.ShadowPercent > 100) {
+			err = fmt.Errorf("must be between 0 and 100")
+		}
+	case "shadow.mode":
+		config.ShadowMode = value
+		if value != ShadowHeaders && value != ShadowFull {
+			err = fmt.Errorf("must be %s or %s", ShadowHeaders, ShadowFull)
+		}
+	case "shadow.strip.headers":
+		config.ShadowStripHeaders = splitList(value)
+	case "shadow.workers":
+		config.ShadowWorkers, err = strconv.Atoi(value)
+		if err == nil && config.ShadowWorkers < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "shadow.queue":
+		config.ShadowQueue, err = strconv.Atoi(value)
+		if err == nil && config.ShadowQueue < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "shadow.timeout":
+		config.ShadowTimeout, err = time.ParseDuration(value)
+	case "userguide.canary.filename":
+		config.CanaryFile = value
+	case "userguide.canary.percent":
+		config.CanaryPercent, err = strconv.Atoi(value)
+		if err == nil && (config.CanaryPercent < 0 || config.CanaryPercent > 100) {
+			err = fmt.Errorf("must be between 0 and 100")
+		}
+	case "preview.path":
+		config.PreviewPath = value
+	case "preview.secret":
+		config.PreviewSecret = value
+	case "preview.ttl":
+		config.PreviewTTL, err = time.ParseDuration(value)
+	case "preview.base.url":
+		config.PreviewBaseURL = value
+	case "server.port":
+		config.ServerPort = value
+	case "slo.availability.target":
+		config.SLOAvailabilityTarget, err = parseSLOTarget(value)
+	case "slo.latency.target":
+		config.SLOLatencyTarget, err = parseSLOTarget(value)
+	case "slo.latency.threshold":
+		config.SLOLatencyThreshold, err = time.ParseDuration(value)
+	case "slo.windows":
+		config.SLOWindows = nil
+		for _, item := range splitList(value) {
+			window, parseErr := time.ParseDuration(item)
+			if parseErr != nil || window < time.Minute || window%time.Minute != 0 {
+				return fmt.Errorf("windows must be whole minutes, got %q", item)
+			}
+			config.SLOWindows = append(config.SLOWindows, window)
+		}
+	case "slo.exclude.routes":
+		config.SLOExcludeRoutes = splitList(value)
+	case "ip.allow":
+		config.IPAllow, err = parseNetworks(splitList(value))
+	case "ip.deny":
+		config.IPDeny, err = parseNetworks(splitList(value))
+	case "ip.trusted.proxies":
+		config.IPTrustedProxies, err = parseNetworks(splitList(value))
+	case "ip.filter.exclude.routes":
+		config.IPFilterExcludeRoutes = splitList(value)
+	case "download.max.concurrent.per.client":
+		config.DownloadMaxConcurrent, err = strconv.Atoi(value)
+	case "download.max.concurrent.wait":
+		config.DownloadConcurrentWait, err = time.ParseDuration(value)
+	case "download.analytics.enabled":
+		config.DownloadAnalytics, err = strconv.ParseBool(value)
+	case "download.analytics.window":
+		config.DownloadAnalyticsWindow, err = time.ParseDuration(value)
+		if err == nil && config.DownloadAnalyticsWindow <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "download.analytics.max.records":
+		config.DownloadAnalyticsMaxRecords, err = strconv.Atoi(value)
+		if err == nil && config.DownloadAnalyticsMaxRecords < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "cdn.purge.url":
+		config.CDNPurgeURL = value
+	case "cdn.purge.method":
+		config.CDNPurgeMethod = strings.ToUpper(value)
+	case "cdn.purge.token":
+		config.CDNPurgeToken = value
+	case "cdn.purge.paths":
+		config.CDNPurgePaths = splitList(value)
+	case "csrf.groups":
+		config.CSRFGroups = splitList(value)
+	case "server.tls.cert.file":
+		config.TLSCertFile = value
+	case "server.tls.key.file":
+		config.TLSKeyFile = value
+	case "server.tls.client.ca.file":
+		config.TLSClientCAFile = value
+	case "server.tls.client.auth":
+		config.TLSClientAuth = value
+	case "server.read.header.timeout":
+		config.ReadHeaderTimeout, err = time.ParseDuration(value)
+	case "server.read.timeout":
+		config.ReadTimeout, err = time.ParseDuration(value)
+	case "server.body.read.timeout":
+		config.BodyReadTimeout, err = time.ParseDuration(value)
+	case "server.write.timeout":
+		config.WriteTimeout, err = time.ParseDuration(value)
+	case "server.max.header.bytes":
+		config.MaxHeaderBytes, err = strconv.Atoi(value)
+	case "server.max.body.bytes":
+		config.MaxBodyBytes, err = strconv.ParseInt(value, 10, 64)
+	case "server.max.connections":
+		config.MaxConnections, err = strconv.Atoi(value)
+	case "server.max.inflight":
+		config.MaxInFlight, err = strconv.Atoi(value)
+	case "server.max.inflight.queue":
+		config.MaxInFlightQueue, err = strconv.Atoi(value)
+	case "server.max.inflight.wait":
+		config.MaxInFlightWait, err = time.ParseDuration(value)
+	case "server.shutdown.timeout":
+		config.ShutdownTimeout, err = time.ParseDuration(value)
+	case "server.warmup.enabled":
+		config.WarmupEnabled, err = strconv.ParseBool(value)
+	case "server.warmup.timeout":
+		config.WarmupTimeout, err = time.ParseDuration(value)
+	case "server.idle.timeout":
+		config.IdleTimeout, err = time.ParseDuration(value)
+	case "server.keepalive.enabled":
+		config.KeepAlivesEnabled, err = strconv.ParseBool(value)
+	case "server.max.connections.per.ip":
+		config.MaxConnectionsPerIP, err = strconv.Atoi(value)
+	case "server.zero.copy":
+		config.ZeroCopy, err = strconv.ParseBool(value)
+	case "serve.mmap.enabled":
+		config.MmapEnabled, err = strconv.ParseBool(value)
+	case "serve.mmap.hot.threshold":
+		config.MmapThreshold, err = strconv.Atoi(value)
+	case "serve.mmap.max.bytes":
+		config.MmapMaxBytes, err = strconv.ParseInt(value, 10, 64)
+	case "serve.digest.mode":
+		config.DigestMode = value
+		if value != DigestOff && value != DigestLog && value != DigestTrailer {
+			err = fmt.Errorf("must be one of off, log, trailer")
+		}
+	case "hotlink.allowed.origins":
+		config.HotlinkAllowedOrigins = splitList(value)
+	case "hotlink.allow.empty.referer":
+		config.HotlinkAllowEmptyReferer, err = strconv.ParseBool(value)
+	case "cors.allowed.origins":
+		config.CORSAllowedOrigins = splitList(value)
+	case "cors.allowed.methods":
+		config.CORSAllowedMethods = splitList(value)
+	case "cors.allowed.headers":
+		config.CORSAllowedHeaders = splitList(value)
+	case "cors.exposed.headers":
+		config.CORSExposedHeaders = splitList(value)
+	case "cors.max.age":
+		config.CORSMaxAge, err = time.ParseDuration(value)
+	case "cors.allow.credentials":
+		config.CORSAllowCredentials, err = strconv.ParseBool(value)
+	case "headers.strip":
+		config.HeadersStrip = splitList(value)
+	case "audit.log.file":
+		config.AuditLogFile = value
+	case "audit.ticket.pattern":
+		config.AuditTicketPattern, err = regexp.Compile(`^(?:` + value + `)$`)
+	case "audit.customer.pattern":
+		config.AuditCustomerPattern, err = regexp.Compile(`^(?:` + value + `)$`)
+	case "pages.max.source.bytes":
+		config.PagesMaxSourceBytes, err = strconv.ParseInt(value, 10, 64)
+	case "pages.max.inflated.bytes":
+		config.PagesMaxInflatedBytes, err = strconv.ParseInt(value, 10, 64)
+		if err == nil && config.PagesMaxInflatedBytes < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "batch.max.guides":
+		config.BatchMaxGuides, err = strconv.Atoi(value)
+		if err == nil && config.BatchMaxGuides < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+	case "recording.mode":
+		config.RecordingMode = value
+		if value != RecordingOff && value != RecordingRecord && value != RecordingReplay {
+			err = fmt.Errorf("must be one of off, record, replay")
+		}
+	case "recording.path":
+		config.RecordingPath = value
+	case "recording.max.body.bytes":
+		config.RecordingMaxBodyBytes, err = strconv.ParseInt(value, 10, 64)
+	case "serve.precompressed.enabled":
+		config.PrecompressedEnabled, err = strconv.ParseBool(value)
+	case "upload.enabled":
+		config.UploadEnabled, err = strconv.ParseBool(value)
+	case "upload.token":
+		config.UploadToken = value
+	case "upload.dedupe":
+		config.UploadDedupe, err = strconv.ParseBool(value)
+	case "office.scan":
+		switch value {
+		case OfficeScanOff, OfficeScanReject, OfficeScanStrip:
+			config.OfficeScan = value
+		default:
+			err = fmt.Errorf("must be %s, %s or %s", OfficeScanOff, OfficeScanReject, OfficeScanStrip)
+		}
+	case "scan.engine":
+		config.ScanEngine = value
+	case "scan.clamd.address":
+		config.ClamdAddress = value
+	case "scan.icap.url":
+		config.ICAPURL = value
+	case "scan.icap.method":
+		config.ICAPMethod = value
+	case "scan.quarantine.path":
+		config.QuarantinePath = value
+	case "scan.quarantine.approval":
+		config.QuarantineApproval, err = strconv.ParseBool(value)
+	case "scan.timeout":
+		config.ScanTimeout, err = time.ParseDuration(value)
+	case "scan.fail.open":
+		config.ScanFailOpen, err = strconv.ParseBool(value)
+	case "encryption.provider":
+		config.EncryptionProvider = value
+	case "encryption.keys":
+		config.EncryptionKeys = splitList(value)
+	case "encryption.key.env":
+		config.EncryptionKeyEnv = value
+	case "admin.token":
+		config.AdminToken = value
+	case "admin.passwords":
+		config.AdminPasswords = splitList(value)
+	case "admin.password.file":
+		config.AdminPasswordFile = value
+	case "upload.max.bytes":
+		config.UploadMaxBytes, err = strconv.ParseInt(value, 10, 64)
+	case "upload.body.timeout":
+		config.UploadBodyTimeout, err = time.ParseDuration(value)
+	case "upload.staging.path":
+		config.StagingPath = value
+	case "schedule.check.interval":
+		config.ScheduleInterval, err = time.ParseDuration(value)
+	case "integrity.check.interval":
+		config.IntegrityInterval, err = time.ParseDuration(value)
+	case "integrity.mirror.url":
+		config.IntegrityMirrorURL = value
+	case "integrity.fetch.timeout":
+		config.IntegrityFetchTimeout, err = time.ParseDuration(value)
+	case "disk.check.interval":
+		config.DiskCheckInterval, err = time.ParseDuration(value)
+	case "disk.warning.percent":
+		config.DiskWarningPercent, err = strconv.ParseFloat(value, 64)
+	case "disk.critical.percent":
+		config.DiskCriticalPercent, err = strconv.ParseFloat(value, 64)
+	case "disk.upload.min.free.bytes":
+		config.DiskUploadMinFreeBytes, err = strconv.ParseUint(value, 10, 64)
+	case "products.enabled":
+		config.ProductsEnabled, err = strconv.ParseBool(value)
+	case "validation.filename.pattern":
+		config.FilenamePolicy.Pattern, err = parseFilenamePattern(value)
+	case "validation.filename.max.length":
+		config.FilenamePolicy.MaxLength, err = strconv.Atoi(value)
+	case "validation.filename.dangerous.patterns":
+		config.FilenamePolicy.DangerousPatterns = splitList(value)
+	case "validation.filename.exclude":
+		config.FilenamePolicy.Exclude, err = parseExcludePatterns(value)
+	case "authz.authorizer":
+		config.Authorizer = value
+	case "opa.url":
+		config.OPAURL = value
+	case "opa.download.rule":
+		config.OPADownloadRule = value
+	case "opa.admin.rule":
+		config.OPAAdminRule = value
+	case "opa.failure.policy":
+		switch value {
+		case FailOpen, FailClosed:
+			config.OPAFailurePolicy = value
+		default:
+			err = fmt.Errorf("must be %s or %s", FailOpen, FailClosed)
+		}
+	case "opa.timeout":
+		config.OPATimeout, err = time.ParseDuration(value)
+	case "opa.bundle.url":
+		config.OPABundleURL = value
+	case "opa.bundle.refresh":
+		config.OPABundleRefresh, err = time.ParseDuration(value)
+	case "license.url":
+		config.LicenseURL = value
+	case "license.restricted":
+		config.LicenseRestricted = splitList(value)
+	case "license.failure.policy":
+		switch value {
+		case FailOpen, FailClosed:
+			config.LicenseFailurePolicy = value
+		default:
+			err = fmt.Errorf("must be %s or %s", FailOpen, FailClosed)
+		}
+	case "license.timeout":
+		config.LicenseTimeout, err = time.ParseDuration(value)
+	case "license.cache.ttl":
+		config.LicenseCacheTTL, err = time.ParseDuration(value)
+	case "license.cache.negative.ttl":
+		config.LicenseNegativeCacheTTL, err = time.ParseDuration(value)
+	case "qos.admission.max.inflight":
+		config.AdmissionMaxInFlight, err = strconv.Atoi(value)
+	case "qos.admission.queue.size":
+		config.AdmissionQueueSize, err = strconv.Atoi(value)
+	case "qos.admission.queue.timeout":
+		config.AdmissionQueueTimeout, err = time.ParseDuration(value)
+	case "qos.ratelimit.store":
+		switch value {
+		case RateLimitStoreMemory, RateLimitStoreRedis:
+			config.RateLimitStore = value
+		default:
+			err = fmt.Errorf("must be %s or %s", RateLimitStoreMemory, RateLimitStoreRedis)
+		}
+	case "qos.ratelimit.headers":
+		config.RateLimitHeaders, err = strconv.ParseBool(value)
+	case "netsim.enabled":
+		config.NetsimEnabled, err = strconv.ParseBool(value)
+	case "netsim.default":
+		config.NetsimDefault = value
+	case "chaos.latency":
+		config.Chaos.Latency, err = time.ParseDuration(value)
+	case "chaos.latency.jitter":
+		config.Chaos.LatencyJitter, err = time.ParseDuration(value)
+	case "chaos.storage.error.rate":
+		config.Chaos.StorageErrorRate, err = strconv.ParseFloat(value, 64)
+	case "chaos.truncate.rate":
+		config.Chaos.TruncateRate, err = strconv.ParseFloat(value, 64)
+	default:
+		switch {
+		case strings.HasPrefix(key, "netsim.profile."):
+			err = parseNetworkProfileProperty(config, strings.TrimPrefix(key, "netsim.profile."), value)
+		case strings.HasPrefix(key, "qos.tier."):
+			err = parseTierProperty(config, strings.TrimPrefix(key, "qos.tier."), value)
+		case strings.HasPrefix(key, "quota."):
+			err = parseQuotaProperty(config, strings.TrimPrefix(key, "quota."), value)
+		case strings.HasPrefix(key, "authz.acl."):
+			config.ACL[strings.TrimPrefix(key, "authz.acl.")] = splitList(value)
+		case strings.HasPrefix(key, "embargo."):
+			err = parseWindowProperty(config, "embargo", strings.TrimPrefix(key, "embargo."), value)
+		case strings.HasPrefix(key, "window."):
+			err = parseWindowProperty(config, "window", strings.TrimPrefix(key, "window."), value)
+		case strings.HasPrefix(key, "security.header."):
+			err = parseSecurityHeaderProperty(config, strings.TrimPrefix(key, "security.header."), value)
+		case strings.HasPrefix(key, "headers.allow."):
+			err = parseHeaderAllowProperty(config, strings.TrimPrefix(key, "headers.allow."), value)
+		case strings.HasPrefix(key, "variant."):
+			err = parseVariantProperty(config, strings.TrimPrefix(key, "variant."), value)
+		case strings.HasPrefix(key, "release."):
+			err = parseReleaseProperty(config, strings.TrimPrefix(key, "release."), value)
+		}
+	}
+	return err
+}
+
+// parseTierProperty applies a qos.tier.<name>.<field> property
+func parseTierProperty(config *Config, key, value string) error {
+	name, field, ok := strings.Cut(key, ".")
+	if !ok {
+		return fmt.Errorf("expected qos.tier.<name>.<field>")
+	}
+
+	tier, ok := config.Tiers[name]
+	if !ok {
+		tier = &TierLimits{}
+		config.Tiers[name] = tier
+	}
+
+	var err error
+	switch field {
+	case "keys":
+		tier.Keys = splitList(value)
+	case "rate":
+		tier.RatePerSecond, err = strconv.ParseFloat(value, 64)
+	case "burst":
+		tier.Burst, err = strconv.Atoi(value)
+	case "bandwidth":
+		tier.BandwidthBytes, err = strconv.ParseInt(value, 10, 64)
+	case "bypass.admission":
+		tier.BypassAdmission, err = strconv.ParseBool(value)
+	default:
+		err = fmt.Errorf("unknown tier field %q", field)
+	}
+	return err
+}
+
+// parseNetworkProfileProperty applies a netsim.profile.<name>.<field>
+// property, defining the profile when it is new
+func parseNetworkProfileProperty(config *Config, key, value string) error {
+	name, field, ok := strings.Cut(key, ".")
+	if !ok || name == "off" {
+		return fmt.Errorf("expected netsim.profile.<name>.<field>")
+	}
+
+	profile, ok := config.NetworkProfiles[name]
+	if !ok {
+		profile = &NetworkProfile{}
+		config.NetworkProfiles[name] = profile
+	}
+
+	var err error
+	switch field {
+	case "bandwidth":
+		profile.BandwidthBytes, err = strconv.ParseInt(value, 10, 64)
+	case "latency":
+		profile.Latency, err = time.ParseDuration(value)
+	case "jitter":
+		profile.Jitter, err = time.ParseDuration(value)
+	default:
+		err = fmt.Errorf("unknown profile field %q", field)
+	}
+	return err
+}
+
+// parseSLOTarget parses an objective such as 0.999, which must lie strictly
+// between 0 and 1
+func parseSLOTarget(value string) (float64, error) {
+	target, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if target <= 0 || target >= 1 {
+		return 0, fmt.Errorf("target must be between 0 and 1, e.g. 0.999")
+	}
+	return target, nil
+}
+
+// splitList parses a comma separated property value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,39 @@
+package userguide
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCORSCredentialsRequireListedOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		props   map[string]string
+		wantErr bool
+	}{
+		{"any origin without credentials", map[string]string{"cors.allowed.origins": "*"}, false},
+		{"listed origins with credentials", map[string]string{"cors.allowed.origins": "https://docs.example.com", "cors.allow.credentials": "true"}, false},
+		{"any origin with credentials", map[string]string{"cors.allowed.origins": "*", "cors.allow.credentials": "true"}, true},
+		{"any origin among others with credentials", map[string]string{"cors.allowed.origins": "https://docs.example.com,*", "cors.allow.credentials": "true"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildConfig(tt.props)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "cors.allow.credentials") {
+				t.Errorf("err = %v, does not name the setting", err)
+			}
+		})
+	}
+}
+
+func TestJWKSRequiresIssuer(t *testing.T) {
+	if _, err := buildConfig(map[string]string{"jwt.jwks.url": "https://login.example.com/jwks.json"}); err == nil || !strings.Contains(err.Error(), "jwt.issuer") {
+		t.Errorf("err = %v, want jwt.issuer to be required", err)
+	}
+	if _, err := buildConfig(map[string]string{"jwt.jwks.url": "https://login.example.com/jwks.json", "jwt.issuer": "https://login.example.com/"}); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
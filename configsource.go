@@ -0,0 +1,255 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Remote configuration source types
+const (
+	ConfigSourceConsul = "consul"
+	ConfigSourceEtcd   = "etcd"
+)
+
+// ConfigSource loads properties from a remote key/value store. Fetch returns
+// the properties under the configured prefix together with an opaque index;
+// passing the previous index lets sources that support it block until a change.
+type ConfigSource interface {
+	Fetch(ctx context.Context, index string) (map[string]string, string, error)
+}
+
+// NewConfigSource creates the remote source selected by config.source
+func NewConfigSource(config *Config) (ConfigSource, error) {
+	client := NewHTTPClient(config, config.ConfigWatchWait+30*time.Second)
+	switch config.ConfigSource {
+	case ConfigSourceConsul:
+		return &consulSource{
+			address: strings.TrimSuffix(config.ConfigAddress, "/"),
+			prefix:  config.ConfigPrefix,
+			token:   config.ConfigToken,
+			wait:    config.ConfigWatchWait,
+			client:  client,
+		}, nil
+	case ConfigSourceEtcd:
+		return &etcdSource{
+			address: strings.TrimSuffix(config.ConfigAddress, "/"),
+			prefix:  config.ConfigPrefix,
+			token:   config.ConfigToken,
+			client:  client,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown config source %q", config.ConfigSource)
+}
+
+// keyToProperty maps a store key below prefix to a property name, so both
+// "prefix/userguide.filename" and "prefix/userguide/filename" work
+func keyToProperty(key, prefix string) string {
+	return strings.ReplaceAll(strings.Trim(strings.TrimPrefix(key, prefix), "/"), "/", ".")
+}
+
+// consulSource reads properties from Consul KV using blocking queries
+type consulSource struct {
+	address string
+	prefix  string
+	token   string
+	wait    time.Duration
+	client  *http.Client
+}
+
+func (cs *consulSource) Fetch(ctx context.Context, index string) (map[string]string, string, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index != "" {
+		query.Set("index", index)
+		query.Set("wait", cs.wait.String())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", cs.address+"/v1/kv/"+url.PathEscape(cs.prefix)+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if cs.token != "" {
+		req.Header.Set("X-Consul-Token", cs.token)
+	}
+
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	props := make(map[string]string)
+	newIndex := resp.Header.Get("X-Consul-Index")
+	if resp.StatusCode == http.StatusNotFound {
+		return props, newIndex, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var pairs []struct {
+		Key   string
+		Value []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, "", err
+	}
+	for _, pair := range pairs {
+		if name := keyToProperty(pair.Key, cs.prefix); name != "" && pair.Value != nil {
+			props[name] = strings.TrimSpace(string(pair.Value))
+		}
+	}
+	return props, newIndex, nil
+}
+
+// etcdSource reads properties through the etcd v3 JSON gateway
+type etcdSource struct {
+	address string
+	prefix  string
+	token   string
+	client  *http.Client
+}
+
+func (es *etcdSource) Fetch(ctx context.Context, index string) (map[string]string, string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(es.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixRangeEnd(es.prefix)),
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", es.address+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if es.token != "" {
+		req.Header.Set("Authorization", es.token)
+	}
+
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("etcd returned %s", resp.Status)
+	}
+
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key         []byte `json:"key"`
+			Value       []byte `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+
+	props := make(map[string]string)
+	for _, kv := range result.Kvs {
+		if name := keyToProperty(string(kv.Key), es.prefix); name != "" {
+			props[name] = strings.TrimSpace(string(kv.Value))
+		}
+	}
+	return props, result.Header.Revision, nil
+}
+
+// prefixRangeEnd returns the etcd range end covering every key with prefix
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// ConfigWatcher polls a remote source and rebuilds the configuration when
+// its properties change
+type ConfigWatcher struct {
+	filename  string
+	source    ConfigSource
+	interval  time.Duration
+	listeners []func(*Config)
+}
+
+// NewConfigWatcher creates a watcher layering source over the properties file
+func NewConfigWatcher(filename string, source ConfigSource, interval time.Duration) *ConfigWatcher {
+	return &ConfigWatcher{filename: filename, source: source, interval: interval}
+}
+
+// OnChange registers a function called with each new configuration
+func (cw *ConfigWatcher) OnChange(fn func(*Config)) {
+	cw.listeners = append(cw.listeners, fn)
+}
+
+// Run watches for changes until ctx is cancelled
+func (cw *ConfigWatcher) Run(ctx context.Context) {
+	current, index, err := cw.source.Fetch(ctx, "")
+	if err != nil {
+		log.Printf("Config watch: initial fetch failed: %s", err.Error())
+	}
+
+	for ctx.Err() == nil {
+		props, newIndex, err := cw.source.Fetch(ctx, index)
+		if err != nil {
+			log.Printf("Config watch: fetch failed: %s", err.Error())
+			health.Set("config", StatusDegraded, err.Error())
+			cw.sleep(ctx)
+			continue
+		}
+		health.Set("config", StatusHealthy, "")
+
+		if !maps.Equal(props, current) {
+			cw.apply(props)
+			current = props
+		}
+		if newIndex == index || newIndex == "" {
+			// The source did not block; poll at the configured interval
+			cw.sleep(ctx)
+		}
+		index = newIndex
+	}
+}
+
+func (cw *ConfigWatcher) apply(remote map[string]string) {
+	local, err := readProperties(cw.filename)
+	if err != nil {
+		log.Printf("Config watch: unable to read %s: %s", cw.filename, err.Error())
+		return
+	}
+	config, err := buildConfig(mergeProperties(local, remote))
+	if err != nil {
+		log.Printf("Config watch: ignoring invalid remote configuration: %s", err.Error())
+		metrics.Inc("userguide_config_reloads_total", "result", "invalid")
+		events.Publish(Event{Type: EventConfigReloaded, Subject: cw.filename, Data: map[string]string{"result": "rejected", "error": err.Error()}})
+		return
+	}
+
+	log.Printf("Config watch: remote configuration changed, applying")
+	metrics.Inc("userguide_config_reloads_total", "result", "applied")
+	events.Publish(Event{Type: EventConfigReloaded, Subject: cw.filename})
+	for _, fn := range cw.listeners {
+		fn(config)
+	}
+}
+
+func (cw *ConfigWatcher) sleep(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(cw.interval):
+	}
+}
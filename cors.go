@@ -0,0 +1,128 @@
+package userguide
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CORS lets pages on the configured origins call the API from scripts. It
+// wraps the whole router because preflight OPTIONS requests match no route.
+type CORS struct {
+	origins     []string
+	anyOrigin   bool
+	methods     string
+	headers     []string
+	anyHeader   bool
+	exposed     string
+	maxAge      string
+	credentials bool
+}
+
+// NewCORS creates the middleware for cors.* settings; it returns nil when
+// cors.allowed.origins is empty
+func NewCORS(config *Config) *CORS {
+	if len(config.CORSAllowedOrigins) == 0 {
+		return nil
+	}
+	c := &CORS{
+		methods:     strings.Join(config.CORSAllowedMethods, ", "),
+		exposed:     strings.Join(config.CORSExposedHeaders, ", "),
+		maxAge:      strconv.Itoa(int(config.CORSMaxAge.Seconds())),
+		credentials: config.CORSAllowCredentials,
+	}
+	for _, origin := range config.CORSAllowedOrigins {
+		if origin == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		c.origins = append(c.origins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+	}
+	for _, header := range config.CORSAllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+			continue
+		}
+		c.headers = append(c.headers, http.CanonicalHeaderKey(header))
+	}
+	return c
+}
+
+// Middleware answers preflights itself and adds the CORS response headers
+// to requests from allowed origins. Requests from other origins are served
+// without them, so the browser withholds the response from the page.
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowed(origin) {
+			metrics.Inc("userguide_cors_rejected_total")
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.anyOrigin && !c.credentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", c.methods)
+			if headers := c.allowedHeaders(r.Header.Get("Access-Control-Request-Headers")); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", c.maxAge)
+			metrics.Inc("userguide_cors_preflights_total")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if c.exposed != "" {
+			w.Header().Set("Access-Control-Expose-Headers", c.exposed)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *CORS) allowed(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.origins {
+		if originMatches(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHeaders returns the requested headers the preflight may grant;
+// the browser refuses the request if any it asked for is missing
+func (c *CORS) allowedHeaders(requested string) string {
+	var granted []string
+	for _, header := range strings.Split(requested, ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header != "" && (c.anyHeader || slices.Contains(c.headers, header)) {
+			granted = append(granted, header)
+		}
+	}
+	return strings.Join(granted, ", ")
+}
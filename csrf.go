@@ -0,0 +1,148 @@
+package userguide
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Double-submit CSRF token names
+const (
+	csrfCookie    = "ug_csrf"
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+// CSRFGuard protects state-changing routes against cross-site requests with
+// the double-submit cookie pattern: the token in the ug_csrf cookie must be
+// echoed in the X-CSRF-Token header or a csrf_token form field. Another
+// site can make the browser send the cookie but cannot read it.
+//
+// Routes are enabled by group, the first segment of their path template,
+// so csrf.groups=admin,upload covers /admin/* and /upload/*.
+type CSRFGuard struct {
+	groups []string
+	// proxies may report HTTPS with X-Forwarded-Proto
+	proxies []*net.IPNet
+}
+
+// NewCSRFGuard creates the guard for csrf.groups; it returns nil when no
+// group is listed
+func NewCSRFGuard(config *Config) *CSRFGuard {
+	if len(config.CSRFGroups) == 0 {
+		return nil
+	}
+	return &CSRFGuard{groups: config.CSRFGroups, proxies: config.IPTrustedProxies}
+}
+
+// RegisterRoutes registers GET /csrf, which hands a script the token to
+// echo, setting the cookie if the browser has none yet
+func (cg *CSRFGuard) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/csrf", cg.TokenHandler).Methods("GET")
+}
+
+// TokenHandler answers with the browser's CSRF token
+func (cg *CSRFGuard) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"token": cg.token(w, r), "header": csrfHeader})
+}
+
+// Middleware issues the cookie on safe requests to protected groups and
+// refuses unsafe ones whose echoed token does not match it
+func (cg *CSRFGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cg.protects(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			cg.token(w, r)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !browserCredentials(r) {
+			// Nothing the browser attaches on its own authenticates this request
+			next.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrfCookie)
+		if err != nil || cookie.Value == "" {
+			cg.refuse(w, r, "missing_cookie")
+			return
+		}
+		echoed := r.Header.Get(csrfHeader)
+		if echoed == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			echoed = r.PostFormValue(csrfFormField)
+		}
+		if echoed == "" {
+			cg.refuse(w, r, "missing_token")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(echoed), []byte(cookie.Value)) != 1 {
+			cg.refuse(w, r, "mismatch")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// protects reports whether the matched route belongs to an enabled group
+func (cg *CSRFGuard) protects(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return false
+	}
+	group, _, _ := strings.Cut(strings.TrimPrefix(template, "/"), "/")
+	return slices.Contains(cg.groups, group)
+}
+
+// token returns the browser's CSRF token, issuing a new cookie if it has none
+func (cg *CSRFGuard) token(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	random := make([]byte, 32)
+	rand.Read(random)
+	token := hex.EncodeToString(random)
+	// Scripts must read the cookie to echo it, so it is not HttpOnly
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   forwardedHTTPS(r, cg.proxies),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+func (cg *CSRFGuard) refuse(w http.ResponseWriter, r *http.Request, reason string) {
+	log.Printf("CSRF check failed for %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, reason)
+	metrics.Inc("userguide_csrf_rejected_total", "reason", reason)
+	http.Error(w, "CSRF token missing or invalid", http.StatusForbidden)
+}
+
+// browserCredentials reports whether a request may be authenticated by
+// something a browser sends on its own to any site that triggers it:
+// cookies or HTTP Basic auth. Bearer tokens and API keys are set by the
+// caller's code, which a cross-site form cannot do.
+func browserCredentials(r *http.Request) bool {
+	if len(r.Cookies()) > 0 {
+		return true
+	}
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.EqualFold(scheme, "Basic")
+}
@@ -0,0 +1,110 @@
+package userguide
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newCSRFTestRouter guards the admin group of a router with routes under
+// /admin and /upload
+func newCSRFTestRouter(t *testing.T) http.Handler {
+	t.Helper()
+	config, err := buildConfig(map[string]string{"csrf.groups": "admin", "ip.trusted.proxies": "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	guard := NewCSRFGuard(config)
+	r := mux.NewRouter()
+	r.Use(guard.Middleware)
+	guard.RegisterRoutes(r)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/admin/reload", ok).Methods("GET", "POST")
+	r.HandleFunc("/upload/{name}", ok).Methods("POST")
+	return r
+}
+
+func TestCSRFGuard(t *testing.T) {
+	router := newCSRFTestRouter(t)
+	const token = "0123456789abcdef"
+	form := url.Values{csrfFormField: {token}}.Encode()
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie string
+		header string
+		auth   string
+		form   string
+		want   int
+	}{
+		{"matching header", "/admin/reload", token, token, "", "", http.StatusOK},
+		{"matching form field", "/admin/reload", token, "", "", form, http.StatusOK},
+		{"missing cookie", "/admin/reload", "", token, "Basic YWRtaW46c2VjcmV0", "", http.StatusForbidden},
+		{"missing token", "/admin/reload", token, "", "", "", http.StatusForbidden},
+		{"mismatched header", "/admin/reload", token, "fedcba9876543210", "", "", http.StatusForbidden},
+		{"mismatched form field", "/admin/reload", token, "", "", url.Values{csrfFormField: {"forged"}}.Encode(), http.StatusForbidden},
+		{"Basic auth without token", "/admin/reload", "", "", "Basic YWRtaW46c2VjcmV0", "", http.StatusForbidden},
+		{"Bearer token", "/admin/reload", "", "", "Bearer admin-token", "", http.StatusOK},
+		{"no credentials", "/admin/reload", "", "", "", "", http.StatusOK},
+		{"group not guarded", "/upload/guide.pdf", token, "", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.form))
+			if tt.form != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, tt.header)
+			}
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFCookieSecure(t *testing.T) {
+	router := newCSRFTestRouter(t)
+	tests := []struct {
+		name   string
+		remote string
+		proto  string
+		want   bool
+	}{
+		{"plain HTTP", "192.0.2.7:4000", "", false},
+		{"forwarded by a client", "192.0.2.7:4000", "https", false},
+		{"forwarded by a trusted proxy", "10.0.0.2:4000", "https", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/csrf", nil)
+			r.RemoteAddr = tt.remote
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != csrfCookie {
+				t.Fatalf("cookies = %v, want %s", cookies, csrfCookie)
+			}
+			if cookies[0].Secure != tt.want {
+				t.Errorf("Secure = %t, want %t", cookies[0].Secure, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,539 @@
+package userguide
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StorageBackendDB names the database guide store
+const StorageBackendDB = "db"
+
+// TLS modes of db.tls: prefer encrypts when the server supports it, require
+// always encrypts, verify also checks the server certificate against the
+// system roots and db.ca.file
+const (
+	DBTLSOff     = "off"
+	DBTLSPrefer  = "prefer"
+	DBTLSRequire = "require"
+	DBTLSVerify  = "verify"
+)
+
+func init() {
+	RegisterStorage(StorageBackendDB, func(config *Config) (Storage, error) { return NewDBStorage(config) })
+}
+
+// dbTableName is the pattern db.table must match, as it is part of queries
+var dbTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// DBStorage keeps guides in a PostgreSQL or MySQL database, for
+// deployments that already back one up and want no separate file volume.
+// The table db.table lists the guides; their content is split into rows
+// of db.chunk.size bytes in db.table_chunks, so neither side ever holds a
+// whole guide in memory. Chunks belong to a version: an upload writes a
+// new one and switches the guide to it in one update, so readers never see
+// a partial guide. Like S3Storage it serves guides from local copies.
+type DBStorage struct {
+	target    *sqlTarget
+	table     string
+	chunkSize int
+	create    bool
+	ready     atomic.Bool
+	pool      *sqlPool
+	cache     *objectCache
+}
+
+// sqlTarget is the database server of db.url and how to log in to it
+type sqlTarget struct {
+	driver   string
+	address  string
+	user     string
+	password string
+	database string
+	tls      string
+	rootCAs  *x509.CertPool
+}
+
+// tlsConfig returns the client TLS settings of the db.tls mode
+func (t *sqlTarget) tlsConfig() *tls.Config {
+	host, _, _ := net.SplitHostPort(t.address)
+	return &tls.Config{
+		ServerName:         host,
+		RootCAs:            t.rootCAs,
+		InsecureSkipVerify: t.tls != DBTLSVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+}
+
+// sqlConn is a connection of either client. Queries number their
+// placeholders $1, $2...; rows hold the columns as text, integers in
+// decimal.
+type sqlConn interface {
+	query(query string, args ...any) (rows [][][]byte, affected int64, err error)
+	setDeadline(t time.Time)
+	Close() error
+}
+
+// NewDBStorage creates a storage of the guides in the db.url database
+func NewDBStorage(config *Config) (*DBStorage, error) {
+	target, err := parseDBURL(config.DBURL)
+	if err != nil {
+		return nil, err
+	}
+	if config.DBPassword != "" {
+		target.password = config.DBPassword
+	}
+	target.tls = config.DBTLS
+	if config.DBCAFile != "" {
+		if target.rootCAs, err = loadCAPool(config.DBCAFile); err != nil {
+			return nil, fmt.Errorf("invalid db.ca.file: %v", err)
+		}
+	}
+	cacheDir := config.DBCachePath
+	if cacheDir == "" {
+		cacheDir = filepath.Join(config.UserGuidePath, ".db-cache")
+	}
+	s := &DBStorage{
+		target:    target,
+		table:     config.DBTable,
+		chunkSize: config.DBChunkSize,
+		create:    config.DBCreateTables,
+	}
+	s.pool = newSQLPool(config.DBPoolSize, config.DBTimeout, func(ctx context.Context) (sqlConn, error) {
+		return dialSQL(ctx, target, config.DBTimeout)
+	})
+	if s.cache, err = newObjectCache(StorageBackendDB, s.String(), cacheDir, config.DBCacheTTL); err != nil {
+		return nil, err
+	}
+	s.cache.head = s.head
+	s.cache.download = func(ctx context.Context, info ObjectInfo) (io.ReadCloser, error) {
+		return &dbChunkReader{ctx: ctx, storage: s, info: info}, nil
+	}
+	return s, nil
+}
+
+// parseDBURL reads a postgres://, postgresql:// or mysql:// URL with the
+// user, optional password, host, port and database name
+func parseDBURL(value string) (*sqlTarget, error) {
+	if value == "" {
+		return nil, fmt.Errorf("storage.type=%s needs db.url", StorageBackendDB)
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid db.url %s", redactURL(value))
+	}
+	target := &sqlTarget{database: strings.TrimPrefix(u.Path, "/"), address: u.Host}
+	port := ""
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		target.driver, port = "postgres", "5432"
+	case "mysql":
+		target.driver, port = "mysql", "3306"
+	default:
+		return nil, fmt.Errorf("db.url must be a postgres:// or mysql:// URL, not %s", u.Scheme)
+	}
+	if u.Port() == "" {
+		target.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		target.user = u.User.Username()
+		target.password, _ = u.User.Password()
+	}
+	if target.user == "" {
+		return nil, fmt.Errorf("db.url needs a user name")
+	}
+	return target, nil
+}
+
+// String describes the database table for logs
+func (s *DBStorage) String() string {
+	return s.target.driver + "://" + s.target.user + "@" + s.target.address + "/" + s.target.database + "#" + s.table
+}
+
+// dialSQL connects and logs in to target, giving both timeout to complete
+func dialSQL(ctx context.Context, target *sqlTarget, timeout time.Duration) (sqlConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	raw, err := dialer.DialContext(ctx, "tcp", target.address)
+	if err != nil {
+		return nil, err
+	}
+	raw.SetDeadline(time.Now().Add(timeout))
+	var conn sqlConn
+	if target.driver == "mysql" {
+		conn, err = dialMySQL(raw, target)
+	} else {
+		conn, err = dialPostgres(raw, target)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// withConn runs fn on a pooled connection, creating the tables on first use
+// unless db.create.tables is off
+func (s *DBStorage) withConn(ctx context.Context, fn func(conn sqlConn) error) error {
+	conn, err := s.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	if s.create && !s.ready.Load() {
+		if err = s.createTables(ctx, conn); err != nil {
+			s.pool.put(conn, err)
+			return fmt.Errorf("unable to create the %s tables: %v", s.table, err)
+		}
+		s.ready.Store(true)
+	}
+	err = fn(conn)
+	s.pool.put(conn, err)
+	return err
+}
+
+// createTables creates the guide and chunk tables when they are missing.
+// Names compare byte by byte, like keys of the other storages.
+func (s *DBStorage) createTables(ctx context.Context, conn sqlConn) error {
+	name, blob := "VARCHAR(512)", "BYTEA"
+	if s.target.driver == "mysql" {
+		name, blob = "VARCHAR(512) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin", "LONGBLOB"
+	}
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS " + s.table + " (name " + name + " NOT NULL PRIMARY KEY, size BIGINT NOT NULL, modified BIGINT NOT NULL, version VARCHAR(32) NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + s.table + "_chunks (version VARCHAR(32) NOT NULL, seq INTEGER NOT NULL, data " + blob + " NOT NULL, PRIMARY KEY (version, seq))",
+	} {
+		if _, err := s.pool.exec(ctx, conn, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open reads the current version of key
+func (s *DBStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	info, err := s.head(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &dbChunkReader{ctx: ctx, storage: s, info: info}, nil
+}
+
+func (s *DBStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.cache.Stat(ctx, key)
+}
+
+// head reads the row of key
+func (s *DBStorage) head(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := checkObjectKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	var rows [][][]byte
+	err := s.withConn(ctx, func(conn sqlConn) error {
+		var err error
+		rows, err = s.pool.exec(ctx, conn, "SELECT name, size, modified, version FROM "+s.table+" WHERE name = $1", key)
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("db %s: %v", key, err)
+	}
+	if len(rows) == 0 {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return dbObjectInfo(rows[0])
+}
+
+// LocalPath returns the cached copy of key, downloading it when needed
+func (s *DBStorage) LocalPath(ctx context.Context, key string) (string, error) {
+	return s.cache.LocalPath(ctx, key)
+}
+
+// List returns the guides whose names start with prefix
+func (s *DBStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	pattern := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+	var rows [][][]byte
+	err := s.withConn(ctx, func(conn sqlConn) error {
+		var err error
+		rows, err = s.pool.exec(ctx, conn, "SELECT name, size, modified, version FROM "+s.table+" WHERE name LIKE $1 ESCAPE '!'", pattern)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("db list %s: %v", prefix, err)
+	}
+	objects := make([]ObjectInfo, 0, len(rows))
+	for _, row := range rows {
+		info, err := dbObjectInfo(row)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(info.Key, prefix) || checkObjectKey(info.Key) != nil || hiddenKey(info.Key) {
+			continue
+		}
+		objects = append(objects, info)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Put writes the chunks of body under a new version, then points key's
+// row at it and removes the chunks of the version replaced
+func (s *DBStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	version := hex.EncodeToString(id)
+	defer s.cache.Forget(key)
+
+	err := s.withConn(ctx, func(conn sqlConn) error {
+		buf := make([]byte, s.chunkSize)
+		var size int64
+		for seq := 0; ; seq++ {
+			n, err := io.ReadFull(body, buf)
+			if n > 0 {
+				if _, err := s.pool.exec(ctx, conn, "INSERT INTO "+s.table+"_chunks (version, seq, data) VALUES ($1, $2, $3)", version, seq, buf[:n]); err != nil {
+					return err
+				}
+				size += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		upsert := "INSERT INTO " + s.table + " (name, size, modified, version) VALUES ($1, $2, $3, $4) ON CONFLICT (name) DO UPDATE SET size = EXCLUDED.size, modified = EXCLUDED.modified, version = EXCLUDED.version"
+		if s.target.driver == "mysql" {
+			upsert = "INSERT INTO " + s.table + " (name, size, modified, version) VALUES ($1, $2, $3, $4) ON DUPLICATE KEY UPDATE size = VALUES(size), modified = VALUES(modified), version = VALUES(version)"
+		}
+		var replaced string
+		err := s.transaction(ctx, conn, func() error {
+			var err error
+			if replaced, err = s.lockVersion(ctx, conn, key); err != nil {
+				return err
+			}
+			_, err = s.pool.exec(ctx, conn, upsert, key, size, time.Now().UnixMilli(), version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if replaced != "" {
+			s.pool.exec(ctx, conn, "DELETE FROM "+s.table+"_chunks WHERE version = $1", replaced)
+		}
+		return nil
+	})
+	if err != nil {
+		// Drop the chunks written before the failure
+		s.withConn(context.WithoutCancel(ctx), func(conn sqlConn) error {
+			_, err := s.pool.exec(context.WithoutCancel(ctx), conn, "DELETE FROM "+s.table+"_chunks WHERE version = $1", version)
+			return err
+		})
+		return fmt.Errorf("db upload %s: %v", key, err)
+	}
+	return nil
+}
+
+func (s *DBStorage) Delete(ctx context.Context, key string) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	err := s.withConn(ctx, func(conn sqlConn) error {
+		var deleted string
+		err := s.transaction(ctx, conn, func() error {
+			var err error
+			if deleted, err = s.lockVersion(ctx, conn, key); err != nil || deleted == "" {
+				return err
+			}
+			_, err = s.pool.exec(ctx, conn, "DELETE FROM "+s.table+" WHERE name = $1", key)
+			return err
+		})
+		if err == nil && deleted != "" {
+			_, err = s.pool.exec(ctx, conn, "DELETE FROM "+s.table+"_chunks WHERE version = $1", deleted)
+		}
+		return err
+	})
+	s.cache.Forget(key)
+	if err != nil {
+		return fmt.Errorf("db delete %s: %v", key, err)
+	}
+	s.cache.Remove(key)
+	return nil
+}
+
+// Probe checks that the guide table can be read, for the storage health
+// check
+func (s *DBStorage) Probe(ctx context.Context) error {
+	return s.withConn(ctx, func(conn sqlConn) error {
+		_, err := s.pool.exec(ctx, conn, "SELECT name FROM "+s.table+" WHERE name = $1", ".probe")
+		return err
+	})
+}
+
+// transaction runs fn between BEGIN and COMMIT, rolling back when it fails
+func (s *DBStorage) transaction(ctx context.Context, conn sqlConn, fn func() error) error {
+	if _, err := s.pool.exec(ctx, conn, "BEGIN"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		s.pool.exec(context.WithoutCancel(ctx), conn, "ROLLBACK")
+		return err
+	}
+	_, err := s.pool.exec(ctx, conn, "COMMIT")
+	return err
+}
+
+// lockVersion returns the current version of key, locking its row until
+// the transaction ends; it is empty for a new key
+func (s *DBStorage) lockVersion(ctx context.Context, conn sqlConn, key string) (string, error) {
+	rows, err := s.pool.exec(ctx, conn, "SELECT version FROM "+s.table+" WHERE name = $1 FOR UPDATE", key)
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	return string(rows[0][0]), nil
+}
+
+// dbObjectInfo reads a name, size, modified, version row
+func dbObjectInfo(row [][]byte) (ObjectInfo, error) {
+	if len(row) != 4 {
+		return ObjectInfo{}, fmt.Errorf("db: unexpected row of %d columns", len(row))
+	}
+	size, err := strconv.ParseInt(string(row[1]), 10, 64)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("db: invalid size of %s", row[0])
+	}
+	modified, err := strconv.ParseInt(string(row[2]), 10, 64)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("db: invalid modification time of %s", row[0])
+	}
+	return ObjectInfo{Key: string(row[0]), Size: size, ModTime: time.UnixMilli(modified), Version: string(row[3])}, nil
+}
+
+// dbChunkReader reads the chunks of one version in order, a query each. A
+// chunk gone missing means the guide was replaced or deleted meanwhile.
+type dbChunkReader struct {
+	ctx     context.Context
+	storage *DBStorage
+	info    ObjectInfo
+	seq     int
+	read    int64
+	chunk   []byte
+}
+
+func (r *dbChunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.read >= r.info.Size {
+			return 0, io.EOF
+		}
+		var rows [][][]byte
+		err := r.storage.withConn(r.ctx, func(conn sqlConn) error {
+			var err error
+			rows, err = r.storage.pool.exec(r.ctx, conn, "SELECT data FROM "+r.storage.table+"_chunks WHERE version = $1 AND seq = $2", r.info.Version, r.seq)
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("db %s: %v", r.info.Key, err)
+		}
+		if len(rows) == 0 {
+			return 0, fmt.Errorf("%w: %s", ErrObjectNotFound, r.info.Key)
+		}
+		if len(rows[0][0]) == 0 {
+			return 0, fmt.Errorf("%w: %s", errObjectChanged, r.info.Key)
+		}
+		r.chunk = rows[0][0]
+		r.seq++
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+func (r *dbChunkReader) Close() error { return nil }
+
+// sqlPool hands out database connections, at most size at a time, keeping
+// the idle ones for reuse. Each query gets timeout to complete.
+type sqlPool struct {
+	dial    func(ctx context.Context) (sqlConn, error)
+	timeout time.Duration
+	slots   chan struct{}
+	idle    chan sqlConn
+}
+
+func newSQLPool(size int, timeout time.Duration, dial func(ctx context.Context) (sqlConn, error)) *sqlPool {
+	return &sqlPool{dial: dial, timeout: timeout, slots: make(chan struct{}, size), idle: make(chan sqlConn, size)}
+}
+
+// get returns an idle connection, or a new one when there is none, waiting
+// while size connections are in use
+func (p *sqlPool) get(ctx context.Context) (sqlConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case conn := <-p.idle:
+		metrics.Inc("userguide_db_connections_total", "result", "reused")
+		return conn, nil
+	default:
+	}
+	conn, err := p.dial(ctx)
+	if err != nil {
+		<-p.slots
+		metrics.Inc("userguide_db_connections_total", "result", "failed")
+		return nil, fmt.Errorf("database connection failed: %v", err)
+	}
+	metrics.Inc("userguide_db_connections_total", "result", "new")
+	return conn, nil
+}
+
+// put returns conn to the pool after a query ended with err. The
+// connection is kept after errors the server reported, whose state is
+// known, and closed after I/O errors.
+func (p *sqlPool) put(conn sqlConn, err error) {
+	var pgErr *pgError
+	var mysqlErr *mysqlError
+	if err == nil || errors.As(err, &pgErr) || errors.As(err, &mysqlErr) {
+		select {
+		case p.idle <- conn:
+		default:
+			conn.Close()
+		}
+	} else {
+		conn.Close()
+	}
+	<-p.slots
+}
+
+// exec runs query on conn within the pool timeout and ctx. Cancelling ctx
+// interrupts the query; the connection then fails and is closed.
+func (p *sqlPool) exec(ctx context.Context, conn sqlConn, query string, args ...any) ([][][]byte, error) {
+	deadline := time.Now().Add(p.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.setDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.setDeadline(time.Unix(1, 0)) })
+	defer stop()
+	rows, _, err := conn.query(query, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return rows, err
+}
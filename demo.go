@@ -0,0 +1,106 @@
+package userguide
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"userguide_api_poc/samples"
+)
+
+// demoToken is the bearer token for uploads and protected guides in demo mode
+const demoToken = "demo-token"
+
+// demoGuides are generated below the demo directory next to the embedded
+// sample guides, by path
+var demoGuides = map[string][]byte{
+	"protected/service-manual.pdf": samples.PDF("Service Manual (restricted)"),
+	"drafts/draft-guide.pdf":       samples.PDF("Draft Guide"),
+}
+
+// prepareDemo returns a self-contained configuration serving generated
+// guides from a temporary directory, with verbose logging. It starts from
+// the defaults, so only -port and -memory shape it. The returned function
+// removes the directory.
+func prepareDemo(args []string) (*Config, func(), error) {
+	fs := flag.NewFlagSet("demo", flag.ContinueOnError)
+	port := fs.String("port", "8080", "port to listen on")
+	keep := fs.Bool("keep", false, "keep the generated guides on exit")
+	memory := fs.Bool("memory", false, "serve the sample guides from memory (storage.type=memory)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "userguide-demo-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		if *keep {
+			log.Printf("Demo guides kept in %s", dir)
+			return
+		}
+		os.RemoveAll(dir)
+	}
+	if !*memory {
+		// The memory storage holds the samples itself
+		if err := os.CopyFS(filepath.Join(dir, "guides"), samples.Guides()); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	for name, content := range demoGuides {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	config := DefaultConfig()
+	config.ServerPort = *port
+	config.UserGuidePath = filepath.Join(dir, "guides")
+	if *memory {
+		config.StorageType = StorageBackendMemory
+		config.MemoryCachePath = filepath.Join(dir, "memory-cache")
+	}
+	config.UserGuideFile = "user-guide.pdf"
+	config.CanaryFile = "user-guide-v2.pdf"
+	config.CanaryPercent = 50
+	config.ProductsEnabled = true
+	config.UploadEnabled = true
+	config.UploadToken = demoToken
+	config.ProtectedPath = filepath.Join(dir, "protected")
+	config.ProtectedTokens = []string{demoToken}
+	config.PreviewPath = filepath.Join(dir, "drafts")
+	config.PreviewSecret = hex.EncodeToString(secret)
+	config.PreviewBaseURL = "http://localhost:" + *port
+	config.DiskCheckInterval = 0
+
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+
+	base := "http://localhost:" + *port
+	fmt.Printf("Demo guides generated in %s\n\n", dir)
+	fmt.Println("Try:")
+	fmt.Printf("  curl -OJ %s/download/userguide\n", base)
+	fmt.Printf("  curl -OJ %s/products/acme/guides/setup-guide.pdf\n", base)
+	fmt.Printf("  curl -OJ %s/products/acme/releases/2.4.1/userguide\n", base)
+	fmt.Printf("  curl -OJ -H 'Authorization: Bearer %s' %s/protected/guides/service-manual.pdf\n", demoToken, base)
+	fmt.Printf("  curl -X PUT -H 'Authorization: Bearer %s' --data-binary @guide.pdf %s/upload/acme/new-guide.pdf\n", demoToken, base)
+	if token, _, err := NewPreviewService(config).CreateToken("draft-guide.pdf"); err == nil {
+		fmt.Printf("  curl -OJ %s/preview/%s\n", base, token)
+	}
+	fmt.Printf("  curl %s/health/deep\n\n", base)
+	return config, cleanup, nil
+}
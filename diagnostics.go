@@ -0,0 +1,239 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Diagnostic check outcomes
+const (
+	DiagnosticPass = "pass"
+	DiagnosticFail = "fail"
+	DiagnosticSkip = "skip"
+)
+
+// diagnosticTimeout bounds each diagnostic check
+const diagnosticTimeout = 5 * time.Second
+
+// DiagnosticResult is the outcome of one diagnostic check
+type DiagnosticResult struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// DiagnosticReport is the body returned by GET /admin/diagnostics
+type DiagnosticReport struct {
+	Status string             `json:"status"`
+	Checks []DiagnosticResult `json:"checks"`
+}
+
+// errDiagnosticSkipped marks a check that does not apply to this instance
+type errDiagnosticSkipped string
+
+func (e errDiagnosticSkipped) Error() string { return string(e) }
+
+// DiagnosticsHandler runs the self-diagnostic checks and reports each
+// result; the status is 503 when any check fails
+func (ah *AdminHandler) DiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.permitted(w, r, "diagnostics.run", "diagnostics") {
+		return
+	}
+	ah.mu.RLock()
+	config := ah.config
+	ah.mu.RUnlock()
+
+	checks := []struct {
+		name string
+		run  func(ctx context.Context, config *Config) (string, error)
+	}{
+		{"guide.read", ah.checkGuideRead},
+		{"storage.write", checkStorageWrite},
+		{"dns.outbound", checkOutboundDNS},
+		{"metadata.checksums", checkChecksumManifest},
+		{"metadata.redis", checkRedis},
+	}
+
+	report := DiagnosticReport{Status: DiagnosticPass}
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), diagnosticTimeout)
+		start := time.Now()
+		detail, err := check.run(ctx, config)
+		cancel()
+
+		result := DiagnosticResult{Name: check.name, Status: DiagnosticPass, Detail: detail, DurationMS: time.Since(start).Milliseconds()}
+		if skipped, ok := err.(errDiagnosticSkipped); ok {
+			result.Status, result.Detail = DiagnosticSkip, string(skipped)
+		} else if err != nil {
+			result.Status, result.Detail = DiagnosticFail, err.Error()
+			report.Status = DiagnosticFail
+		}
+		metrics.Inc("userguide_diagnostic_checks_total", "check", check.name, "status", result.Status)
+		report.Checks = append(report.Checks, result)
+	}
+
+	status := http.StatusOK
+	if report.Status == DiagnosticFail {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
+
+// checkGuideRead resolves the configured user guide and reads from it
+func (ah *AdminHandler) checkGuideRead(ctx context.Context, config *Config) (string, error) {
+	filePath, err := ah.fileService.DownloadUserGuide()
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %v", config.UserGuideFile, err)
+	}
+	file, err := openGuide(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	n, err := file.Read(make([]byte, 512))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return fmt.Sprintf("read %d bytes of %s", n, filepath.Base(filePath)), nil
+}
+
+// checkStorageWrite writes, syncs and removes a temporary file where
+// published guides are stored
+func checkStorageWrite(ctx context.Context, config *Config) (string, error) {
+	if !config.UploadEnabled && config.ReplicationRole != ReplicationSecondary {
+		return "", errDiagnosticSkipped("guides are not written by this instance")
+	}
+	file, err := os.CreateTemp(config.UserGuidePath, ".diagnostics-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("diagnostics"); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return "wrote " + config.UserGuidePath, nil
+}
+
+// checkOutboundDNS resolves every host this instance calls out to
+func checkOutboundDNS(ctx context.Context, config *Config) (string, error) {
+	hosts := outboundHosts(config)
+	if len(hosts) == 0 {
+		return "", errDiagnosticSkipped("no outbound services configured")
+	}
+	var failed []string
+	for _, host := range hosts {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", host, err))
+		}
+	}
+	if len(failed) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return "resolved " + strings.Join(hosts, ", "), nil
+}
+
+// outboundHosts lists the hosts of the services the configuration enables
+func outboundHosts(config *Config) []string {
+	var addresses []string
+	if config.ConfigSource != "" {
+		addresses = append(addresses, config.ConfigAddress)
+	}
+	if config.DiscoveryEnabled {
+		addresses = append(addresses, config.DiscoveryConsulAddress)
+	}
+	if config.Authorizer == AuthorizerOPA {
+		addresses = append(addresses, config.OPAURL, config.OPABundleURL)
+	}
+	addresses = append(addresses, config.LicenseURL, config.IntegrityMirrorURL)
+	if config.ReplicationRole == ReplicationPrimary {
+		addresses = append(addresses, config.ReplicationTargets...)
+	}
+	if usesRedis(config) {
+		addresses = append(addresses, config.RedisAddress)
+	}
+
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, address := range addresses {
+		host := hostOf(address)
+		if host == "" || seen[host] || net.ParseIP(host) != nil {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// hostOf returns the host of a URL or host:port address
+func hostOf(address string) string {
+	if strings.Contains(address, "://") {
+		if u, err := url.Parse(address); err == nil {
+			return u.Hostname()
+		}
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// usesRedis reports whether any shared state lives in Redis
+func usesRedis(config *Config) bool {
+	return config.LockStore == LockStoreRedis || config.RateLimitStore == RateLimitStoreRedis || config.LeaderElection == LeaderRedis ||
+		(config.SessionEnabled && config.SessionStore == SessionStoreRedis)
+}
+
+// checkChecksumManifest parses the checksum manifest that records every
+// published guide
+func checkChecksumManifest(ctx context.Context, config *Config) (string, error) {
+	path := filepath.Join(config.UserGuidePath, checksumFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", errDiagnosticSkipped("no guides published through this service yet")
+	}
+	if err != nil {
+		return "", err
+	}
+	var hashes map[string]string
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		return "", fmt.Errorf("invalid checksum manifest %s: %v", path, err)
+	}
+	return fmt.Sprintf("%d guides recorded", len(hashes)), nil
+}
+
+// checkRedis pings the Redis server holding shared state
+func checkRedis(ctx context.Context, config *Config) (string, error) {
+	if !usesRedis(config) {
+		return "", errDiagnosticSkipped("no shared state in Redis")
+	}
+	client := NewRedisClient(config)
+	defer client.Close()
+	reply, err := client.Do(ctx, "PING")
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", config.RedisAddress, err)
+	}
+	return fmt.Sprintf("%s answered %v", config.RedisAddress, reply), nil
+}
@@ -0,0 +1,120 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ServiceRegistrar registers this instance with the Consul agent catalog
+type ServiceRegistrar struct {
+	address string
+	token   string
+	service consulService
+	client  *http.Client
+}
+
+type consulService struct {
+	ID      string
+	Name    string
+	Tags    []string
+	Address string
+	Port    int
+	Check   consulCheck
+}
+
+type consulCheck struct {
+	HTTP                           string
+	Interval                       string
+	Timeout                        string
+	DeregisterCriticalServiceAfter string
+}
+
+// NewServiceRegistrar builds the service definition for this instance
+func NewServiceRegistrar(config *Config) (*ServiceRegistrar, error) {
+	port, err := strconv.Atoi(config.ServerPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server port %q", config.ServerPort)
+	}
+
+	advertise := config.DiscoveryAdvertiseAddress
+	if advertise == "" {
+		if advertise, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	id := config.DiscoveryServiceID
+	if id == "" {
+		id = fmt.Sprintf("%s-%s-%d", config.DiscoveryServiceName, advertise, port)
+	}
+
+	checkURL := config.DiscoveryCheckURL
+	if checkURL == "" {
+		checkURL = (&url.URL{Scheme: "http", Host: fmt.Sprintf("%s:%d", advertise, port), Path: "/health"}).String()
+	}
+
+	return &ServiceRegistrar{
+		address: strings.TrimSuffix(config.DiscoveryConsulAddress, "/"),
+		token:   config.DiscoveryConsulToken,
+		service: consulService{
+			ID:      id,
+			Name:    config.DiscoveryServiceName,
+			Tags:    config.DiscoveryTags,
+			Address: advertise,
+			Port:    port,
+			Check: consulCheck{
+				HTTP:                           checkURL,
+				Interval:                       config.DiscoveryCheckInterval.String(),
+				Timeout:                        "5s",
+				DeregisterCriticalServiceAfter: "10m",
+			},
+		},
+		client: NewHTTPClient(config, 0),
+	}, nil
+}
+
+// ServiceID returns the registered instance ID
+func (sr *ServiceRegistrar) ServiceID() string {
+	return sr.service.ID
+}
+
+// Register adds this instance and its health check to the catalog
+func (sr *ServiceRegistrar) Register(ctx context.Context) error {
+	body, err := json.Marshal(sr.service)
+	if err != nil {
+		return err
+	}
+	return sr.put(ctx, "/v1/agent/service/register", body)
+}
+
+// Deregister removes this instance from the catalog
+func (sr *ServiceRegistrar) Deregister(ctx context.Context) error {
+	return sr.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(sr.service.ID), nil)
+}
+
+func (sr *ServiceRegistrar) put(ctx context.Context, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", sr.address+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if sr.token != "" {
+		req.Header.Set("X-Consul-Token", sr.token)
+	}
+
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul returned %s", resp.Status)
+	}
+	return nil
+}
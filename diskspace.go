@@ -0,0 +1,125 @@
+package userguide
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Disk space levels reported by the monitor
+const (
+	DiskOK       = "ok"
+	DiskWarning  = "warning"
+	DiskCritical = "critical"
+)
+
+// Event types for disk space level changes
+const (
+	EventDiskWarning   = "disk.warning"
+	EventDiskCritical  = "disk.critical"
+	EventDiskRecovered = "disk.recovered"
+)
+
+// ErrInsufficientStorage is returned when an upload would exhaust disk space
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// DiskUsage is a snapshot of filesystem capacity
+type DiskUsage struct {
+	TotalBytes uint64 `json:"totalBytes"`
+	FreeBytes  uint64 `json:"freeBytes"`
+}
+
+// FreePercent returns the free space as a percentage of the total
+func (du DiskUsage) FreePercent() float64 {
+	if du.TotalBytes == 0 {
+		return 0
+	}
+	return float64(du.FreeBytes) / float64(du.TotalBytes) * 100
+}
+
+// DiskMonitor watches free space under the guide directory
+type DiskMonitor struct {
+	path            string
+	warningPercent  float64
+	criticalPercent float64
+	uploadMinFree   uint64
+
+	mu    sync.Mutex
+	level string
+}
+
+// NewDiskMonitor creates a monitor for the guide directory
+func NewDiskMonitor(config *Config) *DiskMonitor {
+	return &DiskMonitor{
+		path:            config.UserGuidePath,
+		warningPercent:  config.DiskWarningPercent,
+		criticalPercent: config.DiskCriticalPercent,
+		uploadMinFree:   config.DiskUploadMinFreeBytes,
+		level:           DiskOK,
+	}
+}
+
+// Check measures free space, updates metrics and health, and emits an event
+// whenever the level changes
+func (dm *DiskMonitor) Check(ctx context.Context) error {
+	usage, err := diskUsage(dm.path)
+	if err != nil {
+		health.Set("disk", StatusUnhealthy, err.Error())
+		return err
+	}
+
+	metrics.Set("userguide_disk_free_bytes", float64(usage.FreeBytes))
+	metrics.Set("userguide_disk_total_bytes", float64(usage.TotalBytes))
+
+	level := DiskOK
+	switch free := usage.FreePercent(); {
+	case free < dm.criticalPercent:
+		level = DiskCritical
+	case free < dm.warningPercent:
+		level = DiskWarning
+	}
+
+	detail := fmt.Sprintf("%.1f%% free (%d bytes)", usage.FreePercent(), usage.FreeBytes)
+	switch level {
+	case DiskOK:
+		health.Set("disk", StatusHealthy, detail)
+	case DiskWarning:
+		health.Set("disk", StatusDegraded, detail)
+	case DiskCritical:
+		health.Set("disk", StatusUnhealthy, detail)
+	}
+
+	dm.mu.Lock()
+	previous := dm.level
+	dm.level = level
+	dm.mu.Unlock()
+
+	if level != previous {
+		eventType := EventDiskRecovered
+		switch level {
+		case DiskWarning:
+			eventType = EventDiskWarning
+		case DiskCritical:
+			eventType = EventDiskCritical
+		}
+		events.Publish(Event{Type: eventType, Subject: dm.path, Data: map[string]string{"free": detail, "previous": previous}})
+	}
+	return nil
+}
+
+// EnsureRoom returns ErrInsufficientStorage if writing size more bytes would
+// leave less than the configured minimum free space
+func (dm *DiskMonitor) EnsureRoom(size int64) error {
+	usage, err := diskUsage(dm.path)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		size = 0
+	}
+	if usage.FreeBytes < uint64(size) || usage.FreeBytes-uint64(size) < dm.uploadMinFree {
+		return fmt.Errorf("%w: %d bytes free", ErrInsufficientStorage, usage.FreeBytes)
+	}
+	return nil
+}
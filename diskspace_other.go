@@ -0,0 +1,10 @@
+//go:build !unix
+
+package userguide
+
+import "errors"
+
+// diskUsage is not supported on this platform
+func diskUsage(path string) (DiskUsage, error) {
+	return DiskUsage{}, errors.New("disk usage not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package userguide
+
+import "syscall"
+
+// diskUsage reports capacity of the filesystem containing path
+func diskUsage(path string) (DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskUsage{}, err
+	}
+	return DiskUsage{
+		TotalBytes: st.Blocks * uint64(st.Bsize),
+		FreeBytes:  st.Bavail * uint64(st.Bsize),
+	}, nil
+}
@@ -0,0 +1,108 @@
+package userguide
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DownloadLimiter caps the downloads one client streams at once. Clients
+// are told apart by Identity.Subject, so an API key or signed-in user is
+// limited across all its addresses and anonymous clients per address.
+type DownloadLimiter struct {
+	max   int
+	wait  time.Duration
+	utils *Utils
+
+	mu      sync.Mutex
+	clients map[string]*clientDownloads
+}
+
+// clientDownloads holds one client's download slots; refs counts the
+// requests holding or waiting for a slot so idle clients can be dropped
+type clientDownloads struct {
+	slots chan struct{}
+	refs  int
+}
+
+// NewDownloadLimiter creates the limiter for download.max.concurrent.per.client;
+// it returns nil when the limit is off
+func NewDownloadLimiter(config *Config) *DownloadLimiter {
+	if config.DownloadMaxConcurrent <= 0 {
+		return nil
+	}
+	return &DownloadLimiter{
+		max:     config.DownloadMaxConcurrent,
+		wait:    config.DownloadConcurrentWait,
+		utils:   &Utils{},
+		clients: make(map[string]*clientDownloads),
+	}
+}
+
+// Middleware holds a download slot of the client for the whole response.
+// Extra downloads wait up to download.max.concurrent.wait for one of the
+// client's downloads to finish and are then refused with a 429.
+func (dl *DownloadLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject := identityFromRequest(r, dl.utils).Subject
+		release, ok := dl.acquire(r.Context(), subject)
+		if !ok {
+			log.Printf("Refused download of %s from %s: %d downloads in progress", r.URL.Path, subject, dl.max)
+			metrics.Inc("userguide_download_concurrency_rejected_total")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many simultaneous downloads", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire takes one of subject's slots, waiting up to dl.wait for one
+func (dl *DownloadLimiter) acquire(ctx context.Context, subject string) (func(), bool) {
+	dl.mu.Lock()
+	client, ok := dl.clients[subject]
+	if !ok {
+		client = &clientDownloads{slots: make(chan struct{}, dl.max)}
+		dl.clients[subject] = client
+	}
+	client.refs++
+	dl.mu.Unlock()
+
+	acquired := false
+	select {
+	case client.slots <- struct{}{}:
+		acquired = true
+	default:
+		if dl.wait > 0 {
+			timer := time.NewTimer(dl.wait)
+			select {
+			case client.slots <- struct{}{}:
+				acquired = true
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+			timer.Stop()
+		}
+	}
+	if !acquired {
+		dl.drop(subject, client)
+		return nil, false
+	}
+	return func() {
+		<-client.slots
+		dl.drop(subject, client)
+	}, true
+}
+
+// drop releases a reference to client, forgetting it once unused
+func (dl *DownloadLimiter) drop(subject string, client *clientDownloads) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	client.refs--
+	if client.refs == 0 {
+		delete(dl.clients, subject)
+	}
+}
@@ -0,0 +1,180 @@
+package userguide
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrDownloadTokenInvalid is returned for forged, malformed or expired download tokens
+var ErrDownloadTokenInvalid = errors.New("download token invalid or expired")
+
+// Token purposes, mixed into the signature so one kind of token cannot be
+// replayed as another
+const (
+	purposeDownload   = "link"
+	purposeResume     = "resume"
+	purposeResumeLink = "resume-link"
+)
+
+// DownloadTokens issues short-lived links to a single restricted guide, for
+// browsers that cannot attach an Authorization header to a navigation
+type DownloadTokens struct {
+	secret    []byte
+	ttl       time.Duration
+	resumeTTL time.Duration
+}
+
+// NewDownloadTokens creates a token issuer. Without download.token.secret a
+// random secret is used, so links only work on the replica that issued them.
+func NewDownloadTokens(config *Config) *DownloadTokens {
+	secret := []byte(config.DownloadTokenSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		log.Println("Warning: download.token.secret is empty; download links are only valid on this replica")
+	}
+	return &DownloadTokens{secret: secret, ttl: config.DownloadTokenTTL, resumeTTL: config.DownloadResumeTTL}
+}
+
+// Issue returns a token granting a download of guide until it expires
+func (dt *DownloadTokens) Issue(guide string) (string, time.Time) {
+	expires := time.Now().Add(dt.ttl)
+	return dt.seal(purposeDownload, expires, guide), expires
+}
+
+// Verify checks a token and returns the guide it grants
+func (dt *DownloadTokens) Verify(token string) (string, error) {
+	fields, err := dt.open(purposeDownload, token, 1)
+	if err != nil {
+		return "", err
+	}
+	return fields[0], nil
+}
+
+// seal signs fields and an expiry into a token for purpose
+func (dt *DownloadTokens) seal(purpose string, expires time.Time, fields ...string) string {
+	payload := strings.Join(append(fields, strconv.FormatInt(expires.Unix(), 10)), "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(dt.signPurpose(purpose, payload))
+}
+
+// open verifies a token sealed for purpose and returns its n fields
+func (dt *DownloadTokens) open(purpose, token string, n int) ([]string, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrDownloadTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrDownloadTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, dt.signPurpose(purpose, string(payload))) {
+		return nil, ErrDownloadTokenInvalid
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != n+1 {
+		return nil, ErrDownloadTokenInvalid
+	}
+	expires, err := strconv.ParseInt(fields[n], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrDownloadTokenInvalid
+	}
+	return fields[:n], nil
+}
+
+func (dt *DownloadTokens) signPurpose(purpose, payload string) []byte {
+	return dt.sign(purpose + "|" + payload)
+}
+
+func (dt *DownloadTokens) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, dt.secret)
+	mac.Write([]byte("download|" + payload))
+	return mac.Sum(nil)
+}
+
+// downloadTokenRequest is the body of POST /token/download
+type downloadTokenRequest struct {
+	Guide string `json:"guide"`
+}
+
+// downloadTokenResponse carries the link the browser navigates to
+type downloadTokenResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DownloadTokenHandler exchanges the caller's bearer credentials for a
+// download link to one restricted guide; the route is guarded by AuthMiddleware
+func (fh *FileHandler) DownloadTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var req downloadTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Guide == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "request body must be {\"guide\": name}"})
+		return
+	}
+	filePath, err := fh.guides(r).DownloadProtectedGuide(req.Guide)
+	if err != nil {
+		log.Printf("Download token refused for %s to %s: %s", req.Guide, r.RemoteAddr, err.Error())
+		writeGuideError(w, err)
+		return
+	}
+	guide := filepath.Base(filePath)
+	if !fh.authorized(w, r, protectedGuidePrefix+guide) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	token, expires := fh.downloadTokens.Issue(guide)
+	metrics.Inc("userguide_download_tokens_issued_total")
+	writeJSON(w, http.StatusOK, downloadTokenResponse{
+		Token:     token,
+		URL:       "/download/token/" + token,
+		ExpiresAt: expires.UTC(),
+	})
+}
+
+// TokenDownloadHandler serves the restricted guide named by a download token
+func (fh *FileHandler) TokenDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	guide, err := fh.downloadTokens.Verify(mux.Vars(r)["token"])
+	if err != nil {
+		log.Printf("Rejected download token from %s: %s", r.RemoteAddr, err.Error())
+		metrics.Inc("userguide_download_token_rejections_total")
+		http.Error(w, "Download link invalid or expired", http.StatusForbidden)
+		return
+	}
+	filePath, err := fh.fileService.DownloadProtectedGuide(guide)
+	if err != nil {
+		log.Printf("Token download of %s failed from %s: %s", guide, r.RemoteAddr, err.Error())
+		writeGuideError(w, err)
+		return
+	}
+
+	safeFilename := filepath.Base(filePath)
+	w.Header().Set("Content-Type", fh.utils.GetContentType(safeFilename))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fh.utils.EscapeForHeader(safeFilename)+"\"")
+	w.Header().Set("Cache-Control", "private, no-store")
+	// Links must not leak through the Referer of anything the guide opens
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	fh.offerResume(w, guide, filePath)
+
+	log.Printf("Serving protected guide %s by download token to %s", safeFilename, r.RemoteAddr)
+	metrics.Inc("userguide_protected_downloads_total")
+	fh.recordDownload(w, r, protectedGuidePrefix+safeFilename)
+	fileServer.ServeFile(w, r, filePath)
+}
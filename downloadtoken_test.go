@@ -0,0 +1,109 @@
+package userguide
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"userguide_api_poc/samples"
+)
+
+// retarget swaps the first field of a token's payload for guide, keeping
+// the signature, as someone editing a link would
+func retarget(token, guide string) string {
+	encodedPayload, sig, _ := strings.Cut(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encodedPayload)
+	_, rest, _ := strings.Cut(string(payload), "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(guide+"|"+rest)) + "." + sig
+}
+
+func TestDownloadTokens(t *testing.T) {
+	config := DefaultConfig()
+	config.DownloadTokenSecret = "test-secret"
+	tokens := NewDownloadTokens(config)
+	token, _ := tokens.Issue("manual.pdf")
+
+	if guide, err := tokens.Verify(token); err != nil || guide != "manual.pdf" {
+		t.Fatalf("Verify = %q, %v, want manual.pdf", guide, err)
+	}
+
+	expired := *tokens
+	expired.ttl = -time.Second
+	stale, _ := expired.Issue("manual.pdf")
+	config.DownloadTokenSecret = "other-secret"
+	foreign, _ := NewDownloadTokens(config).Issue("manual.pdf")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", stale},
+		{"other guide", retarget(token, "user-guide.pdf")},
+		{"traversal", retarget(token, "../user-guide.pdf")},
+		{"other secret", foreign},
+		{"resume token", tokens.IssueResume("manual.pdf", strings.Repeat("0", 64))},
+		{"no signature", strings.Split(token, ".")[0]},
+		{"malformed", "%%%.%%%"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		if guide, err := tokens.Verify(tt.token); err != ErrDownloadTokenInvalid {
+			t.Errorf("%s: Verify = %q, %v, want ErrDownloadTokenInvalid", tt.name, guide, err)
+		}
+	}
+}
+
+// issueDownloadToken exchanges the harness' protected token for a link to guide
+func issueDownloadToken(t *testing.T, h *testHarness, guide string) downloadTokenResponse {
+	t.Helper()
+	body, _ := json.Marshal(downloadTokenRequest{Guide: guide})
+	resp := h.Post(t, "/token/download", "Bearer alpha-token", body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /token/download: status = %d, want 200", resp.StatusCode)
+	}
+	var issued downloadTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&issued); err != nil {
+		t.Fatalf("decode token: %v", err)
+	}
+	return issued
+}
+
+func TestTokenDownloadServesOnlyTheSignedGuide(t *testing.T) {
+	h := newProtectedHarness(t, nil)
+
+	if resp := h.Post(t, "/token/download", "", []byte(`{"guide": "manual.pdf"}`)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token without credentials: status = %d, want 401", resp.StatusCode)
+	}
+
+	issued := issueDownloadToken(t, h, "manual.pdf")
+	resp := h.Get(t, issued.URL, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status = %d, want 200", issued.URL, resp.StatusCode)
+	}
+	if body := readBody(t, resp); !bytes.Equal(body, samples.PDF("Manual")) {
+		t.Errorf("download token did not serve manual.pdf")
+	}
+
+	for _, guide := range []string{"user-guide.pdf", "../user-guide.pdf", "..%2Fuser-guide.pdf"} {
+		resp := h.Get(t, "/download/token/"+retarget(issued.Token, guide), "")
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("token edited to %s: status = %d, want 403", guide, resp.StatusCode)
+		}
+		if body := readBody(t, resp); bytes.Contains(body, []byte("%PDF")) {
+			t.Errorf("token edited to %s served a guide", guide)
+		}
+	}
+
+	// The resume token handed out with the download is not a download link
+	resume := resp.Header.Get(ResumeTokenHeader)
+	if resume == "" {
+		t.Fatal("no resume token offered with the download")
+	}
+	if resp := h.Get(t, "/download/token/"+resume, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("resume token as a download link: status = %d, want 403", resp.StatusCode)
+	}
+}
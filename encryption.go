@@ -0,0 +1,587 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in encryption key providers
+const (
+	KeyProviderConfig = "config"
+	KeyProviderEnv    = "env"
+)
+
+// encryptedMagic starts every guide file encrypted at rest
+var encryptedMagic = []byte("UGENC\x01")
+
+// ErrEncryptedGuide is returned for a corrupted or tampered encrypted guide
+var ErrEncryptedGuide = errors.New("encrypted guide cannot be decrypted")
+
+const (
+	// encryptionChunkSize is the plaintext size of each sealed chunk; ranges
+	// decrypt only the chunks they touch
+	encryptionChunkSize = 64 * 1024
+	// maxCachedDataKeys bounds the unwrapped data keys kept in memory
+	maxCachedDataKeys = 1024
+	// keyProviderTimeout bounds each call to the key provider
+	keyProviderTimeout = 10 * time.Second
+)
+
+// atRest encrypts guides as they are published and decrypts them for
+// readers; nil when encryption at rest is off
+var atRest *AtRestEncryption
+
+// KeyProvider protects the random data key each guide is encrypted with.
+// WrapKey encrypts a data key with the current key encryption key and names
+// that key; UnwrapKey must still accept keys wrapped by earlier ones, so
+// guides stay readable after a rotation. A KMS is plugged in by
+// implementing this interface and calling RegisterKeyProvider.
+type KeyProvider interface {
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeyProviderFactory builds a key provider from configuration
+type KeyProviderFactory func(config *Config) (KeyProvider, error)
+
+var (
+	keyProvidersMu sync.RWMutex
+	keyProviders   = map[string]KeyProviderFactory{
+		KeyProviderConfig: func(config *Config) (KeyProvider, error) {
+			return newStaticKeys(config.EncryptionKeys, "encryption.keys")
+		},
+		KeyProviderEnv: func(config *Config) (KeyProvider, error) {
+			return newStaticKeys(splitList(os.Getenv(config.EncryptionKeyEnv)), "$"+config.EncryptionKeyEnv)
+		},
+	}
+)
+
+// RegisterKeyProvider makes a KMS selectable with encryption.provider. Call
+// it from an init function in the file that implements it.
+func RegisterKeyProvider(name string, factory KeyProviderFactory) {
+	keyProvidersMu.Lock()
+	defer keyProvidersMu.Unlock()
+	keyProviders[name] = factory
+}
+
+// AtRestEncryption stores guides AES-256-GCM encrypted in chunks, each file
+// under its own data key wrapped by the key provider
+type AtRestEncryption struct {
+	provider string
+	keys     KeyProvider
+
+	mu       sync.Mutex
+	dataKeys map[string]cipher.AEAD
+}
+
+// NewAtRestEncryption creates the encryption for encryption.provider; it
+// returns nil when no provider is configured
+func NewAtRestEncryption(config *Config) (*AtRestEncryption, error) {
+	if config.EncryptionProvider == "" {
+		return nil, nil
+	}
+	keyProvidersMu.RLock()
+	factory, ok := keyProviders[config.EncryptionProvider]
+	keyProvidersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption provider %q", config.EncryptionProvider)
+	}
+	keys, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+	return &AtRestEncryption{provider: config.EncryptionProvider, keys: keys, dataKeys: make(map[string]cipher.AEAD)}, nil
+}
+
+// encryptionHeader is the start of an encrypted guide:
+//
+//	magic | key id length (1) | key id | wrapped key length (2) | wrapped key |
+//	nonce prefix (8) | plaintext size (8)
+//
+// followed by the sealed chunks. Chunk i is sealed with the nonce prefix
+// and i, and the whole header as additional data, so chunks cannot be
+// reordered, truncated away or moved between files.
+type encryptionHeader struct {
+	keyID   string
+	wrapped []byte
+	prefix  [8]byte
+	size    int64
+	raw     []byte
+}
+
+func (h *encryptionHeader) marshal() []byte {
+	var buf bytes.Buffer
+	buf.Write(encryptedMagic)
+	buf.WriteByte(byte(len(h.keyID)))
+	buf.WriteString(h.keyID)
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.wrapped)))
+	buf.Write(h.wrapped)
+	buf.Write(h.prefix[:])
+	binary.Write(&buf, binary.BigEndian, uint64(h.size))
+	h.raw = buf.Bytes()
+	return h.raw
+}
+
+// readEncryptionHeader reads the header of an encrypted guide. It returns
+// nil without error when r does not start with the magic, leaving the
+// read position unspecified.
+func readEncryptionHeader(r io.Reader) (*encryptionHeader, error) {
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, encryptedMagic) {
+		return nil, nil
+	}
+	raw := bytes.NewBuffer(append([]byte(nil), magic...))
+	r = io.TeeReader(r, raw)
+	h := &encryptionHeader{}
+	var idLen [1]byte
+	var wrappedLen uint16
+	if _, err := io.ReadFull(r, idLen[:]); err != nil {
+		return nil, ErrEncryptedGuide
+	}
+	keyID := make([]byte, idLen[0])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, ErrEncryptedGuide
+	}
+	if err := binary.Read(r, binary.BigEndian, &wrappedLen); err != nil {
+		return nil, ErrEncryptedGuide
+	}
+	h.keyID, h.wrapped = string(keyID), make([]byte, wrappedLen)
+	var size uint64
+	if _, err := io.ReadFull(r, h.wrapped); err != nil {
+		return nil, ErrEncryptedGuide
+	}
+	if _, err := io.ReadFull(r, h.prefix[:]); err != nil {
+		return nil, ErrEncryptedGuide
+	}
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, ErrEncryptedGuide
+	}
+	h.size, h.raw = int64(size), raw.Bytes()
+	return h, nil
+}
+
+func (h *encryptionHeader) nonce(chunk int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, h.prefix[:])
+	binary.BigEndian.PutUint32(nonce[8:], uint32(chunk))
+	return nonce
+}
+
+// Encrypt writes src, size bytes long, to dst in the encrypted format
+func (e *AtRestEncryption) Encrypt(ctx context.Context, dst io.Writer, src io.Reader, size int64) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	h := &encryptionHeader{size: size}
+	if _, err := rand.Read(h.prefix[:]); err != nil {
+		return err
+	}
+	var err error
+	if h.keyID, h.wrapped, err = e.keys.WrapKey(ctx, dataKey); err != nil {
+		return fmt.Errorf("unable to wrap data key: %v", err)
+	}
+	if len(h.keyID) > 255 || len(h.wrapped) > 65535 {
+		return fmt.Errorf("key id or wrapped key too long")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	header := h.marshal()
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	plain := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+aead.Overhead())
+	var written int64
+	for chunk := int64(0); written < size; chunk++ {
+		n, err := io.ReadFull(src, plain[:min(int64(len(plain)), size-written)])
+		if err != nil {
+			return fmt.Errorf("guide shorter than %d bytes: %v", size, err)
+		}
+		sealed = aead.Seal(sealed[:0], h.nonce(chunk), plain[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		written += int64(n)
+	}
+	return nil
+}
+
+// EncryptStaged replaces a verified staged guide with its encrypted form,
+// returning the staged file to commit. The guide is read by name, as a
+// content check may have replaced it with a cleaned copy, and the plaintext
+// is removed.
+func (e *AtRestEncryption) EncryptStaged(file *os.File) (*os.File, error) {
+	plain, err := os.Open(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+	info, err := plain.Stat()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := os.CreateTemp(filepath.Dir(file.Name()), "encrypted-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), keyProviderTimeout)
+	defer cancel()
+	if err := e.Encrypt(ctx, encrypted, plain, info.Size()); err != nil {
+		encrypted.Close()
+		os.Remove(encrypted.Name())
+		return nil, err
+	}
+	file.Close()
+	os.Remove(file.Name())
+	metrics.Inc("userguide_encrypted_guides_total")
+	return encrypted, nil
+}
+
+// aead returns the cipher for the data key in h, unwrapping it with the
+// key provider unless it was seen before
+func (e *AtRestEncryption) aead(h *encryptionHeader) (cipher.AEAD, error) {
+	cacheKey := h.keyID + "\x00" + string(h.wrapped)
+	e.mu.Lock()
+	aead, ok := e.dataKeys[cacheKey]
+	e.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), keyProviderTimeout)
+	defer cancel()
+	dataKey, err := e.keys.UnwrapKey(ctx, h.keyID, h.wrapped)
+	if err != nil {
+		metrics.Inc("userguide_encryption_errors_total", "reason", "unwrap")
+		return nil, fmt.Errorf("unable to unwrap data key with %s key %q: %v", e.provider, h.keyID, err)
+	}
+	if aead, err = newGCM(dataKey); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	if len(e.dataKeys) >= maxCachedDataKeys {
+		clear(e.dataKeys)
+	}
+	e.dataKeys[cacheKey] = aead
+	e.mu.Unlock()
+	return aead, nil
+}
+
+// guideFile is a guide opened for reading, decrypted if it is encrypted at
+// rest. Stat reports the plaintext size.
+type guideFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// openGuide opens a guide file for reading, decrypting it when encryption
+// at rest is on and the file is encrypted; plaintext guides published
+// before encryption was turned on are read as they are
+func openGuide(path string) (guideFile, error) {
+	file, err := os.Open(path)
+	if err != nil || atRest == nil {
+		return file, err
+	}
+	h, err := readEncryptionHeader(file)
+	if err == nil && h == nil {
+		_, err = file.Seek(0, io.SeekStart)
+		return file, err
+	}
+	if err == nil {
+		var aead cipher.AEAD
+		if aead, err = atRest.aead(h); err == nil {
+			return &encryptedFile{file: file, header: h, aead: aead, chunk: -1}, nil
+		}
+	}
+	file.Close()
+	return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+}
+
+// statGuide is os.Stat reporting the plaintext size of encrypted guides
+func statGuide(path string) (os.FileInfo, error) {
+	if atRest == nil {
+		return os.Stat(path)
+	}
+	file, err := openGuide(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+// encryptedFile decrypts an encrypted guide chunk by chunk as it is read
+type encryptedFile struct {
+	file   *os.File
+	header *encryptionHeader
+	aead   cipher.AEAD
+	offset int64
+
+	// the last chunk decrypted, which sequential reads mostly hit
+	chunk int64
+	plain []byte
+}
+
+func (ef *encryptedFile) Read(p []byte) (int, error) {
+	n, err := ef.ReadAt(p, ef.offset)
+	ef.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (ef *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	read := 0
+	for read < len(p) {
+		if off >= ef.header.size {
+			return read, io.EOF
+		}
+		chunk := off / encryptionChunkSize
+		if err := ef.load(chunk); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], ef.plain[off-chunk*encryptionChunkSize:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+// load decrypts chunk into ef.plain
+func (ef *encryptedFile) load(chunk int64) error {
+	if ef.chunk == chunk {
+		return nil
+	}
+	overhead := int64(ef.aead.Overhead())
+	length := min(encryptionChunkSize, ef.header.size-chunk*encryptionChunkSize) + overhead
+	sealed := make([]byte, length)
+	offset := int64(len(ef.header.raw)) + chunk*(encryptionChunkSize+overhead)
+	if _, err := ef.file.ReadAt(sealed, offset); err != nil {
+		metrics.Inc("userguide_encryption_errors_total", "reason", "truncated")
+		return fmt.Errorf("%w: chunk %d: %v", ErrEncryptedGuide, chunk, err)
+	}
+	plain, err := ef.aead.Open(ef.plain[:0], ef.header.nonce(chunk), sealed, ef.header.raw)
+	if err != nil {
+		ef.chunk = -1
+		metrics.Inc("userguide_encryption_errors_total", "reason", "authentication")
+		return fmt.Errorf("%w: chunk %d failed authentication", ErrEncryptedGuide, chunk)
+	}
+	ef.chunk, ef.plain = chunk, plain
+	return nil
+}
+
+func (ef *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ef.offset
+	case io.SeekEnd:
+		offset += ef.header.size
+	default:
+		return 0, fmt.Errorf("invalid whence")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	ef.offset = offset
+	return offset, nil
+}
+
+func (ef *encryptedFile) Stat() (os.FileInfo, error) {
+	info, err := ef.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return plaintextInfo{FileInfo: info, size: ef.header.size}, nil
+}
+
+func (ef *encryptedFile) Close() error {
+	return ef.file.Close()
+}
+
+// plaintextInfo reports the decrypted size of an encrypted guide
+type plaintextInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (pi plaintextInfo) Size() int64 {
+	return pi.size
+}
+
+// staticKeys wraps data keys with AES-256-GCM key encryption keys given as
+// id:base64 entries. The first entry wraps new data keys; the others are
+// kept to read guides written before a rotation.
+type staticKeys struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func newStaticKeys(entries []string, source string) (*staticKeys, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s lists no encryption keys", source)
+	}
+	sk := &staticKeys{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%s: expected id:base64-key entries", source)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s: key %q must be 32 bytes in base64", source, id)
+		}
+		if sk.keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+		if sk.current == "" {
+			sk.current = id
+		}
+	}
+	return sk, nil
+}
+
+func (sk *staticKeys) WrapKey(_ context.Context, dataKey []byte) (string, []byte, error) {
+	kek := sk.keys[sk.current]
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return sk.current, kek.Seal(nonce, nonce, dataKey, []byte(sk.current)), nil
+}
+
+func (sk *staticKeys) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	kek, ok := sk.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no key %q configured", keyID)
+	}
+	if len(wrapped) < kek.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	return kek.Open(nil, wrapped[:kek.NonceSize()], wrapped[kek.NonceSize():], []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// runEncryptCommand encrypts the plaintext guides already in the guide
+// directory, or with -genkey prints a new key for encryption.keys
+func runEncryptCommand(config *Config, args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	genkey := fs.Bool("genkey", false, "Print a new random key entry for encryption.keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *genkey {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		fmt.Printf("%s:%s\n", time.Now().UTC().Format("20060102"), base64.StdEncoding.EncodeToString(key))
+		return nil
+	}
+
+	var err error
+	if atRest, err = NewAtRestEncryption(config); err != nil {
+		return err
+	}
+	if atRest == nil {
+		return fmt.Errorf("usage: encrypt [-genkey]; encryption.provider must be set to encrypt guides")
+	}
+	staging := NewStaging(config)
+	utils := &Utils{}
+	encrypted := 0
+	err = filepath.WalkDir(config.UserGuidePath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != config.UserGuidePath {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !utils.IsAllowedExtension(d.Name()) {
+			return nil
+		}
+		done, err := encryptInPlace(staging, path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if done {
+			log.Printf("Encrypted %s", path)
+			encrypted++
+		}
+		return nil
+	})
+	log.Printf("Encrypted %d guides", encrypted)
+	return err
+}
+
+// encryptInPlace replaces a plaintext guide with its encrypted form through
+// staging; it reports false for a guide that is already encrypted
+func encryptInPlace(staging *Staging, path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if h, err := readEncryptionHeader(file); err != nil || h != nil {
+		return false, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	tmp, err := staging.Create("encrypt")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), keyProviderTimeout)
+	defer cancel()
+	if err := atRest.Encrypt(ctx, tmp, file, info.Size()); err != nil {
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	return true, os.Rename(tmp.Name(), path)
+}
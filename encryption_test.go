@@ -0,0 +1,236 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEncryptionKey is a key entry for encryption.keys
+const testEncryptionKey = "k1:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+
+// useTestEncryption turns encryption at rest on until the test ends
+func useTestEncryption(t *testing.T) {
+	t.Helper()
+	config := DefaultConfig()
+	config.EncryptionProvider = KeyProviderConfig
+	config.EncryptionKeys = []string{testEncryptionKey}
+	encryption, err := NewAtRestEncryption(config)
+	if err != nil {
+		t.Fatalf("encryption: %v", err)
+	}
+	atRest = encryption
+	t.Cleanup(func() { atRest = nil })
+}
+
+// writeEncryptedGuide encrypts plain to a file named name in dir
+func writeEncryptedGuide(t *testing.T, dir, name string, plain []byte) string {
+	t.Helper()
+	var encrypted bytes.Buffer
+	if err := atRest.Encrypt(context.Background(), &encrypted, bytes.NewReader(plain), int64(len(plain))); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, encrypted.Bytes(), 0644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+// testPlaintext returns n bytes that differ from chunk to chunk
+func testPlaintext(n int) []byte {
+	plain := make([]byte, n)
+	for i := range plain {
+		plain[i] = byte(i*7 + i/encryptionChunkSize)
+	}
+	return plain
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	useTestEncryption(t)
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"exact chunk", encryptionChunkSize},
+		{"chunk and a byte", encryptionChunkSize + 1},
+		{"several chunks", 3*encryptionChunkSize - 7},
+		{"exact chunks", 3 * encryptionChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := testPlaintext(tt.size)
+			path := writeEncryptedGuide(t, dir, strings.ReplaceAll(tt.name, " ", "-")+".pdf", plain)
+
+			stored, _ := os.ReadFile(path)
+			if tt.size > 16 && bytes.Contains(stored, plain[:16]) {
+				t.Error("plaintext stored unencrypted")
+			}
+
+			file, err := openGuide(path)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer file.Close()
+			info, err := file.Stat()
+			if err != nil || info.Size() != int64(tt.size) {
+				t.Errorf("Stat size = %v (%v), want %d", info.Size(), err, tt.size)
+			}
+			got, err := io.ReadAll(file)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("read %d bytes, not the %d plaintext bytes", len(got), len(plain))
+			}
+
+			sum := sha256.Sum256(plain)
+			if hash, err := hashFile(path); err != nil || hash != hex.EncodeToString(sum[:]) {
+				t.Errorf("hashFile = %s, %v, want the plaintext hash", hash, err)
+			}
+		})
+	}
+}
+
+func TestEncryptionRejectsTampering(t *testing.T) {
+	useTestEncryption(t)
+	dir := t.TempDir()
+	plain := testPlaintext(3*encryptionChunkSize - 7)
+	path := writeEncryptedGuide(t, dir, "guide.pdf", plain)
+	stored, _ := os.ReadFile(path)
+	other, _ := os.ReadFile(writeEncryptedGuide(t, dir, "other.pdf", plain))
+
+	file, err := openGuide(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	headerLen := len(file.(*encryptedFile).header.raw)
+	file.Close()
+	sealedChunk := encryptionChunkSize + 16
+
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"flipped byte", func(b []byte) []byte {
+			b[headerLen+sealedChunk+100] ^= 1
+			return b
+		}},
+		{"flipped tag", func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}},
+		{"reordered chunks", func(b []byte) []byte {
+			first := append([]byte(nil), b[headerLen:headerLen+sealedChunk]...)
+			copy(b[headerLen:], b[headerLen+sealedChunk:headerLen+2*sealedChunk])
+			copy(b[headerLen+sealedChunk:], first)
+			return b
+		}},
+		{"truncated last chunk", func(b []byte) []byte {
+			return b[:len(b)-10]
+		}},
+		{"last chunk dropped", func(b []byte) []byte {
+			return b[:headerLen+2*sealedChunk]
+		}},
+		{"size in header reduced", func(b []byte) []byte {
+			b[headerLen-1]--
+			return b
+		}},
+		{"header of another guide", func(b []byte) []byte {
+			return append(append([]byte(nil), other[:headerLen]...), b[headerLen:]...)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := filepath.Join(dir, "tampered.pdf")
+			if err := os.WriteFile(tampered, tt.tamper(append([]byte(nil), stored...)), 0644); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			file, err := openGuide(tampered)
+			if err == nil {
+				_, err = io.ReadAll(file)
+				file.Close()
+			}
+			if !errors.Is(err, ErrEncryptedGuide) {
+				t.Errorf("err = %v, want ErrEncryptedGuide", err)
+			}
+			if _, err := hashFile(tampered); err == nil {
+				t.Error("hashFile accepted the tampered guide")
+			}
+		})
+	}
+}
+
+func TestEncryptionRanges(t *testing.T) {
+	useTestEncryption(t)
+	plain := testPlaintext(3*encryptionChunkSize - 7)
+	path := writeEncryptedGuide(t, t.TempDir(), "guide.pdf", plain)
+
+	file, err := openGuide(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer file.Close()
+	for _, off := range []int64{0, encryptionChunkSize - 3, encryptionChunkSize, 2*encryptionChunkSize + 5, int64(len(plain)) - 4} {
+		buf := make([]byte, 8)
+		n, err := file.ReadAt(buf, off)
+		want := plain[off:min(off+8, int64(len(plain)))]
+		if !bytes.Equal(buf[:n], want) || (n < len(buf) && err != io.EOF) {
+			t.Errorf("ReadAt(%d) = %d bytes, %v; want %d plaintext bytes", off, n, err, len(want))
+		}
+	}
+
+	// Range requests go through the same decryption
+	tests := []struct {
+		header     string
+		start, end int
+	}{
+		{"bytes=0-9", 0, 10},
+		{"bytes=65530-65545", 65530, 65546},
+		{"bytes=-100", len(plain) - 100, len(plain)},
+		{"bytes=131070-", 131070, len(plain)},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/download/userguide", nil)
+		r.Header.Set("Range", tt.header)
+		w := httptest.NewRecorder()
+		fileServer.ServeFile(w, r, path)
+		if w.Code != http.StatusPartialContent {
+			t.Errorf("%s: status = %d, want 206", tt.header, w.Code)
+			continue
+		}
+		if !bytes.Equal(w.Body.Bytes(), plain[tt.start:tt.end]) {
+			t.Errorf("%s: body is not plaintext bytes %d-%d", tt.header, tt.start, tt.end-1)
+		}
+	}
+}
+
+func TestEncryptionReadsPlaintextGuides(t *testing.T) {
+	useTestEncryption(t)
+	path := filepath.Join(t.TempDir(), "legacy.pdf")
+	plain := []byte("%PDF-1.4 published before encryption")
+	if err := os.WriteFile(path, plain, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	file, err := openGuide(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer file.Close()
+	if got, _ := io.ReadAll(file); !bytes.Equal(got, plain) {
+		t.Errorf("read %q, want the plaintext guide", got)
+	}
+}
@@ -0,0 +1,189 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// LicenseKeyHeader carries the client's license key
+const LicenseKeyHeader = "X-License-Key"
+
+// Entitlement failure policies
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+)
+
+// Entitlement check errors
+var (
+	ErrLicenseRequired        = fmt.Errorf("%w: license key required", ErrUnauthenticated)
+	ErrNotEntitled            = fmt.Errorf("%w: license does not cover this guide", ErrForbidden)
+	ErrEntitlementUnavailable = errors.New("entitlement service unavailable")
+)
+
+// EntitlementChecker decides whether a license key may download a guide
+type EntitlementChecker interface {
+	// CheckEntitlement returns nil if the guide may be served
+	CheckEntitlement(ctx context.Context, licenseKey, guide string) error
+}
+
+// httpEntitlements asks an external license service about restricted guides.
+// Answers are cached per license key and guide; when the service cannot be
+// reached the failure policy decides whether downloads proceed.
+type httpEntitlements struct {
+	url         string
+	restricted  []string
+	policy      string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	client      *http.Client
+
+	mu     sync.Mutex
+	cache  map[string]entitlementEntry
+	lastGC time.Time
+}
+
+type entitlementEntry struct {
+	entitled bool
+	expires  time.Time
+}
+
+// entitlementRequest is the body sent to the license service
+type entitlementRequest struct {
+	LicenseKey string `json:"license_key"`
+	Guide      string `json:"guide"`
+}
+
+// entitlementResponse is the license service's answer
+type entitlementResponse struct {
+	Entitled bool   `json:"entitled"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// NewEntitlementChecker creates the HTTP entitlement checker, or nil when
+// no license service is configured
+func NewEntitlementChecker(config *Config) EntitlementChecker {
+	if config.LicenseURL == "" {
+		return nil
+	}
+	return &httpEntitlements{
+		url:         config.LicenseURL,
+		restricted:  config.LicenseRestricted,
+		policy:      config.LicenseFailurePolicy,
+		ttl:         config.LicenseCacheTTL,
+		negativeTTL: config.LicenseNegativeCacheTTL,
+		client:      NewHTTPClient(config, config.LicenseTimeout),
+		cache:       make(map[string]entitlementEntry),
+	}
+}
+
+// isRestricted reports whether a guide matches one of the restricted patterns
+func (he *httpEntitlements) isRestricted(guide string) bool {
+	for _, pattern := range he.restricted {
+		if matched, _ := path.Match(pattern, guide); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (he *httpEntitlements) CheckEntitlement(ctx context.Context, licenseKey, guide string) error {
+	if !he.isRestricted(guide) {
+		return nil
+	}
+	if licenseKey == "" {
+		return ErrLicenseRequired
+	}
+
+	cacheKey := licenseKey + "\x00" + guide
+	he.mu.Lock()
+	entry, ok := he.cache[cacheKey]
+	he.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		metrics.Inc("userguide_entitlement_checks_total", "result", "cached")
+		return entitlementResult(entry.entitled)
+	}
+
+	answer, err := he.query(ctx, licenseKey, guide)
+	if err != nil {
+		log.Printf("Entitlement check for %s failed (fail-%s): %s", guide, he.policy, err.Error())
+		metrics.Inc("userguide_entitlement_checks_total", "result", "error")
+		if he.policy == FailOpen {
+			return nil
+		}
+		return fmt.Errorf("%w: %v", ErrEntitlementUnavailable, err)
+	}
+
+	ttl := he.ttl
+	if !answer.Entitled {
+		ttl = he.negativeTTL
+		log.Printf("License not entitled to %s: %s", guide, answer.Reason)
+	}
+	he.mu.Lock()
+	he.collectExpired()
+	he.cache[cacheKey] = entitlementEntry{entitled: answer.Entitled, expires: time.Now().Add(ttl)}
+	he.mu.Unlock()
+
+	result := "entitled"
+	if !answer.Entitled {
+		result = "denied"
+	}
+	metrics.Inc("userguide_entitlement_checks_total", "result", result)
+	return entitlementResult(answer.Entitled)
+}
+
+func entitlementResult(entitled bool) error {
+	if entitled {
+		return nil
+	}
+	return ErrNotEntitled
+}
+
+// collectExpired drops stale cache entries once a minute; callers must hold the lock
+func (he *httpEntitlements) collectExpired() {
+	now := time.Now()
+	if now.Sub(he.lastGC) < time.Minute {
+		return
+	}
+	he.lastGC = now
+	for key, entry := range he.cache {
+		if now.After(entry.expires) {
+			delete(he.cache, key)
+		}
+	}
+}
+
+func (he *httpEntitlements) query(ctx context.Context, licenseKey, guide string) (*entitlementResponse, error) {
+	body, err := json.Marshal(entitlementRequest{LicenseKey: licenseKey, Guide: guide})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", he.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := he.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("license service returned %s", resp.Status)
+	}
+
+	var answer entitlementResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid license service response: %v", err)
+	}
+	return &answer, nil
+}
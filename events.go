@@ -0,0 +1,67 @@
+package userguide
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types published on the event bus
+const (
+	EventGuidePublished = "guide.published"
+	EventGuideCorrupted = "guide.corrupted"
+	EventGuideRepaired  = "guide.repaired"
+	EventGuideMissing   = "guide.missing"
+	EventGuideArchived  = "guide.archived"
+	EventConfigReloaded = "config.reloaded"
+	EventStorageSwapped = "storage.swapped"
+)
+
+// events is the process-wide event bus
+var events = NewEventBus()
+
+// Event is a notification about something that happened to a guide or the service
+type Event struct {
+	Type    string            `json:"type"`
+	Time    time.Time         `json:"time"`
+	Subject string            `json:"subject,omitempty"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// EventBus delivers events synchronously to all subscribers
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers []func(Event)
+}
+
+// NewEventBus creates an event bus that logs every event
+func NewEventBus() *EventBus {
+	bus := &EventBus{}
+	bus.Subscribe(func(e Event) {
+		log.Printf("Event %s: %s %v", e.Type, e.Subject, e.Data)
+	})
+	return bus
+}
+
+// Subscribe registers a function called for every published event
+func (b *EventBus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Publish stamps and delivers an event to all subscribers
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+
+	metrics.Inc("userguide_events_total", "type", e.Type)
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
@@ -0,0 +1,250 @@
+package userguide
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Digest modes for bytes sent during downloads
+const (
+	DigestOff     = "off"
+	DigestLog     = "log"
+	DigestTrailer = "trailer"
+)
+
+// fileServer serves guide files with the options configured in main
+var fileServer = &FileServer{digestMode: DigestOff}
+
+// FileServer streams local files to clients
+type FileServer struct {
+	hotFiles   *mmapCache
+	siblings   *precompressedSiblings
+	digestMode string
+}
+
+// ServeFile streams a local file through http.ServeContent. Passing the
+// *os.File itself lets the server's ReaderFrom hand the copy to sendfile(2),
+// including for Range requests, as long as no wrapper hides io.ReaderFrom.
+func (s *FileServer) ServeFile(w http.ResponseWriter, r *http.Request, path string) {
+	file, err := openGuide(path)
+	if err != nil {
+		http.Error(w, "User guide not available", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "User guide not available", http.StatusNotFound)
+		return
+	}
+
+	// Serve a verified .br or .gz sibling instead of the original if the client
+	// accepts it. Ranges always address the original bytes: a client resuming
+	// an identity download must not get compressed bytes spliced onto it, so
+	// ranged requests skip the siblings and compressed responses do not
+	// advertise range support.
+	if s.siblings != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Header.Get("Range") != "" {
+			if r.Header.Get("Accept-Encoding") != "" {
+				metrics.Inc("userguide_precompressed_skipped_total", "reason", "range")
+			}
+		} else if siblingPath, encoding := s.siblings.Find(r, path, info); siblingPath != "" {
+			if sibling, err := os.Open(siblingPath); err == nil {
+				if siblingInfo, err := sibling.Stat(); err == nil {
+					defer sibling.Close()
+					file, info, path = sibling, siblingInfo, siblingPath
+					w.Header().Set("Content-Encoding", encoding)
+					w = &noRangesWriter{ResponseWriter: w}
+					metrics.Inc("userguide_precompressed_served_total", "encoding", encoding)
+				} else {
+					sibling.Close()
+				}
+			}
+		}
+	}
+
+	// Digesting requires seeing every byte, which rules out sendfile
+	if s.digestMode == DigestLog || s.digestMode == DigestTrailer {
+		dw := &digestWriter{ResponseWriter: w, hash: sha256.New(), expected: -1,
+			trailer: s.digestMode == DigestTrailer, head: r.Method == http.MethodHead}
+		defer dw.finish(r, info.Name())
+		w = dw
+	}
+
+	// Hot files are served from a shared memory mapping when enabled
+	if s.hotFiles != nil {
+		if mf := s.hotFiles.Acquire(path, info); mf != nil {
+			defer s.hotFiles.Release(mf)
+			http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(mf.data))
+			return
+		}
+	}
+
+	http.ServeContent(&countingWriter{ResponseWriter: w, tls: r.TLS != nil}, r, info.Name(), info.ModTime(), file)
+}
+
+// countingWriter records how many body bytes took the zero-copy path versus
+// being buffered through userspace
+type countingWriter struct {
+	http.ResponseWriter
+	// tls connections encrypt in userspace, so nothing sent on them is
+	// zero-copy
+	tls bool
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	metrics.Add("userguide_served_bytes_total", float64(n), "path", "buffered")
+	return n, err
+}
+
+// ReadFrom keeps the sendfile fast path when the underlying writer supports it
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := cw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{cw}, src)
+	}
+	n, err := rf.ReadFrom(src)
+	path := "buffered"
+	if !cw.tls && sendfileSource(src) {
+		path = "zero_copy"
+	}
+	metrics.Add("userguide_served_bytes_total", float64(n), "path", path)
+	return n, err
+}
+
+// sendfileSource reports whether the connection can send src with
+// sendfile(2): net/http only does so for files, which http.ServeContent
+// passes limited to the requested length. Decrypting readers and other
+// sources are copied through a buffer.
+func sendfileSource(src io.Reader) bool {
+	if limited, ok := src.(*io.LimitedReader); ok {
+		src = limited.R
+	}
+	_, ok := src.(*os.File)
+	return ok
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// noRangesWriter answers with Accept-Ranges: none, overriding the bytes
+// unit http.ServeContent advertises, so clients never resume into a
+// compressed representation
+type noRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (nw *noRangesWriter) WriteHeader(code int) {
+	nw.Header().Set("Accept-Ranges", "none")
+	nw.ResponseWriter.WriteHeader(code)
+}
+
+func (nw *noRangesWriter) Write(p []byte) (int, error) {
+	nw.Header().Set("Accept-Ranges", "none")
+	return nw.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the sendfile fast path when the underlying writer supports it
+func (nw *noRangesWriter) ReadFrom(src io.Reader) (int64, error) {
+	nw.Header().Set("Accept-Ranges", "none")
+	if rf, ok := nw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{nw.ResponseWriter}, src)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (nw *noRangesWriter) Unwrap() http.ResponseWriter {
+	return nw.ResponseWriter
+}
+
+// writerOnly hides any ReaderFrom implementation of the wrapped writer
+type writerOnly struct {
+	io.Writer
+}
+
+// digestWriter hashes the body bytes actually written to the client
+type digestWriter struct {
+	http.ResponseWriter
+	hash     hash.Hash
+	trailer  bool
+	head     bool
+	status   int
+	expected int64
+	written  int64
+}
+
+func (dw *digestWriter) WriteHeader(status int) {
+	dw.status = status
+	if length, err := strconv.ParseInt(dw.Header().Get("Content-Length"), 10, 64); err == nil {
+		dw.expected = length
+	}
+	// Only responses with a body carry the trailer, and trailers are only
+	// sent with chunked encoding, which Content-Length prevents
+	if dw.trailer && dw.digested() {
+		dw.Header().Set("Trailer", "Content-Digest")
+		dw.Header().Del("Content-Length")
+	}
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *digestWriter) Write(p []byte) (int, error) {
+	if dw.status == 0 {
+		dw.WriteHeader(http.StatusOK)
+	}
+	n, err := dw.ResponseWriter.Write(p)
+	dw.hash.Write(p[:n])
+	dw.written += int64(n)
+	return n, err
+}
+
+// digested reports whether the response sends guide bytes to digest
+func (dw *digestWriter) digested() bool {
+	return !dw.head && (dw.status == http.StatusOK || dw.status == http.StatusPartialContent)
+}
+
+// finish logs the digest and, in trailer mode, sends it as Content-Digest
+func (dw *digestWriter) finish(r *http.Request, name string) {
+	if !dw.digested() {
+		return
+	}
+
+	sum := dw.hash.Sum(nil)
+	if dw.trailer {
+		dw.Header().Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	}
+
+	complete := dw.expected < 0 || dw.written == dw.expected
+	if !complete {
+		metrics.Inc("userguide_incomplete_transfers_total")
+	}
+
+	log.Printf("Sent %s to %s: %d bytes, range %q, complete %t, sha256 %s",
+		name, r.RemoteAddr, dw.written, r.Header.Get("Range"), complete, hex.EncodeToString(sum))
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (dw *digestWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// bufferedOnlyMiddleware disables the zero-copy path so that its throughput
+// can be compared against plain userspace copying
+func bufferedOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(struct{ http.ResponseWriter }{w}, r)
+	})
+}
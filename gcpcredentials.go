@@ -0,0 +1,237 @@
+package userguide
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsScope is the OAuth scope of guide reads and uploads
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcpCredentials is an OAuth access token and its expiry
+type gcpCredentials struct {
+	AccessToken string
+	Expires     time.Time
+}
+
+// gcpCredentialFile is an application-default credentials file: a service
+// account key or the refresh token gcloud auth application-default login
+// stores
+type gcpCredentialFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcpCredentialSource finds credentials the way Google's application
+// default credentials do: the key file gcs.credentials.file or
+// GOOGLE_APPLICATION_CREDENTIALS names, else gcloud's application default
+// login, else the service account of the instance from the metadata
+// server (GCE, GKE workload identity, Cloud Run). Access tokens are
+// fetched again shortly before they expire.
+type gcpCredentialSource struct {
+	file     *gcpCredentialFile
+	key      *rsa.PrivateKey
+	oauth    *http.Client
+	metadata *http.Client
+
+	mu      sync.Mutex
+	current gcpCredentials
+}
+
+func newGCPCredentialSource(config *Config) (*gcpCredentialSource, error) {
+	source := &gcpCredentialSource{
+		oauth: NewHTTPClient(config, 0),
+		// The metadata server is link-local; never proxy it
+		metadata: &http.Client{Timeout: 5 * time.Second},
+	}
+	name := config.GCSCredentialsFile
+	if name == "" {
+		name = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if name == "" {
+		if wellKnown := gcloudADCFile(); wellKnown != "" {
+			if _, err := os.Stat(wellKnown); err == nil {
+				name = wellKnown
+			}
+		}
+	}
+	if name == "" {
+		return source, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read GCP credentials: %v", err)
+	}
+	var file gcpCredentialFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid GCP credentials %s: %v", name, err)
+	}
+	switch file.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(file.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("invalid GCP credentials %s: no private key", name)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCP credentials %s: %v", name, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("invalid GCP credentials %s: not an RSA key", name)
+		}
+		source.key = rsaKey
+		if file.TokenURI == "" {
+			file.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+	case "authorized_user":
+		if file.RefreshToken == "" {
+			return nil, fmt.Errorf("invalid GCP credentials %s: no refresh token", name)
+		}
+		file.TokenURI = "https://oauth2.googleapis.com/token"
+	default:
+		return nil, fmt.Errorf("GCP credentials %s: unsupported type %q", name, file.Type)
+	}
+	source.file = &file
+	return source, nil
+}
+
+// gcloudADCFile is where gcloud auth application-default login stores
+// credentials
+func gcloudADCFile() string {
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		if runtime.GOOS == "windows" {
+			dir = filepath.Join(os.Getenv("APPDATA"), "gcloud")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".config", "gcloud")
+		} else {
+			return ""
+		}
+	}
+	return filepath.Join(dir, "application_default_credentials.json")
+}
+
+// Get returns a valid access token
+func (cs *gcpCredentialSource) Get(ctx context.Context) (gcpCredentials, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.current.AccessToken != "" && time.Until(cs.current.Expires) > credentialRefresh {
+		return cs.current, nil
+	}
+	var creds gcpCredentials
+	var err error
+	switch {
+	case cs.key != nil:
+		creds, err = cs.serviceAccount(ctx)
+	case cs.file != nil:
+		creds, err = cs.exchange(ctx, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {cs.file.ClientID},
+			"client_secret": {cs.file.ClientSecret},
+			"refresh_token": {cs.file.RefreshToken},
+		})
+	default:
+		creds, err = cs.instance(ctx)
+	}
+	if err != nil {
+		return gcpCredentials{}, err
+	}
+	cs.current = creds
+	return creds, nil
+}
+
+// serviceAccount exchanges a JWT signed with the service account key for
+// an access token
+func (cs *gcpCredentialSource) serviceAccount(ctx context.Context) (gcpCredentials, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": cs.file.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   cs.file.ClientEmail,
+		"scope": gcsScope,
+		"aud":   cs.file.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, cs.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return gcpCredentials{}, err
+	}
+	return cs.exchange(ctx, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+}
+
+// exchange posts an OAuth grant to the token endpoint of the credentials file
+func (cs *gcpCredentialSource) exchange(ctx context.Context, grant url.Values) (gcpCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cs.file.TokenURI, strings.NewReader(grant.Encode()))
+	if err != nil {
+		return gcpCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := readCredentialResponse(cs.oauth, req)
+	if err != nil {
+		return gcpCredentials{}, fmt.Errorf("oauth: %v", err)
+	}
+	return parseGCPToken(body)
+}
+
+// instance reads the token of the instance's service account from the
+// metadata server; GCE_METADATA_HOST overrides its address
+func (cs *gcpCredentialSource) instance(ctx context.Context) (gcpCredentials, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcsScope), nil)
+	if err != nil {
+		return gcpCredentials{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := readCredentialResponse(cs.metadata, req)
+	if err != nil {
+		return gcpCredentials{}, fmt.Errorf("metadata server: %v", err)
+	}
+	return parseGCPToken(body)
+}
+
+// parseGCPToken reads the token responses of the OAuth endpoint and the
+// metadata server
+func parseGCPToken(body []byte) (gcpCredentials, error) {
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return gcpCredentials{}, errors.New("invalid token response")
+	}
+	return gcpCredentials{AccessToken: token.AccessToken, Expires: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)}, nil
+}
@@ -0,0 +1,343 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageBackendGCS names the Google Cloud Storage guide store
+const StorageBackendGCS = "gcs"
+
+func init() {
+	RegisterStorage(StorageBackendGCS, func(config *Config) (Storage, error) { return NewGCSStorage(config) })
+}
+
+// gcsMaxBackoff caps the wait between attempts of a GCS request
+const gcsMaxBackoff = 10 * time.Second
+
+// GCSStorage keeps guides as objects in a Google Cloud Storage bucket,
+// below an optional name prefix, through the JSON API with
+// application-default credentials. Like S3Storage it serves guides from
+// local copies; a copy is downloaded pinned to the generation its
+// metadata reported, so a guide replaced mid-way is never cached as a mix
+// of two versions. Requests failing with 429, 5xx or a network error are
+// retried with exponential backoff and jitter.
+type GCSStorage struct {
+	client    *http.Client
+	transfers *http.Client
+	endpoint  string
+	bucket    string
+	prefix    string
+	creds     *gcpCredentialSource
+	retries   int
+	backoff   time.Duration
+	cache     *objectCache
+}
+
+// gcsObject is the object resource of the JSON API; numbers arrive as strings
+type gcsObject struct {
+	Name       string    `json:"name"`
+	Size       string    `json:"size"`
+	Updated    time.Time `json:"updated"`
+	Generation string    `json:"generation"`
+}
+
+// info converts o to the metadata of the guide key
+func (o gcsObject) info(key string) ObjectInfo {
+	size, _ := strconv.ParseInt(o.Size, 10, 64)
+	return ObjectInfo{Key: key, Size: size, ModTime: o.Updated, Version: o.Generation}
+}
+
+// NewGCSStorage creates a storage of the gcs.bucket objects below gcs.prefix
+func NewGCSStorage(config *Config) (*GCSStorage, error) {
+	if config.GCSBucket == "" {
+		return nil, fmt.Errorf("storage.type=%s needs gcs.bucket", StorageBackendGCS)
+	}
+	endpoint, err := url.Parse(config.GCSEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid gcs.endpoint %q", config.GCSEndpoint)
+	}
+	creds, err := newGCPCredentialSource(config)
+	if err != nil {
+		return nil, err
+	}
+	cacheDir := config.GCSCachePath
+	if cacheDir == "" {
+		cacheDir = filepath.Join(config.UserGuidePath, ".gcs-cache")
+	}
+	prefix := strings.Trim(config.GCSPrefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &GCSStorage{
+		client:    NewHTTPClient(config, 0),
+		transfers: &http.Client{Transport: outboundTransport(config)},
+		endpoint:  endpoint.Scheme + "://" + endpoint.Host,
+		bucket:    config.GCSBucket,
+		prefix:    prefix,
+		creds:     creds,
+		retries:   config.GCSRetries,
+		backoff:   config.GCSRetryBackoff,
+	}
+	if s.cache, err = newObjectCache(StorageBackendGCS, s.String(), cacheDir, config.GCSCacheTTL); err != nil {
+		return nil, err
+	}
+	s.cache.head = s.head
+	s.cache.download = func(ctx context.Context, info ObjectInfo) (io.ReadCloser, error) {
+		return s.read(ctx, info.Key, info.Version)
+	}
+	return s, nil
+}
+
+// String describes the bucket for logs
+func (s *GCSStorage) String() string {
+	return fmt.Sprintf("gs://%s/%s", s.bucket, s.prefix)
+}
+
+// objectURL returns the JSON API address of key, with the whole object
+// name escaped as one path segment
+func (s *GCSStorage) objectURL(key string) string {
+	return s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(s.prefix+key)
+}
+
+func (s *GCSStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkObjectKey(key); err != nil {
+		return nil, err
+	}
+	return s.read(ctx, key, "")
+}
+
+// read downloads key, the given generation of it unless that is empty
+func (s *GCSStorage) read(ctx context.Context, key, generation string) (io.ReadCloser, error) {
+	query := url.Values{"alt": {"media"}}
+	if generation != "" {
+		query.Set("generation", generation)
+	}
+	resp, err := s.do(ctx, s.transfers, http.MethodGet, s.objectURL(key)+"?"+query.Encode(), nil, 0, key)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *GCSStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.cache.Stat(ctx, key)
+}
+
+// head reads the metadata of key, including its current generation
+func (s *GCSStorage) head(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, s.client, http.MethodGet, s.objectURL(key)+"?fields=name,size,updated,generation", nil, 0, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+	var object gcsObject
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&object); err != nil {
+		return ObjectInfo{}, fmt.Errorf("invalid object metadata: %v", err)
+	}
+	return object.info(key), nil
+}
+
+// LocalPath returns the cached copy of key, downloading it when needed
+func (s *GCSStorage) LocalPath(ctx context.Context, key string) (string, error) {
+	return s.cache.LocalPath(ctx, key)
+}
+
+func (s *GCSStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		page, err := s.listPage(ctx, prefix, token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Items {
+			key := strings.TrimPrefix(object.Name, s.prefix)
+			if checkObjectKey(key) != nil || hiddenKey(key) {
+				continue
+			}
+			objects = append(objects, object.info(key))
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// gcsListResult is a page of objects.list
+type gcsListResult struct {
+	Items         []gcsObject `json:"items"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+// listPage lists one page of the objects below prefix; maxResults 0 leaves
+// the page size to GCS
+func (s *GCSStorage) listPage(ctx context.Context, prefix, token string, maxResults int) (*gcsListResult, error) {
+	query := url.Values{
+		"prefix": {s.prefix + prefix},
+		"fields": {"items(name,size,updated,generation),nextPageToken"},
+	}
+	if token != "" {
+		query.Set("pageToken", token)
+	}
+	if maxResults > 0 {
+		query.Set("maxResults", strconv.Itoa(maxResults))
+	}
+	resp, err := s.do(ctx, s.client, http.MethodGet, s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var page gcsListResult
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&page); err != nil {
+		return nil, fmt.Errorf("invalid list response: %v", err)
+	}
+	return &page, nil
+}
+
+// Put uploads body under key in a single request. Bodies other than files
+// and in-memory readers are spooled to the cache directory first, so a
+// retried upload can send them again.
+func (s *GCSStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	spooled, size, cleanup, err := spoolBody(s.cache.dir, body)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	query := url.Values{"uploadType": {"media"}, "name": {s.prefix + key}}
+	resp, err := s.do(ctx, s.transfers, http.MethodPost,
+		s.endpoint+"/upload/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), spooled, size, key)
+	s.cache.Forget(key)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *GCSStorage) Delete(ctx context.Context, key string) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, s.client, http.MethodDelete, s.objectURL(key), nil, 0, key)
+	s.cache.Forget(key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+	s.cache.Remove(key)
+	return nil
+}
+
+// Probe checks that the bucket can be listed, for the storage health check
+func (s *GCSStorage) Probe(ctx context.Context) error {
+	_, err := s.listPage(ctx, "", "", 1)
+	return err
+}
+
+// do sends an authorized request for key, or for the bucket when key is
+// empty, and returns the successful response. Failures worth another try
+// are retried up to s.retries times, rewinding body for each attempt.
+func (s *GCSStorage) do(ctx context.Context, client *http.Client, method, address string, body io.ReadSeeker, size int64, key string) (*http.Response, error) {
+	var start int64
+	if body != nil {
+		var err error
+		if start, err = body.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	backoff := s.backoff
+	for attempt := 0; ; attempt++ {
+		creds, err := s.creds.Get(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("no GCP credentials: %v", err)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, address, nil)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			if _, err := body.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+			req.Body = io.NopCloser(body)
+			req.ContentLength = size
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		req.Header.Set("Authorization", "Bearer "+creds.AccessToken)
+
+		resp, err := client.Do(req)
+		retry := ""
+		switch {
+		case err != nil && ctx.Err() == nil:
+			retry = "network"
+		case err != nil:
+			return nil, err
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+			retry = strconv.Itoa(resp.StatusCode)
+		}
+		if retry == "" || attempt >= s.retries {
+			if err != nil {
+				return nil, err
+			}
+			return resp, gcsError(resp, key)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		metrics.Inc("userguide_gcs_retries_total", "reason", retry)
+		// Full jitter spreads out the instances retrying after an outage
+		wait := time.Duration(rand.Int64N(int64(backoff) + 1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, gcsMaxBackoff)
+	}
+}
+
+// gcsError closes the body of a failed response and describes the
+// failure; a missing key is ErrObjectNotFound, a missing bucket is not
+func gcsError(resp *http.Response, key string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	var failure struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+	what := key
+	if key == "" {
+		what = "bucket"
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" && !strings.Contains(failure.Error.Message, "specified bucket") {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if failure.Error.Message == "" {
+		return fmt.Errorf("gcs %s: %s", what, resp.Status)
+	}
+	return fmt.Errorf("gcs %s: %s: %s", what, resp.Status, failure.Error.Message)
+}
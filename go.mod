@@ -2,4 +2,9 @@ module userguide_api_poc
 
 go 1.24.4
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	golang.org/x/crypto v0.40.0
+)
+
+require golang.org/x/sys v0.34.0 // indirect
@@ -0,0 +1,91 @@
+package userguide
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Headers for version-aware polling by device agents
+const (
+	// GuideVersionHeader carries the version of the served guide
+	GuideVersionHeader = "X-Guide-Version"
+	// InstalledVersionHeader carries the version the client already has
+	InstalledVersionHeader = "X-Installed-Guide-Version"
+)
+
+// guideVersions identifies guide versions by the SHA-256 of their content,
+// so renaming a file or restoring an old copy gives the expected answer.
+// Hashes are cached until the file's size or modification time changes.
+type guideVersions struct {
+	mu      sync.Mutex
+	entries map[string]versionEntry
+}
+
+type versionEntry struct {
+	stamp   fileStamp
+	version string
+}
+
+func newGuideVersions() *guideVersions {
+	return &guideVersions{entries: make(map[string]versionEntry)}
+}
+
+// Version returns the version of the guide at path
+func (gv *guideVersions) Version(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	gv.mu.Lock()
+	entry, ok := gv.entries[path]
+	gv.mu.Unlock()
+	if ok && entry.stamp == stampOf(info) {
+		return entry.version, nil
+	}
+
+	version, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	gv.mu.Lock()
+	gv.entries[path] = versionEntry{stamp: stampOf(info), version: version}
+	gv.mu.Unlock()
+	return version, nil
+}
+
+// NotModified sets the version header and reports whether the client's
+// installed version is current, in which case a body-less 304 has been sent
+func (gv *guideVersions) NotModified(w http.ResponseWriter, r *http.Request, path string) bool {
+	version, err := gv.Version(path)
+	if err != nil {
+		return false
+	}
+	w.Header().Set(GuideVersionHeader, version)
+	w.Header().Add("Vary", InstalledVersionHeader)
+
+	installed := strings.ToLower(strings.TrimSpace(r.Header.Get(InstalledVersionHeader)))
+	if installed == "" || installed != version {
+		return false
+	}
+	metrics.Inc("userguide_downloads_not_modified_total")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Invalidate forgets the versions of files matching match and returns
+// their paths
+func (gv *guideVersions) Invalidate(match func(path string) bool) []string {
+	gv.mu.Lock()
+	defer gv.mu.Unlock()
+	var paths []string
+	for p := range gv.entries {
+		if match(p) {
+			delete(gv.entries, p)
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
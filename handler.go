@@ -1,9 +1,11 @@
-package main
+package userguide
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"path/filepath"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -11,60 +13,433 @@ import (
 // FileHandler handles HTTP requests
 type FileHandler struct {
 	fileService FileServiceInterface
+	authorizer  Authorizer
+	versions    *guideVersions
 	utils       *Utils
+	// protectedAuth guards the /protected routes; nil disables them
+	protectedAuth mux.MiddlewareFunc
+	// jwtKeys verify the JWTs protectedAuth accepts; nil without jwt.jwks.url
+	jwtKeys        *JWKSCache
+	downloadTokens *DownloadTokens
+	// variants are the device variants of guides by guide name
+	variants DeviceVariants
+	// pagesMaxSourceBytes caps the guides pages are extracted from, and
+	// pagesMaxInflatedBytes what their compressed streams inflate to
+	pagesMaxSourceBytes   int64
+	pagesMaxInflatedBytes int64
+	// batchMaxGuides caps the guides one batch download may ask for
+	batchMaxGuides int
+	// routeGuards are the credential checks of routes marked by
+	// RequireAPIKey, RequireIntrospection and RequireOIDC, by route template
+	routeGuards map[string][]mux.MiddlewareFunc
+	// signer verifies signed URLs issued by POST /sign; nil disables them
+	signer *URLSigner
+	// rbac requires roles per guide; nil when no policy is configured
+	rbac *RBACPolicy
+	// downloads caps each client's simultaneous downloads; nil when off
+	downloads *DownloadLimiter
+	// usage records downloads made with API keys; nil when off
+	usage *KeyUsageLedger
+	// swap tracks requests per guide storage; nil when storage cannot change
+	swap *StorageSwap
+	// shadow mirrors downloads to staging; nil when off
+	shadow *TrafficShadow
+	// analytics records interrupted downloads; nil when off
+	analytics *DownloadAnalytics
 }
 
-// NewFileHandler creates a new file handler
-func NewFileHandler(fileService FileServiceInterface) *FileHandler {
-	return &FileHandler{
+// NewFileHandler creates a new file handler that checks downloads with
+// authorizer; restricted guides are served only when protected.path is set
+// along with protected.tokens or jwt.jwks.url
+func NewFileHandler(fileService FileServiceInterface, authorizer Authorizer, config *Config) *FileHandler {
+	fh := &FileHandler{
 		fileService: fileService,
-		utils:       &Utils{},
+		authorizer:  authorizer,
+		versions:    newGuideVersions(),
+		utils:       &Utils{policy: &config.FilenamePolicy},
+
+		pagesMaxSourceBytes:   config.PagesMaxSourceBytes,
+		pagesMaxInflatedBytes: config.PagesMaxInflatedBytes,
+		batchMaxGuides:        config.BatchMaxGuides,
+		variants:              config.DeviceVariants,
+	}
+	if config.ProtectedPath != "" {
+		if validator := NewJWTValidator(config); validator != nil {
+			fh.protectedAuth = JWTMiddleware(validator, config.ProtectedTokens)
+			fh.jwtKeys = validator.keys
+		} else if len(config.ProtectedTokens) > 0 {
+			fh.protectedAuth = AuthMiddleware(config.ProtectedTokens)
+		}
 	}
+	if fh.protectedAuth != nil {
+		fh.downloadTokens = NewDownloadTokens(config)
+	}
+	fh.signer = NewURLSigner(config)
+	fh.downloads = NewDownloadLimiter(config)
+	return fh
 }
 
 // RegisterRoutes registers all handler routes with the router
 func (fh *FileHandler) RegisterRoutes(r *mux.Router) {
 	// Main user guide download route
-	r.HandleFunc("/download/userguide", fh.DownloadUserGuideHandler).Methods("GET")
+	fh.handle(r, "/download/userguide", fh.DownloadUserGuideHandler).Methods("GET")
+	fh.handle(r, "/view/userguide", fh.ViewUserGuideHandler).Methods("GET")
+	fh.handle(r, "/public/download", fh.PublicDownloadHandler).Methods("GET")
+	fh.registerPageRoutes(r)
+	fh.handle(r, "/download/batch", fh.BatchDownloadHandler).Methods("POST")
+
+	// Product guide route (multi-product mode)
+	fh.handle(r, "/products/{product}/guides/{name}", fh.DownloadProductGuideHandler).Methods("GET")
+	fh.handle(r, "/products/{product}/releases/{release}/userguide", fh.DownloadReleaseGuideHandler).Methods("GET")
+
+	// Restricted guides require a bearer token
+	if fh.protectedAuth != nil {
+		protected := r.PathPrefix("/protected").Subrouter()
+		protected.Use(fh.protectedAuth)
+		fh.handle(protected, "/guides/{name}", fh.ProtectedDownloadHandler).Methods("GET")
+		fh.handle(protected, "/download", fh.ProtectedDownloadHandler).Methods("GET")
+
+		// Browsers exchange their credentials for a plain download link
+		exchange := r.PathPrefix("/token").Subrouter()
+		exchange.Use(fh.protectedAuth)
+		fh.handle(exchange, "/download", fh.DownloadTokenHandler).Methods("POST")
+		fh.handle(r, "/download/token/{token}", fh.TokenDownloadHandler).Methods("GET")
+
+		// Interrupted downloads continue from the bytes already received
+		fh.handle(exchange, "/resume", fh.ResumeTokenHandler).Methods("POST")
+		fh.handle(r, "/download/resume/{token}", fh.ResumeDownloadHandler).Methods("GET")
+	}
+
+	if fh.rbac != nil {
+		fh.handle(r, "/rbac/permissions", fh.PermissionsHandler).Methods("GET")
+	}
 
 	// Health check route
 	r.HandleFunc("/health", fh.HealthCheckHandler).Methods("GET")
+	r.HandleFunc("/health/deep", fh.DeepHealthCheckHandler).Methods("GET")
+	r.HandleFunc("/ready", fh.ReadinessHandler).Methods("GET")
+
+	// Metrics route
+	r.Handle("/metrics", metrics).Methods("GET")
+}
+
+// RequireAPIKey marks routes as requiring an X-API-Key held by store; routes
+// maps route templates, e.g. /products/{product}/guides/{name}, to the scope
+// the key must grant, empty for any valid key. Call before RegisterRoutes.
+func (fh *FileHandler) RequireAPIKey(store KeyStore, routes map[string]string) {
+	for template, scope := range routes {
+		fh.guard(template, APIKeyMiddleware(store, scope))
+	}
+}
+
+// RequireIntrospection marks routes as requiring a bearer token that the
+// introspection endpoint reports active with scope. Call before RegisterRoutes.
+func (fh *FileHandler) RequireIntrospection(introspector *TokenIntrospector, routes []string, scope string) {
+	for _, template := range routes {
+		fh.guard(template, IntrospectionMiddleware(introspector, scope))
+	}
+}
+
+// RequireOIDC marks routes as requiring a login session or a bearer JWT from
+// the OpenID provider. Call before RegisterRoutes.
+func (fh *FileHandler) RequireOIDC(oidc *OIDCClient, routes []string) {
+	for _, template := range routes {
+		fh.guard(template, OIDCMiddleware(oidc))
+	}
+}
+
+// RequireRoles checks every guide against the roles of the caller before
+// it is served. Call before RegisterRoutes.
+func (fh *FileHandler) RequireRoles(policy *RBACPolicy) {
+	fh.rbac = policy
+}
+
+// TrackKeyUsage records the downloads made with API keys in ledger. Call
+// before RegisterRoutes.
+func (fh *FileHandler) TrackKeyUsage(ledger *KeyUsageLedger) {
+	fh.usage = ledger
+}
+
+// UseSessions remembers callers admitted to the /protected routes, so their
+// next downloads need only the session cookie. Call before RegisterRoutes.
+// It reports whether there are protected routes to remember callers for.
+func (fh *FileHandler) UseSessions(sessions *Sessions) bool {
+	if fh.protectedAuth == nil {
+		return false
+	}
+	sessions.jwtKeys = fh.jwtKeys
+	fh.protectedAuth = sessions.Middleware(fh.protectedAuth)
+	return true
+}
+
+// UseStorageSwap lets swap wait for guide requests still reading the
+// storage it replaces
+func (fh *FileHandler) UseStorageSwap(swap *StorageSwap) {
+	fh.swap = swap
+}
+
+// MirrorDownloads sends a sample of download requests to staging through
+// shadow as well. Call it before RegisterRoutes.
+func (fh *FileHandler) MirrorDownloads(shadow *TrafficShadow) {
+	fh.shadow = shadow
+}
+
+// TrackInterruptions records how downloads end in analytics. Call it
+// before RegisterRoutes.
+func (fh *FileHandler) TrackInterruptions(analytics *DownloadAnalytics) {
+	fh.analytics = analytics
+}
+
+// guides returns the file service as seen by the caller: limited to the
+// guides its roles grant when a role policy is set. Signed URLs were vetted
+// when they were issued.
+func (fh *FileHandler) guides(r *http.Request) FileServiceInterface {
+	if fh.rbac == nil || signedURLFromContext(r.Context()) {
+		return fh.fileService
+	}
+	return fh.rbac.Scope(r.Context(), fh.fileService)
+}
+
+func (fh *FileHandler) guard(template string, check mux.MiddlewareFunc) {
+	if fh.routeGuards == nil {
+		fh.routeGuards = make(map[string][]mux.MiddlewareFunc)
+	}
+	fh.routeGuards[template] = append(fh.routeGuards[template], check)
+}
+
+// handle registers a guide route behind the credential checks it was marked
+// with, in the order they were added; a valid signed URL skips them. Download
+// routes also take one of the client's download slots once admitted.
+func (fh *FileHandler) handle(r *mux.Router, path string, handler http.HandlerFunc) *mux.Route {
+	route := r.NewRoute().Path(path)
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		template = path
+	}
+	var open http.Handler = handler
+	if headerGroup(template) == HeaderGroupDownload {
+		if fh.analytics != nil {
+			open = fh.analytics.Middleware(open)
+		}
+		if fh.usage != nil {
+			open = fh.usage.Middleware(open)
+		}
+		if fh.downloads != nil {
+			open = fh.downloads.Middleware(open)
+		}
+		if fh.shadow != nil {
+			open = fh.shadow.Middleware(open)
+		}
+	}
+	if fh.swap != nil {
+		open = fh.swap.Middleware(open)
+	}
+	guards := fh.routeGuards[template]
+	h := open
+	for i := len(guards) - 1; i >= 0; i-- {
+		h = guards[i](h)
+	}
+	if fh.signer != nil {
+		h = SignedURLMiddleware(fh.signer, h, open)
+	}
+	return route.Handler(h)
 }
 
 // DownloadUserGuideHandler handles the /download/userguide route specifically
 func (fh *FileHandler) DownloadUserGuideHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("User guide download request from %s", r.RemoteAddr)
+	fh.serveUserGuide(w, r, "attachment")
+}
 
+// ViewUserGuideHandler serves the user guide for the browser's built-in
+// viewer, which fetches it in byte ranges as the reader pages through
+func (fh *FileHandler) ViewUserGuideHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("User guide view request from %s", r.RemoteAddr)
+	// Ranges must address the PDF itself, not a compressed sibling
+	r.Header.Del("Accept-Encoding")
+	fh.serveUserGuide(w, r, "inline")
+}
+
+// serveUserGuide serves the client's user guide variant with the given
+// Content-Disposition type
+func (fh *FileHandler) serveUserGuide(w http.ResponseWriter, r *http.Request, disposition string) {
 	// Service-level security validation (gets filename from config)
-	filePath, err := fh.fileService.DownloadUserGuide()
+	files := fh.guides(r)
+	filePath, variant, err := files.DownloadUserGuideFor(fh.utils.ClientIP(r))
 	if err != nil {
 		log.Printf("User guide download failed from %s: %s", r.RemoteAddr, err.Error())
-		http.Error(w, "User guide not available", http.StatusNotFound)
+		metrics.Inc("userguide_download_errors_total", "variant", variant)
+		writeGuideError(w, err)
 		return
 	}
 
+	// Mobile and low-bandwidth clients may get a lighter edition
+	guide := filepath.Base(filePath)
+	filePath = fh.withDeviceVariant(w, r, guide, filePath, files.DownloadGuide)
+
 	// Set content type using utils
 	safeFilename := filepath.Base(filePath)
 	w.Header().Set("Content-Type", fh.utils.GetContentType(safeFilename))
 
 	// Set content disposition with proper escaping
 	escapedFilename := fh.utils.EscapeForHeader(safeFilename)
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+escapedFilename+"\"")
+	w.Header().Set("Content-Disposition", disposition+"; filename=\""+escapedFilename+"\"")
+
+	// Security headers and the public Cache-Control come from securityMiddleware
+
+	// While a canary rolls out the URL serves two versions by client, so no
+	// response of either may be shared with other clients
+	w.Header().Set("X-Guide-Variant", variant)
+	if files.CanaryActive() {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
 
-	// Security headers
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "DENY")
-	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if !fh.authorized(w, r, guide) {
+		return
+	}
+
+	// Agents that already have this version get no body
+	if fh.versions.NotModified(w, r, filePath) {
+		log.Printf("User guide %s (%s) already installed by %s", safeFilename, variant, r.RemoteAddr)
+		return
+	}
 
-	log.Printf("Serving user guide: %s to %s", safeFilename, r.RemoteAddr)
+	log.Printf("Serving user guide: %s (%s) to %s", safeFilename, variant, r.RemoteAddr)
+	metrics.Inc("userguide_downloads_total", "variant", variant)
+	fh.recordDownload(w, r, guide)
 
 	// Serve the file
-	http.ServeFile(w, r, filePath)
+	fileServer.ServeFile(w, r, filePath)
+}
+
+// DownloadProductGuideHandler serves a named guide of one product
+func (fh *FileHandler) DownloadProductGuideHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	files := fh.guides(r)
+	filePath, err := files.DownloadProductGuide(vars["product"], vars["name"])
+	if err != nil {
+		log.Printf("Product guide download failed from %s: %s", r.RemoteAddr, err.Error())
+		writeGuideError(w, err)
+		return
+	}
+
+	guide := vars["product"] + "/" + filepath.Base(filePath)
+	filePath = fh.withDeviceVariant(w, r, guide, filePath, func(filename string) (string, error) {
+		return files.DownloadProductGuide(vars["product"], filename)
+	})
+	safeFilename := filepath.Base(filePath)
+	w.Header().Set("Content-Type", fh.utils.GetContentType(safeFilename))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fh.utils.EscapeForHeader(safeFilename)+"\"")
+	if !fh.authorized(w, r, guide) || fh.versions.NotModified(w, r, filePath) {
+		return
+	}
+
+	log.Printf("Serving product guide: %s/%s to %s", vars["product"], safeFilename, r.RemoteAddr)
+	metrics.Inc("userguide_product_downloads_total", "product", vars["product"])
+	fh.recordDownload(w, r, guide)
+	fileServer.ServeFile(w, r, filePath)
+}
+
+// DownloadReleaseGuideHandler serves the guide mapped to a product release
+func (fh *FileHandler) DownloadReleaseGuideHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	files := fh.guides(r)
+	filePath, err := files.DownloadReleaseGuide(vars["product"], vars["release"])
+	if err != nil {
+		log.Printf("Release guide download failed from %s: %s", r.RemoteAddr, err.Error())
+		writeGuideError(w, err)
+		return
+	}
+
+	guide := vars["product"] + "/" + filepath.Base(filePath)
+	filePath = fh.withDeviceVariant(w, r, guide, filePath, func(filename string) (string, error) {
+		return files.DownloadProductGuide(vars["product"], filename)
+	})
+	safeFilename := filepath.Base(filePath)
+	w.Header().Set("Content-Type", fh.utils.GetContentType(safeFilename))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fh.utils.EscapeForHeader(safeFilename)+"\"")
+	if !fh.authorized(w, r, guide) || fh.versions.NotModified(w, r, filePath) {
+		return
+	}
+
+	log.Printf("Serving %s release %s guide: %s to %s", vars["product"], vars["release"], safeFilename, r.RemoteAddr)
+	metrics.Inc("userguide_product_downloads_total", "product", vars["product"])
+	fh.recordDownload(w, r, guide)
+	fileServer.ServeFile(w, r, filePath)
+}
+
+// writeGuideError answers a failed guide lookup: 403 with the dates for
+// guides outside their access window, 401 or 403 for guides the caller's
+// roles do not grant, otherwise 404
+func writeGuideError(w http.ResponseWriter, err error) {
+	var windowErr *WindowError
+	switch {
+	case errors.As(err, &windowErr):
+		writeWindowError(w, windowErr)
+	case errors.Is(err, ErrUnauthenticated):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "User guide not available", http.StatusNotFound)
+	}
+}
+
+// resolveGuide returns the path of a published guide named by its file
+// name, or product/name for product guides
+func resolveGuide(files FileServiceInterface, name string) (string, error) {
+	if product, filename, ok := strings.Cut(name, "/"); ok {
+		return files.DownloadProductGuide(product, filename)
+	}
+	return files.DownloadGuide(name)
+}
+
+// authorized asks the authorizer whether the client may download the guide
+// and writes the error response when it may not
+func (fh *FileHandler) authorized(w http.ResponseWriter, r *http.Request, guide string) bool {
+	if signedURLFromContext(r.Context()) {
+		// Whoever signed the link vouched for the download
+		w.Header().Set("Cache-Control", "private, no-store")
+		return true
+	}
+	identity := identityFromRequest(r, fh.utils)
+	err := fh.authorizer.AuthorizeDownload(r.Context(), identity, guide)
+	switch {
+	case err == nil:
+		// Copies handed out on the strength of credentials must not be
+		// served to others by shared caches
+		if identity.APIKey != "" || identity.LicenseKey != "" || len(identity.Roles) > 0 {
+			w.Header().Set("Cache-Control", "private, max-age=3600")
+		}
+		return true
+	case errors.Is(err, ErrUnauthenticated):
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	default:
+		http.Error(w, "Authorization unavailable", http.StatusServiceUnavailable)
+	}
+	log.Printf("Denied %s to %s: %s", guide, identity.Subject, err.Error())
+	metrics.Inc("userguide_authz_denied_total")
+	return false
 }
 
 // HealthCheckHandler handles health check requests
 func (fh *FileHandler) HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("{\"status\": \"healthy\"}"))
+	report := health.Report()
+	status := http.StatusOK
+	if report.Status == StatusUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// DeepHealthCheckHandler runs live component checks before reporting health
+func (fh *FileHandler) DeepHealthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	report := health.DeepReport(r.Context())
+	status := http.StatusOK
+	if report.Status == StatusUnhealthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
 }
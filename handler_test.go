@@ -0,0 +1,300 @@
+package userguide
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"userguide_api_poc/samples"
+	"userguide_api_poc/testutil"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	tokens := []string{"alpha-token", "beta-token"}
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"basic scheme", "Basic YWxwaGEtdG9rZW4=", http.StatusUnauthorized},
+		{"scheme only", "Bearer", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"lowercase scheme", "bearer alpha-token", http.StatusUnauthorized},
+		{"no space", "Beareralpha-token", http.StatusUnauthorized},
+		{"wrong token", "Bearer gamma-token", http.StatusUnauthorized},
+		{"token prefix", "Bearer alpha", http.StatusUnauthorized},
+		{"token with suffix", "Bearer alpha-token2", http.StatusUnauthorized},
+		{"trailing space", "Bearer alpha-token ", http.StatusUnauthorized},
+		{"first token", "Bearer alpha-token", http.StatusOK},
+		{"second token", "Bearer beta-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var identity Identity
+			var admitted bool
+			handler := AuthMiddleware(tokens)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				admitted = true
+				identity, _ = IdentityFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/protected/download", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if admitted != (tt.want == http.StatusOK) {
+				t.Fatalf("admitted = %t", admitted)
+			}
+			if !admitted {
+				if got := rec.Header().Get("WWW-Authenticate"); got != `Bearer realm="userguide"` {
+					t.Errorf("WWW-Authenticate = %q", got)
+				}
+				return
+			}
+			token := strings.TrimPrefix(tt.header, "Bearer ")
+			if want := "token:" + keyFingerprint(token); identity.Subject != want || identity.Method != AuthToken {
+				t.Errorf("identity = %s (%s), want %s (%s)", identity.Subject, identity.Method, want, AuthToken)
+			}
+		})
+	}
+}
+
+func TestValidBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []string
+		header string
+		want   bool
+	}{
+		{"no tokens configured", nil, "Bearer alpha-token", false},
+		{"empty configured token never matches", []string{""}, "Bearer ", false},
+		{"empty entries are skipped", []string{"", "alpha-token"}, "Bearer alpha-token", true},
+		{"match after a longer token", []string{"alpha-token-long", "alpha-token"}, "Bearer alpha-token", true},
+		{"match before a shorter token", []string{"alpha-token", "alpha"}, "Bearer alpha-token", true},
+		{"duplicate tokens", []string{"alpha-token", "alpha-token"}, "Bearer alpha-token", true},
+		{"different length", []string{"alpha-token"}, "Bearer alpha-token-long", false},
+		{"same length, different bytes", []string{"alpha-token"}, "Bearer alpha-tokeN", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/protected/download", nil)
+			req.Header.Set("Authorization", tt.header)
+			if got := validBearerToken(req, tt.tokens); got != tt.want {
+				t.Errorf("validBearerToken = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// newFakeFileHandler returns a handler serving guides from a fake file
+// service over a temporary guide store, with restricted guides enabled
+func newFakeFileHandler(t *testing.T) (*FileHandler, *testutil.FakeFileService, *testutil.GuideStore) {
+	t.Helper()
+	store := testutil.NewGuideStore(t)
+	files := testutil.NewFakeFileService("user-guide.pdf", store.Add(t, "user-guide.pdf", samples.PDF("User Guide")))
+	config := DefaultConfig()
+	config.ProtectedPath = store.Dir
+	config.ProtectedTokens = []string{"alpha-token"}
+	config.DownloadTokenSecret = "test-secret"
+	authorizer, err := NewAuthorizer(config)
+	if err != nil {
+		t.Fatalf("create authorizer: %v", err)
+	}
+	return NewFileHandler(files, authorizer, config), files, store
+}
+
+func TestProtectedDownloadHandler(t *testing.T) {
+	fh, files, store := newFakeFileHandler(t)
+	files.AddGuide("protected/manual.pdf", store.Add(t, "protected/manual.pdf", samples.PDF("Manual")))
+	files.AddGuide("protected/user-guide.pdf", store.Add(t, "protected/user-guide.pdf", samples.PDF("Restricted User Guide")))
+
+	tests := []struct {
+		name     string
+		vars     map[string]string
+		want     int
+		filename string
+		call     string
+	}{
+		{"named guide", map[string]string{"name": "manual.pdf"}, http.StatusOK, "manual.pdf", "DownloadProtectedGuide(manual.pdf)"},
+		{"restricted user guide", nil, http.StatusOK, "user-guide.pdf", "DownloadProtectedGuide()"},
+		{"unknown guide", map[string]string{"name": "missing.pdf"}, http.StatusNotFound, "", "DownloadProtectedGuide(missing.pdf)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/protected/download", nil), tt.vars)
+			rec := httptest.NewRecorder()
+			fh.ProtectedDownloadHandler(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			calls := files.Calls()
+			if got := calls[len(calls)-1]; got != tt.call {
+				t.Errorf("last call = %s, want %s", got, tt.call)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "private, no-store" {
+				t.Errorf("Cache-Control = %q, restricted guides must not be cached", got)
+			}
+			if got, want := rec.Header().Get("Content-Disposition"), `attachment; filename="`+tt.filename+`"`; got != want {
+				t.Errorf("Content-Disposition = %q, want %q", got, want)
+			}
+			if rec.Header().Get(ResumeTokenHeader) == "" {
+				t.Errorf("no %s offered", ResumeTokenHeader)
+			}
+		})
+	}
+}
+
+func TestPublicDownloadHandler(t *testing.T) {
+	fh, files, _ := newFakeFileHandler(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/public/download", nil)
+	rec := httptest.NewRecorder()
+	fh.PublicDownloadHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("Content-Type = %q, want application/pdf", got)
+	}
+	for _, call := range files.Calls() {
+		if strings.HasPrefix(call, "DownloadProtectedGuide") {
+			t.Errorf("public download looked up a restricted guide: %s", call)
+		}
+	}
+}
+
+// newProtectedHarness runs the service with restricted guides enabled: a
+// public user-guide.pdf in the guide storage and a restricted edition of it
+// and manual.pdf in protected.path
+func newProtectedHarness(t *testing.T, configure func(*Config)) *testHarness {
+	t.Helper()
+	protected := t.TempDir()
+	h := newTestHarness(t, func(config *Config) {
+		config.ProtectedPath = protected
+		config.ProtectedTokens = []string{"alpha-token"}
+		config.DownloadTokenSecret = "test-secret"
+		if configure != nil {
+			configure(config)
+		}
+	})
+	h.AddProtectedGuide(t, "user-guide.pdf", samples.PDF("Restricted User Guide"))
+	h.AddProtectedGuide(t, "manual.pdf", samples.PDF("Manual"))
+	return h
+}
+
+func TestPublicDownloadServesOnlyPublicGuides(t *testing.T) {
+	h := newProtectedHarness(t, nil)
+
+	resp := h.Get(t, "/public/download", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if body := readBody(t, resp); !bytes.Equal(body, samples.PDF("User Guide")) {
+		t.Errorf("/public/download did not serve the public edition")
+	}
+
+	// A guide that only exists as a restricted one is not public
+	h = newProtectedHarness(t, func(config *Config) { config.UserGuideFile = "manual.pdf" })
+	for _, auth := range []string{"", "Bearer alpha-token"} {
+		if resp := h.Get(t, "/public/download", auth); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("restricted manual.pdf through /public/download (auth %q): status = %d, want 404", auth, resp.StatusCode)
+		}
+	}
+}
+
+func TestProtectedDownloadRequiresToken(t *testing.T) {
+	h := newProtectedHarness(t, nil)
+
+	for _, auth := range []string{"", "Bearer wrong-token", "Basic YWxwaGEtdG9rZW4="} {
+		resp := h.Get(t, "/protected/download", auth)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("auth %q: status = %d, want 401", auth, resp.StatusCode)
+		}
+		if body := readBody(t, resp); bytes.Contains(body, []byte("%PDF")) {
+			t.Errorf("auth %q: restricted guide sent with the 401", auth)
+		}
+	}
+}
+
+func TestProtectedDownloadServesGuideWithToken(t *testing.T) {
+	h := newProtectedHarness(t, nil)
+
+	resp := h.Get(t, "/protected/download", "Bearer alpha-token")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if body := readBody(t, resp); !bytes.Equal(body, samples.PDF("Restricted User Guide")) {
+		t.Errorf("/protected/download did not serve the restricted edition")
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "private, no-store" {
+		t.Errorf("Cache-Control = %q, want private, no-store", got)
+	}
+
+	resp = h.Get(t, "/protected/guides/manual.pdf", "Bearer alpha-token")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("named guide status = %d, want 200", resp.StatusCode)
+	}
+	if body := readBody(t, resp); !bytes.Equal(body, samples.PDF("Manual")) {
+		t.Errorf("/protected/guides/manual.pdf did not serve the manual")
+	}
+}
+
+func TestUserGuideNotSharedDuringCanary(t *testing.T) {
+	// The harness client connects from 127.0.0.1; find a rollout that
+	// leaves it in the stable bucket
+	stablePercent := 0
+	for p := 1; p < 100 && stablePercent == 0; p++ {
+		if !inCanary("127.0.0.1", "user-guide-v2.pdf", p) {
+			stablePercent = p
+		}
+	}
+	if stablePercent == 0 {
+		t.Fatal("no rollout leaves 127.0.0.1 in the stable bucket")
+	}
+
+	tests := []struct {
+		name        string
+		percent     int
+		wantVariant string
+		wantCaching string
+	}{
+		{"no rollout", 0, VariantStable, "public, max-age=3600"},
+		{"stable during a rollout", stablePercent, VariantStable, "private, max-age=3600"},
+		{"canary", 100, VariantCanary, "private, max-age=3600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHarness(t, func(config *Config) {
+				config.CanaryFile = "user-guide-v2.pdf"
+				config.CanaryPercent = tt.percent
+			})
+			h.Storage.Add("user-guide-v2.pdf", samples.PDF("User Guide v2"))
+
+			resp := h.Get(t, "/download/userguide", "")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := resp.Header.Get("X-Guide-Variant"); got != tt.wantVariant {
+				t.Errorf("X-Guide-Variant = %q, want %q", got, tt.wantVariant)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.wantCaching {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCaching)
+			}
+		})
+	}
+}
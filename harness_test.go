@@ -0,0 +1,191 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"userguide_api_poc/samples"
+	"userguide_api_poc/testutil"
+)
+
+// testHarness serves the full service, wired by NewApp as Main wires it,
+// over a testutil.FakeStorage, so tests go through the real middlewares,
+// routes and response headers without a guide directory. Tests outside the
+// package use userguidetest.NewServer, which wires the service the same way.
+type testHarness struct {
+	Config  *Config
+	Storage *testutil.FakeStorage
+	App     *App
+	Server  *httptest.Server
+}
+
+// newTestHarness starts the service over a fake storage holding a sample
+// user-guide.pdf. configure, when not nil, adjusts the configuration before
+// the service is wired. Everything stops when the test ends.
+func newTestHarness(t testing.TB, configure func(*Config)) *testHarness {
+	t.Helper()
+	config := DefaultConfig()
+	config.UserGuidePath = t.TempDir()
+	config.UserGuideFile = "user-guide.pdf"
+	config.StorageType = "fake"
+	config.DiskCheckInterval = 0
+	if configure != nil {
+		configure(config)
+	}
+
+	store := testutil.NewFakeStorage(t)
+	store.Add("user-guide.pdf", samples.PDF("User Guide"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app, err := NewApp(ctx, config, store, NewBootReport(config))
+	if err != nil {
+		cancel()
+		t.Fatalf("wire service: %v", err)
+	}
+	app.Start(ctx)
+
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = NewHTTPServer(config, app.Handler)
+	server.Start()
+	t.Cleanup(func() {
+		server.Close()
+		cancel()
+		app.Close(context.Background())
+	})
+	return &testHarness{Config: config, Storage: store, App: app, Server: server}
+}
+
+// AddProtectedGuide writes a restricted guide below protected.path, which
+// is always a local directory
+func (h *testHarness) AddProtectedGuide(t testing.TB, name string, content []byte) {
+	t.Helper()
+	if h.Config.ProtectedPath == "" {
+		t.Fatal("protected.path is not configured")
+	}
+	if err := os.WriteFile(filepath.Join(h.Config.ProtectedPath, name), content, 0644); err != nil {
+		t.Fatalf("write protected guide %s: %v", name, err)
+	}
+}
+
+// Get requests path, with the Authorization header when auth is not empty
+func (h *testHarness) Get(t testing.TB, path, auth string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, h.Server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := h.Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// Post sends body to path as JSON, with the Authorization header when auth
+// is not empty
+func (h *testHarness) Post(t testing.TB, path, auth string, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, h.Server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := h.Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readBody returns the whole body of resp
+func readBody(t testing.TB, resp *http.Response) []byte {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return body
+}
+
+func TestHarnessServesUserGuide(t *testing.T) {
+	h := newTestHarness(t, nil)
+
+	resp := h.Get(t, "/download/userguide", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := readBody(t, resp); !bytes.Equal(got, samples.PDF("User Guide")) {
+		t.Errorf("body is not the stored guide (%d bytes)", len(got))
+	}
+	for header, want := range map[string]string{
+		"Content-Type":           "application/pdf",
+		"Content-Disposition":    `attachment; filename="user-guide.pdf"`,
+		"X-Guide-Variant":        "stable",
+		"X-Content-Type-Options": "nosniff",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestHarnessPublishesUpload(t *testing.T) {
+	h := newTestHarness(t, func(config *Config) {
+		config.UploadEnabled = true
+		config.UploadToken = "upload-token"
+	})
+
+	req, err := http.NewRequest(http.MethodPut, h.Server.URL+"/upload/quick-start.md", bytes.NewReader(samples.Markdown("Quick Start")))
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer upload-token")
+	resp, err := h.Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, want 201", resp.StatusCode)
+	}
+	if _, ok := h.Storage.Content("quick-start.md"); !ok {
+		t.Fatal("upload not published to the storage")
+	}
+
+	details := h.Get(t, "/guides/quick-start.md", "")
+	if details.StatusCode != http.StatusOK {
+		t.Fatalf("details status = %d, want 200", details.StatusCode)
+	}
+	if body := readBody(t, details); !bytes.Contains(body, []byte(`"quick-start.md"`)) {
+		t.Errorf("details do not name the guide: %s", body)
+	}
+}
+
+func TestHarnessStorageFailure(t *testing.T) {
+	h := newTestHarness(t, nil)
+	h.Storage.Fail("Stat", errors.New("storage unreachable"))
+
+	resp := h.Get(t, "/download/userguide", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+	calls := h.Storage.Calls()
+	if len(calls) == 0 || calls[len(calls)-1] != "Stat(user-guide.pdf)" {
+		t.Errorf("calls = %v, want a Stat of user-guide.pdf last", calls)
+	}
+}
@@ -0,0 +1,172 @@
+package userguide
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Response header route groups
+const (
+	HeaderGroupDownload = "download"
+	HeaderGroupCatalog  = "catalog"
+	HeaderGroupUpload   = "upload"
+	HeaderGroupAdmin    = "admin"
+	HeaderGroupAuth     = "auth"
+	HeaderGroupDefault  = "default"
+)
+
+// headerGroups lists every route group
+var headerGroups = []string{HeaderGroupDownload, HeaderGroupCatalog, HeaderGroupUpload, HeaderGroupAdmin, HeaderGroupAuth, HeaderGroupDefault}
+
+// headerGroupPrefixes assigns routes to header policy groups; unlisted
+// routes are in the default group. Only routes serving whole guides are in
+// the download group, whose routes also count as downloads.
+var headerGroupPrefixes = []struct {
+	prefix string
+	group  string
+}{
+	{"/download/", HeaderGroupDownload},
+	{"/view/", HeaderGroupDownload},
+	{"/products/", HeaderGroupDownload},
+	{"/protected/", HeaderGroupDownload},
+	{"/public/", HeaderGroupDownload},
+	{"/preview/", HeaderGroupDownload},
+	{"/blobs/", HeaderGroupDownload},
+	{"/guides", HeaderGroupCatalog},
+	{"/upload/", HeaderGroupUpload},
+	{"/replication/", HeaderGroupUpload},
+	{"/token/", HeaderGroupUpload},
+	{"/admin/", HeaderGroupAdmin},
+	{"/auth/", HeaderGroupAuth},
+	{"/csrf", HeaderGroupAuth},
+	{"/sign", HeaderGroupAuth},
+	{"/token", HeaderGroupAuth},
+}
+
+// protocolHeaders are never scrubbed: without them responses cannot be
+// parsed, resumed or retried correctly
+var protocolHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Encoding", "Content-Range",
+	"Accept-Ranges", "Transfer-Encoding", "Trailer", "Date", "Location",
+	"Retry-After", "WWW-Authenticate", "Allow", "Vary",
+	"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Expose-Headers",
+}
+
+// HeaderPolicy removes response headers that reveal implementation details
+// and, for route groups with an allow-list, every header not on it
+type HeaderPolicy struct {
+	strip []string
+	allow map[string]map[string]bool
+}
+
+// NewHeaderPolicy creates the policy configured with headers.strip and
+// headers.allow.<group>
+func NewHeaderPolicy(config *Config) *HeaderPolicy {
+	hp := &HeaderPolicy{allow: make(map[string]map[string]bool)}
+	for _, name := range config.HeadersStrip {
+		hp.strip = append(hp.strip, http.CanonicalHeaderKey(name))
+	}
+	for group, names := range config.HeadersAllow {
+		allowed := make(map[string]bool, len(names)+len(protocolHeaders))
+		for _, name := range protocolHeaders {
+			allowed[name] = true
+		}
+		for _, name := range names {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		hp.allow[group] = allowed
+	}
+	return hp
+}
+
+// Middleware scrubs response headers just before they are sent
+func (hp *HeaderPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := headerGroup(r.URL.Path)
+		next.ServeHTTP(&scrubbingWriter{ResponseWriter: w, policy: hp, group: group}, r)
+	})
+}
+
+// scrub removes the headers the policy does not let through for group
+func (hp *HeaderPolicy) scrub(header http.Header, group string) {
+	removed := 0
+	for _, name := range hp.strip {
+		if _, ok := header[name]; ok {
+			delete(header, name)
+			removed++
+		}
+	}
+	if allowed, ok := hp.allow[group]; ok {
+		for name := range header {
+			if !allowed[name] {
+				delete(header, name)
+				removed++
+			}
+		}
+	}
+	if removed > 0 {
+		metrics.Add("userguide_response_headers_scrubbed_total", float64(removed), "group", group)
+	}
+}
+
+// headerGroup returns the policy group of a request path
+func headerGroup(path string) string {
+	for _, g := range headerGroupPrefixes {
+		if strings.HasPrefix(path, g.prefix) {
+			return g.group
+		}
+	}
+	return HeaderGroupDefault
+}
+
+// parseHeaderAllowProperty applies a headers.allow.<group> property
+func parseHeaderAllowProperty(config *Config, group, value string) error {
+	if !slices.Contains(headerGroups, group) {
+		return fmt.Errorf("unknown group %q, must be one of %s", group, strings.Join(headerGroups, ", "))
+	}
+	config.HeadersAllow[group] = splitList(value)
+	return nil
+}
+
+// scrubbingWriter applies the header policy once, when the handler first
+// commits the response
+type scrubbingWriter struct {
+	http.ResponseWriter
+	policy   *HeaderPolicy
+	group    string
+	scrubbed bool
+}
+
+func (sw *scrubbingWriter) commit() {
+	if !sw.scrubbed {
+		sw.scrubbed = true
+		sw.policy.scrub(sw.ResponseWriter.Header(), sw.group)
+	}
+}
+
+func (sw *scrubbingWriter) WriteHeader(status int) {
+	sw.commit()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *scrubbingWriter) Write(p []byte) (int, error) {
+	sw.commit()
+	return sw.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the sendfile fast path when the underlying writer supports it
+func (sw *scrubbingWriter) ReadFrom(src io.Reader) (int64, error) {
+	sw.commit()
+	if rf, ok := sw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{sw.ResponseWriter}, src)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sw *scrubbingWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
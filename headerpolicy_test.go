@@ -0,0 +1,26 @@
+package userguide
+
+import "testing"
+
+func TestHeaderGroup(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/download/userguide", HeaderGroupDownload},
+		{"/products/{product}/guides/{name}", HeaderGroupDownload},
+		{"/protected/guides/{name}", HeaderGroupDownload},
+		{"/guides", HeaderGroupCatalog},
+		{"/guides/{name}", HeaderGroupCatalog},
+		{"/guides/{name}/pages", HeaderGroupCatalog},
+		{"/upload/{name}", HeaderGroupUpload},
+		{"/admin/usage", HeaderGroupAdmin},
+		{"/auth/login", HeaderGroupAuth},
+		{"/health", HeaderGroupDefault},
+	}
+	for _, tt := range tests {
+		if got := headerGroup(tt.path); got != tt.want {
+			t.Errorf("headerGroup(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package userguide
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Health statuses reported by components
+const (
+	StatusHealthy   = "healthy"
+	StatusDegraded  = "degraded"
+	StatusUnhealthy = "unhealthy"
+)
+
+// health is the process-wide component health registry
+var health = NewHealthRegistry()
+
+// ComponentHealth is the last reported state of one component
+type ComponentHealth struct {
+	Status  string    `json:"status"`
+	Detail  string    `json:"detail,omitempty"`
+	Updated time.Time `json:"updated"`
+	// LastSuccess is when a backend last answered, for backends reported
+	// through SetBackend
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// HealthReport is the body returned by the health endpoint
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+// HealthRegistry collects component health for the health endpoint
+type HealthRegistry struct {
+	mu         sync.RWMutex
+	components map[string]ComponentHealth
+	checks     map[string]func(ctx context.Context) error
+}
+
+// NewHealthRegistry creates an empty health registry
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{
+		components: make(map[string]ComponentHealth),
+		checks:     make(map[string]func(ctx context.Context) error),
+	}
+}
+
+// RegisterCheck adds a live check run by the deep health endpoint. The check
+// reports its own status through Set.
+func (h *HealthRegistry) RegisterCheck(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// DeepReport runs every registered check before building the report
+func (h *HealthRegistry) DeepReport(ctx context.Context) HealthReport {
+	h.mu.RLock()
+	checks := make(map[string]func(ctx context.Context) error, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.RUnlock()
+
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			h.Set(name, StatusUnhealthy, err.Error())
+		}
+	}
+	return h.Report()
+}
+
+// Set records the status of a component
+func (h *HealthRegistry) Set(component, status, detail string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.components[component] = ComponentHealth{Status: status, Detail: detail, Updated: time.Now().UTC()}
+}
+
+// Remove drops a component that no longer exists, such as a replaced backend
+func (h *HealthRegistry) Remove(component string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.components, component)
+}
+
+// SetBackend records whether a backend is reachable along with the last
+// time it answered; err is nil when the backend is reachable
+func (h *HealthRegistry) SetBackend(component string, err error, lastSuccess time.Time) {
+	c := ComponentHealth{Status: StatusHealthy, Detail: "reachable", Updated: time.Now().UTC()}
+	if err != nil {
+		c.Status, c.Detail = StatusUnhealthy, err.Error()
+	}
+	if !lastSuccess.IsZero() {
+		at := lastSuccess.UTC()
+		c.LastSuccess = &at
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.components[component] = c
+}
+
+// Report returns the overall status, which is the worst component status
+func (h *HealthRegistry) Report() HealthReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	report := HealthReport{Status: StatusHealthy, Components: make(map[string]ComponentHealth, len(h.components))}
+	for name, c := range h.components {
+		report.Components[name] = c
+		if c.Status == StatusUnhealthy || (c.Status == StatusDegraded && report.Status == StatusHealthy) {
+			report.Status = c.Status
+		}
+	}
+	return report
+}
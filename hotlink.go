@@ -0,0 +1,104 @@
+package userguide
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// hotlinkGuardedPrefixes are the routes that serve guide content
+var hotlinkGuardedPrefixes = []string{"/download/", "/view/", "/guides/", "/products/", "/protected/", "/preview/", "/blobs/"}
+
+// HotlinkGuard refuses guide downloads started from pages on other sites,
+// judged by the Origin or Referer header the browser sends
+type HotlinkGuard struct {
+	allowed    []string
+	allowEmpty bool
+}
+
+// NewHotlinkGuard creates a guard for the configured origins
+func NewHotlinkGuard(config *Config) *HotlinkGuard {
+	allowed := make([]string, 0, len(config.HotlinkAllowedOrigins))
+	for _, origin := range config.HotlinkAllowedOrigins {
+		allowed = append(allowed, strings.ToLower(strings.TrimSuffix(origin, "/")))
+	}
+	return &HotlinkGuard{allowed: allowed, allowEmpty: config.HotlinkAllowEmptyReferer}
+}
+
+// Middleware answers 403 to guide requests from pages on origins not allowed
+func (hg *HotlinkGuard) Middleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hg.guarded(r.URL.Path) && !hg.allowedRequest(r) {
+				log.Printf("Blocked hotlinked request for %s from %s (origin %q, referer %q)",
+					r.URL.Path, r.RemoteAddr, r.Header.Get("Origin"), r.Header.Get("Referer"))
+				metrics.Inc("userguide_hotlink_blocked_total")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (hg *HotlinkGuard) guarded(path string) bool {
+	for _, prefix := range hotlinkGuardedPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedRequest reports whether the page that started the request may
+// link to guides
+func (hg *HotlinkGuard) allowedRequest(r *http.Request) bool {
+	// Typed URLs, bookmarks and same-site pages are never hotlinks
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "none", "same-origin":
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		origin = refererOrigin(r.Header.Get("Referer"))
+	}
+	if origin == "" {
+		// API clients and privacy-conscious browsers send neither header
+		return hg.allowEmpty
+	}
+
+	origin = strings.ToLower(origin)
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range hg.allowed {
+		if originMatches(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// refererOrigin reduces a Referer URL to scheme://host[:port]
+func refererOrigin(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// originMatches compares an origin against an allowed entry, which may use
+// a leading "*." for any subdomain, e.g. https://*.example.com
+func originMatches(allowed, origin string) bool {
+	scheme, host, ok := strings.Cut(allowed, "://*.")
+	if !ok {
+		return allowed == origin
+	}
+	originScheme, originHost, ok := strings.Cut(origin, "://")
+	return ok && originScheme == scheme && strings.HasSuffix(originHost, "."+host)
+}
@@ -0,0 +1,120 @@
+package userguide
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outbound holds the transport shared by every outbound client, so all
+// integrations pool connections together; it is rebuilt when the http.*
+// settings change
+var outbound struct {
+	mu        sync.Mutex
+	settings  string
+	transport *http.Transport
+}
+
+// NewHTTPClient returns a client for calls to other services that honours
+// the http.* settings: proxy, extra CA certificates and connection limits.
+// A zero timeout means http.timeout.
+func NewHTTPClient(config *Config, timeout time.Duration) *http.Client {
+	if timeout == 0 {
+		timeout = config.HTTPTimeout
+	}
+	return &http.Client{Timeout: timeout, Transport: outboundTransport(config)}
+}
+
+func outboundTransport(config *Config) *http.Transport {
+	settings := fmt.Sprint(config.HTTPProxy, config.HTTPNoProxy, config.HTTPCAFile, config.HTTPMaxIdleConnsPerHost, config.HTTPDialTimeout)
+	outbound.mu.Lock()
+	defer outbound.mu.Unlock()
+	if outbound.transport != nil && outbound.settings == settings {
+		return outbound.transport
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = outboundProxy(config)
+	transport.DialContext = (&net.Dialer{Timeout: config.HTTPDialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.MaxIdleConnsPerHost = config.HTTPMaxIdleConnsPerHost
+	if config.HTTPCAFile != "" {
+		pool, err := loadCAPool(config.HTTPCAFile)
+		if err != nil {
+			// The file was readable when the configuration was loaded
+			log.Printf("Unable to load %s, using system CAs only: %s", config.HTTPCAFile, err.Error())
+		} else {
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		}
+	}
+	if outbound.transport != nil {
+		outbound.transport.CloseIdleConnections()
+	}
+	outbound.transport = transport
+	outbound.settings = settings
+	return transport
+}
+
+// outboundProxy returns the proxy selection for outbound requests:
+// http.proxy except for hosts matching http.no.proxy, or the standard
+// HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment variables when it is unset
+func outboundProxy(config *Config) func(*http.Request) (*url.URL, error) {
+	if config.HTTPProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, _ := url.Parse(config.HTTPProxy)
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), config.HTTPNoProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+// bypassProxy reports whether host matches a no-proxy entry: "*", an exact
+// host or IP, a domain (".example.com" or "example.com" also matching its
+// subdomains) or a CIDR range
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(entry)
+		if entry == "*" || entry == host {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if domain := strings.TrimPrefix(entry, "."); strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCAPool returns the system roots with the PEM certificates in file added
+func loadCAPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return pool, nil
+}
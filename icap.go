@@ -0,0 +1,196 @@
+package userguide
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScannerICAP selects the ICAP client, for antivirus appliances and proxies
+// (Symantec, McAfee, Trend Micro, Kaspersky, c-icap with ClamAV and others)
+const ScannerICAP = "icap"
+
+func init() {
+	RegisterScanner(ScannerICAP, newICAPScanner)
+}
+
+// icapInfectionHeaders are the ICAP response headers services use to name
+// what they found, in order of preference
+var icapInfectionHeaders = []string{"X-Infection-Found", "X-Virus-Id", "X-Virus-Name", "X-Violations-Found", "X-Blocked-Reason"}
+
+// icapScanner sends each guide to an ICAP service (RFC 3507) wrapped in an
+// HTTP message: as the body of a response with RESPMOD, or of an upload
+// request with REQMOD. A 204 answer means the service would leave the
+// message unchanged and the guide is clean; a modified message, usually a
+// block page, or an infection header means it is infected.
+type icapScanner struct {
+	url     *url.URL
+	method  string
+	timeout time.Duration
+	tls     *tls.Config
+}
+
+// newICAPScanner connects to scan.icap.url, icap://host[:1344]/service or
+// icaps:// for ICAP over TLS, which trusts http.ca.file as well
+func newICAPScanner(config *Config) (Scanner, error) {
+	if config.ICAPURL == "" {
+		return nil, fmt.Errorf("scan.engine=icap requires scan.icap.url")
+	}
+	u, err := url.Parse(config.ICAPURL)
+	if err != nil || (u.Scheme != "icap" && u.Scheme != "icaps") || u.Host == "" {
+		return nil, fmt.Errorf("scan.icap.url must be icap://host[:port]/service or icaps://...")
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	method := strings.ToUpper(config.ICAPMethod)
+	if method != "RESPMOD" && method != "REQMOD" {
+		return nil, fmt.Errorf("scan.icap.method must be RESPMOD or REQMOD")
+	}
+	is := &icapScanner{url: u, method: method, timeout: config.ScanTimeout}
+	if u.Scheme == "icaps" {
+		is.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if tc := outboundTransport(config).TLSClientConfig; tc != nil {
+			is.tls.RootCAs = tc.RootCAs
+		}
+	}
+	return is, nil
+}
+
+func (is *icapScanner) Scan(ctx context.Context, path string) (ScanResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, is.timeout)
+	defer cancel()
+	var conn net.Conn
+	if is.tls != nil {
+		conn, err = (&tls.Dialer{Config: is.tls}).DialContext(ctx, "tcp", is.url.Host)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", is.url.Host)
+	}
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("icap: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := is.writeRequest(conn, filepath.Base(path), file, info.Size()); err != nil {
+		return ScanResult{}, fmt.Errorf("icap: %v", err)
+	}
+	return readICAPResponse(bufio.NewReader(conn))
+}
+
+// writeRequest sends the ICAP request with the guide as a chunked body
+func (is *icapScanner) writeRequest(conn net.Conn, name string, body io.Reader, size int64) error {
+	target := "/" + url.PathEscape(name)
+	reqHdr := "GET " + target + " HTTP/1.1\r\nHost: userguide\r\n\r\n"
+	bodyHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: " + strconv.FormatInt(size, 10) + "\r\n\r\n"
+	encapsulated := fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(reqHdr), len(reqHdr)+len(bodyHdr))
+	if is.method == "REQMOD" {
+		reqHdr = "PUT " + target + " HTTP/1.1\r\nHost: userguide\r\nContent-Type: application/octet-stream\r\nContent-Length: " + strconv.FormatInt(size, 10) + "\r\n\r\n"
+		bodyHdr = ""
+		encapsulated = fmt.Sprintf("req-hdr=0, req-body=%d", len(reqHdr))
+	}
+
+	w := bufio.NewWriterSize(conn, 64*1024)
+	fmt.Fprintf(w, "%s %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nConnection: close\r\nEncapsulated: %s\r\n\r\n",
+		is.method, is.url.String(), is.url.Host, encapsulated)
+	w.WriteString(reqHdr)
+	w.WriteString(bodyHdr)
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(chunk)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(chunk[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	return w.Flush()
+}
+
+// readICAPResponse reads the verdict from the ICAP status, the infection
+// headers and the status of an encapsulated HTTP response
+func readICAPResponse(br *bufio.Reader) (ScanResult, error) {
+	tp := textproto.NewReader(br)
+	status, err := tp.ReadLine()
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("icap: %v", err)
+	}
+	proto, rest, _ := strings.Cut(status, " ")
+	code, _, _ := strings.Cut(rest, " ")
+	if !strings.HasPrefix(proto, "ICAP/") {
+		return ScanResult{}, fmt.Errorf("icap: unexpected response %q", status)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("icap: %v", err)
+	}
+
+	for _, name := range icapInfectionHeaders {
+		if value := strings.TrimSpace(header.Get(name)); value != "" {
+			return ScanResult{Infected: true, Signature: icapSignature(value)}, nil
+		}
+	}
+	switch code {
+	case "204":
+		return ScanResult{}, nil
+	case "200":
+	default:
+		return ScanResult{}, fmt.Errorf("icap: %s", status)
+	}
+
+	// The service returned a modified message. An unchanged 2xx response
+	// comes from services that ignore Allow: 204; anything else, such as a
+	// 403 block page, means the guide was blocked.
+	if !strings.Contains(header.Get("Encapsulated"), "res-hdr") {
+		return ScanResult{Infected: true, Signature: "blocked by ICAP service"}, nil
+	}
+	httpStatus, err := tp.ReadLine()
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("icap: %v", err)
+	}
+	_, rest, _ = strings.Cut(httpStatus, " ")
+	if strings.HasPrefix(rest, "2") {
+		return ScanResult{}, nil
+	}
+	return ScanResult{Infected: true, Signature: "blocked by ICAP service (HTTP " + rest + ")"}, nil
+}
+
+// icapSignature extracts the threat name from values such as
+// "Type=0; Resolution=2; Threat=Eicar-Test-Signature;"
+func icapSignature(value string) string {
+	for _, field := range strings.Split(value, ";") {
+		if name, threat, ok := strings.Cut(strings.TrimSpace(field), "="); ok && strings.EqualFold(name, "Threat") {
+			return strings.TrimSpace(threat)
+		}
+	}
+	return value
+}
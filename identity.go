@@ -0,0 +1,81 @@
+package userguide
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Authentication methods of Identity.Method, naming the credential that
+// established the subject
+const (
+	AuthAnonymous  = "anonymous"
+	AuthAPIKey     = "api-key"
+	AuthJWT        = "jwt"
+	AuthOIDC       = "oidc"
+	AuthSession    = "session"
+	AuthClientCert = "mtls"
+	AuthAdmin      = "admin"
+	AuthToken      = "token"
+)
+
+type identityContextKey struct{}
+
+// IdentityFromContext returns the identity the auth middleware that
+// admitted the request resolved, for code that only has a context, such as
+// storages, event publishers and authorizers. ok is false for requests no
+// auth middleware admitted.
+func IdentityFromContext(ctx context.Context) (identity Identity, ok bool) {
+	stored, _ := ctx.Value(identityContextKey{}).(*Identity)
+	if stored == nil || stored.Subject == "" {
+		return Identity{}, false
+	}
+	return *stored, true
+}
+
+// identityMiddleware gives each request a place for its identity, so the
+// middlewares wrapping the auth middlewares, such as the audit log, learn
+// after serving who the request was admitted as
+func identityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, &Identity{})))
+	})
+}
+
+// withIdentity resolves the identity of r, after an auth middleware added
+// the credential it accepted to the context, and stores it for the
+// handlers and hooks of the request. Every auth middleware admits requests
+// through it, so subsystems agree on who made a request.
+func withIdentity(r *http.Request) *http.Request {
+	identity := resolveIdentity(r, &Utils{})
+	if stored, ok := r.Context().Value(identityContextKey{}).(*Identity); ok {
+		*stored = identity
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey{}, &identity))
+}
+
+type bearerTokenContextKey struct{}
+
+// withBearerToken admits r for the static bearer token it presented, which
+// identifies it as token:<fingerprint>
+func withBearerToken(r *http.Request) *http.Request {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return withIdentity(r.WithContext(context.WithValue(r.Context(), bearerTokenContextKey{}, keyFingerprint(token))))
+}
+
+// actorData adds who made the request behind ctx to the data of an event,
+// as the audit log reads it: actor and the auth method. Requests no auth
+// middleware admitted add nothing.
+func actorData(ctx context.Context, data map[string]string) map[string]string {
+	identity, ok := IdentityFromContext(ctx)
+	if !ok {
+		return data
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	data["actor"] = identity.Subject
+	data["auth"] = identity.Method
+	return data
+}
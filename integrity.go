@@ -0,0 +1,203 @@
+package userguide
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// IntegrityVerifier re-hashes stored guides and compares them to the checksum store
+type IntegrityVerifier struct {
+	// guides returns the storage guides are served from
+	guides    func() Storage
+	store     *ChecksumStore
+	locker    Locker
+	mirrorURL string
+	client    *http.Client
+	staging   *Staging
+	utils     *Utils
+}
+
+// NewIntegrityVerifier creates a verifier for the guides guides returns
+func NewIntegrityVerifier(config *Config, guides func() Storage, store *ChecksumStore, locker Locker, staging *Staging) *IntegrityVerifier {
+	return &IntegrityVerifier{
+		guides:    guides,
+		store:     store,
+		locker:    locker,
+		mirrorURL: config.IntegrityMirrorURL,
+		client:    NewHTTPClient(config, config.IntegrityFetchTimeout),
+		staging:   staging,
+		utils:     &Utils{policy: &config.FilenamePolicy},
+	}
+}
+
+// Run verifies every guide once. Guides without a stored checksum are
+// recorded as the baseline; mismatches are reported and, when a mirror is
+// configured, repaired from it.
+func (iv *IntegrityVerifier) Run(ctx context.Context) error {
+	if err := iv.store.Reload(); err != nil {
+		health.Set("integrity", StatusUnhealthy, err.Error())
+		return err
+	}
+	guides := iv.guides()
+	names, err := iv.listGuides(ctx, guides)
+	if err != nil {
+		health.Set("integrity", StatusUnhealthy, err.Error())
+		return err
+	}
+
+	seen := make(map[string]bool)
+	var corrupted []string
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		seen[name] = true
+
+		actual, err := hashGuide(ctx, guides, name)
+		if err != nil {
+			log.Printf("Integrity check could not read %s: %s", name, err.Error())
+			corrupted = append(corrupted, name)
+			continue
+		}
+
+		expected, ok := iv.store.Get(name)
+		if !ok {
+			if err := iv.store.Set(ctx, name, actual); err != nil {
+				return err
+			}
+			continue
+		}
+		if actual == expected {
+			continue
+		}
+
+		metrics.Inc("userguide_integrity_failures_total")
+		events.Publish(Event{Type: EventGuideCorrupted, Subject: name, Data: map[string]string{"expected": expected, "actual": actual}})
+
+		if iv.mirrorURL != "" {
+			if err := iv.repair(ctx, guides, name, expected); err != nil {
+				log.Printf("Unable to repair %s from mirror: %s", name, err.Error())
+			} else {
+				events.Publish(Event{Type: EventGuideRepaired, Subject: name, Data: map[string]string{"sha256": expected}})
+				continue
+			}
+		}
+		corrupted = append(corrupted, name)
+	}
+
+	for name := range iv.store.All() {
+		if !seen[name] {
+			events.Publish(Event{Type: EventGuideMissing, Subject: name})
+			corrupted = append(corrupted, name)
+		}
+	}
+
+	if len(corrupted) > 0 {
+		health.Set("integrity", StatusDegraded, "corrupted or missing: "+strings.Join(corrupted, ", "))
+	} else {
+		health.Set("integrity", StatusHealthy, "")
+	}
+	return nil
+}
+
+// listGuides returns the keys of the guides in guides: those at the top
+// and, in multi-product mode, those of product directories
+func (iv *IntegrityVerifier) listGuides(ctx context.Context, guides Storage) ([]string, error) {
+	objects, err := guides.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, object := range objects {
+		if strings.Count(object.Key, "/") > 1 {
+			continue
+		}
+		product, name := path.Split(object.Key)
+		if (product != "" && iv.utils.IsExcluded(path.Clean(product))) || iv.utils.IsExcluded(name) || !iv.utils.IsAllowedExtension(name) {
+			continue
+		}
+		names = append(names, object.Key)
+	}
+	return names, nil
+}
+
+// hashGuide returns the SHA-256 of the guide stored under key, reading
+// remote guides through their local copies as the file service does
+func hashGuide(ctx context.Context, guides Storage, key string) (string, error) {
+	filePath, err := storagePath(ctx, guides, key)
+	if err != nil {
+		return "", err
+	}
+	return hashFile(filePath)
+}
+
+// repair downloads a guide from the mirror and replaces the stored copy if
+// the download matches the expected checksum
+func (iv *IntegrityVerifier) repair(ctx context.Context, guides Storage, name, expected string) error {
+	source, err := url.JoinPath(iv.mirrorURL, strings.Split(name, "/")...)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := iv.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mirror returned %s", resp.Status)
+	}
+
+	tmp, err := iv.staging.Create("repair")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("mirror copy checksum %s does not match %s", actual, expected)
+	}
+	staged, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err := iv.staging.Verify(ctx, name, tmp); err != nil {
+		return err
+	}
+	// A repair must restore the recorded bytes, not a cleaned variant
+	if checked, err := os.Stat(tmp.Name()); err != nil || !os.SameFile(staged, checked) {
+		return fmt.Errorf("content checks altered the mirror copy")
+	}
+
+	// A publish may have replaced the guide while the mirror copy downloaded
+	unlock, err := iv.locker.Lock(ctx, "guide:"+name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := iv.store.Reload(); err != nil {
+		return err
+	}
+	if current, _ := iv.store.Get(name); current != expected {
+		return fmt.Errorf("guide was republished during repair")
+	}
+	return iv.staging.CommitTo(ctx, tmp, guides, name)
+}
@@ -0,0 +1,397 @@
+package userguide
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Download outcomes: delivered in full, cut off by the client going away,
+// or ended early by the server with the client still connected
+const (
+	DownloadCompleted = "completed"
+	DownloadAborted   = "aborted"
+	DownloadShort     = "short"
+)
+
+// interruptionSizes are the upper bounds of the size classes downloads are
+// grouped by; larger downloads fall in the last, unbounded class
+var interruptionSizes = []int64{1 << 20, 10 << 20, 100 << 20}
+
+// DownloadAttempt is one guide response as download analytics saw it
+type DownloadAttempt struct {
+	Time time.Time `json:"time"`
+	// Guides lists the guides served; batch downloads serve several
+	Guides  []string `json:"guides"`
+	Status  int      `json:"status"`
+	Range   bool     `json:"range,omitempty"`
+	Outcome string   `json:"outcome"`
+	// Sent is the body bytes written; Total the Content-Length the response
+	// announced, -1 when it was streamed without one
+	Sent       int64  `json:"sent"`
+	Total      int64  `json:"total"`
+	DurationMS int64  `json:"duration_ms"`
+	Network    string `json:"network,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type downloadAttemptContextKey struct{}
+
+// downloadAttemptFromContext returns the analytics record of a download
+// being tracked, or nil
+func downloadAttemptFromContext(ctx context.Context) *DownloadAttempt {
+	da, _ := ctx.Value(downloadAttemptContextKey{}).(*DownloadAttempt)
+	return da
+}
+
+// DownloadAnalytics watches guide downloads for client aborts and short
+// writes and keeps the recent ones in memory, so operators can see which
+// guides, sizes and client networks fail to finish. Handlers name the
+// guides they serve through publishDownload; other responses are ignored.
+type DownloadAnalytics struct {
+	window time.Duration
+	max    int
+	utils  *Utils
+
+	mu       sync.Mutex
+	attempts []DownloadAttempt
+	// next is where the following attempt is stored once attempts is full
+	next int
+}
+
+// NewDownloadAnalytics creates the analytics for download.analytics.*; it
+// returns nil unless download.analytics.enabled is set
+func NewDownloadAnalytics(config *Config) *DownloadAnalytics {
+	if !config.DownloadAnalytics {
+		return nil
+	}
+	return &DownloadAnalytics{window: config.DownloadAnalyticsWindow, max: config.DownloadAnalyticsMaxRecords, utils: &Utils{}}
+}
+
+// Middleware records how GET downloads of guides end
+func (da *DownloadAnalytics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		attempt := &DownloadAttempt{Time: time.Now().UTC(), Range: r.Header.Get("Range") != ""}
+		iw := &interruptionWriter{ResponseWriter: w, status: http.StatusOK, expected: -1}
+		next.ServeHTTP(iw, r.WithContext(context.WithValue(r.Context(), downloadAttemptContextKey{}, attempt)))
+		if len(attempt.Guides) == 0 || (iw.status != http.StatusOK && iw.status != http.StatusPartialContent) {
+			return
+		}
+		attempt.Status = iw.status
+		attempt.Sent = iw.written
+		attempt.Total = iw.expected
+		attempt.DurationMS = time.Since(attempt.Time).Milliseconds()
+		attempt.Network = clientNetwork(da.utils.ClientIP(r))
+		ctxErr := r.Context().Err()
+		switch {
+		case iw.err == nil && ((attempt.Total >= 0 && attempt.Sent >= attempt.Total) || (attempt.Total < 0 && ctxErr == nil)):
+			attempt.Outcome = DownloadCompleted
+		case errors.Is(ctxErr, context.DeadlineExceeded):
+			// The server's own time limit cut the download off
+			attempt.Outcome = DownloadShort
+			attempt.Error = ctxErr.Error()
+		case iw.err != nil:
+			attempt.Outcome = DownloadAborted
+			attempt.Error = iw.err.Error()
+		case ctxErr != nil:
+			attempt.Outcome = DownloadAborted
+			attempt.Error = ctxErr.Error()
+		default:
+			attempt.Outcome = DownloadShort
+		}
+		for _, guide := range attempt.Guides {
+			metrics.Inc("userguide_download_outcomes_total", "guide", guide, "outcome", attempt.Outcome)
+		}
+		da.Record(*attempt)
+	})
+}
+
+// Record keeps attempt, replacing the oldest one when the record limit is
+// reached
+func (da *DownloadAnalytics) Record(attempt DownloadAttempt) {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	if len(da.attempts) < da.max {
+		da.attempts = append(da.attempts, attempt)
+		return
+	}
+	da.attempts[da.next] = attempt
+	da.next = (da.next + 1) % da.max
+}
+
+// InterruptionReport summarizes the downloads of a period and how many of
+// them were interrupted, per guide, size class and client network
+type InterruptionReport struct {
+	From        time.Time            `json:"from"`
+	To          time.Time            `json:"to"`
+	Downloads   int                  `json:"downloads"`
+	Interrupted int                  `json:"interrupted"`
+	Rate        float64              `json:"interruption_rate"`
+	Guides      []*InterruptionStats `json:"guides"`
+	Sizes       []*InterruptionStats `json:"sizes"`
+	Networks    []*InterruptionStats `json:"networks"`
+	// Recent lists the latest interrupted downloads, newest first
+	Recent []DownloadAttempt `json:"recent"`
+}
+
+// InterruptionStats counts the downloads of one guide, size class or
+// client network. Progress is the median share of the announced length
+// interrupted downloads had received.
+type InterruptionStats struct {
+	Name        string  `json:"name"`
+	Downloads   int     `json:"downloads"`
+	Completed   int     `json:"completed"`
+	Aborted     int     `json:"aborted"`
+	Short       int     `json:"short"`
+	Rate        float64 `json:"interruption_rate"`
+	BytesSent   int64   `json:"bytes_sent"`
+	Progress    float64 `json:"median_progress,omitempty"`
+	progress    []float64
+	interrupted int
+}
+
+// maxReportedNetworks bounds the networks a report lists, worst first
+const maxReportedNetworks = 20
+
+// maxRecentInterruptions bounds the interrupted downloads a report lists
+const maxRecentInterruptions = 50
+
+// Report summarizes the downloads of the analytics window, only those of
+// guide when it is not empty
+func (da *DownloadAnalytics) Report(guide string) *InterruptionReport {
+	to := time.Now().UTC()
+	report := &InterruptionReport{From: to.Add(-da.window), To: to, Recent: []DownloadAttempt{}}
+	guides := make(map[string]*InterruptionStats)
+	sizes := make(map[string]*InterruptionStats)
+	networks := make(map[string]*InterruptionStats)
+
+	da.mu.Lock()
+	attempts := make([]DownloadAttempt, 0, len(da.attempts))
+	attempts = append(attempts, da.attempts[da.next:]...)
+	attempts = append(attempts, da.attempts[:da.next]...)
+	da.mu.Unlock()
+
+	for i := len(attempts) - 1; i >= 0; i-- {
+		attempt := attempts[i]
+		if attempt.Time.Before(report.From) {
+			continue
+		}
+		if guide != "" && !slices.Contains(attempt.Guides, guide) {
+			continue
+		}
+		report.Downloads++
+		if attempt.Outcome != DownloadCompleted {
+			report.Interrupted++
+			if len(report.Recent) < maxRecentInterruptions {
+				report.Recent = append(report.Recent, attempt)
+			}
+		}
+		for _, name := range attempt.Guides {
+			if guide == "" || name == guide {
+				statsFor(guides, name).add(attempt)
+			}
+		}
+		statsFor(sizes, sizeClass(attempt.Total)).add(attempt)
+		if attempt.Network != "" {
+			statsFor(networks, attempt.Network).add(attempt)
+		}
+	}
+	report.Rate = ratio(report.Interrupted, report.Downloads)
+
+	report.Guides = finishStats(guides)
+	sort.Slice(report.Guides, func(i, j int) bool { return report.Guides[i].Name < report.Guides[j].Name })
+	report.Sizes = finishStats(sizes)
+	sort.Slice(report.Sizes, func(i, j int) bool {
+		return sizeClassOrder(report.Sizes[i].Name) < sizeClassOrder(report.Sizes[j].Name)
+	})
+	report.Networks = finishStats(networks)
+	sort.Slice(report.Networks, func(i, j int) bool {
+		a, b := report.Networks[i], report.Networks[j]
+		if a.interrupted != b.interrupted {
+			return a.interrupted > b.interrupted
+		}
+		return a.Name < b.Name
+	})
+	if len(report.Networks) > maxReportedNetworks {
+		report.Networks = report.Networks[:maxReportedNetworks]
+	}
+	return report
+}
+
+func statsFor(stats map[string]*InterruptionStats, name string) *InterruptionStats {
+	s, ok := stats[name]
+	if !ok {
+		s = &InterruptionStats{Name: name}
+		stats[name] = s
+	}
+	return s
+}
+
+func (s *InterruptionStats) add(attempt DownloadAttempt) {
+	s.Downloads++
+	s.BytesSent += attempt.Sent
+	switch attempt.Outcome {
+	case DownloadCompleted:
+		s.Completed++
+		return
+	case DownloadAborted:
+		s.Aborted++
+	case DownloadShort:
+		s.Short++
+	}
+	s.interrupted++
+	if attempt.Total > 0 {
+		s.progress = append(s.progress, float64(attempt.Sent)/float64(attempt.Total))
+	}
+}
+
+// finishStats computes the rates and median progress of stats
+func finishStats(stats map[string]*InterruptionStats) []*InterruptionStats {
+	list := make([]*InterruptionStats, 0, len(stats))
+	for _, s := range stats {
+		s.Rate = ratio(s.interrupted, s.Downloads)
+		if len(s.progress) > 0 {
+			sort.Float64s(s.progress)
+			s.Progress = s.progress[len(s.progress)/2]
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// sizeClass names the size class of a response of length bytes
+func sizeClass(length int64) string {
+	if length < 0 {
+		return "unknown"
+	}
+	for _, limit := range interruptionSizes {
+		if length < limit {
+			return "<" + formatMiB(limit)
+		}
+	}
+	return ">=" + formatMiB(interruptionSizes[len(interruptionSizes)-1])
+}
+
+// sizeClassOrder sorts size classes from small to large
+func sizeClassOrder(class string) int {
+	for i, limit := range interruptionSizes {
+		if class == "<"+formatMiB(limit) {
+			return i
+		}
+	}
+	if class == "unknown" {
+		return len(interruptionSizes) + 1
+	}
+	return len(interruptionSizes)
+}
+
+func formatMiB(bytes int64) string {
+	return strconv.FormatInt(bytes>>20, 10) + "MiB"
+}
+
+// clientNetwork returns the /24 (IPv4) or /48 (IPv6) network of ip, which
+// groups the clients of one site or provider without naming each address
+func clientNetwork(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// interruptionWriter counts the body bytes of a response against the
+// Content-Length it announced and keeps the first write error
+type interruptionWriter struct {
+	http.ResponseWriter
+	status   int
+	expected int64
+	written  int64
+	err      error
+}
+
+func (iw *interruptionWriter) WriteHeader(status int) {
+	if status >= 200 {
+		iw.status = status
+		if length, err := strconv.ParseInt(iw.Header().Get("Content-Length"), 10, 64); err == nil {
+			iw.expected = length
+		}
+	}
+	iw.ResponseWriter.WriteHeader(status)
+}
+
+func (iw *interruptionWriter) Write(p []byte) (int, error) {
+	if iw.written == 0 && iw.expected < 0 {
+		if length, err := strconv.ParseInt(iw.Header().Get("Content-Length"), 10, 64); err == nil {
+			iw.expected = length
+		}
+	}
+	n, err := iw.ResponseWriter.Write(p)
+	iw.written += int64(n)
+	if err != nil && iw.err == nil {
+		iw.err = err
+	}
+	return n, err
+}
+
+// ReadFrom keeps the sendfile fast path when the underlying writer supports it
+func (iw *interruptionWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := iw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{iw.ResponseWriter}, src)
+	}
+	iw.written += n
+	if err != nil && iw.err == nil {
+		iw.err = err
+	}
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (iw *interruptionWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// InterruptionsHandler serves GET /admin/downloads/interruptions?guide=,
+// the interruption rates of the downloads in download.analytics.window
+func (ah *AdminHandler) InterruptionsHandler(w http.ResponseWriter, r *http.Request) {
+	guide := r.URL.Query().Get("guide")
+	resource := guide
+	if resource == "" {
+		resource = "downloads"
+	}
+	if !ah.permitted(w, r, "downloads.analytics", resource) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, ah.analytics.Report(guide))
+}
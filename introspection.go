@@ -0,0 +1,185 @@
+package userguide
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// introspectionCacheMax bounds the cached introspection results; expired
+// entries are swept when it is reached
+const introspectionCacheMax = 10000
+
+// IntrospectionResult is the part of an RFC 7662 response the service uses
+type IntrospectionResult struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope"`
+	ClientID  string `json:"client_id"`
+	Username  string `json:"username"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// HasScope reports whether the space separated scope claim grants scope
+func (ir *IntrospectionResult) HasScope(scope string) bool {
+	return scope == "" || slices.Contains(strings.Fields(ir.Scope), scope)
+}
+
+// principal names the token holder in logs
+func (ir *IntrospectionResult) principal() string {
+	for _, name := range []string{ir.Subject, ir.Username, ir.ClientID} {
+		if name != "" {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+type introspectionEntry struct {
+	result  *IntrospectionResult
+	expires time.Time
+}
+
+// TokenIntrospector validates opaque bearer tokens against an RFC 7662
+// introspection endpoint. Results are cached by token hash: active tokens
+// until the cache TTL or their own expiry, whichever is sooner, and
+// inactive ones for the shorter negative TTL.
+type TokenIntrospector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	cacheTTL     time.Duration
+	negativeTTL  time.Duration
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionEntry
+}
+
+// NewTokenIntrospector creates an introspector for oauth.* settings; it
+// returns nil when no introspection endpoint is configured
+func NewTokenIntrospector(config *Config) *TokenIntrospector {
+	if config.OAuthIntrospectionURL == "" {
+		return nil
+	}
+	return &TokenIntrospector{
+		url:          config.OAuthIntrospectionURL,
+		clientID:     config.OAuthClientID,
+		clientSecret: config.OAuthClientSecret,
+		client:       NewHTTPClient(config, config.OAuthTimeout),
+		cacheTTL:     config.OAuthCacheTTL,
+		negativeTTL:  config.OAuthNegativeCacheTTL,
+		cache:        make(map[[sha256.Size]byte]introspectionEntry),
+	}
+}
+
+// Introspect returns the endpoint's view of token, from cache when possible
+func (ti *TokenIntrospector) Introspect(ctx context.Context, token string) (*IntrospectionResult, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	ti.mu.Lock()
+	entry, ok := ti.cache[key]
+	ti.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		metrics.Inc("userguide_introspection_requests_total", "result", "cached")
+		return entry.result, nil
+	}
+
+	result, err := ti.fetch(ctx, token)
+	if err != nil {
+		metrics.Inc("userguide_introspection_requests_total", "result", "error")
+		return nil, err
+	}
+	metrics.Inc("userguide_introspection_requests_total", "result", "fetched")
+
+	expires := now.Add(ti.negativeTTL)
+	if result.Active {
+		expires = now.Add(ti.cacheTTL)
+		if result.ExpiresAt != 0 && time.Unix(result.ExpiresAt, 0).Before(expires) {
+			expires = time.Unix(result.ExpiresAt, 0)
+		}
+	}
+	ti.mu.Lock()
+	if len(ti.cache) >= introspectionCacheMax {
+		for k, e := range ti.cache {
+			if !now.Before(e.expires) {
+				delete(ti.cache, k)
+			}
+		}
+		if len(ti.cache) >= introspectionCacheMax {
+			clear(ti.cache)
+		}
+	}
+	ti.cache[key] = introspectionEntry{result: result, expires: expires}
+	ti.mu.Unlock()
+	return result, nil
+}
+
+// fetch posts the token to the introspection endpoint
+func (ti *TokenIntrospector) fetch(ctx context.Context, token string) (*IntrospectionResult, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, "POST", ti.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if ti.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(ti.clientID), url.QueryEscape(ti.clientSecret))
+	}
+
+	resp, err := ti.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+	var result IntrospectionResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid introspection response: %v", err)
+	}
+	return &result, nil
+}
+
+// IntrospectionMiddleware accepts requests whose bearer token the endpoint
+// reports active and granting scope; others get an RFC 6750 error
+func IntrospectionMiddleware(introspector *TokenIntrospector, scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if !strings.HasPrefix(header, "Bearer ") {
+				writeJWTError(w, r, &JWTError{Code: "invalid_request", Description: "bearer token required"})
+				return
+			}
+			result, err := introspector.Introspect(r.Context(), strings.TrimPrefix(header, "Bearer "))
+			if err != nil {
+				log.Printf("Token introspection failed: %s", err.Error())
+				w.Header().Set("Retry-After", "5")
+				writeJSON(w, http.StatusServiceUnavailable, &JWTError{Code: "temporarily_unavailable", Description: "token could not be verified"})
+				return
+			}
+			if !result.Active || (result.ExpiresAt != 0 && !time.Now().Before(time.Unix(result.ExpiresAt, 0))) {
+				writeJWTError(w, r, invalidToken("token is not active"))
+				return
+			}
+			if !result.HasScope(scope) {
+				writeJWTError(w, r, &JWTError{Code: "insufficient_scope", Description: fmt.Sprintf("token lacks the %s scope", scope)})
+				return
+			}
+			log.Printf("Accepted introspected token for %q from %s", result.principal(), r.RemoteAddr)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
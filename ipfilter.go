@@ -0,0 +1,165 @@
+package userguide
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type clientIPContextKey struct{}
+
+// clientIPFromContext returns the address resolved by IPFilter, if any
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPContextKey{}).(string)
+	return ip
+}
+
+// IPFilter resolves the client address, taking X-Forwarded-For only from
+// trusted proxies, and refuses clients outside ip.allow or inside ip.deny
+type IPFilter struct {
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	proxies []*net.IPNet
+	exclude []string
+}
+
+// NewIPFilter creates the filter for ip.* settings
+func NewIPFilter(config *Config) *IPFilter {
+	return &IPFilter{
+		allow:   config.IPAllow,
+		deny:    config.IPDeny,
+		proxies: config.IPTrustedProxies,
+		exclude: config.IPFilterExcludeRoutes,
+	}
+}
+
+// Middleware stores the client address for Utils.ClientIP and answers
+// refused clients with a 403. Deny rules win over allow rules; an empty
+// allow list admits every address not denied.
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := f.clientIP(r)
+		r = r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
+
+		if len(f.allow) > 0 || len(f.deny) > 0 {
+			template := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+			}
+			if !slices.Contains(f.exclude, template) {
+				if rule := f.refused(net.ParseIP(ip)); rule != "" {
+					log.Printf("Refused %s %s from %s: %s", r.Method, r.URL.Path, ip, rule)
+					metrics.Inc("userguide_ip_refused_total", "rule", rule)
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refused names the rule that keeps ip out, or returns "" when it may pass
+func (f *IPFilter) refused(ip net.IP) string {
+	if ip == nil {
+		return "unparsable"
+	}
+	if containsIP(f.deny, ip) {
+		return "deny"
+	}
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return "allow"
+	}
+	return ""
+}
+
+// clientIP is the peer address, or when the peer is a trusted proxy the
+// rightmost X-Forwarded-For entry not added by a trusted proxy. Entries
+// further left are written by the client and cannot be believed.
+func (f *IPFilter) clientIP(r *http.Request) string {
+	peer, trusted := peerAddress(r, f.proxies)
+	if !trusted {
+		return peer
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// A malformed hop ends the chain we can vouch for
+			break
+		}
+		client = ip.String()
+		if !containsIP(f.proxies, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// peerAddress returns the address of the connection's peer and whether it
+// is one of the trusted proxies, whose forwarding headers may be believed
+func peerAddress(r *http.Request, proxies []*net.IPNet) (string, bool) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	return peer, containsIP(proxies, net.ParseIP(peer))
+}
+
+// forwardedHTTPS reports whether the request came over TLS, either directly
+// or to a trusted proxy that says so with X-Forwarded-Proto
+func forwardedHTTPS(r *http.Request, proxies []*net.IPNet) bool {
+	if r.TLS != nil {
+		return true
+	}
+	_, trusted := peerAddress(r, proxies)
+	return trusted && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// containsIP reports whether any of networks holds ip
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a list of CIDR ranges or single addresses
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR range %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,101 @@
+package userguide
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestClientIP(t *testing.T) {
+	config, err := buildConfig(map[string]string{"ip.trusted.proxies": "10.0.0.2,10.0.0.3,2001:db8::2"})
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	filter := NewIPFilter(config)
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct client", "203.0.113.9:5000", nil, "203.0.113.9"},
+		{"untrusted peer", "198.51.100.1:5000", []string{"203.0.113.9"}, "198.51.100.1"},
+		{"one proxy", "10.0.0.2:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"two proxies", "10.0.0.2:5000", []string{"203.0.113.9, 10.0.0.3"}, "203.0.113.9"},
+		{"headers of several proxies", "10.0.0.2:5000", []string{"203.0.113.9", "10.0.0.3"}, "203.0.113.9"},
+		{"spoofed leftmost hop", "10.0.0.2:5000", []string{"192.0.2.1, 203.0.113.9"}, "203.0.113.9"},
+		{"spoofed trusted hop", "10.0.0.2:5000", []string{"10.0.0.3, 203.0.113.9"}, "203.0.113.9"},
+		{"malformed leftmost hop", "10.0.0.2:5000", []string{"not-an-ip, 203.0.113.9"}, "203.0.113.9"},
+		// Proxies only write addresses, so nothing right of a malformed hop
+		// names the client; the nearest proxy is used
+		{"malformed hop from a proxy", "10.0.0.2:5000", []string{"203.0.113.9, bogus, 10.0.0.3"}, "10.0.0.3"},
+		{"only proxies", "10.0.0.2:5000", []string{"10.0.0.3"}, "10.0.0.3"},
+		{"trusted peer without header", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"empty hops", "10.0.0.2:5000", []string{" , 203.0.113.9 ,"}, "203.0.113.9"},
+		{"IPv6", "[2001:db8::2]:443", []string{"2001:db8::9"}, "2001:db8::9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/download/userguide", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := filter.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPFilterRules(t *testing.T) {
+	config, err := buildConfig(map[string]string{
+		"ip.allow":                 "203.0.113.0/24",
+		"ip.deny":                  "203.0.113.66",
+		"ip.trusted.proxies":       "10.0.0.2",
+		"ip.filter.exclude.routes": "/health",
+	})
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	r := mux.NewRouter()
+	r.Use(NewIPFilter(config).Middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/download/userguide", ok)
+	r.HandleFunc("/health", ok)
+
+	tests := []struct {
+		name      string
+		path      string
+		remote    string
+		forwarded string
+		want      int
+	}{
+		{"allowed", "/download/userguide", "203.0.113.9:5000", "", http.StatusOK},
+		{"denied inside the allowed range", "/download/userguide", "203.0.113.66:5000", "", http.StatusForbidden},
+		{"outside the allowed range", "/download/userguide", "198.51.100.1:5000", "", http.StatusForbidden},
+		{"allowed through a proxy", "/download/userguide", "10.0.0.2:5000", "203.0.113.9", http.StatusOK},
+		{"denied through a proxy", "/download/userguide", "10.0.0.2:5000", "203.0.113.66", http.StatusForbidden},
+		{"forwarded by an untrusted peer", "/download/userguide", "198.51.100.1:5000", "203.0.113.9", http.StatusForbidden},
+		{"spoofed allowed hop", "/download/userguide", "10.0.0.2:5000", "203.0.113.9, 198.51.100.1", http.StatusForbidden},
+		{"excluded route", "/health", "198.51.100.1:5000", "", http.StatusOK},
+		{"excluded route, denied address", "/health", "203.0.113.66:5000", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
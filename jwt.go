@@ -0,0 +1,423 @@
+package userguide
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Supported JWT signature algorithms
+const (
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+)
+
+// JWTError is a token rejection reported to the client as a structured 401
+type JWTError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *JWTError) Error() string { return e.Code + ": " + e.Description }
+
+func invalidToken(format string, args ...interface{}) *JWTError {
+	return &JWTError{Code: "invalid_token", Description: fmt.Sprintf(format, args...)}
+}
+
+// JWTClaims are the registered claims checked by the validator
+type JWTClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	IssuedAt  int64       `json:"iat"`
+	// Set in OpenID Connect ID tokens
+	Nonce string `json:"nonce"`
+	Email string `json:"email"`
+	// Roles is read from the claim named by rbac.roles.claim
+	Roles []string `json:"-"`
+	// KeyID is the kid of the key that signed the token
+	KeyID string `json:"-"`
+}
+
+// jwtAudience accepts the single string or array forms of "aud"
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// JWTValidator verifies RS256 and ES256 bearer tokens against the keys
+// published at a JWKS endpoint
+type JWTValidator struct {
+	keys       *JWKSCache
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	rolesClaim string
+}
+
+// NewJWTValidator creates a validator for jwt.* settings; it returns nil
+// when no JWKS endpoint is configured
+func NewJWTValidator(config *Config) *JWTValidator {
+	if config.JWTJWKSURL == "" {
+		return nil
+	}
+	return &JWTValidator{
+		keys:       NewJWKSCache(config.JWTJWKSURL, config),
+		issuer:     config.JWTIssuer,
+		audience:   config.JWTAudience,
+		leeway:     config.JWTLeeway,
+		rolesClaim: config.RBACRolesClaim,
+	}
+}
+
+// Validate checks the signature and claims of a compact JWT
+func (jv *JWTValidator) Validate(ctx context.Context, token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, invalidToken("malformed token header")
+	}
+	if header.Alg != JWTAlgRS256 && header.Alg != JWTAlgES256 {
+		return nil, invalidToken("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed token signature")
+	}
+
+	key, err := jv.keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifyJWTSignature(header.Alg, key, digest[:], signature) {
+		return nil, invalidToken("signature verification failed")
+	}
+
+	var claims JWTClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, invalidToken("malformed token claims")
+	}
+	if err := jv.checkClaims(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+	claims.KeyID = header.Kid
+	if jv.rolesClaim != "" {
+		var raw map[string]json.RawMessage
+		if err := decodeJWTPart(parts[1], &raw); err == nil {
+			claims.Roles = parseRolesClaim(raw[jv.rolesClaim])
+		}
+	}
+	return &claims, nil
+}
+
+// parseRolesClaim accepts an array of roles or a space separated string,
+// the form OAuth uses for scope
+func parseRolesClaim(value json.RawMessage) []string {
+	var list []string
+	if err := json.Unmarshal(value, &list); err == nil {
+		return list
+	}
+	var single string
+	if err := json.Unmarshal(value, &single); err == nil {
+		return strings.Fields(single)
+	}
+	return nil
+}
+
+// checkClaims enforces expiry, not-before, issuer and audience
+func (jv *JWTValidator) checkClaims(claims *JWTClaims, now time.Time) error {
+	if claims.ExpiresAt == 0 {
+		return invalidToken("token has no expiry")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(jv.leeway)) {
+		return invalidToken("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jv.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return invalidToken("token not yet valid")
+	}
+	if claims.Issuer != jv.issuer {
+		return invalidToken("unexpected issuer")
+	}
+	if jv.audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == jv.audience {
+				return nil
+			}
+		}
+		return invalidToken("token not issued for this audience")
+	}
+	return nil
+}
+
+// verifyJWTSignature checks an RS256 or ES256 signature over digest
+func verifyJWTSignature(alg string, key crypto.PublicKey, digest, signature []byte) bool {
+	switch alg {
+	case JWTAlgRS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature) == nil
+	case JWTAlgES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest, r, s)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// JWKSCache holds the signing keys of a JWKS endpoint. Keys are refetched
+// when they age past the refresh interval or a token names an unknown key
+// id, at most once per minimum interval so forged key ids cannot hammer the
+// identity provider. The last good key set is kept if a refresh fails.
+type JWKSCache struct {
+	url         string
+	client      *http.Client
+	refresh     time.Duration
+	minInterval time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+}
+
+// NewJWKSCache creates a cache for the JWKS endpoint at url, refreshed as
+// configured by jwt.jwks.*
+func NewJWKSCache(url string, config *Config) *JWKSCache {
+	return &JWKSCache{
+		url:         url,
+		client:      NewHTTPClient(config, config.JWTJWKSTimeout),
+		refresh:     config.JWTJWKSRefresh,
+		minInterval: config.JWTJWKSMinRefresh,
+		keys:        make(map[string]crypto.PublicKey),
+	}
+}
+
+// Key returns the verification key with the given key id. Tokens without
+// a key id are accepted when the endpoint publishes a single key.
+func (jc *JWKSCache) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+
+	key, ok := jc.lookup(kid)
+	stale := time.Since(jc.fetchedAt) > jc.refresh
+	if (!ok || stale) && time.Since(jc.lastAttempt) >= jc.minInterval {
+		jc.lastAttempt = time.Now()
+		if err := jc.fetch(ctx); err != nil {
+			log.Printf("JWKS refresh from %s failed: %s", jc.url, err.Error())
+			metrics.Inc("userguide_jwks_refreshes_total", "result", "error")
+		} else {
+			metrics.Inc("userguide_jwks_refreshes_total", "result", "ok")
+			key, ok = jc.lookup(kid)
+		}
+	}
+	if !ok {
+		return nil, invalidToken("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (jc *JWKSCache) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(jc.keys) == 1 {
+		for _, key := range jc.keys {
+			return key, true
+		}
+	}
+	key, ok := jc.keys[kid]
+	return key, ok
+}
+
+// jsonWebKey is one entry of a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch replaces the cached keys with the endpoint's current signing keys;
+// callers must hold the lock
+func (jc *JWKSCache) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", jc.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("invalid JWKS document: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %s", jwk.Kid, err.Error())
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS document has no usable signing keys")
+	}
+	jc.keys = keys
+	jc.fetchedAt = time.Now()
+	return nil
+}
+
+// publicKey decodes an RSA or P-256 EC key
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on P-256")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+type jwtClaimsContextKey struct{}
+
+// JWTClaimsFromContext returns the claims of the bearer JWT the request was
+// accepted with, or nil
+func JWTClaimsFromContext(ctx context.Context) *JWTClaims {
+	claims, _ := ctx.Value(jwtClaimsContextKey{}).(*JWTClaims)
+	return claims
+}
+
+// JWTMiddleware accepts requests bearing a valid JWT, or one of the static
+// tokens when any are configured, and answers others with a structured 401
+func JWTMiddleware(validator *JWTValidator, tokens []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if !strings.HasPrefix(header, "Bearer ") {
+				writeJWTError(w, r, &JWTError{Code: "invalid_request", Description: "bearer token required"})
+				return
+			}
+			token := strings.TrimPrefix(header, "Bearer ")
+			if strings.Count(token, ".") != 2 {
+				if len(tokens) > 0 && validBearerToken(r, tokens) {
+					next.ServeHTTP(w, withBearerToken(r))
+					return
+				}
+				writeJWTError(w, r, invalidToken("unrecognized token"))
+				return
+			}
+
+			claims, err := validator.Validate(r.Context(), token)
+			if err != nil {
+				var jwtErr *JWTError
+				if !errors.As(err, &jwtErr) {
+					jwtErr = invalidToken("token could not be verified")
+				}
+				writeJWTError(w, r, jwtErr)
+				return
+			}
+			log.Printf("Accepted token for %q from %s", claims.Subject, r.RemoteAddr)
+			next.ServeHTTP(w, withIdentity(r.WithContext(context.WithValue(r.Context(), jwtClaimsContextKey{}, claims))))
+		})
+	}
+}
+
+// writeJWTError sends an RFC 6750 style 401, or 403 for a token lacking a
+// required scope, with a JSON body
+func writeJWTError(w http.ResponseWriter, r *http.Request, err *JWTError) {
+	log.Printf("Rejected token for %s from %s: %s", r.URL.Path, r.RemoteAddr, err.Description)
+	metrics.Inc("userguide_auth_failures_total")
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="userguide", error=%q, error_description=%q`, err.Code, err.Description))
+	w.Header().Set("Cache-Control", "no-store")
+	if err.Code == "insufficient_scope" {
+		writeJSON(w, http.StatusForbidden, err)
+		return
+	}
+	writeJSON(w, http.StatusUnauthorized, err)
+}
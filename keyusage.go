@@ -0,0 +1,340 @@
+package userguide
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// keyIDPattern matches the API key fingerprints used in logs and audit
+// records (key:<fingerprint>)
+var keyIDPattern = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// defaultReportPeriod is covered by a key report without ?from=
+const defaultReportPeriod = 30 * 24 * time.Hour
+
+// KeyDownload is one download made with an API key, as written to the
+// usage file
+type KeyDownload struct {
+	Time time.Time `json:"time"`
+	// Key is the fingerprint of the API key
+	Key string `json:"key"`
+	// Guides lists the guides served; batch downloads serve several
+	Guides     []string `json:"guides"`
+	Version    string   `json:"version,omitempty"`
+	Bytes      int64    `json:"bytes"`
+	Status     int      `json:"status"`
+	Range      string   `json:"range,omitempty"`
+	DownloadID string   `json:"download_id,omitempty"`
+	DurationMS int64    `json:"duration_ms"`
+}
+
+type keyDownloadContextKey struct{}
+
+// keyDownloadFromContext returns the usage record of a download being
+// tracked, or nil
+func keyDownloadFromContext(ctx context.Context) *KeyDownload {
+	kd, _ := ctx.Value(keyDownloadContextKey{}).(*KeyDownload)
+	return kd
+}
+
+// KeyUsageLedger appends the downloads made with API keys to a JSON lines
+// file and summarizes them per key for usage reviews
+type KeyUsageLedger struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewKeyUsageLedger creates the ledger for apikeys.usage.file; it returns
+// nil when the file is not configured
+func NewKeyUsageLedger(config *Config) *KeyUsageLedger {
+	if config.APIKeyUsageFile == "" {
+		return nil
+	}
+	return &KeyUsageLedger{path: config.APIKeyUsageFile}
+}
+
+// Middleware records downloads made with an X-API-Key once the response
+// is complete. Handlers name the guides they serve through publishDownload;
+// requests that served none are not recorded.
+func (kl *KeyUsageLedger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(APIKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		record := &KeyDownload{Time: time.Now().UTC(), Key: keyFingerprint(key), Range: r.Header.Get("Range")}
+		uw := &usageWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(uw, r.WithContext(context.WithValue(r.Context(), keyDownloadContextKey{}, record)))
+		if len(record.Guides) == 0 {
+			return
+		}
+		record.Bytes = uw.written
+		record.Status = uw.status
+		record.DurationMS = time.Since(record.Time).Milliseconds()
+		record.Version = w.Header().Get(GuideVersionHeader)
+		if record.Version == "" {
+			record.Version = strings.Trim(w.Header().Get("ETag"), `"`)
+		}
+		if err := kl.Record(record); err != nil {
+			log.Printf("Unable to record API key usage in %s: %s", kl.path, err.Error())
+			metrics.Inc("userguide_apikey_usage_errors_total")
+		}
+	})
+}
+
+// Record appends one download to the usage file
+func (kl *KeyUsageLedger) Record(record *KeyDownload) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	f, err := os.OpenFile(kl.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// KeyUsageReport summarizes the downloads of one API key over a period
+type KeyUsageReport struct {
+	Key       string          `json:"key"`
+	Owner     string          `json:"owner,omitempty"`
+	From      time.Time       `json:"from"`
+	To        time.Time       `json:"to"`
+	Downloads int             `json:"downloads"`
+	Bytes     int64           `json:"bytes"`
+	Guides    []GuideKeyUsage `json:"guides"`
+	Records   []KeyDownload   `json:"records"`
+	byGuide   map[string]*GuideKeyUsage
+}
+
+// GuideKeyUsage is the usage of one guide within a key report. A batch
+// download counts towards each guide it contained, with its full size.
+type GuideKeyUsage struct {
+	Guide     string    `json:"guide"`
+	Downloads int       `json:"downloads"`
+	Bytes     int64     `json:"bytes"`
+	Versions  []string  `json:"versions"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+// Report reads the usage file for the downloads made with key in [from, to)
+func (kl *KeyUsageLedger) Report(key string, from, to time.Time) (*KeyUsageReport, error) {
+	report := &KeyUsageReport{Key: key, From: from, To: to, Guides: []GuideKeyUsage{}, Records: []KeyDownload{}, byGuide: make(map[string]*GuideKeyUsage)}
+
+	kl.mu.Lock()
+	f, err := os.Open(kl.path)
+	kl.mu.Unlock()
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record KeyDownload
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			// A line cut short by a crash must not hide the rest of the file
+			continue
+		}
+		if record.Key != key || record.Time.Before(from) || !record.Time.Before(to) {
+			continue
+		}
+		report.add(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, usage := range report.byGuide {
+		report.Guides = append(report.Guides, *usage)
+	}
+	sort.Slice(report.Guides, func(i, j int) bool { return report.Guides[i].Guide < report.Guides[j].Guide })
+	return report, nil
+}
+
+func (kr *KeyUsageReport) add(record KeyDownload) {
+	kr.Records = append(kr.Records, record)
+	kr.Downloads++
+	kr.Bytes += record.Bytes
+	for _, guide := range record.Guides {
+		usage, ok := kr.byGuide[guide]
+		if !ok {
+			usage = &GuideKeyUsage{Guide: guide, Versions: []string{}, First: record.Time}
+			kr.byGuide[guide] = usage
+		}
+		usage.Downloads++
+		usage.Bytes += record.Bytes
+		usage.Last = record.Time
+		if record.Version != "" && !slices.Contains(usage.Versions, record.Version) {
+			usage.Versions = append(usage.Versions, record.Version)
+		}
+	}
+}
+
+// writeCSV writes one line per download of the report
+func (kr *KeyUsageReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "guides", "version", "bytes", "status", "range", "duration_ms", "download_id"})
+	for _, record := range kr.Records {
+		cw.Write([]string{
+			record.Time.Format(time.RFC3339),
+			strings.Join(record.Guides, " "),
+			record.Version,
+			strconv.FormatInt(record.Bytes, 10),
+			strconv.Itoa(record.Status),
+			record.Range,
+			strconv.FormatInt(record.DurationMS, 10),
+			record.DownloadID,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// KeyReportHandler serves GET /admin/apikeys/{id}/report?from=&to=&format=,
+// the downloads of the key with fingerprint id as a JSON summary or, with
+// format=csv, one line per download. The period defaults to the last 30
+// days; from and to take RFC 3339 times or dates.
+func (ah *AdminHandler) KeyReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !ah.permitted(w, r, "apikeys.report", id) {
+		return
+	}
+	to := time.Now().UTC()
+	if value := r.URL.Query().Get("to"); value != "" {
+		t, err := parseReportTime(value)
+		if err != nil {
+			http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-defaultReportPeriod)
+	if value := r.URL.Query().Get("from"); value != "" {
+		t, err := parseReportTime(value)
+		if err != nil {
+			http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	report, err := ah.usage.Report(id, from, to)
+	if err != nil {
+		log.Printf("Unable to build usage report for key %s: %s", id, err.Error())
+		http.Error(w, "Usage report unavailable", http.StatusInternalServerError)
+		return
+	}
+	if ah.keys != nil {
+		if info := ah.keys.Fingerprinted(id); info != nil {
+			report.Owner = info.Owner
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	filename := fmt.Sprintf("apikey-%s-%s-%s", id, from.Format("20060102"), to.Format("20060102"))
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		report.writeCSV(w)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// parseReportTime accepts an RFC 3339 time or a YYYY-MM-DD date (UTC)
+func parseReportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC 3339 time or YYYY-MM-DD date")
+	}
+	return t, nil
+}
+
+// Fingerprinted returns the metadata of the key with the given fingerprint,
+// or nil when the store holds no such key
+func (ks *FileKeyStore) Fingerprinted(fingerprint string) *APIKeyInfo {
+	if err := ks.reload(); err != nil {
+		log.Printf("Unable to reload API keys from %s: %s", ks.path, err.Error())
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for sum, info := range ks.keys {
+		if strings.HasPrefix(sum, fingerprint) {
+			return info
+		}
+	}
+	return nil
+}
+
+// usageWriter counts the body bytes and remembers the status of a response
+type usageWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (uw *usageWriter) WriteHeader(status int) {
+	uw.status = status
+	uw.ResponseWriter.WriteHeader(status)
+}
+
+func (uw *usageWriter) Write(p []byte) (int, error) {
+	n, err := uw.ResponseWriter.Write(p)
+	uw.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile fast path when the underlying writer supports it
+func (uw *usageWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := uw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{uw.ResponseWriter}, src)
+	}
+	uw.written += n
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (uw *usageWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
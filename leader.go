@@ -0,0 +1,341 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Leader election backends
+const (
+	LeaderNone       = "none"
+	LeaderRedis      = "redis"
+	LeaderKubernetes = "kubernetes"
+)
+
+// Event types for leadership changes
+const (
+	EventLeaderAcquired = "leader.acquired"
+	EventLeaderLost     = "leader.lost"
+)
+
+// LeaderElector decides which replica runs singleton background jobs
+type LeaderElector interface {
+	IsLeader() bool
+	// Ready is closed once the first election round has completed
+	Ready() <-chan struct{}
+	Run(ctx context.Context)
+	// Resign releases leadership so another replica can take over immediately
+	Resign(ctx context.Context)
+}
+
+// NewLeaderElector creates the elector selected by leader.election
+func NewLeaderElector(config *Config) (LeaderElector, error) {
+	identity := config.LeaderIdentity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = hostname
+	}
+
+	base := &leaderState{
+		identity:      identity,
+		renewInterval: config.LeaderRenewInterval,
+		leaseDuration: config.LeaderLeaseDuration,
+		ready:         make(chan struct{}),
+	}
+	switch config.LeaderElection {
+	case LeaderRedis:
+		return &redisElector{leaderState: base, redis: NewRedisClient(config), key: "userguide:leader:" + config.LeaderLeaseName}, nil
+	case LeaderKubernetes:
+		return newKubernetesElector(base, config.LeaderLeaseName)
+	}
+	return nil, fmt.Errorf("unknown leader election backend %q", config.LeaderElection)
+}
+
+// leaderState holds the shared campaign loop for electors
+type leaderState struct {
+	identity      string
+	renewInterval time.Duration
+	leaseDuration time.Duration
+	leader        atomic.Bool
+	resigned      atomic.Bool
+	ready         chan struct{}
+	readyOnce     sync.Once
+}
+
+// IsLeader reports whether this replica currently holds the lease
+func (ls *leaderState) IsLeader() bool {
+	return ls.leader.Load()
+}
+
+// Ready is closed once the first election round has completed
+func (ls *leaderState) Ready() <-chan struct{} {
+	return ls.ready
+}
+
+// campaign calls tryAcquire every renew interval and records transitions
+func (ls *leaderState) campaign(ctx context.Context, tryAcquire func(ctx context.Context) (bool, error)) {
+	ticker := time.NewTicker(ls.renewInterval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil && !ls.resigned.Load() {
+		acquired, err := tryAcquire(ctx)
+		if err != nil {
+			log.Printf("Leader election error: %s", err.Error())
+			acquired = false
+		}
+		if ls.resigned.Load() {
+			return
+		}
+		ls.set(acquired)
+		ls.readyOnce.Do(func() { close(ls.ready) })
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ls *leaderState) set(leader bool) {
+	if ls.leader.Swap(leader) == leader {
+		return
+	}
+	gauge := 0.0
+	eventType := EventLeaderLost
+	if leader {
+		gauge = 1
+		eventType = EventLeaderAcquired
+	}
+	metrics.Set("userguide_leader", gauge)
+	events.Publish(Event{Type: eventType, Subject: ls.identity})
+}
+
+// redisElector holds leadership through a Redis key with an expiry
+type redisElector struct {
+	*leaderState
+	redis *RedisClient
+	key   string
+}
+
+// renewScript extends the lease only if this replica still owns it
+const renewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+
+// releaseScript deletes a lease or lock only if its owner still holds it
+const releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+func (re *redisElector) Run(ctx context.Context) {
+	re.campaign(ctx, re.tryAcquire)
+}
+
+func (re *redisElector) tryAcquire(ctx context.Context) (bool, error) {
+	ttl := fmt.Sprint(re.leaseDuration.Milliseconds())
+	if re.IsLeader() {
+		renewed, err := re.redis.Do(ctx, "EVAL", renewScript, "1", re.key, re.identity, ttl)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := renewed.(int64); n == 1 {
+			return true, nil
+		}
+	}
+	reply, err := re.redis.Do(ctx, "SET", re.key, re.identity, "NX", "PX", ttl)
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+func (re *redisElector) Resign(ctx context.Context) {
+	re.resigned.Store(true)
+	if !re.IsLeader() {
+		return
+	}
+	re.set(false)
+	if _, err := re.redis.Do(ctx, "EVAL", releaseScript, "1", re.key, re.identity); err != nil {
+		log.Printf("Failed to release leadership: %s", err.Error())
+	}
+}
+
+// kubernetesElector holds leadership through a coordination.k8s.io Lease
+type kubernetesElector struct {
+	*leaderState
+	client *http.Client
+	url    string
+	token  string
+	name   string
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func newKubernetesElector(base *leaderState, name string) (*kubernetesElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running inside Kubernetes")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	return &kubernetesElector{
+		leaderState: base,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:   fmt.Sprintf("https://%s:%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", host, port, strings.TrimSpace(string(namespace))),
+		token: strings.TrimSpace(string(token)),
+		name:  name,
+	}, nil
+}
+
+// lease is the subset of a Kubernetes Lease object used for election
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	RenewTime            string `json:"renewTime"`
+}
+
+// microTime is the timestamp format of Lease renewTime
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (ke *kubernetesElector) Run(ctx context.Context) {
+	ke.campaign(ctx, ke.tryAcquire)
+}
+
+func (ke *kubernetesElector) tryAcquire(ctx context.Context) (bool, error) {
+	current, status, err := ke.getLease(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	desired := lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: ke.name},
+		Spec: leaseSpec{
+			HolderIdentity:       ke.identity,
+			LeaseDurationSeconds: int(ke.leaseDuration.Seconds()),
+			RenewTime:            now.Format(microTime),
+		},
+	}
+
+	if status == http.StatusNotFound {
+		return ke.writeLease(ctx, "POST", ke.url, desired)
+	}
+
+	if current.Spec.HolderIdentity != ke.identity {
+		renewed, err := time.Parse(time.RFC3339Nano, current.Spec.RenewTime)
+		expiry := renewed.Add(time.Duration(current.Spec.LeaseDurationSeconds) * time.Second)
+		if err == nil && now.Before(expiry) {
+			return false, nil
+		}
+	}
+
+	// Optimistic concurrency: the update fails if another replica wrote first
+	desired.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+	return ke.writeLease(ctx, "PUT", ke.url+"/"+ke.name, desired)
+}
+
+func (ke *kubernetesElector) Resign(ctx context.Context) {
+	ke.resigned.Store(true)
+	if !ke.IsLeader() {
+		return
+	}
+	ke.set(false)
+	current, status, err := ke.getLease(ctx)
+	if err != nil || status != http.StatusOK || current.Spec.HolderIdentity != ke.identity {
+		return
+	}
+	current.Spec.HolderIdentity = ""
+	if _, err := ke.writeLease(ctx, "PUT", ke.url+"/"+ke.name, current); err != nil {
+		log.Printf("Failed to release leadership: %s", err.Error())
+	}
+}
+
+func (ke *kubernetesElector) getLease(ctx context.Context) (lease, int, error) {
+	var l lease
+	req, err := http.NewRequestWithContext(ctx, "GET", ke.url+"/"+ke.name, nil)
+	if err != nil {
+		return l, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ke.token)
+
+	resp, err := ke.client.Do(req)
+	if err != nil {
+		return l, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return l, resp.StatusCode, json.NewDecoder(resp.Body).Decode(&l)
+	case http.StatusNotFound:
+		return l, resp.StatusCode, nil
+	}
+	return l, resp.StatusCode, fmt.Errorf("lease lookup returned %s", resp.Status)
+}
+
+func (ke *kubernetesElector) writeLease(ctx context.Context, method, url string, l lease) (bool, error) {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ke.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ke.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	return false, fmt.Errorf("lease update returned %s", resp.Status)
+}
@@ -0,0 +1,235 @@
+package userguide
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Request kinds exercised by the load test
+const (
+	loadFull        = "full"
+	loadRange       = "range"
+	loadConditional = "conditional"
+)
+
+var loadKinds = []string{loadFull, loadRange, loadConditional}
+
+// loadResult aggregates the outcome of load test requests of one kind.
+// Latencies are those of successful responses only: error statuses are
+// often answered early and would make the service look faster than it is.
+type loadResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+	// failed counts responses with an error status, errors the requests
+	// that got no response
+	failed int
+	errors int
+	bytes  int64
+}
+
+// record adds the outcome of one request
+func (res *loadResult) record(resp *http.Response, err error, elapsed time.Duration, n int64) {
+	if err != nil {
+		res.errors++
+		return
+	}
+	res.statuses[resp.StatusCode]++
+	res.bytes += n
+	if !loadSuccess(resp.StatusCode) {
+		res.failed++
+		return
+	}
+	res.latencies = append(res.latencies, elapsed)
+}
+
+// total is the number of requests made
+func (res *loadResult) total() int {
+	return len(res.latencies) + res.failed + res.errors
+}
+
+// loadSuccess reports whether status answers a download as intended:
+// 200, 206 for ranges and 304 for conditional requests
+func loadSuccess(status int) bool {
+	return status >= 200 && status < 300 || status == http.StatusNotModified
+}
+
+// runLoadTestCommand exercises the download endpoint and reports latency
+// percentiles of the successful requests. It fails when more requests than
+// -max-error-rate allows got an error status or no response.
+func runLoadTestCommand(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	url := fs.String("url", "http://localhost:8080/download/userguide", "download URL to exercise")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent clients")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run")
+	apiKey := fs.String("api-key", "", "API key sent in the X-API-Key header")
+	maxErrorRate := fs.Float64("max-error-rate", 0.01, "fraction of failed requests above which the run fails")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	if *maxErrorRate < 0 || *maxErrorRate > 1 {
+		return fmt.Errorf("max-error-rate must be between 0 and 1")
+	}
+
+	client := &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+
+	// Prime validators for conditional requests
+	etag, lastModified, err := fetchValidators(client, *url, *apiKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Load testing %s with %d clients for %s\n", *url, *concurrency, *duration)
+
+	var mu sync.Mutex
+	results := make(map[string]*loadResult)
+	for _, kind := range loadKinds {
+		results[kind] = &loadResult{statuses: make(map[int]int)}
+	}
+
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	for worker := 0; worker < *concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := worker; time.Now().Before(deadline); i++ {
+				kind := loadKinds[i%len(loadKinds)]
+				req, err := http.NewRequest("GET", *url, nil)
+				if err != nil {
+					return
+				}
+				if *apiKey != "" {
+					req.Header.Set(APIKeyHeader, *apiKey)
+				}
+				switch kind {
+				case loadRange:
+					req.Header.Set("Range", "bytes=0-1023")
+				case loadConditional:
+					if etag != "" {
+						req.Header.Set("If-None-Match", etag)
+					} else if lastModified != "" {
+						req.Header.Set("If-Modified-Since", lastModified)
+					}
+				}
+
+				begin := time.Now()
+				resp, err := client.Do(req)
+				var n int64
+				if err == nil {
+					n, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				elapsed := time.Since(begin)
+
+				mu.Lock()
+				results[kind].record(resp, err, elapsed, n)
+				mu.Unlock()
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	printLoadReport(results, time.Since(start))
+	if rate := loadErrorRate(results); rate > *maxErrorRate {
+		return fmt.Errorf("%.2f%% of requests failed, above the %.2f%% allowed", rate*100, *maxErrorRate*100)
+	}
+	return nil
+}
+
+// loadErrorRate is the fraction of requests that failed, with an error
+// status or without a response; a run without requests failed entirely
+func loadErrorRate(results map[string]*loadResult) float64 {
+	total, failed := 0, 0
+	for _, res := range results {
+		total += res.total()
+		failed += res.failed + res.errors
+	}
+	if total == 0 {
+		return 1
+	}
+	return float64(failed) / float64(total)
+}
+
+// fetchValidators performs one request to learn the ETag and Last-Modified values
+func fetchValidators(client *http.Client, url, apiKey string) (string, string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if apiKey != "" {
+		req.Header.Set(APIKeyHeader, apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("warm-up request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("warm-up request returned %s", resp.Status)
+	}
+	return resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"), nil
+}
+
+func printLoadReport(results map[string]*loadResult, elapsed time.Duration) {
+	total := 0
+	for _, kind := range loadKinds {
+		total += results[kind].total()
+	}
+	var totalBytes int64
+	for _, kind := range loadKinds {
+		totalBytes += results[kind].bytes
+	}
+	fmt.Printf("\n%d requests in %s (%.1f req/s, %.1f MB/s), %.2f%% failed\n\n", total, elapsed.Round(time.Millisecond),
+		float64(total)/elapsed.Seconds(), float64(totalBytes)/(1<<20)/elapsed.Seconds(), loadErrorRate(results)*100)
+	fmt.Printf("%-12s %8s %8s %8s %10s %10s %10s %10s %10s  %s\n", "kind", "ok", "failed", "errors", "p50", "p90", "p99", "max", "MB", "statuses")
+
+	for _, kind := range loadKinds {
+		res := results[kind]
+		sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+
+		statuses := ""
+		codes := make([]int, 0, len(res.statuses))
+		for code := range res.statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			statuses += fmt.Sprintf("%d:%d ", code, res.statuses[code])
+		}
+
+		fmt.Printf("%-12s %8d %8d %8d %10s %10s %10s %10s %10.1f  %s\n", kind,
+			len(res.latencies), res.failed, res.errors,
+			percentile(res.latencies, 50), percentile(res.latencies, 90),
+			percentile(res.latencies, 99), percentile(res.latencies, 100),
+			float64(res.bytes)/(1<<20), statuses)
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := (len(sorted)*p + 99) / 100
+	if idx < 1 {
+		idx = 1
+	}
+	if idx > len(sorted) {
+		idx = len(sorted)
+	}
+	return sorted[idx-1].Round(time.Microsecond)
+}
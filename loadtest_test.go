@@ -0,0 +1,87 @@
+package userguide
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadResultKeepsErrorsOutOfPercentiles(t *testing.T) {
+	res := &loadResult{statuses: make(map[int]int)}
+	for _, outcome := range []struct {
+		status  int
+		elapsed time.Duration
+	}{
+		{http.StatusOK, 40 * time.Millisecond},
+		{http.StatusPartialContent, 50 * time.Millisecond},
+		{http.StatusNotModified, 60 * time.Millisecond},
+		{http.StatusServiceUnavailable, time.Millisecond},
+		{http.StatusNotFound, time.Millisecond},
+	} {
+		res.record(&http.Response{StatusCode: outcome.status}, nil, outcome.elapsed, 0)
+	}
+	res.record(nil, io.ErrUnexpectedEOF, 0, 0)
+
+	if len(res.latencies) != 3 || res.failed != 2 || res.errors != 1 {
+		t.Fatalf("ok %d, failed %d, errors %d, want 3, 2, 1", len(res.latencies), res.failed, res.errors)
+	}
+	if p50 := percentile(res.latencies, 50); p50 != 50*time.Millisecond {
+		t.Errorf("p50 = %s, want 50ms from the successful requests", p50)
+	}
+	if res.statuses[http.StatusServiceUnavailable] != 1 {
+		t.Errorf("statuses = %v, want the error statuses reported", res.statuses)
+	}
+	if rate := loadErrorRate(map[string]*loadResult{loadFull: res}); rate != 0.5 {
+		t.Errorf("error rate = %v, want 0.5", rate)
+	}
+	if rate := loadErrorRate(map[string]*loadResult{}); rate != 1 {
+		t.Errorf("error rate without requests = %v, want 1", rate)
+	}
+}
+
+func TestLoadTestFailsAboveErrorRate(t *testing.T) {
+	// Every range request fails once the validators are fetched
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Range") != "" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "%PDF-1.4")
+	}))
+	defer server.Close()
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+
+	tests := []struct {
+		maxErrorRate string
+		wantErr      bool
+	}{
+		{"0.01", true},
+		{"0.5", false},
+	}
+	for _, tt := range tests {
+		err := runLoadTestCommand([]string{"-url", server.URL, "-concurrency", "3", "-duration", "100ms", "-max-error-rate", tt.maxErrorRate})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("max-error-rate %s: err = %v, want error %t", tt.maxErrorRate, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), "requests failed") {
+			t.Errorf("err = %v, want the failure rate", err)
+		}
+	}
+	if requests.Load() == 0 {
+		t.Fatal("no requests made")
+	}
+}
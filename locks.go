@@ -0,0 +1,131 @@
+package userguide
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Lock stores
+const (
+	LockStoreMemory = "memory"
+	LockStoreRedis  = "redis"
+)
+
+// ErrLockTimeout is returned when a lock could not be acquired in time
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// Locker serialises changes to a named resource, such as a guide or the
+// checksum manifest, across goroutines and, with Redis, across replicas
+type Locker interface {
+	// Lock blocks until the named lock is held and returns its release function
+	Lock(ctx context.Context, name string) (func(), error)
+}
+
+// NewLocker creates the locker selected by lock.store
+func NewLocker(config *Config) Locker {
+	if config.LockStore == LockStoreRedis {
+		return &redisLocker{redis: NewRedisClient(config), ttl: config.LockTTL, wait: config.LockWait}
+	}
+	return &localLocker{wait: config.LockWait, locks: make(map[string]*localLock)}
+}
+
+// localLocker holds locks within this process only
+type localLocker struct {
+	mu    sync.Mutex
+	wait  time.Duration
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+func (ll *localLocker) Lock(ctx context.Context, name string) (func(), error) {
+	ll.mu.Lock()
+	lock, ok := ll.locks[name]
+	if !ok {
+		lock = &localLock{held: make(chan struct{}, 1)}
+		ll.locks[name] = lock
+	}
+	lock.waiters++
+	ll.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, ll.wait)
+	defer cancel()
+
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			ll.done(name, lock)
+		}, nil
+	case <-ctx.Done():
+		ll.done(name, lock)
+		return nil, fmt.Errorf("%w %s", ErrLockTimeout, name)
+	}
+}
+
+// done drops the lock entry once nobody holds or waits for it
+func (ll *localLocker) done(name string, lock *localLock) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	lock.waiters--
+	if lock.waiters == 0 {
+		delete(ll.locks, name)
+	}
+}
+
+// redisLocker holds locks as Redis keys owned by a random token. The TTL
+// bounds how long a crashed replica can block others.
+type redisLocker struct {
+	redis *RedisClient
+	ttl   time.Duration
+	wait  time.Duration
+}
+
+func (rl *redisLocker) Lock(ctx context.Context, name string) (func(), error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	key := "userguide:lock:" + name
+	ttl := fmt.Sprint(rl.ttl.Milliseconds())
+
+	ctx, cancel := context.WithTimeout(ctx, rl.wait)
+	defer cancel()
+
+	backoff := 25 * time.Millisecond
+	for {
+		reply, err := rl.redis.Do(ctx, "SET", key, token, "NX", "PX", ttl)
+		if err != nil && ctx.Err() == nil {
+			return nil, err
+		}
+		if reply == "OK" {
+			return func() { rl.unlock(key, token) }, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w %s", ErrLockTimeout, name)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 500*time.Millisecond)
+	}
+}
+
+// unlock deletes the key only if the lock has not expired and been taken over
+func (rl *redisLocker) unlock(key, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := rl.redis.Do(ctx, "EVAL", releaseScript, "1", key, token); err != nil {
+		log.Printf("Failed to release lock %s: %s", key, err.Error())
+	}
+}
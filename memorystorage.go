@@ -0,0 +1,196 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"userguide_api_poc/samples"
+)
+
+// StorageBackendMemory names the in-memory guide store
+const StorageBackendMemory = "memory"
+
+// Seeds of memory.seed
+const (
+	MemorySeedSamples = "samples"
+	MemorySeedNone    = "none"
+)
+
+func init() {
+	RegisterStorage(StorageBackendMemory, func(config *Config) (Storage, error) { return NewMemoryStorage(config) })
+}
+
+// MemoryStorage keeps guides in process memory, seeded with the embedded
+// sample guides, so integration tests and demos run without preparing a
+// guide directory. Uploads last until the process exits. The serving layer
+// reads guides by path, so requested guides are copied to a cache
+// directory, a temporary one removed by Close unless memory.cache.path is
+// set.
+type MemoryStorage struct {
+	mu         sync.RWMutex
+	objects    map[string]memoryObject
+	generation int64
+	cacheDir   string
+	tempCache  bool
+	cache      *objectCache
+}
+
+// memoryObject is one stored guide; data is never modified once stored
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+	version string
+}
+
+// NewMemoryStorage creates a storage holding the memory.seed guides
+func NewMemoryStorage(config *Config) (*MemoryStorage, error) {
+	s := &MemoryStorage{objects: make(map[string]memoryObject)}
+	if config.MemorySeed == MemorySeedSamples {
+		if err := s.seed(samples.Guides()); err != nil {
+			return nil, fmt.Errorf("unable to load sample guides: %v", err)
+		}
+	}
+	s.cacheDir = config.MemoryCachePath
+	var err error
+	if s.cacheDir == "" {
+		if s.cacheDir, err = os.MkdirTemp("", "userguide-memory-"); err != nil {
+			return nil, fmt.Errorf("unable to create memory cache: %v", err)
+		}
+		s.tempCache = true
+	}
+	// Metadata lookups are as cheap as the cache's, so none are remembered:
+	// with ttl 0 the cache looks up every request and keeps no stats
+	if s.cache, err = newObjectCache(StorageBackendMemory, s.String(), s.cacheDir, 0); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.cache.head = s.head
+	s.cache.download = func(_ context.Context, info ObjectInfo) (io.ReadCloser, error) {
+		s.mu.RLock()
+		object, ok := s.objects[info.Key]
+		s.mu.RUnlock()
+		if !ok || object.version != info.Version {
+			return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, info.Key)
+		}
+		return io.NopCloser(bytes.NewReader(object.data)), nil
+	}
+	return s, nil
+}
+
+// seed stores every file of guides under its path
+func (s *MemoryStorage) seed(guides fs.FS) error {
+	now := time.Now()
+	return fs.WalkDir(guides, ".", func(key string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(guides, key)
+		if err != nil {
+			return err
+		}
+		s.generation++
+		s.objects[key] = memoryObject{data: data, modTime: now, version: strconv.FormatInt(s.generation, 10)}
+		return nil
+	})
+}
+
+// Close removes the cache directory when it is a temporary one
+func (s *MemoryStorage) Close() error {
+	if !s.tempCache {
+		return nil
+	}
+	return os.RemoveAll(s.cacheDir)
+}
+
+// String describes the storage for logs
+func (s *MemoryStorage) String() string {
+	return "process memory, served from " + s.cacheDir
+}
+
+func (s *MemoryStorage) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	if err := checkObjectKey(key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	object, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (s *MemoryStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.head(ctx, key)
+}
+
+// head returns the metadata of key
+func (s *MemoryStorage) head(_ context.Context, key string) (ObjectInfo, error) {
+	if err := checkObjectKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	s.mu.RLock()
+	object, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime, Version: object.version}, nil
+}
+
+// LocalPath returns the cached copy of key, writing it when needed
+func (s *MemoryStorage) LocalPath(ctx context.Context, key string) (string, error) {
+	return s.cache.LocalPath(ctx, key)
+}
+
+// List returns the guides whose keys start with prefix; like hidden files,
+// keys with a part starting with a dot are not listed
+func (s *MemoryStorage) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	objects := make([]ObjectInfo, 0, len(s.objects))
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) && !hiddenKey(key) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime, Version: object.version})
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Put reads body whole, then replaces key's guide with it
+func (s *MemoryStorage) Put(_ context.Context, key string, body io.Reader) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.generation++
+	s.objects[key] = memoryObject{data: data, modTime: time.Now(), version: strconv.FormatInt(s.generation, 10)}
+	s.mu.Unlock()
+	s.cache.Forget(key)
+	return nil
+}
+
+func (s *MemoryStorage) Delete(_ context.Context, key string) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+	s.cache.Remove(key)
+	return nil
+}
@@ -0,0 +1,199 @@
+package userguide
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric kinds used in the exposition output
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// defaultBuckets are the histogram upper bounds in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics is the process-wide registry served on /metrics
+var metrics = NewMetrics()
+
+// Metrics is a minimal in-process registry exposed in Prometheus text format
+type Metrics struct {
+	mu         sync.Mutex
+	kinds      map[string]string
+	values     map[string]map[string]float64
+	hists      map[string]map[string]*histogram
+	collectors []func()
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics creates an empty metrics registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		kinds:  make(map[string]string),
+		values: make(map[string]map[string]float64),
+		hists:  make(map[string]map[string]*histogram),
+	}
+}
+
+// Inc increments a counter by one
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Add increments a counter by the given value
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series(name, metricCounter)[labelKey(labels)] += value
+}
+
+// Set sets a gauge to the given value
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series(name, metricGauge)[labelKey(labels)] = value
+}
+
+// Observe records a histogram sample
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.kinds[name] = metricHistogram
+	series, ok := m.hists[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.hists[name] = series
+	}
+	key := labelKey(labels)
+	h, ok := series[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(defaultBuckets))}
+		series[key] = h
+	}
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// AddCollector registers a function that updates derived series just
+// before each scrape
+func (m *Metrics) AddCollector(collect func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, collect)
+}
+
+// Value returns the current value of a counter or gauge series
+func (m *Metrics) Value(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[name][labelKey(labels)]
+}
+
+func (m *Metrics) series(name, kind string) map[string]float64 {
+	m.kinds[name] = kind
+	series, ok := m.values[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.values[name] = series
+	}
+	return series
+}
+
+// WriteTo writes all series in Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.kinds))
+	for name := range m.kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		kind := m.kinds[name]
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, kind)
+		if kind == metricHistogram {
+			for _, key := range sortedKeys(m.hists[name]) {
+				h := m.hists[name][key]
+				for i, bound := range defaultBuckets {
+					le := "le=\"" + strconv.FormatFloat(bound, 'g', -1, 64) + "\""
+					fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, joinLabels(key, le), h.counts[i])
+				}
+				fmt.Fprintf(&b, "%s_bucket{%s} %d\n", name, joinLabels(key, "le=\"+Inf\""), h.count)
+				fmt.Fprintf(&b, "%s_sum%s %g\n", name, wrapLabels(key), h.sum)
+				fmt.Fprintf(&b, "%s_count%s %d\n", name, wrapLabels(key), h.count)
+			}
+			continue
+		}
+		for _, key := range sortedKeys(m.values[name]) {
+			fmt.Fprintf(&b, "%s%s %g\n", name, wrapLabels(key), m.values[name][key])
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP exposes the registry for scraping
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	collectors := m.collectors
+	m.mu.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// labelKey renders name/value label pairs as a Prometheus label list
+func labelKey(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(key, extra string) string {
+	if key == "" {
+		return extra
+	}
+	return key + "," + extra
+}
+
+func wrapLabels(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "{" + key + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,199 @@
+package userguide
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// mmapCache maps frequently requested files into memory so concurrent
+// downloads share the page cache without per-read syscalls. When maxBytes
+// are mapped, the least recently used mappings no download is reading make
+// room for newly hot files.
+//
+// Mappings are shared with the file on disk, and reading past the end of a
+// file truncated in place kills the process with SIGBUS. Guides must only
+// ever be replaced by rename, as uploads, replication and the schedule do.
+type mmapCache struct {
+	mu        sync.Mutex
+	threshold int
+	maxBytes  int64
+	mapped    int64
+	// clock orders mappings by use for eviction
+	clock uint64
+	hits  map[string]*hitCounter
+	files map[string]*mappedFile
+}
+
+// hitCounter counts requests for a path within a one minute window
+type hitCounter struct {
+	count       int
+	windowStart time.Time
+}
+
+// mappedFile is a read-only mapping shared by concurrent downloads
+type mappedFile struct {
+	path    string
+	data    []byte
+	size    int64
+	modTime time.Time
+	refs    int
+	stale   bool
+	// used is the cache clock of the mapping's last use
+	used uint64
+}
+
+// newMmapCache creates a cache mapping files requested at least threshold
+// times per minute, keeping at most maxBytes mapped
+func newMmapCache(threshold int, maxBytes int64) *mmapCache {
+	return &mmapCache{
+		threshold: threshold,
+		maxBytes:  maxBytes,
+		hits:      make(map[string]*hitCounter),
+		files:     make(map[string]*mappedFile),
+	}
+}
+
+// Acquire returns a mapping of the file if it is hot, or nil to fall back to
+// regular serving. Callers must Release a non-nil result.
+func (c *mmapCache) Acquire(path string, info os.FileInfo) *mappedFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if mf, ok := c.files[path]; ok {
+		if mf.size == info.Size() && mf.modTime.Equal(info.ModTime()) {
+			mf.refs++
+			mf.used = c.tick()
+			metrics.Inc("userguide_mmap_requests_total", "result", "hit")
+			return mf
+		}
+		// The file changed on disk; retire the old mapping
+		c.retire(mf)
+	}
+
+	if !c.isHot(path) || info.Size() == 0 || !c.makeRoom(info.Size()) {
+		return nil
+	}
+
+	data, err := mapFile(path, info.Size())
+	if err != nil {
+		log.Printf("Unable to memory-map %s: %s", path, err.Error())
+		return nil
+	}
+
+	mf := &mappedFile{path: path, data: data, size: info.Size(), modTime: info.ModTime(), refs: 1, used: c.tick()}
+	c.files[path] = mf
+	c.mapped += mf.size
+	metrics.Set("userguide_mmap_mapped_bytes", float64(c.mapped))
+	metrics.Inc("userguide_mmap_requests_total", "result", "mapped")
+	return mf
+}
+
+// Prime maps a file ahead of demand so its first requests are served from
+// memory; it reports whether the file is now mapped
+func (c *mmapCache) Prime(path string, info os.FileInfo) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.files[path]; ok {
+		return true
+	}
+	if info.Size() == 0 || !c.makeRoom(info.Size()) {
+		return false
+	}
+	data, err := mapFile(path, info.Size())
+	if err != nil {
+		log.Printf("Unable to memory-map %s: %s", path, err.Error())
+		return false
+	}
+	c.files[path] = &mappedFile{path: path, data: data, size: info.Size(), modTime: info.ModTime(), used: c.tick()}
+	c.mapped += info.Size()
+	metrics.Set("userguide_mmap_mapped_bytes", float64(c.mapped))
+	return true
+}
+
+// Release drops a reference taken by Acquire
+func (c *mmapCache) Release(mf *mappedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mf.refs--
+	if mf.stale && mf.refs == 0 {
+		c.unmap(mf)
+	}
+}
+
+// isHot records a request for path and reports whether it crossed the threshold
+func (c *mmapCache) isHot(path string) bool {
+	now := time.Now()
+	h, ok := c.hits[path]
+	if !ok || now.Sub(h.windowStart) > time.Minute {
+		h = &hitCounter{windowStart: now}
+		c.hits[path] = h
+	}
+	h.count++
+	return h.count >= c.threshold
+}
+
+// tick advances the cache clock; callers must hold the lock
+func (c *mmapCache) tick() uint64 {
+	c.clock++
+	return c.clock
+}
+
+// makeRoom evicts unused mappings, least recently used first, until size
+// more bytes fit, and reports whether they do; callers must hold the lock
+func (c *mmapCache) makeRoom(size int64) bool {
+	if size > c.maxBytes {
+		return false
+	}
+	for c.mapped+size > c.maxBytes {
+		var victim *mappedFile
+		for _, mf := range c.files {
+			if mf.refs == 0 && (victim == nil || mf.used < victim.used) {
+				victim = mf
+			}
+		}
+		if victim == nil {
+			// Everything mapped is being read
+			return false
+		}
+		c.retire(victim)
+		metrics.Inc("userguide_mmap_evictions_total")
+	}
+	return true
+}
+
+// retire removes a mapping from the cache, unmapping it once unused
+func (c *mmapCache) retire(mf *mappedFile) {
+	delete(c.files, mf.path)
+	mf.stale = true
+	if mf.refs == 0 {
+		c.unmap(mf)
+	}
+}
+
+func (c *mmapCache) unmap(mf *mappedFile) {
+	if err := unmapFile(mf.data); err != nil {
+		log.Printf("Unable to unmap %s: %s", mf.path, err.Error())
+	}
+	c.mapped -= mf.size
+	metrics.Set("userguide_mmap_mapped_bytes", float64(c.mapped))
+}
+
+// Invalidate retires the mappings of files matching match; downloads still
+// reading a mapping keep it until they release it
+func (c *mmapCache) Invalidate(match func(path string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	retired := 0
+	for p, mf := range c.files {
+		if match(p) {
+			c.retire(mf)
+			delete(c.hits, p)
+			retired++
+		}
+	}
+	return retired
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package userguide
+
+import "errors"
+
+// mapFile is not supported on this platform; files are served normally
+func mapFile(path string, size int64) ([]byte, error) {
+	return nil, errors.New("memory mapping not supported on this platform")
+}
+
+// unmapFile is a no-op on platforms without memory mapping
+func unmapFile(data []byte) error {
+	return nil
+}
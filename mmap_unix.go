@@ -0,0 +1,24 @@
+//go:build unix
+
+package userguide
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of path read-only into memory
+func mapFile(path string, size int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile releases a mapping created by mapFile
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,119 @@
+package userguide
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Client certificate modes for server.tls.client.auth
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// ClientCertificate describes the verified certificate a client presented,
+// so downloads can be attributed to a device or partner
+type ClientCertificate struct {
+	CommonName   string   `json:"common_name"`
+	Organization []string `json:"organization,omitempty"`
+	DNSNames     []string `json:"dns_names,omitempty"`
+	Emails       []string `json:"emails,omitempty"`
+	URIs         []string `json:"uris,omitempty"`
+	Serial       string   `json:"serial"`
+	// SHA-256 of the DER certificate, hex encoded
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Name identifies the certificate holder: the common name, or the first
+// subject alternative name when the certificate has none
+func (cc *ClientCertificate) Name() string {
+	for _, names := range [][]string{{cc.CommonName}, cc.DNSNames, cc.URIs, cc.Emails} {
+		if len(names) > 0 && names[0] != "" {
+			return names[0]
+		}
+	}
+	return cc.Fingerprint[:16]
+}
+
+type clientCertContextKey struct{}
+
+// ClientCertFromContext returns the verified client certificate of the
+// request, or nil when none was presented
+func ClientCertFromContext(ctx context.Context) *ClientCertificate {
+	cert, _ := ctx.Value(clientCertContextKey{}).(*ClientCertificate)
+	return cert
+}
+
+// newServerTLSConfig builds the listener's TLS configuration from
+// server.tls.*; it returns nil when no certificate is configured. With a
+// client CA, clients must present a certificate it signed (or may, in
+// optional mode).
+func newServerTLSConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		if config.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("server.tls.client.ca.file requires server.tls.cert.file and server.tls.key.file")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.TLSClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(config.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", config.TLSClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	switch config.TLSClientAuth {
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("server.tls.client.auth must be %s or %s", ClientAuthRequire, ClientAuthOptional)
+	}
+	return tlsConfig, nil
+}
+
+// clientCertMiddleware exposes the verified client certificate of each
+// request through ClientCertFromContext
+func clientCertMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		leaf := r.TLS.VerifiedChains[0][0]
+		sum := sha256.Sum256(leaf.Raw)
+		cert := &ClientCertificate{
+			CommonName:   leaf.Subject.CommonName,
+			Organization: leaf.Subject.Organization,
+			DNSNames:     leaf.DNSNames,
+			Emails:       leaf.EmailAddresses,
+			Serial:       leaf.SerialNumber.Text(16),
+			Fingerprint:  hex.EncodeToString(sum[:]),
+		}
+		for _, uri := range leaf.URIs {
+			cert.URIs = append(cert.URIs, uri.String())
+		}
+		next.ServeHTTP(w, withIdentity(r.WithContext(context.WithValue(r.Context(), clientCertContextKey{}, cert))))
+	})
+}
@@ -0,0 +1,498 @@
+package userguide
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mysqlConn is a minimal MySQL client: protocol 4.1 logins with
+// mysql_native_password or caching_sha2_password, optional TLS, and text
+// protocol queries. Query arguments are interpolated client side.
+type mysqlConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    byte
+	// noBackslashEscapes is the NO_BACKSLASH_ESCAPES SQL mode of the server
+	noBackslashEscapes bool
+}
+
+// mysqlError is an ERR packet of the server; the connection stays usable
+type mysqlError struct {
+	code    uint16
+	message string
+}
+
+func (e *mysqlError) Error() string { return fmt.Sprintf("mysql: %s (%d)", e.message, e.code) }
+
+// Capability flags of the client
+const (
+	mysqlClientLongPassword   = 0x1
+	mysqlClientConnectWithDB  = 0x8
+	mysqlClientProtocol41     = 0x200
+	mysqlClientSSL            = 0x800
+	mysqlClientTransactions   = 0x2000
+	mysqlClientSecureConn     = 0x8000
+	mysqlClientMultiResults   = 0x20000
+	mysqlClientPluginAuth     = 0x80000
+	mysqlClientLenencAuthData = 0x200000
+
+	mysqlMaxPacket         = 1<<24 - 1
+	mysqlStatusNoBackslash = 0x200
+	mysqlCharsetUTF8MB4    = 45
+)
+
+// dialMySQL logs in to the database of target over conn
+func dialMySQL(conn net.Conn, target *sqlTarget) (*mysqlConn, error) {
+	c := &mysqlConn{conn: conn, reader: bufio.NewReaderSize(conn, 64*1024)}
+	greeting, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(greeting) > 0 && greeting[0] == 0xff {
+		return nil, mysqlErrorPacket(greeting)
+	}
+	if len(greeting) < 1 || greeting[0] != 10 {
+		return nil, errors.New("mysql: unsupported protocol version")
+	}
+	end := bytes.IndexByte(greeting[1:], 0)
+	if end < 0 || len(greeting) < 1+end+1+4+8+1+2 {
+		return nil, errors.New("mysql: invalid handshake")
+	}
+	rest := greeting[1+end+1+4:]
+	scramble := append([]byte(nil), rest[:8]...)
+	capabilities := uint32(binary.LittleEndian.Uint16(rest[9:]))
+	rest = rest[11:]
+	plugin := "mysql_native_password"
+	if len(rest) >= 16 {
+		status := binary.LittleEndian.Uint16(rest[1:])
+		c.noBackslashEscapes = status&mysqlStatusNoBackslash != 0
+		capabilities |= uint32(binary.LittleEndian.Uint16(rest[3:])) << 16
+		dataLength := int(rest[5])
+		rest = rest[16:]
+		if capabilities&mysqlClientSecureConn != 0 {
+			n := max(13, dataLength-8)
+			if len(rest) < n {
+				return nil, errors.New("mysql: invalid handshake")
+			}
+			scramble = append(scramble, bytes.TrimRight(rest[:n], "\x00")...)
+			rest = rest[n:]
+		}
+		if capabilities&mysqlClientPluginAuth != 0 {
+			if end := bytes.IndexByte(rest, 0); end >= 0 {
+				plugin = string(rest[:end])
+			} else {
+				plugin = string(rest)
+			}
+		}
+	}
+	if capabilities&mysqlClientProtocol41 == 0 || capabilities&mysqlClientSecureConn == 0 {
+		return nil, errors.New("mysql: server too old")
+	}
+
+	flags := uint32(mysqlClientLongPassword | mysqlClientProtocol41 | mysqlClientTransactions |
+		mysqlClientSecureConn | mysqlClientMultiResults | mysqlClientPluginAuth | mysqlClientLenencAuthData)
+	if target.database != "" {
+		flags |= mysqlClientConnectWithDB
+	}
+	secure := false
+	if target.tls != DBTLSOff {
+		switch {
+		case capabilities&mysqlClientSSL != 0:
+			flags |= mysqlClientSSL
+			if err := c.writePacket(mysqlHandshakeHeader(flags)); err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, target.tlsConfig())
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+			c.conn, c.reader = tlsConn, bufio.NewReaderSize(tlsConn, 64*1024)
+			secure = true
+		case target.tls != DBTLSPrefer:
+			return nil, errors.New("mysql: server does not support TLS")
+		}
+	}
+
+	auth, err := mysqlScramble(plugin, scramble, target.password)
+	if err != nil {
+		return nil, err
+	}
+	response := mysqlHandshakeHeader(flags)
+	response = append(append(response, target.user...), 0)
+	response = mysqlAppendLength(response, uint64(len(auth)))
+	response = append(response, auth...)
+	if target.database != "" {
+		response = append(append(response, target.database...), 0)
+	}
+	response = append(append(response, plugin...), 0)
+	if err := c.writePacket(response); err != nil {
+		return nil, err
+	}
+	if err := c.authenticate(plugin, scramble, target.password, secure); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// authenticate answers the server until it accepts or refuses the login
+func (c *mysqlConn) authenticate(plugin string, scramble []byte, password string, secure bool) error {
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if len(packet) == 0 {
+			return errors.New("mysql: empty authentication packet")
+		}
+		switch packet[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return mysqlErrorPacket(packet)
+		case 0xfe:
+			// Switch to another authentication method
+			name, data, _ := bytes.Cut(packet[1:], []byte{0})
+			plugin, scramble = string(name), bytes.TrimRight(data, "\x00")
+			auth, err := mysqlScramble(plugin, scramble, password)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(auth); err != nil {
+				return err
+			}
+		case 0x01:
+			if plugin != "caching_sha2_password" || len(packet) < 2 {
+				return fmt.Errorf("mysql: unexpected authentication data for %s", plugin)
+			}
+			switch {
+			case packet[1] == 3:
+				// Fast authentication succeeded; the OK packet follows
+			case packet[1] == 4 && secure:
+				err = c.writePacket(append([]byte(password), 0))
+			case packet[1] == 4:
+				// Full authentication without TLS encrypts the password
+				// with the RSA key of the server
+				err = c.writePacket([]byte{2})
+			default:
+				var encrypted []byte
+				if encrypted, err = mysqlEncryptPassword(packet[1:], scramble, password); err == nil {
+					err = c.writePacket(encrypted)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("mysql: unexpected packet 0x%02x during login", packet[0])
+		}
+	}
+}
+
+// query interpolates args for the $1, $2... placeholders of query and
+// runs it. Arguments are strings, int64 or []byte.
+func (c *mysqlConn) query(query string, args ...any) ([][][]byte, int64, error) {
+	statement, err := c.interpolate(query, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.seq = 0
+	if err := c.writePacket(append([]byte{0x03}, statement...)); err != nil {
+		return nil, 0, err
+	}
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case len(packet) == 0:
+		return nil, 0, errors.New("mysql: empty response")
+	case packet[0] == 0xff:
+		return nil, 0, mysqlErrorPacket(packet)
+	case packet[0] == 0x00:
+		affected, _ := mysqlReadLength(packet[1:])
+		return nil, int64(affected), nil
+	}
+	columns, _ := mysqlReadLength(packet)
+	// Column definitions, then an EOF packet
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+		if mysqlEOF(packet) {
+			break
+		}
+	}
+	var rows [][][]byte
+	for {
+		packet, err := c.readPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+		if mysqlEOF(packet) {
+			return rows, int64(len(rows)), nil
+		}
+		if len(packet) > 0 && packet[0] == 0xff {
+			return nil, 0, mysqlErrorPacket(packet)
+		}
+		row := make([][]byte, 0, columns)
+		for len(packet) > 0 {
+			if packet[0] == 0xfb {
+				row = append(row, nil)
+				packet = packet[1:]
+				continue
+			}
+			length, n := mysqlReadLength(packet)
+			if n == 0 || uint64(len(packet)-n) < length {
+				return nil, 0, errors.New("mysql: invalid row")
+			}
+			row = append(row, packet[n:n+int(length)])
+			packet = packet[n+int(length):]
+		}
+		rows = append(rows, row)
+	}
+}
+
+// interpolate replaces the $n placeholders of query by SQL literals
+func (c *mysqlConn) interpolate(query string, args []any) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(query); i++ {
+		if query[i] != '$' {
+			out = append(out, query[i])
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		n, err := strconv.Atoi(query[i+1 : j])
+		if err != nil || n < 1 || n > len(args) {
+			return nil, fmt.Errorf("mysql: invalid placeholder in %q", query)
+		}
+		switch v := args[n-1].(type) {
+		case string:
+			out = c.appendString(out, v)
+		case int64:
+			out = strconv.AppendInt(out, v, 10)
+		case int:
+			out = strconv.AppendInt(out, int64(v), 10)
+		case []byte:
+			out = append(out, "X'"...)
+			out = hex.AppendEncode(out, v)
+			out = append(out, '\'')
+		default:
+			return nil, fmt.Errorf("mysql: unsupported argument type %T", v)
+		}
+		i = j - 1
+	}
+	return out, nil
+}
+
+// appendString appends s as a quoted string literal
+func (c *mysqlConn) appendString(out []byte, s string) []byte {
+	out = append(out, '\'')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '\'':
+			out = append(out, '\'', '\'')
+		case c.noBackslashEscapes:
+			out = append(out, ch)
+		case ch == '\\':
+			out = append(out, '\\', '\\')
+		case ch == 0:
+			out = append(out, '\\', '0')
+		case ch == '\n':
+			out = append(out, '\\', 'n')
+		case ch == '\r':
+			out = append(out, '\\', 'r')
+		case ch == 0x1a:
+			out = append(out, '\\', 'Z')
+		default:
+			out = append(out, ch)
+		}
+	}
+	return append(out, '\'')
+}
+
+func (c *mysqlConn) setDeadline(t time.Time) { c.conn.SetDeadline(t) }
+func (c *mysqlConn) Close() error {
+	c.seq = 0
+	c.writePacket([]byte{0x01})
+	return c.conn.Close()
+}
+
+// readPacket reads one packet, joining those split at 16 MiB
+func (c *mysqlConn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		c.seq = header[3] + 1
+		part := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, part); err != nil {
+			return nil, err
+		}
+		payload = append(payload, part...)
+		if length < mysqlMaxPacket {
+			return payload, nil
+		}
+	}
+}
+
+// writePacket writes payload, split into packets of at most 16 MiB
+func (c *mysqlConn) writePacket(payload []byte) error {
+	for {
+		n := min(len(payload), mysqlMaxPacket)
+		header := []byte{byte(n), byte(n >> 8), byte(n >> 16), c.seq}
+		c.seq++
+		if _, err := c.conn.Write(append(header, payload[:n]...)); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if n < mysqlMaxPacket {
+			return nil
+		}
+	}
+}
+
+// mysqlHandshakeHeader starts a handshake response or SSL request
+func mysqlHandshakeHeader(flags uint32) []byte {
+	header := binary.LittleEndian.AppendUint32(nil, flags)
+	header = binary.LittleEndian.AppendUint32(header, mysqlMaxPacket)
+	header = append(header, mysqlCharsetUTF8MB4)
+	return append(header, make([]byte, 23)...)
+}
+
+// mysqlScramble answers the challenge of an authentication method
+func mysqlScramble(plugin string, scramble []byte, password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	switch plugin {
+	case "mysql_native_password":
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		stage1 := sha1.Sum([]byte(password))
+		stage2 := sha1.Sum(stage1[:])
+		hash := sha1.New()
+		hash.Write(scramble[:min(len(scramble), 20)])
+		hash.Write(stage2[:])
+		mask := hash.Sum(nil)
+		for i := range mask {
+			mask[i] ^= stage1[i]
+		}
+		return mask, nil
+	case "caching_sha2_password":
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		stage1 := sha256.Sum256([]byte(password))
+		stage2 := sha256.Sum256(stage1[:])
+		hash := sha256.New()
+		hash.Write(stage2[:])
+		hash.Write(scramble[:min(len(scramble), 20)])
+		mask := hash.Sum(nil)
+		for i := range mask {
+			mask[i] ^= stage1[i]
+		}
+		return mask, nil
+	}
+	return nil, fmt.Errorf("mysql: unsupported authentication method %s", plugin)
+}
+
+// mysqlEncryptPassword encrypts the password for full caching_sha2_password
+// authentication with the public key the server sent
+func mysqlEncryptPassword(keyPEM, scramble []byte, password string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("mysql: invalid server public key")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: invalid server public key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok || len(scramble) == 0 {
+		return nil, errors.New("mysql: server public key is not an RSA key")
+	}
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, key, plain, nil)
+}
+
+// mysqlReadLength decodes a length-encoded integer, returning its size
+// in bytes too (0 when invalid)
+func mysqlReadLength(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xfc:
+		if len(b) >= 3 {
+			return uint64(binary.LittleEndian.Uint16(b[1:])), 3
+		}
+	case 0xfd:
+		if len(b) >= 4 {
+			return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4
+		}
+	case 0xfe:
+		if len(b) >= 9 {
+			return binary.LittleEndian.Uint64(b[1:]), 9
+		}
+	default:
+		if b[0] < 0xfb {
+			return uint64(b[0]), 1
+		}
+	}
+	return 0, 0
+}
+
+// mysqlAppendLength appends n as a length-encoded integer
+func mysqlAppendLength(b []byte, n uint64) []byte {
+	switch {
+	case n < 0xfb:
+		return append(b, byte(n))
+	case n < 1<<16:
+		return binary.LittleEndian.AppendUint16(append(b, 0xfc), uint16(n))
+	case n < 1<<24:
+		return append(b, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return binary.LittleEndian.AppendUint64(append(b, 0xfe), n)
+}
+
+// mysqlEOF reports an EOF packet, which ends column definitions and rows
+func mysqlEOF(packet []byte) bool {
+	return len(packet) > 0 && packet[0] == 0xfe && len(packet) < 9
+}
+
+// mysqlErrorPacket reads the code and message of an ERR packet
+func mysqlErrorPacket(packet []byte) error {
+	e := &mysqlError{message: "unknown error"}
+	if len(packet) >= 3 {
+		e.code = binary.LittleEndian.Uint16(packet[1:])
+		message := string(packet[3:])
+		if strings.HasPrefix(message, "#") && len(message) >= 6 {
+			message = message[6:]
+		}
+		e.message = message
+	}
+	return e
+}
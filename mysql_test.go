@@ -0,0 +1,497 @@
+package userguide
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mysqlTestServer plays the server side of a recorded MySQL exchange
+type mysqlTestServer struct {
+	t    *testing.T
+	conn net.Conn
+	seq  byte
+}
+
+// startMySQL runs script as the server of a pipe and returns the client end
+func startMySQL(t *testing.T, script func(s *mysqlTestServer)) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		script(&mysqlTestServer{t: t, conn: server})
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// send writes one packet with the next sequence number
+func (s *mysqlTestServer) send(payload []byte) {
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), s.seq}
+	s.seq++
+	s.write(append(header, payload...))
+}
+
+// write sends raw bytes. A client that gave up on the exchange has closed
+// its end, which is not an error.
+func (s *mysqlTestServer) write(data []byte) {
+	if _, err := s.conn.Write(data); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		s.t.Errorf("write: %v", err)
+	}
+}
+
+// receive reads the next client packet
+func (s *mysqlTestServer) receive() []byte {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		s.t.Errorf("read packet: %v", err)
+		return nil
+	}
+	if header[3] != s.seq {
+		s.t.Errorf("client sequence = %d, want %d", header[3], s.seq)
+	}
+	s.seq = header[3] + 1
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		s.t.Errorf("read packet: %v", err)
+	}
+	return payload
+}
+
+// mysqlScrambleData is the 20 byte challenge of the test greetings
+var mysqlScrambleData = []byte("Wq(3@Ax+>vK%:T;b8sP!")
+
+// mysqlGreeting builds a protocol 10 greeting of MySQL 8.0 offering plugin
+func mysqlGreeting(plugin string, status uint16) []byte {
+	capabilities := uint32(0xdfffffff) &^ mysqlClientSSL
+	greeting := append([]byte{10}, "8.0.36\x00"...)
+	greeting = binary.LittleEndian.AppendUint32(greeting, 42)
+	greeting = append(greeting, mysqlScrambleData[:8]...)
+	greeting = append(greeting, 0)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(capabilities))
+	greeting = append(greeting, 255)
+	greeting = binary.LittleEndian.AppendUint16(greeting, status)
+	greeting = binary.LittleEndian.AppendUint16(greeting, uint16(capabilities>>16))
+	greeting = append(greeting, 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(append(greeting, mysqlScrambleData[8:]...), 0)
+	return append(append(greeting, plugin...), 0)
+}
+
+// mysqlOK is an OK packet for affected rows
+func mysqlOK(affected uint64) []byte {
+	return append(mysqlAppendLength([]byte{0}, affected), 0, 0x02, 0, 0, 0)
+}
+
+// mysqlAccessDenied is the ERR packet MySQL 8.0 sends for a wrong password
+var mysqlAccessDenied = append([]byte{0xff, 0x15, 0x04}, "#28000Access denied for user 'guides'@'10.0.0.5' (using password: YES)"...)
+
+// handshakeResponse splits a HandshakeResponse41 into the user, the auth
+// response and the plugin
+func (s *mysqlTestServer) handshakeResponse() (user string, auth []byte, database, plugin string) {
+	packet := s.receive()
+	if len(packet) < 32 {
+		s.t.Errorf("handshake response of %d bytes", len(packet))
+		return
+	}
+	flags := binary.LittleEndian.Uint32(packet)
+	rest := packet[32:]
+	name, rest, _ := bytes.Cut(rest, []byte{0})
+	length, n := mysqlReadLength(rest)
+	auth, rest = rest[n:n+int(length)], rest[n+int(length):]
+	if flags&mysqlClientConnectWithDB != 0 {
+		var db []byte
+		db, rest, _ = bytes.Cut(rest, []byte{0})
+		database = string(db)
+	}
+	return string(name), auth, database, strings.TrimRight(string(rest), "\x00")
+}
+
+// checkNativePassword verifies a mysql_native_password response as the
+// server does, from the stored SHA1(SHA1(password))
+func checkNativePassword(auth, scramble []byte, password string) bool {
+	stage1 := sha1.Sum([]byte(password))
+	stored := sha1.Sum(stage1[:])
+	hash := sha1.New()
+	hash.Write(scramble)
+	hash.Write(stored[:])
+	mask := hash.Sum(nil)
+	if len(auth) != len(mask) {
+		return false
+	}
+	for i := range mask {
+		mask[i] ^= auth[i]
+	}
+	return sha1.Sum(mask) == stored
+}
+
+// checkCachingSHA2 verifies a caching_sha2_password fast authentication
+// response from the cached SHA256(SHA256(password))
+func checkCachingSHA2(auth, scramble []byte, password string) bool {
+	stage1 := sha256.Sum256([]byte(password))
+	stored := sha256.Sum256(stage1[:])
+	hash := sha256.New()
+	hash.Write(stored[:])
+	hash.Write(scramble)
+	mask := hash.Sum(nil)
+	if len(auth) != len(mask) {
+		return false
+	}
+	for i := range mask {
+		mask[i] ^= auth[i]
+	}
+	return sha256.Sum256(mask) == stored
+}
+
+func mysqlTestTarget() *sqlTarget {
+	return &sqlTarget{driver: "mysql", address: "db:3306", user: "guides", password: "s3cret", database: "docs", tls: DBTLSOff}
+}
+
+func TestMySQLNativePasswordLogin(t *testing.T) {
+	conn := startMySQL(t, func(s *mysqlTestServer) {
+		s.send(mysqlGreeting("mysql_native_password", 0x0002))
+		user, auth, database, plugin := s.handshakeResponse()
+		if user != "guides" || database != "docs" || plugin != "mysql_native_password" {
+			s.t.Errorf("handshake response: user %q, database %q, plugin %q", user, database, plugin)
+		}
+		if !checkNativePassword(auth, mysqlScrambleData, "s3cret") {
+			s.t.Errorf("wrong mysql_native_password response")
+		}
+		s.send(mysqlOK(0))
+	})
+	if _, err := dialMySQL(conn, mysqlTestTarget()); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+}
+
+func TestMySQLCachingSHA2FastLogin(t *testing.T) {
+	conn := startMySQL(t, func(s *mysqlTestServer) {
+		s.send(mysqlGreeting("caching_sha2_password", 0x0002))
+		_, auth, _, plugin := s.handshakeResponse()
+		if plugin != "caching_sha2_password" || !checkCachingSHA2(auth, mysqlScrambleData, "s3cret") {
+			s.t.Errorf("wrong caching_sha2_password response")
+		}
+		s.send([]byte{0x01, 3})
+		s.send(mysqlOK(0))
+	})
+	if _, err := dialMySQL(conn, mysqlTestTarget()); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+}
+
+func TestMySQLCachingSHA2FullLogin(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	conn := startMySQL(t, func(s *mysqlTestServer) {
+		s.send(mysqlGreeting("caching_sha2_password", 0x0002))
+		s.handshakeResponse()
+		// Not cached yet: without TLS the client asks for the RSA key
+		s.send([]byte{0x01, 4})
+		if request := s.receive(); !bytes.Equal(request, []byte{2}) {
+			s.t.Errorf("public key request = %v", request)
+		}
+		s.send(append([]byte{0x01}, publicKey...))
+		plain, err := rsa.DecryptOAEP(sha1.New(), nil, key, s.receive(), nil)
+		if err != nil {
+			s.t.Errorf("decrypt password: %v", err)
+			return
+		}
+		for i := range plain {
+			plain[i] ^= mysqlScrambleData[i%len(mysqlScrambleData)]
+		}
+		if string(plain) != "s3cret\x00" {
+			s.t.Errorf("password = %q", plain)
+		}
+		s.send(mysqlOK(0))
+	})
+	if _, err := dialMySQL(conn, mysqlTestTarget()); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+}
+
+func TestMySQLAuthSwitch(t *testing.T) {
+	switched := []byte("0123456789abcdefghij")
+	conn := startMySQL(t, func(s *mysqlTestServer) {
+		s.send(mysqlGreeting("caching_sha2_password", 0x0002))
+		s.handshakeResponse()
+		s.send(append(append([]byte{0xfe}, "mysql_native_password\x00"...), append(switched, 0)...))
+		if !checkNativePassword(s.receive(), switched, "s3cret") {
+			s.t.Errorf("wrong response after the switch")
+		}
+		s.send(mysqlOK(0))
+	})
+	if _, err := dialMySQL(conn, mysqlTestTarget()); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+}
+
+func TestMySQLAuthFailure(t *testing.T) {
+	conn := startMySQL(t, func(s *mysqlTestServer) {
+		s.send(mysqlGreeting("mysql_native_password", 0x0002))
+		s.handshakeResponse()
+		s.send(mysqlAccessDenied)
+	})
+	_, err := dialMySQL(conn, mysqlTestTarget())
+	var myErr *mysqlError
+	if !errors.As(err, &myErr) {
+		t.Fatalf("err = %v, want a mysqlError", err)
+	}
+	if myErr.code != 1045 || !strings.HasPrefix(myErr.message, "Access denied for user 'guides'") {
+		t.Errorf("error = %q (%d)", myErr.message, myErr.code)
+	}
+}
+
+func TestMySQLMalformedHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(s *mysqlTestServer)
+	}{
+		{"too many connections", func(s *mysqlTestServer) {
+			s.send(append([]byte{0xff, 0x10, 0x04}, "Too many connections"...))
+		}},
+		{"protocol 9", func(s *mysqlTestServer) {
+			s.send(append([]byte{9}, "3.23.58\x00"...))
+		}},
+		{"empty greeting", func(s *mysqlTestServer) {
+			s.send(nil)
+		}},
+		{"unterminated version", func(s *mysqlTestServer) {
+			s.send(append([]byte{10}, "8.0.36"...))
+		}},
+		{"truncated greeting", func(s *mysqlTestServer) {
+			s.send(mysqlGreeting("mysql_native_password", 0)[:20])
+		}},
+		{"truncated scramble", func(s *mysqlTestServer) {
+			greeting := mysqlGreeting("mysql_native_password", 0)
+			s.send(greeting[:len(greeting)-len("mysql_native_password")-10])
+		}},
+		{"truncated packet", func(s *mysqlTestServer) {
+			s.write([]byte{0x40, 0, 0, 0, 10, '8'})
+		}},
+		{"unknown plugin", func(s *mysqlTestServer) {
+			s.send(mysqlGreeting("sha256_password_v9", 0))
+		}},
+		{"unexpected login packet", func(s *mysqlTestServer) {
+			s.send(mysqlGreeting("mysql_native_password", 0))
+			s.handshakeResponse()
+			s.send([]byte{0x07})
+		}},
+		{"empty login packet", func(s *mysqlTestServer) {
+			s.send(mysqlGreeting("mysql_native_password", 0))
+			s.handshakeResponse()
+			s.send(nil)
+		}},
+		{"invalid public key", func(s *mysqlTestServer) {
+			s.send(mysqlGreeting("caching_sha2_password", 0))
+			s.handshakeResponse()
+			s.send([]byte{0x01, 4})
+			s.receive()
+			s.send(append([]byte{0x01}, "-----BEGIN PUBLIC KEY-----\nnot a key"...))
+		}},
+		{"more data for native password", func(s *mysqlTestServer) {
+			s.send(mysqlGreeting("mysql_native_password", 0))
+			s.handshakeResponse()
+			s.send([]byte{0x01, 3})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := startMySQL(t, tt.script)
+			if _, err := dialMySQL(conn, mysqlTestTarget()); err == nil {
+				t.Fatal("login succeeded")
+			}
+		})
+	}
+}
+
+// mysqlColumn is a column definition packet of name
+func mysqlColumn(name string) []byte {
+	var packet []byte
+	for _, field := range []string{"def", "docs", "guides", "guides", name, name} {
+		packet = mysqlAppendLength(packet, uint64(len(field)))
+		packet = append(packet, field...)
+	}
+	return append(packet, 0x0c, 0x2d, 0, 0, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0)
+}
+
+// mysqlEOFPacket ends column definitions and rows
+var mysqlEOFPacket = []byte{0xfe, 0, 0, 0x02, 0}
+
+// mysqlTextRow encodes a text protocol row, nil for NULL
+func mysqlTextRow(values ...[]byte) []byte {
+	var row []byte
+	for _, value := range values {
+		if value == nil {
+			row = append(row, 0xfb)
+			continue
+		}
+		row = mysqlAppendLength(row, uint64(len(value)))
+		row = append(row, value...)
+	}
+	return row
+}
+
+// loggedIn answers the login of a session that then runs queries
+func (s *mysqlTestServer) loggedIn(status uint16) {
+	s.send(mysqlGreeting("mysql_native_password", status))
+	s.handshakeResponse()
+	s.send(mysqlOK(0))
+}
+
+// command reads the next COM_QUERY and returns its statement
+func (s *mysqlTestServer) command() string {
+	s.seq = 0
+	packet := s.receive()
+	if len(packet) == 0 || packet[0] != 0x03 {
+		s.t.Errorf("command = %q, want COM_QUERY", packet)
+		return ""
+	}
+	return string(packet[1:])
+}
+
+func TestMySQLQuery(t *testing.T) {
+	conn := startMySQL(t, func(s *mysqlTestServer) {
+		s.loggedIn(0x0002)
+
+		if statement := s.command(); statement != "SELECT size, etag FROM guides WHERE name = 'o''brien''s guide.pdf' AND version = 7" {
+			s.t.Errorf("statement = %q", statement)
+		}
+		s.send([]byte{2})
+		s.send(mysqlColumn("size"))
+		s.send(mysqlColumn("etag"))
+		s.send(mysqlEOFPacket)
+		s.send(mysqlTextRow([]byte("1048576"), []byte("a1b2")))
+		s.send(mysqlTextRow([]byte("0"), nil))
+		s.send(mysqlEOFPacket)
+
+		if statement := s.command(); statement != "INSERT INTO chunks VALUES (X'00ff10')" {
+			s.t.Errorf("statement = %q", statement)
+		}
+		s.send(mysqlOK(1))
+
+		s.command()
+		s.send(append([]byte{0xff, 0x7a, 0x04}, "#42S02Table 'docs.missing' doesn't exist"...))
+
+		// A row claiming more bytes than it holds
+		s.command()
+		s.send([]byte{1})
+		s.send(mysqlColumn("size"))
+		s.send(mysqlEOFPacket)
+		s.send([]byte{9, '1', '2'})
+	})
+
+	c, err := dialMySQL(conn, mysqlTestTarget())
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	rows, affected, err := c.query("SELECT size, etag FROM guides WHERE name = $1 AND version = $2", `o'brien's guide.pdf`, int64(7))
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if affected != 2 || len(rows) != 2 {
+		t.Fatalf("rows = %q, affected = %d", rows, affected)
+	}
+	if string(rows[0][0]) != "1048576" || string(rows[0][1]) != "a1b2" {
+		t.Errorf("first row = %q", rows[0])
+	}
+	if string(rows[1][0]) != "0" || rows[1][1] != nil {
+		t.Errorf("second row = %q, want a NULL etag", rows[1])
+	}
+
+	if _, affected, err = c.query("INSERT INTO chunks VALUES ($1)", []byte{0, 0xff, 0x10}); err != nil || affected != 1 {
+		t.Errorf("insert: affected = %d, err = %v", affected, err)
+	}
+
+	_, _, err = c.query("SELECT 1 FROM missing")
+	var myErr *mysqlError
+	if !errors.As(err, &myErr) || myErr.code != 1146 || myErr.message != "Table 'docs.missing' doesn't exist" {
+		t.Errorf("err = %v, want 1146", err)
+	}
+
+	if _, _, err = c.query("SELECT size FROM guides"); err == nil || !strings.Contains(err.Error(), "invalid row") {
+		t.Errorf("err = %v, want an invalid row", err)
+	}
+}
+
+func TestMySQLInterpolate(t *testing.T) {
+	tests := []struct {
+		name        string
+		noBackslash bool
+		query       string
+		args        []any
+		want        string
+		wantErr     bool
+	}{
+		{"quotes and escapes", false, "$1", []any{"a'b\\c\x00d\ne\rf\x1a"}, `'a''b\\c\0d\ne\rf\Z'`, false},
+		{"no backslash escapes", true, "$1", []any{`a'b\c`}, `'a''b\c'`, false},
+		{"integers", false, "$1, $2", []any{int64(-3), 12}, "-3, 12", false},
+		{"bytes", false, "$1", []any{[]byte("\x00'")}, "X'0027'", false},
+		{"tenth placeholder", false, "$10", []any{1, 2, 3, 4, 5, 6, 7, 8, 9, "ten"}, "'ten'", false},
+		{"placeholder past the arguments", false, "$2", []any{"a"}, "", true},
+		{"bare dollar", false, "$", []any{"a"}, "", true},
+		{"unsupported type", false, "$1", []any{1.5}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &mysqlConn{noBackslashEscapes: tt.noBackslash}
+			got, err := c.interpolate(tt.query, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("interpolate = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMySQLNoBackslashEscapesFromGreeting(t *testing.T) {
+	conn := startMySQL(t, func(s *mysqlTestServer) {
+		s.loggedIn(0x0002 | mysqlStatusNoBackslash)
+	})
+	c, err := dialMySQL(conn, mysqlTestTarget())
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !c.noBackslashEscapes {
+		t.Error("NO_BACKSLASH_ESCAPES of the server status ignored")
+	}
+}
+
+func TestMySQLLengthEncoding(t *testing.T) {
+	for _, n := range []uint64{0, 250, 251, 1<<16 - 1, 1 << 16, 1<<24 - 1, 1 << 24, 1 << 40} {
+		encoded := mysqlAppendLength(nil, n)
+		got, size := mysqlReadLength(encoded)
+		if got != n || size != len(encoded) {
+			t.Errorf("%d: decoded %d from %d of %d bytes", n, got, size, len(encoded))
+		}
+	}
+	for _, invalid := range [][]byte{nil, {0xfb}, {0xff}, {0xfc, 1}, {0xfd, 1, 2}, {0xfe, 1, 2, 3}} {
+		if _, size := mysqlReadLength(invalid); size != 0 {
+			t.Errorf("% x: decoded as %d bytes", invalid, size)
+		}
+	}
+}
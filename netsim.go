@@ -0,0 +1,96 @@
+package userguide
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NetsimParam is the query parameter selecting a network profile per
+// request, e.g. ?netsim=slow-3g, or off to skip netsim.default
+const NetsimParam = "netsim"
+
+// NetworkProfile describes the field conditions a simulated network has:
+// the throughput of response bodies in bytes per second (0 is unlimited),
+// and the delay before a response, latency plus up to jitter more
+type NetworkProfile struct {
+	BandwidthBytes int64
+	Latency        time.Duration
+	Jitter         time.Duration
+}
+
+// defaultNetworkProfiles returns the built-in profiles, close to the
+// throttling presets of browser developer tools
+func defaultNetworkProfiles() map[string]*NetworkProfile {
+	return map[string]*NetworkProfile{
+		"2g":        {BandwidthBytes: 32 * 1024, Latency: 650 * time.Millisecond, Jitter: 300 * time.Millisecond},
+		"slow-3g":   {BandwidthBytes: 50 * 1024, Latency: 400 * time.Millisecond, Jitter: 200 * time.Millisecond},
+		"fast-3g":   {BandwidthBytes: 180 * 1024, Latency: 150 * time.Millisecond, Jitter: 75 * time.Millisecond},
+		"4g":        {BandwidthBytes: 1200 * 1024, Latency: 60 * time.Millisecond, Jitter: 30 * time.Millisecond},
+		"satellite": {BandwidthBytes: 250 * 1024, Latency: 700 * time.Millisecond, Jitter: 100 * time.Millisecond},
+	}
+}
+
+// NetworkSimulator slows responses down to a network profile, so client
+// teams can try their download UX against field conditions on this
+// server. It applies netsim.default to every response, or the profile a
+// request names with ?netsim=. It is a development aid and only runs with
+// netsim.enabled.
+type NetworkSimulator struct {
+	profiles map[string]*NetworkProfile
+	fallback string
+}
+
+// NewNetworkSimulator creates the simulator; it returns nil unless
+// netsim.enabled is set
+func NewNetworkSimulator(config *Config) *NetworkSimulator {
+	if !config.NetsimEnabled {
+		return nil
+	}
+	return &NetworkSimulator{profiles: config.NetworkProfiles, fallback: config.NetsimDefault}
+}
+
+// Profiles lists the profile names for the boot report
+func (ns *NetworkSimulator) Profiles() string {
+	names := make([]string, 0, len(ns.profiles))
+	for name := range ns.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Middleware delays the response and paces its body per the profile in
+// effect. Health and metrics endpoints are never slowed.
+func (ns *NetworkSimulator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/metrics" || r.URL.Path == "/ready" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := ns.fallback
+		if requested := r.URL.Query().Get(NetsimParam); requested != "" {
+			name = requested
+		}
+		profile, ok := ns.profiles[name]
+		if !ok {
+			// off, unknown names and no default serve at full speed
+			next.ServeHTTP(w, r)
+			return
+		}
+		metrics.Inc("userguide_netsim_requests_total", "profile", name)
+
+		if delay := profile.Latency + jitter(profile.Jitter); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if profile.BandwidthBytes > 0 {
+			w = &throttledWriter{ResponseWriter: w, bytesPerSec: profile.BandwidthBytes, start: time.Now()}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,263 @@
+package userguide
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// objectCache keeps local copies of the objects of a remote storage, which
+// the serving layer reads by path. An object is downloaded the first time
+// it is requested and again whenever its size or modification time
+// changes; downloads then get Content-Length and range support from the
+// local copy. Object metadata is re-checked at most once per ttl.
+type objectCache struct {
+	// backend names the storage in metrics; source describes it in logs
+	backend string
+	source  string
+	dir     string
+	ttl     time.Duration
+	// head reads the metadata of a key; download reads the object version
+	// head described
+	head     func(ctx context.Context, key string) (ObjectInfo, error)
+	download func(ctx context.Context, info ObjectInfo) (io.ReadCloser, error)
+
+	mu       sync.Mutex
+	stats    map[string]cachedStat
+	lastGC   time.Time
+	fetching map[string]chan struct{}
+}
+
+// cachedStat is the remembered result of a metadata lookup
+type cachedStat struct {
+	info    ObjectInfo
+	err     error
+	checked time.Time
+}
+
+// newObjectCache creates the cache directory dir of a remote storage
+func newObjectCache(backend, source, dir string, ttl time.Duration) (*objectCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create %s cache: %v", backend, err)
+	}
+	return &objectCache{
+		backend:  backend,
+		source:   source,
+		dir:      dir,
+		ttl:      ttl,
+		stats:    make(map[string]cachedStat),
+		lastGC:   time.Now(),
+		fetching: make(map[string]chan struct{}),
+	}, nil
+}
+
+// Stat returns the metadata of key, from the last lookup when it is recent.
+// Missing keys are remembered too.
+func (oc *objectCache) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if err := checkObjectKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	oc.mu.Lock()
+	cached, ok := oc.stats[key]
+	oc.mu.Unlock()
+	if ok && time.Since(cached.checked) < oc.ttl {
+		return cached.info, cached.err
+	}
+
+	info, err := oc.head(ctx, key)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return ObjectInfo{}, err
+	}
+	oc.remember(key, cachedStat{info: info, err: err, checked: time.Now()})
+	return info, err
+}
+
+// remember caches st for key, dropping entries older than the ttl now and
+// then; without a ttl nothing would be reused, so nothing is kept
+func (oc *objectCache) remember(key string, st cachedStat) {
+	if oc.ttl <= 0 {
+		return
+	}
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	oc.stats[key] = st
+	if now := time.Now(); now.Sub(oc.lastGC) >= oc.ttl {
+		for k, entry := range oc.stats {
+			if now.Sub(entry.checked) >= oc.ttl {
+				delete(oc.stats, k)
+			}
+		}
+		oc.lastGC = now
+	}
+}
+
+// Forget drops the cached metadata of key after it changed
+func (oc *objectCache) Forget(key string) {
+	oc.mu.Lock()
+	delete(oc.stats, key)
+	oc.mu.Unlock()
+}
+
+// Remove drops the metadata and the local copy of a deleted key
+func (oc *objectCache) Remove(key string) {
+	oc.Forget(key)
+	os.Remove(filepath.Join(oc.dir, filepath.FromSlash(key)))
+}
+
+// LocalPath returns the local copy of key, downloading the object first
+// when there is no copy of its current version. Concurrent requests for
+// the same key share one download. When the object changes during the
+// download, its metadata is looked up again and the download retried once.
+func (oc *objectCache) LocalPath(ctx context.Context, key string) (string, error) {
+	info, err := oc.Stat(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	local := filepath.Join(oc.dir, filepath.FromSlash(key))
+	retried := false
+	for {
+		if cachedCopy(local, info) {
+			metrics.Inc("userguide_"+oc.backend+"_cache_total", "result", "hit")
+			return local, nil
+		}
+		oc.mu.Lock()
+		wait, busy := oc.fetching[key]
+		done := make(chan struct{})
+		if !busy {
+			oc.fetching[key] = done
+		}
+		oc.mu.Unlock()
+		if busy {
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		err := oc.fetch(ctx, local, info)
+		oc.mu.Lock()
+		delete(oc.fetching, key)
+		oc.mu.Unlock()
+		close(done)
+		if err == nil {
+			metrics.Inc("userguide_"+oc.backend+"_cache_total", "result", "miss")
+			return local, nil
+		}
+		if !errors.Is(err, errObjectChanged) || retried {
+			return "", err
+		}
+		oc.Forget(key)
+		if info, err = oc.Stat(ctx, key); err != nil {
+			return "", err
+		}
+		retried = true
+	}
+}
+
+// errObjectChanged reports an object replaced while it was downloaded
+var errObjectChanged = errors.New("object changed during download")
+
+// cachedCopy reports whether local holds the object version described by info
+func cachedCopy(local string, info ObjectInfo) bool {
+	fileInfo, err := os.Stat(local)
+	return err == nil && fileInfo.Mode().IsRegular() && fileInfo.Size() == info.Size && fileInfo.ModTime().Equal(info.ModTime)
+}
+
+// fetch downloads the object of info to local, giving the file the
+// object's modification time so Last-Modified and validators match the
+// remote storage
+func (oc *objectCache) fetch(ctx context.Context, local string, info ObjectInfo) error {
+	start := time.Now()
+	body, err := oc.download(ctx, info)
+	if errors.Is(err, ErrObjectNotFound) && info.Version != "" {
+		// The version looked up is gone; the object was replaced or deleted
+		return fmt.Errorf("%w: %s", errObjectChanged, info.Key)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := os.MkdirAll(filepath.Dir(local), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(local), ".fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to download %s: %v", info.Key, err)
+	}
+	if n != info.Size {
+		return fmt.Errorf("%w: %s: got %d of %d bytes", errObjectChanged, info.Key, n, info.Size)
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime, info.ModTime); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		return err
+	}
+	metrics.Add("userguide_"+oc.backend+"_fetched_bytes_total", float64(n))
+	log.Printf("Fetched %s from %s (%d bytes) in %s", info.Key, oc.source, n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// spoolBody returns body as a reader that can be rewound, with the number
+// of bytes left in it. Files and in-memory readers are used as they are;
+// other bodies are copied to a temporary file in dir first, which cleanup
+// removes.
+func spoolBody(dir string, body io.Reader) (io.ReadSeeker, int64, func(), error) {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		if size, err := readerSize(body); err == nil {
+			return seeker, size, func() {}, nil
+		}
+	}
+	spool, err := os.CreateTemp(dir, ".put-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	size, err := io.Copy(spool, body)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return spool, size, cleanup, nil
+}
+
+// readerSize returns how many bytes are left in body, if it can tell
+func readerSize(body io.Reader) (int64, error) {
+	switch b := body.(type) {
+	case *os.File:
+		info, err := b.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, errors.New("not a regular file")
+		}
+		offset, err := b.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size() - offset, nil
+	case interface{ Len() int }:
+		return int64(b.Len()), nil
+	}
+	return 0, errors.New("unknown length")
+}
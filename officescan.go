@@ -0,0 +1,373 @@
+package userguide
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// Office scan modes
+const (
+	OfficeScanOff    = "off"
+	OfficeScanReject = "reject"
+	OfficeScanStrip  = "strip"
+)
+
+// Content types of the main part of macro-enabled documents and templates
+// and their macro-free equivalents
+var macroFreeContentTypes = map[string]string{
+	"application/vnd.ms-word.document.macroEnabled.main+xml":         "application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml",
+	"application/vnd.ms-word.template.macroEnabledTemplate.main+xml": "application/vnd.openxmlformats-officedocument.wordprocessingml.template.main+xml",
+}
+
+// officeMaxExpandedBytes caps the uncompressed size of a .docx being stripped
+const officeMaxExpandedBytes = 512 << 20
+
+// Relationship types, by suffix, that attach active content to a document
+var activeRelationshipTypes = []string{"/vbaProject", "/oleObject", "/package", "/control"}
+
+var (
+	relationshipPattern = regexp.MustCompile(`<Relationship\b[^>]*/>`)
+	overridePattern     = regexp.MustCompile(`<Override\b[^>]*/>`)
+	objectPattern       = regexp.MustCompile(`(?s)<w:object\b.*?</w:object>`)
+	attributePattern    = regexp.MustCompile(`\b(\w+)="([^"]*)"`)
+)
+
+// OfficeScanner inspects Word guides before they are published for VBA
+// macros and embedded OLE objects or ActiveX controls, which run code when
+// a reader opens the document. Depending on office.scan such guides are
+// rejected or, for .docx, published with the active content removed.
+// Legacy .doc files cannot be cleaned and are always rejected.
+type OfficeScanner struct {
+	mode string
+}
+
+// NewOfficeScanner creates the scanner for office.scan; it returns nil when
+// scanning is off
+func NewOfficeScanner(config *Config) *OfficeScanner {
+	if config.OfficeScan == OfficeScanOff {
+		return nil
+	}
+	return &OfficeScanner{mode: config.OfficeScan}
+}
+
+// Check is a StagedCheck for .doc and .docx guides. When stripping it
+// replaces the staged file with the cleaned copy.
+func (sc *OfficeScanner) Check(_ context.Context, name, filePath string) error {
+	var findings []string
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".docx":
+		findings, err = scanOOXML(filePath)
+	case ".doc":
+		findings, err = scanCompoundFile(filePath)
+	default:
+		return nil
+	}
+	if err != nil {
+		metrics.Inc("userguide_office_scan_total", "result", "unreadable")
+		return fmt.Errorf("%w: %s is not a readable Word document: %v", ErrRejectedContent, name, err)
+	}
+	if len(findings) == 0 {
+		metrics.Inc("userguide_office_scan_total", "result", "clean")
+		return nil
+	}
+
+	if sc.mode == OfficeScanStrip && strings.EqualFold(filepath.Ext(name), ".docx") {
+		if err := stripOOXML(filePath); err != nil {
+			return fmt.Errorf("unable to strip %s from %s: %v", strings.Join(findings, " and "), name, err)
+		}
+		log.Printf("Stripped %s from %s", strings.Join(findings, " and "), name)
+		metrics.Inc("userguide_office_scan_total", "result", "stripped")
+		return nil
+	}
+	metrics.Inc("userguide_office_scan_total", "result", "rejected")
+	return fmt.Errorf("%w: %s contains %s", ErrRejectedContent, name, strings.Join(findings, " and "))
+}
+
+// scanOOXML lists the kinds of active content in a .docx package
+func scanOOXML(filePath string) ([]string, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	var macros, objects bool
+	for _, file := range archive.File {
+		macros = macros || isMacroPart(file.Name)
+		objects = objects || isObjectPart(file.Name)
+	}
+	return findingsOf(macros, objects), nil
+}
+
+func findingsOf(macros, objects bool) []string {
+	var findings []string
+	if macros {
+		findings = append(findings, "macros")
+	}
+	if objects {
+		findings = append(findings, "embedded objects")
+	}
+	return findings
+}
+
+// isMacroPart reports whether a package part holds VBA code
+func isMacroPart(name string) bool {
+	base := strings.ToLower(path.Base(name))
+	return base == "vbaproject.bin" || base == "vbadata.xml" || base == "vbaproject.bin.rels"
+}
+
+// isObjectPart reports whether a package part is an OLE object or ActiveX control
+func isObjectPart(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "word/activex/") ||
+		(strings.HasPrefix(lower, "word/embeddings/") && strings.HasPrefix(path.Base(lower), "oleobject"))
+}
+
+// stripOOXML rewrites a .docx package without macros, OLE objects and
+// ActiveX controls: the parts are dropped along with the relationships,
+// content type overrides and w:object elements that refer to them. Charts
+// keep their embedded workbooks, which are not referenced from word/_rels.
+func stripOOXML(filePath string) error {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	// Parts are rewritten in memory; refuse packages that would expand
+	// beyond reason (the zip reader enforces the declared sizes)
+	var expanded uint64
+	for _, file := range archive.File {
+		expanded += file.UncompressedSize64
+	}
+	if expanded > officeMaxExpandedBytes {
+		return fmt.Errorf("document expands to %d bytes", expanded)
+	}
+	parts := make(map[string][]byte, len(archive.File))
+	for _, file := range archive.File {
+		data, err := readZipFile(file)
+		if err != nil {
+			return err
+		}
+		parts[file.Name] = data
+	}
+
+	removed := make(map[string]bool)
+	for name := range parts {
+		if isMacroPart(name) || isObjectPart(name) {
+			removed[name] = true
+		}
+	}
+	// Relationships of the document, headers and footers; their owners lose
+	// the objects pointing at them
+	for name, data := range parts {
+		if path.Dir(name) != "word/_rels" || !strings.HasSuffix(name, ".rels") {
+			continue
+		}
+		parts[name] = relationshipPattern.ReplaceAllFunc(data, func(rel []byte) []byte {
+			attrs := xmlAttributes(rel)
+			if !slices.ContainsFunc(activeRelationshipTypes, func(suffix string) bool { return strings.HasSuffix(attrs["Type"], suffix) }) {
+				return rel
+			}
+			if target := attrs["Target"]; attrs["TargetMode"] != "External" {
+				if strings.HasPrefix(target, "/") {
+					removed[strings.TrimPrefix(target, "/")] = true
+				} else {
+					removed[path.Join("word", target)] = true
+				}
+			}
+			return nil
+		})
+		owner := path.Join("word", strings.TrimSuffix(path.Base(name), ".rels"))
+		if data, ok := parts[owner]; ok && !removed[owner] {
+			parts[owner] = objectPattern.ReplaceAll(data, nil)
+		}
+	}
+
+	if types, ok := parts["[Content_Types].xml"]; ok {
+		types = overridePattern.ReplaceAllFunc(types, func(override []byte) []byte {
+			if removed[strings.TrimPrefix(xmlAttributes(override)["PartName"], "/")] {
+				return nil
+			}
+			return override
+		})
+		for macroType, plainType := range macroFreeContentTypes {
+			types = bytes.ReplaceAll(types, []byte(macroType), []byte(plainType))
+		}
+		parts["[Content_Types].xml"] = types
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".strip-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	out := zip.NewWriter(tmp)
+	for _, file := range archive.File {
+		if removed[file.Name] {
+			continue
+		}
+		header := file.FileHeader
+		w, err := out.CreateHeader(&header)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(parts[file.Name]); err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// xmlAttributes returns the attributes of a single XML element
+func xmlAttributes(element []byte) map[string]string {
+	attrs := make(map[string]string)
+	for _, match := range attributePattern.FindAllSubmatch(element, -1) {
+		attrs[string(match[1])] = string(match[2])
+	}
+	return attrs
+}
+
+// Compound File Binary layout constants used by scanCompoundFile
+var cfbSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+const (
+	cfbEndOfChain   = 0xFFFFFFFE
+	cfbHeaderDIFATs = 109
+	cfbDirEntrySize = 128
+)
+
+// scanCompoundFile lists the kinds of active content in a legacy .doc by
+// the names in its compound file directory: the Macros storage holds the
+// VBA project and the ObjectPool storage embedded OLE objects
+func scanCompoundFile(filePath string) ([]string, error) {
+	names, err := compoundFileNames(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var macros, objects bool
+	for _, name := range names {
+		switch {
+		case name == "Macros" || name == "_VBA_PROJECT_CUR" || name == "_VBA_PROJECT":
+			macros = true
+		case len(name) > 1 && name[0] == '_' && strings.Trim(name[1:], "0123456789") == "":
+			// Objects are stored as _<id> storages inside ObjectPool
+			objects = objects || slices.Contains(names, "ObjectPool")
+		}
+	}
+	return findingsOf(macros, objects), nil
+}
+
+// compoundFileNames reads the directory entry names of a compound file
+func compoundFileNames(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 512)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.Equal(header[:8], cfbSignature) {
+		return nil, fmt.Errorf("not a compound file")
+	}
+	shift := binary.LittleEndian.Uint16(header[0x1E:])
+	if shift != 9 && shift != 12 {
+		return nil, fmt.Errorf("unsupported sector size")
+	}
+	sectorSize := int64(1) << shift
+	maxSectors := uint32(info.Size() / sectorSize)
+	readSector := func(sector uint32) ([]byte, error) {
+		if sector >= maxSectors {
+			return nil, fmt.Errorf("sector %d out of range", sector)
+		}
+		buf := make([]byte, sectorSize)
+		_, err := file.ReadAt(buf, (int64(sector)+1)*sectorSize)
+		return buf, err
+	}
+
+	// The FAT sectors are listed in the header, then in a chain of DIFAT sectors
+	var fatSectors []uint32
+	for i := 0; i < cfbHeaderDIFATs; i++ {
+		fatSectors = append(fatSectors, binary.LittleEndian.Uint32(header[0x4C+4*i:]))
+	}
+	difat := binary.LittleEndian.Uint32(header[0x44:])
+	for steps := uint32(0); difat < maxSectors && steps < maxSectors; steps++ {
+		buf, err := readSector(difat)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < sectorSize/4-1; i++ {
+			fatSectors = append(fatSectors, binary.LittleEndian.Uint32(buf[4*i:]))
+		}
+		difat = binary.LittleEndian.Uint32(buf[sectorSize-4:])
+	}
+	var fat []uint32
+	for _, sector := range fatSectors[:min(len(fatSectors), int(binary.LittleEndian.Uint32(header[0x2C:])))] {
+		buf, err := readSector(sector)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < sectorSize/4; i++ {
+			fat = append(fat, binary.LittleEndian.Uint32(buf[4*i:]))
+		}
+	}
+
+	var names []string
+	sector := binary.LittleEndian.Uint32(header[0x30:])
+	for steps := uint32(0); sector != cfbEndOfChain; steps++ {
+		if steps >= maxSectors || int(sector) >= len(fat) {
+			return nil, fmt.Errorf("corrupt directory chain")
+		}
+		buf, err := readSector(sector)
+		if err != nil {
+			return nil, err
+		}
+		for offset := int64(0); offset+cfbDirEntrySize <= sectorSize; offset += cfbDirEntrySize {
+			entry := buf[offset : offset+cfbDirEntrySize]
+			length := int(binary.LittleEndian.Uint16(entry[0x40:]))
+			if entry[0x42] == 0 || length < 2 || length > 64 {
+				continue
+			}
+			units := make([]uint16, length/2-1)
+			for i := range units {
+				units[i] = binary.LittleEndian.Uint16(entry[2*i:])
+			}
+			names = append(names, string(utf16.Decode(units)))
+		}
+		sector = fat[sector]
+	}
+	return names, nil
+}
@@ -0,0 +1,445 @@
+package userguide
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Cookies of the OpenID Connect login flow
+const (
+	oidcSessionCookie = "ug_session"
+	oidcStateCookie   = "ug_oidc_state"
+)
+
+// oidcStateTTL bounds how long a user may spend at the identity provider
+const oidcStateTTL = 10 * time.Minute
+
+// oidcDiscoveryRetry spaces out discovery attempts while the identity
+// provider is unreachable
+const oidcDiscoveryRetry = 10 * time.Second
+
+type oidcContextKey struct{}
+
+// OIDCSession is the signed-in browser user carried in the session cookie
+type OIDCSession struct {
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// OIDCSessionFromContext returns the session that let the request through, if any
+func OIDCSessionFromContext(ctx context.Context) *OIDCSession {
+	session, _ := ctx.Value(oidcContextKey{}).(*OIDCSession)
+	return session
+}
+
+// oidcState is what the login round trip needs to remember, kept in a
+// signed cookie rather than on the server so any replica can finish it
+type oidcState struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ReturnTo  string `json:"return_to"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// oidcProvider is the discovered configuration of the identity provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	idTokens *JWTValidator
+	bearers  *JWTValidator
+}
+
+// OIDCClient signs browser users in with the OpenID Connect authorization
+// code flow (with PKCE) and keeps them signed in with an HMAC-signed session
+// cookie. Routes it guards also accept bearer JWTs from the same provider,
+// so API clients are unaffected.
+type OIDCClient struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	audience     string
+	scopes       []string
+	sessionTTL   time.Duration
+	secure       bool
+	secret       []byte
+	client       *http.Client
+	config       *Config
+
+	mu          sync.Mutex
+	provider    *oidcProvider
+	lastAttempt time.Time
+}
+
+// NewOIDCClient creates a client for oidc.* settings; it returns nil when no
+// issuer is configured. Without oidc.cookie.secret a random secret is used,
+// so sessions only work on the replica that issued them.
+func NewOIDCClient(config *Config) *OIDCClient {
+	if config.OIDCIssuer == "" {
+		return nil
+	}
+	secret := []byte(config.OIDCCookieSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		log.Println("Warning: oidc.cookie.secret is empty; login sessions are only valid on this replica")
+	}
+	audience := config.OIDCAudience
+	if audience == "" {
+		audience = config.OIDCClientID
+	}
+	return &OIDCClient{
+		issuer:       config.OIDCIssuer,
+		clientID:     config.OIDCClientID,
+		clientSecret: config.OIDCClientSecret,
+		redirectURL:  config.OIDCRedirectURL,
+		audience:     audience,
+		scopes:       config.OIDCScopes,
+		sessionTTL:   config.OIDCSessionTTL,
+		secure:       strings.HasPrefix(config.OIDCRedirectURL, "https://"),
+		secret:       secret,
+		client:       NewHTTPClient(config, config.OIDCTimeout),
+		config:       config,
+	}
+}
+
+// RegisterRoutes adds the login, callback and logout endpoints
+func (oc *OIDCClient) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/auth/login", oc.LoginHandler).Methods("GET")
+	r.HandleFunc("/auth/callback", oc.CallbackHandler).Methods("GET")
+	r.HandleFunc("/auth/logout", oc.LogoutHandler).Methods("POST")
+}
+
+// discover fetches the provider's configuration once, retrying at most
+// every oidcDiscoveryRetry while it fails
+func (oc *OIDCClient) discover(ctx context.Context) (*oidcProvider, error) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if oc.provider != nil {
+		return oc.provider, nil
+	}
+	if time.Since(oc.lastAttempt) < oidcDiscoveryRetry {
+		return nil, errors.New("identity provider discovery failed recently")
+	}
+	oc.lastAttempt = time.Now()
+
+	discoveryURL := strings.TrimSuffix(oc.issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, "GET", discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery endpoint returned %s", resp.Status)
+	}
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %v", err)
+	}
+	if provider.Issuer != oc.issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", provider.Issuer, oc.issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks an authorization, token or JWKS endpoint")
+	}
+	keys := NewJWKSCache(provider.JWKSURI, oc.config)
+	provider.idTokens = &JWTValidator{keys: keys, issuer: provider.Issuer, audience: oc.clientID, leeway: oc.config.JWTLeeway, rolesClaim: oc.config.RBACRolesClaim}
+	provider.bearers = &JWTValidator{keys: keys, issuer: provider.Issuer, audience: oc.audience, leeway: oc.config.JWTLeeway, rolesClaim: oc.config.RBACRolesClaim}
+	oc.provider = &provider
+	log.Printf("Discovered OpenID provider %s", provider.Issuer)
+	return oc.provider, nil
+}
+
+// LoginHandler sends the browser to the identity provider, remembering
+// where to return it in the state cookie
+func (oc *OIDCClient) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, err := oc.discover(r.Context())
+	if err != nil {
+		log.Printf("OpenID discovery failed: %s", err.Error())
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Sign-in is temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	authURL, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		http.Error(w, "Sign-in is misconfigured", http.StatusInternalServerError)
+		return
+	}
+
+	state := oidcState{
+		State:     randomURLToken(),
+		Nonce:     randomURLToken(),
+		Verifier:  randomURLToken(),
+		ReturnTo:  safeReturnTo(r.URL.Query().Get("return_to")),
+		ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    oc.seal("state", state),
+		Path:     "/auth/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   oc.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", oc.clientID)
+	query.Set("redirect_uri", oc.redirectURL)
+	query.Set("scope", strings.Join(oc.scopes, " "))
+	query.Set("state", state.State)
+	query.Set("nonce", state.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	metrics.Inc("userguide_oidc_logins_total", "result", "started")
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+}
+
+// CallbackHandler finishes the login: it checks the state, redeems the code
+// for an ID token, validates it and issues the session cookie
+func (oc *OIDCClient) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/auth/", MaxAge: -1, HttpOnly: true, Secure: oc.secure})
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		oc.loginFailed(w, r, http.StatusUnauthorized, "identity provider returned "+errCode)
+		return
+	}
+	var state oidcState
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || oc.open("state", cookie.Value, &state) != nil || time.Now().Unix() > state.ExpiresAt {
+		oc.loginFailed(w, r, http.StatusBadRequest, "login expired or was started in another browser")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		oc.loginFailed(w, r, http.StatusBadRequest, "state mismatch")
+		return
+	}
+	if query.Get("code") == "" {
+		oc.loginFailed(w, r, http.StatusBadRequest, "authorization code missing")
+		return
+	}
+
+	provider, err := oc.discover(r.Context())
+	if err != nil {
+		log.Printf("OpenID discovery failed: %s", err.Error())
+		oc.loginFailed(w, r, http.StatusServiceUnavailable, "identity provider unavailable")
+		return
+	}
+	idToken, err := oc.exchange(r.Context(), provider, query.Get("code"), state.Verifier)
+	if err != nil {
+		log.Printf("OpenID code exchange failed: %s", err.Error())
+		oc.loginFailed(w, r, http.StatusBadGateway, "authorization code could not be redeemed")
+		return
+	}
+	claims, err := provider.idTokens.Validate(r.Context(), idToken)
+	if err != nil {
+		oc.loginFailed(w, r, http.StatusUnauthorized, "ID token rejected: "+err.Error())
+		return
+	}
+	if claims.Subject == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(state.Nonce)) != 1 {
+		oc.loginFailed(w, r, http.StatusUnauthorized, "ID token nonce mismatch")
+		return
+	}
+
+	session := OIDCSession{Subject: claims.Subject, Email: claims.Email, Roles: claims.Roles, ExpiresAt: time.Now().Add(oc.sessionTTL).Unix()}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    oc.seal("session", session),
+		Path:     "/",
+		MaxAge:   int(oc.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   oc.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("Signed in %q from %s", claims.Subject, r.RemoteAddr)
+	metrics.Inc("userguide_oidc_logins_total", "result", "ok")
+	http.Redirect(w, r, state.ReturnTo, http.StatusFound)
+}
+
+// LogoutHandler clears the session cookie; the identity provider session is
+// left alone. It only answers POST, so a link or image elsewhere cannot
+// sign the user out.
+func (oc *OIDCClient) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: oc.secure})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, safeReturnTo(r.URL.Query().Get("return_to")), http.StatusSeeOther)
+}
+
+func (oc *OIDCClient) loginFailed(w http.ResponseWriter, r *http.Request, status int, reason string) {
+	log.Printf("Sign-in failed for %s: %s", r.RemoteAddr, reason)
+	metrics.Inc("userguide_oidc_logins_total", "result", "failed")
+	http.Error(w, "Sign-in failed", status)
+}
+
+// exchange redeems an authorization code at the token endpoint and returns
+// the ID token
+func (oc *OIDCClient) exchange(ctx context.Context, provider *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oc.redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(oc.clientID), url.QueryEscape(oc.clientSecret))
+
+	resp, err := oc.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// Session returns the valid session carried by the request, if any
+func (oc *OIDCClient) Session(r *http.Request) *OIDCSession {
+	cookie, err := r.Cookie(oidcSessionCookie)
+	if err != nil {
+		return nil
+	}
+	var session OIDCSession
+	if oc.open("session", cookie.Value, &session) != nil || session.Subject == "" || time.Now().Unix() > session.ExpiresAt {
+		return nil
+	}
+	return &session
+}
+
+// seal signs v as a cookie value for purpose
+func (oc *OIDCClient) seal(purpose string, v interface{}) string {
+	payload, _ := json.Marshal(v)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(oc.sign(purpose, encoded))
+}
+
+// open verifies a cookie value sealed for purpose and decodes it into v
+func (oc *OIDCClient) open(purpose, value string, v interface{}) error {
+	encoded, encodedSig, ok := strings.Cut(value, ".")
+	if !ok {
+		return errors.New("malformed cookie")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, oc.sign(purpose, encoded)) {
+		return errors.New("cookie signature mismatch")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func (oc *OIDCClient) sign(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, oc.secret)
+	mac.Write([]byte("oidc-" + purpose + "|" + payload))
+	return mac.Sum(nil)
+}
+
+// OIDCMiddleware lets through requests with a login session or a bearer JWT
+// from the identity provider. Browsers without either are sent to sign in;
+// other clients get an RFC 6750 401.
+func OIDCMiddleware(oc *OIDCClient) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if session := oc.Session(r); session != nil {
+				next.ServeHTTP(w, withIdentity(r.WithContext(context.WithValue(r.Context(), oidcContextKey{}, session))))
+				return
+			}
+			if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+				provider, err := oc.discover(r.Context())
+				if err != nil {
+					log.Printf("OpenID discovery failed: %s", err.Error())
+					w.Header().Set("Retry-After", "10")
+					writeJSON(w, http.StatusServiceUnavailable, &JWTError{Code: "temporarily_unavailable", Description: "token could not be verified"})
+					return
+				}
+				claims, err := provider.bearers.Validate(r.Context(), strings.TrimPrefix(header, "Bearer "))
+				if err != nil {
+					var jwtErr *JWTError
+					if !errors.As(err, &jwtErr) {
+						jwtErr = invalidToken("token could not be verified")
+					}
+					writeJWTError(w, r, jwtErr)
+					return
+				}
+				log.Printf("Accepted token for %q from %s", claims.Subject, r.RemoteAddr)
+				next.ServeHTTP(w, withIdentity(r.WithContext(context.WithValue(r.Context(), jwtClaimsContextKey{}, claims))))
+				return
+			}
+			if (r.Method == "GET" || r.Method == "HEAD") && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				w.Header().Set("Cache-Control", "no-store")
+				http.Redirect(w, r, "/auth/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			writeJWTError(w, r, &JWTError{Code: "invalid_request", Description: "bearer token or login session required"})
+		})
+	}
+}
+
+// safeReturnTo keeps post-login redirects on this site. Browsers drop tabs
+// and newlines from URLs, so "/\t/evil" would become "//evil".
+func safeReturnTo(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.Contains(target, "\\") {
+		return "/"
+	}
+	if strings.ContainsFunc(target, func(c rune) bool { return c < 0x20 || c == 0x7f }) {
+		return "/"
+	}
+	return target
+}
+
+// randomURLToken returns 32 random bytes, URL-safe encoded
+func randomURLToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,343 @@
+package userguide
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// oidcTestProvider is an OpenID provider that signs ID tokens with its own
+// RSA key and redeems each authorization code only with the PKCE verifier
+// of the login it was issued for
+type oidcTestProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]oidcTestLogin
+}
+
+// oidcTestLogin is what the provider remembers about an authorization code
+type oidcTestLogin struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newOIDCTestProvider(t *testing.T) *oidcTestProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	p := &oidcTestProvider{key: key, codes: make(map[string]oidcTestLogin)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/authorize",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		login, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		p.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != login.challenge {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": p.sign(t, login.claims)})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// authorize stands in for the user signing in at the provider: it issues a
+// code for the login whose redirect is location, with ID token claims
+// adjusted by edit
+func (p *oidcTestProvider) authorize(t *testing.T, location string, edit func(claims map[string]interface{})) (state, code string) {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, p.server.URL+"/authorize") {
+		t.Fatalf("login redirected to %q, not the provider", location)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("login without a PKCE S256 challenge: %s", u.RawQuery)
+	}
+	claims := map[string]interface{}{
+		"iss":   p.server.URL,
+		"aud":   query.Get("client_id"),
+		"sub":   "alice",
+		"email": "alice@example.com",
+		"nonce": query.Get("nonce"),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	code = randomURLToken()
+	p.mu.Lock()
+	p.codes[code] = oidcTestLogin{challenge: query.Get("code_challenge"), claims: claims}
+	p.mu.Unlock()
+	return query.Get("state"), code
+}
+
+// sign returns claims as an RS256 JWT
+func (p *oidcTestProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": JWTAlgRS256, "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign ID token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOIDCTestClient(t *testing.T, provider *oidcTestProvider) (*OIDCClient, *mux.Router) {
+	config := DefaultConfig()
+	config.OIDCIssuer = provider.server.URL
+	config.OIDCClientID = "userguide-portal"
+	config.OIDCClientSecret = "client-secret"
+	config.OIDCRedirectURL = "https://guides.example.com/auth/callback"
+	config.OIDCCookieSecret = "cookie-secret"
+	oc := NewOIDCClient(config)
+	router := mux.NewRouter()
+	oc.RegisterRoutes(router)
+	return oc, router
+}
+
+// startOIDCLogin requests /auth/login and returns the provider redirect and
+// the state cookie
+func startOIDCLogin(t *testing.T, router http.Handler, returnTo string) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?return_to="+url.QueryEscape(returnTo), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status = %d, want 302", w.Code)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			return w.Header().Get("Location"), cookie
+		}
+	}
+	t.Fatal("login set no state cookie")
+	return "", nil
+}
+
+// finishOIDCLogin calls /auth/callback with state and code
+func finishOIDCLogin(router http.Handler, state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/auth/callback?state="+url.QueryEscape(state)+"&code="+url.QueryEscape(code), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	oc, router := newOIDCTestClient(t, provider)
+
+	location, cookie := startOIDCLogin(t, router, "/download/userguide")
+	state, code := provider.authorize(t, location, nil)
+	w := finishOIDCLogin(router, state, code, cookie)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/download/userguide" {
+		t.Fatalf("callback: %d to %q, want 302 to /download/userguide", w.Code, w.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcSessionCookie {
+			session = c
+		}
+	}
+	if session == nil || !session.HttpOnly || !session.Secure {
+		t.Fatalf("session cookie = %+v, want a secure HttpOnly cookie", session)
+	}
+	r := httptest.NewRequest("GET", "/download/userguide", nil)
+	r.AddCookie(session)
+	if got := oc.Session(r); got == nil || got.Subject != "alice" {
+		t.Errorf("Session = %+v, want alice", got)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	oc, router := newOIDCTestClient(t, provider)
+	other, _ := newOIDCTestClient(t, provider)
+	other.secret = []byte("another-secret")
+
+	tests := []struct {
+		name string
+		// run finishes the login started at location with cookie
+		run  func(location string, cookie *http.Cookie) *httptest.ResponseRecorder
+		want int
+	}{
+		{"state mismatch", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			_, code := provider.authorize(t, location, nil)
+			return finishOIDCLogin(router, randomURLToken(), code, cookie)
+		}, http.StatusBadRequest},
+		{"no state cookie", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			state, code := provider.authorize(t, location, nil)
+			return finishOIDCLogin(router, state, code, nil)
+		}, http.StatusBadRequest},
+		{"forged state cookie", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			state, code := provider.authorize(t, location, nil)
+			var st oidcState
+			oc.open("state", cookie.Value, &st)
+			forged := &http.Cookie{Name: oidcStateCookie, Value: other.seal("state", st)}
+			return finishOIDCLogin(router, state, code, forged)
+		}, http.StatusBadRequest},
+		{"expired state cookie", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			state, code := provider.authorize(t, location, nil)
+			var st oidcState
+			oc.open("state", cookie.Value, &st)
+			st.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+			return finishOIDCLogin(router, state, code, &http.Cookie{Name: oidcStateCookie, Value: oc.seal("state", st)})
+		}, http.StatusBadRequest},
+		{"code of another login", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			// The code was issued for another browser's PKCE challenge
+			otherLocation, _ := startOIDCLogin(t, router, "/")
+			_, code := provider.authorize(t, otherLocation, nil)
+			state, _ := provider.authorize(t, location, nil)
+			return finishOIDCLogin(router, state, code, cookie)
+		}, http.StatusBadGateway},
+		{"nonce mismatch", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			state, code := provider.authorize(t, location, func(claims map[string]interface{}) { claims["nonce"] = "replayed" })
+			return finishOIDCLogin(router, state, code, cookie)
+		}, http.StatusUnauthorized},
+		{"no nonce", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			state, code := provider.authorize(t, location, func(claims map[string]interface{}) { delete(claims, "nonce") })
+			return finishOIDCLogin(router, state, code, cookie)
+		}, http.StatusUnauthorized},
+		{"other audience", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			state, code := provider.authorize(t, location, func(claims map[string]interface{}) { claims["aud"] = "another-client" })
+			return finishOIDCLogin(router, state, code, cookie)
+		}, http.StatusUnauthorized},
+		{"expired ID token", func(location string, cookie *http.Cookie) *httptest.ResponseRecorder {
+			state, code := provider.authorize(t, location, func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Hour).Unix() })
+			return finishOIDCLogin(router, state, code, cookie)
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location, cookie := startOIDCLogin(t, router, "/download/userguide")
+			w := tt.run(location, cookie)
+			if w.Code != tt.want {
+				t.Errorf("callback status = %d, want %d", w.Code, tt.want)
+			}
+			for _, c := range w.Result().Cookies() {
+				if c.Name == oidcSessionCookie && c.MaxAge > 0 {
+					t.Error("failed login set a session cookie")
+				}
+			}
+		})
+	}
+}
+
+func TestOIDCSessionCookie(t *testing.T) {
+	provider := newOIDCTestProvider(t)
+	oc, _ := newOIDCTestClient(t, provider)
+	other, _ := newOIDCTestClient(t, provider)
+	other.secret = []byte("another-secret")
+	valid := OIDCSession{Subject: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	sealed := oc.seal("session", valid)
+	encoded, sig, _ := strings.Cut(sealed, ".")
+	payload, _ := json.Marshal(OIDCSession{Subject: "admin", ExpiresAt: valid.ExpiresAt})
+
+	tests := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"valid", sealed, true},
+		{"expired", oc.seal("session", OIDCSession{Subject: "alice", ExpiresAt: time.Now().Add(-time.Second).Unix()}), false},
+		{"no subject", oc.seal("session", OIDCSession{ExpiresAt: valid.ExpiresAt}), false},
+		{"other secret", other.seal("session", valid), false},
+		{"state cookie", oc.seal("state", valid), false},
+		{"edited subject", base64.RawURLEncoding.EncodeToString(payload) + "." + sig, false},
+		{"no signature", encoded, false},
+		{"malformed", "%%%.%%%", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/download/userguide", nil)
+		r.AddCookie(&http.Cookie{Name: oidcSessionCookie, Value: tt.value})
+		if got := oc.Session(r) != nil; got != tt.want {
+			t.Errorf("%s: session accepted = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSafeReturnTo(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/download/userguide", "/download/userguide"},
+		{"/guides?q=setup", "/guides?q=setup"},
+		{"", "/"},
+		{"//evil.example", "/"},
+		{"/\\evil.example", "/"},
+		{"\\\\evil.example", "/"},
+		{"https://evil.example/", "/"},
+		{"evil.example", "/"},
+		{"javascript:alert(1)", "/"},
+		{"/\t/evil.example", "/"},
+		{"/\n/evil.example", "/"},
+	}
+	for _, tt := range tests {
+		if got := safeReturnTo(tt.target); got != tt.want {
+			t.Errorf("safeReturnTo(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCLogoutIsPostOnly(t *testing.T) {
+	_, router := newOIDCTestClient(t, newOIDCTestProvider(t))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/auth/logout", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /auth/logout: status = %d, want 405", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/auth/logout?return_to=//evil.example", nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Errorf("POST /auth/logout: %d to %q, want 303 to /", w.Code, w.Header().Get("Location"))
+	}
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		cleared = cleared || (c.Name == oidcSessionCookie && c.MaxAge < 0)
+	}
+	if !cleared {
+		t.Error("logout did not clear the session cookie")
+	}
+}
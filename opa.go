@@ -0,0 +1,289 @@
+package userguide
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthorizerOPA selects the Open Policy Agent authorizer
+const AuthorizerOPA = "opa"
+
+// EventAuthzDecision records a policy decision for auditing
+const EventAuthzDecision = "authz.decision"
+
+func init() {
+	RegisterAuthorizer(AuthorizerOPA, newOPAAuthorizer)
+}
+
+// AdminAuthorizer is implemented by authorizers that also decide
+// administrative actions such as publishing guides or reading usage
+type AdminAuthorizer interface {
+	AuthorizeAdmin(ctx context.Context, identity Identity, action, resource string) error
+}
+
+// authorizeAdmin consults the authorizer for admin actions if it supports them
+func authorizeAdmin(ctx context.Context, authorizer Authorizer, identity Identity, action, resource string) error {
+	if admin, ok := authorizer.(AdminAuthorizer); ok {
+		return admin.AuthorizeAdmin(ctx, identity, action, resource)
+	}
+	return nil
+}
+
+// opaAuthorizer queries an OPA sidecar through its data API. Decisions are
+// published as authz.decision events for the audit trail.
+type opaAuthorizer struct {
+	url          string
+	downloadRule string
+	adminRule    string
+	policy       string
+	client       *http.Client
+
+	bundleURL  string
+	bundleMu   sync.Mutex
+	bundleETag string
+}
+
+// opaInput is the input document policies are evaluated against
+type opaInput struct {
+	Action   string      `json:"action"`
+	Resource string      `json:"resource"`
+	Identity opaIdentity `json:"identity"`
+}
+
+type opaIdentity struct {
+	Subject       string `json:"subject"`
+	Method        string `json:"method,omitempty"`
+	Email         string `json:"email,omitempty"`
+	IP            string `json:"ip,omitempty"`
+	HasAPIKey     bool   `json:"has_api_key"`
+	HasLicenseKey bool   `json:"has_license_key"`
+}
+
+func newOPAAuthorizer(config *Config) (Authorizer, error) {
+	if config.OPAURL == "" {
+		return nil, fmt.Errorf("the opa authorizer requires opa.url")
+	}
+	return &opaAuthorizer{
+		url:          strings.TrimSuffix(config.OPAURL, "/"),
+		downloadRule: strings.Trim(config.OPADownloadRule, "/"),
+		adminRule:    strings.Trim(config.OPAAdminRule, "/"),
+		policy:       config.OPAFailurePolicy,
+		client:       NewHTTPClient(config, config.OPATimeout),
+		bundleURL:    config.OPABundleURL,
+	}, nil
+}
+
+func (oa *opaAuthorizer) AuthorizeDownload(ctx context.Context, identity Identity, guide string) error {
+	return oa.decide(ctx, oa.downloadRule, identity, "download", guide)
+}
+
+func (oa *opaAuthorizer) AuthorizeAdmin(ctx context.Context, identity Identity, action, resource string) error {
+	return oa.decide(ctx, oa.adminRule, identity, action, resource)
+}
+
+func (oa *opaAuthorizer) decide(ctx context.Context, rule string, identity Identity, action, resource string) error {
+	input := opaInput{
+		Action:   action,
+		Resource: resource,
+		Identity: opaIdentity{
+			Subject:       identity.Subject,
+			Method:        identity.Method,
+			Email:         identity.Email,
+			HasAPIKey:     identity.APIKey != "",
+			HasLicenseKey: identity.LicenseKey != "",
+		},
+	}
+	if identity.IP != nil {
+		input.Identity.IP = identity.IP.String()
+	}
+
+	allowed, reason, err := oa.query(ctx, rule, input)
+	decision := "allow"
+	switch {
+	case err != nil:
+		log.Printf("OPA query for %s %s failed (fail-%s): %s", action, resource, oa.policy, err.Error())
+		decision = "error"
+	case !allowed:
+		decision = "deny"
+		if reason == "" {
+			reason = "denied by policy"
+		}
+	}
+
+	decisionID := make([]byte, 8)
+	rand.Read(decisionID)
+	events.Publish(Event{Type: EventAuthzDecision, Subject: resource, Data: map[string]string{
+		"decision_id": hex.EncodeToString(decisionID),
+		"engine":      AuthorizerOPA,
+		"action":      action,
+		"subject":     identity.Subject,
+		"decision":    decision,
+		"reason":      reason,
+	}})
+	metrics.Inc("userguide_authz_decisions_total", "engine", AuthorizerOPA, "decision", decision)
+
+	switch {
+	case err != nil && oa.policy == FailOpen:
+		return nil
+	case err != nil:
+		return fmt.Errorf("policy engine unavailable: %v", err)
+	case !allowed && identity.APIKey == "" && identity.LicenseKey == "":
+		return fmt.Errorf("%w: %s", ErrUnauthenticated, reason)
+	case !allowed:
+		return fmt.Errorf("%w: %s", ErrForbidden, reason)
+	}
+	return nil
+}
+
+// query evaluates a rule that yields either a boolean or an object with
+// "allow" and an optional "reason". An undefined result denies.
+func (oa *opaAuthorizer) query(ctx context.Context, rule string, input opaInput) (bool, string, error) {
+	body, err := json.Marshal(map[string]opaInput{"input": input})
+	if err != nil {
+		return false, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", oa.url+"/v1/data/"+rule, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("OPA returned %s", resp.Status)
+	}
+
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return false, "", err
+	}
+	if len(answer.Result) == 0 {
+		return false, "policy result undefined", nil
+	}
+
+	var allowed bool
+	if err := json.Unmarshal(answer.Result, &allowed); err == nil {
+		return allowed, "", nil
+	}
+	var decision struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(answer.Result, &decision); err != nil {
+		return false, "", fmt.Errorf("unexpected policy result %s", answer.Result)
+	}
+	return decision.Allow, decision.Reason, nil
+}
+
+// LoadBundle downloads the policy bundle (a .tar.gz of .rego files and
+// data.json documents) and pushes it to the sidecar's policy and data APIs.
+// Unchanged bundles are skipped using the ETag.
+func (oa *opaAuthorizer) LoadBundle(ctx context.Context) error {
+	if oa.bundleURL == "" {
+		return nil
+	}
+	oa.bundleMu.Lock()
+	defer oa.bundleMu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", oa.bundleURL, nil)
+	if err != nil {
+		return err
+	}
+	if oa.bundleETag != "" {
+		req.Header.Set("If-None-Match", oa.bundleETag)
+	}
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bundle download returned %s", resp.Status)
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("invalid bundle: %v", err)
+	}
+	tr := tar.NewReader(zr)
+	loaded := 0
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid bundle: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if strings.HasPrefix(name, "..") {
+			return fmt.Errorf("invalid bundle entry %s", header.Name)
+		}
+		content, err := io.ReadAll(io.LimitReader(tr, 10<<20))
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasSuffix(name, ".rego"):
+			err = oa.put(ctx, "/v1/policies/"+name, "text/plain", content)
+		case path.Base(name) == "data.json":
+			err = oa.put(ctx, "/v1/data/"+strings.Trim(path.Dir(name), "./"), "application/json", content)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("loading %s: %v", name, err)
+		}
+		loaded++
+	}
+
+	oa.bundleETag = resp.Header.Get("ETag")
+	log.Printf("Loaded OPA bundle from %s (%d files)", oa.bundleURL, loaded)
+	metrics.Set("userguide_opa_bundle_loaded_timestamp_seconds", float64(time.Now().Unix()))
+	return nil
+}
+
+func (oa *opaAuthorizer) put(ctx context.Context, apiPath, contentType string, content []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", oa.url+apiPath, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OPA returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package userguide
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// registerPageRoutes registers the page extraction route with its parameter rules
+func (fh *FileHandler) registerPageRoutes(r *mux.Router) {
+	fh.handle(r, "/guides/{name}/pages", Validate(fh.GuidePagesHandler,
+		ParamRule{Source: QueryParam, Name: "from", Required: true, Type: IntType, MaxLength: 6},
+		ParamRule{Source: QueryParam, Name: "to", Required: true, Type: IntType, MaxLength: 6},
+	).ServeHTTP).Methods("GET")
+}
+
+// GuidePagesHandler serves pages from..to of a PDF guide as a smaller PDF,
+// so support agents can link customers straight to a chapter
+func (fh *FileHandler) GuidePagesHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	to, _ := strconv.Atoi(r.URL.Query().Get("to"))
+	if from < 1 || to < from {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from and to must satisfy 1 <= from <= to"})
+		return
+	}
+
+	filePath, err := fh.guides(r).DownloadGuide(name)
+	if err != nil {
+		log.Printf("Page extraction failed from %s: %s", r.RemoteAddr, err.Error())
+		writeGuideError(w, err)
+		return
+	}
+	safeFilename := filepath.Base(filePath)
+	if !strings.EqualFold(filepath.Ext(safeFilename), ".pdf") {
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "pages can only be extracted from PDF guides"})
+		return
+	}
+	if !fh.authorized(w, r, safeFilename) {
+		return
+	}
+
+	file, err := openGuide(filePath)
+	if err != nil {
+		http.Error(w, "User guide not available", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "User guide not available", http.StatusNotFound)
+		return
+	}
+	if info.Size() > fh.pagesMaxSourceBytes {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "guide is too large to extract pages from"})
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "User guide not available", http.StatusNotFound)
+		return
+	}
+
+	doc, err := parsePDF(data, fh.pagesMaxInflatedBytes)
+	if err != nil {
+		log.Printf("Cannot extract pages from %s: %s", safeFilename, err.Error())
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	extract, err := doc.ExtractPages(from, to)
+	if errors.Is(err, ErrPageOutOfRange) {
+		writeJSON(w, http.StatusRequestedRangeNotSatisfiable, map[string]interface{}{"error": err.Error(), "pages": doc.PageCount()})
+		return
+	}
+	if err != nil {
+		log.Printf("Cannot extract pages from %s: %s", safeFilename, err.Error())
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+
+	extractName := fmt.Sprintf("%s-pages-%d-%d.pdf", strings.TrimSuffix(safeFilename, filepath.Ext(safeFilename)), from, to)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", "inline; filename=\""+fh.utils.EscapeForHeader(extractName)+"\"")
+	w.Header().Set("X-Total-Pages", strconv.Itoa(doc.PageCount()))
+
+	log.Printf("Serving pages %d-%d of %s (%d bytes of %d) to %s", from, to, safeFilename, len(extract), len(data), r.RemoteAddr)
+	metrics.Inc("userguide_page_extracts_total")
+	fh.recordDownload(w, r, safeFilename)
+	http.ServeContent(w, r, extractName, info.ModTime(), bytes.NewReader(extract))
+}
@@ -0,0 +1,684 @@
+package userguide
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Errors returned when a page range cannot be extracted from a PDF
+var (
+	ErrPDFEncrypted   = errors.New("encrypted PDFs are not supported")
+	ErrPDFUnreadable  = errors.New("unable to parse PDF")
+	ErrPageOutOfRange = errors.New("page range outside the document")
+)
+
+// PDF object model; names, numbers and strings keep their source bytes so
+// they are written back exactly as they were read
+type (
+	pdfName    string
+	pdfNumber  string
+	pdfString  []byte
+	pdfRef     struct{ Num, Gen int }
+	pdfDict    map[pdfName]interface{}
+	pdfArray   []interface{}
+	pdfKeyword string
+	pdfStream  struct {
+		Dict pdfDict
+		Data []byte
+	}
+)
+
+// pdfNull is the PDF null object
+type pdfNull struct{}
+
+// pdfDocument holds the objects of a parsed PDF and its catalog
+type pdfDocument struct {
+	objects map[pdfRef]interface{}
+	root    pdfRef
+	// inflateBudget is what compressed streams may still inflate to
+	inflateBudget int64
+}
+
+// objectHeader finds "<num> <gen> obj" headers when scanning a file
+var objectHeader = regexp.MustCompile(`(\d+)[ \t\r\n\f\x00]+(\d+)[ \t\r\n\f\x00]+obj\b`)
+
+// trailerHeader finds classic trailer dictionaries
+var trailerHeader = regexp.MustCompile(`trailer[ \t\r\n\f]*<<`)
+
+// parsePDF reads every object of a PDF. Objects are found by scanning the
+// file rather than trusting the cross-reference table, which copes with
+// damaged tables; later definitions win as they do in incremental updates.
+// The compressed streams of the file may inflate to at most maxInflated
+// bytes in total.
+func parsePDF(data []byte, maxInflated int64) (*pdfDocument, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("%PDF-")) {
+		return nil, ErrPDFUnreadable
+	}
+	doc := &pdfDocument{objects: make(map[pdfRef]interface{}), inflateBudget: maxInflated}
+	var trailers []pdfDict
+
+	end := 0
+	for _, match := range objectHeader.FindAllSubmatchIndex(data, -1) {
+		if match[0] < end {
+			continue // inside the stream of the previous object
+		}
+		num, _ := strconv.Atoi(string(data[match[2]:match[3]]))
+		gen, _ := strconv.Atoi(string(data[match[4]:match[5]]))
+		p := &pdfParser{data: data, pos: match[1]}
+		value, err := p.parseIndirectBody()
+		if err != nil {
+			continue
+		}
+		end = p.pos
+		ref := pdfRef{num, gen}
+		doc.objects[ref] = value
+
+		if stream, ok := value.(*pdfStream); ok {
+			switch stream.Dict["Type"] {
+			case pdfName("XRef"):
+				trailers = append(trailers, stream.Dict)
+			case pdfName("ObjStm"):
+				if err := doc.loadObjectStream(stream); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	doc.fixStreamLengths()
+	for _, idx := range trailerHeader.FindAllIndex(data, -1) {
+		p := &pdfParser{data: data, pos: idx[1] - 2}
+		if value, err := p.parseValue(); err == nil {
+			if dict, ok := value.(pdfDict); ok {
+				trailers = append(trailers, dict)
+			}
+		}
+	}
+
+	for i := len(trailers) - 1; i >= 0; i-- {
+		if _, ok := trailers[i]["Encrypt"]; ok {
+			return nil, ErrPDFEncrypted
+		}
+		if root, ok := trailers[i]["Root"].(pdfRef); ok {
+			doc.root = root
+			break
+		}
+	}
+	if _, ok := doc.resolve(doc.root).(pdfDict); !ok {
+		return nil, ErrPDFUnreadable
+	}
+	return doc, nil
+}
+
+// fixStreamLengths cuts streams whose Length was not a usable direct number
+// when they were read down to their declared length
+func (doc *pdfDocument) fixStreamLengths() {
+	for _, value := range doc.objects {
+		stream, ok := value.(*pdfStream)
+		if !ok {
+			continue
+		}
+		if _, direct := stream.Dict["Length"].(pdfNumber); direct {
+			continue
+		}
+		length, err := strconv.Atoi(string(asNumber(doc.resolve(stream.Dict["Length"]))))
+		if err == nil && length >= 0 && length <= len(stream.Data) {
+			stream.Data = stream.Data[:length]
+		} else {
+			stream.Data = bytes.TrimRight(stream.Data, "\r\n")
+		}
+	}
+}
+
+// loadObjectStream adds the objects compressed in an object stream
+func (doc *pdfDocument) loadObjectStream(stream *pdfStream) error {
+	data, err := doc.decodeStream(stream)
+	if err != nil {
+		return err
+	}
+	count, _ := strconv.Atoi(string(asNumber(doc.resolve(stream.Dict["N"]))))
+	first, err := strconv.Atoi(string(asNumber(doc.resolve(stream.Dict["First"]))))
+	if err != nil || first < 0 || first > len(data) {
+		return ErrPDFUnreadable
+	}
+	// Each entry of the header takes at least four bytes ("1 0 "), so a
+	// larger count cannot be right
+	if count < 0 || count > (first+1)/4 {
+		return ErrPDFUnreadable
+	}
+
+	header := &pdfParser{data: data[:first]}
+	for i := 0; i < count; i++ {
+		num, err1 := header.parseValue()
+		offset, err2 := header.parseValue()
+		if err1 != nil || err2 != nil {
+			return ErrPDFUnreadable
+		}
+		n, _ := strconv.Atoi(string(asNumber(num)))
+		off, err := strconv.Atoi(string(asNumber(offset)))
+		if err != nil || off < 0 || off >= len(data)-first {
+			return ErrPDFUnreadable
+		}
+		p := &pdfParser{data: data, pos: first + off}
+		value, err := p.parseValue()
+		if err != nil {
+			return ErrPDFUnreadable
+		}
+		// Objects defined later in the file replace these as the scan goes on
+		doc.objects[pdfRef{n, 0}] = value
+	}
+	return nil
+}
+
+// decodeStream returns the data of a FlateDecode or unfiltered stream.
+// Inflated data counts against the document's budget, so a small stream
+// expanding to gigabytes is refused rather than read.
+func (doc *pdfDocument) decodeStream(stream *pdfStream) ([]byte, error) {
+	switch filter := doc.resolve(stream.Dict["Filter"]).(type) {
+	case nil:
+		return stream.Data, nil
+	case pdfName:
+		if filter != "FlateDecode" {
+			return nil, fmt.Errorf("unsupported stream filter %s", filter)
+		}
+	case pdfArray:
+		if len(filter) != 1 || filter[0] != pdfName("FlateDecode") {
+			return nil, fmt.Errorf("unsupported stream filters")
+		}
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(stream.Data))
+	if err != nil {
+		return nil, ErrPDFUnreadable
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, doc.inflateBudget+1))
+	if err != nil || int64(len(data)) > doc.inflateBudget {
+		return nil, ErrPDFUnreadable
+	}
+	doc.inflateBudget -= int64(len(data))
+	return data, nil
+}
+
+// resolve follows indirect references
+func (doc *pdfDocument) resolve(value interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		value = doc.objects[ref]
+	}
+	return nil
+}
+
+// dict returns the dictionary of a dictionary or stream object
+func (doc *pdfDocument) dict(value interface{}) pdfDict {
+	switch v := doc.resolve(value).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.Dict
+	}
+	return nil
+}
+
+// inheritedPageKeys are page attributes a page may take from its ancestors
+var inheritedPageKeys = []pdfName{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// pdfPage is a leaf of the page tree with its inherited attributes
+type pdfPage struct {
+	ref       pdfRef
+	inherited pdfDict
+}
+
+// pages walks the page tree in document order. It also returns the refs of
+// the intermediate tree nodes, which extracted documents must not reference.
+func (doc *pdfDocument) pages() ([]pdfPage, map[pdfRef]bool) {
+	var pages []pdfPage
+	nodes := make(map[pdfRef]bool)
+	var walk func(ref pdfRef, inherited pdfDict)
+	walk = func(ref pdfRef, inherited pdfDict) {
+		if nodes[ref] {
+			return
+		}
+		node := doc.dict(ref)
+		if node == nil {
+			return
+		}
+		attrs := make(pdfDict, len(inherited))
+		for key, value := range inherited {
+			attrs[key] = value
+		}
+		for _, key := range inheritedPageKeys {
+			if value, ok := node[key]; ok {
+				attrs[key] = value
+			}
+		}
+		if node["Type"] == pdfName("Page") {
+			pages = append(pages, pdfPage{ref: ref, inherited: attrs})
+			return
+		}
+		nodes[ref] = true
+		kids, _ := doc.resolve(node["Kids"]).(pdfArray)
+		for _, kid := range kids {
+			if kidRef, ok := kid.(pdfRef); ok {
+				walk(kidRef, attrs)
+			}
+		}
+	}
+	if root, ok := doc.dict(doc.root)["Pages"].(pdfRef); ok {
+		walk(root, pdfDict{})
+	}
+	return pages, nodes
+}
+
+// PageCount returns the number of pages in the document
+func (doc *pdfDocument) PageCount() int {
+	pages, _ := doc.pages()
+	return len(pages)
+}
+
+// ExtractPages writes a new PDF holding pages from..to (1-based, inclusive)
+// and every object they use
+func (doc *pdfDocument) ExtractPages(from, to int) ([]byte, error) {
+	pages, treeNodes := doc.pages()
+	if from < 1 || to < from || to > len(pages) {
+		return nil, ErrPageOutOfRange
+	}
+	selected := pages[from-1 : to]
+
+	allPages := make(map[pdfRef]bool, len(pages))
+	for _, page := range pages {
+		allPages[page.ref] = true
+	}
+
+	w := &pdfWriter{doc: doc, renumbered: make(map[pdfRef]int), skip: treeNodes, objects: make(map[int]interface{}), next: 1}
+	catalogNum := w.allocate()
+	pagesNum := w.allocate()
+	// Selected pages keep their numbers so links between them still resolve;
+	// links to pages left out become null
+	for _, page := range selected {
+		w.renumbered[page.ref] = w.allocate()
+		delete(allPages, page.ref)
+	}
+	for ref := range allPages {
+		w.skip[ref] = true
+	}
+
+	kids := make(pdfArray, 0, len(selected))
+	for _, page := range selected {
+		dict := make(pdfDict)
+		for key, value := range page.inherited {
+			dict[key] = value
+		}
+		for key, value := range doc.dict(page.ref) {
+			dict[key] = value
+		}
+		delete(dict, "Parent")
+		copied := w.remap(dict).(pdfDict)
+		copied["Parent"] = pdfRef{pagesNum, 0}
+		w.objects[w.renumbered[page.ref]] = copied
+		kids = append(kids, pdfRef{w.renumbered[page.ref], 0})
+	}
+	w.objects[pagesNum] = pdfDict{"Type": pdfName("Pages"), "Kids": kids, "Count": pdfNumber(strconv.Itoa(len(kids)))}
+	w.objects[catalogNum] = pdfDict{"Type": pdfName("Catalog"), "Pages": pdfRef{pagesNum, 0}}
+	return w.finish(catalogNum), nil
+}
+
+// pdfWriter copies objects into a new, compactly numbered PDF
+type pdfWriter struct {
+	doc        *pdfDocument
+	renumbered map[pdfRef]int
+	skip       map[pdfRef]bool
+	objects    map[int]interface{}
+	pending    []pdfRef
+	next       int
+}
+
+func (w *pdfWriter) allocate() int {
+	w.next++
+	return w.next - 1
+}
+
+// remap rewrites the references inside a value to their new numbers,
+// queueing referenced objects that have not been copied yet
+func (w *pdfWriter) remap(value interface{}) interface{} {
+	switch v := value.(type) {
+	case pdfRef:
+		if w.skip[v] {
+			return pdfNull{}
+		}
+		if num, ok := w.renumbered[v]; ok {
+			return pdfRef{num, 0}
+		}
+		if _, ok := w.doc.objects[v]; !ok {
+			return pdfNull{}
+		}
+		num := w.allocate()
+		w.renumbered[v] = num
+		w.pending = append(w.pending, v)
+		return pdfRef{num, 0}
+	case pdfDict:
+		out := make(pdfDict, len(v))
+		for key, item := range v {
+			out[key] = w.remap(item)
+		}
+		return out
+	case pdfArray:
+		out := make(pdfArray, len(v))
+		for i, item := range v {
+			out[i] = w.remap(item)
+		}
+		return out
+	case *pdfStream:
+		dict := w.remap(v.Dict).(pdfDict)
+		dict["Length"] = pdfNumber(strconv.Itoa(len(v.Data)))
+		return &pdfStream{Dict: dict, Data: v.Data}
+	}
+	return value
+}
+
+// finish copies every object still queued and serializes the document
+func (w *pdfWriter) finish(rootNum int) []byte {
+	for len(w.pending) > 0 {
+		ref := w.pending[0]
+		w.pending = w.pending[1:]
+		w.objects[w.renumbered[ref]] = w.remap(w.doc.objects[ref])
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, w.next)
+	for num := 1; num < w.next; num++ {
+		offsets[num] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n", num)
+		writePDFValue(&buf, w.objects[num])
+		buf.WriteString("\nendobj\n")
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", w.next)
+	for num := 1; num < w.next; num++ {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offsets[num])
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", w.next, rootNum, xref)
+	return buf.Bytes()
+}
+
+// writePDFValue serializes a value; dictionary keys are sorted so output is
+// deterministic
+func writePDFValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil, pdfNull:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case pdfNumber:
+		buf.WriteString(string(v))
+	case pdfName:
+		buf.WriteString("/" + string(v))
+	case pdfString:
+		buf.Write(v)
+	case pdfKeyword:
+		buf.WriteString(string(v))
+	case pdfRef:
+		fmt.Fprintf(buf, "%d %d R", v.Num, v.Gen)
+	case pdfArray:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			writePDFValue(buf, item)
+		}
+		buf.WriteByte(']')
+	case pdfDict:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, string(key))
+		}
+		sort.Strings(keys)
+		buf.WriteString("<<")
+		for _, key := range keys {
+			buf.WriteString("/" + key + " ")
+			writePDFValue(buf, v[pdfName(key)])
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(">>")
+	case *pdfStream:
+		writePDFValue(buf, v.Dict)
+		buf.WriteString("\nstream\n")
+		buf.Write(v.Data)
+		buf.WriteString("\nendstream")
+	}
+}
+
+// asNumber returns a number's text, or "" for other values
+func asNumber(value interface{}) pdfNumber {
+	n, _ := value.(pdfNumber)
+	return n
+}
+
+// pdfParser reads PDF values from a byte slice
+type pdfParser struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+// skipSpace skips whitespace and comments
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '%' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if isPDFSpace(c) {
+			p.pos++
+		} else {
+			return
+		}
+	}
+}
+
+// regular reads a run of regular characters
+func (p *pdfParser) regular() string {
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// parseIndirectBody parses the value after "<num> <gen> obj", including a
+// stream's data, up to endobj
+func (p *pdfParser) parseIndirectBody() (interface{}, error) {
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if dict, ok := value.(pdfDict); ok && bytes.HasPrefix(p.data[p.pos:], []byte("stream")) {
+		p.pos += len("stream")
+		if p.pos < len(p.data) && p.data[p.pos] == '\r' {
+			p.pos++
+		}
+		if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+			p.pos++
+		}
+		data, err := p.streamData(dict)
+		if err != nil {
+			return nil, err
+		}
+		value = &pdfStream{Dict: dict, Data: data}
+		p.skipSpace()
+	}
+	if !bytes.HasPrefix(p.data[p.pos:], []byte("endobj")) {
+		return nil, ErrPDFUnreadable
+	}
+	p.pos += len("endobj")
+	return value, nil
+}
+
+// streamData returns stream bytes using a direct Length when it is
+// consistent, otherwise by searching for endstream
+func (p *pdfParser) streamData(dict pdfDict) ([]byte, error) {
+	if length, err := strconv.Atoi(string(asNumber(dict["Length"]))); err == nil && length >= 0 && p.pos+length <= len(p.data) {
+		after := &pdfParser{data: p.data, pos: p.pos + length}
+		after.skipSpace()
+		if bytes.HasPrefix(p.data[after.pos:], []byte("endstream")) {
+			data := p.data[p.pos : p.pos+length]
+			p.pos = after.pos + len("endstream")
+			return data, nil
+		}
+	}
+	end := bytes.Index(p.data[p.pos:], []byte("endstream"))
+	if end < 0 {
+		return nil, ErrPDFUnreadable
+	}
+	// The end of line before endstream is trimmed by fixStreamLengths once
+	// an indirect Length can be resolved
+	data := p.data[p.pos : p.pos+end]
+	p.pos += end + len("endstream")
+	return data, nil
+}
+
+// parseValue parses one value, combining "<num> <gen> R" into a reference
+func (p *pdfParser) parseValue() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, ErrPDFUnreadable
+	}
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		p.pos++
+		return pdfName(p.regular()), nil
+	case c == '(':
+		return p.literalString()
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		return p.dictionary()
+	case c == '<':
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			return nil, ErrPDFUnreadable
+		}
+		s := pdfString(p.data[p.pos : p.pos+end+1])
+		p.pos += end + 1
+		return s, nil
+	case c == '[':
+		p.pos++
+		var array pdfArray
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.data) {
+				return nil, ErrPDFUnreadable
+			}
+			if p.data[p.pos] == ']' {
+				p.pos++
+				return array, nil
+			}
+			item, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, item)
+		}
+	case c == '{':
+		// PostScript calculator functions are only found inside streams
+		return nil, ErrPDFUnreadable
+	case isPDFDelimiter(c):
+		return nil, ErrPDFUnreadable
+	}
+
+	token := p.regular()
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return pdfNull{}, nil
+	case "":
+		return nil, ErrPDFUnreadable
+	}
+	num, err := strconv.Atoi(token)
+	if err != nil {
+		if _, err := strconv.ParseFloat(token, 64); err == nil {
+			return pdfNumber(token), nil
+		}
+		return pdfKeyword(token), nil
+	}
+	// Look ahead for "<gen> R"
+	save := p.pos
+	p.skipSpace()
+	if gen, err := strconv.Atoi(p.regular()); err == nil && gen >= 0 {
+		p.skipSpace()
+		if p.pos < len(p.data) && p.data[p.pos] == 'R' && (p.pos+1 == len(p.data) || isPDFSpace(p.data[p.pos+1]) || isPDFDelimiter(p.data[p.pos+1])) {
+			p.pos++
+			return pdfRef{num, gen}, nil
+		}
+	}
+	p.pos = save
+	return pdfNumber(token), nil
+}
+
+// dictionary parses << ... >>
+func (p *pdfParser) dictionary() (interface{}, error) {
+	p.pos += 2
+	dict := make(pdfDict)
+	for {
+		p.skipSpace()
+		if p.pos+1 < len(p.data) && p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+			p.pos += 2
+			return dict, nil
+		}
+		key, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			return nil, ErrPDFUnreadable
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		dict[name] = value
+	}
+}
+
+// literalString parses a (...) string with nested parentheses and escapes,
+// keeping its source bytes
+func (p *pdfParser) literalString() (interface{}, error) {
+	start := p.pos
+	depth := 0
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case '\\':
+			p.pos++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return pdfString(p.data[start:p.pos]), nil
+			}
+		}
+		p.pos++
+	}
+	return nil, ErrPDFUnreadable
+}
@@ -0,0 +1,68 @@
+package userguide
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// pdfWithObjectStream wraps an object stream with the given dictionary
+// entries and data in a minimal PDF
+func pdfWithObjectStream(entries string, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	fmt.Fprintf(&buf, "2 0 obj\n<< /Type /ObjStm %s /Length %d >>\nstream\n", entries, len(data))
+	buf.Write(data)
+	buf.WriteString("\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return buf.Bytes()
+}
+
+func TestParsePDFRejectsBadObjectStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries string
+		data    string
+	}{
+		// Found by fuzzing; data[:first] used to panic
+		{"negative first", "/N 1 /First -5", "3 0 true"},
+		{"negative offset", "/N 1 /First 5", "3 -4 true"},
+		{"offset past the end", "/N 1 /First 5", "3 90 true"},
+		{"first missing", "/N 1", "3 0 true"},
+		{"count larger than the header", "/N 1000000 /First 5", "3 0 true"},
+		{"negative count", "/N -1 /First 5", "3 0 true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePDF(pdfWithObjectStream(tt.entries, []byte(tt.data)), 1<<20)
+			if !errors.Is(err, ErrPDFUnreadable) {
+				t.Errorf("err = %v, want ErrPDFUnreadable", err)
+			}
+		})
+	}
+
+	doc, err := parsePDF(pdfWithObjectStream("/N 1 /First 4", []byte("3 0 true")), 1<<20)
+	if err != nil {
+		t.Fatalf("valid object stream: %v", err)
+	}
+	if doc.objects[pdfRef{3, 0}] != true {
+		t.Errorf("object 3 = %v, want true", doc.objects[pdfRef{3, 0}])
+	}
+}
+
+func TestParsePDFLimitsInflatedStreams(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("3 0 true"))
+	zw.Write(bytes.Repeat([]byte(" "), 1<<20))
+	zw.Close()
+	pdf := pdfWithObjectStream("/N 1 /First 4 /Filter /FlateDecode", compressed.Bytes())
+
+	if _, err := parsePDF(pdf, 64<<10); !errors.Is(err, ErrPDFUnreadable) {
+		t.Errorf("err = %v, want ErrPDFUnreadable past the inflate limit", err)
+	}
+	if _, err := parsePDF(pdf, 2<<20); err != nil {
+		t.Errorf("within the inflate limit: %v", err)
+	}
+}
@@ -0,0 +1,430 @@
+package userguide
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pgConn is a minimal PostgreSQL client speaking the version 3 protocol:
+// cleartext, MD5 and SCRAM-SHA-256 logins, optional TLS, and queries with
+// parameters through the extended query protocol. Values come back in
+// binary format, integers converted to decimal text.
+type pgConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// pgError is an ErrorResponse of the server; the connection stays usable
+type pgError struct {
+	code    string
+	message string
+}
+
+func (e *pgError) Error() string { return "postgres: " + e.message + " (" + e.code + ")" }
+
+// Type OIDs of the integer columns, converted from their binary form
+const (
+	pgInt8 = 20
+	pgInt2 = 21
+	pgInt4 = 23
+)
+
+// dialPostgres connects and logs in to the database of target
+func dialPostgres(conn net.Conn, target *sqlTarget) (*pgConn, error) {
+	if target.tls != DBTLSOff {
+		request := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), 80877103)
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, 1)
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return nil, err
+		}
+		switch {
+		case answer[0] == 'S':
+			tlsConn := tls.Client(conn, target.tlsConfig())
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+			conn = tlsConn
+		case target.tls != DBTLSPrefer:
+			return nil, errors.New("postgres: server does not support TLS")
+		}
+	}
+	c := &pgConn{conn: conn, reader: bufio.NewReaderSize(conn, 64*1024)}
+
+	var startup []byte
+	startup = binary.BigEndian.AppendUint32(startup, 196608)
+	for _, param := range []string{"user", target.user, "database", target.database, "application_name", "userguide", "client_encoding", "UTF8"} {
+		startup = append(append(startup, param...), 0)
+	}
+	startup = append(startup, 0)
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(startup)+4))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(startup); err != nil {
+		return nil, err
+	}
+	if err := c.login(target); err != nil {
+		return nil, err
+	}
+	// Parameter statuses and the cancellation key precede ReadyForQuery
+	for {
+		kind, body, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case 'Z':
+			return c, nil
+		case 'E':
+			return nil, pgErrorResponse(body)
+		}
+	}
+}
+
+// login answers the authentication requests of the server
+func (c *pgConn) login(target *sqlTarget) error {
+	var scram *scramClient
+	for {
+		kind, body, err := c.receive()
+		if err != nil {
+			return err
+		}
+		if kind == 'E' {
+			return pgErrorResponse(body)
+		}
+		if kind != 'R' || len(body) < 4 {
+			return fmt.Errorf("postgres: unexpected message %q during login", kind)
+		}
+		method, data := binary.BigEndian.Uint32(body), body[4:]
+		switch method {
+		case 0:
+			if scram != nil && !scram.verified {
+				return errors.New("postgres: server signature missing")
+			}
+			return nil
+		case 3:
+			err = c.send('p', append([]byte(target.password), 0))
+		case 5:
+			if len(data) < 4 {
+				return errors.New("postgres: invalid MD5 salt")
+			}
+			inner := md5.Sum([]byte(target.password + target.user))
+			outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), data[:4]...))
+			err = c.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+		case 10:
+			if !bytes.Contains(data, []byte("SCRAM-SHA-256\x00")) {
+				return fmt.Errorf("postgres: no supported SASL mechanism in %q", data)
+			}
+			scram = newSCRAMClient(target.password)
+			first := scram.first()
+			message := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+			err = c.send('p', append(message, first...))
+		case 11:
+			if scram == nil {
+				return errors.New("postgres: unexpected SASL challenge")
+			}
+			var final string
+			if final, err = scram.final(string(data)); err == nil {
+				err = c.send('p', []byte(final))
+			}
+		case 12:
+			if scram == nil {
+				return errors.New("postgres: unexpected SASL outcome")
+			}
+			err = scram.verify(string(data))
+		default:
+			return fmt.Errorf("postgres: unsupported authentication method %d", method)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// query runs query with args through the extended protocol. Arguments are
+// strings, int64 or []byte.
+func (c *pgConn) query(query string, args ...any) ([][][]byte, int64, error) {
+	var parse []byte
+	parse = append(parse, 0)
+	parse = append(append(parse, query...), 0)
+	parse = binary.BigEndian.AppendUint16(parse, 0)
+
+	var bind []byte
+	bind = append(bind, 0, 0)
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(args)))
+	values := make([][]byte, len(args))
+	for i, arg := range args {
+		format := uint16(0)
+		switch v := arg.(type) {
+		case string:
+			values[i] = []byte(v)
+		case int64:
+			values[i] = strconv.AppendInt(nil, v, 10)
+		case int:
+			values[i] = strconv.AppendInt(nil, int64(v), 10)
+		case []byte:
+			format, values[i] = 1, v
+		default:
+			return nil, 0, fmt.Errorf("postgres: unsupported argument type %T", arg)
+		}
+		bind = binary.BigEndian.AppendUint16(bind, format)
+	}
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(args)))
+	for _, value := range values {
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(value)))
+		bind = append(bind, value...)
+	}
+	// Every result column in binary format
+	bind = binary.BigEndian.AppendUint16(bind, 1)
+	bind = binary.BigEndian.AppendUint16(bind, 1)
+
+	var out bytes.Buffer
+	for _, message := range []struct {
+		kind byte
+		body []byte
+	}{{'P', parse}, {'B', bind}, {'D', []byte{'P', 0}}, {'E', []byte{0, 0, 0, 0, 0}}, {'S', nil}} {
+		out.WriteByte(message.kind)
+		out.Write(binary.BigEndian.AppendUint32(nil, uint32(len(message.body)+4)))
+		out.Write(message.body)
+	}
+	if _, err := c.conn.Write(out.Bytes()); err != nil {
+		return nil, 0, err
+	}
+
+	var rows [][][]byte
+	var types []uint32
+	var affected int64
+	var failure error
+	for {
+		kind, body, err := c.receive()
+		if err != nil {
+			return nil, 0, err
+		}
+		switch kind {
+		case 'T':
+			if types, err = pgColumnTypes(body); err != nil {
+				return nil, 0, err
+			}
+		case 'D':
+			row, err := pgDataRow(body, types)
+			if err != nil {
+				return nil, 0, err
+			}
+			rows = append(rows, row)
+		case 'C':
+			tag := strings.Fields(strings.TrimRight(string(body), "\x00"))
+			if len(tag) > 0 {
+				affected, _ = strconv.ParseInt(tag[len(tag)-1], 10, 64)
+			}
+		case 'E':
+			failure = pgErrorResponse(body)
+		case 'Z':
+			return rows, affected, failure
+		}
+	}
+}
+
+func (c *pgConn) setDeadline(t time.Time) { c.conn.SetDeadline(t) }
+func (c *pgConn) Close() error {
+	c.send('X', nil)
+	return c.conn.Close()
+}
+
+// send writes one message
+func (c *pgConn) send(kind byte, body []byte) error {
+	message := append([]byte{kind}, binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	_, err := c.conn.Write(append(message, body...))
+	return err
+}
+
+// receive reads one message, skipping notices
+func (c *pgConn) receive() (byte, []byte, error) {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, nil, err
+		}
+		length := binary.BigEndian.Uint32(header[1:])
+		if length < 4 || length > 1<<30 {
+			return 0, nil, fmt.Errorf("postgres: message of %d bytes", length)
+		}
+		body := make([]byte, length-4)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			return 0, nil, err
+		}
+		if header[0] != 'N' {
+			return header[0], body, nil
+		}
+	}
+}
+
+// pgColumnTypes reads the type OIDs of a RowDescription
+func pgColumnTypes(body []byte) ([]uint32, error) {
+	if len(body) < 2 {
+		return nil, errors.New("postgres: invalid row description")
+	}
+	count := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	types := make([]uint32, count)
+	for i := range types {
+		end := bytes.IndexByte(body, 0)
+		if end < 0 || len(body) < end+19 {
+			return nil, errors.New("postgres: invalid row description")
+		}
+		types[i] = binary.BigEndian.Uint32(body[end+7:])
+		body = body[end+19:]
+	}
+	return types, nil
+}
+
+// pgDataRow reads the values of a DataRow, nil for NULL
+func pgDataRow(body []byte, types []uint32) ([][]byte, error) {
+	if len(body) < 2 {
+		return nil, errors.New("postgres: invalid data row")
+	}
+	count := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	row := make([][]byte, count)
+	for i := range row {
+		if len(body) < 4 {
+			return nil, errors.New("postgres: invalid data row")
+		}
+		length := int32(binary.BigEndian.Uint32(body))
+		body = body[4:]
+		if length < 0 {
+			continue
+		}
+		if len(body) < int(length) {
+			return nil, errors.New("postgres: invalid data row")
+		}
+		value := body[:length]
+		body = body[length:]
+		if i < len(types) {
+			switch {
+			case types[i] == pgInt8 && len(value) == 8:
+				value = strconv.AppendInt(nil, int64(binary.BigEndian.Uint64(value)), 10)
+			case types[i] == pgInt4 && len(value) == 4:
+				value = strconv.AppendInt(nil, int64(int32(binary.BigEndian.Uint32(value))), 10)
+			case types[i] == pgInt2 && len(value) == 2:
+				value = strconv.AppendInt(nil, int64(int16(binary.BigEndian.Uint16(value))), 10)
+			}
+		}
+		row[i] = value
+	}
+	return row, nil
+}
+
+// pgErrorResponse reads the code and message of an ErrorResponse
+func pgErrorResponse(body []byte) error {
+	e := &pgError{}
+	for len(body) > 1 {
+		end := bytes.IndexByte(body[1:], 0)
+		if end < 0 {
+			break
+		}
+		value := string(body[1 : 1+end])
+		switch body[0] {
+		case 'C':
+			e.code = value
+		case 'M':
+			e.message = value
+		}
+		body = body[end+2:]
+	}
+	return e
+}
+
+// scramClient performs a SCRAM-SHA-256 exchange (RFC 7677) without
+// channel binding
+type scramClient struct {
+	password    string
+	nonce       string
+	clientFirst string
+	serverKey   []byte
+	authMessage string
+	verified    bool
+}
+
+func newSCRAMClient(password string) *scramClient {
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return &scramClient{password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}
+}
+
+// first returns the client-first-message; the user name is the one of the
+// startup message
+func (s *scramClient) first() string {
+	s.clientFirst = "n=,r=" + s.nonce
+	return "n,," + s.clientFirst
+}
+
+// final answers the server-first-message
+func (s *scramClient) final(serverFirst string) (string, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attribute := range strings.Split(serverFirst, ",") {
+		key, value, _ := strings.Cut(attribute, "=")
+		switch key {
+		case "r":
+			nonce = value
+		case "s":
+			salt = value
+		case "i":
+			iterations, _ = strconv.Atoi(value)
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iterations < 1 {
+		return "", errors.New("postgres: invalid SCRAM challenge")
+	}
+	salted, err := pbkdf2.Key(sha256.New, s.password, saltBytes, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	s.serverKey = scramHMAC(salted, "Server Key")
+
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientFirst + "," + serverFirst + "," + withoutProof
+	signature := scramHMAC(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server signature of the server-final-message
+func (s *scramClient) verify(serverFinal string) error {
+	expected := base64.StdEncoding.EncodeToString(scramHMAC(s.serverKey, s.authMessage))
+	if serverFinal != "v="+expected {
+		return errors.New("postgres: invalid SCRAM server signature")
+	}
+	s.verified = true
+	return nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,480 @@
+package userguide
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// pgTestServer plays the server side of a recorded PostgreSQL exchange
+type pgTestServer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// startPG runs script as the server of a pipe and returns the client end
+func startPG(t *testing.T, script func(s *pgTestServer)) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		script(&pgTestServer{t: t, conn: server})
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	return client
+}
+
+// startup reads the startup message and returns its parameters
+func (s *pgTestServer) startup() map[string]string {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		s.t.Errorf("read startup: %v", err)
+		return nil
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header)-4)
+	if _, err := io.ReadFull(s.conn, body); err != nil {
+		s.t.Errorf("read startup: %v", err)
+		return nil
+	}
+	if version := binary.BigEndian.Uint32(body); version != 196608 {
+		s.t.Errorf("protocol version = %d, want 3.0", version)
+	}
+	params := make(map[string]string)
+	fields := strings.Split(strings.TrimRight(string(body[4:]), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		params[fields[i]] = fields[i+1]
+	}
+	return params
+}
+
+// expect reads the next client message, which must be of kind
+func (s *pgTestServer) expect(kind byte) []byte {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		s.t.Errorf("read message %q: %v", kind, err)
+		return nil
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(s.conn, body); err != nil {
+		s.t.Errorf("read message %q: %v", kind, err)
+		return nil
+	}
+	if header[0] != kind {
+		s.t.Errorf("client sent %q, want %q", header[0], kind)
+	}
+	return body
+}
+
+// send writes one server message
+func (s *pgTestServer) send(kind byte, body []byte) {
+	s.write(append(append([]byte{kind}, binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))...), body...))
+}
+
+// write sends raw bytes, such as a malformed message. A client that gave
+// up on the exchange has closed its end, which is not an error.
+func (s *pgTestServer) write(data []byte) {
+	if _, err := s.conn.Write(data); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		s.t.Errorf("write: %v", err)
+	}
+}
+
+// auth sends an AuthenticationRequest of method with data
+func (s *pgTestServer) auth(method uint32, data []byte) {
+	s.send('R', append(binary.BigEndian.AppendUint32(nil, method), data...))
+}
+
+// ready ends the login with a parameter status, the backend key and
+// ReadyForQuery, as servers do
+func (s *pgTestServer) ready() {
+	s.send('S', []byte("server_version\x0016.2\x00"))
+	s.send('K', []byte{0, 0, 0x30, 0x39, 0x12, 0x34, 0x56, 0x78})
+	s.send('Z', []byte{'I'})
+}
+
+// pgAuthFailed is the ErrorResponse PostgreSQL 16 sends for a wrong password
+var pgAuthFailed = []byte("SFATAL\x00VFATAL\x00C28P01\x00Mpassword authentication failed for user \"guides\"\x00Fauth.c\x00L326\x00Rauth_failed\x00\x00")
+
+func pgTestTarget() *sqlTarget {
+	return &sqlTarget{driver: "postgres", address: "db:5432", user: "guides", password: "s3cret", database: "docs", tls: DBTLSOff}
+}
+
+func TestPostgresMD5Login(t *testing.T) {
+	salt := []byte{0x8e, 0x1b, 0x4c, 0x02}
+	conn := startPG(t, func(s *pgTestServer) {
+		params := s.startup()
+		if params["user"] != "guides" || params["database"] != "docs" {
+			s.t.Errorf("startup parameters = %v", params)
+		}
+		s.auth(5, salt)
+		inner := md5.Sum([]byte("s3cretguides"))
+		outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+		if got, want := string(s.expect('p')), "md5"+hex.EncodeToString(outer[:])+"\x00"; got != want {
+			s.t.Errorf("password message = %q, want %q", got, want)
+		}
+		s.auth(0, nil)
+		s.ready()
+		s.expect('X')
+	})
+
+	c, err := dialPostgres(conn, pgTestTarget())
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	c.Close()
+}
+
+func TestPostgresCleartextLogin(t *testing.T) {
+	conn := startPG(t, func(s *pgTestServer) {
+		s.startup()
+		s.auth(3, nil)
+		if got := string(s.expect('p')); got != "s3cret\x00" {
+			s.t.Errorf("password message = %q", got)
+		}
+		s.auth(0, nil)
+		s.ready()
+	})
+	if _, err := dialPostgres(conn, pgTestTarget()); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+}
+
+func TestPostgresAuthFailure(t *testing.T) {
+	conn := startPG(t, func(s *pgTestServer) {
+		s.startup()
+		s.auth(5, []byte{1, 2, 3, 4})
+		s.expect('p')
+		s.send('E', pgAuthFailed)
+	})
+	_, err := dialPostgres(conn, pgTestTarget())
+	var pgErr *pgError
+	if !errors.As(err, &pgErr) {
+		t.Fatalf("err = %v, want a pgError", err)
+	}
+	if pgErr.code != "28P01" || pgErr.message != `password authentication failed for user "guides"` {
+		t.Errorf("error = %q (%s)", pgErr.message, pgErr.code)
+	}
+}
+
+// scramServer checks SCRAM-SHA-256 proofs as PostgreSQL does, for a
+// password stored with a salt and 4096 iterations
+type scramServer struct {
+	storedKey, serverKey []byte
+	salt                 []byte
+}
+
+func newSCRAMServer(t *testing.T, password string) *scramServer {
+	salt := []byte("userguide-salt16")
+	salted, err := pbkdf2.Key(sha256.New, password, salt, 4096, sha256.Size)
+	if err != nil {
+		t.Fatalf("derive key: %v", err)
+	}
+	storedKey := sha256.Sum256(scramHMAC(salted, "Client Key"))
+	return &scramServer{storedKey: storedKey[:], serverKey: scramHMAC(salted, "Server Key"), salt: salt}
+}
+
+// exchange runs the server side of the SASL exchange, sending serverFinal
+// when not empty instead of the correct signature
+func (ss *scramServer) exchange(s *pgTestServer, serverFinal string) {
+	s.auth(10, []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00"))
+	initial := s.expect('p')
+	mechanism, rest, _ := bytes.Cut(initial, []byte{0})
+	if string(mechanism) != "SCRAM-SHA-256" || len(rest) < 4 {
+		s.t.Errorf("SASL initial response = %q", initial)
+		return
+	}
+	clientFirstBare := strings.TrimPrefix(string(rest[4:]), "n,,")
+	clientNonce := strings.TrimPrefix(clientFirstBare, "n=,r=")
+	serverFirst := "r=" + clientNonce + "3rfcNHYJY1ZVvWVs7j,s=" + base64.StdEncoding.EncodeToString(ss.salt) + ",i=4096"
+	s.auth(11, []byte(serverFirst))
+
+	clientFinal := string(s.expect('p'))
+	withoutProof, proof, _ := strings.Cut(clientFinal, ",p=")
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientKey, _ := base64.StdEncoding.DecodeString(proof)
+	signature := scramHMAC(ss.storedKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i%len(signature)]
+	}
+	if sum := sha256.Sum256(clientKey); !hmac.Equal(sum[:], ss.storedKey) {
+		s.send('E', pgAuthFailed)
+		return
+	}
+	if serverFinal == "" {
+		serverFinal = "v=" + base64.StdEncoding.EncodeToString(scramHMAC(ss.serverKey, authMessage))
+	}
+	s.auth(12, []byte(serverFinal))
+	s.auth(0, nil)
+	s.ready()
+}
+
+func TestPostgresSCRAMLogin(t *testing.T) {
+	ss := newSCRAMServer(t, "s3cret")
+	conn := startPG(t, func(s *pgTestServer) {
+		s.startup()
+		ss.exchange(s, "")
+	})
+	if _, err := dialPostgres(conn, pgTestTarget()); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+}
+
+func TestPostgresSCRAMWrongPassword(t *testing.T) {
+	ss := newSCRAMServer(t, "another")
+	conn := startPG(t, func(s *pgTestServer) {
+		s.startup()
+		ss.exchange(s, "")
+	})
+	_, err := dialPostgres(conn, pgTestTarget())
+	var pgErr *pgError
+	if !errors.As(err, &pgErr) || pgErr.code != "28P01" {
+		t.Fatalf("err = %v, want the server's 28P01", err)
+	}
+}
+
+func TestPostgresSCRAMRejectsServerSignature(t *testing.T) {
+	ss := newSCRAMServer(t, "s3cret")
+	conn := startPG(t, func(s *pgTestServer) {
+		s.startup()
+		ss.exchange(s, "v="+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	})
+	if _, err := dialPostgres(conn, pgTestTarget()); err == nil || !strings.Contains(err.Error(), "server signature") {
+		t.Fatalf("err = %v, want an invalid server signature", err)
+	}
+}
+
+func TestPostgresSCRAMRequiresServerSignature(t *testing.T) {
+	conn := startPG(t, func(s *pgTestServer) {
+		s.startup()
+		s.auth(10, []byte("SCRAM-SHA-256\x00\x00"))
+		s.expect('p')
+		// A server that skips the proof exchange is not trusted
+		s.auth(0, nil)
+		s.ready()
+	})
+	if _, err := dialPostgres(conn, pgTestTarget()); err == nil || !strings.Contains(err.Error(), "signature missing") {
+		t.Fatalf("err = %v, want a missing server signature", err)
+	}
+}
+
+// TestSCRAMVector checks the client against the SCRAM-SHA-256 example of
+// RFC 7677 section 3
+func TestSCRAMVector(t *testing.T) {
+	s := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO", clientFirst: "n=user,r=rOprNGfwEbeRWgbNEkqO"}
+	final, err := s.final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatalf("final: %v", err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Errorf("client-final = %q, want %q", final, want)
+	}
+	if err := s.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	for _, challenge := range []string{
+		"r=another-nonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqO%hvY,s=not base64,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqO%hvY,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+	} {
+		if _, err := s.final(challenge); err == nil {
+			t.Errorf("challenge %q accepted", challenge)
+		}
+	}
+}
+
+func TestPostgresQuery(t *testing.T) {
+	conn := startPG(t, func(s *pgTestServer) {
+		s.startup()
+		s.auth(0, nil)
+		s.ready()
+
+		parse := s.expect('P')
+		if !bytes.Contains(parse, []byte("SELECT size, etag FROM guides WHERE name = $1")) {
+			s.t.Errorf("parse = %q", parse)
+		}
+		bind := s.expect('B')
+		if !bytes.Contains(bind, []byte("user-guide.pdf")) {
+			s.t.Errorf("bind = %q", bind)
+		}
+		s.expect('D')
+		s.expect('E')
+		s.expect('S')
+
+		s.send('1', nil)
+		s.send('2', nil)
+		// RowDescription: size int8, etag text
+		var description []byte
+		description = binary.BigEndian.AppendUint16(description, 2)
+		for _, column := range []struct {
+			name string
+			oid  uint32
+		}{{"size", pgInt8}, {"etag", 25}} {
+			description = append(append(description, column.name...), 0)
+			description = binary.BigEndian.AppendUint32(description, 16390)
+			description = binary.BigEndian.AppendUint16(description, 1)
+			description = binary.BigEndian.AppendUint32(description, column.oid)
+			description = append(description, 0, 8, 0xff, 0xff, 0xff, 0xff, 0, 1)
+		}
+		s.send('T', description)
+		s.send('N', []byte("SNOTICE\x00C00000\x00Mignored\x00\x00"))
+		s.send('D', pgRow(binary.BigEndian.AppendUint64(nil, 1048576), []byte("a1b2")))
+		s.send('D', pgRow(binary.BigEndian.AppendUint64(nil, 0), nil))
+		s.send('C', []byte("SELECT 2\x00"))
+		s.send('Z', []byte{'I'})
+
+		// A failing statement leaves the connection usable
+		for _, kind := range []byte("PBDES") {
+			s.expect(kind)
+		}
+		s.send('E', []byte("SERROR\x00C42P01\x00Mrelation \"missing\" does not exist\x00\x00"))
+		s.send('Z', []byte{'I'})
+
+		for _, kind := range []byte("PBDES") {
+			s.expect(kind)
+		}
+		s.send('1', nil)
+		s.send('2', nil)
+		s.send('n', nil)
+		s.send('C', []byte("DELETE 3\x00"))
+		s.send('Z', []byte{'I'})
+	})
+
+	c, err := dialPostgres(conn, pgTestTarget())
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	rows, affected, err := c.query("SELECT size, etag FROM guides WHERE name = $1", "user-guide.pdf")
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if affected != 2 || len(rows) != 2 {
+		t.Fatalf("rows = %q, affected = %d", rows, affected)
+	}
+	if string(rows[0][0]) != "1048576" || string(rows[0][1]) != "a1b2" {
+		t.Errorf("first row = %q", rows[0])
+	}
+	if string(rows[1][0]) != "0" || rows[1][1] != nil {
+		t.Errorf("second row = %q, want a NULL etag", rows[1])
+	}
+
+	_, _, err = c.query("SELECT 1 FROM missing")
+	var pgErr *pgError
+	if !errors.As(err, &pgErr) || pgErr.code != "42P01" {
+		t.Fatalf("err = %v, want 42P01", err)
+	}
+	if _, affected, err = c.query("DELETE FROM guides"); err != nil || affected != 3 {
+		t.Errorf("after an error: affected = %d, err = %v", affected, err)
+	}
+}
+
+// pgRow encodes a DataRow with binary values, nil for NULL
+func pgRow(values ...[]byte) []byte {
+	row := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			row = binary.BigEndian.AppendUint32(row, 0xffffffff)
+			continue
+		}
+		row = binary.BigEndian.AppendUint32(row, uint32(len(value)))
+		row = append(row, value...)
+	}
+	return row
+}
+
+func TestPostgresMalformedMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(s *pgTestServer)
+	}{
+		{"length below its own size", func(s *pgTestServer) {
+			s.startup()
+			s.write([]byte{'R', 0, 0, 0, 2})
+		}},
+		{"oversized length", func(s *pgTestServer) {
+			s.startup()
+			s.write([]byte{'R', 0x7f, 0xff, 0xff, 0xff})
+		}},
+		{"truncated message", func(s *pgTestServer) {
+			s.startup()
+			s.write([]byte{'R', 0, 0, 0, 12, 0, 0})
+		}},
+		{"short authentication request", func(s *pgTestServer) {
+			s.startup()
+			s.send('R', []byte{0, 0})
+		}},
+		{"unexpected message", func(s *pgTestServer) {
+			s.startup()
+			s.send('D', pgRow([]byte("x")))
+		}},
+		{"unsupported method", func(s *pgTestServer) {
+			s.startup()
+			s.auth(7, nil)
+		}},
+		{"short MD5 salt", func(s *pgTestServer) {
+			s.startup()
+			s.auth(5, []byte{1, 2})
+		}},
+		{"no known SASL mechanism", func(s *pgTestServer) {
+			s.startup()
+			s.auth(10, []byte("SCRAM-SHA-1\x00\x00"))
+		}},
+		{"SASL challenge without a start", func(s *pgTestServer) {
+			s.startup()
+			s.auth(11, []byte("r=x,s=c2FsdA==,i=1"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := startPG(t, tt.script)
+			if _, err := dialPostgres(conn, pgTestTarget()); err == nil {
+				t.Fatal("login succeeded")
+			}
+		})
+	}
+}
+
+func TestPostgresMalformedRows(t *testing.T) {
+	types := []uint32{pgInt8, 25}
+	for name, body := range map[string][]byte{
+		"empty":              nil,
+		"missing length":     {0, 2, 0, 0, 0, 1, 'x'},
+		"value past the end": {0, 1, 0, 0, 0, 9, 'x'},
+	} {
+		if _, err := pgDataRow(body, types); err == nil {
+			t.Errorf("%s: data row accepted", name)
+		}
+	}
+	for name, body := range map[string][]byte{
+		"empty":           nil,
+		"unterminated":    append([]byte{0, 1}, "size"...),
+		"truncated field": append([]byte{0, 1}, "size\x00\x00\x00"...),
+	} {
+		if _, err := pgColumnTypes(body); err == nil {
+			t.Errorf("%s: row description accepted", name)
+		}
+	}
+	// Integers of an unexpected width stay as sent
+	row, err := pgDataRow(pgRow([]byte{1, 2, 3}), []uint32{pgInt8})
+	if err != nil || !bytes.Equal(row[0], []byte{1, 2, 3}) {
+		t.Errorf("row = %v, err = %v", row, err)
+	}
+	// An unterminated error field keeps what was read
+	if err := pgErrorResponse([]byte("C28P01\x00Mtruncated")); !strings.Contains(err.Error(), "28P01") {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package userguide
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// precompressedEncodings lists sibling files in order of preference
+var precompressedEncodings = []struct {
+	encoding string
+	suffix   string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// digestSuffix names the sidecar holding the SHA-256 of a brotli sibling's
+// decompressed content; the standard library has no brotli decoder to check
+// the sibling directly
+const digestSuffix = ".sha256"
+
+// precompressedSiblings finds verified pre-compressed copies of guides.
+// Verification results are cached until either file changes.
+type precompressedSiblings struct {
+	mu      sync.Mutex
+	checked map[string]siblingCheck
+}
+
+type siblingCheck struct {
+	original fileStamp
+	sibling  fileStamp
+	valid    bool
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func stampOf(info os.FileInfo) fileStamp {
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}
+}
+
+func newPrecompressedSiblings() *precompressedSiblings {
+	return &precompressedSiblings{checked: make(map[string]siblingCheck)}
+}
+
+// Find returns the path and encoding of the preferred sibling the client
+// accepts, or empty strings to serve the original
+func (ps *precompressedSiblings) Find(r *http.Request, path string, original os.FileInfo) (string, string) {
+	accept := r.Header.Get("Accept-Encoding")
+	if accept == "" {
+		return "", ""
+	}
+	for _, candidate := range precompressedEncodings {
+		if !acceptsEncoding(accept, candidate.encoding) {
+			continue
+		}
+		siblingPath := path + candidate.suffix
+		info, err := os.Stat(siblingPath)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if ps.verified(path, original, siblingPath, info, candidate.encoding) {
+			return siblingPath, candidate.encoding
+		}
+	}
+	return "", ""
+}
+
+// verified reports whether the sibling decompresses to the original's content
+func (ps *precompressedSiblings) verified(path string, original os.FileInfo, siblingPath string, sibling os.FileInfo, encoding string) bool {
+	ps.mu.Lock()
+	check, ok := ps.checked[siblingPath]
+	ps.mu.Unlock()
+	if ok && check.original == stampOf(original) && check.sibling == stampOf(sibling) {
+		return check.valid
+	}
+
+	err := verifySibling(path, siblingPath, encoding)
+	if err != nil {
+		log.Printf("Warning: not serving %s: %s", siblingPath, err.Error())
+		metrics.Inc("userguide_precompressed_mismatch_total", "encoding", encoding)
+	}
+
+	ps.mu.Lock()
+	ps.checked[siblingPath] = siblingCheck{original: stampOf(original), sibling: stampOf(sibling), valid: err == nil}
+	ps.mu.Unlock()
+	return err == nil
+}
+
+// verifySibling compares the SHA-256 of the sibling's decompressed content
+// with that of the original
+func verifySibling(path, siblingPath, encoding string) error {
+	expected, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+
+	var actual string
+	switch encoding {
+	case "gzip":
+		file, err := os.Open(siblingPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, zr); err != nil {
+			return err
+		}
+		actual = hex.EncodeToString(h.Sum(nil))
+	default:
+		data, err := os.ReadFile(siblingPath + digestSuffix)
+		if err != nil {
+			return fmt.Errorf("no %s digest to verify against", digestSuffix)
+		}
+		actual = strings.ToLower(strings.TrimSpace(strings.Fields(string(data) + " ")[0]))
+	}
+
+	if actual != expected {
+		return fmt.Errorf("decompressed checksum %s does not match original %s", actual, expected)
+	}
+	return nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows the
+// encoding with a non-zero quality, directly or through "*"
+func acceptsEncoding(header, encoding string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(k, "q") {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch name {
+		case encoding:
+			return q > 0
+		case "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
+
+// Invalidate drops the verification results of siblings of files matching
+// match, so they are verified again before being served
+func (ps *precompressedSiblings) Invalidate(match func(path string) bool) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	dropped := 0
+	for siblingPath := range ps.checked {
+		original := siblingPath
+		for _, candidate := range precompressedEncodings {
+			original = strings.TrimSuffix(original, candidate.suffix)
+		}
+		if match(original) {
+			delete(ps.checked, siblingPath)
+			dropped++
+		}
+	}
+	return dropped
+}
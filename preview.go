@@ -0,0 +1,153 @@
+package userguide
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// previewTokenPattern matches the payload.signature shape of preview tokens
+var previewTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+$`)
+
+// PreviewService issues and verifies short-lived preview tokens for draft guides
+type PreviewService struct {
+	drafts *FileService
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewPreviewService creates a preview service serving drafts from the configured path
+func NewPreviewService(config *Config) *PreviewService {
+	return &PreviewService{
+		drafts: &FileService{guides: NewLocalStorage(config.PreviewPath, config.FollowSymlinks), utils: &Utils{policy: &config.FilenamePolicy}},
+		secret: []byte(config.PreviewSecret),
+		ttl:    config.PreviewTTL,
+	}
+}
+
+// CreateToken returns a signed token granting access to a draft until it expires
+func (ps *PreviewService) CreateToken(filename string) (string, time.Time, error) {
+	if _, err := ps.drafts.resolveFile(filename); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := time.Now().Add(ps.ttl)
+	payload := filename + "|" + strconv.FormatInt(expires.Unix(), 10)
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(ps.sign(payload))
+
+	return token, expires, nil
+}
+
+// ResolveToken verifies a token and returns the draft file path it grants
+func (ps *PreviewService) ResolveToken(token string) (string, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", fmt.Errorf("malformed preview token")
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", fmt.Errorf("malformed preview token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return "", fmt.Errorf("malformed preview token")
+	}
+
+	payload := string(payloadBytes)
+	if !hmac.Equal(sig, ps.sign(payload)) {
+		return "", fmt.Errorf("invalid preview token signature")
+	}
+
+	filename, expiresStr, ok := strings.Cut(payload, "|")
+	if !ok {
+		return "", fmt.Errorf("malformed preview token")
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed preview token")
+	}
+	if time.Now().Unix() > expires {
+		return "", fmt.Errorf("preview token expired")
+	}
+
+	return ps.drafts.resolveFile(filename)
+}
+
+func (ps *PreviewService) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, ps.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// PreviewHandler serves draft guides through preview tokens
+type PreviewHandler struct {
+	previewService *PreviewService
+	utils          *Utils
+}
+
+// NewPreviewHandler creates a new preview handler
+func NewPreviewHandler(previewService *PreviewService) *PreviewHandler {
+	return &PreviewHandler{
+		previewService: previewService,
+		utils:          &Utils{},
+	}
+}
+
+// RegisterRoutes registers the preview route with the router
+func (ph *PreviewHandler) RegisterRoutes(r *mux.Router) {
+	r.Handle("/preview/{token}", Validate(ph.PreviewDownloadHandler,
+		ParamRule{Source: PathParam, Name: "token", Required: true, Pattern: previewTokenPattern, MaxLength: 1024},
+	)).Methods("GET")
+}
+
+// PreviewDownloadHandler serves the draft referenced by a valid preview token
+func (ph *PreviewHandler) PreviewDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	filePath, err := ph.previewService.ResolveToken(mux.Vars(r)["token"])
+	if err != nil {
+		log.Printf("Preview request rejected from %s: %s", r.RemoteAddr, err.Error())
+		http.Error(w, "Preview not available", http.StatusNotFound)
+		return
+	}
+
+	safeFilename := filepath.Base(filePath)
+	w.Header().Set("Content-Type", ph.utils.GetContentType(safeFilename))
+	w.Header().Set("Content-Disposition", "inline; filename=\""+ph.utils.EscapeForHeader(safeFilename)+"\"")
+
+	// Drafts must never be cached by browsers or intermediaries
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	log.Printf("Serving preview: %s to %s", safeFilename, r.RemoteAddr)
+	fileServer.ServeFile(w, r, filePath)
+}
+
+// runPreviewCommand prints a preview link for a draft guide
+func runPreviewCommand(config *Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: preview <draft-filename>")
+	}
+	if config.PreviewSecret == "" || config.PreviewPath == "" {
+		return fmt.Errorf("preview.path and preview.secret must be configured")
+	}
+
+	token, expires, err := NewPreviewService(config).CreateToken(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s/preview/%s\n", strings.TrimSuffix(config.PreviewBaseURL, "/"), token)
+	fmt.Printf("Expires: %s\n", expires.Format(time.RFC3339))
+	return nil
+}
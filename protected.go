@@ -0,0 +1,86 @@
+package userguide
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// protectedGuidePrefix namespaces restricted guides for authorizers and
+// access windows, e.g. "protected/service-manual.pdf"
+const protectedGuidePrefix = "protected/"
+
+// AuthMiddleware rejects requests that do not carry one of the configured
+// bearer tokens with 401
+func AuthMiddleware(tokens []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !validBearerToken(r, tokens) {
+				log.Printf("Rejected unauthenticated request for %s from %s", r.URL.Path, r.RemoteAddr)
+				metrics.Inc("userguide_auth_failures_total")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="userguide"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, withBearerToken(r))
+		})
+	}
+}
+
+// validBearerToken reports whether the Authorization header holds one of
+// tokens; every token is compared so timing does not reveal which matched
+func validBearerToken(r *http.Request, tokens []string) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	presented := []byte(strings.TrimPrefix(header, "Bearer "))
+	valid := 0
+	for _, token := range tokens {
+		if token != "" {
+			valid |= subtle.ConstantTimeCompare(presented, []byte(token))
+		}
+	}
+	return valid == 1
+}
+
+// PublicDownloadHandler serves the general user guide without credentials
+func (fh *FileHandler) PublicDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	fh.DownloadUserGuideHandler(w, r)
+}
+
+// ProtectedDownloadHandler serves a restricted guide, or the restricted
+// edition of the configured user guide on /protected/download; the routes
+// are guarded by AuthMiddleware
+func (fh *FileHandler) ProtectedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	filePath, err := fh.guides(r).DownloadProtectedGuide(name)
+	if err != nil {
+		log.Printf("Protected guide download failed from %s: %s", r.RemoteAddr, err.Error())
+		writeGuideError(w, err)
+		return
+	}
+
+	safeFilename := filepath.Base(filePath)
+	w.Header().Set("Content-Type", fh.utils.GetContentType(safeFilename))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fh.utils.EscapeForHeader(safeFilename)+"\"")
+	if !fh.authorized(w, r, protectedGuidePrefix+safeFilename) {
+		return
+	}
+	// Restricted copies must never be served from a shared cache
+	w.Header().Set("Cache-Control", "private, no-store")
+	if fh.versions.NotModified(w, r, filePath) {
+		return
+	}
+
+	fh.offerResume(w, safeFilename, filePath)
+
+	log.Printf("Serving protected guide: %s to %s", safeFilename, r.RemoteAddr)
+	metrics.Inc("userguide_protected_downloads_total")
+	fh.recordDownload(w, r, protectedGuidePrefix+safeFilename)
+	fileServer.ServeFile(w, r, filePath)
+}
@@ -0,0 +1,235 @@
+package userguide
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Built-in API key tiers
+const (
+	TierGold     = "gold"
+	TierStandard = "standard"
+)
+
+// APIKeyHeader carries the client's API key
+const APIKeyHeader = "X-API-Key"
+
+// TierLimits configures the service level of an API key tier
+type TierLimits struct {
+	Keys            []string
+	RatePerSecond   float64
+	Burst           int
+	BandwidthBytes  int64
+	BypassAdmission bool
+}
+
+// defaultTiers returns the built-in tier definitions
+func defaultTiers() map[string]*TierLimits {
+	return map[string]*TierLimits{
+		TierGold:     {BypassAdmission: true},
+		TierStandard: {},
+	}
+}
+
+// QoS assigns requests to tiers by API key and enforces per-tier limits
+type QoS struct {
+	tiers map[string]*TierLimits
+	// keyTiers maps the SHA-256 of keys listed in qos.tier.*.keys to
+	// their tier
+	keyTiers map[string]string
+	// keys validates keys that are not listed; nil without apikeys.file
+	keys      KeyStore
+	limiter   RateLimiter
+	admission *admissionQueue
+	// headers adds X-RateLimit-* to responses of rate limited tiers
+	headers bool
+	utils   *Utils
+}
+
+// NewQoS creates the QoS middleware from configuration; keys may be nil
+func NewQoS(config *Config, keys KeyStore) *QoS {
+	q := &QoS{
+		tiers:    config.Tiers,
+		keyTiers: make(map[string]string),
+		keys:     keys,
+		limiter:  NewRateLimiter(config),
+		headers:  config.RateLimitHeaders,
+		utils:    &Utils{},
+	}
+	for name, tier := range config.Tiers {
+		for _, key := range tier.Keys {
+			sum := sha256.Sum256([]byte(key))
+			q.keyTiers[hex.EncodeToString(sum[:])] = name
+		}
+	}
+	if config.AdmissionMaxInFlight > 0 {
+		q.admission = newAdmissionQueue(config.AdmissionMaxInFlight, config.AdmissionQueueSize, config.AdmissionQueueTimeout)
+	}
+	return q
+}
+
+// Tier returns the tier name and client identity for a request. Keys listed
+// in a tier and valid keys of apikeys.file, whose tier field picks the tier,
+// are limited per key; other requests per client IP. QoS runs before the
+// routes check keys, so it validates them itself. Keys are identified by
+// their fingerprint, keeping them out of limiter and Redis keys.
+func (q *QoS) Tier(r *http.Request) (string, string) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return TierStandard, "ip:" + q.utils.ClientIP(r)
+	}
+	sum := sha256.Sum256([]byte(key))
+	tier, known := q.keyTiers[hex.EncodeToString(sum[:])]
+	if !known && q.keys != nil {
+		info, err := q.keys.Lookup(r.Context(), key)
+		if err == nil && !info.Expired(time.Now()) {
+			tier, known = info.Tier, true
+		}
+	}
+	if !known {
+		return TierStandard, "ip:" + q.utils.ClientIP(r)
+	}
+	// A tier the configuration does not define gets no unlimited pass
+	if _, ok := q.tiers[tier]; !ok {
+		tier = TierStandard
+	}
+	return tier, "key:" + keyFingerprint(key)
+}
+
+// Middleware applies rate, admission and bandwidth limits for the request's tier
+func (q *QoS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tierName, client := q.Tier(r)
+		tier, ok := q.tiers[tierName]
+		if !ok {
+			tier = &TierLimits{}
+		}
+		metrics.Inc("userguide_qos_requests_total", "tier", tierName)
+
+		status := q.limiter.Allow(r.Context(), tierName+"|"+client, tier.RatePerSecond, tier.Burst)
+		if q.headers && tier.RatePerSecond > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(max(tier.Burst, 1)))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(status.Reset.Seconds()))))
+		}
+		if !status.Allowed {
+			metrics.Inc("userguide_qos_rejected_total", "tier", tierName, "reason", "rate")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(status.RetryAfter.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		if q.admission != nil && !tier.BypassAdmission {
+			if !q.admission.Acquire(r.Context()) {
+				log.Printf("Admission queue full, rejecting %s request from %s", tierName, r.RemoteAddr)
+				metrics.Inc("userguide_qos_rejected_total", "tier", tierName, "reason", "admission")
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Service busy", http.StatusServiceUnavailable)
+				return
+			}
+			defer q.admission.Release()
+		}
+
+		if tier.BandwidthBytes > 0 {
+			w = &throttledWriter{ResponseWriter: w, bytesPerSec: tier.BandwidthBytes, start: time.Now()}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// admissionQueue bounds in-flight requests and lets a limited number of
+// requests wait for a free slot
+type admissionQueue struct {
+	slots   chan struct{}
+	waiting chan struct{}
+	timeout time.Duration
+}
+
+func newAdmissionQueue(maxInFlight, queueSize int, timeout time.Duration) *admissionQueue {
+	return &admissionQueue{
+		slots:   make(chan struct{}, maxInFlight),
+		waiting: make(chan struct{}, queueSize),
+		timeout: timeout,
+	}
+}
+
+// Acquire takes an in-flight slot, queueing until the timeout if necessary
+func (aq *admissionQueue) Acquire(ctx context.Context) bool {
+	select {
+	case aq.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case aq.waiting <- struct{}{}:
+		defer func() { <-aq.waiting }()
+	default:
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, aq.timeout)
+	defer cancel()
+
+	select {
+	case aq.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees an in-flight slot
+func (aq *admissionQueue) Release() {
+	<-aq.slots
+}
+
+// throttledWriter paces response writes to an average bytes-per-second rate
+type throttledWriter struct {
+	http.ResponseWriter
+	bytesPerSec int64
+	start       time.Time
+	written     int64
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	chunk := int(tw.bytesPerSec / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	total := 0
+	for len(p) > 0 {
+		n := min(chunk, len(p))
+		written, err := tw.ResponseWriter.Write(p[:n])
+		total += written
+		tw.written += int64(written)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		expected := time.Duration(float64(tw.written) / float64(tw.bytesPerSec) * float64(time.Second))
+		if ahead := expected - time.Since(tw.start); ahead > 0 {
+			time.Sleep(ahead)
+		}
+	}
+	return total, nil
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,60 @@
+package userguide
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticKeyStore holds API keys in memory
+type staticKeyStore map[string]*APIKeyInfo
+
+func (s staticKeyStore) Lookup(_ context.Context, key string) (*APIKeyInfo, error) {
+	if info, ok := s[key]; ok {
+		return info, nil
+	}
+	return nil, ErrUnknownAPIKey
+}
+
+func TestQoSTier(t *testing.T) {
+	config := DefaultConfig()
+	config.Tiers[TierGold].Keys = []string{"listed-gold-key"}
+	q := NewQoS(config, staticKeyStore{
+		"file-key":    {Owner: "acme"},
+		"file-gold":   {Owner: "acme", Tier: TierGold},
+		"file-custom": {Owner: "acme", Tier: "platinum"},
+		"expired-key": {Owner: "acme", ExpiresAt: time.Now().Add(-time.Hour)},
+	})
+
+	tests := []struct {
+		key      string
+		wantTier string
+		keyed    bool
+	}{
+		{"", TierStandard, false},
+		{"listed-gold-key", TierGold, true},
+		{"file-key", TierStandard, true},
+		{"file-gold", TierGold, true},
+		{"file-custom", TierStandard, true},
+		{"expired-key", TierStandard, false},
+		{"unknown-key", TierStandard, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/download/userguide", nil)
+		if tt.key != "" {
+			r.Header.Set(APIKeyHeader, tt.key)
+		}
+		tier, client := q.Tier(r)
+		if tier != tt.wantTier {
+			t.Errorf("%q: tier = %s, want %s", tt.key, tier, tt.wantTier)
+		}
+		if keyed := strings.HasPrefix(client, "key:"); keyed != tt.keyed {
+			t.Errorf("%q: client = %s, want keyed %t", tt.key, client, tt.keyed)
+		}
+		if tt.key != "" && strings.Contains(client, tt.key) {
+			t.Errorf("%q: client %s holds the raw key", tt.key, client)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Events published when operators act on quarantined guides
+const (
+	EventQuarantineReleased = "quarantine.released"
+	EventQuarantinePurged   = "quarantine.purged"
+)
+
+// Errors of quarantine management
+var (
+	ErrQuarantineNotFound = errors.New("quarantined guide not found")
+	ErrReleaseConflict    = errors.New("release conflict")
+)
+
+// QuarantineRelease is a request to publish a quarantined guide, waiting for
+// a second operator to approve it
+type QuarantineRelease struct {
+	RequestedBy string    `json:"requestedBy"`
+	RequestedAt time.Time `json:"requestedAt"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// QuarantineEntry is a quarantined guide with its scan report
+type QuarantineEntry struct {
+	ID string `json:"id"`
+	QuarantineReport
+}
+
+type quarantineReleaseKey struct{}
+
+// releasedFromQuarantine returns the quarantine id of a guide being
+// published by an approved release, or ""
+func releasedFromQuarantine(ctx context.Context) string {
+	id, _ := ctx.Value(quarantineReleaseKey{}).(string)
+	return id
+}
+
+// List returns the quarantined guides, newest first
+func (vs *VirusScan) List() ([]QuarantineEntry, error) {
+	files, err := os.ReadDir(vs.quarantine)
+	if err != nil {
+		return nil, err
+	}
+	entries := []QuarantineEntry{}
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || !file.Type().IsRegular() {
+			continue
+		}
+		entry, err := vs.Entry(id)
+		if err != nil {
+			log.Printf("Skipping quarantine report %s: %s", file.Name(), err.Error())
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.After(entries[j].Time) })
+	return entries, nil
+}
+
+// Entry returns the report of the quarantined guide id
+func (vs *VirusScan) Entry(id string) (*QuarantineEntry, error) {
+	if id == "" || id != filepath.Base(id) || strings.HasPrefix(id, ".") || strings.HasSuffix(id, ".json") {
+		return nil, ErrQuarantineNotFound
+	}
+	if _, err := os.Stat(filepath.Join(vs.quarantine, id)); err != nil {
+		return nil, ErrQuarantineNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(vs.quarantine, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrQuarantineNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &QuarantineEntry{ID: id}
+	if err := json.Unmarshal(data, &entry.QuarantineReport); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// RequestRelease records that actor wants the quarantined guide published,
+// for example after confirming a false positive with the antivirus vendor
+func (vs *VirusScan) RequestRelease(id, actor, reason string) (*QuarantineEntry, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	entry, err := vs.Entry(id)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Release != nil {
+		return nil, fmt.Errorf("%w: release already requested by %s", ErrReleaseConflict, entry.Release.RequestedBy)
+	}
+	entry.Release = &QuarantineRelease{RequestedBy: actor, RequestedAt: time.Now().UTC(), Reason: reason}
+	report, _ := json.MarshalIndent(entry.QuarantineReport, "", "  ")
+	if err := os.WriteFile(filepath.Join(vs.quarantine, id+".json"), report, 0o600); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Release publishes the quarantined guide id through uploads, with every
+// content check but the virus scan, and removes it from quarantine. With
+// approval required, the release must have been requested by an operator
+// other than approver.
+func (vs *VirusScan) Release(ctx context.Context, id, approver string, uploads *UploadService) (*UploadResult, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	entry, err := vs.Entry(id)
+	if err != nil {
+		return nil, err
+	}
+	requestedBy := approver
+	if vs.approval {
+		if entry.Release == nil {
+			return nil, fmt.Errorf("%w: no release has been requested", ErrReleaseConflict)
+		}
+		if entry.Release.RequestedBy == approver {
+			return nil, fmt.Errorf("%w: the release must be approved by another operator than %s", ErrReleaseConflict, approver)
+		}
+		requestedBy = entry.Release.RequestedBy
+	}
+
+	filePath := filepath.Join(vs.quarantine, id)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	product, name := path.Split(entry.Guide)
+	ctx = context.WithValue(ctx, quarantineReleaseKey{}, id)
+	result, err := uploads.Publish(ctx, strings.TrimSuffix(product, "/"), name, file, info.Size(), Checksums{}, ScheduleEntry{})
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	os.Remove(filePath)
+	os.Remove(filePath + ".json")
+
+	log.Printf("Released %s from quarantine %s (%s): requested by %s, approved by %s", entry.Guide, id, entry.Signature, requestedBy, approver)
+	metrics.Inc("userguide_quarantine_actions_total", "action", "released")
+	events.Publish(Event{Type: EventQuarantineReleased, Subject: entry.Guide, Data: map[string]string{
+		"quarantine":  id,
+		"signature":   entry.Signature,
+		"requestedBy": requestedBy,
+		"approvedBy":  approver,
+	}})
+	return result, nil
+}
+
+// Purge deletes the quarantined guide id and its report
+func (vs *VirusScan) Purge(id, actor string) (*QuarantineEntry, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	entry, err := vs.Entry(id)
+	if err != nil {
+		return nil, err
+	}
+	filePath := filepath.Join(vs.quarantine, id)
+	if err := os.Remove(filePath); err != nil {
+		return nil, err
+	}
+	os.Remove(filePath + ".json")
+
+	log.Printf("Purged %s from quarantine %s (%s) by %s", entry.Guide, id, entry.Signature, actor)
+	metrics.Inc("userguide_quarantine_actions_total", "action", "purged")
+	events.Publish(Event{Type: EventQuarantinePurged, Subject: entry.Guide, Data: map[string]string{
+		"quarantine": id,
+		"signature":  entry.Signature,
+		"actor":      actor,
+	}})
+	return entry, nil
+}
+
+// registerQuarantineRoutes adds the quarantine endpoints to the admin group
+func (ah *AdminHandler) registerQuarantineRoutes(admin *mux.Router) {
+	admin.HandleFunc("/quarantine", ah.QuarantineListHandler).Methods("GET")
+	admin.HandleFunc("/quarantine/{id}", ah.QuarantineEntryHandler).Methods("GET")
+	admin.HandleFunc("/quarantine/{id}", ah.QuarantinePurgeHandler).Methods("DELETE")
+	admin.HandleFunc("/quarantine/{id}/release", ah.QuarantineReleaseHandler).Methods("POST")
+	admin.HandleFunc("/quarantine/{id}/approve", ah.QuarantineApproveHandler).Methods("POST")
+}
+
+// QuarantineListHandler serves GET /admin/quarantine, the quarantined
+// guides with their scan reports, newest first
+func (ah *AdminHandler) QuarantineListHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.permitted(w, r, "quarantine.read", "quarantine") {
+		return
+	}
+	entries, err := ah.quarantine.List()
+	if err != nil {
+		log.Printf("Unable to list quarantine: %s", err.Error())
+		http.Error(w, "Quarantine unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"quarantined": entries, "approvalRequired": ah.quarantine.approval})
+}
+
+// QuarantineEntryHandler serves GET /admin/quarantine/{id}, the scan report
+// of one quarantined guide
+func (ah *AdminHandler) QuarantineEntryHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !ah.permitted(w, r, "quarantine.read", id) {
+		return
+	}
+	entry, err := ah.quarantine.Entry(id)
+	if err != nil {
+		ah.quarantineError(w, id, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// QuarantineReleaseHandler serves POST /admin/quarantine/{id}/release with
+// an optional {"reason": "..."} body. When releases need approval it
+// records the request and answers 202; otherwise the guide is published.
+func (ah *AdminHandler) QuarantineReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !ah.permitted(w, r, "quarantine.release", id) {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid release request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := requestActor(r, ah.utils)
+	if !ah.quarantine.approval {
+		ah.releaseQuarantined(w, r, id, actor)
+		return
+	}
+	entry, err := ah.quarantine.RequestRelease(id, actor, req.Reason)
+	if err != nil {
+		ah.quarantineError(w, id, err)
+		return
+	}
+	log.Printf("Release of %s from quarantine %s requested by %s", entry.Guide, id, actor)
+	metrics.Inc("userguide_quarantine_actions_total", "action", "release_requested")
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusAccepted, entry)
+}
+
+// QuarantineApproveHandler serves POST /admin/quarantine/{id}/approve,
+// publishing a guide whose release another operator requested
+func (ah *AdminHandler) QuarantineApproveHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !ah.permitted(w, r, "quarantine.approve", id) {
+		return
+	}
+	ah.releaseQuarantined(w, r, id, requestActor(r, ah.utils))
+}
+
+func (ah *AdminHandler) releaseQuarantined(w http.ResponseWriter, r *http.Request, id, actor string) {
+	result, err := ah.quarantine.Release(r.Context(), id, actor, ah.uploads)
+	if err != nil {
+		ah.quarantineError(w, id, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, result)
+}
+
+// QuarantinePurgeHandler serves DELETE /admin/quarantine/{id}, deleting a
+// quarantined guide for good
+func (ah *AdminHandler) QuarantinePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !ah.permitted(w, r, "quarantine.purge", id) {
+		return
+	}
+	entry, err := ah.quarantine.Purge(id, requestActor(r, ah.utils))
+	if err != nil {
+		ah.quarantineError(w, id, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// quarantineError answers a failed quarantine operation
+func (ah *AdminHandler) quarantineError(w http.ResponseWriter, id string, err error) {
+	switch {
+	case errors.Is(err, ErrQuarantineNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrReleaseConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrRejectedContent):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Quarantine operation on %s failed: %s", id, err.Error())
+		http.Error(w, "Quarantine operation failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,169 @@
+package userguide
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultTenant names the quota applied to products without their own
+const DefaultTenant = "default"
+
+// ErrQuotaExceeded is returned when an upload would exceed a tenant quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the storage used by one product; zero means unlimited
+type Quota struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int   `json:"maxFiles"`
+}
+
+// TenantUsage reports a product's storage use against its quota
+type TenantUsage struct {
+	Product string `json:"product"`
+	Bytes   int64  `json:"bytes"`
+	Files   int    `json:"files"`
+	Quota   Quota  `json:"quota"`
+}
+
+// QuotaManager enforces per-product storage quotas in multi-product mode
+type QuotaManager struct {
+	// guides returns the storage guides are served from
+	guides func() Storage
+	quotas map[string]Quota
+	utils  *Utils
+}
+
+// NewQuotaManager creates a quota manager for the guides guides returns
+func NewQuotaManager(config *Config, guides func() Storage) *QuotaManager {
+	return &QuotaManager{
+		guides: guides,
+		quotas: config.Quotas,
+		utils:  &Utils{policy: &config.FilenamePolicy},
+	}
+}
+
+// QuotaFor returns the quota that applies to a product
+func (qm *QuotaManager) QuotaFor(product string) Quota {
+	if q, ok := qm.quotas[product]; ok {
+		return q
+	}
+	return qm.quotas[DefaultTenant]
+}
+
+// usage totals the objects stored directly below each product prefix;
+// with product set, only that product's
+func (qm *QuotaManager) usage(ctx context.Context, product string) (map[string]*TenantUsage, error) {
+	prefix := ""
+	if product != "" {
+		prefix = product + "/"
+	}
+	objects, err := qm.guides().List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]*TenantUsage)
+	for _, object := range objects {
+		owner, name, ok := strings.Cut(object.Key, "/")
+		if !ok || strings.Contains(name, "/") || qm.utils.IsExcluded(name) {
+			continue
+		}
+		if usage[owner] == nil {
+			usage[owner] = &TenantUsage{Product: owner, Quota: qm.QuotaFor(owner)}
+		}
+		usage[owner].Bytes += object.Size
+		usage[owner].Files++
+	}
+	return usage, nil
+}
+
+// Usage totals the visible guide files stored for a product
+func (qm *QuotaManager) Usage(ctx context.Context, product string) (TenantUsage, error) {
+	usage, err := qm.usage(ctx, product)
+	if err != nil {
+		return TenantUsage{Product: product, Quota: qm.QuotaFor(product)}, err
+	}
+	if u, ok := usage[product]; ok {
+		return *u, nil
+	}
+	return TenantUsage{Product: product, Quota: qm.QuotaFor(product)}, nil
+}
+
+// Check returns ErrQuotaExceeded if storing size bytes as name would push the
+// product over its quota. Replacing an existing file only counts the difference.
+func (qm *QuotaManager) Check(ctx context.Context, product, name string, size int64) error {
+	usage, err := qm.Usage(ctx, product)
+	if err != nil {
+		return err
+	}
+
+	bytes, files := usage.Bytes+size, usage.Files+1
+	if info, err := qm.guides().Stat(ctx, product+"/"+name); err == nil {
+		bytes -= info.Size
+		files--
+	}
+
+	if usage.Quota.MaxBytes > 0 && bytes > usage.Quota.MaxBytes {
+		return fmt.Errorf("%w: %s would use %d of %d bytes", ErrQuotaExceeded, product, bytes, usage.Quota.MaxBytes)
+	}
+	if usage.Quota.MaxFiles > 0 && files > usage.Quota.MaxFiles {
+		return fmt.Errorf("%w: %s would store %d of %d files", ErrQuotaExceeded, product, files, usage.Quota.MaxFiles)
+	}
+	return nil
+}
+
+// Report returns usage for every product holding guides
+func (qm *QuotaManager) Report(ctx context.Context) ([]TenantUsage, error) {
+	usage, err := qm.usage(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	report := []TenantUsage{}
+	for _, u := range usage {
+		report = append(report, *u)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Product < report[j].Product })
+	return report, nil
+}
+
+// UsageHandler reports per-product storage usage against quotas
+func (ah *AdminHandler) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.permitted(w, r, "usage.read", "usage") {
+		return
+	}
+	report, err := ah.quotas.Report(r.Context())
+	if err != nil {
+		log.Printf("Usage report failed: %s", err.Error())
+		http.Error(w, "Usage not available", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// parseQuotaProperty applies a quota.<product>.<field> property
+func parseQuotaProperty(config *Config, key, value string) error {
+	product, field, ok := strings.Cut(key, ".")
+	if !ok {
+		return fmt.Errorf("expected quota.<product>.<field>")
+	}
+
+	quota := config.Quotas[product]
+	var err error
+	switch field {
+	case "max.bytes":
+		quota.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+	case "max.files":
+		quota.MaxFiles, err = strconv.Atoi(value)
+	default:
+		err = fmt.Errorf("unknown quota field %q", field)
+	}
+	config.Quotas[product] = quota
+	return err
+}
@@ -0,0 +1,47 @@
+package userguide
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQuotaUsageFromStorage(t *testing.T) {
+	config := DefaultConfig()
+	config.MemorySeed = MemorySeedNone
+	config.UserGuidePath = t.TempDir() // holds nothing; usage must come from storage
+	config.Quotas["acme"] = Quota{MaxFiles: 2}
+	store, err := NewMemoryStorage(config)
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	for key, body := range map[string]string{
+		"acme/setup-guide.pdf":   "%PDF-1.7 setup",
+		"acme/install-guide.pdf": "%PDF-1.7 install",
+		"globex/user-guide.pdf":  "%PDF-1.7 user",
+		"user-guide.pdf":         "%PDF-1.7 top level",
+	} {
+		if err := store.Put(ctx, key, strings.NewReader(body)); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	quotas := NewQuotaManager(config, func() Storage { return store })
+
+	report, err := quotas.Report(ctx)
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if len(report) != 2 || report[0].Product != "acme" || report[0].Files != 2 || report[0].Bytes != 30 || report[1].Product != "globex" {
+		t.Errorf("report = %+v", report)
+	}
+
+	if err := quotas.Check(ctx, "acme", "setup-guide.pdf", 10); err != nil {
+		t.Errorf("replacing a guide: %v", err)
+	}
+	if err := quotas.Check(ctx, "acme", "new-guide.pdf", 10); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("third guide: %v, want ErrQuotaExceeded", err)
+	}
+}
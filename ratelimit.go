@@ -0,0 +1,193 @@
+package userguide
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate limiter stores
+const (
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreRedis  = "redis"
+)
+
+// RateLimiter decides whether a client may make another request
+type RateLimiter interface {
+	// Allow takes one token from the key's bucket, refilled at rate tokens
+	// per second up to burst, and reports what is left
+	Allow(ctx context.Context, key string, rate float64, burst int) RateLimitStatus
+}
+
+// RateLimitStatus is a rate limit decision with the state of the bucket
+type RateLimitStatus struct {
+	Allowed bool
+	// Remaining is the number of whole tokens left
+	Remaining int
+	// RetryAfter is how long until a token is available when not allowed
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// unlimited is the status for buckets with no rate
+var unlimited = RateLimitStatus{Allowed: true}
+
+// NewRateLimiter creates the limiter selected by qos.ratelimit.store
+func NewRateLimiter(config *Config) RateLimiter {
+	if config.RateLimitStore == RateLimitStoreRedis {
+		return newRedisLimiter(NewRedisClient(config))
+	}
+	return newTokenBucketLimiter()
+}
+
+// tokenBucketLimiter is an in-process token bucket limiter keyed by client
+type tokenBucketLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	lastGC  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket refills to its burst at its own rate
+	full time.Time
+}
+
+func newTokenBucketLimiter() *tokenBucketLimiter {
+	return &tokenBucketLimiter{
+		buckets: make(map[string]*tokenBucket),
+		lastGC:  time.Now(),
+	}
+}
+
+// Allow implements RateLimiter for a single process
+func (l *tokenBucketLimiter) Allow(_ context.Context, key string, rate float64, burst int) RateLimitStatus {
+	if rate <= 0 {
+		return unlimited
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.collectIdle(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	status := RateLimitStatus{Allowed: b.tokens >= 1}
+	if status.Allowed {
+		b.tokens--
+	} else {
+		status.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	status.Remaining = int(b.tokens)
+	status.Reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	b.full = now.Add(status.Reset)
+	return status
+}
+
+// collectIdle drops buckets that have been idle long enough to be full
+// again. Keys of different tiers refill at different rates, so each bucket
+// is judged by its own refill time.
+func (l *tokenBucketLimiter) collectIdle(now time.Time) {
+	if now.Sub(l.lastGC) < time.Minute {
+		return
+	}
+	l.lastGC = now
+
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// redisLimiter shares token buckets across replicas through Redis. If Redis
+// is unreachable it falls back to per-process limits rather than failing
+// every request.
+type redisLimiter struct {
+	redis    *RedisClient
+	fallback *tokenBucketLimiter
+}
+
+// tokenBucketScript refills and takes from a bucket atomically using the
+// server clock, so replicas with skewed clocks share one consistent bucket
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait, math.floor(tokens), math.ceil((burst - tokens) / rate * 1000)}
+`
+
+func newRedisLimiter(client *RedisClient) *redisLimiter {
+	return &redisLimiter{redis: client, fallback: newTokenBucketLimiter()}
+}
+
+// Allow implements RateLimiter across all replicas sharing the Redis server
+func (l *redisLimiter) Allow(ctx context.Context, key string, rate float64, burst int) RateLimitStatus {
+	if rate <= 0 {
+		return unlimited
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	status, err := l.take(ctx, key, rate, burst)
+	if err != nil {
+		log.Printf("Rate limit store unavailable, using local limits: %s", err.Error())
+		metrics.Inc("userguide_ratelimit_store_errors_total")
+		return l.fallback.Allow(ctx, key, rate, burst)
+	}
+	return status
+}
+
+func (l *redisLimiter) take(ctx context.Context, key string, rate float64, burst int) (RateLimitStatus, error) {
+	reply, err := l.redis.Do(ctx, "EVAL", tokenBucketScript, "1", "userguide:ratelimit:"+key,
+		fmt.Sprint(rate), fmt.Sprint(burst))
+	if err != nil {
+		return RateLimitStatus{}, err
+	}
+	result, ok := reply.([]interface{})
+	if !ok || len(result) != 4 {
+		return RateLimitStatus{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := result[0].(int64)
+	waitMillis, _ := result[1].(int64)
+	remaining, _ := result[2].(int64)
+	resetMillis, _ := result[3].(int64)
+	return RateLimitStatus{
+		Allowed:    allowed == 1,
+		Remaining:  int(remaining),
+		RetryAfter: time.Duration(waitMillis) * time.Millisecond,
+		Reset:      time.Duration(resetMillis) * time.Millisecond,
+	}, nil
+}
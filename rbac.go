@@ -0,0 +1,290 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rbacPolicyFile is the layout of rbac.policy.file: guide patterns, as in
+// authz.acl, mapped to the roles that may download matching guides.
+// Restricted guides are named protected/<name> and product guides
+// <product>/<name>. Guides matching no pattern need default_roles, or no
+// role when it is empty.
+type rbacPolicyFile struct {
+	Guides       map[string][]string `json:"guides"`
+	DefaultRoles []string            `json:"default_roles"`
+}
+
+// RBACPolicy requires roles per guide. Roles come from the JWT claim named
+// by rbac.roles.claim (validated bearer tokens and OpenID sign-ins) and from
+// the scopes of the API key; the "*" scope holds every role. The policy
+// file is re-read when its modification time changes.
+type RBACPolicy struct {
+	path string
+	// Guide names are derived from paths under these directories
+	basePath      string
+	protectedPath string
+
+	mu           sync.Mutex
+	modTime      time.Time
+	loaded       bool
+	patterns     []string
+	rules        map[string][]string
+	defaultRoles []string
+}
+
+// NewRBACPolicy loads rbac.policy.file; it returns nil when none is configured
+func NewRBACPolicy(config *Config) (*RBACPolicy, error) {
+	if config.RBACPolicyFile == "" {
+		return nil, nil
+	}
+	policy := &RBACPolicy{path: config.RBACPolicyFile, basePath: config.UserGuidePath, protectedPath: config.ProtectedPath}
+	if err := policy.reload(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// reload re-reads the policy file if it changed since it was last read
+func (p *RBACPolicy) reload() error {
+	stat, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	unchanged := p.loaded && stat.ModTime().Equal(p.modTime)
+	p.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var file rbacPolicyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("parsing %s: %w", p.path, err)
+	}
+	patterns := make([]string, 0, len(file.Guides))
+	for pattern, roles := range file.Guides {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%s: invalid guide pattern %q", p.path, pattern)
+		}
+		if len(roles) == 0 {
+			return fmt.Errorf("%s: guide pattern %q lists no roles", p.path, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	sortBySpecificity(patterns)
+
+	p.mu.Lock()
+	p.patterns = patterns
+	p.rules = file.Guides
+	p.defaultRoles = file.DefaultRoles
+	p.modTime = stat.ModTime()
+	p.loaded = true
+	p.mu.Unlock()
+	metrics.Set("userguide_rbac_rules_loaded", float64(len(patterns)))
+	return nil
+}
+
+// Required returns the roles that may download guide, any one of which is
+// enough, and the pattern that decided; no roles means anyone may
+func (p *RBACPolicy) Required(guide string) ([]string, string) {
+	if err := p.reload(); err != nil {
+		// Keep enforcing the last good copy of the file
+		log.Printf("Unable to reload RBAC policy from %s: %s", p.path, err.Error())
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pattern := range p.patterns {
+		if matched, _ := path.Match(pattern, guide); matched {
+			return p.rules[pattern], pattern
+		}
+	}
+	return p.defaultRoles, ""
+}
+
+// Rules returns the guide patterns, most specific first, with their roles
+func (p *RBACPolicy) Rules() ([]string, map[string][]string) {
+	if err := p.reload(); err != nil {
+		log.Printf("Unable to reload RBAC policy from %s: %s", p.path, err.Error())
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.patterns), p.rules
+}
+
+// Allows reports whether roles include one the guide requires
+func (p *RBACPolicy) Allows(guide string, roles []string) bool {
+	required, _ := p.Required(guide)
+	return grants(roles, required)
+}
+
+// Check returns nil when roles include one the guide requires; callers who
+// presented no credentials are told to authenticate
+func (p *RBACPolicy) Check(guide string, roles []string, authenticated bool) error {
+	if p.Allows(guide, roles) {
+		return nil
+	}
+	required, _ := p.Required(guide)
+	metrics.Inc("userguide_rbac_denied_total")
+	if !authenticated {
+		return fmt.Errorf("%w: %s requires a role", ErrUnauthenticated, guide)
+	}
+	return fmt.Errorf("%w: %s requires one of the roles %v", ErrForbidden, guide, required)
+}
+
+// Scope returns a view of files that refuses guides the roles of the
+// request do not grant
+func (p *RBACPolicy) Scope(ctx context.Context, files FileServiceInterface) FileServiceInterface {
+	return &rbacFileService{
+		FileServiceInterface: files,
+		policy:               p,
+		roles:                rolesFromContext(ctx),
+		authenticated:        APIKeyFromContext(ctx) != nil || JWTClaimsFromContext(ctx) != nil || OIDCSessionFromContext(ctx) != nil,
+	}
+}
+
+// rbacFileService checks the role requirements of a guide before handing
+// out its path
+type rbacFileService struct {
+	FileServiceInterface
+	policy        *RBACPolicy
+	roles         []string
+	authenticated bool
+}
+
+func (rs *rbacFileService) DownloadUserGuide() (string, error) {
+	return rs.check(rs.FileServiceInterface.DownloadUserGuide())
+}
+
+func (rs *rbacFileService) DownloadUserGuideFor(clientKey string) (string, string, error) {
+	filePath, variant, err := rs.FileServiceInterface.DownloadUserGuideFor(clientKey)
+	filePath, err = rs.check(filePath, err)
+	return filePath, variant, err
+}
+
+func (rs *rbacFileService) DownloadProductGuide(product, filename string) (string, error) {
+	return rs.check(rs.FileServiceInterface.DownloadProductGuide(product, filename))
+}
+
+func (rs *rbacFileService) DownloadReleaseGuide(product, release string) (string, error) {
+	return rs.check(rs.FileServiceInterface.DownloadReleaseGuide(product, release))
+}
+
+func (rs *rbacFileService) DownloadProtectedGuide(filename string) (string, error) {
+	return rs.check(rs.FileServiceInterface.DownloadProtectedGuide(filename))
+}
+
+func (rs *rbacFileService) DownloadGuide(filename string) (string, error) {
+	return rs.check(rs.FileServiceInterface.DownloadGuide(filename))
+}
+
+// check withholds a resolved path unless the roles grant its guide
+func (rs *rbacFileService) check(filePath string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if err := rs.policy.Check(rs.policy.guideName(filePath), rs.roles, rs.authenticated); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// guideName names a resolved guide the way policies and authorizers do
+func (p *RBACPolicy) guideName(filePath string) string {
+	if p.protectedPath != "" {
+		if rel, err := filepath.Rel(p.protectedPath, filePath); err == nil && filepath.IsLocal(rel) {
+			return protectedGuidePrefix + filepath.ToSlash(rel)
+		}
+	}
+	if rel, err := filepath.Rel(p.basePath, filePath); err == nil && filepath.IsLocal(rel) {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(filePath)
+}
+
+// rolesFromContext collects the roles granted by the credentials the
+// request's guards accepted
+func rolesFromContext(ctx context.Context) []string {
+	var roles []string
+	if key := APIKeyFromContext(ctx); key != nil {
+		roles = append(roles, key.Scopes...)
+	}
+	if claims := JWTClaimsFromContext(ctx); claims != nil {
+		roles = append(roles, claims.Roles...)
+	}
+	if session := OIDCSessionFromContext(ctx); session != nil {
+		roles = append(roles, session.Roles...)
+	}
+	slices.Sort(roles)
+	return slices.Compact(roles)
+}
+
+// guidePermission is one policy rule as it applies to the caller
+type guidePermission struct {
+	Guides  string   `json:"guides"`
+	Roles   []string `json:"roles"`
+	Allowed bool     `json:"allowed"`
+}
+
+// permissionsResponse is the body of GET /rbac/permissions
+type permissionsResponse struct {
+	Subject string            `json:"subject"`
+	Roles   []string          `json:"roles"`
+	Rules   []guidePermission `json:"rules"`
+	// Guide is set when the query names one
+	Guide *guidePermission `json:"guide,omitempty"`
+}
+
+// PermissionsHandler reports the caller's roles and which guide patterns
+// they grant; ?guide=<name> checks one guide. Credentials are those the
+// route's guards accept, so list it with the download routes in
+// apikeys.routes or oidc.routes.
+func (fh *FileHandler) PermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	roles := rolesFromContext(r.Context())
+	resp := permissionsResponse{
+		Subject: identityFromRequest(r, fh.utils).Subject,
+		Roles:   roles,
+		Rules:   []guidePermission{},
+	}
+	if resp.Roles == nil {
+		resp.Roles = []string{}
+	}
+
+	patterns, rules := fh.rbac.Rules()
+	for _, pattern := range patterns {
+		required := rules[pattern]
+		resp.Rules = append(resp.Rules, guidePermission{Guides: pattern, Roles: required, Allowed: grants(roles, required)})
+	}
+	if guide := r.URL.Query().Get("guide"); guide != "" {
+		required, _ := fh.rbac.Required(guide)
+		resp.Guide = &guidePermission{Guides: guide, Roles: required, Allowed: grants(roles, required)}
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// grants reports whether roles satisfy a requirement of any one of required
+func grants(roles, required []string) bool {
+	if len(required) == 0 || slices.Contains(roles, "*") {
+		return true
+	}
+	for _, role := range roles {
+		if slices.Contains(required, role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,473 @@
+package userguide
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Recording modes for contract test fixtures
+const (
+	RecordingOff    = "off"
+	RecordingRecord = "record"
+	RecordingReplay = "replay"
+)
+
+// redacted replaces credentials in recorded requests and responses
+const redacted = "[redacted]"
+
+// recordedRequestHeaders change the response and are part of a fixture's key
+var recordedRequestHeaders = []string{"Accept-Encoding", "If-None-Match", "If-Modified-Since", "Range", InstalledVersionHeader, TicketIDHeader, CustomerIDHeader, "Save-Data", "ECT", "Sec-CH-UA-Mobile"}
+
+// credentialHeaders carry credentials; requests sending one are never
+// recorded or replayed
+var credentialHeaders = []string{"Authorization", "Cookie", "X-API-Key", LicenseKeyHeader}
+
+// liveRoutes are route prefixes behind authentication or link tokens. They
+// always reach the service, in both modes, so a stub checks credentials as
+// the service does and restricted guides and admin responses never end up in
+// fixture files.
+var liveRoutes = []string{"/protected/", "/token/", "/admin/", "/upload/", "/replication/", "/auth/", "/download/token/", "/download/resume/"}
+
+// credentialParams are query parameters whose values are redacted
+var credentialParams = []string{"token", "sig", "signature", "key", "api_key", "access_token"}
+
+// credentialFields are JSON body fields whose values are redacted, besides
+// token and fields ending in _token. Key fingerprints and virus signature
+// names are not credentials and stay readable.
+var credentialFields = []string{"sig", "api_key", "license_key", "client_secret", "private_key", "password"}
+
+// tokenPaths are route prefixes followed by a link token
+var tokenPaths = []string{"/download/token/", "/download/resume/", "/preview/"}
+
+// credentialLinkParts find credentials in bodies that are not valid JSON,
+// such as truncated ones: link tokens and credential query values
+var credentialLinkParts = regexp.MustCompile(`((?:/download/token/|/download/resume/|/preview/)|[?&](?:token|sig|signature|key|api_key|access_token)=)[^"&#?\s]+`)
+
+// volatileResponseHeaders differ on every response and are not recorded
+var volatileResponseHeaders = []string{"Date", "Content-Digest", DownloadIDHeader}
+
+// Recording is one sanitized request/response pair
+type Recording struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest identifies the requests a recording answers
+type RecordedRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Query   string            `json:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// RecordedResponse is replayed verbatim; Body is base64 in the fixture file
+type RecordedResponse struct {
+	Status        int               `json:"status"`
+	Headers       map[string]string `json:"headers"`
+	Body          []byte            `json:"body"`
+	BodyTruncated bool              `json:"body_truncated,omitempty"`
+}
+
+// Recorder writes request/response pairs to fixture files, or serves
+// responses from them, so client teams can run contract tests against a
+// deterministic stub of the service
+type Recorder struct {
+	mode         string
+	dir          string
+	maxBodyBytes int64
+
+	mu       sync.RWMutex
+	fixtures map[string]*Recording
+}
+
+// NewRecorder creates a recorder; in replay mode the fixtures are loaded
+// from the recording directory
+func NewRecorder(config *Config) (*Recorder, error) {
+	rec := &Recorder{
+		mode:         config.RecordingMode,
+		dir:          config.RecordingPath,
+		maxBodyBytes: config.RecordingMaxBodyBytes,
+		fixtures:     make(map[string]*Recording),
+	}
+	switch rec.mode {
+	case RecordingRecord:
+		if err := os.MkdirAll(rec.dir, 0755); err != nil {
+			return nil, err
+		}
+	case RecordingReplay:
+		if err := rec.load(); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// Middleware records or replays every anonymous request except metrics
+// scrapes; requests with credentials and live routes are served as usual
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" || liveRoute(r.URL.Path) || hasCredentials(r) {
+			metrics.Inc("userguide_recordings_total", "mode", rec.mode, "result", "passed")
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch rec.mode {
+		case RecordingRecord:
+			rec.record(w, r, next)
+		case RecordingReplay:
+			rec.replay(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// record serves the request and stores the sanitized exchange
+func (rec *Recorder) record(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	rw := &recordingWriter{ResponseWriter: w, limit: rec.maxBodyBytes}
+	next.ServeHTTP(rw, r)
+
+	request := sanitizeRequest(r)
+	recording := &Recording{
+		Request: request,
+		Response: RecordedResponse{
+			Status:        rw.statusCode(),
+			Headers:       sanitizeResponseHeaders(w.Header()),
+			Body:          rw.body.Bytes(),
+			BodyTruncated: rw.truncated,
+		},
+	}
+	sanitizeResponseBody(&recording.Response)
+	if err := rec.save(recording); err != nil {
+		log.Printf("Failed to record %s %s: %s", r.Method, r.URL.Path, err.Error())
+		metrics.Inc("userguide_recordings_total", "mode", rec.mode, "result", "error")
+		return
+	}
+	metrics.Inc("userguide_recordings_total", "mode", rec.mode, "result", "recorded")
+}
+
+// replay answers from the fixture matching the request, or 404 when none does
+func (rec *Recorder) replay(w http.ResponseWriter, r *http.Request) {
+	rec.mu.RLock()
+	recording, ok := rec.fixtures[sanitizeRequest(r).key()]
+	rec.mu.RUnlock()
+
+	w.Header().Set("X-Recording", "hit")
+	if !ok {
+		metrics.Inc("userguide_recordings_total", "mode", rec.mode, "result", "miss")
+		w.Header().Set("X-Recording", "miss")
+		http.Error(w, "No recorded response for this request", http.StatusNotFound)
+		return
+	}
+	metrics.Inc("userguide_recordings_total", "mode", rec.mode, "result", "hit")
+	for name, value := range recording.Response.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(recording.Response.Status)
+	if r.Method != http.MethodHead {
+		w.Write(recording.Response.Body)
+	}
+}
+
+// save writes a recording to its fixture file, replacing earlier recordings
+// of the same request
+func (rec *Recorder) save(recording *Recording) error {
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(rec.dir, recording.Request.fileName())
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load reads every fixture in the recording directory
+func (rec *Recorder) load() error {
+	paths, err := filepath.Glob(filepath.Join(rec.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	fixtures := make(map[string]*Recording, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var recording Recording
+		if err := json.Unmarshal(data, &recording); err != nil {
+			return fmt.Errorf("invalid recording %s: %v", path, err)
+		}
+		fixtures[recording.Request.key()] = &recording
+	}
+
+	rec.mu.Lock()
+	rec.fixtures = fixtures
+	rec.mu.Unlock()
+	log.Printf("Loaded %d recorded responses from %s", len(fixtures), rec.dir)
+	return nil
+}
+
+// liveRoute reports whether path is served by the service in every mode
+func liveRoute(path string) bool {
+	for _, prefix := range liveRoutes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCredentials reports whether a request sends a credential header or
+// query parameter, such as a bearer token, an API key or a URL signature
+func hasCredentials(r *http.Request) bool {
+	for _, name := range credentialHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	query := r.URL.Query()
+	for name := range query {
+		for _, credential := range credentialParams {
+			if strings.EqualFold(name, credential) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sanitizeRequest reduces an anonymous request to the parts that select a
+// response
+func sanitizeRequest(r *http.Request) RecordedRequest {
+	request := RecordedRequest{
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Query:   r.URL.Query().Encode(),
+		Headers: make(map[string]string),
+	}
+	for _, name := range recordedRequestHeaders {
+		if value := r.Header.Get(name); value != "" {
+			request.Headers[name] = value
+		}
+	}
+	return request
+}
+
+// sanitizeQuery encodes a query with sorted keys and credentials redacted
+func sanitizeQuery(query url.Values) string {
+	for name := range query {
+		for _, credential := range credentialParams {
+			if strings.EqualFold(name, credential) {
+				query[name] = []string{redacted}
+			}
+		}
+	}
+	return query.Encode()
+}
+
+// sanitizePath redacts the link token of token routes
+func sanitizePath(path string) string {
+	for _, prefix := range tokenPaths {
+		if strings.HasPrefix(path, prefix) && len(path) > len(prefix) {
+			return prefix + redacted
+		}
+	}
+	return path
+}
+
+// sanitizeURL redacts link tokens and credential query values in a URL,
+// such as a signed or token download link; other strings are returned as is
+func sanitizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	changed := false
+	if path := sanitizePath(u.Path); path != u.Path {
+		u.Path, u.RawPath = path, path
+		changed = true
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		if sanitized := sanitizeQuery(query); sanitized != u.RawQuery && strings.Contains(sanitized, url.QueryEscape(redacted)) {
+			u.RawQuery = sanitized
+			changed = true
+		}
+	}
+	if !changed {
+		return raw
+	}
+	return u.String()
+}
+
+// sanitizeResponseHeaders drops volatile headers and redacts cookies, resume
+// tokens and the credentials of redirect links
+func sanitizeResponseHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for name, values := range header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	for _, name := range volatileResponseHeaders {
+		delete(headers, http.CanonicalHeaderKey(name))
+	}
+	for _, name := range []string{"Set-Cookie", ResumeTokenHeader} {
+		if _, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+			headers[http.CanonicalHeaderKey(name)] = redacted
+		}
+	}
+	if location, ok := headers["Location"]; ok {
+		headers["Location"] = sanitizeURL(location)
+	}
+	return headers
+}
+
+// sanitizeResponseBody redacts credentials in JSON bodies, such as the
+// links of /sign and the token exchange: credential fields, and link
+// tokens and credential query values in every string
+func sanitizeResponseBody(response *RecordedResponse) {
+	if !strings.Contains(response.Headers["Content-Type"], "json") || len(response.Body) == 0 {
+		return
+	}
+	var body interface{}
+	if response.BodyTruncated || json.Unmarshal(response.Body, &body) != nil {
+		response.Body = credentialLinkParts.ReplaceAll(response.Body, []byte("${1}"+redacted))
+	} else {
+		sanitized, err := json.Marshal(sanitizeJSON(body))
+		if err != nil {
+			return
+		}
+		response.Body = append(sanitized, '\n')
+	}
+	if _, ok := response.Headers["Content-Length"]; ok {
+		response.Headers["Content-Length"] = strconv.Itoa(len(response.Body))
+	}
+}
+
+// sanitizeJSON redacts credentials in a decoded JSON value
+func sanitizeJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			if _, ok := field.(string); ok && credentialField(name) {
+				v[name] = redacted
+			} else {
+				v[name] = sanitizeJSON(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = sanitizeJSON(item)
+		}
+	case string:
+		return sanitizeURL(v)
+	}
+	return value
+}
+
+// credentialField reports whether a JSON field holds a credential
+func credentialField(name string) bool {
+	name = strings.ToLower(name)
+	if name == "token" || strings.HasSuffix(name, "_token") {
+		return true
+	}
+	for _, credential := range credentialFields {
+		if name == credential {
+			return true
+		}
+	}
+	return false
+}
+
+// key identifies the request across recording and replay
+func (rr RecordedRequest) key() string {
+	names := make([]string, 0, len(rr.Headers))
+	for name := range rr.Headers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", rr.Method, rr.Path, rr.Query)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s: %s\n", name, rr.header(name))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// header looks up a recorded header regardless of case
+func (rr RecordedRequest) header(name string) string {
+	for key, value := range rr.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// fixtureNameChars matches runs of characters unsafe in fixture file names
+var fixtureNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// fileName names a fixture after its request so the directory is browsable
+func (rr RecordedRequest) fileName() string {
+	path := strings.Trim(fixtureNameChars.ReplaceAllString(rr.Path, "_"), "_")
+	return fmt.Sprintf("%s_%s_%s.json", rr.Method, path, rr.key()[:12])
+}
+
+// recordingWriter keeps a copy of the status and up to limit body bytes
+type recordingWriter struct {
+	http.ResponseWriter
+	status    int
+	limit     int64
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	if room := rw.limit - int64(rw.body.Len()); room < int64(n) {
+		rw.body.Write(p[:max(room, 0)])
+		rw.truncated = true
+	} else {
+		rw.body.Write(p[:n])
+	}
+	return n, err
+}
+
+// statusCode returns the status sent, which is 200 if the handler wrote nothing
+func (rw *recordingWriter) statusCode() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,91 @@
+package userguide
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"userguide_api_poc/samples"
+)
+
+// recordedFixtures returns the fixture files in dir
+func recordedFixtures(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("list fixtures: %v", err)
+	}
+	return paths
+}
+
+func TestRecordingSkipsCredentials(t *testing.T) {
+	dir := t.TempDir()
+	h := newProtectedHarness(t, func(config *Config) {
+		config.RecordingMode = RecordingRecord
+		config.RecordingPath = dir
+	})
+
+	if resp := h.Get(t, "/download/userguide", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("public download status = %d, want 200", resp.StatusCode)
+	}
+	if resp := h.Get(t, "/protected/download", "Bearer alpha-token"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("protected download status = %d, want 200", resp.StatusCode)
+	}
+	if resp := h.Get(t, "/download/userguide", "Bearer alpha-token"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("public download with credentials status = %d, want 200", resp.StatusCode)
+	}
+
+	fixtures := recordedFixtures(t, dir)
+	if len(fixtures) != 1 || !strings.Contains(filepath.Base(fixtures[0]), "download_userguide") {
+		t.Fatalf("fixtures = %v, want only the anonymous public download", fixtures)
+	}
+	for _, path := range fixtures {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read fixture: %v", err)
+		}
+		if bytes.Contains(data, []byte("alpha-token")) {
+			t.Errorf("%s holds the bearer token", path)
+		}
+	}
+}
+
+func TestReplayChecksCredentials(t *testing.T) {
+	dir := t.TempDir()
+	record := newProtectedHarness(t, func(config *Config) {
+		config.RecordingMode = RecordingRecord
+		config.RecordingPath = dir
+	})
+	record.Get(t, "/download/userguide", "")
+	record.Get(t, "/protected/download", "Bearer alpha-token")
+
+	h := newProtectedHarness(t, func(config *Config) {
+		config.RecordingMode = RecordingReplay
+		config.RecordingPath = dir
+	})
+
+	resp := h.Get(t, "/download/userguide", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Recording") != "hit" {
+		t.Fatalf("anonymous download: status = %d, X-Recording = %q, want a replayed 200", resp.StatusCode, resp.Header.Get("X-Recording"))
+	}
+	if body := readBody(t, resp); !bytes.Equal(body, samples.PDF("User Guide")) {
+		t.Errorf("replayed body is not the recorded guide")
+	}
+
+	for _, auth := range []string{"", "Bearer wrong-token"} {
+		resp := h.Get(t, "/protected/download", auth)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("auth %q: status = %d, want 401", auth, resp.StatusCode)
+		}
+		if resp.Header.Get("X-Recording") != "" {
+			t.Errorf("auth %q: answered by the recorder", auth)
+		}
+	}
+	resp = h.Get(t, "/protected/download", "Bearer alpha-token")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Recording") != "" {
+		t.Errorf("valid token: status = %d, X-Recording = %q, want the service's 200", resp.StatusCode, resp.Header.Get("X-Recording"))
+	}
+}
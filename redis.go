@@ -0,0 +1,180 @@
+package userguide
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// errRedisNil is returned for RESP null replies
+var errRedisNil = errors.New("redis: nil")
+
+// RedisClient is a minimal RESP2 client with a small connection pool
+type RedisClient struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisClient creates a client for the configured Redis server
+func NewRedisClient(config *Config) *RedisClient {
+	return &RedisClient{
+		address:  config.RedisAddress,
+		password: config.RedisPassword,
+		db:       config.RedisDB,
+		timeout:  config.RedisTimeout,
+		pool:     make(chan *redisConn, 8),
+	}
+}
+
+// Do sends a command and returns its reply: string, int64, []interface{} or nil
+func (rc *RedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := rc.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(ctx, rc.timeout, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection state is unknown after I/O errors
+		c.conn.Close()
+		return nil, err
+	}
+	rc.put(c)
+	return reply, err
+}
+
+func (rc *RedisClient) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-rc.pool:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: rc.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", rc.address)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if rc.password != "" {
+		if _, err := c.do(ctx, rc.timeout, "AUTH", rc.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if rc.db != 0 {
+		if _, err := c.do(ctx, rc.timeout, "SELECT", strconv.Itoa(rc.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (rc *RedisClient) put(c *redisConn) {
+	select {
+	case rc.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// Close closes the idle pooled connections
+func (rc *RedisClient) Close() {
+	for {
+		select {
+		case c := <-rc.pool:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (c *redisConn) do(ctx context.Context, timeout time.Duration, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: short reply")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
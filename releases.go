@@ -0,0 +1,77 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// releaseMatrixFile is the per-product release metadata inside a product directory
+const releaseMatrixFile = ".releases.json"
+
+// releasePattern matches firmware release identifiers such as 2.4.1 or 3.0.0-rc1
+var releasePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,63}$`)
+
+// ReleaseMatrix maps a product's releases to guide filenames. Keys are exact
+// releases or prefixes ending in "*" such as "2.4.*"; an exact entry wins,
+// otherwise the longest matching prefix, so every release resolves to
+// exactly one guide or none.
+type ReleaseMatrix map[string]string
+
+// Resolve returns the guide filename for a release
+func (m ReleaseMatrix) Resolve(release string) (string, bool) {
+	if filename, ok := m[release]; ok {
+		return filename, true
+	}
+
+	best, filename := -1, ""
+	for pattern, name := range m {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(release, prefix) && len(prefix) > best {
+			best, filename = len(prefix), name
+		}
+	}
+	return filename, best >= 0
+}
+
+// loadReleaseMatrix reads a product's .releases.json from store; a missing
+// file is an empty matrix
+func loadReleaseMatrix(ctx context.Context, store Storage, product string) (ReleaseMatrix, error) {
+	file, err := store.Open(ctx, product+"/"+releaseMatrixFile)
+	if errors.Is(err, ErrObjectNotFound) || os.IsNotExist(err) {
+		return ReleaseMatrix{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var matrix ReleaseMatrix
+	if err := json.NewDecoder(file).Decode(&matrix); err != nil {
+		return nil, fmt.Errorf("invalid %s of %s: %v", releaseMatrixFile, product, err)
+	}
+	return matrix, nil
+}
+
+// parseReleaseProperty applies a release.<product>.<release> property
+func parseReleaseProperty(config *Config, key, value string) error {
+	product, release, ok := strings.Cut(key, ".")
+	if !ok || release == "" {
+		return fmt.Errorf("expected release.<product>.<release>")
+	}
+	if !productPattern.MatchString(product) {
+		return fmt.Errorf("invalid product name %q", product)
+	}
+	if !releasePattern.MatchString(strings.TrimSuffix(release, "*")) && release != "*" {
+		return fmt.Errorf("invalid release %q", release)
+	}
+
+	if config.Releases[product] == nil {
+		config.Releases[product] = ReleaseMatrix{}
+	}
+	config.Releases[product][release] = value
+	return nil
+}
@@ -0,0 +1,389 @@
+package userguide
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Replication roles
+const (
+	ReplicationNone      = "none"
+	ReplicationPrimary   = "primary"
+	ReplicationSecondary = "secondary"
+)
+
+// ReplicationPublishedAtHeader carries the time the guide was published on the primary
+const ReplicationPublishedAtHeader = "X-Replication-Published-At"
+
+// Replicator pushes published guides from the primary region to secondaries.
+// Each target has its own queue, so a slow or unreachable region does not
+// hold back the others.
+type Replicator struct {
+	basePath string
+	token    string
+	maxLag   time.Duration
+	retry    time.Duration
+	client   *http.Client
+	store    *ChecksumStore
+	targets  []*replicaTarget
+	utils    *Utils
+}
+
+// replicaTarget is one secondary region and the guides it has not received yet
+type replicaTarget struct {
+	url     string
+	mu      sync.Mutex
+	pending []replicationItem
+	wake    chan struct{}
+}
+
+// replicationItem is a guide version waiting to be pushed. since is when the
+// oldest unreplicated version of the guide was published, so replacing a
+// queued version with a newer one does not hide the lag; published is when
+// the queued version was.
+type replicationItem struct {
+	name      string
+	sha256    string
+	since     time.Time
+	published time.Time
+}
+
+// NewReplicator creates a replicator for the configured secondary regions
+func NewReplicator(config *Config, store *ChecksumStore) *Replicator {
+	rep := &Replicator{
+		basePath: config.UserGuidePath,
+		token:    config.ReplicationToken,
+		maxLag:   config.ReplicationMaxLag,
+		retry:    config.ReplicationRetryInterval,
+		client:   NewHTTPClient(config, config.ReplicationTimeout),
+		store:    store,
+		utils:    &Utils{policy: &config.FilenamePolicy},
+	}
+	for _, target := range config.ReplicationTargets {
+		rep.targets = append(rep.targets, &replicaTarget{url: strings.TrimSuffix(target, "/"), wake: make(chan struct{}, 1)})
+	}
+	events.Subscribe(rep.onEvent)
+	return rep
+}
+
+// onEvent queues newly published guides for every target
+func (rep *Replicator) onEvent(e Event) {
+	if e.Type != EventGuidePublished {
+		return
+	}
+	for _, target := range rep.targets {
+		target.enqueue(replicationItem{name: e.Subject, sha256: e.Data["sha256"], since: e.Time, published: e.Time})
+	}
+}
+
+func (t *replicaTarget) enqueue(item replicationItem) {
+	t.mu.Lock()
+	replaced := false
+	for i, queued := range t.pending {
+		if queued.name == item.name {
+			t.pending[i].sha256 = item.sha256
+			t.pending[i].published = item.published
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		t.pending = append(t.pending, item)
+	}
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest queued guide
+func (t *replicaTarget) next() (replicationItem, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return replicationItem{}, false
+	}
+	return t.pending[0], true
+}
+
+// done removes a pushed guide unless a newer version was queued meanwhile
+func (t *replicaTarget) done(item replicationItem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, queued := range t.pending {
+		if queued.name == item.name {
+			if queued.sha256 == item.sha256 {
+				t.pending = append(t.pending[:i], t.pending[i+1:]...)
+			} else {
+				t.pending[i].since = queued.published
+			}
+			return
+		}
+	}
+}
+
+// lag returns how long the oldest queued guide has been waiting
+func (t *replicaTarget) lag() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var oldest time.Duration
+	for _, item := range t.pending {
+		oldest = max(oldest, time.Since(item.since))
+	}
+	return oldest
+}
+
+// Run pushes queued guides to every target until ctx is cancelled
+func (rep *Replicator) Run(ctx context.Context) {
+	for _, target := range rep.targets {
+		go rep.push(ctx, target)
+	}
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		rep.reportLag()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rep *Replicator) push(ctx context.Context, target *replicaTarget) {
+	for {
+		item, ok := target.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-target.wake:
+				continue
+			}
+		}
+
+		err := rep.send(ctx, target.url, item)
+		if err == nil {
+			target.done(item)
+			metrics.Inc("userguide_replication_pushes_total", "target", target.url, "result", "success")
+			continue
+		}
+		log.Printf("Replication of %s to %s failed: %s", item.name, target.url, err.Error())
+		metrics.Inc("userguide_replication_pushes_total", "target", target.url, "result", "error")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rep.retry):
+		}
+	}
+}
+
+// send uploads one guide with its checksum to a secondary
+func (rep *Replicator) send(ctx context.Context, targetURL string, item replicationItem) error {
+	file, err := openGuide(filepath.Join(rep.basePath, filepath.FromSlash(item.name)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := url.JoinPath(targetURL, append([]string{"replication", "guides"}, strings.Split(item.name, "/")...)...)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", endpoint, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Authorization", "Bearer "+rep.token)
+	req.Header.Set(ChecksumSHA256Header, item.sha256)
+	req.Header.Set(ReplicationPublishedAtHeader, item.since.Format(time.RFC3339Nano))
+
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("secondary returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Resync compares every target's manifest with the local checksums and
+// queues the guides a target is missing or holds an older version of. It
+// catches up secondaries after a primary restart lost its queues.
+func (rep *Replicator) Resync(ctx context.Context) error {
+	if err := rep.store.Reload(); err != nil {
+		return err
+	}
+	local := rep.store.All()
+
+	var failed []string
+	for _, target := range rep.targets {
+		remote, err := rep.manifest(ctx, target.url)
+		if err != nil {
+			log.Printf("Replication resync with %s failed: %s", target.url, err.Error())
+			failed = append(failed, target.url)
+			continue
+		}
+		for name, sum := range local {
+			if rep.utils.IsExcluded(name) {
+				continue
+			}
+			if remote[name] != sum {
+				now := time.Now().UTC()
+				target.enqueue(replicationItem{name: name, sha256: sum, since: now, published: now})
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to resync %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (rep *Replicator) manifest(ctx context.Context, targetURL string) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", targetURL+"/replication/manifest", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+rep.token)
+
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secondary returned %s", resp.Status)
+	}
+	manifest := make(map[string]string)
+	return manifest, json.NewDecoder(resp.Body).Decode(&manifest)
+}
+
+// reportLag publishes per-target lag metrics and the replication health
+func (rep *Replicator) reportLag() {
+	var behind []string
+	for _, target := range rep.targets {
+		lag := target.lag()
+		metrics.Set("userguide_replication_lag_seconds", lag.Seconds(), "target", target.url)
+		if lag > rep.maxLag {
+			behind = append(behind, fmt.Sprintf("%s (%s)", target.url, lag.Round(time.Second)))
+		}
+	}
+	if len(behind) > 0 {
+		health.Set("replication", StatusDegraded, "lagging: "+strings.Join(behind, ", "))
+	} else {
+		health.Set("replication", StatusHealthy, "")
+	}
+}
+
+// ReplicationHandler receives guides pushed from the primary on a secondary
+type ReplicationHandler struct {
+	uploadService *UploadService
+	checksums     *ChecksumStore
+	token         string
+	maxLag        time.Duration
+}
+
+// NewReplicationHandler creates the secondary side of replication
+func NewReplicationHandler(uploadService *UploadService, checksums *ChecksumStore, config *Config) *ReplicationHandler {
+	return &ReplicationHandler{
+		uploadService: uploadService,
+		checksums:     checksums,
+		token:         config.ReplicationToken,
+		maxLag:        config.ReplicationMaxLag,
+	}
+}
+
+// RegisterRoutes registers the replication routes with the router
+func (rh *ReplicationHandler) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/replication/guides/{name}", rh.ReceiveHandler).Methods("PUT")
+	r.HandleFunc("/replication/guides/{product}/{name}", rh.ReceiveHandler).Methods("PUT")
+	r.HandleFunc("/replication/manifest", rh.ManifestHandler).Methods("GET")
+}
+
+// authorized checks the replication bearer token
+func (rh *ReplicationHandler) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(rh.token)) == 1
+}
+
+// ReceiveHandler stores a guide pushed by the primary after verifying its checksum
+func (rh *ReplicationHandler) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
+	if !rh.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sum, err := hex.DecodeString(r.Header.Get(ChecksumSHA256Header))
+	if err != nil || len(sum) == 0 {
+		http.Error(w, "Missing or invalid "+ChecksumSHA256Header+" header", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	result, err := rh.uploadService.Publish(r.Context(), vars["product"], vars["name"], r.Body, r.ContentLength, Checksums{SHA256: sum}, ScheduleEntry{})
+	if err != nil {
+		log.Printf("Replicated guide rejected: %s", err.Error())
+		metrics.Inc("userguide_replication_received_total", "result", "error")
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, ErrChecksumMismatch), errors.Is(err, ErrRejectedContent):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, ErrInsufficientStorage):
+			status = http.StatusInsufficientStorage
+		case errors.Is(err, ErrLockTimeout):
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	metrics.Inc("userguide_replication_received_total", "result", "success")
+	if publishedAt, err := time.Parse(time.RFC3339Nano, r.Header.Get(ReplicationPublishedAtHeader)); err == nil {
+		lag := time.Since(publishedAt)
+		metrics.Set("userguide_replication_applied_lag_seconds", lag.Seconds())
+		if lag > rh.maxLag {
+			health.Set("replication", StatusDegraded, fmt.Sprintf("last guide arrived %s after publish", lag.Round(time.Second)))
+		} else {
+			health.Set("replication", StatusHealthy, "")
+		}
+	}
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// ManifestHandler returns the checksums of every guide held by this region
+func (rh *ReplicationHandler) ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	if !rh.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := rh.checksums.Reload(); err != nil {
+		http.Error(w, "Unable to read manifest", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, rh.checksums.All())
+}
@@ -0,0 +1,184 @@
+package userguide
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ResumeTokenHeader carries the token that lets a client continue an
+// interrupted protected download instead of starting over
+const ResumeTokenHeader = "X-Resume-Token"
+
+// ErrGuideChanged is returned when a download is resumed after the guide
+// was replaced, so the bytes already received belong to another version
+var ErrGuideChanged = errors.New("guide changed since the download started")
+
+// IssueResume returns a token naming the guide version being downloaded. It
+// is handed out with the download and is only useful together with fresh
+// credentials, which POST /token/resume requires.
+func (dt *DownloadTokens) IssueResume(guide, sha256 string) string {
+	return dt.seal(purposeResume, time.Now().Add(dt.resumeTTL), guide, sha256)
+}
+
+// VerifyResume checks a resume token and returns its guide and checksum
+func (dt *DownloadTokens) VerifyResume(token string) (string, string, error) {
+	fields, err := dt.open(purposeResume, token, 2)
+	if err != nil {
+		return "", "", err
+	}
+	return fields[0], fields[1], nil
+}
+
+// IssueResumeLink returns a short-lived token granting the rest of a guide
+// version from offset
+func (dt *DownloadTokens) IssueResumeLink(guide, sha256 string, offset int64) (string, time.Time) {
+	expires := time.Now().Add(dt.ttl)
+	return dt.seal(purposeResumeLink, expires, guide, sha256, strconv.FormatInt(offset, 10)), expires
+}
+
+// VerifyResumeLink checks a resume link and returns its guide, checksum and offset
+func (dt *DownloadTokens) VerifyResumeLink(token string) (string, string, int64, error) {
+	fields, err := dt.open(purposeResumeLink, token, 3)
+	if err != nil {
+		return "", "", 0, err
+	}
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || offset < 0 {
+		return "", "", 0, ErrDownloadTokenInvalid
+	}
+	return fields[0], fields[1], offset, nil
+}
+
+// offerResume attaches a resume token for the guide version about to be served
+func (fh *FileHandler) offerResume(w http.ResponseWriter, guide, filePath string) {
+	sum, err := fh.versions.Version(filePath)
+	if err != nil {
+		return
+	}
+	w.Header().Set(ResumeTokenHeader, fh.downloadTokens.IssueResume(guide, sum))
+}
+
+// resumeRequest is the body of POST /token/resume
+type resumeRequest struct {
+	ResumeToken string `json:"resume_token"`
+	Offset      int64  `json:"offset"`
+}
+
+// resumeResponse carries the link that continues the download
+type resumeResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	Offset    int64     `json:"offset"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ResumeTokenHandler exchanges a resume token, the number of bytes already
+// received and fresh bearer credentials for a link to the rest of the
+// guide; the route is guarded like /token/download
+func (fh *FileHandler) ResumeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	var req resumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResumeToken == "" || req.Offset < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "request body must be {\"resume_token\": token, \"offset\": bytes received}"})
+		return
+	}
+	guide, sum, err := fh.downloadTokens.VerifyResume(req.ResumeToken)
+	if err != nil {
+		metrics.Inc("userguide_download_resumes_total", "result", "invalid")
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "resume token invalid or expired"})
+		return
+	}
+	filePath, size, err := fh.resumable(fh.guides(r), guide, sum)
+	if errors.Is(err, ErrGuideChanged) {
+		metrics.Inc("userguide_download_resumes_total", "result", "changed")
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeGuideError(w, err)
+		return
+	}
+	if req.Offset >= size {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "offset must be less than the guide size " + strconv.FormatInt(size, 10)})
+		return
+	}
+	if !fh.authorized(w, r, protectedGuidePrefix+filepath.Base(filePath)) {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	token, expires := fh.downloadTokens.IssueResumeLink(guide, sum, req.Offset)
+	metrics.Inc("userguide_download_resumes_total", "result", "issued")
+	writeJSON(w, http.StatusOK, resumeResponse{
+		Token:     token,
+		URL:       "/download/resume/" + token,
+		Offset:    req.Offset,
+		ExpiresAt: expires.UTC(),
+	})
+}
+
+// ResumeDownloadHandler serves a guide from the offset named by a resume
+// link, provided the guide is still the version the download started with
+func (fh *FileHandler) ResumeDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	guide, sum, offset, err := fh.downloadTokens.VerifyResumeLink(mux.Vars(r)["token"])
+	if err != nil {
+		log.Printf("Rejected resume link from %s: %s", r.RemoteAddr, err.Error())
+		metrics.Inc("userguide_download_token_rejections_total")
+		http.Error(w, "Resume link invalid or expired", http.StatusForbidden)
+		return
+	}
+	filePath, _, err := fh.resumable(fh.fileService, guide, sum)
+	if errors.Is(err, ErrGuideChanged) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeGuideError(w, err)
+		return
+	}
+
+	safeFilename := filepath.Base(filePath)
+	w.Header().Set("Content-Type", fh.utils.GetContentType(safeFilename))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+fh.utils.EscapeForHeader(safeFilename)+"\"")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set(GuideVersionHeader, sum)
+
+	// The offset addresses the stored bytes, never a compressed sibling
+	r.Header.Del("Accept-Encoding")
+	r.Header.Del("If-Range")
+	r.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+
+	log.Printf("Resuming protected guide %s at byte %d for %s", safeFilename, offset, r.RemoteAddr)
+	metrics.Inc("userguide_download_resumes_total", "result", "served")
+	fileServer.ServeFile(w, r, filePath)
+}
+
+// resumable resolves a guide with files and checks it is still the version
+// with sum
+func (fh *FileHandler) resumable(files FileServiceInterface, guide, sum string) (string, int64, error) {
+	filePath, err := files.DownloadProtectedGuide(guide)
+	if err != nil {
+		return "", 0, err
+	}
+	current, err := fh.versions.Version(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	if current != sum {
+		return "", 0, ErrGuideChanged
+	}
+	info, err := statGuide(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	return filePath, info.Size(), nil
+}
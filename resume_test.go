@@ -0,0 +1,120 @@
+package userguide
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"userguide_api_poc/samples"
+)
+
+func TestResumeTokens(t *testing.T) {
+	config := DefaultConfig()
+	config.DownloadTokenSecret = "test-secret"
+	tokens := NewDownloadTokens(config)
+	sum := strings.Repeat("ab", 32)
+
+	resume := tokens.IssueResume("manual.pdf", sum)
+	if guide, got, err := tokens.VerifyResume(resume); err != nil || guide != "manual.pdf" || got != sum {
+		t.Fatalf("VerifyResume = %q, %q, %v", guide, got, err)
+	}
+	link, _ := tokens.IssueResumeLink("manual.pdf", sum, 100)
+	if guide, got, offset, err := tokens.VerifyResumeLink(link); err != nil || guide != "manual.pdf" || got != sum || offset != 100 {
+		t.Fatalf("VerifyResumeLink = %q, %q, %d, %v", guide, got, offset, err)
+	}
+
+	expired := *tokens
+	expired.ttl, expired.resumeTTL = -time.Second, -time.Second
+	staleLink, _ := expired.IssueResumeLink("manual.pdf", sum, 100)
+	download, _ := tokens.Issue("manual.pdf")
+
+	resumes := []struct {
+		name  string
+		token string
+	}{
+		{"expired", expired.IssueResume("manual.pdf", sum)},
+		{"other guide", retarget(resume, "user-guide.pdf")},
+		{"download token", download},
+		{"resume link", link},
+	}
+	for _, tt := range resumes {
+		if _, _, err := tokens.VerifyResume(tt.token); err != ErrDownloadTokenInvalid {
+			t.Errorf("resume token %s: err = %v, want ErrDownloadTokenInvalid", tt.name, err)
+		}
+	}
+	links := []struct {
+		name  string
+		token string
+	}{
+		{"expired", staleLink},
+		{"other guide", retarget(link, "user-guide.pdf")},
+		{"download token", download},
+		{"resume token", resume},
+	}
+	for _, tt := range links {
+		if _, _, _, err := tokens.VerifyResumeLink(tt.token); err != ErrDownloadTokenInvalid {
+			t.Errorf("resume link %s: err = %v, want ErrDownloadTokenInvalid", tt.name, err)
+		}
+	}
+}
+
+// requestResume exchanges a resume token for a link to the rest of a guide
+func requestResume(t *testing.T, h *testHarness, auth, token string, offset int64) *http.Response {
+	t.Helper()
+	body, _ := json.Marshal(resumeRequest{ResumeToken: token, Offset: offset})
+	return h.Post(t, "/token/resume", auth, body)
+}
+
+func TestResumeDownload(t *testing.T) {
+	h := newProtectedHarness(t, nil)
+	manual := samples.PDF("Manual")
+
+	issued := issueDownloadToken(t, h, "manual.pdf")
+	download := h.Get(t, issued.URL, "")
+	resume := download.Header.Get(ResumeTokenHeader)
+	if resume == "" {
+		t.Fatal("no resume token offered with the download")
+	}
+
+	if resp := requestResume(t, h, "", resume, 10); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("resume without credentials: status = %d, want 401", resp.StatusCode)
+	}
+	if resp := requestResume(t, h, "Bearer alpha-token", issued.Token, 10); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("download token as a resume token: status = %d, want 403", resp.StatusCode)
+	}
+	if resp := requestResume(t, h, "Bearer alpha-token", resume, int64(len(manual))); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("offset past the end: status = %d, want 400", resp.StatusCode)
+	}
+
+	resp := requestResume(t, h, "Bearer alpha-token", resume, 10)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("resume: status = %d, want 200", resp.StatusCode)
+	}
+	var link resumeResponse
+	json.NewDecoder(resp.Body).Decode(&link)
+
+	rest := h.Get(t, link.URL, "")
+	if rest.StatusCode != http.StatusPartialContent {
+		t.Fatalf("GET %s: status = %d, want 206", link.URL, rest.StatusCode)
+	}
+	if body := readBody(t, rest); !bytes.Equal(body, manual[10:]) {
+		t.Errorf("resumed download is not manual.pdf from byte 10")
+	}
+	for _, guide := range []string{"user-guide.pdf", "../user-guide.pdf"} {
+		if resp := h.Get(t, "/download/resume/"+retarget(link.Token, guide), ""); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("link edited to %s: status = %d, want 403", guide, resp.StatusCode)
+		}
+	}
+	if resp := h.Get(t, "/download/token/"+link.Token, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("resume link as a download link: status = %d, want 403", resp.StatusCode)
+	}
+
+	// The bytes already received belong to the replaced version
+	h.AddProtectedGuide(t, "manual.pdf", samples.PDF("Manual, second edition"))
+	if resp := h.Get(t, link.URL, ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("link after the guide changed: status = %d, want 409", resp.StatusCode)
+	}
+}
@@ -0,0 +1,407 @@
+package userguide
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageBackendS3 names the Amazon S3 guide store
+const StorageBackendS3 = "s3"
+
+func init() {
+	RegisterStorage(StorageBackendS3, func(config *Config) (Storage, error) { return NewS3Storage(config) })
+}
+
+// s3Unsigned is the payload hash of requests whose body is not signed,
+// which S3 accepts over any transport
+const s3Unsigned = "UNSIGNED-PAYLOAD"
+
+// S3Storage keeps guides as objects in an S3 bucket, below an optional key
+// prefix. Requests are signed with AWS Signature Version 4. The serving
+// layer reads guides through a local copy in the cache directory; object
+// metadata is re-checked with HEAD at most once per ttl.
+type S3Storage struct {
+	client    *http.Client
+	transfers *http.Client
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string
+	pathStyle bool
+	creds     *awsCredentialSource
+	cache     *objectCache
+}
+
+// NewS3Storage creates a storage of the s3.bucket objects below s3.prefix
+func NewS3Storage(config *Config) (*S3Storage, error) {
+	if config.S3Bucket == "" {
+		return nil, fmt.Errorf("storage.type=%s needs s3.bucket", StorageBackendS3)
+	}
+	address := config.S3Endpoint
+	if address == "" {
+		address = "https://s3." + config.S3Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(address, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" ||
+		endpoint.RawQuery != "" || endpoint.Fragment != "" {
+		return nil, fmt.Errorf("invalid s3.endpoint %q", address)
+	}
+	cacheDir := config.S3CachePath
+	if cacheDir == "" {
+		cacheDir = filepath.Join(config.UserGuidePath, ".s3-cache")
+	}
+	prefix := strings.Trim(config.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &S3Storage{
+		client: NewHTTPClient(config, 0),
+		// Guide transfers take as long as they take; the transport still
+		// bounds dialing and idle connections
+		transfers: &http.Client{Transport: outboundTransport(config)},
+		// Gateways may serve S3 below a path, which every request keeps
+		endpoint:  &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: endpoint.Path},
+		bucket:    config.S3Bucket,
+		region:    config.S3Region,
+		prefix:    prefix,
+		pathStyle: config.S3PathStyle,
+		creds:     newAWSCredentialSource(config),
+	}
+	if s.cache, err = newObjectCache(StorageBackendS3, s.String(), cacheDir, config.S3CacheTTL); err != nil {
+		return nil, err
+	}
+	s.cache.head = s.head
+	s.cache.download = func(ctx context.Context, info ObjectInfo) (io.ReadCloser, error) { return s.Open(ctx, info.Key) }
+	return s, nil
+}
+
+// String describes the bucket for logs
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("s3://%s/%s at %s", s.bucket, s.prefix, s.endpoint.Host)
+}
+
+func (s *S3Storage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkObjectKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, s.transfers, http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Error(resp, key); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.cache.Stat(ctx, key)
+}
+
+// head reads the metadata of key with a HEAD request
+func (s *S3Storage) head(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, s.client, http.MethodHead, key, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := s3Error(resp, key); err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// LocalPath returns the cached copy of key, downloading it when needed
+func (s *S3Storage) LocalPath(ctx context.Context, key string) (string, error) {
+	return s.cache.LocalPath(ctx, key)
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		page, err := s.listPage(ctx, prefix, token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(object.Key, s.prefix)
+			if checkObjectKey(key) != nil || hiddenKey(key) {
+				continue
+			}
+			objects = append(objects, ObjectInfo{Key: key, Size: object.Size, ModTime: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// s3ListResult is a ListObjectsV2 response
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listPage lists one page of the objects below prefix; maxKeys 0 leaves the
+// page size to S3
+func (s *S3Storage) listPage(ctx context.Context, prefix, token string, maxKeys int) (*s3ListResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	resp, err := s.do(ctx, s.client, http.MethodGet, "", query, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := s3Error(resp, "bucket "+s.bucket); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var page s3ListResult
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&page); err != nil {
+		return nil, fmt.Errorf("invalid list response: %v", err)
+	}
+	return &page, nil
+}
+
+// Put uploads body under key. S3 needs the length up front, so bodies other
+// than files and in-memory readers are spooled to the cache directory first.
+func (s *S3Storage) Put(ctx context.Context, key string, body io.Reader) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	spooled, size, cleanup, err := spoolBody(s.cache.dir, body)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	resp, err := s.do(ctx, s.transfers, http.MethodPut, key, nil, io.NopCloser(spooled), size)
+	s.cache.Forget(key)
+	if err != nil {
+		return err
+	}
+	if err := s3Error(resp, key); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, s.client, http.MethodDelete, key, nil, nil, 0)
+	s.cache.Forget(key)
+	if err != nil {
+		return err
+	}
+	if err := s3Error(resp, key); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+	resp.Body.Close()
+	s.cache.Remove(key)
+	return nil
+}
+
+// Probe checks that the bucket can be listed, for the storage health check
+func (s *S3Storage) Probe(ctx context.Context) error {
+	_, err := s.listPage(ctx, "", "", 1)
+	return err
+}
+
+// checkObjectKey refuses keys that could not have come from LocalStorage
+func checkObjectKey(key string) error {
+	if !fs.ValidPath(key) || key == "." {
+		return fmt.Errorf("%w: invalid key %q", ErrObjectNotFound, key)
+	}
+	return nil
+}
+
+// hiddenKey reports whether any part of key starts with a dot; like hidden
+// files, such objects are never listed
+func hiddenKey(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends a signed request for key, or for the bucket when key is empty
+func (s *S3Storage) do(ctx context.Context, client *http.Client, method, key string, query url.Values, body io.ReadCloser, size int64) (*http.Response, error) {
+	creds, err := s.creds.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials: %v", err)
+	}
+
+	target := *s.endpoint
+	objectPath := ""
+	if key != "" {
+		objectPath = s.prefix + key
+	}
+	if s.pathStyle {
+		target.Path += "/" + s.bucket
+		if objectPath != "" {
+			target.Path += "/" + objectPath
+		}
+	} else {
+		target.Host = s.bucket + "." + target.Host
+		target.Path += "/" + objectPath
+	}
+	target.RawPath = s3Escape(target.Path, false)
+	target.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+		req.ContentLength = size
+	}
+	signAWSRequest(req, creds, s.region, "s3", time.Now())
+	return client.Do(req)
+}
+
+// s3Error closes the body of a failed response and describes the failure;
+// a missing key or bucket is ErrObjectNotFound
+func s3Error(resp *http.Response, what string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	var failure struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+	if resp.StatusCode == http.StatusNotFound && failure.Code != "NoSuchBucket" {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, what)
+	}
+	if failure.Code == "" {
+		return fmt.Errorf("s3 %s: %s", what, resp.Status)
+	}
+	return fmt.Errorf("s3 %s: %s: %s", what, failure.Code, failure.Message)
+}
+
+// signAWSRequest adds AWS Signature Version 4 headers to req. The body is
+// sent unsigned unless X-Amz-Content-Sha256 already holds its hash.
+func signAWSRequest(req *http.Request, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", s3Unsigned)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+	canonical := awsCanonicalRequest(req, signed)
+	signedHeaders := strings.Join(signed, ";")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// awsCanonicalRequest is the canonical form of req that Signature Version 4
+// signs, covering the named headers, which must be sorted and lower case
+func awsCanonicalRequest(req *http.Request, signed []string) string {
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	return strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		strings.Join(signed, ";"),
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query sorted by name and then value, as signing
+// requires
+func s3CanonicalQuery(query url.Values) string {
+	type pair struct{ name, value string }
+	var pairs []pair
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, pair{s3Escape(name, true), s3Escape(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].name != pairs[j].name {
+			return pairs[i].name < pairs[j].name
+		}
+		return pairs[i].value < pairs[j].value
+	})
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.name + "=" + p.value
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters and, unless
+// slash is set, the path separator
+func s3Escape(value string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !slash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,72 @@
+// Package samples holds the sample guides of demo mode and the memory
+// storage, and generates guides for the test doubles in testutil. It is
+// linked into the server, so it must not depend on testing code.
+package samples
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+)
+
+// guides is the embedded sample guide tree; all: keeps the dot files of
+// release matrices
+//
+//go:embed all:guides
+var guides embed.FS
+
+// Guides returns the sample guides laid out like userguide.path: a user
+// guide with its canary, a markdown guide and the acme product with a
+// release matrix
+func Guides() fs.FS {
+	sub, err := fs.Sub(guides, "guides")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// PDF returns a small valid one-page PDF showing title
+func PDF(title string) []byte {
+	stream := fmt.Sprintf("BT /F1 24 Tf 72 720 Td (%s) Tj ET", pdfEscape(title))
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// Markdown returns a short markdown guide titled title
+func Markdown(title string) []byte {
+	return []byte(fmt.Sprintf("# %s\n\nThis is a generated sample guide.\n\n## Getting started\n\n1. Unpack the device.\n2. Connect power.\n3. Follow the on-screen setup.\n", title))
+}
+
+// pdfEscape escapes the characters that end or nest a PDF string literal
+func pdfEscape(s string) string {
+	var buf bytes.Buffer
+	for _, c := range s {
+		if c == '(' || c == ')' || c == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
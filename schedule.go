@@ -0,0 +1,404 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// scheduleFile is the name of the publish/expiry manifest inside the guide directory
+const scheduleFile = ".schedule.json"
+
+// Directories inside the guide directory for guides that are not served:
+// uploads waiting for their publishAt, and guides removed at their expireAt
+const (
+	embargoDir = ".embargoed"
+	archiveDir = ".archive"
+)
+
+// Scheduled guide transitions
+const (
+	TransitionPublish = "publish"
+	TransitionExpire  = "expire"
+)
+
+// ScheduleEntry holds the launch and expiry times of a guide; a zero time
+// means no transition is scheduled
+type ScheduleEntry struct {
+	PublishAt time.Time `json:"publishAt,omitzero"`
+	ExpireAt  time.Time `json:"expireAt,omitzero"`
+}
+
+// IsZero reports whether the entry schedules nothing
+func (e ScheduleEntry) IsZero() bool {
+	return e.PublishAt.IsZero() && e.ExpireAt.IsZero()
+}
+
+// ScheduledTransition is an upcoming change to a guide
+type ScheduledTransition struct {
+	Guide      string    `json:"guide"`
+	Transition string    `json:"transition"`
+	At         time.Time `json:"at"`
+}
+
+// GuideSchedule persists publishAt/expireAt per guide and applies them:
+// embargoed guides are moved into the served tree at launch time and expired
+// ones into the archive. Like the checksum manifest it may be shared by
+// several replicas, so updates hold the manifest lock.
+type GuideSchedule struct {
+	mu        sync.Mutex
+	path      string
+	basePath  string
+	locker    Locker
+	checksums *ChecksumStore
+	entries   map[string]ScheduleEntry
+}
+
+// NewGuideSchedule loads the schedule manifest from the guide directory
+func NewGuideSchedule(basePath string, checksums *ChecksumStore, locker Locker) (*GuideSchedule, error) {
+	gs := &GuideSchedule{
+		path:      filepath.Join(basePath, scheduleFile),
+		basePath:  basePath,
+		locker:    locker,
+		checksums: checksums,
+		entries:   make(map[string]ScheduleEntry),
+	}
+	if err := gs.load(); err != nil {
+		return nil, err
+	}
+	return gs, nil
+}
+
+// Get returns the schedule of a guide
+func (gs *GuideSchedule) Get(name string) (ScheduleEntry, bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	entry, ok := gs.entries[name]
+	return entry, ok
+}
+
+// Set records a guide's schedule and persists the manifest; a zero entry
+// removes the guide from the schedule
+func (gs *GuideSchedule) Set(ctx context.Context, name string, entry ScheduleEntry) error {
+	unlock, err := gs.locker.Lock(ctx, scheduleFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if err := gs.load(); err != nil {
+		return err
+	}
+	if _, ok := gs.entries[name]; !ok && entry.IsZero() {
+		return nil
+	}
+	if entry.IsZero() {
+		delete(gs.entries, name)
+	} else {
+		gs.entries[name] = entry
+	}
+	return gs.save()
+}
+
+// EmbargoPath returns where a guide waits until its publishAt
+func (gs *GuideSchedule) EmbargoPath(name string) string {
+	return filepath.Join(gs.basePath, embargoDir, filepath.FromSlash(name))
+}
+
+// Upcoming returns every scheduled transition in the order they will happen
+func (gs *GuideSchedule) Upcoming() []ScheduledTransition {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	transitions := []ScheduledTransition{}
+	for name, entry := range gs.entries {
+		if !entry.PublishAt.IsZero() {
+			transitions = append(transitions, ScheduledTransition{Guide: name, Transition: TransitionPublish, At: entry.PublishAt})
+		}
+		if !entry.ExpireAt.IsZero() {
+			transitions = append(transitions, ScheduledTransition{Guide: name, Transition: TransitionExpire, At: entry.ExpireAt})
+		}
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		if !transitions[i].At.Equal(transitions[j].At) {
+			return transitions[i].At.Before(transitions[j].At)
+		}
+		return transitions[i].Guide < transitions[j].Guide
+	})
+	return transitions
+}
+
+// Reload picks up schedule changes made by other replicas
+func (gs *GuideSchedule) Reload() error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.load()
+}
+
+// Run applies every transition that is due
+func (gs *GuideSchedule) Run(ctx context.Context) error {
+	if err := gs.Reload(); err != nil {
+		return err
+	}
+	var failed []string
+	pending := map[string]int{TransitionPublish: 0, TransitionExpire: 0}
+	now := time.Now()
+	for _, t := range gs.Upcoming() {
+		if now.Before(t.At) {
+			pending[t.Transition]++
+			continue
+		}
+		var err error
+		if t.Transition == TransitionPublish {
+			err = gs.publish(ctx, t.Guide)
+		} else {
+			err = gs.expire(ctx, t.Guide)
+		}
+		if err != nil {
+			log.Printf("Scheduled %s of %s failed: %s", t.Transition, t.Guide, err.Error())
+			metrics.Inc("userguide_schedule_transitions_total", "transition", t.Transition, "result", "error")
+			failed = append(failed, t.Guide)
+			continue
+		}
+		metrics.Inc("userguide_schedule_transitions_total", "transition", t.Transition, "result", "success")
+	}
+	for transition, count := range pending {
+		metrics.Set("userguide_schedule_pending", float64(count), "transition", transition)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("transitions failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// publish lifts the embargo of a guide by moving it into the served tree
+func (gs *GuideSchedule) publish(ctx context.Context, name string) error {
+	unlock, err := gs.locker.Lock(ctx, "guide:"+name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := gs.Reload(); err != nil {
+		return err
+	}
+	entry, ok := gs.Get(name)
+	if !ok || entry.PublishAt.IsZero() || time.Now().Before(entry.PublishAt) {
+		// Rescheduled or published by another replica meanwhile
+		return nil
+	}
+
+	source := gs.EmbargoPath(name)
+	target := filepath.Join(gs.basePath, filepath.FromSlash(name))
+	if _, err := os.Stat(source); errors.Is(err, os.ErrNotExist) {
+		log.Printf("Embargoed copy of %s is gone, dropping its launch", name)
+	} else {
+		sum, err := hashFile(source)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(source, target); err != nil {
+			return err
+		}
+		if err := gs.checksums.Set(ctx, name, sum); err != nil {
+			log.Printf("Warning: unable to record checksum for %s: %s", name, err.Error())
+		}
+		log.Printf("Embargo lifted, published %s", name)
+		events.Publish(Event{Type: EventGuidePublished, Subject: name, Data: map[string]string{"sha256": sum}})
+	}
+
+	entry.PublishAt = time.Time{}
+	return gs.Set(ctx, name, entry)
+}
+
+// expire moves a guide, or its embargoed copy if it never launched, into
+// the archive
+func (gs *GuideSchedule) expire(ctx context.Context, name string) error {
+	unlock, err := gs.locker.Lock(ctx, "guide:"+name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := gs.Reload(); err != nil {
+		return err
+	}
+	entry, ok := gs.Get(name)
+	if !ok || entry.ExpireAt.IsZero() || time.Now().Before(entry.ExpireAt) {
+		return nil
+	}
+
+	source := filepath.Join(gs.basePath, filepath.FromSlash(name))
+	if !entry.PublishAt.IsZero() {
+		source = gs.EmbargoPath(name)
+	}
+	target := filepath.Join(gs.basePath, archiveDir, time.Now().UTC().Format("20060102T150405Z"), filepath.FromSlash(name))
+	if _, err := os.Stat(source); errors.Is(err, os.ErrNotExist) {
+		log.Printf("Expired guide %s is already gone", name)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(source, target); err != nil {
+			return err
+		}
+		log.Printf("Guide %s expired, archived to %s", name, target)
+		events.Publish(Event{Type: EventGuideArchived, Subject: name})
+	}
+	if err := gs.checksums.Delete(ctx, name); err != nil {
+		log.Printf("Warning: unable to remove checksum for %s: %s", name, err.Error())
+	}
+	return gs.Set(ctx, name, ScheduleEntry{})
+}
+
+// load replaces the in-memory schedule with the manifest on disk; callers
+// must hold the lock
+func (gs *GuideSchedule) load() error {
+	data, err := os.ReadFile(gs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]ScheduleEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid schedule manifest %s: %v", gs.path, err)
+	}
+	gs.entries = entries
+	return nil
+}
+
+// save writes the manifest atomically; callers must hold the lock
+func (gs *GuideSchedule) save() error {
+	data, err := json.MarshalIndent(gs.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := gs.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, gs.path)
+}
+
+// parseScheduleHeaders reads X-Publish-At and X-Expire-At (RFC 3339) from
+// an upload request
+func parseScheduleHeaders(publishAt, expireAt string) (ScheduleEntry, error) {
+	var entry ScheduleEntry
+	var err error
+	if publishAt != "" {
+		if entry.PublishAt, err = time.Parse(time.RFC3339, publishAt); err != nil {
+			return entry, fmt.Errorf("invalid %s header: must be an RFC 3339 time", PublishAtHeader)
+		}
+	}
+	if expireAt != "" {
+		if entry.ExpireAt, err = time.Parse(time.RFC3339, expireAt); err != nil {
+			return entry, fmt.Errorf("invalid %s header: must be an RFC 3339 time", ExpireAtHeader)
+		}
+	}
+	return entry, entry.validate(time.Now())
+}
+
+// validate rejects schedules that end before they start or are already over
+func (e ScheduleEntry) validate(now time.Time) error {
+	if !e.ExpireAt.IsZero() && !now.Before(e.ExpireAt) {
+		return fmt.Errorf("expireAt %s is in the past", e.ExpireAt.Format(time.RFC3339))
+	}
+	if !e.PublishAt.IsZero() && !e.ExpireAt.IsZero() && !e.PublishAt.Before(e.ExpireAt) {
+		return fmt.Errorf("expireAt must be after publishAt")
+	}
+	return nil
+}
+
+// state reports whether a guide is currently served and whether an
+// embargoed copy of it is waiting for launch
+func (gs *GuideSchedule) state(name string) (served, embargoed bool) {
+	_, err := os.Stat(filepath.Join(gs.basePath, filepath.FromSlash(name)))
+	served = err == nil
+	_, err = os.Stat(gs.EmbargoPath(name))
+	embargoed = err == nil
+	return served, embargoed
+}
+
+// ScheduleHandler lists upcoming launches and expiries, soonest first
+func (ah *AdminHandler) ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if !ah.permitted(w, r, "schedule.read", "schedule") {
+		return
+	}
+	if err := ah.schedule.Reload(); err != nil {
+		http.Error(w, "Unable to read schedule", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"transitions": ah.schedule.Upcoming()})
+}
+
+// UpdateScheduleHandler sets the publishAt and expireAt of a guide from a
+// JSON body; publishAt can only move the launch of an embargoed guide
+func (ah *AdminHandler) UpdateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, err := ah.utils.ValidateFilename(vars["name"])
+	if err == nil && vars["product"] != "" {
+		err = ah.utils.ValidateProductName(vars["product"])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	guide := path.Join(vars["product"], name)
+	if !ah.permitted(w, r, "schedule.write", guide) {
+		return
+	}
+
+	var entry ScheduleEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, "Invalid schedule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := entry.validate(time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	served, embargoed := ah.schedule.state(guide)
+	switch {
+	case !served && !embargoed:
+		http.Error(w, "Guide not found", http.StatusNotFound)
+		return
+	case embargoed && entry.PublishAt.IsZero():
+		http.Error(w, "publishAt is required while the guide is embargoed", http.StatusBadRequest)
+		return
+	case !embargoed && !entry.PublishAt.IsZero():
+		http.Error(w, "Guide is already published", http.StatusConflict)
+		return
+	}
+
+	if err := ah.schedule.Set(r.Context(), guide, entry); err != nil {
+		log.Printf("Unable to update schedule of %s: %s", guide, err.Error())
+		http.Error(w, "Unable to update schedule", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Schedule of %s set to publishAt=%s expireAt=%s", guide, formatScheduleTime(entry.PublishAt), formatScheduleTime(entry.ExpireAt))
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func formatScheduleTime(t time.Time) string {
+	if t.IsZero() {
+		return "none"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,78 @@
+package userguide
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Scheduler runs background jobs at fixed intervals
+type Scheduler struct {
+	leader LeaderElector
+	jobs   []scheduledJob
+}
+
+type scheduledJob struct {
+	name      string
+	interval  time.Duration
+	singleton bool
+	run       func(ctx context.Context) error
+}
+
+// NewScheduler creates an empty scheduler. Singleton jobs only run while
+// leader holds leadership; a nil leader means this is the only replica.
+func NewScheduler(leader LeaderElector) *Scheduler {
+	return &Scheduler{leader: leader}
+}
+
+// Every registers a job run on every replica once at start and then every interval
+func (s *Scheduler) Every(name string, interval time.Duration, run func(ctx context.Context) error) {
+	s.jobs = append(s.jobs, scheduledJob{name: name, interval: interval, run: run})
+}
+
+// Singleton registers a job that runs on the elected leader replica only
+func (s *Scheduler) Singleton(name string, interval time.Duration, run func(ctx context.Context) error) {
+	s.jobs = append(s.jobs, scheduledJob{name: name, interval: interval, singleton: true, run: run})
+}
+
+// Start launches leader election and all registered jobs until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+	if s.leader != nil {
+		go s.leader.Run(ctx)
+	}
+	for _, job := range s.jobs {
+		go s.loop(ctx, job)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, job scheduledJob) {
+	if job.singleton && s.leader != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.leader.Ready():
+		}
+	}
+
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		if job.singleton && s.leader != nil && !s.leader.IsLeader() {
+			metrics.Inc("userguide_job_runs_total", "job", job.name, "result", "skipped")
+		} else if err := job.run(ctx); err != nil {
+			log.Printf("Job %s failed: %s", job.name, err.Error())
+			metrics.Inc("userguide_job_runs_total", "job", job.name, "result", "error")
+		} else {
+			metrics.Inc("userguide_job_runs_total", "job", job.name, "result", "success")
+		}
+		metrics.Observe("userguide_job_duration_seconds", time.Since(start).Seconds(), "job", job.name)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package userguide
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// SecurityHeaders are the response headers securityMiddleware sets before
+// the handler runs; handlers may still override them (Cache-Control for
+// private guides, for example)
+type SecurityHeaders struct {
+	// All applies to every route
+	All map[string]string
+	// Groups override All for a header policy route group; an empty value
+	// disables the header for the group
+	Groups map[string]map[string]string
+}
+
+// defaultSecurityHeaders are sent unless security.header.* says otherwise.
+// Only guide downloads may be cached publicly; admin and auth responses
+// are never stored.
+func defaultSecurityHeaders() SecurityHeaders {
+	return SecurityHeaders{
+		All: map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+			"X-Xss-Protection":       "1; mode=block",
+			"Referrer-Policy":        "strict-origin-when-cross-origin",
+		},
+		Groups: map[string]map[string]string{
+			HeaderGroupDownload: {"Cache-Control": "public, max-age=3600"},
+			HeaderGroupAdmin:    {"Cache-Control": "no-store"},
+			HeaderGroupAuth:     {"Cache-Control": "no-store"},
+		},
+	}
+}
+
+// parseSecurityHeaderProperty applies security.header.<name> or
+// security.header.<group>.<name>; header names never contain dots
+func parseSecurityHeaderProperty(config *Config, key, value string) error {
+	name := key
+	target := config.SecurityHeaders.All
+	if group, rest, ok := strings.Cut(key, "."); ok {
+		if !slices.Contains(headerGroups, group) {
+			return fmt.Errorf("unknown group %q, must be one of %s", group, strings.Join(headerGroups, ", "))
+		}
+		if config.SecurityHeaders.Groups[group] == nil {
+			config.SecurityHeaders.Groups[group] = make(map[string]string)
+		}
+		name, target = rest, config.SecurityHeaders.Groups[group]
+	}
+	if name == "" || strings.ContainsAny(name, " :") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	target[http.CanonicalHeaderKey(name)] = value
+	return nil
+}
+
+// securityHeaderSet is the resolved list of headers for one route group
+type securityHeaderSet []struct{ name, value string }
+
+// resolveSecurityHeaders merges the group overrides into All for each group,
+// dropping disabled headers
+func resolveSecurityHeaders(headers SecurityHeaders) map[string]securityHeaderSet {
+	resolved := make(map[string]securityHeaderSet)
+	for _, group := range headerGroups {
+		merged := make(map[string]string, len(headers.All))
+		for name, value := range headers.All {
+			merged[name] = value
+		}
+		for name, value := range headers.Groups[group] {
+			merged[name] = value
+		}
+		var set securityHeaderSet
+		for name, value := range merged {
+			if value != "" {
+				set = append(set, struct{ name, value string }{name, value})
+			}
+		}
+		sort.Slice(set, func(i, j int) bool { return set[i].name < set[j].name })
+		resolved[group] = set
+	}
+	return resolved
+}
+
+// securityMiddleware refuses paths with a trailing slash and sets the
+// configured security headers for the request's route group.
+// Strict-Transport-Security is only meaningful over HTTPS, so it is sent on
+// TLS connections and requests a trusted proxy forwarded from HTTPS.
+func securityMiddleware(config *Config) func(http.Handler) http.Handler {
+	groups := resolveSecurityHeaders(config.SecurityHeaders)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/") {
+				http.NotFound(w, r)
+				return
+			}
+
+			secure := forwardedHTTPS(r, config.IPTrustedProxies)
+			for _, h := range groups[headerGroup(r.URL.Path)] {
+				if h.name == "Strict-Transport-Security" && !secure {
+					continue
+				}
+				w.Header().Set(h.name, h.value)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package userguide
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecurityHeadersHSTSFromTrustedProxies(t *testing.T) {
+	config, err := buildConfig(map[string]string{
+		"ip.trusted.proxies":                        "10.0.0.2",
+		"security.header.Strict-Transport-Security": "max-age=31536000",
+	})
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	handler := securityMiddleware(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		remote string
+		proto  string
+		want   bool
+	}{
+		{"plain HTTP", "192.0.2.7:4000", "", false},
+		{"forwarded by a client", "192.0.2.7:4000", "https", false},
+		{"forwarded by a trusted proxy", "10.0.0.2:4000", "https", true},
+		{"trusted proxy over HTTP", "10.0.0.2:4000", "http", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/download/userguide", nil)
+			r.RemoteAddr = tt.remote
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get("Strict-Transport-Security") != ""; got != tt.want {
+				t.Errorf("HSTS sent = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersCacheControlByGroup(t *testing.T) {
+	handler := securityMiddleware(DefaultConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/download/userguide", "public, max-age=3600"},
+		{"/admin/usage", "no-store"},
+		{"/auth/session", "no-store"},
+		{"/sign", "no-store"},
+		{"/health", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if got := w.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: Cache-Control = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
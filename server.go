@@ -0,0 +1,298 @@
+package userguide
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NewHTTPServer builds the HTTP server with hardened timeouts and limits
+func NewHTTPServer(config *Config, handler http.Handler) *http.Server {
+	tracker := newConnTracker(config.ReadHeaderTimeout)
+
+	server := &http.Server{
+		Addr:              ":" + config.ServerPort,
+		Handler:           inFlightLimitMiddleware(config)(requestLimitMiddleware(bodyLimits(config))(handler)),
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		ConnState:         tracker.ConnState,
+	}
+	server.SetKeepAlivesEnabled(config.KeepAlivesEnabled)
+
+	return server
+}
+
+// bodyLimit caps request bodies for paths starting with prefix and bounds
+// the time allowed to read them. Routes taking large bodies are long: their
+// timeout, 0 for none, replaces the server-wide read timeout.
+type bodyLimit struct {
+	prefix  string
+	max     int64
+	timeout time.Duration
+	long    bool
+}
+
+// bodyLimits returns the per-route body limits, most specific first; the
+// empty prefix applies to every other route
+func bodyLimits(config *Config) []bodyLimit {
+	return []bodyLimit{
+		{prefix: "/upload/", max: config.UploadMaxBytes, timeout: config.UploadBodyTimeout, long: true},
+		{prefix: "/replication/", max: config.UploadMaxBytes, timeout: config.UploadBodyTimeout, long: true},
+		{prefix: "", max: config.MaxBodyBytes, timeout: config.BodyReadTimeout},
+	}
+}
+
+// connTracker follows connection state transitions to detect slow clients
+type connTracker struct {
+	mu            sync.Mutex
+	headerTimeout time.Duration
+	conns         map[net.Conn]connInfo
+}
+
+type connInfo struct {
+	state http.ConnState
+	since time.Time
+}
+
+func newConnTracker(headerTimeout time.Duration) *connTracker {
+	return &connTracker{
+		headerTimeout: headerTimeout,
+		conns:         make(map[net.Conn]connInfo),
+	}
+}
+
+// ConnState records transitions and counts connections dropped for sending
+// their request headers too slowly
+func (ct *connTracker) ConnState(c net.Conn, state http.ConnState) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		prev, ok := ct.conns[c]
+		delete(ct.conns, c)
+		if ok && prev.state == http.StateNew && ct.headerTimeout > 0 && time.Since(prev.since) >= ct.headerTimeout {
+			metrics.Inc("userguide_slow_client_disconnects_total", "phase", "header")
+		}
+	default:
+		ct.conns[c] = connInfo{state: state, since: time.Now()}
+	}
+	metrics.Set("userguide_open_connections", float64(len(ct.conns)))
+}
+
+// requestLimitMiddleware caps request body size and bounds the time allowed
+// to read the body of each request
+func requestLimitMiddleware(limits []bodyLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var route bodyLimit
+			for _, limit := range limits {
+				if strings.HasPrefix(r.URL.Path, limit.prefix) {
+					route = limit
+					break
+				}
+			}
+			maxBody := route.max
+
+			if maxBody > 0 && r.ContentLength > maxBody {
+				metrics.Inc("userguide_oversized_requests_total")
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			if (route.timeout > 0 || route.long) && r.Body != nil && r.Body != http.NoBody {
+				var deadline time.Time
+				if route.timeout > 0 {
+					deadline = time.Now().Add(route.timeout)
+				}
+				http.NewResponseController(w).SetReadDeadline(deadline)
+			}
+			if maxBody > 0 && r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+			}
+			if r.Body != nil {
+				r.Body = &slowBodyReader{ReadCloser: r.Body}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// inFlightLimitMiddleware bounds the requests handled at once by the whole
+// server, ahead of routing, so a flood cannot exhaust memory or file
+// descriptors whichever route or tier it targets
+func inFlightLimitMiddleware(config *Config) func(http.Handler) http.Handler {
+	if config.MaxInFlight <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	queue := newAdmissionQueue(config.MaxInFlight, config.MaxInFlightQueue, config.MaxInFlightWait)
+	var inFlight atomic.Int64
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Probes and scrapes must answer while the server is saturated
+			if r.URL.Path == "/health" || r.URL.Path == "/ready" || r.URL.Path == "/metrics" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !queue.Acquire(r.Context()) {
+				metrics.Inc("userguide_inflight_rejected_total")
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Service busy", http.StatusServiceUnavailable)
+				return
+			}
+			metrics.Set("userguide_inflight_requests", float64(inFlight.Add(1)))
+			defer func() {
+				metrics.Set("userguide_inflight_requests", float64(inFlight.Add(-1)))
+				queue.Release()
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// slowBodyReader counts body reads aborted by the read deadline or size cap
+type slowBodyReader struct {
+	io.ReadCloser
+	reported bool
+}
+
+func (sb *slowBodyReader) Read(p []byte) (int, error) {
+	n, err := sb.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && !sb.reported {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			sb.reported = true
+			metrics.Inc("userguide_slow_client_disconnects_total", "phase", "body")
+		case errors.As(err, &maxBytesErr):
+			sb.reported = true
+			metrics.Inc("userguide_oversized_requests_total")
+		}
+	}
+	return n, err
+}
+
+// newListener opens the server listener, applying the configured connection ceilings
+func newListener(config *Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", ":"+config.ServerPort)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxConnections > 0 || config.MaxConnectionsPerIP > 0 {
+		ln = newLimitListener(ln, config.MaxConnections, config.MaxConnectionsPerIP)
+	}
+	tlsConfig, err := newServerTLSConfig(config)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
+
+// limitListener closes incoming connections beyond a fixed number of open
+// connections, overall and per client IP, instead of queueing them, so a
+// flood cannot pile up in the backlog
+type limitListener struct {
+	net.Listener
+	max      int
+	maxPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newLimitListener(ln net.Listener, max, maxPerIP int) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		max:      max,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+}
+
+// Accept returns the next connection that fits under the limits
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, err := net.SplitHostPort(c.RemoteAddr().String())
+		if err != nil {
+			ip = c.RemoteAddr().String()
+		}
+
+		if reason := l.acquire(ip); reason != "" {
+			metrics.Inc("userguide_rejected_connections_total", "reason", reason)
+			c.Close()
+			continue
+		}
+
+		return &limitedConn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// acquire reserves a slot for ip, returning the limit that was hit if any
+func (l *limitListener) acquire(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return "total"
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return "per_ip"
+	}
+
+	l.total++
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *limitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// limitedConn frees its listener slot exactly once when closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// ReadFrom keeps the sendfile fast path: the server hands file bodies to the
+// connection's ReaderFrom, which the embedded net.Conn interface hides
+func (c *limitedConn) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{c.Conn}, src)
+}
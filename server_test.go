@@ -0,0 +1,170 @@
+package userguide
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"userguide_api_poc/samples"
+)
+
+// readFromConn is a net.Conn that records whether the server used its
+// ReaderFrom, as it does with *net.TCPConn to send files with sendfile(2)
+type readFromConn struct {
+	net.Conn
+	readFrom bool
+	written  bytes.Buffer
+}
+
+func (c *readFromConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *readFromConn) ReadFrom(src io.Reader) (int64, error) {
+	c.readFrom = true
+	return c.written.ReadFrom(src)
+}
+
+// writeOnlyConn is a net.Conn without a ReaderFrom, like a TLS connection
+type writeOnlyConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *writeOnlyConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestLimitedConnReadFrom(t *testing.T) {
+	inner := &readFromConn{}
+	var conn net.Conn = &limitedConn{Conn: inner, release: func() {}}
+	rf, ok := conn.(io.ReaderFrom)
+	if !ok {
+		t.Fatal("limitedConn hides the ReaderFrom of the connection")
+	}
+	if _, err := rf.ReadFrom(strings.NewReader("guide")); err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if !inner.readFrom || inner.written.String() != "guide" {
+		t.Errorf("ReadFrom not forwarded: readFrom = %t, written = %q", inner.readFrom, inner.written.String())
+	}
+
+	plain := &writeOnlyConn{}
+	conn = &limitedConn{Conn: plain, release: func() {}}
+	if _, err := conn.(io.ReaderFrom).ReadFrom(strings.NewReader("guide")); err != nil {
+		t.Fatalf("ReadFrom without a ReaderFrom: %v", err)
+	}
+	if plain.written.String() != "guide" {
+		t.Errorf("written = %q, want the body copied with Write", plain.written.String())
+	}
+}
+
+// benchmarkGuideSize is large enough for the copy to dominate a download
+// and for the page cache, not the benchmark, to hold the guide
+const benchmarkGuideSize = 256 << 20
+
+// benchmarkDownload downloads a large guide through the full service, its
+// listener wrapped by wrap when not nil. It reports the share of the body
+// bytes the service counted as sent with sendfile(2).
+func benchmarkDownload(b *testing.B, zeroCopy bool, wrap func(net.Listener) net.Listener) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	h := newTestHarness(b, func(config *Config) { config.ZeroCopy = zeroCopy })
+	guide := samples.PDF("User Guide")
+	guide = append(guide, bytes.Repeat([]byte{'\n'}, benchmarkGuideSize-len(guide))...)
+	h.Storage.Add("user-guide.pdf", guide)
+
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = NewHTTPServer(h.Config, h.App.Handler)
+	if wrap != nil {
+		server.Listener = wrap(server.Listener)
+	}
+	server.Start()
+	b.Cleanup(server.Close)
+	client := server.Client()
+	sent := metrics.Value("userguide_served_bytes_total", "path", "zero_copy")
+
+	b.SetBytes(benchmarkGuideSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := client.Get(server.URL + "/download/userguide")
+		if err != nil {
+			b.Fatalf("download: %v", err)
+		}
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || n != benchmarkGuideSize {
+			b.Fatalf("download: status %d, %d bytes, %v", resp.StatusCode, n, err)
+		}
+	}
+	b.StopTimer()
+	sent = metrics.Value("userguide_served_bytes_total", "path", "zero_copy") - sent
+	b.ReportMetric(sent/float64(benchmarkGuideSize*b.N), "zero-copy-share")
+}
+
+// BenchmarkDownload serves the same guide with sendfile(2) and, as the
+// baseline, with server.zero.copy=false, which copies it through a buffer;
+// run it with -bench Download to compare them side by side
+func BenchmarkDownload(b *testing.B) {
+	b.Run("zero_copy", func(b *testing.B) { benchmarkDownload(b, true, nil) })
+	b.Run("buffered", func(b *testing.B) { benchmarkDownload(b, false, nil) })
+	b.Run("zero_copy_limit_listener", func(b *testing.B) {
+		benchmarkDownload(b, true, func(ln net.Listener) net.Listener {
+			return newLimitListener(ln, 100, 10)
+		})
+	})
+}
+
+// readFromRecorder is a response writer with a ReaderFrom, like the one
+// net/http hands to handlers
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	return r.Body.ReadFrom(src)
+}
+
+func TestCountingWriterPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user-guide.pdf")
+	if err := os.WriteFile(path, samples.PDF("User Guide"), 0644); err != nil {
+		t.Fatalf("write guide: %v", err)
+	}
+	tests := []struct {
+		name string
+		tls  bool
+		src  func(file *os.File) io.Reader
+		want string
+	}{
+		{"file", false, func(file *os.File) io.Reader { return file }, "zero_copy"},
+		{"range of a file", false, func(file *os.File) io.Reader { return io.LimitReader(file, 100) }, "zero_copy"},
+		{"file over TLS", true, func(file *os.File) io.Reader { return file }, "buffered"},
+		{"decrypting reader", false, func(file *os.File) io.Reader { return io.MultiReader(file) }, "buffered"},
+		{"in-memory guide", false, func(*os.File) io.Reader { return bytes.NewReader(samples.PDF("User Guide")) }, "buffered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("open guide: %v", err)
+			}
+			defer file.Close()
+			before := metrics.Value("userguide_served_bytes_total", "path", tt.want)
+			cw := &countingWriter{ResponseWriter: readFromRecorder{httptest.NewRecorder()}, tls: tt.tls}
+			n, err := cw.ReadFrom(tt.src(file))
+			if err != nil || n == 0 {
+				t.Fatalf("ReadFrom = %d, %v", n, err)
+			}
+			if got := metrics.Value("userguide_served_bytes_total", "path", tt.want) - before; got != float64(n) {
+				t.Errorf("%s bytes counted = %v, want %d", tt.want, got, n)
+			}
+		})
+	}
+}
@@ -1,83 +1,224 @@
-package main
+package userguide
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Config holds application configuration
-type Config struct {
-	UserGuidePath string
-	UserGuideFile string
+// Guide variants served during a canary rollout
+const (
+	VariantStable = "stable"
+	VariantCanary = "canary"
+)
+
+// FileServiceInterface defines the contract for file download operations
+type FileServiceInterface interface {
+	DownloadUserGuide() (string, error)
+	DownloadUserGuideFor(clientKey string) (string, string, error)
+	CanaryActive() bool
+	DownloadProductGuide(product, filename string) (string, error)
+	DownloadReleaseGuide(product, release string) (string, error)
+	DownloadProtectedGuide(filename string) (string, error)
+	DownloadGuide(filename string) (string, error)
 }
 
-// LoadConfig loads configuration from properties file
-func LoadConfig(filename string) (*Config, error) {
-	config := &Config{}
+// FileService implements FileServiceInterface on top of the guides storage
+// and, when restricted guides are enabled, the protected storage. Guides
+// are handed to the serving layer as local paths.
+type FileService struct {
+	mu            sync.RWMutex
+	guides        Storage
+	protected     Storage
+	userGuideFile string
+	canaryFile    string
+	canaryPercent int
+	products      bool
+	releases      map[string]ReleaseMatrix
+	windows       map[string]AccessWindow
+	utils         *Utils
+}
 
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Printf("Warning: Could not open config file %s, using defaults", filename)
-		return config, nil
+// NewFileService creates a new file service that implements FileServiceInterface
+// on guides and the local protected directory
+func NewFileService(config *Config, guides Storage) FileServiceInterface {
+	var protected Storage
+	if config.ProtectedPath != "" {
+		protected = NewLocalStorage(config.ProtectedPath, config.FollowSymlinks)
 	}
-	defer file.Close()
+	return NewStorageFileService(guides, protected, config)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+// NewStorageFileService creates a file service on guides and protected, the
+// storage of restricted guides or nil when they are disabled
+func NewStorageFileService(guides, protected Storage, config *Config) *FileService {
+	return &FileService{
+		guides:        guides,
+		protected:     protected,
+		userGuideFile: config.UserGuideFile,
+		canaryFile:    config.CanaryFile,
+		canaryPercent: config.CanaryPercent,
+		products:      config.ProductsEnabled,
+		releases:      config.Releases,
+		windows:       config.AccessWindows,
+		utils:         &Utils{policy: &config.FilenamePolicy},
+	}
+}
 
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
+// DownloadUserGuide validates and returns file path for download using configured filename
+func (fs *FileService) DownloadUserGuide() (string, error) {
+	fs.mu.RLock()
+	filename := fs.userGuideFile
+	fs.mu.RUnlock()
+
+	// Get filename from configuration instead of parameter
+	return fs.resolveFile(filename)
+}
+
+// DownloadUserGuideFor returns the file path and variant for a specific client.
+// When a canary is configured, a stable hash of the client key places the
+// client in the canary bucket for CanaryPercent of all clients.
+func (fs *FileService) DownloadUserGuideFor(clientKey string) (string, string, error) {
+	fs.mu.RLock()
+	stableFile, canaryFile, canaryPercent := fs.userGuideFile, fs.canaryFile, fs.canaryPercent
+	fs.mu.RUnlock()
+
+	if inCanary(clientKey, canaryFile, canaryPercent) {
+		path, err := fs.resolveFile(canaryFile)
+		return path, VariantCanary, err
+	}
+
+	path, err := fs.resolveFile(stableFile)
+	return path, VariantStable, err
+}
+
+// CanaryActive reports whether some clients are given the canary user
+// guide, so the same URL currently serves two versions
+func (fs *FileService) CanaryActive() bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.canaryFile != "" && fs.canaryPercent > 0
+}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+// DownloadProductGuide validates and returns the path of a product's guide in multi-product mode
+func (fs *FileService) DownloadProductGuide(product, filename string) (string, error) {
+	if !fs.products {
+		return "", fmt.Errorf("multi-product mode is disabled")
+	}
+	if err := fs.utils.ValidateProductName(product); err != nil {
+		return "", err
+	}
+	return fs.resolveFileIn(fs.guideStorage(), product, filename)
+}
+
+// DownloadReleaseGuide returns the path of the guide documenting a product
+// release. Releases configured with release.<product>.<release> take
+// precedence over the product's .releases.json.
+func (fs *FileService) DownloadReleaseGuide(product, release string) (string, error) {
+	if !fs.products {
+		return "", fmt.Errorf("multi-product mode is disabled")
+	}
+	if err := fs.utils.ValidateProductName(product); err != nil {
+		return "", err
+	}
+	if err := fs.utils.ValidateReleaseName(release); err != nil {
+		return "", err
+	}
 
-		switch key {
-		case "userguide.path":
-			config.UserGuidePath = value
-		case "userguide.filename":
-			config.UserGuideFile = value
+	fs.mu.RLock()
+	filename, ok := fs.releases[product].Resolve(release)
+	fs.mu.RUnlock()
+	if !ok {
+		matrix, err := loadReleaseMatrix(context.Background(), fs.guideStorage(), product)
+		if err != nil {
+			return "", err
+		}
+		if filename, ok = matrix.Resolve(release); !ok {
+			return "", fmt.Errorf("no guide for %s release %s", product, release)
 		}
 	}
+	return fs.resolveFileIn(fs.guideStorage(), product, filename)
+}
 
-	return config, scanner.Err()
+// DownloadGuide validates and returns the path of any top-level guide
+func (fs *FileService) DownloadGuide(filename string) (string, error) {
+	return fs.resolveFile(filename)
 }
 
-// FileServiceInterface defines the contract for file download operations
-type FileServiceInterface interface {
-	DownloadUserGuide() (string, error)
+// DownloadProtectedGuide validates and returns the path of a restricted
+// guide; an empty filename selects the restricted edition of the configured
+// user guide
+func (fs *FileService) DownloadProtectedGuide(filename string) (string, error) {
+	if fs.protected == nil {
+		return "", fmt.Errorf("protected guides are disabled")
+	}
+	if filename == "" {
+		fs.mu.RLock()
+		filename = fs.userGuideFile
+		fs.mu.RUnlock()
+	}
+	return fs.resolveFileIn(fs.protected, "", filename)
 }
 
-// FileService implements FileServiceInterface
-type FileService struct {
-	basePath      string
-	userGuideFile string
-	utils         *Utils
+// Reload applies the runtime-changeable settings of a new configuration
+func (fs *FileService) Reload(config *Config) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.userGuideFile != config.UserGuideFile || fs.canaryFile != config.CanaryFile || fs.canaryPercent != config.CanaryPercent {
+		log.Printf("User guide file now %s (canary %q at %d%%)", config.UserGuideFile, config.CanaryFile, config.CanaryPercent)
+	}
+	fs.userGuideFile = config.UserGuideFile
+	fs.canaryFile = config.CanaryFile
+	fs.canaryPercent = config.CanaryPercent
+	fs.releases = config.Releases
+	fs.windows = config.AccessWindows
 }
 
-// NewFileService creates a new file service that implements FileServiceInterface
-func NewFileService(basePath, userGuideFile string) FileServiceInterface {
-	return &FileService{
-		basePath:      basePath,
-		userGuideFile: userGuideFile,
-		utils:         &Utils{},
+// SetGuides serves guides from store from now on; calls already resolving
+// a guide finish with the storage they started with
+func (fs *FileService) SetGuides(store Storage) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.guides = store
+}
+
+// guideStorage returns the storage guides are currently served from
+func (fs *FileService) guideStorage() Storage {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.guides
+}
+
+// inCanary reports whether the client is sticky-assigned to the canary version
+func inCanary(clientKey, canaryFile string, canaryPercent int) bool {
+	if canaryFile == "" || canaryPercent <= 0 {
+		return false
+	}
+	if canaryPercent >= 100 {
+		return true
 	}
+
+	h := fnv.New32a()
+	h.Write([]byte(clientKey))
+	return int(h.Sum32()%100) < canaryPercent
 }
 
-// DownloadUserGuide validates and returns file path for download using configured filename
-func (fs *FileService) DownloadUserGuide() (string, error) {
-	// Get filename from configuration instead of parameter
-	filename := fs.userGuideFile
+// resolveFile validates a filename and returns the path of the guide
+func (fs *FileService) resolveFile(filename string) (string, error) {
+	return fs.resolveFileIn(fs.guideStorage(), "", filename)
+}
 
+// resolveFileIn validates a filename and returns the path of the object
+// holding it in store, below dir when that is not empty
+func (fs *FileService) resolveFileIn(store Storage, dir, filename string) (string, error) {
 	// Validate filename using utils
 	cleanFilename, err := fs.utils.ValidateFilename(filename)
 	if err != nil {
@@ -90,24 +231,31 @@ func (fs *FileService) DownloadUserGuide() (string, error) {
 		return "", fmt.Errorf("file type not allowed: %s", ext)
 	}
 
-	// Check for hidden files
-	if strings.HasPrefix(cleanFilename, ".") && filepath.Ext(cleanFilename) == "" {
-		return "", fmt.Errorf("hidden files not allowed")
+	key := path.Join(dir, cleanFilename)
+	ctx := context.Background()
+	if _, err := store.Stat(ctx, key); err != nil {
+		if !errors.Is(err, ErrObjectNotFound) {
+			log.Printf("Unable to stat %s: %s", key, err.Error())
+		}
+		return "", fmt.Errorf("file access denied or file not found")
 	}
 
-	// Construct full file path
-	fullPath := filepath.Join(fs.basePath, cleanFilename)
-
-	// Validate file security
-	if !fs.utils.IsFileSecure(fullPath, fs.basePath) {
-		return "", fmt.Errorf("file access denied or file not found")
+	// Enforce embargoes and availability windows by guide name; restricted
+	// guides are named protected/<name>, as the authorizer sees them
+	name := key
+	if store == fs.protected {
+		name = protectedGuidePrefix + key
+	}
+	fs.mu.RLock()
+	windows := fs.windows
+	fs.mu.RUnlock()
+	if err := checkAccessWindows(windows, name, time.Now()); err != nil {
+		return "", err
 	}
 
-	// Return absolute path
-	absPath, err := filepath.Abs(fullPath)
+	filePath, err := storagePath(ctx, store, key)
 	if err != nil {
 		return "", fmt.Errorf("unable to resolve file path")
 	}
-
-	return absPath, nil
+	return filePath, nil
 }
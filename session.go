@@ -0,0 +1,412 @@
+package userguide
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Session stores
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreRedis  = "redis"
+)
+
+// sessionCookie carries the session id; the session itself stays on the server
+const sessionCookie = "ug_sid"
+
+// sessionTouchInterval spaces out the store writes that keep an active
+// session from idling out
+const sessionTouchInterval = time.Minute
+
+// How a session's user originally authenticated
+const (
+	sessionMethodToken = "token"
+	sessionMethodJWT   = "jwt"
+)
+
+// Session is a signed-in user remembered between requests
+type Session struct {
+	Subject   string    `json:"sub"`
+	Method    string    `json:"method"`
+	Email     string    `json:"email,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	KeyID     string    `json:"kid,omitempty"`
+	CreatedAt time.Time `json:"created"`
+	ExpiresAt time.Time `json:"expires"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// SessionStore keeps sessions by key until their ttl runs out. Load returns
+// nil for unknown or expired keys.
+type SessionStore interface {
+	Load(ctx context.Context, key string) (*Session, error)
+	Save(ctx context.Context, key string, session *Session, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Sessions remembers users who authenticated once on the /protected routes,
+// so later guide downloads from the same browser need only the secure,
+// HttpOnly session cookie. OpenID sign-ins keep their own signed cookie.
+// Sessions end after session.ttl, or session.idle.timeout without use,
+// whichever comes first, and never outlive the JWT they were started with.
+// Token sessions end once their token is no longer in protected.tokens,
+// JWT sessions once the key that signed their JWT leaves the JWKS.
+type Sessions struct {
+	store  SessionStore
+	ttl    time.Duration
+	idle   time.Duration
+	secure bool
+	// tokens holds the fingerprints of protected.tokens
+	tokens map[string]bool
+	// jwtKeys is set by FileHandler.UseSessions when JWTs are accepted
+	jwtKeys *JWKSCache
+}
+
+// NewSessions creates the sessions of session.store; it returns nil when
+// session.enabled is off
+func NewSessions(config *Config) *Sessions {
+	if !config.SessionEnabled {
+		return nil
+	}
+	var store SessionStore = newMemorySessionStore(config.SessionMemoryMax)
+	if config.SessionStore == SessionStoreRedis {
+		store = &redisSessionStore{client: NewRedisClient(config)}
+	}
+	tokens := make(map[string]bool)
+	for _, token := range config.ProtectedTokens {
+		if token != "" {
+			tokens[keyFingerprint(token)] = true
+		}
+	}
+	return &Sessions{
+		store:  store,
+		ttl:    config.SessionTTL,
+		idle:   config.SessionIdleTimeout,
+		secure: config.SessionCookieSecure,
+		tokens: tokens,
+	}
+}
+
+// RegisterRoutes adds GET /auth/session, describing the caller's session,
+// and DELETE /auth/session, ending it
+func (s *Sessions) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/auth/session", s.SessionHandler).Methods("GET")
+	r.HandleFunc("/auth/session", s.EndHandler).Methods("DELETE")
+}
+
+// SessionHandler serves GET /auth/session
+func (s *Sessions) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	session := s.Current(r)
+	if session == nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "no session"})
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// EndHandler serves DELETE /auth/session
+func (s *Sessions) EndHandler(w http.ResponseWriter, r *http.Request) {
+	s.End(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Middleware lets requests with a valid session cookie skip auth, restoring
+// the identity they authenticated with. Browser requests auth admits start
+// a new session; API clients send their credentials every time and get no
+// cookie.
+func (s *Sessions) Middleware(auth mux.MiddlewareFunc) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		authenticated := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fromBrowser(r) {
+				s.Start(w, r, sessionFromRequest(r))
+			}
+			next.ServeHTTP(w, r)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if session := s.Current(r); session != nil {
+				metrics.Inc("userguide_sessions_total", "event", "resumed")
+				next.ServeHTTP(w, withIdentity(r.WithContext(session.restore(r.Context()))))
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
+// fromBrowser reports whether r is a page load, which asks for HTML, rather
+// than an API call
+func fromBrowser(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// sessionFromRequest describes the user an auth middleware just admitted
+func sessionFromRequest(r *http.Request) *Session {
+	if claims := JWTClaimsFromContext(r.Context()); claims != nil {
+		session := &Session{Subject: claims.Subject, Method: sessionMethodJWT, Email: claims.Email, Roles: claims.Roles, KeyID: claims.KeyID}
+		if claims.ExpiresAt > 0 {
+			session.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+		}
+		return session
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return &Session{Subject: "token:" + keyFingerprint(token), Method: sessionMethodToken}
+}
+
+type sessionContextKey struct{}
+
+// SessionFromContext returns the session a request resumed, or nil
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return session
+}
+
+// restore adds the identity the session was started with to ctx, as the
+// auth middleware that admitted it did
+func (session *Session) restore(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, sessionContextKey{}, session)
+	if session.Method == sessionMethodToken {
+		return context.WithValue(ctx, bearerTokenContextKey{}, strings.TrimPrefix(session.Subject, "token:"))
+	}
+	if session.Method == sessionMethodJWT {
+		return context.WithValue(ctx, jwtClaimsContextKey{}, &JWTClaims{
+			Subject:   session.Subject,
+			Email:     session.Email,
+			Roles:     session.Roles,
+			ExpiresAt: session.ExpiresAt.Unix(),
+			KeyID:     session.KeyID,
+		})
+	}
+	return ctx
+}
+
+// Start stores session and sets its cookie. A session ExpiresAt later than
+// session.ttl from now, or unset, is brought forward to it.
+func (s *Sessions) Start(w http.ResponseWriter, r *http.Request, session *Session) {
+	now := time.Now()
+	session.CreatedAt, session.LastSeen = now, now
+	if limit := now.Add(s.ttl); session.ExpiresAt.IsZero() || session.ExpiresAt.After(limit) {
+		session.ExpiresAt = limit
+	}
+	id := randomURLToken()
+	if err := s.store.Save(r.Context(), sessionKey(id), session, s.remaining(session, now)); err != nil {
+		// The request was authenticated; only the next one will have to be again
+		log.Printf("Unable to start session for %s: %s", session.Subject, err.Error())
+		metrics.Inc("userguide_session_errors_total")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(time.Until(session.ExpiresAt).Seconds()),
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("Started %s session for %q from %s", session.Method, session.Subject, r.RemoteAddr)
+	metrics.Inc("userguide_sessions_total", "event", "started")
+}
+
+// Current returns the valid session of the request's cookie, if any, and
+// records that it is in use
+func (s *Sessions) Current(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	key := sessionKey(cookie.Value)
+	session, err := s.store.Load(r.Context(), key)
+	if err != nil {
+		log.Printf("Unable to load session: %s", err.Error())
+		metrics.Inc("userguide_session_errors_total")
+		return nil
+	}
+	if session == nil {
+		return nil
+	}
+	now := time.Now()
+	if s.remaining(session, now) <= 0 {
+		s.store.Delete(r.Context(), key)
+		metrics.Inc("userguide_sessions_total", "event", "expired")
+		return nil
+	}
+	if !s.stillValid(r.Context(), session) {
+		log.Printf("Ending %s session for %q: its credentials were revoked", session.Method, session.Subject)
+		s.store.Delete(r.Context(), key)
+		metrics.Inc("userguide_sessions_total", "event", "revoked")
+		return nil
+	}
+	if now.Sub(session.LastSeen) >= sessionTouchInterval {
+		session.LastSeen = now
+		if err := s.store.Save(r.Context(), key, session, s.remaining(session, now)); err != nil {
+			log.Printf("Unable to refresh session for %s: %s", session.Subject, err.Error())
+			metrics.Inc("userguide_session_errors_total")
+		}
+	}
+	return session
+}
+
+// End deletes the request's session and clears its cookie
+func (s *Sessions) End(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: s.secure, SameSite: http.SameSiteLaxMode})
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return
+	}
+	if err := s.store.Delete(r.Context(), sessionKey(cookie.Value)); err != nil {
+		log.Printf("Unable to end session: %s", err.Error())
+		metrics.Inc("userguide_session_errors_total")
+		return
+	}
+	metrics.Inc("userguide_sessions_total", "event", "ended")
+}
+
+// stillValid reports whether the credentials session was started with
+// would still be accepted: the token is still configured, or the key that
+// signed the JWT is still published
+func (s *Sessions) stillValid(ctx context.Context, session *Session) bool {
+	switch session.Method {
+	case sessionMethodToken:
+		return s.tokens[strings.TrimPrefix(session.Subject, "token:")]
+	case sessionMethodJWT:
+		if s.jwtKeys == nil {
+			return false
+		}
+		_, err := s.jwtKeys.Key(ctx, session.KeyID)
+		return err == nil
+	}
+	return false
+}
+
+// remaining is how long session stays valid without further use
+func (s *Sessions) remaining(session *Session, now time.Time) time.Duration {
+	return min(session.ExpiresAt.Sub(now), session.LastSeen.Add(s.idle).Sub(now))
+}
+
+// sessionKey is the store key of a session id, so neither the store nor
+// its backups hold cookie values
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// memorySessionStore keeps sessions in this process; they are lost on
+// restart and not shared with other replicas. Beyond max sessions, the
+// one closest to expiring is dropped for each new one.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+	max      int
+	lastGC   time.Time
+}
+
+type memorySession struct {
+	session Session
+	expires time.Time
+}
+
+func newMemorySessionStore(max int) *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySession), max: max, lastGC: time.Now()}
+}
+
+func (ms *memorySessionStore) Load(_ context.Context, key string) (*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entry, ok := ms.sessions[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, nil
+	}
+	session := entry.session
+	return &session, nil
+}
+
+func (ms *memorySessionStore) Save(_ context.Context, key string, session *Session, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	_, exists := ms.sessions[key]
+	if (!exists && len(ms.sessions) >= ms.max) || now.Sub(ms.lastGC) >= sessionTouchInterval {
+		ms.gc(now)
+	}
+	if !exists && len(ms.sessions) >= ms.max {
+		var oldest string
+		for k, entry := range ms.sessions {
+			if oldest == "" || entry.expires.Before(ms.sessions[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(ms.sessions, oldest)
+		metrics.Inc("userguide_sessions_total", "event", "evicted")
+	}
+	ms.sessions[key] = memorySession{session: *session, expires: now.Add(ttl)}
+	return nil
+}
+
+// gc drops the expired sessions
+func (ms *memorySessionStore) gc(now time.Time) {
+	for k, entry := range ms.sessions {
+		if now.After(entry.expires) {
+			delete(ms.sessions, k)
+		}
+	}
+	ms.lastGC = now
+}
+
+func (ms *memorySessionStore) Delete(_ context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, key)
+	return nil
+}
+
+// redisSessionStore keeps sessions in Redis, shared by all replicas, with
+// the session's ttl as the key's expiry
+type redisSessionStore struct {
+	client *RedisClient
+}
+
+// redisSessionPrefix namespaces session keys in Redis
+const redisSessionPrefix = "userguide:session:"
+
+func (rs *redisSessionStore) Load(ctx context.Context, key string) (*Session, error) {
+	reply, err := rs.client.Do(ctx, "GET", redisSessionPrefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, errors.New("redis: unexpected reply to GET")
+	}
+	var session Session
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (rs *redisSessionStore) Save(ctx context.Context, key string, session *Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = rs.client.Do(ctx, "SET", redisSessionPrefix+key, string(data), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+func (rs *redisSessionStore) Delete(ctx context.Context, key string) error {
+	_, err := rs.client.Do(ctx, "DEL", redisSessionPrefix+key)
+	return err
+}
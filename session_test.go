@@ -0,0 +1,288 @@
+package userguide
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSessionStores returns a memory store and a Redis store backed by a
+// fake server, so both are held to the same behavior
+func testSessionStores(t *testing.T) map[string]SessionStore {
+	config := DefaultConfig()
+	config.RedisAddress = newRedisTestServer(t)
+	config.RedisTimeout = time.Second
+	client := NewRedisClient(config)
+	t.Cleanup(client.Close)
+	return map[string]SessionStore{
+		SessionStoreMemory: newMemorySessionStore(100),
+		SessionStoreRedis:  &redisSessionStore{client: client},
+	}
+}
+
+func TestSessionStores(t *testing.T) {
+	for name, store := range testSessionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			session := &Session{Subject: "alice", Method: sessionMethodJWT, Roles: []string{"support"}, KeyID: "k1"}
+
+			if got, err := store.Load(ctx, "missing"); got != nil || err != nil {
+				t.Errorf("Load(missing) = %v, %v, want nil, nil", got, err)
+			}
+			if err := store.Save(ctx, "k", session, time.Minute); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			got, err := store.Load(ctx, "k")
+			if err != nil || got == nil {
+				t.Fatalf("Load = %v, %v", got, err)
+			}
+			if got.Subject != "alice" || got.KeyID != "k1" || len(got.Roles) != 1 {
+				t.Errorf("Load = %+v, want the saved session", got)
+			}
+			if err := store.Delete(ctx, "k"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if got, _ := store.Load(ctx, "k"); got != nil {
+				t.Errorf("Load after Delete = %+v, want nil", got)
+			}
+
+			if err := store.Save(ctx, "short", session, 20*time.Millisecond); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if got, _ := store.Load(ctx, "short"); got != nil {
+				t.Errorf("Load past the ttl = %+v, want nil", got)
+			}
+		})
+	}
+}
+
+func TestMemorySessionStoreCap(t *testing.T) {
+	ctx := context.Background()
+	store := newMemorySessionStore(3)
+	for i := range 3 {
+		store.Save(ctx, strconv.Itoa(i), &Session{Subject: strconv.Itoa(i)}, time.Duration(i+1)*time.Hour)
+	}
+	// Refreshing a stored session does not evict another
+	store.Save(ctx, "2", &Session{Subject: "2"}, 3*time.Hour)
+	if len(store.sessions) != 3 {
+		t.Fatalf("%d sessions, want 3", len(store.sessions))
+	}
+
+	store.Save(ctx, "new", &Session{Subject: "new"}, time.Hour)
+	if len(store.sessions) != 3 {
+		t.Errorf("%d sessions, want at most 3", len(store.sessions))
+	}
+	if got, _ := store.Load(ctx, "0"); got != nil {
+		t.Errorf("the session closest to expiring was kept")
+	}
+	for _, key := range []string{"1", "2", "new"} {
+		if got, _ := store.Load(ctx, key); got == nil {
+			t.Errorf("session %s was evicted", key)
+		}
+	}
+}
+
+func TestSessionsStartOnlyForBrowsers(t *testing.T) {
+	config := DefaultConfig()
+	config.SessionEnabled = true
+	config.ProtectedTokens = []string{"token-a"}
+	sessions := NewSessions(config)
+	handler := sessions.Middleware(AuthMiddleware(config.ProtectedTokens))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		accept string
+		cookie bool
+	}{
+		{"API client", "", false},
+		{"JSON client", "application/json", false},
+		{"browser", "text/html,application/xhtml+xml,*/*;q=0.8", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/protected/guide.pdf", nil)
+			r.Header.Set("Authorization", "Bearer token-a")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+			if got := strings.Contains(w.Header().Get("Set-Cookie"), sessionCookie+"="); got != tt.cookie {
+				t.Errorf("session cookie set = %t, want %t", got, tt.cookie)
+			}
+		})
+	}
+}
+
+func TestSessionsEndWithRevokedToken(t *testing.T) {
+	config := DefaultConfig()
+	config.SessionEnabled = true
+	config.ProtectedTokens = []string{"token-a"}
+	store := newMemorySessionStore(100)
+
+	start := NewSessions(config)
+	start.store = store
+	r := httptest.NewRequest("GET", "/protected/guide.pdf", nil)
+	r.Header.Set("Authorization", "Bearer token-a")
+	w := httptest.NewRecorder()
+	start.Start(w, r, sessionFromRequest(r))
+	cookie := w.Result().Cookies()[0]
+
+	resume := httptest.NewRequest("GET", "/protected/guide.pdf", nil)
+	resume.AddCookie(cookie)
+	if start.Current(resume) == nil {
+		t.Fatal("session not resumed while its token is configured")
+	}
+
+	// The token is rotated out of protected.tokens, as after a restart
+	config.ProtectedTokens = []string{"token-b"}
+	rotated := NewSessions(config)
+	rotated.store = store
+	if rotated.Current(resume) != nil {
+		t.Error("session resumed after its token was removed")
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("%d sessions kept, want the revoked one deleted", len(store.sessions))
+	}
+}
+
+func TestSessionsEndWithoutJWTKeys(t *testing.T) {
+	config := DefaultConfig()
+	config.SessionEnabled = true
+	sessions := NewSessions(config)
+	session := &Session{Subject: "alice", Method: sessionMethodJWT, KeyID: "k1"}
+
+	// JWTs are no longer accepted at all
+	if sessions.stillValid(context.Background(), session) {
+		t.Error("JWT session valid without a JWKS")
+	}
+}
+
+// newRedisTestServer starts a server speaking enough RESP2 for the session
+// store: GET, SET with PX, and DEL. It returns its address.
+func newRedisTestServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	type entry struct {
+		value   string
+		expires time.Time
+	}
+	var (
+		mu    sync.Mutex
+		data  = make(map[string]entry)
+		conns []net.Conn
+		wg    sync.WaitGroup
+	)
+	serve := func(conn net.Conn) {
+		defer wg.Done()
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			args, err := readRedisCommand(reader)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			var reply string
+			switch strings.ToUpper(args[0]) {
+			case "GET":
+				e, ok := data[args[1]]
+				if !ok || (!e.expires.IsZero() && time.Now().After(e.expires)) {
+					reply = "$-1\r\n"
+				} else {
+					reply = "$" + strconv.Itoa(len(e.value)) + "\r\n" + e.value + "\r\n"
+				}
+			case "SET":
+				e := entry{value: args[2]}
+				if len(args) == 5 && strings.EqualFold(args[3], "PX") {
+					ms, _ := strconv.Atoi(args[4])
+					e.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				}
+				data[args[1]] = e
+				reply = "+OK\r\n"
+			case "DEL":
+				_, ok := data[args[1]]
+				delete(data, args[1])
+				reply = ":0\r\n"
+				if ok {
+					reply = ":1\r\n"
+				}
+			default:
+				reply = "-ERR unknown command\r\n"
+			}
+			mu.Unlock()
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	return ln.Addr().String()
+}
+
+// readRedisCommand reads one RESP array of bulk strings
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, errRedisNil
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
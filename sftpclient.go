@@ -0,0 +1,696 @@
+package userguide
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP version 3 packet types, as OpenSSH and most servers speak it
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+)
+
+// SFTP status codes
+const (
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+)
+
+// SFTP open flags and attribute flags
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	// sftpChunk is the size of each read and write request; servers are
+	// only required to accept 32 KiB
+	sftpChunk = 32 * 1024
+	// sftpWindow is how many read or write requests a transfer keeps in
+	// flight, so throughput is not bound by the round trip time
+	sftpWindow = 16
+	// sftpMaxPacket bounds the responses accepted from the server
+	sftpMaxPacket = 1 << 20
+	// sftpPosixRename is the OpenSSH extension that replaces the target
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+// sftpStatusError is a request the server answered with a failure status
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	if e.message != "" {
+		return fmt.Sprintf("sftp status %d: %s", e.code, e.message)
+	}
+	return fmt.Sprintf("sftp status %d", e.code)
+}
+
+// sftpAttributes is the part of a file's attributes the storage uses
+type sftpAttributes struct {
+	size    int64
+	mode    uint32
+	modTime time.Time
+}
+
+func (a sftpAttributes) isDir() bool     { return a.mode&0o170000 == 0o040000 }
+func (a sftpAttributes) isRegular() bool { return a.mode&0o170000 == 0o100000 }
+
+// sftpPacket is a response: its type and the payload after the request id
+type sftpPacket struct {
+	kind byte
+	data []byte
+}
+
+// sftpConn is an SFTP session over its own SSH connection. Requests may be
+// sent from several goroutines; a reader goroutine hands each response to
+// the request with its id.
+type sftpConn struct {
+	client     *ssh.Client
+	session    *ssh.Session
+	stdin      io.WriteCloser
+	extensions map[string]string
+	lastUsed   time.Time
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpPacket
+	err     error
+	done    chan struct{}
+}
+
+// newSFTPConn starts the sftp subsystem on client
+func newSFTPConn(client *ssh.Client) (*sftpConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("no sftp subsystem: %v", err)
+	}
+	c := &sftpConn{
+		client:     client,
+		session:    session,
+		stdin:      stdin,
+		extensions: make(map[string]string),
+		pending:    make(map[uint32]chan sftpPacket),
+		done:       make(chan struct{}),
+	}
+
+	var init sftpBuffer
+	init.uint32(3)
+	if err := c.writePacket(sftpInit, init); err != nil {
+		session.Close()
+		return nil, err
+	}
+	kind, data, err := readSFTPPacket(stdout)
+	if err != nil || kind != sftpVersion {
+		session.Close()
+		return nil, fmt.Errorf("sftp handshake failed: %v", err)
+	}
+	version := sftpReader{data: data}
+	if v := version.uint32(); v != 3 {
+		session.Close()
+		return nil, fmt.Errorf("unsupported sftp version %d", v)
+	}
+	for len(version.data) > 0 && version.err == nil {
+		name, value := version.string(), version.string()
+		c.extensions[name] = value
+	}
+	go c.receive(stdout)
+	return c, nil
+}
+
+// Close ends the session and the SSH connection
+func (c *sftpConn) Close() error {
+	c.session.Close()
+	return c.client.Close()
+}
+
+// broken reports whether the connection has failed
+func (c *sftpConn) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// receive dispatches responses until the session ends
+func (c *sftpConn) receive(r io.Reader) {
+	var err error
+	for {
+		var kind byte
+		var data []byte
+		if kind, data, err = readSFTPPacket(r); err != nil {
+			break
+		}
+		if len(data) < 4 {
+			err = errors.New("sftp response without a request id")
+			break
+		}
+		id := binary.BigEndian.Uint32(data)
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- sftpPacket{kind: kind, data: data[4:]}
+		}
+	}
+	c.mu.Lock()
+	if err == io.EOF {
+		err = errors.New("sftp session closed")
+	}
+	c.err = err
+	c.pending = nil
+	c.mu.Unlock()
+	close(c.done)
+}
+
+// send writes a request and returns the channel its response arrives on
+func (c *sftpConn) send(kind byte, payload sftpBuffer) (chan sftpPacket, error) {
+	ch := make(chan sftpPacket, 1)
+	c.mu.Lock()
+	if c.pending == nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	var request sftpBuffer
+	request.uint32(id)
+	request = append(request, payload...)
+	if err := c.writePacket(kind, request); err != nil {
+		c.mu.Lock()
+		if c.pending != nil {
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// wait returns the response arriving on ch
+func (c *sftpConn) wait(ctx context.Context, ch chan sftpPacket) (sftpPacket, error) {
+	select {
+	case packet := <-ch:
+		return packet, nil
+	case <-c.done:
+		// The response may have been delivered just before the session ended
+		select {
+		case packet := <-ch:
+			return packet, nil
+		default:
+			return sftpPacket{}, c.err
+		}
+	case <-ctx.Done():
+		return sftpPacket{}, ctx.Err()
+	}
+}
+
+// request sends a request and waits for its response
+func (c *sftpConn) request(ctx context.Context, kind byte, payload sftpBuffer) (sftpPacket, error) {
+	ch, err := c.send(kind, payload)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return c.wait(ctx, ch)
+}
+
+func (c *sftpConn) writePacket(kind byte, payload []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)+1))
+	header[4] = kind
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.stdin.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("sftp packet of %d bytes", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+// status returns the error of a status response, nil for OK, and an error
+// for any other response type than want
+func (p sftpPacket) status(want byte) error {
+	if p.kind == sftpStatus {
+		r := sftpReader{data: p.data}
+		code, message := r.uint32(), r.string()
+		if code == sftpOK {
+			return nil
+		}
+		return &sftpStatusError{code: code, message: message}
+	}
+	if p.kind != want {
+		return fmt.Errorf("unexpected sftp response %d", p.kind)
+	}
+	return nil
+}
+
+// stat returns the attributes of path, following symlinks
+func (c *sftpConn) stat(ctx context.Context, path string) (sftpAttributes, error) {
+	var payload sftpBuffer
+	payload.string(path)
+	resp, err := c.request(ctx, sftpStat, payload)
+	if err != nil {
+		return sftpAttributes{}, err
+	}
+	if err := resp.status(sftpAttrs); err != nil {
+		return sftpAttributes{}, err
+	}
+	r := sftpReader{data: resp.data}
+	attrs := r.attributes()
+	return attrs, r.err
+}
+
+// open opens path with the given flags and returns its handle
+func (c *sftpConn) open(ctx context.Context, path string, flags uint32) (string, error) {
+	var payload sftpBuffer
+	payload.string(path)
+	payload.uint32(flags)
+	payload.uint32(0)
+	return c.handle(ctx, sftpOpen, payload)
+}
+
+// handle sends an open request and reads the handle it returns
+func (c *sftpConn) handle(ctx context.Context, kind byte, payload sftpBuffer) (string, error) {
+	resp, err := c.request(ctx, kind, payload)
+	if err != nil {
+		return "", err
+	}
+	if err := resp.status(sftpHandle); err != nil {
+		return "", err
+	}
+	if resp.kind != sftpHandle {
+		return "", errors.New("sftp server returned no handle")
+	}
+	r := sftpReader{data: resp.data}
+	handle := r.string()
+	return handle, r.err
+}
+
+// closeHandle releases a file or directory handle
+func (c *sftpConn) closeHandle(ctx context.Context, handle string) error {
+	var payload sftpBuffer
+	payload.string(handle)
+	resp, err := c.request(ctx, sftpClose, payload)
+	if err != nil {
+		return err
+	}
+	return resp.status(sftpStatus)
+}
+
+// sftpEntry is a directory entry
+type sftpEntry struct {
+	name  string
+	attrs sftpAttributes
+}
+
+// readDir lists the entries of the directory path, without . and ..
+func (c *sftpConn) readDir(ctx context.Context, path string) ([]sftpEntry, error) {
+	var payload sftpBuffer
+	payload.string(path)
+	handle, err := c.handle(ctx, sftpOpendir, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(context.WithoutCancel(ctx), handle)
+	var entries []sftpEntry
+	for {
+		var payload sftpBuffer
+		payload.string(handle)
+		resp, err := c.request(ctx, sftpReaddir, payload)
+		if err != nil {
+			return nil, err
+		}
+		if err := resp.status(sftpName); err != nil {
+			var status *sftpStatusError
+			if errors.As(err, &status) && status.code == sftpEOF {
+				return entries, nil
+			}
+			return nil, err
+		}
+		r := sftpReader{data: resp.data}
+		for count := r.uint32(); count > 0 && r.err == nil; count-- {
+			name := r.string()
+			r.string() // the ls -l style line
+			attrs := r.attributes()
+			if name != "." && name != ".." {
+				entries = append(entries, sftpEntry{name: name, attrs: attrs})
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+// pathRequest sends a request whose payload is the given paths and checks
+// its status
+func (c *sftpConn) pathRequest(ctx context.Context, kind byte, paths ...string) error {
+	var payload sftpBuffer
+	for _, path := range paths {
+		payload.string(path)
+	}
+	if kind == sftpMkdir {
+		payload.uint32(0)
+	}
+	resp, err := c.request(ctx, kind, payload)
+	if err != nil {
+		return err
+	}
+	return resp.status(sftpStatus)
+}
+
+// rename moves from to to, replacing to where the server can
+func (c *sftpConn) rename(ctx context.Context, from, to string) error {
+	if _, ok := c.extensions[sftpPosixRename]; ok {
+		var payload sftpBuffer
+		payload.string(sftpPosixRename)
+		payload.string(from)
+		payload.string(to)
+		resp, err := c.request(ctx, sftpExtended, payload)
+		if err != nil {
+			return err
+		}
+		return resp.status(sftpStatus)
+	}
+	// Plain SFTP renames refuse to replace a file
+	if err := c.pathRequest(ctx, sftpRemove, to); err != nil && !sftpNotFound(err) {
+		return err
+	}
+	return c.pathRequest(ctx, sftpRename, from, to)
+}
+
+// write copies body to the open file handle, keeping several write
+// requests in flight
+func (c *sftpConn) write(ctx context.Context, handle string, body io.Reader) error {
+	var inflight []chan sftpPacket
+	collect := func() error {
+		resp, err := c.wait(ctx, inflight[0])
+		inflight = inflight[1:]
+		if err != nil {
+			return err
+		}
+		return resp.status(sftpStatus)
+	}
+	buf := make([]byte, sftpChunk)
+	var offset uint64
+	for {
+		n, readErr := io.ReadFull(body, buf)
+		if n > 0 {
+			if len(inflight) == sftpWindow {
+				if err := collect(); err != nil {
+					return err
+				}
+			}
+			var payload sftpBuffer
+			payload.string(handle)
+			payload.uint64(offset)
+			payload.bytes(buf[:n])
+			ch, err := c.send(sftpWrite, payload)
+			if err != nil {
+				return err
+			}
+			inflight = append(inflight, ch)
+			offset += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	for len(inflight) > 0 {
+		if err := collect(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sftpFileReader reads an open file from the start, keeping several read
+// requests in flight
+type sftpFileReader struct {
+	ctx     context.Context
+	conn    *sftpConn
+	handle  string
+	next    uint64
+	eof     bool
+	pending []sftpReadRequest
+	buf     []byte
+	err     error
+	release func()
+}
+
+// sftpReadRequest is a read request in flight
+type sftpReadRequest struct {
+	offset uint64
+	length uint32
+	ch     chan sftpPacket
+}
+
+func (fr *sftpFileReader) Read(p []byte) (int, error) {
+	for len(fr.buf) == 0 {
+		if fr.err != nil {
+			return 0, fr.err
+		}
+		fr.fill()
+	}
+	n := copy(p, fr.buf)
+	fr.buf = fr.buf[n:]
+	return n, nil
+}
+
+// fill waits for the oldest read request, topping the window up first
+func (fr *sftpFileReader) fill() {
+	for !fr.eof && len(fr.pending) < sftpWindow {
+		ch, err := fr.request(fr.next, sftpChunk)
+		if err != nil {
+			fr.err = err
+			return
+		}
+		fr.pending = append(fr.pending, sftpReadRequest{offset: fr.next, length: sftpChunk, ch: ch})
+		fr.next += sftpChunk
+	}
+	if len(fr.pending) == 0 {
+		fr.err = io.EOF
+		return
+	}
+	read := fr.pending[0]
+	fr.pending = fr.pending[1:]
+	resp, err := fr.conn.wait(fr.ctx, read.ch)
+	if err != nil {
+		fr.err = err
+		return
+	}
+	if err := resp.status(sftpData); err != nil {
+		var status *sftpStatusError
+		if errors.As(err, &status) && status.code == sftpEOF {
+			// Requests past the end of the file are answered with EOF too
+			fr.eof = true
+			fr.pending = nil
+			fr.err = io.EOF
+			return
+		}
+		fr.err = err
+		return
+	}
+	r := sftpReader{data: resp.data}
+	data := r.string()
+	if r.err != nil {
+		fr.err = r.err
+		return
+	}
+	if len(data) == 0 || uint32(len(data)) > read.length {
+		fr.err = fmt.Errorf("sftp read of %d bytes answered with %d", read.length, len(data))
+		return
+	}
+	fr.buf = []byte(data)
+	if short := read.length - uint32(len(data)); short > 0 {
+		// Servers may answer with less than asked for; the rest must be
+		// read before the requests already in flight
+		ch, err := fr.request(read.offset+uint64(len(data)), short)
+		if err != nil {
+			fr.err = err
+			return
+		}
+		fr.pending = append([]sftpReadRequest{{offset: read.offset + uint64(len(data)), length: short, ch: ch}}, fr.pending...)
+	}
+}
+
+func (fr *sftpFileReader) request(offset uint64, length uint32) (chan sftpPacket, error) {
+	var payload sftpBuffer
+	payload.string(fr.handle)
+	payload.uint64(offset)
+	payload.uint32(length)
+	return fr.conn.send(sftpRead, payload)
+}
+
+// Close releases the file handle and the connection it was read over
+func (fr *sftpFileReader) Close() error {
+	if fr.release == nil {
+		return nil
+	}
+	err := fr.conn.closeHandle(context.WithoutCancel(fr.ctx), fr.handle)
+	fr.release()
+	fr.release = nil
+	return err
+}
+
+// sftpNotFound reports whether err is the server's no such file status
+func sftpNotFound(err error) bool {
+	var status *sftpStatusError
+	return errors.As(err, &status) && status.code == sftpNoSuchFile
+}
+
+// sftpBuffer encodes SFTP request payloads
+type sftpBuffer []byte
+
+func (b *sftpBuffer) uint32(v uint32) { *b = binary.BigEndian.AppendUint32(*b, v) }
+func (b *sftpBuffer) uint64(v uint64) { *b = binary.BigEndian.AppendUint64(*b, v) }
+
+func (b *sftpBuffer) string(s string) {
+	b.uint32(uint32(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *sftpBuffer) bytes(p []byte) {
+	b.uint32(uint32(len(p)))
+	*b = append(*b, p...)
+}
+
+// sftpReader decodes SFTP response payloads; the first error sticks
+type sftpReader struct {
+	data []byte
+	err  error
+}
+
+var errSFTPShort = errors.New("truncated sftp response")
+
+func (r *sftpReader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.err, r.data = errSFTPShort, nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if len(r.data) < 8 {
+		r.err, r.data = errSFTPShort, nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.data)
+	r.data = r.data[8:]
+	return v
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if uint32(len(r.data)) < n {
+		r.err, r.data = errSFTPShort, nil
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *sftpReader) attributes() sftpAttributes {
+	var attrs sftpAttributes
+	flags := r.uint32()
+	if flags&sftpAttrSize != 0 {
+		attrs.size = int64(r.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		attrs.mode = r.uint32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		r.uint32()
+		attrs.modTime = time.Unix(int64(r.uint32()), 0).UTC()
+	}
+	if flags&sftpAttrExtended != 0 {
+		for count := r.uint32(); count > 0 && r.err == nil; count-- {
+			r.string()
+			r.string()
+		}
+	}
+	return attrs
+}
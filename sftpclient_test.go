@@ -0,0 +1,596 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpTestServer is an SSH server whose sftp subsystem keeps files in
+// memory. It decodes and encodes SFTP version 3 packets on its own, so
+// the client is checked against the protocol rather than against itself.
+type sftpTestServer struct {
+	Address string
+	HostKey ssh.Signer
+
+	// maxRead caps the data of each read response; zero answers in full
+	maxRead int
+	// posixRename offers the posix-rename@openssh.com extension
+	posixRename bool
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	files   map[string][]byte
+	dirs    map[string]bool
+	handles map[string]*sftpTestHandle
+	next    int
+}
+
+// sftpTestHandle is an open file or directory
+type sftpTestHandle struct {
+	path   string
+	dir    bool
+	listed bool
+}
+
+// sftpTestModTime is the modification time of every file, in Unix seconds
+const sftpTestModTime = 1700000000
+
+// newSFTPTestServer starts a server accepting user guides with password
+// s3cret, holding an empty guides directory
+func newSFTPTestServer(t *testing.T) *sftpTestServer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("host key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "guides" && string(password) == "s3cret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &sftpTestServer{
+		Address: ln.Addr().String(),
+		HostKey: hostKey,
+		files:   make(map[string][]byte),
+		dirs:    map[string]bool{"guides": true},
+		handles: make(map[string]*sftpTestHandle),
+	}
+	var wg sync.WaitGroup
+	// The storages keep pooled connections open, so they are ended here
+	t.Cleanup(func() {
+		ln.Close()
+		s.mu.Lock()
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serveSSH(conn, config)
+			}()
+		}
+	}()
+	return s
+}
+
+// serveSSH runs the sftp subsystem of the sessions of one connection
+func (s *sftpTestServer) serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && bytes.Equal(req.Payload, append([]byte{0, 0, 0, 4}, "sftp"...))
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						s.serveSFTP(channel)
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// sftpTestPacket decodes a request payload
+type sftpTestPacket struct {
+	data []byte
+}
+
+func (p *sftpTestPacket) uint32() uint32 {
+	if len(p.data) < 4 {
+		p.data = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.data)
+	p.data = p.data[4:]
+	return v
+}
+
+func (p *sftpTestPacket) uint64() uint64 {
+	return uint64(p.uint32())<<32 | uint64(p.uint32())
+}
+
+func (p *sftpTestPacket) string() string {
+	n := int(p.uint32())
+	if n > len(p.data) {
+		p.data = nil
+		return ""
+	}
+	v := string(p.data[:n])
+	p.data = p.data[n:]
+	return v
+}
+
+// sftpTestAppendString appends an SFTP string
+func sftpTestAppendString(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint32(b, uint32(len(s))), s...)
+}
+
+// sftpTestAppendAttrs appends the size, permissions and times of a file or
+// directory
+func sftpTestAppendAttrs(b []byte, size int, dir bool) []byte {
+	mode := uint32(0o100644)
+	if dir {
+		mode = 0o040755
+	}
+	b = binary.BigEndian.AppendUint32(b, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+	b = binary.BigEndian.AppendUint64(b, uint64(size))
+	b = binary.BigEndian.AppendUint32(b, mode)
+	b = binary.BigEndian.AppendUint32(b, sftpTestModTime)
+	return binary.BigEndian.AppendUint32(b, sftpTestModTime)
+}
+
+// serveSFTP answers requests until the client ends the session
+func (s *sftpTestServer) serveSFTP(rw io.ReadWriter) {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(rw, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header)-1)
+		if _, err := io.ReadFull(rw, body); err != nil {
+			return
+		}
+		kind, reply := s.handle(header[4], &sftpTestPacket{data: body})
+		response := binary.BigEndian.AppendUint32(nil, uint32(len(reply)+1))
+		if _, err := rw.Write(append(append(response, kind), reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one request with a response type and payload
+func (s *sftpTestServer) handle(kind byte, p *sftpTestPacket) (byte, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kind == sftpInit {
+		reply := binary.BigEndian.AppendUint32(nil, 3)
+		if s.posixRename {
+			reply = sftpTestAppendString(sftpTestAppendString(reply, sftpPosixRename), "1")
+		}
+		return sftpVersion, reply
+	}
+	id := p.uint32()
+	reply := binary.BigEndian.AppendUint32(nil, id)
+	status := func(code uint32, message string) (byte, []byte) {
+		reply = binary.BigEndian.AppendUint32(reply, code)
+		return sftpStatus, sftpTestAppendString(sftpTestAppendString(reply, message), "en")
+	}
+	newHandle := func(h *sftpTestHandle) (byte, []byte) {
+		s.next++
+		name := "h" + strconv.Itoa(s.next)
+		s.handles[name] = h
+		return sftpHandle, sftpTestAppendString(reply, name)
+	}
+
+	switch kind {
+	case sftpOpen:
+		name, flags := path.Clean(p.string()), p.uint32()
+		if !s.dirs[path.Dir(name)] {
+			return status(sftpNoSuchFile, "No such file")
+		}
+		if _, ok := s.files[name]; !ok && flags&sftpFlagCreate == 0 {
+			return status(sftpNoSuchFile, "No such file")
+		}
+		if flags&sftpFlagTrunc != 0 || s.files[name] == nil {
+			s.files[name] = []byte{}
+		}
+		return newHandle(&sftpTestHandle{path: name})
+	case sftpClose:
+		delete(s.handles, p.string())
+		return status(sftpOK, "")
+	case sftpRead:
+		h, offset, length := s.handles[p.string()], p.uint64(), int(p.uint32())
+		if h == nil {
+			return status(4, "Bad handle")
+		}
+		content := s.files[h.path]
+		if offset >= uint64(len(content)) {
+			return status(sftpEOF, "")
+		}
+		if s.maxRead > 0 {
+			length = min(length, s.maxRead)
+		}
+		end := min(int(offset)+length, len(content))
+		return sftpData, sftpTestAppendString(reply, string(content[offset:end]))
+	case sftpWrite:
+		h, offset, data := s.handles[p.string()], int(p.uint64()), p.string()
+		if h == nil {
+			return status(4, "Bad handle")
+		}
+		content := s.files[h.path]
+		if len(content) < offset+len(data) {
+			content = append(content, make([]byte, offset+len(data)-len(content))...)
+		}
+		copy(content[offset:], data)
+		s.files[h.path] = content
+		return status(sftpOK, "")
+	case sftpOpendir:
+		name := path.Clean(p.string())
+		if !s.dirs[name] {
+			return status(sftpNoSuchFile, "No such file")
+		}
+		return newHandle(&sftpTestHandle{path: name, dir: true})
+	case sftpReaddir:
+		h := s.handles[p.string()]
+		if h == nil || !h.dir {
+			return status(4, "Bad handle")
+		}
+		if h.listed {
+			return status(sftpEOF, "")
+		}
+		h.listed = true
+		entries := [][]byte{
+			sftpTestAppendAttrs(sftpTestAppendString(sftpTestAppendString(nil, "."), "drwxr-xr-x ."), 0, true),
+			sftpTestAppendAttrs(sftpTestAppendString(sftpTestAppendString(nil, ".."), "drwxr-xr-x .."), 0, true),
+		}
+		for _, name := range s.children(h.path) {
+			full := path.Join(h.path, name)
+			content, file := s.files[full]
+			entries = append(entries, sftpTestAppendAttrs(sftpTestAppendString(sftpTestAppendString(nil, name), "-rw-r--r-- "+name), len(content), !file))
+		}
+		reply = binary.BigEndian.AppendUint32(reply, uint32(len(entries)))
+		for _, entry := range entries {
+			reply = append(reply, entry...)
+		}
+		return sftpName, reply
+	case sftpRemove:
+		name := path.Clean(p.string())
+		if _, ok := s.files[name]; !ok {
+			return status(sftpNoSuchFile, "No such file")
+		}
+		delete(s.files, name)
+		return status(sftpOK, "")
+	case sftpMkdir:
+		name := path.Clean(p.string())
+		if !s.dirs[path.Dir(name)] {
+			return status(sftpNoSuchFile, "No such file")
+		}
+		s.dirs[name] = true
+		return status(sftpOK, "")
+	case sftpStat:
+		name := path.Clean(p.string())
+		if s.dirs[name] {
+			return sftpAttrs, sftpTestAppendAttrs(reply, 0, true)
+		}
+		content, ok := s.files[name]
+		if !ok {
+			return status(sftpNoSuchFile, "No such file")
+		}
+		return sftpAttrs, sftpTestAppendAttrs(reply, len(content), false)
+	case sftpRename:
+		from, to := path.Clean(p.string()), path.Clean(p.string())
+		if _, ok := s.files[to]; ok {
+			// Plain SFTP renames never replace a file
+			return status(4, "Failure")
+		}
+		return s.move(from, to, status)
+	case sftpExtended:
+		if name := p.string(); name != sftpPosixRename || !s.posixRename {
+			return status(8, "Unsupported")
+		}
+		from, to := path.Clean(p.string()), path.Clean(p.string())
+		return s.move(from, to, status)
+	}
+	return status(8, "Unsupported")
+}
+
+// move renames a file, replacing to
+func (s *sftpTestServer) move(from, to string, status func(uint32, string) (byte, []byte)) (byte, []byte) {
+	content, ok := s.files[from]
+	if !ok {
+		return status(sftpNoSuchFile, "No such file")
+	}
+	delete(s.files, from)
+	s.files[to] = content
+	return status(sftpOK, "")
+}
+
+// children returns the names of the files and directories in dir
+func (s *sftpTestServer) children(dir string) []string {
+	var names []string
+	for name := range s.files {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	for name := range s.dirs {
+		if name != dir && path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// File returns the content of a server file and whether it exists
+func (s *sftpTestServer) File(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content, ok := s.files[name]
+	return content, ok
+}
+
+// Files lists every server file
+func (s *sftpTestServer) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sftpTestConfig configures the storage for server, trusting its host key
+func sftpTestConfig(t *testing.T, server *sftpTestServer) *Config {
+	config := DefaultConfig()
+	config.SFTPAddress = server.Address
+	config.SFTPUser = "guides"
+	config.SFTPPassword = "s3cret"
+	config.SFTPPath = "guides"
+	config.SFTPCachePath = t.TempDir()
+	config.SFTPCacheTTL = 0
+	config.SFTPHostKeyFingerprints = []string{ssh.FingerprintSHA256(server.HostKey.PublicKey())}
+	return config
+}
+
+// sftpTestGuide is larger than the read and write windows, so transfers
+// keep several requests in flight and wrap around them
+var sftpTestGuide = bytes.Repeat([]byte("%PDF-1.7 user guide page\n"), 40000)
+
+func TestSFTPStorageRoundTrip(t *testing.T) {
+	for _, posixRename := range []bool{true, false} {
+		t.Run("posix-rename "+strconv.FormatBool(posixRename), func(t *testing.T) {
+			server := newSFTPTestServer(t)
+			server.posixRename = posixRename
+			storage, err := NewSFTPStorage(sftpTestConfig(t, server))
+			if err != nil {
+				t.Fatalf("create storage: %v", err)
+			}
+			defer closeStorage(storage)
+			ctx := context.Background()
+
+			if err := storage.Put(ctx, "acme/setup-guide.pdf", bytes.NewReader(sftpTestGuide)); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if content, ok := server.File("guides/acme/setup-guide.pdf"); !ok || !bytes.Equal(content, sftpTestGuide) {
+				t.Fatalf("server holds %d bytes, want %d", len(content), len(sftpTestGuide))
+			}
+			// A replaced guide goes through the rename too
+			if err := storage.Put(ctx, "acme/setup-guide.pdf", strings.NewReader("%PDF-1.7 v2")); err != nil {
+				t.Fatalf("replace: %v", err)
+			}
+			if err := storage.Put(ctx, "acme/setup-guide.pdf", bytes.NewReader(sftpTestGuide)); err != nil {
+				t.Fatalf("replace again: %v", err)
+			}
+			if files := server.Files(); len(files) != 1 {
+				t.Errorf("server files = %v, want no temporary files left", files)
+			}
+
+			info, err := storage.Stat(ctx, "acme/setup-guide.pdf")
+			if err != nil {
+				t.Fatalf("stat: %v", err)
+			}
+			if info.Size != int64(len(sftpTestGuide)) || info.ModTime.Unix() != sftpTestModTime {
+				t.Errorf("info = %+v", info)
+			}
+
+			body, err := storage.Open(ctx, "acme/setup-guide.pdf")
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			content, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || !bytes.Equal(content, sftpTestGuide) {
+				t.Fatalf("read %d bytes (%v), want %d", len(content), err, len(sftpTestGuide))
+			}
+
+			objects, err := storage.List(ctx, "acme/")
+			if err != nil || len(objects) != 1 || objects[0].Key != "acme/setup-guide.pdf" {
+				t.Errorf("list = %+v, %v", objects, err)
+			}
+
+			if err := storage.Delete(ctx, "acme/setup-guide.pdf"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if _, err := storage.Stat(ctx, "acme/setup-guide.pdf"); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("stat after delete: %v, want ErrObjectNotFound", err)
+			}
+			if _, err := storage.Open(ctx, "missing.pdf"); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("open missing: %v, want ErrObjectNotFound", err)
+			}
+		})
+	}
+}
+
+func TestSFTPShortReads(t *testing.T) {
+	server := newSFTPTestServer(t)
+	server.maxRead = 1000
+	storage, err := NewSFTPStorage(sftpTestConfig(t, server))
+	if err != nil {
+		t.Fatalf("create storage: %v", err)
+	}
+	defer closeStorage(storage)
+	ctx := context.Background()
+	if err := storage.Put(ctx, "user-guide.pdf", bytes.NewReader(sftpTestGuide)); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	body, err := storage.Open(ctx, "user-guide.pdf")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer body.Close()
+	content, err := io.ReadAll(body)
+	if err != nil || !bytes.Equal(content, sftpTestGuide) {
+		t.Fatalf("read %d bytes (%v), want %d in order", len(content), err, len(sftpTestGuide))
+	}
+}
+
+func TestReadSFTPPacket(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		kind byte
+		want []byte
+	}{
+		{"status", []byte{0, 0, 0, 5, sftpStatus, 0, 0, 0, 7}, sftpStatus, []byte{0, 0, 0, 7}},
+		{"no payload", []byte{0, 0, 0, 1, sftpVersion}, sftpVersion, []byte{}},
+		{"empty length", []byte{0, 0, 0, 0, sftpStatus}, 0, nil},
+		{"oversized", []byte{0, 0x10, 0, 1, sftpData}, 0, nil},
+		{"truncated header", []byte{0, 0, 0}, 0, nil},
+		{"truncated payload", []byte{0, 0, 0, 9, sftpStatus, 0, 0}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, data, err := readSFTPPacket(bytes.NewReader(tt.data))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("packet %v accepted", tt.data)
+				}
+				return
+			}
+			if err != nil || kind != tt.kind || !bytes.Equal(data, tt.want) {
+				t.Errorf("packet = %d %v, %v", kind, data, err)
+			}
+		})
+	}
+}
+
+func TestSFTPBufferRoundTrip(t *testing.T) {
+	var b sftpBuffer
+	b.uint32(7)
+	b.uint64(1 << 40)
+	b.string("guides/user-guide.pdf")
+	b.bytes([]byte{0, 1, 2})
+	b = sftpBuffer(sftpTestAppendAttrs(b, 4096, false))
+
+	r := sftpReader{data: b}
+	if r.uint32() != 7 || r.uint64() != 1<<40 || r.string() != "guides/user-guide.pdf" || r.string() != "\x00\x01\x02" {
+		t.Fatal("values changed in a round trip")
+	}
+	attrs := r.attributes()
+	if r.err != nil || attrs.size != 4096 || !attrs.isRegular() || attrs.modTime.Unix() != sftpTestModTime {
+		t.Errorf("attributes = %+v, %v", attrs, r.err)
+	}
+	if len(r.data) != 0 {
+		t.Errorf("%d bytes left over", len(r.data))
+	}
+
+	// Extended attributes and owners are skipped
+	var extended sftpBuffer
+	extended.uint32(sftpAttrUIDGID | sftpAttrPermissions | sftpAttrExtended)
+	extended.uint32(1000)
+	extended.uint32(1000)
+	extended.uint32(0o040755)
+	extended.uint32(1)
+	extended.string("acl@example.com")
+	extended.string("rwx")
+	r = sftpReader{data: extended}
+	if attrs := r.attributes(); r.err != nil || !attrs.isDir() || len(r.data) != 0 {
+		t.Errorf("extended attributes = %+v, %v", attrs, r.err)
+	}
+}
+
+func TestSFTPReaderTruncated(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"short integer":     {0, 0, 1},
+		"string past end":   {0, 0, 0, 9, 'a', 'b'},
+		"attributes size":   {0, 0, 0, sftpAttrSize, 0, 0},
+		"extended attrs":    {0x80, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 1, 'a'},
+		"status no message": {},
+	} {
+		r := sftpReader{data: data}
+		r.attributes()
+		r.string()
+		if !errors.Is(r.err, errSFTPShort) {
+			t.Errorf("%s: err = %v, want a truncated response", name, r.err)
+		}
+	}
+
+	// A failure status keeps the server's message
+	status := sftpPacket{kind: sftpStatus, data: sftpTestAppendString(binary.BigEndian.AppendUint32(nil, sftpNoSuchFile), "No such file")}
+	if err := status.status(sftpAttrs); !sftpNotFound(err) || !strings.Contains(err.Error(), "No such file") {
+		t.Errorf("status = %v", err)
+	}
+	if err := (sftpPacket{kind: sftpData}).status(sftpAttrs); err == nil {
+		t.Error("unexpected response type accepted")
+	}
+}
@@ -0,0 +1,504 @@
+package userguide
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// StorageBackendSFTP names the SFTP server guide store
+const StorageBackendSFTP = "sftp"
+
+func init() {
+	RegisterStorage(StorageBackendSFTP, func(config *Config) (Storage, error) { return NewSFTPStorage(config) })
+}
+
+// SFTPStorage keeps guides as files below a directory of an SFTP server.
+// Requests share a pool of up to sftp.pool.size SSH connections, each
+// closed once unused for sftp.pool.idle.timeout. The server must present a
+// host key listed in sftp.known.hosts or sftp.host.key.fingerprints;
+// unknown servers are never trusted. Like S3Storage it serves guides from
+// local copies, downloaded again when a file's size or modification time
+// changes.
+type SFTPStorage struct {
+	address string
+	user    string
+	root    string
+	pool    *sftpPool
+	cache   *objectCache
+}
+
+// NewSFTPStorage creates a storage of the files below sftp.path on the
+// sftp.address server
+func NewSFTPStorage(config *Config) (*SFTPStorage, error) {
+	if config.SFTPAddress == "" || config.SFTPUser == "" {
+		return nil, fmt.Errorf("storage.type=%s needs sftp.address and sftp.user", StorageBackendSFTP)
+	}
+	address := config.SFTPAddress
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+	auth, err := sftpAuth(config)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := sftpHostKeyCallback(config)
+	if err != nil {
+		return nil, err
+	}
+	cacheDir := config.SFTPCachePath
+	if cacheDir == "" {
+		cacheDir = filepath.Join(config.UserGuidePath, ".sftp-cache")
+	}
+	s := &SFTPStorage{
+		address: address,
+		user:    config.SFTPUser,
+		root:    strings.TrimSuffix(config.SFTPPath, "/"),
+	}
+	clientConfig := &ssh.ClientConfig{User: config.SFTPUser, Auth: auth, HostKeyCallback: hostKeys}
+	s.pool = newSFTPPool(config.SFTPPoolSize, config.SFTPIdleTimeout, func(ctx context.Context) (*sftpConn, error) {
+		return dialSFTP(ctx, address, clientConfig, config.SFTPTimeout)
+	})
+	if s.cache, err = newObjectCache(StorageBackendSFTP, s.String(), cacheDir, config.SFTPCacheTTL); err != nil {
+		return nil, err
+	}
+	s.cache.head = s.head
+	s.cache.download = func(ctx context.Context, info ObjectInfo) (io.ReadCloser, error) {
+		return s.Open(ctx, info.Key)
+	}
+	return s, nil
+}
+
+// String describes the server directory for logs
+func (s *SFTPStorage) String() string {
+	return "sftp://" + s.user + "@" + s.address + "/" + strings.TrimPrefix(s.root+"/", "/")
+}
+
+// remotePath returns the server path of key; without sftp.path it is
+// relative to the login directory
+func (s *SFTPStorage) remotePath(key string) string {
+	if s.root == "" {
+		return key
+	}
+	return path.Join(s.root, key)
+}
+
+// withConn runs fn on a pooled connection. A request failing on a reused
+// connection, which the server may have dropped while idle, is tried once
+// more on a new one.
+func (s *SFTPStorage) withConn(ctx context.Context, fn func(conn *sftpConn) error) error {
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := s.pool.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(conn)
+		s.pool.put(conn)
+		if err == nil || !reused || attempt > 0 || !conn.broken() || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (s *SFTPStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkObjectKey(key); err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := s.pool.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		handle, err := conn.open(ctx, s.remotePath(key), sftpFlagRead)
+		if err == nil {
+			return &sftpFileReader{ctx: ctx, conn: conn, handle: handle, release: func() { s.pool.put(conn) }}, nil
+		}
+		s.pool.put(conn)
+		if !reused || attempt > 0 || !conn.broken() || ctx.Err() != nil {
+			return nil, sftpError(err, key)
+		}
+	}
+}
+
+func (s *SFTPStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return s.cache.Stat(ctx, key)
+}
+
+// head reads the attributes of key's file
+func (s *SFTPStorage) head(ctx context.Context, key string) (ObjectInfo, error) {
+	var attrs sftpAttributes
+	err := s.withConn(ctx, func(conn *sftpConn) error {
+		var err error
+		attrs, err = conn.stat(ctx, s.remotePath(key))
+		return err
+	})
+	if err != nil {
+		return ObjectInfo{}, sftpError(err, key)
+	}
+	if !attrs.isRegular() {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return ObjectInfo{Key: key, Size: attrs.size, ModTime: attrs.modTime}, nil
+}
+
+// LocalPath returns the cached copy of key, downloading it when needed
+func (s *SFTPStorage) LocalPath(ctx context.Context, key string) (string, error) {
+	return s.cache.LocalPath(ctx, key)
+}
+
+// List walks the directories below prefix. Symlinks and other special
+// files are not listed.
+func (s *SFTPStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	start := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = prefix[:i]
+	}
+	err := s.withConn(ctx, func(conn *sftpConn) error {
+		objects = nil
+		return s.walk(ctx, conn, start, prefix, &objects)
+	})
+	if err != nil && !sftpNotFound(err) {
+		return nil, fmt.Errorf("sftp list %s: %v", prefix, err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// walk adds the files below dir whose keys start with prefix to objects
+func (s *SFTPStorage) walk(ctx context.Context, conn *sftpConn, dir, prefix string, objects *[]ObjectInfo) error {
+	remote := s.root
+	if dir != "" {
+		remote = s.remotePath(dir)
+	} else if remote == "" {
+		remote = "."
+	}
+	entries, err := conn.readDir(ctx, remote)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		key := entry.name
+		if dir != "" {
+			key = dir + "/" + entry.name
+		}
+		if checkObjectKey(key) != nil || hiddenKey(key) {
+			continue
+		}
+		switch {
+		case entry.attrs.isDir():
+			// Only descend into directories the prefix can match below
+			if strings.HasPrefix(key+"/", prefix) || strings.HasPrefix(prefix, key+"/") {
+				if err := s.walk(ctx, conn, key, prefix, objects); err != nil {
+					return err
+				}
+			}
+		case entry.attrs.isRegular() && strings.HasPrefix(key, prefix):
+			*objects = append(*objects, ObjectInfo{Key: key, Size: entry.attrs.size, ModTime: entry.attrs.modTime})
+		}
+	}
+	return nil
+}
+
+// Put writes body to a hidden temporary file next to key's, then renames
+// it into place, so readers never see a partial guide
+func (s *SFTPStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	target := s.remotePath(key)
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	tmp := path.Join(path.Dir(target), ".upload-"+hex.EncodeToString(suffix))
+	conn, _, err := s.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.pool.put(conn)
+	defer s.cache.Forget(key)
+	if dir := path.Dir(key); dir != "." {
+		if err := s.mkdirAll(ctx, conn, dir); err != nil {
+			return fmt.Errorf("sftp mkdir %s: %v", dir, err)
+		}
+	}
+	handle, err := conn.open(ctx, tmp, sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc)
+	if err != nil {
+		return fmt.Errorf("sftp upload %s: %v", key, err)
+	}
+	err = conn.write(ctx, handle, body)
+	if closeErr := conn.closeHandle(ctx, handle); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = conn.rename(ctx, tmp, target)
+	}
+	if err != nil {
+		conn.pathRequest(context.WithoutCancel(ctx), sftpRemove, tmp)
+		return fmt.Errorf("sftp upload %s: %v", key, err)
+	}
+	return nil
+}
+
+// mkdirAll creates the directory of keys dir and its parents below the root
+func (s *SFTPStorage) mkdirAll(ctx context.Context, conn *sftpConn, dir string) error {
+	attrs, err := conn.stat(ctx, s.remotePath(dir))
+	if err == nil {
+		if !attrs.isDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if !sftpNotFound(err) {
+		return err
+	}
+	if parent := path.Dir(dir); parent != "." {
+		if err := s.mkdirAll(ctx, conn, parent); err != nil {
+			return err
+		}
+	}
+	return conn.pathRequest(ctx, sftpMkdir, s.remotePath(dir))
+}
+
+func (s *SFTPStorage) Delete(ctx context.Context, key string) error {
+	if err := checkObjectKey(key); err != nil {
+		return err
+	}
+	err := s.withConn(ctx, func(conn *sftpConn) error {
+		return conn.pathRequest(ctx, sftpRemove, s.remotePath(key))
+	})
+	s.cache.Forget(key)
+	if err != nil && !sftpNotFound(err) {
+		return fmt.Errorf("sftp delete %s: %v", key, err)
+	}
+	s.cache.Remove(key)
+	return nil
+}
+
+// Probe checks that the guide directory can be read, for the storage
+// health check
+func (s *SFTPStorage) Probe(ctx context.Context) error {
+	remote := s.root
+	if remote == "" {
+		remote = "."
+	}
+	return s.withConn(ctx, func(conn *sftpConn) error {
+		attrs, err := conn.stat(ctx, remote)
+		if err == nil && !attrs.isDir() {
+			err = fmt.Errorf("%s is not a directory", remote)
+		}
+		return err
+	})
+}
+
+// sftpError maps a missing file to ErrObjectNotFound
+func sftpError(err error, key string) error {
+	if sftpNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return fmt.Errorf("sftp %s: %v", key, err)
+}
+
+// sftpAuth returns the SSH authentication methods configured: the key of
+// sftp.private.key.file, then sftp.password
+func sftpAuth(config *Config) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if config.SFTPPrivateKeyFile != "" {
+		pemBytes, err := os.ReadFile(config.SFTPPrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read sftp.private.key.file: %v", err)
+		}
+		var signer ssh.Signer
+		if config.SFTPPrivateKeyPassword != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(config.SFTPPrivateKeyPassword))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pemBytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid sftp.private.key.file: %v", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if config.SFTPPassword != "" {
+		methods = append(methods, ssh.Password(config.SFTPPassword))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("storage.type=%s needs sftp.private.key.file or sftp.password", StorageBackendSFTP)
+	}
+	return methods, nil
+}
+
+// sftpHostKeyCallback accepts the host keys of sftp.known.hosts and those
+// with a SHA256 fingerprint in sftp.host.key.fingerprints
+func sftpHostKeyCallback(config *Config) (ssh.HostKeyCallback, error) {
+	if config.SFTPKnownHosts == "" && len(config.SFTPHostKeyFingerprints) == 0 {
+		return nil, fmt.Errorf("storage.type=%s needs sftp.known.hosts or sftp.host.key.fingerprints", StorageBackendSFTP)
+	}
+	var known ssh.HostKeyCallback
+	if config.SFTPKnownHosts != "" {
+		var err error
+		if known, err = knownhosts.New(config.SFTPKnownHosts); err != nil {
+			return nil, fmt.Errorf("invalid sftp.known.hosts: %v", err)
+		}
+	}
+	fingerprints := config.SFTPHostKeyFingerprints
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if slices.Contains(fingerprints, ssh.FingerprintSHA256(key)) {
+			return nil
+		}
+		if known == nil {
+			return fmt.Errorf("host key %s of %s is not in sftp.host.key.fingerprints", ssh.FingerprintSHA256(key), hostname)
+		}
+		if err := known(hostname, remote, key); err != nil {
+			return fmt.Errorf("host key %s of %s: %w", ssh.FingerprintSHA256(key), hostname, err)
+		}
+		return nil
+	}, nil
+}
+
+// probeKey is a key no server has, offered to the host key callback to
+// learn which key types it knows for a host
+var probeKey = func() ssh.PublicKey {
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(public)
+	return key
+}()
+
+// knownHostAlgorithms returns the host key algorithms to ask address for:
+// those of the keys known for it, so the server does not present a key
+// type known_hosts has no line for. Nil leaves the choice to the server.
+func knownHostAlgorithms(callback ssh.HostKeyCallback, address string, remote net.Addr) []string {
+	var keyErr *knownhosts.KeyError
+	if err := callback(address, remote, probeKey); !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// dialSFTP connects to address and starts an SFTP session, giving the
+// connection and SSH handshake timeout to complete
+func dialSFTP(ctx context.Context, address string, config *ssh.ClientConfig, timeout time.Duration) (*sftpConn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	raw, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig := *config
+	if config.HostKeyAlgorithms == nil {
+		clientConfig.HostKeyAlgorithms = knownHostAlgorithms(config.HostKeyCallback, address, raw.RemoteAddr())
+	}
+	raw.SetDeadline(time.Now().Add(timeout))
+	sshConn, channels, requests, err := ssh.NewClientConn(raw, address, &clientConfig)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	conn, err := newSFTPConn(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// sftpPool hands out SFTP connections, at most size at a time, keeping
+// the idle ones for reuse until they were unused for idleTimeout
+type sftpPool struct {
+	dial        func(ctx context.Context) (*sftpConn, error)
+	idleTimeout time.Duration
+	slots       chan struct{}
+
+	mu   sync.Mutex
+	idle []*sftpConn
+}
+
+func newSFTPPool(size int, idleTimeout time.Duration, dial func(ctx context.Context) (*sftpConn, error)) *sftpPool {
+	return &sftpPool{dial: dial, idleTimeout: idleTimeout, slots: make(chan struct{}, size)}
+}
+
+// get returns an idle connection, or a new one when there is none, waiting
+// while size connections are in use. reused reports an idle connection.
+func (p *sftpPool) get(ctx context.Context) (conn *sftpConn, reused bool, err error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	p.mu.Lock()
+	for len(p.idle) > 0 && conn == nil {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if last.broken() || time.Since(last.lastUsed) > p.idleTimeout {
+			last.Close()
+			continue
+		}
+		conn = last
+	}
+	p.closeExpired()
+	p.mu.Unlock()
+	if conn != nil {
+		metrics.Inc("userguide_sftp_connections_total", "result", "reused")
+		return conn, true, nil
+	}
+	if conn, err = p.dial(ctx); err != nil {
+		<-p.slots
+		metrics.Inc("userguide_sftp_connections_total", "result", "failed")
+		return nil, false, fmt.Errorf("sftp connection failed: %v", err)
+	}
+	metrics.Inc("userguide_sftp_connections_total", "result", "new")
+	return conn, false, nil
+}
+
+// put returns conn to the pool, closing it when it failed
+func (p *sftpPool) put(conn *sftpConn) {
+	p.mu.Lock()
+	if conn.broken() {
+		conn.Close()
+	} else {
+		conn.lastUsed = time.Now()
+		p.idle = append(p.idle, conn)
+		time.AfterFunc(p.idleTimeout+time.Second, func() {
+			p.mu.Lock()
+			p.closeExpired()
+			p.mu.Unlock()
+		})
+	}
+	p.closeExpired()
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// closeExpired closes the idle connections unused for idleTimeout, the
+// oldest being first in idle
+func (p *sftpPool) closeExpired() {
+	for len(p.idle) > 0 && time.Since(p.idle[0].lastUsed) > p.idleTimeout {
+		p.idle[0].Close()
+		p.idle = p.idle[1:]
+	}
+}
@@ -0,0 +1,174 @@
+package userguide
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shadow modes: what a mirrored request asks staging for
+const (
+	ShadowHeaders = "headers"
+	ShadowFull    = "full"
+)
+
+// ShadowHeader marks mirrored requests, so staging can tell them apart and
+// never mirrors them again
+const ShadowHeader = "X-Shadow-Request"
+
+// TrafficShadow mirrors a sample of download requests to a staging
+// instance, so a new storage backend there sees production traffic
+// patterns. Mirrors are sent after the production response is complete,
+// by a few workers reading a bounded queue; when staging falls behind,
+// mirrors are dropped rather than slowing production. In headers mode
+// staging gets a HEAD request; in full mode the original request, whose
+// response body is read to the end. Staging's status and length are
+// compared with production's.
+type TrafficShadow struct {
+	target  *url.URL
+	percent float64
+	mode    string
+	strip   []string
+	workers int
+	client  *http.Client
+	queue   chan shadowRequest
+}
+
+// shadowRequest is a download to mirror with what production answered
+type shadowRequest struct {
+	method   string
+	uri      string
+	header   http.Header
+	clientIP string
+	status   int
+	length   int64
+}
+
+// NewTrafficShadow creates the shadow for shadow.url; it returns nil when
+// shadowing is off
+func NewTrafficShadow(config *Config) *TrafficShadow {
+	if config.ShadowURL == "" || config.ShadowPercent <= 0 {
+		return nil
+	}
+	target, _ := url.Parse(strings.TrimSuffix(config.ShadowURL, "/"))
+	return &TrafficShadow{
+		target:  target,
+		percent: config.ShadowPercent,
+		mode:    config.ShadowMode,
+		strip:   config.ShadowStripHeaders,
+		workers: config.ShadowWorkers,
+		client:  NewHTTPClient(config, config.ShadowTimeout),
+		queue:   make(chan shadowRequest, config.ShadowQueue),
+	}
+}
+
+// String describes the shadow for the boot report
+func (ts *TrafficShadow) String() string {
+	return fmt.Sprintf("%g%% of downloads mirrored to %s (%s)", ts.percent, redactURL(ts.target.String()), ts.mode)
+}
+
+// Run sends queued mirrors until ctx is cancelled
+func (ts *TrafficShadow) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < ts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case sr := <-ts.queue:
+					ts.mirror(ctx, sr)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Middleware queues a sample of the requests it serves for mirroring once
+// they are answered. Requests with a body are not mirrored.
+func (ts *TrafficShadow) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ShadowHeader) != "" || r.ContentLength != 0 || rand.Float64()*100 >= ts.percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sr := shadowRequest{
+			method:   r.Method,
+			uri:      r.URL.RequestURI(),
+			header:   r.Header.Clone(),
+			clientIP: clientIPFromContext(r.Context()),
+		}
+		sw := &usageWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		sr.status, sr.length = sw.status, sw.written
+		if declared, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			sr.length = declared
+		}
+		select {
+		case ts.queue <- sr:
+		default:
+			metrics.Inc("userguide_shadow_requests_total", "result", "dropped")
+		}
+	})
+}
+
+// mirror sends sr to staging and compares the answer with production's
+func (ts *TrafficShadow) mirror(ctx context.Context, sr shadowRequest) {
+	method := sr.method
+	if ts.mode == ShadowHeaders {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, ts.target.String()+sr.uri, nil)
+	if err != nil {
+		metrics.Inc("userguide_shadow_requests_total", "result", "error")
+		return
+	}
+	req.Header = sr.header
+	for _, name := range ts.strip {
+		req.Header.Del(name)
+	}
+	req.Header.Set(ShadowHeader, "1")
+	if sr.clientIP != "" {
+		req.Header.Set("X-Forwarded-For", sr.clientIP)
+	}
+
+	start := time.Now()
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		metrics.Inc("userguide_shadow_requests_total", "result", "error")
+		log.Printf("Shadow %s %s failed: %s", method, sr.uri, err.Error())
+		return
+	}
+	length := resp.ContentLength
+	if ts.mode == ShadowFull {
+		n, err := io.Copy(io.Discard, resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			metrics.Inc("userguide_shadow_requests_total", "result", "error")
+			log.Printf("Shadow %s %s failed reading the body: %s", method, sr.uri, err.Error())
+			return
+		}
+		length = n
+	}
+	resp.Body.Close()
+	metrics.Observe("userguide_shadow_duration_seconds", time.Since(start).Seconds())
+
+	if resp.StatusCode != sr.status || (length >= 0 && length != sr.length) {
+		metrics.Inc("userguide_shadow_requests_total", "result", "mismatch")
+		log.Printf("Shadow %s %s differs: production %d (%d bytes), staging %d (%d bytes)",
+			method, sr.uri, sr.status, sr.length, resp.StatusCode, length)
+		return
+	}
+	metrics.Inc("userguide_shadow_requests_total", "result", "match")
+}
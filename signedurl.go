@@ -0,0 +1,183 @@
+package userguide
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Query parameters carried by signed URLs
+const (
+	signedURLExpiresParam = "expires"
+	signedURLSigParam     = "sig"
+)
+
+// ErrSignedURLInvalid is returned for forged, altered or expired signed URLs
+var ErrSignedURLInvalid = errors.New("signed URL invalid or expired")
+
+// URLSigner signs guide URLs with an expiry so they can be shared with
+// people who have no credentials. The signature covers the path and every
+// query parameter, so a link cannot be pointed at another guide.
+type URLSigner struct {
+	secret []byte
+	ttl    time.Duration
+	maxTTL time.Duration
+}
+
+// NewURLSigner creates a signer for signed.url.* settings; it returns nil
+// when no secret is configured, which disables signed URLs
+func NewURLSigner(config *Config) *URLSigner {
+	if config.SignedURLSecret == "" {
+		return nil
+	}
+	return &URLSigner{secret: []byte(config.SignedURLSecret), ttl: config.SignedURLTTL, maxTTL: config.SignedURLMaxTTL}
+}
+
+// Sign returns target with expires and sig parameters added; a zero ttl
+// means signed.url.ttl
+func (us *URLSigner) Sign(target *url.URL, ttl time.Duration) (string, time.Time) {
+	if ttl <= 0 {
+		ttl = us.ttl
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	query := target.Query()
+	query.Del(signedURLSigParam)
+	query.Set(signedURLExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	signed := url.URL{Path: target.Path, RawQuery: query.Encode()}
+	query.Set(signedURLSigParam, us.signature(signed.EscapedPath(), query))
+	signed.RawQuery = query.Encode()
+	return signed.String(), expires
+}
+
+// Verify checks the signature and expiry of a request's URL
+func (us *URLSigner) Verify(u *url.URL) error {
+	query := u.Query()
+	sig := query.Get(signedURLSigParam)
+	expires, err := strconv.ParseInt(query.Get(signedURLExpiresParam), 10, 64)
+	if sig == "" || err != nil || time.Now().Unix() > expires {
+		return ErrSignedURLInvalid
+	}
+	presented, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrSignedURLInvalid
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(us.signature(u.EscapedPath(), query))
+	if !hmac.Equal(presented, expected) {
+		return ErrSignedURLInvalid
+	}
+	return nil
+}
+
+// signature signs the path and the sorted query without the sig parameter
+func (us *URLSigner) signature(path string, query url.Values) string {
+	unsigned := make(url.Values, len(query))
+	for key, values := range query {
+		if key != signedURLSigParam {
+			unsigned[key] = values
+		}
+	}
+	mac := hmac.New(sha256.New, us.secret)
+	mac.Write([]byte("signed-url|" + path + "?" + unsigned.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type signedURLContextKey struct{}
+
+// signedURLFromContext reports whether the request came through a valid signed URL
+func signedURLFromContext(ctx context.Context) bool {
+	signed, _ := ctx.Value(signedURLContextKey{}).(bool)
+	return signed
+}
+
+// SignedURLMiddleware serves GET and HEAD requests carrying a valid
+// signature with open, skipping the credential checks of guarded; requests
+// with a bad or expired signature get a 403 and all others go to guarded
+func SignedURLMiddleware(signer *URLSigner, guarded, open http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != "GET" && r.Method != "HEAD") || !r.URL.Query().Has(signedURLSigParam) {
+			guarded.ServeHTTP(w, r)
+			return
+		}
+		if err := signer.Verify(r.URL); err != nil {
+			log.Printf("Rejected signed URL for %s from %s: %s", r.URL.Path, r.RemoteAddr, err.Error())
+			metrics.Inc("userguide_signed_url_requests_total", "result", "rejected")
+			http.Error(w, "Link invalid or expired", http.StatusForbidden)
+			return
+		}
+		metrics.Inc("userguide_signed_url_requests_total", "result", "accepted")
+		// Links must not leak through the Referer of anything the guide opens
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		open.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signedURLContextKey{}, true)))
+	})
+}
+
+// signRequest is the body of POST /sign
+type signRequest struct {
+	Path string `json:"path"`
+	TTL  string `json:"ttl"`
+}
+
+// signResponse carries the shareable link
+type signResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SignHandler returns a signed, expiring URL for a guide route, e.g.
+// {"path": "/download/userguide", "ttl": "24h"}
+func (ah *AdminHandler) SignHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	var req signRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "request body must be {\"path\": route, \"ttl\": duration}"})
+		return
+	}
+	target, err := url.Parse(req.Path)
+	if err != nil || target.Scheme != "" || target.Host != "" || !strings.HasPrefix(target.Path, "/") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path must be a local path such as /download/userguide"})
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ttl must be a positive duration such as 24h"})
+			return
+		}
+	}
+	if ttl > ah.signer.maxTTL {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ttl exceeds signed.url.max.ttl of " + ah.signer.maxTTL.String()})
+		return
+	}
+	var match mux.RouteMatch
+	probe := &http.Request{Method: "GET", URL: target, Header: http.Header{}}
+	if ah.router == nil || !ah.router.Match(probe, &match) || match.MatchErr != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no download route matches " + target.Path})
+		return
+	}
+	// The /protected routes check their bearer token before any signature,
+	// so such a link would never work; restricted guides are shared with
+	// POST /token/download instead
+	if template, err := match.Route.GetPathTemplate(); err != nil || strings.HasPrefix(template, "/protected/") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "restricted guides cannot be shared by signed URL"})
+		return
+	}
+	if !ah.permitted(w, r, "url.sign", target.Path) {
+		return
+	}
+
+	signed, expires := ah.signer.Sign(target, ttl)
+	log.Printf("Signed %s until %s for %s", target.Path, expires.UTC().Format(time.RFC3339), identityFromRequest(r, ah.utils).Subject)
+	metrics.Inc("userguide_signed_urls_issued_total")
+	writeJSON(w, http.StatusOK, signResponse{URL: signed, ExpiresAt: expires.UTC()})
+}
@@ -0,0 +1,143 @@
+package userguide
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"userguide_api_poc/samples"
+)
+
+// signTestURL asks POST /sign of h for a link to path
+func signTestURL(t *testing.T, h *testHarness, path string) (string, int) {
+	t.Helper()
+	body, _ := json.Marshal(signRequest{Path: path})
+	req, err := http.NewRequest(http.MethodPost, h.Server.URL+"/sign", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp, err := h.Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST /sign: %v", err)
+	}
+	defer resp.Body.Close()
+	var signed signResponse
+	json.NewDecoder(resp.Body).Decode(&signed)
+	return signed.URL, resp.StatusCode
+}
+
+// newSignedURLHarness serves product guides that need an API key, which
+// no test holds, so only signed links reach them
+func newSignedURLHarness(t *testing.T) *testHarness {
+	keys := filepath.Join(t.TempDir(), "apikeys.json")
+	if err := os.WriteFile(keys, []byte("{}"), 0600); err != nil {
+		t.Fatalf("write key file: %v", err)
+	}
+	h := newProtectedHarness(t, func(config *Config) {
+		config.ProductsEnabled = true
+		config.AdminToken = "admin-token"
+		config.SignedURLSecret = "signed-url-secret"
+		config.APIKeysFile = keys
+		config.APIKeyRoutes = map[string]string{"/products/{product}/guides/{name}": ""}
+	})
+	h.Storage.Add("acme/setup.pdf", samples.PDF("Setup"))
+	h.Storage.Add("acme/manual.pdf", samples.PDF("Manual"))
+	return h
+}
+
+func TestSignedURLs(t *testing.T) {
+	h := newSignedURLHarness(t)
+	link, status := signTestURL(t, h, "/products/acme/guides/setup.pdf")
+	if status != http.StatusOK {
+		t.Fatalf("sign status = %d, want 200", status)
+	}
+	signed, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("signed URL %q: %v", link, err)
+	}
+	query := signed.Query()
+
+	// with returns the signed link with its path or one parameter changed
+	with := func(path, param, value string) string {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		if param != "" {
+			q.Set(param, value)
+		}
+		return path + "?" + q.Encode()
+	}
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"as signed", link, http.StatusOK},
+		{"unsigned", signed.Path, http.StatusUnauthorized},
+		{"other guide name", with("/products/acme/guides/manual.pdf", "", ""), http.StatusForbidden},
+		{"other product", with("/products/other/guides/setup.pdf", "", ""), http.StatusForbidden},
+		{"other route", with("/download/userguide", "", ""), http.StatusForbidden},
+		{"added parameter", with(signed.Path, "variant", "mobile"), http.StatusForbidden},
+		{"later expiry", with(signed.Path, signedURLExpiresParam, "99999999999"), http.StatusForbidden},
+		{"altered signature", with(signed.Path, signedURLSigParam, strings.Repeat("A", 43)), http.StatusForbidden},
+		{"malformed signature", with(signed.Path, signedURLSigParam, "%%%"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if resp := h.Get(t, tt.path, ""); resp.StatusCode != tt.want {
+				t.Errorf("GET %s: status = %d, want %d", tt.path, resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedURLExpiry(t *testing.T) {
+	signer := &URLSigner{secret: []byte("signed-url-secret"), ttl: time.Hour, maxTTL: time.Hour}
+	target, _ := url.Parse("/download/userguide")
+
+	link, _ := signer.Sign(target, time.Hour)
+	valid, _ := url.Parse(link)
+	if err := signer.Verify(valid); err != nil {
+		t.Errorf("fresh link: %v", err)
+	}
+
+	past := *signer
+	past.ttl = -time.Second
+	link, _ = past.Sign(target, 0)
+	stale, _ := url.Parse(link)
+	if err := signer.Verify(stale); err != ErrSignedURLInvalid {
+		t.Errorf("expired link: err = %v, want ErrSignedURLInvalid", err)
+	}
+
+	other := &URLSigner{secret: []byte("another-secret")}
+	if err := other.Verify(valid); err != ErrSignedURLInvalid {
+		t.Errorf("link of another secret: err = %v, want ErrSignedURLInvalid", err)
+	}
+}
+
+func TestSignRefusesProtectedRoutes(t *testing.T) {
+	h := newSignedURLHarness(t)
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/download/userguide", http.StatusOK},
+		{"/protected/download", http.StatusBadRequest},
+		{"/protected/guides/manual.pdf", http.StatusBadRequest},
+		{"/nowhere", http.StatusNotFound},
+		{"https://example.com/download/userguide", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if _, status := signTestURL(t, h, tt.path); status != tt.want {
+			t.Errorf("sign %s: status = %d, want %d", tt.path, status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package userguide
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SLO names used as the slo label
+const (
+	SLOAvailability = "availability"
+	SLOLatency      = "latency"
+)
+
+// RouteMetrics records request counts and latency per route template and
+// feeds them to the SLO tracker
+type RouteMetrics struct {
+	slo *SLOTracker
+}
+
+// NewRouteMetrics creates the per-route instrumentation for slo.* settings
+func NewRouteMetrics(config *Config) *RouteMetrics {
+	tracker := NewSLOTracker(config)
+	metrics.AddCollector(tracker.collect)
+	return &RouteMetrics{slo: tracker}
+}
+
+// Middleware instruments every matched route. Latency for the SLO is time
+// to first byte, so large downloads on slow links do not count as slow.
+func (rm *RouteMetrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, start: start}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+			sw.firstByte = time.Since(start)
+		}
+
+		metrics.Inc("userguide_http_requests_total", "route", route, "method", r.Method, "code", strconv.Itoa(sw.status))
+		metrics.Observe("userguide_http_request_duration_seconds", time.Since(start).Seconds(), "route", route, "method", r.Method)
+		rm.slo.Record(route, sw.status, sw.firstByte)
+	})
+}
+
+// statusWriter captures the status code and time to first byte of a response
+type statusWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	status    int
+	firstByte time.Duration
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	// Informational responses precede the real one
+	if sw.status == 0 && status >= 200 {
+		sw.status = status
+		sw.firstByte = time.Since(sw.start)
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps the sendfile fast path when the underlying writer supports it
+func (sw *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := sw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{sw}, src)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// sloBucket counts one minute of requests to a route
+type sloBucket struct {
+	minute int64
+	total  float64
+	errors float64
+	slow   float64
+}
+
+// SLOTracker keeps per-minute request outcomes for each route over the
+// longest alerting window and exposes, at scrape time, the error budget burn
+// rate of every window: the observed bad ratio divided by the ratio the
+// objective allows. A burn rate of 1 spends the budget exactly over the SLO
+// period; multiwindow alerts fire on e.g. 14.4 over both 1h and 5m.
+type SLOTracker struct {
+	availabilityTarget float64
+	latencyTarget      float64
+	latencyThreshold   time.Duration
+	windows            []time.Duration
+	exclude            []string
+
+	mu      sync.Mutex
+	buckets map[string][]sloBucket
+}
+
+// NewSLOTracker creates a tracker for the slo.* objectives
+func NewSLOTracker(config *Config) *SLOTracker {
+	return &SLOTracker{
+		availabilityTarget: config.SLOAvailabilityTarget,
+		latencyTarget:      config.SLOLatencyTarget,
+		latencyThreshold:   config.SLOLatencyThreshold,
+		windows:            config.SLOWindows,
+		exclude:            config.SLOExcludeRoutes,
+		buckets:            make(map[string][]sloBucket),
+	}
+}
+
+// Record counts a request: server errors spend the availability budget and
+// responses slower than the threshold the latency budget
+func (st *SLOTracker) Record(route string, status int, firstByte time.Duration) {
+	if len(st.windows) == 0 || slices.Contains(st.exclude, route) {
+		return
+	}
+	minute := time.Now().Unix() / 60
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ring, ok := st.buckets[route]
+	if !ok {
+		ring = make([]sloBucket, st.ringSize())
+		st.buckets[route] = ring
+	}
+	bucket := &ring[minute%int64(len(ring))]
+	if bucket.minute != minute {
+		*bucket = sloBucket{minute: minute}
+	}
+	bucket.total++
+	if status >= 500 {
+		bucket.errors++
+	}
+	if firstByte > st.latencyThreshold {
+		bucket.slow++
+	}
+}
+
+// ringSize is the number of minutes kept, enough for the longest window
+func (st *SLOTracker) ringSize() int {
+	return int(slices.Max(st.windows) / time.Minute)
+}
+
+// collect publishes the burn rate gauges before a scrape
+func (st *SLOTracker) collect() {
+	if len(st.windows) == 0 {
+		return
+	}
+	metrics.Set("userguide_slo_objective", st.availabilityTarget, "slo", SLOAvailability)
+	metrics.Set("userguide_slo_objective", st.latencyTarget, "slo", SLOLatency)
+	metrics.Set("userguide_slo_latency_threshold_seconds", st.latencyThreshold.Seconds())
+
+	now := time.Now().Unix() / 60
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for route, ring := range st.buckets {
+		for _, window := range st.windows {
+			minutes := int64(window / time.Minute)
+			var total, errors, slow float64
+			for _, bucket := range ring {
+				if bucket.minute > now-minutes && bucket.minute <= now {
+					total += bucket.total
+					errors += bucket.errors
+					slow += bucket.slow
+				}
+			}
+			label := formatWindow(window)
+			metrics.Set("userguide_slo_burn_rate", burnRate(errors, total, st.availabilityTarget),
+				"slo", SLOAvailability, "route", route, "window", label)
+			metrics.Set("userguide_slo_burn_rate", burnRate(slow, total, st.latencyTarget),
+				"slo", SLOLatency, "route", route, "window", label)
+		}
+	}
+}
+
+// burnRate is the bad ratio relative to the budget 1-target allows
+func burnRate(bad, total, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (bad / total) / (1 - target)
+}
+
+// formatWindow renders a window the way alert rules name them, e.g. 5m or 6h
+func formatWindow(window time.Duration) string {
+	if window%time.Hour == 0 {
+		return strconv.Itoa(int(window/time.Hour)) + "h"
+	}
+	return strconv.Itoa(int(window/time.Minute)) + "m"
+}
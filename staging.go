@@ -0,0 +1,192 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrRejectedContent is returned when a staged guide fails a content check
+var ErrRejectedContent = errors.New("content rejected")
+
+// stagingLeftoverAge is how old a staged file must be before it is treated
+// as left behind by a crashed publish; younger files may belong to a
+// replica that is publishing right now
+const stagingLeftoverAge = time.Hour
+
+// StagedCheck inspects a fully written guide before it is published and
+// returns an error wrapping ErrRejectedContent to keep it out. A check may
+// also replace the file at path, by rename, with a cleaned copy.
+type StagedCheck func(ctx context.Context, name, path string) error
+
+// Staging holds incoming guides outside the served tree until they have
+// been verified, then renames them into place so a guide is never visible
+// half written. The staging directory must be on the same filesystem as
+// the guides for the rename to be atomic.
+type Staging struct {
+	dir      string
+	basePath string
+	checks   []StagedCheck
+
+	mu       sync.Mutex
+	prepared bool
+}
+
+// NewStaging creates the staging area configured by upload.staging.path,
+// by default the hidden .staging directory inside the guide directory
+func NewStaging(config *Config) *Staging {
+	dir := config.StagingPath
+	if dir == "" {
+		dir = filepath.Join(config.UserGuidePath, ".staging")
+	}
+	return &Staging{
+		dir:      dir,
+		basePath: config.UserGuidePath,
+		checks:   []StagedCheck{checkGuideSignature},
+	}
+}
+
+// AddCheck adds a content check run on every staged guide before it is published
+func (s *Staging) AddCheck(check StagedCheck) {
+	s.checks = append(s.checks, check)
+}
+
+// Prepare creates the staging directory, verifies that files can be renamed
+// from it into the guide directory and removes leftovers of crashed publishes
+func (s *Staging) Prepare() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prepared {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("unable to create staging directory: %v", err)
+	}
+
+	probe, err := os.CreateTemp(s.dir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("unable to write to staging directory: %v", err)
+	}
+	probe.Close()
+	target := filepath.Join(s.basePath, filepath.Base(probe.Name()))
+	if err := os.Rename(probe.Name(), target); err != nil {
+		os.Remove(probe.Name())
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("staging directory %s must be on the same filesystem as %s", s.dir, s.basePath)
+		}
+		return fmt.Errorf("unable to publish from staging directory: %v", err)
+	}
+	os.Remove(target)
+
+	s.sweep()
+	s.prepared = true
+	return nil
+}
+
+// sweep removes staged files abandoned by a publish that never finished
+func (s *Staging) sweep() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < stagingLeftoverAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, entry.Name())); err == nil {
+			log.Printf("Removed abandoned staged file %s", entry.Name())
+		}
+	}
+}
+
+// Create opens a new staged file; the caller removes it if it is not committed
+func (s *Staging) Create(kind string) (*os.File, error) {
+	if err := s.Prepare(); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(s.dir, kind+"-*.tmp")
+}
+
+// Verify runs the content checks on a staged guide
+func (s *Staging) Verify(ctx context.Context, name string, file *os.File) error {
+	for _, check := range s.checks {
+		if err := check(ctx, name, file.Name()); err != nil {
+			metrics.Inc("userguide_staging_rejected_total")
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit flushes a staged guide and atomically renames it to target,
+// encrypting it first when encryption at rest is on
+func (s *Staging) Commit(file *os.File, target string) error {
+	if atRest != nil {
+		encrypted, err := atRest.EncryptStaged(file)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt guide: %v", err)
+		}
+		defer os.Remove(encrypted.Name())
+		file = encrypted
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), target)
+}
+
+// CommitTo flushes a staged guide and stores it in store under key,
+// encrypting it first when encryption at rest is on
+func (s *Staging) CommitTo(ctx context.Context, file *os.File, store Storage, key string) error {
+	if atRest != nil {
+		encrypted, err := atRest.EncryptStaged(file)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt guide: %v", err)
+		}
+		defer os.Remove(encrypted.Name())
+		defer encrypted.Close()
+		file = encrypted
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return store.Put(ctx, key, file)
+}
+
+// checkGuideSignature rejects PDFs that do not start with a PDF header, such
+// as error pages or truncated transfers saved under a .pdf name
+func checkGuideSignature(_ context.Context, name, path string) error {
+	if !strings.EqualFold(filepath.Ext(name), ".pdf") {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if !bytes.HasPrefix(bytes.TrimLeft(head[:n], " \t\r\n"), []byte("%PDF-")) {
+		return fmt.Errorf("%w: %s is not a PDF", ErrRejectedContent, name)
+	}
+	return nil
+}
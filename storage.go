@@ -0,0 +1,262 @@
+package userguide
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"userguide_api_poc/storage"
+)
+
+// ErrObjectNotFound is returned for keys a storage does not hold, or may
+// not hand out
+var ErrObjectNotFound = storage.ErrNotFound
+
+// ObjectInfo is the metadata of a stored object
+type ObjectInfo = storage.ObjectInfo
+
+// Storage holds guides and their metadata files by key. The local
+// filesystem is built in; object stores implement the same interface.
+type Storage = storage.Storage
+
+// StorageFactory opens the guide storage from configuration
+type StorageFactory func(config *Config) (Storage, error)
+
+var (
+	storagesMu sync.RWMutex
+	storages   = map[string]StorageFactory{
+		StorageBackendLocal: func(config *Config) (Storage, error) {
+			return NewLocalStorage(config.UserGuidePath, config.FollowSymlinks), nil
+		},
+	}
+)
+
+// RegisterStorage makes a guide storage selectable with storage.type. Call
+// it from an init function in the file that implements it.
+func RegisterStorage(name string, factory StorageFactory) {
+	storagesMu.Lock()
+	defer storagesMu.Unlock()
+	storages[name] = factory
+}
+
+// NewGuideStorage opens the guide storage of storage.type
+func NewGuideStorage(config *Config) (Storage, error) {
+	storagesMu.RLock()
+	factory, ok := storages[config.StorageType]
+	storagesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q", config.StorageType)
+	}
+	return factory(config)
+}
+
+// closeStorage releases what a storage holds, such as temporary files, for
+// storages that implement io.Closer
+func closeStorage(store Storage) {
+	closer, ok := store.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		log.Printf("Unable to close guide storage: %s", err.Error())
+	}
+}
+
+// LocalStorage keeps objects as files below a root directory. A file
+// reached through a symlink is refused when the link leads outside the
+// root, and unless followSymlinks is set, inside it as well. Hidden files
+// and directories are only reachable by exact key and never listed.
+type LocalStorage struct {
+	root           string
+	followSymlinks bool
+}
+
+// NewLocalStorage creates a storage of the files below root
+func NewLocalStorage(root string, followSymlinks bool) *LocalStorage {
+	return &LocalStorage{root: root, followSymlinks: followSymlinks}
+}
+
+// path returns the file of key, refusing keys that leave the root
+func (ls *LocalStorage) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("%w: invalid key %q", ErrObjectNotFound, key)
+	}
+	return filepath.Join(ls.root, filepath.FromSlash(key)), nil
+}
+
+// LocalPath returns the absolute path of the regular file holding key
+func (ls *LocalStorage) LocalPath(_ context.Context, key string) (string, error) {
+	fullPath, err := ls.path(key)
+	if err != nil {
+		return "", err
+	}
+	if !ls.secure(fullPath) {
+		return "", fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	absPath, err := filepath.Abs(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve file path")
+	}
+	return absPath, nil
+}
+
+func (ls *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	filePath, err := ls.LocalPath(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
+func (ls *LocalStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	filePath, err := ls.LocalPath(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (ls *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Walk only the directory the prefix names, not the whole root
+	dir := path.Dir(prefix + "x")
+	start := ls.root
+	if dir != "." {
+		var err error
+		if start, err = ls.path(dir); err != nil {
+			return nil, err
+		}
+	}
+	var objects []ObjectInfo
+	err := filepath.WalkDir(start, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == start && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if filePath != start && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || !ls.secure(filePath) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return ctx.Err()
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+// Put writes body to a temporary file beside key and renames it into place,
+// so readers never see a partial object
+func (ls *LocalStorage) Put(_ context.Context, key string, body io.Reader) error {
+	target, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	os.Chmod(tmp.Name(), 0o644)
+	return os.Rename(tmp.Name(), target)
+}
+
+func (ls *LocalStorage) Delete(_ context.Context, key string) error {
+	target, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// secure reports whether fullPath is a regular file inside the root once
+// symlinks are resolved, and reached without any unless followSymlinks is set
+func (ls *LocalStorage) secure(fullPath string) bool {
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil || fileInfo.IsDir() {
+		return false
+	}
+
+	absBasePath, err := filepath.Abs(ls.root)
+	if err != nil {
+		return false
+	}
+	absFilePath, err := filepath.Abs(fullPath)
+	if err != nil {
+		return false
+	}
+	realBasePath, err := filepath.EvalSymlinks(absBasePath)
+	if err != nil {
+		return false
+	}
+	realFilePath, err := filepath.EvalSymlinks(absFilePath)
+	if err != nil {
+		return false
+	}
+	if !isWithin(realFilePath, realBasePath) {
+		return false
+	}
+
+	if !ls.followSymlinks {
+		// Without links the resolved file sits at the same place relative to
+		// the resolved base as the requested one does to the base
+		rel, err := filepath.Rel(absBasePath, absFilePath)
+		if err != nil || filepath.Join(realBasePath, rel) != realFilePath {
+			return false
+		}
+	}
+	return true
+}
+
+// storagePath returns the local file of key for the serving layer, which
+// reads guides by path
+func storagePath(ctx context.Context, store Storage, key string) (string, error) {
+	local, ok := store.(storage.LocalPaths)
+	if !ok {
+		return "", fmt.Errorf("storage %T cannot serve %s as a file", store, key)
+	}
+	return local.LocalPath(ctx, key)
+}
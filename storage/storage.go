@@ -0,0 +1,45 @@
+// Package storage defines the guide store of the user guide API, so that
+// backends and test doubles can be written outside the service itself.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned for keys a storage does not hold, or may not
+// hand out
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo is the metadata of a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// Version identifies the object's content where the storage tracks
+	// it, such as a GCS generation
+	Version string
+}
+
+// Storage holds guides and their metadata files by key: a slash-separated
+// name relative to the store's root, such as user-guide.pdf or
+// acme/.releases.json. The service reads guides by path, so a storage it
+// serves from must implement LocalPaths as well.
+type Storage interface {
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List returns the objects whose keys start with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Put stores body under key, replacing any object there as a whole
+	Put(ctx context.Context, key string, body io.Reader) error
+	// Delete removes key; deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalPaths is implemented by storages whose objects are local files, or
+// that copy them to local files, which the serving layer reads by path
+type LocalPaths interface {
+	LocalPath(ctx context.Context, key string) (string, error)
+}
@@ -0,0 +1,182 @@
+package userguide
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// StorageBackendLocal names the local filesystem guide store
+const StorageBackendLocal = "local"
+
+// StorageMonitor times every guide storage call per backend and tracks when
+// each backend last answered, for metrics and the deep health endpoint
+type StorageMonitor struct {
+	mu          sync.Mutex
+	probes      map[string]func(context.Context) error
+	lastSuccess map[string]time.Time
+}
+
+// NewStorageMonitor creates a monitor for guides and the local guide
+// directories. Storages other than the local one are probed through their
+// Probe method.
+func NewStorageMonitor(config *Config, guides Storage) *StorageMonitor {
+	return &StorageMonitor{
+		probes:      storageProbes(config, guides),
+		lastSuccess: make(map[string]time.Time),
+	}
+}
+
+// SetGuides probes guides, the storage of config, instead of the previous
+// guide storage; backends no longer in use leave the health report
+func (sm *StorageMonitor) SetGuides(config *Config, guides Storage) {
+	probes := storageProbes(config, guides)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for backend := range sm.probes {
+		if _, ok := probes[backend]; !ok {
+			health.Remove("storage." + backend)
+			metrics.Set("userguide_storage_up", 0, "backend", backend)
+		}
+	}
+	sm.probes = probes
+}
+
+// storageProbes returns the health probe of each backend in use
+func storageProbes(config *Config, guides Storage) map[string]func(context.Context) error {
+	probes := make(map[string]func(context.Context) error)
+	var roots []string
+	if prober, ok := guides.(interface{ Probe(context.Context) error }); ok {
+		probes[config.StorageType] = prober.Probe
+	} else {
+		roots = append(roots, config.UserGuidePath)
+	}
+	if config.ProtectedPath != "" {
+		roots = append(roots, config.ProtectedPath)
+	}
+	if len(roots) > 0 {
+		probes[StorageBackendLocal] = func(ctx context.Context) error { return probeRoots(ctx, roots) }
+	}
+	return probes
+}
+
+// Instrument wraps a file service so its calls are recorded against backend
+func (sm *StorageMonitor) Instrument(backend string, inner FileServiceInterface) FileServiceInterface {
+	return &instrumentedFileService{FileServiceInterface: inner, monitor: sm, backend: backend}
+}
+
+// observe records the latency and outcome of one storage call
+func (sm *StorageMonitor) observe(backend, operation string, start time.Time, err error) {
+	metrics.Observe("userguide_storage_operation_duration_seconds", time.Since(start).Seconds(),
+		"backend", backend, "operation", operation)
+	if err != nil {
+		metrics.Inc("userguide_storage_operation_errors_total", "backend", backend, "operation", operation)
+		return
+	}
+	sm.succeeded(backend)
+}
+
+// succeeded notes that backend just answered
+func (sm *StorageMonitor) succeeded(backend string) {
+	now := time.Now()
+	sm.mu.Lock()
+	sm.lastSuccess[backend] = now
+	sm.mu.Unlock()
+	metrics.Set("userguide_storage_last_success_timestamp_seconds", float64(now.Unix()), "backend", backend)
+}
+
+// Check probes every backend and reports each as a storage.<backend> health
+// component carrying the time it last answered
+func (sm *StorageMonitor) Check(ctx context.Context) error {
+	sm.mu.Lock()
+	probes := sm.probes
+	sm.mu.Unlock()
+	for backend, probe := range probes {
+		start := time.Now()
+		err := probe(ctx)
+		metrics.Observe("userguide_storage_operation_duration_seconds", time.Since(start).Seconds(),
+			"backend", backend, "operation", "probe")
+		if err != nil {
+			metrics.Inc("userguide_storage_operation_errors_total", "backend", backend, "operation", "probe")
+			metrics.Set("userguide_storage_up", 0, "backend", backend)
+		} else {
+			sm.succeeded(backend)
+			metrics.Set("userguide_storage_up", 1, "backend", backend)
+		}
+
+		sm.mu.Lock()
+		lastSuccess := sm.lastSuccess[backend]
+		sm.mu.Unlock()
+		health.SetBackend("storage."+backend, err, lastSuccess)
+	}
+	return nil
+}
+
+// probeRoots checks that every root is a readable directory, giving up when
+// ctx ends so a hung mount cannot stall the health endpoint
+func probeRoots(ctx context.Context, roots []string) error {
+	done := make(chan error, 1)
+	go func() {
+		for _, root := range roots {
+			dir, err := os.Open(root)
+			if err != nil {
+				done <- err
+				return
+			}
+			_, err = dir.Readdirnames(1)
+			dir.Close()
+			if err != nil && err != io.EOF {
+				done <- fmt.Errorf("%s: %v", root, err)
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("storage probe: %v", ctx.Err())
+	}
+}
+
+// instrumentedFileService records every call to the file service it wraps
+type instrumentedFileService struct {
+	FileServiceInterface
+	monitor *StorageMonitor
+	backend string
+}
+
+func (is *instrumentedFileService) DownloadUserGuide() (path string, err error) {
+	defer func(start time.Time) { is.monitor.observe(is.backend, "download_user_guide", start, err) }(time.Now())
+	return is.FileServiceInterface.DownloadUserGuide()
+}
+
+func (is *instrumentedFileService) DownloadUserGuideFor(clientKey string) (path, variant string, err error) {
+	defer func(start time.Time) { is.monitor.observe(is.backend, "download_user_guide", start, err) }(time.Now())
+	return is.FileServiceInterface.DownloadUserGuideFor(clientKey)
+}
+
+func (is *instrumentedFileService) DownloadProductGuide(product, filename string) (path string, err error) {
+	defer func(start time.Time) { is.monitor.observe(is.backend, "download_product_guide", start, err) }(time.Now())
+	return is.FileServiceInterface.DownloadProductGuide(product, filename)
+}
+
+func (is *instrumentedFileService) DownloadReleaseGuide(product, release string) (path string, err error) {
+	defer func(start time.Time) { is.monitor.observe(is.backend, "download_release_guide", start, err) }(time.Now())
+	return is.FileServiceInterface.DownloadReleaseGuide(product, release)
+}
+
+func (is *instrumentedFileService) DownloadProtectedGuide(filename string) (path string, err error) {
+	defer func(start time.Time) { is.monitor.observe(is.backend, "download_protected_guide", start, err) }(time.Now())
+	return is.FileServiceInterface.DownloadProtectedGuide(filename)
+}
+
+func (is *instrumentedFileService) DownloadGuide(filename string) (path string, err error) {
+	defer func(start time.Time) { is.monitor.observe(is.backend, "download_guide", start, err) }(time.Now())
+	return is.FileServiceInterface.DownloadGuide(filename)
+}
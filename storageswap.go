@@ -0,0 +1,258 @@
+package userguide
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reindexing is true while a storage swap indexes the new guide storage;
+// the instance reports itself not ready meanwhile
+var reindexing atomic.Bool
+
+// StorageSwap moves guide serving to a new storage when a configuration
+// reload changes storage.type, userguide.path or the s3.*, gcs.* or
+// azure.* settings, without a restart. The new storage is opened and indexed while
+// the old one keeps serving, with readiness withdrawn; then guide routes
+// switch over, and the swap waits for downloads still reading the old
+// storage before reporting it done, so the old location can be retired
+// once storage.swapped fires.
+type StorageSwap struct {
+	ctx     context.Context
+	drain   time.Duration
+	utils   *Utils
+	files   *FileService
+	uploads *UploadService
+	monitor *StorageMonitor
+	sums    *ChecksumStore
+
+	// swapping serializes swaps
+	swapping sync.Mutex
+
+	mu       sync.Mutex
+	current  *storageGeneration
+	settings string
+	target   string
+}
+
+// storageGeneration is a guide storage with the requests using it
+type storageGeneration struct {
+	store    Storage
+	inflight sync.WaitGroup
+}
+
+// NewStorageSwap creates the swap of guides, the storage config opened at
+// startup, for files; swaps stop when ctx ends
+func NewStorageSwap(ctx context.Context, config *Config, guides Storage, files *FileService) *StorageSwap {
+	settings := storageSettings(config)
+	return &StorageSwap{
+		ctx:      ctx,
+		drain:    config.StorageDrainTimeout,
+		utils:    &Utils{policy: &config.FilenamePolicy},
+		files:    files,
+		current:  &storageGeneration{store: guides},
+		settings: settings,
+		target:   settings,
+	}
+}
+
+// Retarget makes swaps also move uploads to the new storage, point the
+// storage health probe at it and record its guides in sums
+func (ss *StorageSwap) Retarget(uploads *UploadService, monitor *StorageMonitor, sums *ChecksumStore) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.uploads, ss.monitor, ss.sums = uploads, monitor, sums
+}
+
+// storageSettings identifies the guide storage a configuration selects
+func storageSettings(config *Config) string {
+	return fmt.Sprint(config.StorageType, config.UserGuidePath, config.FollowSymlinks,
+		config.S3Bucket, config.S3Region, config.S3Prefix, config.S3Endpoint, config.S3PathStyle,
+		config.S3AccessKeyID, config.S3AccessKeySecret, config.S3SessionToken, config.S3CachePath,
+		config.GCSBucket, config.GCSPrefix, config.GCSEndpoint, config.GCSCredentialsFile, config.GCSCachePath,
+		config.AzureAccount, config.AzureContainer, config.AzurePrefix, config.AzureEndpoint, config.AzureSASToken,
+		config.AzureClientID, config.AzureCachePath,
+		config.SFTPAddress, config.SFTPUser, config.SFTPPassword, config.SFTPPrivateKeyFile, config.SFTPPrivateKeyPassword,
+		config.SFTPKnownHosts, config.SFTPHostKeyFingerprints, config.SFTPPath, config.SFTPCachePath,
+		config.DBURL, config.DBPassword, config.DBTLS, config.DBCAFile, config.DBTable, config.DBCreateTables,
+		config.DBChunkSize, config.DBCachePath, config.MemorySeed, config.MemoryCachePath)
+}
+
+// Reload starts a swap when config selects another guide storage than the
+// one serving or being swapped in
+func (ss *StorageSwap) Reload(config *Config) {
+	settings := storageSettings(config)
+	ss.mu.Lock()
+	changed := settings != ss.target
+	ss.target = settings
+	ss.mu.Unlock()
+	if changed {
+		go ss.swap(config, settings)
+	}
+}
+
+// Middleware counts requests against the storage serving when they arrive,
+// so a swap can wait for them
+func (ss *StorageSwap) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss.mu.Lock()
+		generation := ss.current
+		generation.inflight.Add(1)
+		ss.mu.Unlock()
+		defer generation.inflight.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ss *StorageSwap) swap(config *Config, settings string) {
+	ss.swapping.Lock()
+	defer ss.swapping.Unlock()
+	ss.mu.Lock()
+	superseded := settings != ss.target || settings == ss.settings
+	ss.mu.Unlock()
+	if superseded {
+		// A later reload changed the storage again, or back
+		return
+	}
+
+	start := time.Now()
+	store, err := NewGuideStorage(config)
+	if err != nil {
+		ss.failed(config, settings, err)
+		return
+	}
+	described := describeStorage(config, store)
+	log.Printf("Storage swap: indexing %s %s", config.StorageType, described)
+	reindexing.Store(true)
+	health.Set("storage.swap", StatusDegraded, "indexing "+described)
+	indexed, err := ss.index(store)
+	reindexing.Store(false)
+	if err != nil {
+		closeStorage(store)
+		ss.failed(config, settings, err)
+		return
+	}
+
+	ss.files.SetGuides(chaosGuides(config, store))
+	ss.mu.Lock()
+	old := ss.current
+	ss.current = &storageGeneration{store: store}
+	ss.settings = settings
+	uploads, monitor := ss.uploads, ss.monitor
+	ss.mu.Unlock()
+	if uploads != nil {
+		uploads.PublishTo(store)
+	}
+	if monitor != nil {
+		monitor.SetGuides(config, store)
+	}
+	log.Printf("Storage swap: serving %d guides from %s %s; draining the previous storage", indexed, config.StorageType, described)
+
+	drained := make(chan struct{})
+	go func() {
+		old.inflight.Wait()
+		close(drained)
+	}()
+	result := "swapped"
+	select {
+	case <-drained:
+	case <-time.After(ss.drain):
+		result = "drain_timeout"
+		log.Printf("Storage swap: downloads from the previous storage still running after %s", ss.drain)
+	case <-ss.ctx.Done():
+		return
+	}
+	closeStorage(old.store)
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	health.Set("storage.swap", StatusHealthy, "serving from "+described)
+	metrics.Inc("userguide_storage_swaps_total", "result", result)
+	metrics.Set("userguide_storage_swap_duration_seconds", elapsed.Seconds())
+	events.Publish(Event{Type: EventStorageSwapped, Subject: described, Data: map[string]string{
+		"type":   config.StorageType,
+		"guides": fmt.Sprint(indexed),
+		"result": result,
+	}})
+	log.Printf("Storage swap to %s finished in %s", described, elapsed)
+}
+
+// failed keeps the current storage serving after a swap could not complete
+func (ss *StorageSwap) failed(config *Config, settings string, err error) {
+	log.Printf("Storage swap to %s failed, still serving the previous storage: %s", config.StorageType, err.Error())
+	health.Set("storage.swap", StatusDegraded, "swap failed: "+err.Error())
+	metrics.Inc("userguide_storage_swaps_total", "result", "failed")
+	ss.mu.Lock()
+	if ss.target == settings {
+		// The next reload selecting the same storage tries again
+		ss.target = ss.settings
+	}
+	ss.mu.Unlock()
+}
+
+// index hashes every servable guide in store, fetching remote guides into
+// their cache, and records them as the published guides. Guides recorded
+// before but missing from store are dropped from the record.
+func (ss *StorageSwap) index(store Storage) (int, error) {
+	objects, err := store.List(ss.ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("unable to list guides: %v", err)
+	}
+	found := make(map[string]string)
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if ss.utils.IsExcluded(name) || !ss.utils.IsAllowedExtension(name) {
+			continue
+		}
+		filePath, err := storagePath(ss.ctx, store, object.Key)
+		if err != nil {
+			return 0, fmt.Errorf("unable to read %s: %v", object.Key, err)
+		}
+		sum, err := hashFile(filePath)
+		if err != nil {
+			return 0, fmt.Errorf("unable to hash %s: %v", object.Key, err)
+		}
+		found[object.Key] = sum
+	}
+
+	ss.mu.Lock()
+	sums := ss.sums
+	ss.mu.Unlock()
+	if sums == nil {
+		return len(found), nil
+	}
+	for name, sum := range found {
+		if recorded, ok := sums.Get(name); !ok || recorded != sum {
+			if err := sums.Set(ss.ctx, name, sum); err != nil {
+				return 0, fmt.Errorf("unable to record %s: %v", name, err)
+			}
+		}
+	}
+	for name := range sums.All() {
+		if _, ok := found[name]; !ok {
+			if err := sums.Delete(ss.ctx, name); err != nil {
+				return 0, fmt.Errorf("unable to forget %s: %v", name, err)
+			}
+		}
+	}
+	return len(found), nil
+}
+
+// Current returns the storage guides are served from
+func (ss *StorageSwap) Current() Storage {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.current.store
+}
+
+// describeStorage names the location of store for logs and the boot report
+func describeStorage(config *Config, store Storage) string {
+	if described, ok := store.(fmt.Stringer); ok {
+		return described.String()
+	}
+	return config.UserGuidePath
+}
@@ -0,0 +1,154 @@
+// Package testutil provides test doubles for code built on the user guide
+// API: a configurable fake of the service's FileServiceInterface, a fake
+// storage.Storage and a throwaway guide store, so handlers, storage
+// consumers and clients can be tested without real guides or a deployment.
+//
+// The fake file service has the same method set as the service's
+// FileServiceInterface, so the service's own handler tests use it too. To
+// run the full router over a FakeStorage, use the userguidetest package.
+package testutil
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Guide variants, matching the X-Guide-Variant header of the real service
+const (
+	VariantStable = "stable"
+	VariantCanary = "canary"
+)
+
+// ErrNotFound is returned for guides the fake does not know
+var ErrNotFound = errors.New("file access denied or file not found")
+
+// FakeFileService is an in-memory FileServiceInterface. Guides maps guide
+// names to local paths: "user-guide.pdf" for plain guides, "acme/setup.pdf"
+// for product guides and "protected/manual.pdf" for restricted ones.
+type FakeFileService struct {
+	mu sync.Mutex
+
+	// Guides maps guide names to the paths returned for them
+	Guides map[string]string
+	// UserGuide is the name served by DownloadUserGuide
+	UserGuide string
+	// CanaryGuide, when set, is served to clients listed in CanaryClients
+	CanaryGuide   string
+	CanaryClients map[string]bool
+	// Releases maps "product/release" to a guide name below that product
+	Releases map[string]string
+	// Err, when set, is returned by every call
+	Err error
+
+	calls []string
+}
+
+// NewFakeFileService returns a fake serving userGuide, with no other guides
+func NewFakeFileService(userGuide, path string) *FakeFileService {
+	return &FakeFileService{
+		Guides:        map[string]string{userGuide: path},
+		UserGuide:     userGuide,
+		CanaryClients: make(map[string]bool),
+		Releases:      make(map[string]string),
+	}
+}
+
+// AddGuide makes a guide name resolve to path
+func (f *FakeFileService) AddGuide(name, path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Guides[name] = path
+}
+
+// Calls returns the methods invoked so far, e.g. "DownloadProductGuide(acme, setup.pdf)"
+func (f *FakeFileService) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// DownloadUserGuide returns the path of the configured user guide
+func (f *FakeFileService) DownloadUserGuide() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("DownloadUserGuide()")
+	return f.lookup(f.UserGuide)
+}
+
+// DownloadUserGuideFor returns the canary guide for canary clients and the
+// user guide for everyone else
+func (f *FakeFileService) DownloadUserGuideFor(clientKey string) (string, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(fmt.Sprintf("DownloadUserGuideFor(%s)", clientKey))
+	if f.CanaryGuide != "" && f.CanaryClients[clientKey] {
+		path, err := f.lookup(f.CanaryGuide)
+		return path, VariantCanary, err
+	}
+	path, err := f.lookup(f.UserGuide)
+	return path, VariantStable, err
+}
+
+// CanaryActive reports whether a canary guide is set
+func (f *FakeFileService) CanaryActive() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.CanaryGuide != ""
+}
+
+// DownloadProductGuide returns the path of product/filename
+func (f *FakeFileService) DownloadProductGuide(product, filename string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(fmt.Sprintf("DownloadProductGuide(%s, %s)", product, filename))
+	return f.lookup(product + "/" + filename)
+}
+
+// DownloadReleaseGuide returns the path of the guide mapped to a release
+func (f *FakeFileService) DownloadReleaseGuide(product, release string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(fmt.Sprintf("DownloadReleaseGuide(%s, %s)", product, release))
+	filename, ok := f.Releases[product+"/"+release]
+	if !ok {
+		return "", fmt.Errorf("no guide for %s release %s", product, release)
+	}
+	return f.lookup(product + "/" + filename)
+}
+
+// DownloadProtectedGuide returns the path of protected/filename
+func (f *FakeFileService) DownloadProtectedGuide(filename string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(fmt.Sprintf("DownloadProtectedGuide(%s)", filename))
+	if filename == "" {
+		filename = f.UserGuide
+	}
+	return f.lookup("protected/" + filename)
+}
+
+// DownloadGuide returns the path of the guide called filename
+func (f *FakeFileService) DownloadGuide(filename string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record(fmt.Sprintf("DownloadGuide(%s)", filename))
+	return f.lookup(filename)
+}
+
+// record notes a call; callers must hold the lock
+func (f *FakeFileService) record(call string) {
+	f.calls = append(f.calls, call)
+}
+
+// lookup resolves a guide name; callers must hold the lock
+func (f *FakeFileService) lookup(name string) (string, error) {
+	if f.Err != nil {
+		return "", f.Err
+	}
+	path, ok := f.Guides[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return path, nil
+}
@@ -0,0 +1,44 @@
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"userguide_api_poc/samples"
+)
+
+// GuideStore is a throwaway guide directory laid out like userguide.path
+type GuideStore struct {
+	Dir string
+}
+
+// NewGuideStore creates an empty store removed when the test finishes
+func NewGuideStore(tb testing.TB) *GuideStore {
+	tb.Helper()
+	return &GuideStore{Dir: tb.TempDir()}
+}
+
+// Add writes a guide below the store, creating product directories as
+// needed, and returns its path
+func (gs *GuideStore) Add(tb testing.TB, name string, content []byte) string {
+	tb.Helper()
+	path := filepath.Join(gs.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		tb.Fatalf("create guide directory: %v", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		tb.Fatalf("write guide %s: %v", name, err)
+	}
+	return path
+}
+
+// SamplePDF returns a small valid one-page PDF showing title
+func SamplePDF(title string) []byte {
+	return samples.PDF(title)
+}
+
+// SampleMarkdown returns a short markdown guide titled title
+func SampleMarkdown(title string) []byte {
+	return samples.Markdown(title)
+}
@@ -0,0 +1,215 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"userguide_api_poc/storage"
+)
+
+// FakeStorage is an in-memory storage.Storage that records the operations
+// made on it and fails them on demand. Served guides are copied to a test
+// directory, as the service reads guides by path.
+type FakeStorage struct {
+	dir string
+
+	mu         sync.Mutex
+	objects    map[string]fakeObject
+	generation int
+	calls      []string
+	failures   map[string]error
+}
+
+// fakeObject is one stored guide; data is never modified once stored
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+	version string
+}
+
+// NewFakeStorage creates an empty fake removed when the test finishes
+func NewFakeStorage(tb testing.TB) *FakeStorage {
+	tb.Helper()
+	return &FakeStorage{
+		dir:      tb.TempDir(),
+		objects:  make(map[string]fakeObject),
+		failures: make(map[string]error),
+	}
+}
+
+// Add stores content under key without recording a call
+func (s *FakeStorage) Add(key string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(key, content)
+}
+
+// Content returns what is stored under key, without recording a call
+func (s *FakeStorage) Content(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+	return object.data, ok
+}
+
+// Fail makes later calls of method, such as "Stat", fail with err; a nil
+// err lets them succeed again
+func (s *FakeStorage) Fail(method string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = err
+}
+
+// Calls returns the operations made so far, e.g. "Stat(user-guide.pdf)"
+func (s *FakeStorage) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *FakeStorage) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.lookup("Open", key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (s *FakeStorage) Stat(_ context.Context, key string) (storage.ObjectInfo, error) {
+	object, err := s.lookup("Stat", key)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return object.info(key), nil
+}
+
+// LocalPath writes the stored guide to the test directory, once for each
+// version, and returns the copy's path
+func (s *FakeStorage) LocalPath(_ context.Context, key string) (string, error) {
+	object, err := s.lookup("LocalPath", key)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, object.version, filepath.FromSlash(key))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	// Readers never see a partly written copy
+	temp := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	if err := os.WriteFile(temp, object.data, 0o600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(temp, path)
+}
+
+// List returns the guides whose keys start with prefix; like hidden files,
+// keys with a part starting with a dot are not listed
+func (s *FakeStorage) List(_ context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record("List", prefix); err != nil {
+		return nil, err
+	}
+	var objects []storage.ObjectInfo
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) && !hidden(key) {
+			objects = append(objects, object.info(key))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Put reads body whole, then replaces key's guide with it
+func (s *FakeStorage) Put(_ context.Context, key string, body io.Reader) error {
+	if err := s.call("Put", key); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(key, data)
+	return nil
+}
+
+func (s *FakeStorage) Delete(_ context.Context, key string) error {
+	if err := s.call("Delete", key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// call records an operation and returns its injected failure or, for keys
+// no storage could hold, ErrNotFound
+func (s *FakeStorage) call(method, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.record(method, key)
+}
+
+// lookup records an operation on key and returns the guide stored there
+func (s *FakeStorage) lookup(method, key string) (fakeObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.record(method, key); err != nil {
+		return fakeObject{}, err
+	}
+	object, ok := s.objects[key]
+	if !ok {
+		return fakeObject{}, fmt.Errorf("%w: %s", storage.ErrNotFound, key)
+	}
+	return object, nil
+}
+
+// record notes an operation and returns its failure; callers must hold
+// the lock
+func (s *FakeStorage) record(method, key string) error {
+	s.calls = append(s.calls, fmt.Sprintf("%s(%s)", method, key))
+	if err := s.failures[method]; err != nil {
+		return err
+	}
+	if method != "List" && (!fs.ValidPath(key) || key == ".") {
+		return fmt.Errorf("%w: invalid key %q", storage.ErrNotFound, key)
+	}
+	return nil
+}
+
+// store replaces key's guide; callers must hold the lock
+func (s *FakeStorage) store(key string, data []byte) {
+	s.generation++
+	s.objects[key] = fakeObject{data: data, modTime: time.Now(), version: strconv.Itoa(s.generation)}
+}
+
+func (o fakeObject) info(key string) storage.ObjectInfo {
+	return storage.ObjectInfo{Key: key, Size: int64(len(o.data)), ModTime: o.modTime, Version: o.version}
+}
+
+// hidden reports whether any part of key starts with a dot
+func hidden(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package userguide
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// AccessWindow limits when guides matching a pattern may be downloaded.
+// A zero From or Until leaves that side open.
+type AccessWindow struct {
+	From  time.Time
+	Until time.Time
+}
+
+// WindowError reports a guide requested outside its access window
+type WindowError struct {
+	Guide  string
+	Window AccessWindow
+	Now    time.Time
+}
+
+func (e *WindowError) Error() string {
+	if e.Now.Before(e.Window.From) {
+		return fmt.Sprintf("%s is embargoed until %s", e.Guide, e.Window.From.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s was available until %s", e.Guide, e.Window.Until.Format(time.RFC3339))
+}
+
+// Embargoed reports whether the guide will become available later
+func (e *WindowError) Embargoed() bool {
+	return e.Now.Before(e.Window.From)
+}
+
+// checkAccessWindows returns a *WindowError if any window matching the guide
+// excludes the current time
+func checkAccessWindows(windows map[string]AccessWindow, guide string, now time.Time) error {
+	for pattern, window := range windows {
+		if matched, _ := path.Match(pattern, guide); !matched {
+			continue
+		}
+		if (!window.From.IsZero() && now.Before(window.From)) || (!window.Until.IsZero() && !now.Before(window.Until)) {
+			return &WindowError{Guide: guide, Window: window, Now: now}
+		}
+	}
+	return nil
+}
+
+// writeWindowError answers a request for a guide outside its window with 403
+// and the dates it is available
+func writeWindowError(w http.ResponseWriter, err *WindowError) {
+	body := map[string]string{"error": "embargoed", "message": err.Error()}
+	if !err.Window.From.IsZero() {
+		body["available_from"] = err.Window.From.Format(time.RFC3339)
+	}
+	if !err.Window.Until.IsZero() {
+		body["available_until"] = err.Window.Until.Format(time.RFC3339)
+	}
+	if err.Embargoed() {
+		w.Header().Set("Retry-After", err.Window.From.UTC().Format(http.TimeFormat))
+	} else {
+		body["error"] = "expired"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusForbidden, body)
+}
+
+// parseWindowProperty applies embargo.<pattern>=<time> or
+// window.<pattern>=<from>/<until>; either side of a window may be empty
+func parseWindowProperty(config *Config, kind, pattern, value string) error {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return fmt.Errorf("invalid guide pattern %q", pattern)
+	}
+
+	var window AccessWindow
+	var err error
+	switch kind {
+	case "embargo":
+		window.From, err = time.Parse(time.RFC3339, value)
+	case "window":
+		from, until, ok := strings.Cut(value, "/")
+		if !ok {
+			return fmt.Errorf("expected <from>/<until>")
+		}
+		if from != "" {
+			if window.From, err = time.Parse(time.RFC3339, from); err != nil {
+				return err
+			}
+		}
+		if until != "" {
+			window.Until, err = time.Parse(time.RFC3339, until)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// An embargo and a window on the same pattern combine
+	existing := config.AccessWindows[pattern]
+	if window.From.IsZero() {
+		window.From = existing.From
+	}
+	if window.Until.IsZero() {
+		window.Until = existing.Until
+	}
+	config.AccessWindows[pattern] = window
+	return nil
+}
@@ -0,0 +1,458 @@
+package userguide
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ChecksumSHA256Header lets uploaders declare the SHA-256 of the body
+const ChecksumSHA256Header = "X-Checksum-SHA256"
+
+// Headers scheduling when an uploaded guide is launched and withdrawn
+const (
+	PublishAtHeader = "X-Publish-At"
+	ExpireAtHeader  = "X-Expire-At"
+)
+
+// ErrChecksumMismatch is returned when an upload does not match its declared checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Checksums holds the digests declared by, or computed for, an upload
+type Checksums struct {
+	MD5    []byte
+	SHA256 []byte
+}
+
+// UploadResult describes a published guide
+type UploadResult struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+	// Set when the guide is embargoed or scheduled to expire
+	PublishAt time.Time `json:"publishAt,omitzero"`
+	ExpireAt  time.Time `json:"expireAt,omitzero"`
+	// Set when the content was already published and nothing was stored
+	DuplicateOf *PublishedGuide `json:"duplicateOf,omitempty"`
+}
+
+// PublishedGuide points at a guide already serving some content
+type PublishedGuide struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+// UploadService verifies and publishes uploaded guides
+type UploadService struct {
+	basePath  string
+	checksums *ChecksumStore
+	disk      *DiskMonitor
+	quotas    *QuotaManager
+	locker    Locker
+	staging   *Staging
+	schedule  *GuideSchedule
+	dedupe    bool
+	utils     *Utils
+	// store receives published guides instead of basePath when set
+	mu    sync.RWMutex
+	store Storage
+}
+
+// NewUploadService creates an upload service publishing into the guide
+// directory through staging
+func NewUploadService(config *Config, checksums *ChecksumStore, disk *DiskMonitor, quotas *QuotaManager, locker Locker, staging *Staging, schedule *GuideSchedule) *UploadService {
+	return &UploadService{
+		basePath:  config.UserGuidePath,
+		checksums: checksums,
+		disk:      disk,
+		quotas:    quotas,
+		locker:    locker,
+		staging:   staging,
+		schedule:  schedule,
+		dedupe:    config.UploadDedupe,
+		utils:     &Utils{policy: &config.FilenamePolicy},
+	}
+}
+
+// PublishTo publishes guides into store, unless it is the local guide
+// directory the service was created with. Scheduled launches and expiries
+// move files within that directory, so with any other storage uploads
+// carrying a schedule are refused.
+func (us *UploadService) PublishTo(store Storage) {
+	if local, ok := store.(*LocalStorage); ok && filepath.Clean(local.root) == filepath.Clean(us.basePath) {
+		store = nil
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.store = store
+}
+
+// Publish writes body to a staged file, verifies it against the declared
+// checksums and the staging content checks and only then renames it into
+// place under name. product is empty
+// outside multi-product mode; size is the declared body length, or -1 if unknown.
+// A guide whose schedule.PublishAt is in the future is held back until then.
+// Content already published in the same product is not stored again; the
+// result then points at the existing guide.
+func (us *UploadService) Publish(ctx context.Context, product, name string, body io.Reader, size int64, declared Checksums, schedule ScheduleEntry) (*UploadResult, error) {
+	cleanName, err := us.utils.ValidateFilename(name)
+	if err != nil {
+		return nil, err
+	}
+	if !us.utils.IsAllowedExtension(cleanName) {
+		return nil, fmt.Errorf("file type not allowed: %s", strings.ToLower(filepath.Ext(cleanName)))
+	}
+	us.mu.RLock()
+	store := us.store
+	us.mu.RUnlock()
+	if store != nil && (!schedule.PublishAt.IsZero() || !schedule.ExpireAt.IsZero()) {
+		return nil, fmt.Errorf("scheduled guides need storage.type=%s and the startup userguide.path", StorageBackendLocal)
+	}
+	if err := us.disk.EnsureRoom(size); err != nil {
+		return nil, err
+	}
+
+	dir := us.basePath
+	if product != "" {
+		if err := us.utils.ValidateProductName(product); err != nil {
+			return nil, err
+		}
+		if err := us.quotas.Check(ctx, product, cleanName, max(size, 0)); err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(us.basePath, product)
+	}
+
+	tmp, err := us.staging.Create("upload")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create upload file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, md5Hash, sha256Hash), body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read upload: %v", err)
+	}
+
+	computed := Checksums{MD5: md5Hash.Sum(nil), SHA256: sha256Hash.Sum(nil)}
+	if declared.MD5 != nil && subtle.ConstantTimeCompare(declared.MD5, computed.MD5) != 1 {
+		return nil, fmt.Errorf("%w: Content-MD5", ErrChecksumMismatch)
+	}
+	if declared.SHA256 != nil && subtle.ConstantTimeCompare(declared.SHA256, computed.SHA256) != 1 {
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, ChecksumSHA256Header)
+	}
+	guideName := path.Join(product, cleanName)
+	staged, err := os.Stat(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	if err := us.staging.Verify(ctx, guideName, tmp); err != nil {
+		return nil, err
+	}
+	// A content check may have replaced the file with a cleaned copy
+	if checked, err := os.Stat(tmp.Name()); err != nil {
+		return nil, err
+	} else if !os.SameFile(staged, checked) {
+		if computed, size, err = digestFile(tmp.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Replicas publishing the same guide at once must not interleave the
+	// quota check, rename and checksum update
+	unlock, err := us.locker.Lock(ctx, "guide:"+guideName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// The declared size may have been missing or wrong; check what was received
+	if product != "" {
+		if err := us.quotas.Check(ctx, product, cleanName, size); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &UploadResult{
+		Name:      guideName,
+		Size:      size,
+		MD5:       hex.EncodeToString(computed.MD5),
+		SHA256:    hex.EncodeToString(computed.SHA256),
+		PublishAt: schedule.PublishAt,
+		ExpireAt:  schedule.ExpireAt,
+	}
+	if us.dedupe && schedule.PublishAt.IsZero() && schedule.ExpireAt.IsZero() {
+		if existing := us.published(store, product, guideName, result.SHA256); existing != "" {
+			result.DuplicateOf = &PublishedGuide{Name: existing, SHA256: result.SHA256, URL: "/blobs/" + result.SHA256}
+			return result, nil
+		}
+	}
+	if schedule.PublishAt.After(time.Now()) {
+		// Embargoed: kept out of the served tree until the schedule publishes it
+		if err := us.staging.Commit(tmp, us.schedule.EmbargoPath(guideName)); err != nil {
+			return nil, fmt.Errorf("unable to stage embargoed upload: %v", err)
+		}
+		if err := us.schedule.Set(ctx, guideName, schedule); err != nil {
+			return nil, fmt.Errorf("unable to schedule upload: %v", err)
+		}
+		log.Printf("Embargoed %s until %s", guideName, schedule.PublishAt.Format(time.RFC3339))
+		return result, nil
+	}
+
+	if store != nil {
+		err = us.staging.CommitTo(ctx, tmp, store, guideName)
+	} else {
+		err = us.staging.Commit(tmp, filepath.Join(dir, cleanName))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to publish upload: %v", err)
+	}
+	// A direct publish supersedes any embargoed copy waiting for launch
+	os.Remove(us.schedule.EmbargoPath(guideName))
+	result.PublishAt = time.Time{}
+	if err := us.schedule.Set(ctx, guideName, ScheduleEntry{ExpireAt: schedule.ExpireAt}); err != nil {
+		log.Printf("Warning: unable to record schedule for %s: %s", guideName, err.Error())
+	}
+	if err := us.checksums.Set(ctx, result.Name, result.SHA256); err != nil {
+		log.Printf("Warning: unable to record checksum for %s: %s", result.Name, err.Error())
+	}
+	events.Publish(Event{Type: EventGuidePublished, Subject: result.Name, Data: actorData(ctx, map[string]string{"sha256": result.SHA256})})
+
+	return result, nil
+}
+
+// digestFile computes the digests and size of a file
+func digestFile(filePath string) (Checksums, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return Checksums{}, 0, err
+	}
+	defer file.Close()
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), file)
+	if err != nil {
+		return Checksums{}, 0, err
+	}
+	return Checksums{MD5: md5Hash.Sum(nil), SHA256: sha256Hash.Sum(nil)}, size, nil
+}
+
+// published returns the guide of product whose content has sum, preferring
+// guideName itself, or "" when there is none. Recorded checksums are
+// confirmed against the file in store, or basePath when store is nil, which
+// may have been replaced since.
+func (us *UploadService) published(store Storage, product, guideName, sum string) string {
+	if err := us.checksums.Reload(); err != nil {
+		log.Printf("Warning: unable to reload checksums: %s", err.Error())
+	}
+	dir := path.Dir(guideName)
+	var candidates []string
+	for name, recorded := range us.checksums.All() {
+		if recorded == sum && path.Dir(name) == dir {
+			candidates = append(candidates, name)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		if (a == guideName) != (b == guideName) {
+			if a == guideName {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	for _, name := range candidates {
+		filePath := filepath.Join(us.basePath, filepath.FromSlash(name))
+		if store != nil {
+			var err error
+			if filePath, err = storagePath(context.Background(), store, name); err != nil {
+				continue
+			}
+		}
+		if current, err := hashFile(filePath); err == nil && current == sum {
+			return name
+		}
+	}
+	return ""
+}
+
+// parseDeclaredChecksums reads Content-MD5 (base64, RFC 1864) and
+// X-Checksum-SHA256 (hex or base64) from the request headers
+func parseDeclaredChecksums(h http.Header) (Checksums, error) {
+	var declared Checksums
+
+	if v := h.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return declared, fmt.Errorf("invalid Content-MD5 header")
+		}
+		declared.MD5 = sum
+	}
+
+	if v := h.Get(ChecksumSHA256Header); v != "" {
+		sum, err := hex.DecodeString(v)
+		if err != nil {
+			sum, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil || len(sum) != sha256.Size {
+			return declared, fmt.Errorf("invalid %s header", ChecksumSHA256Header)
+		}
+		declared.SHA256 = sum
+	}
+
+	return declared, nil
+}
+
+// UploadHandler handles guide upload requests
+type UploadHandler struct {
+	uploadService *UploadService
+	authorizer    Authorizer
+	products      bool
+	token         string
+	utils         *Utils
+}
+
+// NewUploadHandler creates a new upload handler guarded by a bearer token.
+// Authorizers that implement AdminAuthorizer get the final say.
+func NewUploadHandler(uploadService *UploadService, authorizer Authorizer, products bool, token string) *UploadHandler {
+	return &UploadHandler{
+		uploadService: uploadService,
+		authorizer:    authorizer,
+		products:      products,
+		token:         token,
+		utils:         &Utils{},
+	}
+}
+
+// RegisterRoutes registers the upload routes with the router
+func (uh *UploadHandler) RegisterRoutes(r *mux.Router) {
+	if uh.products {
+		r.HandleFunc("/upload/{product}/{name}", uh.UploadGuideHandler).Methods("PUT")
+	} else {
+		r.HandleFunc("/upload/{name}", uh.UploadGuideHandler).Methods("PUT")
+	}
+}
+
+// authorized checks the upload bearer token
+func (uh *UploadHandler) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(uh.token)) == 1
+}
+
+// permitted asks the authorizer about an admin action and writes the error
+// response when it is refused
+func (uh *UploadHandler) permitted(w http.ResponseWriter, r *http.Request, action, resource string) bool {
+	identity := identityFromRequest(r, uh.utils)
+	err := authorizeAdmin(r.Context(), uh.authorizer, identity, action, resource)
+	if err == nil {
+		return true
+	}
+	log.Printf("Denied %s on %s to %s: %s", action, resource, identity.Subject, err.Error())
+	if errors.Is(err, ErrUnauthenticated) || errors.Is(err, ErrForbidden) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	} else {
+		http.Error(w, "Authorization unavailable", http.StatusServiceUnavailable)
+	}
+	return false
+}
+
+// UploadGuideHandler verifies and publishes an uploaded guide
+func (uh *UploadHandler) UploadGuideHandler(w http.ResponseWriter, r *http.Request) {
+	if !uh.authorized(r) {
+		log.Printf("Unauthorized upload attempt from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	r = withBearerToken(r)
+	vars := mux.Vars(r)
+	if !uh.permitted(w, r, "publish", path.Join(vars["product"], vars["name"])) {
+		return
+	}
+
+	declared, err := parseDeclaredChecksums(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	schedule, err := parseScheduleHeaders(r.Header.Get(PublishAtHeader), r.Header.Get(ExpireAtHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := uh.uploadService.Publish(r.Context(), vars["product"], vars["name"], r.Body, r.ContentLength, declared, schedule)
+	if err != nil {
+		log.Printf("Upload failed from %s: %s", r.RemoteAddr, err.Error())
+		if errors.Is(err, ErrChecksumMismatch) {
+			metrics.Inc("userguide_uploads_total", "result", "checksum_mismatch")
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, ErrRejectedContent) {
+			metrics.Inc("userguide_uploads_total", "result", "rejected")
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, ErrScanUnavailable) {
+			metrics.Inc("userguide_uploads_total", "result", "scan_unavailable")
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Virus scan unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			metrics.Inc("userguide_uploads_total", "result", "quota_exceeded")
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, ErrInsufficientStorage) {
+			metrics.Inc("userguide_uploads_total", "result", "insufficient_storage")
+			http.Error(w, "Insufficient storage", http.StatusInsufficientStorage)
+			return
+		}
+		if errors.Is(err, ErrLockTimeout) {
+			metrics.Inc("userguide_uploads_total", "result", "conflict")
+			http.Error(w, "Another publish of this guide is in progress", http.StatusConflict)
+			return
+		}
+		metrics.Inc("userguide_uploads_total", "result", "error")
+		http.Error(w, "Upload failed", http.StatusBadRequest)
+		return
+	}
+
+	if result.DuplicateOf != nil {
+		log.Printf("Upload of %s from %s matches published %s; nothing stored", path.Join(vars["product"], vars["name"]), r.RemoteAddr, result.DuplicateOf.Name)
+		metrics.Inc("userguide_uploads_total", "result", "duplicate")
+		w.Header().Set("Content-Location", result.DuplicateOf.URL)
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	if !result.PublishAt.IsZero() {
+		// Accepted but not served until the embargo lifts
+		metrics.Inc("userguide_uploads_total", "result", "embargoed")
+		writeJSON(w, http.StatusAccepted, result)
+		return
+	}
+	log.Printf("Published %s (%d bytes, sha256 %s) from %s", result.Name, result.Size, result.SHA256, r.RemoteAddr)
+	metrics.Inc("userguide_uploads_total", "result", "published")
+	writeJSON(w, http.StatusCreated, result)
+}
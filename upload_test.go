@@ -0,0 +1,125 @@
+package userguide
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+
+	"userguide_api_poc/samples"
+)
+
+func TestParseDeclaredChecksums(t *testing.T) {
+	content := samples.Markdown("Quick Start")
+	md5Sum := md5.Sum(content)
+	shaSum := sha256.Sum256(content)
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantMD5    []byte
+		wantSHA256 []byte
+		wantErr    bool
+	}{
+		{name: "none", headers: map[string]string{}},
+		{name: "Content-MD5 base64", headers: map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:])}, wantMD5: md5Sum[:]},
+		// RFC 1864 only defines base64
+		{name: "Content-MD5 hex", headers: map[string]string{"Content-MD5": hex.EncodeToString(md5Sum[:])}, wantErr: true},
+		{name: "Content-MD5 truncated", headers: map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:8])}, wantErr: true},
+		{name: "Content-MD5 garbage", headers: map[string]string{"Content-MD5": "not base64!"}, wantErr: true},
+		{name: "SHA-256 hex", headers: map[string]string{ChecksumSHA256Header: hex.EncodeToString(shaSum[:])}, wantSHA256: shaSum[:]},
+		{name: "SHA-256 upper-case hex", headers: map[string]string{ChecksumSHA256Header: strings.ToUpper(hex.EncodeToString(shaSum[:]))}, wantSHA256: shaSum[:]},
+		{name: "SHA-256 base64", headers: map[string]string{ChecksumSHA256Header: base64.StdEncoding.EncodeToString(shaSum[:])}, wantSHA256: shaSum[:]},
+		{name: "SHA-256 short hex", headers: map[string]string{ChecksumSHA256Header: hex.EncodeToString(shaSum[:16])}, wantErr: true},
+		{name: "SHA-256 of MD5 length", headers: map[string]string{ChecksumSHA256Header: base64.StdEncoding.EncodeToString(md5Sum[:])}, wantErr: true},
+		{name: "SHA-256 garbage", headers: map[string]string{ChecksumSHA256Header: "zz"}, wantErr: true},
+		{
+			name: "both",
+			headers: map[string]string{
+				"Content-MD5":        base64.StdEncoding.EncodeToString(md5Sum[:]),
+				ChecksumSHA256Header: hex.EncodeToString(shaSum[:]),
+			},
+			wantMD5:    md5Sum[:],
+			wantSHA256: shaSum[:],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for name, value := range tt.headers {
+				h.Set(name, value)
+			}
+			declared, err := parseDeclaredChecksums(h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !bytes.Equal(declared.MD5, tt.wantMD5) || !bytes.Equal(declared.SHA256, tt.wantSHA256) {
+				t.Errorf("declared = %x / %x, want %x / %x", declared.MD5, declared.SHA256, tt.wantMD5, tt.wantSHA256)
+			}
+		})
+	}
+}
+
+func TestUploadChecksums(t *testing.T) {
+	content := samples.Markdown("Quick Start")
+	md5Sum := md5.Sum(content)
+	shaSum := sha256.Sum256(content)
+	otherSum := sha256.Sum256([]byte("another guide"))
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"no checksums", nil, http.StatusCreated},
+		{"Content-MD5", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:])}, http.StatusCreated},
+		{"SHA-256 hex", map[string]string{ChecksumSHA256Header: hex.EncodeToString(shaSum[:])}, http.StatusCreated},
+		{"SHA-256 base64", map[string]string{ChecksumSHA256Header: base64.StdEncoding.EncodeToString(shaSum[:])}, http.StatusCreated},
+		{"Content-MD5 mismatch", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(otherSum[:md5.Size])}, http.StatusUnprocessableEntity},
+		{"SHA-256 mismatch", map[string]string{ChecksumSHA256Header: hex.EncodeToString(otherSum[:])}, http.StatusUnprocessableEntity},
+		{
+			"one of two mismatched",
+			map[string]string{
+				"Content-MD5":        base64.StdEncoding.EncodeToString(md5Sum[:]),
+				ChecksumSHA256Header: base64.StdEncoding.EncodeToString(otherSum[:]),
+			},
+			http.StatusUnprocessableEntity,
+		},
+		{"malformed Content-MD5", map[string]string{"Content-MD5": hex.EncodeToString(md5Sum[:])}, http.StatusBadRequest},
+		{"malformed SHA-256", map[string]string{ChecksumSHA256Header: "sha256:" + hex.EncodeToString(shaSum[:])}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHarness(t, func(config *Config) {
+				config.UploadEnabled = true
+				config.UploadToken = "upload-token"
+			})
+			req, err := http.NewRequest(http.MethodPut, h.Server.URL+"/upload/quick-start.md", bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("build request: %v", err)
+			}
+			req.Header.Set("Authorization", "Bearer upload-token")
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := h.Server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("PUT: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if _, published := h.Storage.Content("quick-start.md"); published != (tt.want == http.StatusCreated) {
+				t.Errorf("guide published = %t after status %d", published, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+// Package userguidetest runs the user guide API for tests of code built on
+// it. NewServer wires the real routes and middlewares with NewApp, as the
+// userguide command does, over a testutil.FakeStorage, so clients, gateways
+// and SDKs can be tested against the service itself without guide files or
+// a deployment.
+package userguidetest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	userguide "userguide_api_poc"
+	"userguide_api_poc/samples"
+	"userguide_api_poc/testutil"
+)
+
+// Options adjusts the service started by NewServer
+type Options struct {
+	// Configure, when not nil, adjusts the configuration before the
+	// service is wired
+	Configure func(config *userguide.Config)
+	// Guides are stored by key before the service starts; without any, a
+	// sample user-guide.pdf is
+	Guides map[string][]byte
+}
+
+// Server is a running service. Storage holds its guides: add guides or
+// inject failures there while the test runs.
+type Server struct {
+	*httptest.Server
+	Config  *userguide.Config
+	Storage *testutil.FakeStorage
+	App     *userguide.App
+}
+
+// NewServer starts the service, serving user-guide.pdf by default.
+// Everything stops when the test ends. The service keeps some state in
+// the process, so tests using it must not run in parallel.
+func NewServer(tb testing.TB, opts Options) *Server {
+	tb.Helper()
+	config := userguide.DefaultConfig()
+	config.UserGuidePath = tb.TempDir()
+	config.UserGuideFile = "user-guide.pdf"
+	config.StorageType = "fake"
+	config.DiskCheckInterval = 0
+	if opts.Configure != nil {
+		opts.Configure(config)
+	}
+
+	store := testutil.NewFakeStorage(tb)
+	if len(opts.Guides) == 0 {
+		store.Add("user-guide.pdf", samples.PDF("User Guide"))
+	}
+	for key, content := range opts.Guides {
+		store.Add(key, content)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app, err := userguide.NewApp(ctx, config, store, userguide.NewBootReport(config))
+	if err != nil {
+		cancel()
+		tb.Fatalf("wire service: %v", err)
+	}
+	app.Start(ctx)
+
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = userguide.NewHTTPServer(config, app.Handler)
+	server.Start()
+	tb.Cleanup(func() {
+		server.Close()
+		cancel()
+		app.Close(context.Background())
+	})
+	return &Server{Server: server, Config: config, Storage: store, App: app}
+}
+
+// Get requests path, with the Authorization header when auth is not empty
+func (s *Server) Get(tb testing.TB, path, auth string) *http.Response {
+	tb.Helper()
+	return s.Do(tb, http.MethodGet, path, auth, nil)
+}
+
+// Do sends a request for path with body, which may be nil, and the
+// Authorization header when auth is not empty. The response body is closed
+// when the test ends.
+func (s *Server) Do(tb testing.TB, method, path, auth string, body []byte) *http.Response {
+	tb.Helper()
+	req, err := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		tb.Fatalf("build request: %v", err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		tb.Fatalf("%s %s: %v", method, path, err)
+	}
+	tb.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
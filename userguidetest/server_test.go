@@ -0,0 +1,66 @@
+package userguidetest_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	userguide "userguide_api_poc"
+	"userguide_api_poc/testutil"
+	"userguide_api_poc/userguidetest"
+)
+
+func TestNewServerServesUserGuide(t *testing.T) {
+	s := userguidetest.NewServer(t, userguidetest.Options{})
+
+	resp := s.Get(t, "/download/userguide", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, testutil.SamplePDF("User Guide")) {
+		t.Errorf("body is not the sample user guide (%d bytes)", len(body))
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="user-guide.pdf"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	s := userguidetest.NewServer(t, userguidetest.Options{
+		Configure: func(config *userguide.Config) {
+			config.UserGuideFile = "manual.pdf"
+			config.UploadEnabled = true
+			config.UploadToken = "upload-token"
+		},
+		Guides: map[string][]byte{"manual.pdf": testutil.SamplePDF("Manual")},
+	})
+
+	resp := s.Get(t, "/download/userguide", "")
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !bytes.Equal(body, testutil.SamplePDF("Manual")) {
+		t.Errorf("status = %d, want 200 with manual.pdf", resp.StatusCode)
+	}
+
+	upload := s.Do(t, http.MethodPut, "/upload/quick-start.md", "Bearer upload-token", testutil.SampleMarkdown("Quick Start"))
+	if upload.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, want 201", upload.StatusCode)
+	}
+	if content, ok := s.Storage.Content("quick-start.md"); !ok || !bytes.Equal(content, testutil.SampleMarkdown("Quick Start")) {
+		t.Errorf("upload not stored")
+	}
+}
+
+func TestNewServerStorageFailure(t *testing.T) {
+	s := userguidetest.NewServer(t, userguidetest.Options{})
+	s.Storage.Fail("Stat", errors.New("storage unreachable"))
+
+	if resp := s.Get(t, "/download/userguide", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+	s.Storage.Fail("Stat", nil)
+	if resp := s.Get(t, "/download/userguide", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("status after recovery = %d, want 200", resp.StatusCode)
+	}
+}
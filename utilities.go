@@ -1,20 +1,60 @@
-package main
+package userguide
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 )
 
 // Utils contains utility methods for file operations
-type Utils struct{}
+type Utils struct {
+	// policy overrides the default filename rules when set
+	policy *FilenamePolicy
+}
+
+// FilenamePolicy holds the deployment-tunable filename validation rules.
+// Path separators, ".." sequences, null bytes and control characters are
+// always rejected whatever the policy says.
+type FilenamePolicy struct {
+	Pattern           *regexp.Regexp
+	MaxLength         int
+	DangerousPatterns []string
+	// Exclude holds glob patterns (e.g. *.tmp, ~$*) for editor droppings and
+	// partial files that are never listed, published or served
+	Exclude []string
+}
+
+// defaultFilenamePolicy returns the strict built-in filename rules
+func defaultFilenamePolicy() FilenamePolicy {
+	return FilenamePolicy{
+		Pattern:           regexp.MustCompile(`^[a-zA-Z0-9._-]+$`),
+		MaxLength:         255,
+		DangerousPatterns: []string{"..", "~/", "/", "\\", ":", "*", "?", "\"", "<", ">", "|"},
+		Exclude:           []string{"*.tmp", "*.temp", "*.partial", "*.part", "*.swp", "*~", "~$*", ".DS_Store", "Thumbs.db", "desktop.ini"},
+	}
+}
+
+// mandatoryPatterns can never be allowed by a policy
+var mandatoryPatterns = []string{"..", "/", "\\"}
+
+var builtinFilenamePolicy = defaultFilenamePolicy()
+
+func (u *Utils) filenamePolicy() *FilenamePolicy {
+	if u.policy != nil {
+		return u.policy
+	}
+	return &builtinFilenamePolicy
+}
 
 // ValidateFilename validates filename for security
 func (u *Utils) ValidateFilename(filename string) (string, error) {
+	policy := u.filenamePolicy()
+
 	// URL decode the filename first
 	decodedFilename, err := url.QueryUnescape(filename)
 	if err != nil {
@@ -32,23 +72,23 @@ func (u *Utils) ValidateFilename(filename string) (string, error) {
 		}
 	}
 
-	// Strict filename pattern validation
-	filenamePattern := regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
-	if !filenamePattern.MatchString(decodedFilename) {
+	// Filename pattern validation
+	if !policy.Pattern.MatchString(decodedFilename) {
 		return "", fmt.Errorf("filename contains invalid characters")
 	}
 
 	// Check filename length
-	if len(decodedFilename) > 255 {
+	if len(decodedFilename) > policy.MaxLength {
 		return "", fmt.Errorf("filename too long")
 	}
 
 	// Prevent dangerous patterns
-	dangerousPatterns := []string{"..", "~/", "/", "\\", ":", "*", "?", "\"", "<", ">", "|"}
 	lowerFilename := strings.ToLower(decodedFilename)
-	for _, pattern := range dangerousPatterns {
-		if strings.Contains(lowerFilename, pattern) {
-			return "", fmt.Errorf("dangerous pattern detected in filename: %s", pattern)
+	for _, patterns := range [][]string{mandatoryPatterns, policy.DangerousPatterns} {
+		for _, pattern := range patterns {
+			if strings.Contains(lowerFilename, pattern) {
+				return "", fmt.Errorf("dangerous pattern detected in filename: %s", pattern)
+			}
 		}
 	}
 
@@ -56,45 +96,92 @@ func (u *Utils) ValidateFilename(filename string) (string, error) {
 	if cleanFilename == "" || cleanFilename == "." || cleanFilename == ".." {
 		return "", fmt.Errorf("invalid filename after sanitization")
 	}
+	// Dot files are never guides: storages hide them from listings and the
+	// guide directory keeps its manifests under such names
+	if strings.HasPrefix(cleanFilename, ".") {
+		return "", fmt.Errorf("hidden files not allowed")
+	}
+	if pattern, ok := policy.excludedBy(cleanFilename); ok {
+		return "", fmt.Errorf("filename matches exclusion pattern: %s", pattern)
+	}
 
 	return cleanFilename, nil
 }
 
-// IsAllowedExtension checks if file extension is allowed
-func (u *Utils) IsAllowedExtension(filename string) bool {
-	allowedExtensions := []string{".pdf", ".doc", ".docx", ".txt", ".md"}
-	ext := strings.ToLower(filepath.Ext(filename))
+// IsExcluded reports whether the last element of name is a dot file or
+// matches an exclusion pattern; listings skip such files
+func (u *Utils) IsExcluded(name string) bool {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") {
+		return true
+	}
+	_, excluded := u.filenamePolicy().excludedBy(base)
+	return excluded
+}
 
-	for _, allowedExt := range allowedExtensions {
-		if ext == allowedExt {
-			return true
+// excludedBy returns the exclusion pattern matching a file name, ignoring case
+func (p *FilenamePolicy) excludedBy(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	for _, pattern := range p.Exclude {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), lower); ok {
+			return pattern, true
 		}
 	}
-	return false
+	return "", false
 }
 
-// IsFileSecure validates file exists and is within allowed directory
-func (u *Utils) IsFileSecure(fullPath, basePath string) bool {
-	fileInfo, err := os.Stat(fullPath)
-	if err != nil {
-		return false
+// parseExcludePatterns splits and checks a list of exclusion globs
+func parseExcludePatterns(value string) ([]string, error) {
+	patterns := splitList(value)
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
 	}
+	return patterns, nil
+}
+
+// parseFilenamePattern compiles a filename pattern, anchoring it so it must
+// match the whole name
+func parseFilenamePattern(value string) (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + value + `)$`)
+}
 
-	if fileInfo.IsDir() {
-		return false
+// ValidateProductName validates a product identifier used as a directory name
+func (u *Utils) ValidateProductName(product string) error {
+	if !productPattern.MatchString(product) {
+		return fmt.Errorf("invalid product name")
 	}
+	return nil
+}
 
-	absBasePath, err := filepath.Abs(basePath)
-	if err != nil {
-		return false
+// ValidateReleaseName validates a firmware release identifier
+func (u *Utils) ValidateReleaseName(release string) error {
+	if !releasePattern.MatchString(release) {
+		return fmt.Errorf("invalid release")
 	}
+	return nil
+}
 
-	absFilePath, err := filepath.Abs(fullPath)
-	if err != nil {
-		return false
+// productPattern matches product identifiers
+var productPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// IsAllowedExtension checks if file extension is allowed
+func (u *Utils) IsAllowedExtension(filename string) bool {
+	allowedExtensions := []string{".pdf", ".doc", ".docx", ".txt", ".md"}
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	for _, allowedExt := range allowedExtensions {
+		if ext == allowedExt {
+			return true
+		}
 	}
+	return false
+}
 
-	return strings.HasPrefix(absFilePath, absBasePath+string(filepath.Separator)) || absFilePath == absBasePath
+// isWithin reports whether path is dir or lies below it
+func isWithin(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator)) || path == dir
 }
 
 // GetContentType returns appropriate content type for file extension
@@ -127,20 +214,22 @@ func (u *Utils) EscapeForHeader(str string) string {
 	return strings.ReplaceAll(str, "\"", "\\\"")
 }
 
-// Security middleware
-func securityMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, "/") {
-			http.NotFound(w, r)
-			return
-		}
-
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "DENY")
-		w.Header().Set("X-XSS-Protection", "1; mode=block")
-		w.Header().Set("Cache-Control", "public, max-age=3600")
-		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+// ClientIP returns the remote IP address of the request without the port,
+// or the client behind a trusted proxy as resolved by IPFilter
+func (u *Utils) ClientIP(r *http.Request) string {
+	if ip := clientIPFromContext(r.Context()); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-		next.ServeHTTP(w, r)
-	})
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
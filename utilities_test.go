@@ -0,0 +1,105 @@
+package userguide
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"userguide_api_poc/samples"
+)
+
+// TestExclusionPolicy checks that dot files and names matching an exclusion
+// pattern stay out of listings, the manifest and replication, and are never
+// served, while other guides of the same product are
+func TestExclusionPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		excluded bool
+	}{
+		{"setup.pdf", false},
+		{"~$setup.pdf", true},
+		{".draft.pdf", true},
+		{".DS_Store.pdf", true},
+		{"draft-setup.pdf", true},
+		{"DRAFT-notes.pdf", true},
+		{"notes.pdf", false},
+	}
+
+	var guides []string
+	for _, tt := range tests {
+		guides = append(guides, "acme/"+tt.name)
+	}
+	h := newTestHarness(t, func(config *Config) {
+		config.ProductsEnabled = true
+		config.FilenamePolicy.Exclude = append(config.FilenamePolicy.Exclude, "draft-*")
+		writeChecksumManifest(t, config.UserGuidePath, guides)
+	})
+	for _, name := range guides {
+		h.Storage.Add(name, samples.PDF(name))
+	}
+
+	listed := make(map[string]bool)
+	var page catalogPage
+	resp := h.Get(t, "/guides", "")
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /guides: status = %d, decode: %v", resp.StatusCode, err)
+	}
+	for _, entry := range page.Guides {
+		listed[entry.Name] = true
+	}
+
+	inManifest := make(map[string]bool)
+	var manifest struct {
+		Guides []manifestEntry `json:"guides"`
+	}
+	resp = h.Get(t, "/manifest", "")
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /manifest: status = %d, decode: %v", resp.StatusCode, err)
+	}
+	for _, entry := range manifest.Guides {
+		inManifest[entry.Name] = true
+	}
+
+	// A secondary holding nothing is sent every guide that may be synced
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{})
+	}))
+	defer secondary.Close()
+	config := *h.Config
+	config.ReplicationTargets = []string{secondary.URL}
+	checksums, err := NewChecksumStore(config.UserGuidePath, NewLocker(&config))
+	if err != nil {
+		t.Fatalf("load checksums: %v", err)
+	}
+	rep := NewReplicator(&config, checksums)
+	if err := rep.Resync(context.Background()); err != nil {
+		t.Fatalf("resync: %v", err)
+	}
+	synced := make(map[string]bool)
+	for _, item := range rep.targets[0].pending {
+		synced[item.name] = true
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "acme/" + tt.name
+			if listed[name] == tt.excluded {
+				t.Errorf("listed = %v, want %v", listed[name], !tt.excluded)
+			}
+			if inManifest[name] == tt.excluded {
+				t.Errorf("in manifest = %v, want %v", inManifest[name], !tt.excluded)
+			}
+			if synced[name] == tt.excluded {
+				t.Errorf("synced = %v, want %v", synced[name], !tt.excluded)
+			}
+			resp := h.Get(t, "/products/acme/guides/"+url.PathEscape(tt.name), "")
+			resp.Body.Close()
+			if served := resp.StatusCode == http.StatusOK; served == tt.excluded {
+				t.Errorf("download status = %d, served = %v, want %v", resp.StatusCode, served, !tt.excluded)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package userguide
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// ParamSource identifies where a validated parameter is read from
+type ParamSource string
+
+// Parameter sources supported by ParamRule
+const (
+	QueryParam  ParamSource = "query"
+	HeaderParam ParamSource = "header"
+	PathParam   ParamSource = "path"
+)
+
+// ParamType is the expected type of a parameter value
+type ParamType string
+
+// Parameter types supported by ParamRule
+const (
+	StringType ParamType = "string"
+	IntType    ParamType = "int"
+	BoolType   ParamType = "bool"
+)
+
+// ParamRule declares the constraints for a single request parameter
+type ParamRule struct {
+	Source    ParamSource
+	Name      string
+	Required  bool
+	Type      ParamType
+	Pattern   *regexp.Regexp
+	MaxLength int
+}
+
+// ValidationError describes one parameter that failed validation
+type ValidationError struct {
+	Source  ParamSource `json:"source"`
+	Name    string      `json:"name"`
+	Message string      `json:"message"`
+}
+
+// ValidationResponse is the structured body returned for rejected requests
+type ValidationResponse struct {
+	Error   string            `json:"error"`
+	Details []ValidationError `json:"details"`
+}
+
+// Validate wraps a handler with the given declarative parameter rules
+func Validate(handler http.HandlerFunc, rules ...ParamRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var details []ValidationError
+		for _, rule := range rules {
+			if msg := rule.check(r); msg != "" {
+				details = append(details, ValidationError{Source: rule.Source, Name: rule.Name, Message: msg})
+			}
+		}
+
+		if len(details) > 0 {
+			writeJSON(w, http.StatusBadRequest, ValidationResponse{Error: "validation_failed", Details: details})
+			return
+		}
+
+		handler(w, r)
+	})
+}
+
+// check returns a message describing why the rule failed, or "" if it passed
+func (rule ParamRule) check(r *http.Request) string {
+	value, present := rule.lookup(r)
+	if !present || value == "" {
+		if rule.Required {
+			return "is required"
+		}
+		return ""
+	}
+
+	if rule.MaxLength > 0 && len(value) > rule.MaxLength {
+		return fmt.Sprintf("must be at most %d characters", rule.MaxLength)
+	}
+
+	switch rule.Type {
+	case IntType:
+		if _, err := strconv.Atoi(value); err != nil {
+			return "must be an integer"
+		}
+	case BoolType:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be a boolean"
+		}
+	}
+
+	if rule.Pattern != nil && !rule.Pattern.MatchString(value) {
+		return "has an invalid format"
+	}
+
+	return ""
+}
+
+func (rule ParamRule) lookup(r *http.Request) (string, bool) {
+	switch rule.Source {
+	case QueryParam:
+		values, ok := r.URL.Query()[rule.Name]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	case HeaderParam:
+		values := r.Header.Values(rule.Name)
+		if len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	case PathParam:
+		value, ok := mux.Vars(r)[rule.Name]
+		return value, ok
+	}
+	return "", false
+}
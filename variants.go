@@ -0,0 +1,92 @@
+package userguide
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// DeviceVariantHeader reports which device variant of a guide was served
+const DeviceVariantHeader = "X-Guide-Device-Variant"
+
+// Device variants chosen from client hints; any other name can still be
+// requested with ?variant=
+const (
+	DeviceVariantDefault = "default"
+	DeviceVariantMobile  = "mobile"
+	DeviceVariantLite    = "lite"
+)
+
+// deviceHintHeaders are the client hints variant selection depends on
+const deviceHintHeaders = "Sec-CH-UA-Mobile, Save-Data, ECT"
+
+// DeviceVariants maps a guide name (file name, or product/name) to its
+// variants by variant name, e.g. "user-guide.pdf" -> "mobile" -> "user-guide-mobile.pdf"
+type DeviceVariants map[string]map[string]string
+
+// Select returns the variant a request asks for: ?variant= first, then a
+// low-bandwidth variant for Save-Data or a slow connection, then a mobile
+// variant for mobile browsers. It returns "" for the default.
+func (dv DeviceVariants) Select(r *http.Request, guide string) string {
+	variants := dv[guide]
+	if requested := r.URL.Query().Get("variant"); requested != "" {
+		if _, ok := variants[requested]; ok {
+			return requested
+		}
+		return ""
+	}
+	ect := r.Header.Get("ECT")
+	if _, ok := variants[DeviceVariantLite]; ok && (strings.EqualFold(r.Header.Get("Save-Data"), "on") || ect == "slow-2g" || ect == "2g") {
+		return DeviceVariantLite
+	}
+	if _, ok := variants[DeviceVariantMobile]; ok && r.Header.Get("Sec-CH-UA-Mobile") == "?1" {
+		return DeviceVariantMobile
+	}
+	return ""
+}
+
+// withDeviceVariant returns the path of the variant of guide the client
+// asked for, resolved through resolve, or filePath for the default variant
+// and for variants that cannot be served
+func (fh *FileHandler) withDeviceVariant(w http.ResponseWriter, r *http.Request, guide, filePath string, resolve func(filename string) (string, error)) string {
+	if len(fh.variants[guide]) == 0 {
+		return filePath
+	}
+	w.Header().Set("Accept-CH", deviceHintHeaders)
+	w.Header().Add("Vary", deviceHintHeaders)
+	w.Header().Set(DeviceVariantHeader, DeviceVariantDefault)
+
+	variant := fh.variants.Select(r, guide)
+	if variant == "" {
+		return filePath
+	}
+	variantPath, err := resolve(fh.variants[guide][variant])
+	if err != nil {
+		log.Printf("Variant %s of %s unavailable, serving default: %s", variant, guide, err.Error())
+		metrics.Inc("userguide_device_variant_fallbacks_total", "variant", variant)
+		return filePath
+	}
+	w.Header().Set(DeviceVariantHeader, variant)
+	metrics.Inc("userguide_device_variant_downloads_total", "variant", variant)
+	return variantPath
+}
+
+// parseVariantProperty applies a variant.<variant>.<guide> property
+func parseVariantProperty(config *Config, key, value string) error {
+	variant, guide, ok := strings.Cut(key, ".")
+	if !ok || variant == "" || guide == "" {
+		return fmt.Errorf("expected variant.<variant>.<guide>")
+	}
+	if variant == DeviceVariantDefault {
+		return fmt.Errorf("%q is the guide itself", DeviceVariantDefault)
+	}
+	if strings.ContainsAny(value, "/\\") {
+		return fmt.Errorf("variant must be a file next to the guide")
+	}
+	if config.DeviceVariants[guide] == nil {
+		config.DeviceVariants[guide] = make(map[string]string)
+	}
+	config.DeviceVariants[guide][variant] = value
+	return nil
+}
@@ -0,0 +1,307 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vault authentication methods
+const (
+	VaultAuthToken   = "token"
+	VaultAuthAppRole = "approle"
+)
+
+// vaultReferencePrefix marks a property whose value is a Vault secret
+// field, @vault:<path>#<field>, such as @vault:secret/data/userguide#admin_token
+const vaultReferencePrefix = "@vault:"
+
+const (
+	// vaultResolveTimeout bounds reading the secrets of one configuration
+	vaultResolveTimeout = 30 * time.Second
+	// vaultMinRenewInterval keeps short-lived tokens from renewing in a loop
+	vaultMinRenewInterval = 5 * time.Second
+)
+
+// vaultSession is the Vault client of the current vault.* settings, kept
+// across configuration reloads so it logs in and renews its token once
+var vaultSession struct {
+	mu       sync.Mutex
+	settings string
+	client   *vaultClient
+}
+
+// applyVaultReferences reads the Vault secrets named by the values of keys
+// and applies them to config, which already holds the other properties
+// including the vault.* settings. Each secret path is read once.
+func applyVaultReferences(config *Config, props map[string]string, keys []string) error {
+	client, err := vaultClientFor(config)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vaultResolveTimeout)
+	defer cancel()
+
+	secrets := make(map[string]map[string]interface{})
+	for _, key := range keys {
+		path, field, ok := strings.Cut(strings.TrimPrefix(props[key], vaultReferencePrefix), "#")
+		if !ok {
+			field = "value"
+		}
+		path = strings.Trim(path, "/")
+		data, ok := secrets[path]
+		if !ok {
+			if data, err = client.Secret(ctx, path); err != nil {
+				return fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+			secrets[path] = data
+		}
+		value, ok := data[field]
+		if !ok {
+			return fmt.Errorf("invalid value for %s: vault secret %s has no field %q", key, path, field)
+		}
+		if err := applyProperty(config, key, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	metrics.Set("userguide_vault_resolved_properties", float64(len(keys)))
+	return nil
+}
+
+// vaultClientFor returns the client for the vault.* settings, logging in
+// when they are new
+func vaultClientFor(config *Config) (*vaultClient, error) {
+	if config.VaultAddress == "" {
+		return nil, fmt.Errorf("properties reference Vault but vault.address is not set")
+	}
+	settings := fmt.Sprint(config.VaultAddress, config.VaultNamespace, config.VaultAuth, config.VaultToken,
+		config.VaultRoleID, config.VaultAppRoleSecret, config.VaultAppRoleMount)
+	vaultSession.mu.Lock()
+	defer vaultSession.mu.Unlock()
+	if vaultSession.client != nil && vaultSession.settings == settings {
+		return vaultSession.client, nil
+	}
+
+	vc := &vaultClient{
+		address:   strings.TrimSuffix(config.VaultAddress, "/"),
+		namespace: config.VaultNamespace,
+		auth:      config.VaultAuth,
+		roleID:    config.VaultRoleID,
+		secretID:  config.VaultAppRoleSecret,
+		mount:     config.VaultAppRoleMount,
+		token:     config.VaultToken,
+		client:    NewHTTPClient(config, 0),
+		stop:      make(chan struct{}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vaultResolveTimeout)
+	defer cancel()
+	if err := vc.login(ctx); err != nil {
+		return nil, err
+	}
+	if vaultSession.client != nil {
+		close(vaultSession.client.stop)
+	}
+	vaultSession.client, vaultSession.settings = vc, settings
+	go vc.renewLoop()
+	log.Printf("Vault session at %s (%s auth, token TTL %s, renewable %t)", vc.address, vc.auth, vc.ttl, vc.renewable)
+	return vc, nil
+}
+
+// vaultClient reads secrets from Vault over its HTTP API and keeps its
+// token alive
+type vaultClient struct {
+	address   string
+	namespace string
+	auth      string
+	roleID    string
+	secretID  string
+	mount     string
+	client    *http.Client
+	stop      chan struct{}
+
+	mu        sync.Mutex
+	token     string
+	ttl       time.Duration
+	renewable bool
+}
+
+// vaultAuth is the auth block of login and renewal responses
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int64  `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// login obtains a token with AppRole, or looks up the configured token to
+// learn when it expires
+func (vc *vaultClient) login(ctx context.Context) error {
+	switch vc.auth {
+	case VaultAuthAppRole:
+		var resp struct {
+			Auth vaultAuth `json:"auth"`
+		}
+		body := map[string]string{"role_id": vc.roleID, "secret_id": vc.secretID}
+		if err := vc.do(ctx, http.MethodPost, "auth/"+vc.mount+"/login", body, &resp); err != nil {
+			return fmt.Errorf("vault approle login: %v", err)
+		}
+		vc.setToken(resp.Auth)
+	case VaultAuthToken:
+		var resp struct {
+			Data struct {
+				TTL       int64 `json:"ttl"`
+				Renewable bool  `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := vc.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &resp); err != nil {
+			return fmt.Errorf("vault token lookup: %v", err)
+		}
+		vc.mu.Lock()
+		vc.ttl, vc.renewable = time.Duration(resp.Data.TTL)*time.Second, resp.Data.Renewable
+		vc.mu.Unlock()
+	default:
+		return fmt.Errorf("unknown vault.auth %q", vc.auth)
+	}
+	return nil
+}
+
+func (vc *vaultClient) setToken(auth vaultAuth) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if auth.ClientToken != "" {
+		vc.token = auth.ClientToken
+	}
+	vc.ttl, vc.renewable = time.Duration(auth.LeaseDuration)*time.Second, auth.Renewable
+}
+
+// renewLoop renews the token at half its TTL. When renewal fails or the
+// token reaches its maximum TTL, AppRole logs in again; a configured token
+// cannot be replaced and is reported through health until it is.
+func (vc *vaultClient) renewLoop() {
+	for {
+		vc.mu.Lock()
+		ttl := vc.ttl
+		vc.mu.Unlock()
+		if ttl == 0 {
+			// Root and other non-expiring tokens need no renewal
+			return
+		}
+		select {
+		case <-vc.stop:
+			return
+		case <-time.After(max(ttl/2, vaultMinRenewInterval)):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), vaultResolveTimeout)
+		err := vc.renew(ctx)
+		if err != nil && vc.auth == VaultAuthAppRole {
+			log.Printf("Vault token renewal failed, logging in again: %s", err.Error())
+			err = vc.login(ctx)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Vault token renewal failed: %s", err.Error())
+			metrics.Inc("userguide_vault_renewals_total", "result", "failed")
+			health.Set("vault", StatusDegraded, err.Error())
+			vc.mu.Lock()
+			vc.ttl = max(vc.ttl/2, vaultMinRenewInterval)
+			vc.mu.Unlock()
+			continue
+		}
+		metrics.Inc("userguide_vault_renewals_total", "result", "renewed")
+		health.Set("vault", StatusHealthy, "")
+	}
+}
+
+// renew extends the token's lease; a token that is not renewable, or came
+// back with less time than it had, is at its maximum TTL
+func (vc *vaultClient) renew(ctx context.Context) error {
+	vc.mu.Lock()
+	renewable, before := vc.renewable, vc.ttl
+	vc.mu.Unlock()
+	if !renewable {
+		return fmt.Errorf("token is not renewable")
+	}
+	var resp struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	if err := vc.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{}, &resp); err != nil {
+		return err
+	}
+	vc.setToken(resp.Auth)
+	if time.Duration(resp.Auth.LeaseDuration)*time.Second < before/2 {
+		return fmt.Errorf("token is close to its maximum TTL")
+	}
+	return nil
+}
+
+// Secret reads the fields of the secret at path. Version 2 KV mounts
+// (paths with /data/) nest the fields one level deeper than version 1.
+func (vc *vaultClient) Secret(ctx context.Context, path string) (map[string]interface{}, error) {
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err := vc.do(ctx, http.MethodGet, path, nil, &resp)
+	if err != nil && vc.auth == VaultAuthAppRole && strings.Contains(err.Error(), "403") {
+		// The token may have expired between renewals
+		if err = vc.login(ctx); err == nil {
+			err = vc.do(ctx, http.MethodGet, path, nil, &resp)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("vault secret %s: %v", path, err)
+	}
+	if nested, ok := resp.Data["data"].(map[string]interface{}); ok && resp.Data["metadata"] != nil {
+		return nested, nil
+	}
+	return resp.Data, nil
+}
+
+// do calls the Vault API at /v1/<path>
+func (vc *vaultClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, vc.address+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	vc.mu.Lock()
+	token := vc.token
+	vc.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if vc.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return fmt.Errorf("%s %s returned %s %s", method, path, resp.Status, strings.Join(failure.Errors, "; "))
+	}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
@@ -0,0 +1,266 @@
+package userguide
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventGuideInfected is the alert published when a staged guide carries malware
+const EventGuideInfected = "guide.infected"
+
+// ErrScanUnavailable is returned when the virus scanner cannot give a verdict
+var ErrScanUnavailable = errors.New("virus scan unavailable")
+
+// ScanResult is the verdict of a virus scanner on one file
+type ScanResult struct {
+	Infected bool
+	// Signature names what was found in an infected file
+	Signature string
+}
+
+// Scanner checks a file for malware. Implementations return an error only
+// when they could not reach a verdict. ClamAV and ICAP are built in; other
+// engines are added with RegisterScanner.
+type Scanner interface {
+	Scan(ctx context.Context, path string) (ScanResult, error)
+}
+
+// ScannerFactory builds a scanner from configuration
+type ScannerFactory func(config *Config) (Scanner, error)
+
+// Built-in scanner engines
+const (
+	ScannerClamAV = "clamav"
+)
+
+var (
+	scannersMu sync.RWMutex
+	scanners   = map[string]ScannerFactory{
+		ScannerClamAV: newClamAVScanner,
+	}
+)
+
+// RegisterScanner makes a custom engine selectable with scan.engine. Call it
+// from an init function in the file that implements it.
+func RegisterScanner(name string, factory ScannerFactory) {
+	scannersMu.Lock()
+	defer scannersMu.Unlock()
+	scanners[name] = factory
+}
+
+// VirusScan runs the configured scanner on every staged guide. Infected
+// guides are moved to the quarantine directory with a report beside them
+// and announced with a guide.infected event.
+type VirusScan struct {
+	engine     string
+	scanner    Scanner
+	quarantine string
+	failOpen   bool
+	// approval requires a second operator to release a quarantined guide
+	approval bool
+
+	// mu serializes changes to quarantined guides and their reports
+	mu sync.Mutex
+}
+
+// NewVirusScan creates the scan for scan.engine; it returns nil when no
+// engine is configured
+func NewVirusScan(config *Config) (*VirusScan, error) {
+	if config.ScanEngine == "" {
+		return nil, nil
+	}
+	scannersMu.RLock()
+	factory, ok := scanners[config.ScanEngine]
+	scannersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown scan engine %q", config.ScanEngine)
+	}
+	scanner, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+	quarantine := config.QuarantinePath
+	if quarantine == "" {
+		quarantine = filepath.Join(config.UserGuidePath, ".quarantine")
+	}
+	if err := os.MkdirAll(quarantine, 0o750); err != nil {
+		return nil, fmt.Errorf("unable to create quarantine directory: %v", err)
+	}
+	return &VirusScan{
+		engine:     config.ScanEngine,
+		scanner:    scanner,
+		quarantine: quarantine,
+		failOpen:   config.ScanFailOpen,
+		approval:   config.QuarantineApproval,
+	}, nil
+}
+
+// QuarantineReport is written next to a quarantined file as <file>.json
+type QuarantineReport struct {
+	Guide     string    `json:"guide"`
+	Engine    string    `json:"engine"`
+	Signature string    `json:"signature"`
+	Time      time.Time `json:"time"`
+	Size      int64     `json:"size"`
+	// Release is the pending request to publish the guide anyway
+	Release *QuarantineRelease `json:"release,omitempty"`
+}
+
+// Check is a StagedCheck scanning the staged file
+func (vs *VirusScan) Check(ctx context.Context, name, path string) error {
+	if id := releasedFromQuarantine(ctx); id != "" {
+		log.Printf("Publishing %s unscanned, released from quarantine %s", name, id)
+		metrics.Inc("userguide_virus_scans_total", "engine", vs.engine, "result", "released")
+		return nil
+	}
+	start := time.Now()
+	result, err := vs.scanner.Scan(ctx, path)
+	metrics.Observe("userguide_virus_scan_duration_seconds", time.Since(start).Seconds(), "engine", vs.engine)
+	if err != nil {
+		metrics.Inc("userguide_virus_scans_total", "engine", vs.engine, "result", "error")
+		if vs.failOpen {
+			log.Printf("Warning: publishing %s unscanned: %s", name, err.Error())
+			return nil
+		}
+		return fmt.Errorf("%w: %v", ErrScanUnavailable, err)
+	}
+	if !result.Infected {
+		metrics.Inc("userguide_virus_scans_total", "engine", vs.engine, "result", "clean")
+		return nil
+	}
+
+	metrics.Inc("userguide_virus_scans_total", "engine", vs.engine, "result", "infected")
+	quarantined, err := vs.quarantineFile(name, path, result)
+	if err != nil {
+		log.Printf("Unable to quarantine %s: %s", name, err.Error())
+	}
+	log.Printf("ALERT: %s is infected with %s, quarantined as %s", name, result.Signature, quarantined)
+	events.Publish(Event{Type: EventGuideInfected, Subject: name, Data: map[string]string{
+		"signature":  result.Signature,
+		"engine":     vs.engine,
+		"quarantine": filepath.Base(quarantined),
+	}})
+	return fmt.Errorf("%w: %s is infected (%s)", ErrRejectedContent, name, result.Signature)
+}
+
+// quarantineFile moves an infected staged file out of the publish path,
+// readable only by the service, and writes its report
+func (vs *VirusScan) quarantineFile(name, path string, result ScanResult) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	stamp := time.Now().UTC()
+	target := filepath.Join(vs.quarantine, stamp.Format("20060102T150405.000000000")+"-"+strings.ReplaceAll(name, "/", "_"))
+	if err := os.Rename(path, target); err != nil {
+		return "", err
+	}
+	os.Chmod(target, 0o600)
+	report, _ := json.MarshalIndent(QuarantineReport{
+		Guide:     name,
+		Engine:    vs.engine,
+		Signature: result.Signature,
+		Time:      stamp,
+		Size:      info.Size(),
+	}, "", "  ")
+	return target, os.WriteFile(target+".json", report, 0o600)
+}
+
+// clamAVScanner streams files to clamd with the INSTREAM command
+type clamAVScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// clamAVChunkSize is the size of the chunks files are streamed to clamd in
+const clamAVChunkSize = 64 * 1024
+
+// newClamAVScanner connects to scan.clamd.address: unix:/path/clamd.sock or
+// tcp:host:port (a bare host:port is TCP)
+func newClamAVScanner(config *Config) (Scanner, error) {
+	network, address, ok := strings.Cut(config.ClamdAddress, ":")
+	switch {
+	case ok && network == "unix", ok && network == "tcp":
+	case config.ClamdAddress != "":
+		network, address = "tcp", config.ClamdAddress
+	default:
+		return nil, fmt.Errorf("scan.engine=clamav requires scan.clamd.address")
+	}
+	return &clamAVScanner{network: network, address: address, timeout: config.ScanTimeout}, nil
+}
+
+func (cs *clamAVScanner) Scan(ctx context.Context, path string) (ScanResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, cs.timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, cs.network, cs.address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("clamd: %v", err)
+	}
+	chunk := make([]byte, 4+clamAVChunkSize)
+	for {
+		n, readErr := file.Read(chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				// clamd hangs up once the stream passes its StreamMaxLength;
+				// its reply says so
+				break
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, readErr
+		}
+	}
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil && len(reply) == 0 {
+		return ScanResult{}, fmt.Errorf("clamd: %v", err)
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply reads "stream: OK", "stream: <signature> FOUND" or
+// "<message> ERROR"
+func parseClamdReply(reply string) (ScanResult, error) {
+	verdict := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
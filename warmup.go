@@ -0,0 +1,87 @@
+package userguide
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// ready is true once warm-up has finished and until shutdown begins
+var ready atomic.Bool
+
+// runWarmUp prepares caches before the listener accepts traffic: it hashes
+// every guide in guides and the protected guides so version checks and blob
+// lookups answer from memory, fetching remote guides into their cache, and
+// maps the configured default guide when memory-mapped serving is enabled.
+// Warm-up stops early, leaving the rest to happen on demand, when ctx ends.
+func runWarmUp(ctx context.Context, config *Config, guides Storage, fh *FileHandler) {
+	start := time.Now()
+	hashed := 0
+	stores := []Storage{guides}
+	names := []string{describeStorage(config, guides)}
+	if config.ProtectedPath != "" {
+		stores = append(stores, NewLocalStorage(config.ProtectedPath, config.FollowSymlinks))
+		names = append(names, config.ProtectedPath)
+	}
+	for i, store := range stores {
+		objects, err := store.List(ctx, "")
+		if err != nil {
+			log.Printf("Warm-up of %s incomplete: %s", names[i], err.Error())
+			break
+		}
+		for _, object := range objects {
+			if ctx.Err() != nil {
+				break
+			}
+			name := path.Base(object.Key)
+			if fh.utils.IsExcluded(name) || !fh.utils.IsAllowedExtension(name) {
+				continue
+			}
+			// Handlers look versions up by the path the file service returns
+			filePath, err := storagePath(ctx, store, object.Key)
+			if err != nil {
+				log.Printf("Warm-up could not read %s: %s", object.Key, err.Error())
+				continue
+			}
+			if _, err := fh.versions.Version(filePath); err != nil {
+				log.Printf("Warm-up could not hash %s: %s", object.Key, err.Error())
+				continue
+			}
+			hashed++
+		}
+		if ctx.Err() != nil {
+			log.Printf("Warm-up of %s incomplete: %s", names[i], ctx.Err().Error())
+			break
+		}
+	}
+
+	primed := false
+	if fileServer.hotFiles != nil {
+		if guidePath, err := fh.fileService.DownloadUserGuide(); err == nil {
+			if info, err := os.Stat(guidePath); err == nil {
+				primed = fileServer.hotFiles.Prime(guidePath, info)
+			}
+		}
+	}
+
+	elapsed := time.Since(start)
+	metrics.Set("userguide_warmup_duration_seconds", elapsed.Seconds())
+	metrics.Set("userguide_warmup_guides_hashed", float64(hashed))
+	log.Printf("Warm-up finished in %s: %d guides hashed, default guide mapped: %t", elapsed.Round(time.Millisecond), hashed, primed)
+}
+
+// ReadinessHandler answers 200 once the instance has warmed up and 503
+// before that, while a storage swap indexes new guides and while shutting
+// down
+func (fh *FileHandler) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready.Load() || reindexing.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]bool{"ready": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"ready": true})
+}